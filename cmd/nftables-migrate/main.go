@@ -0,0 +1,76 @@
+// nftables-migrate converts the output of `ipset save` and the `-m set` rules of `iptables-save` and
+// `ip6tables-save` into a script of `nft -f`, or into the Corefile rules of coredns-nftables adding answers into
+// the converted sets. Everything which can not be converted is printed to stderr.
+//
+//	nftables-migrate -ipset ipset.save -iptables iptables.save [-ip6tables ip6tables.save] [-table coredns_migrated] [-output nft/corefile]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/nftables"
+)
+
+func main() {
+	ipset := flag.String("ipset", "", "the file written by `ipset save`, - is stdin")
+	iptables := flag.String("iptables", "", "the file written by `iptables-save`, - is stdin")
+	ip6tables := flag.String("ip6tables", "", "the file written by `ip6tables-save`, - is stdin")
+	table := flag.String("table", "coredns_migrated", "the name of the nftables tables")
+	output := flag.String("output", "nft", "print the nft script(nft) or the Corefile rules(corefile)")
+	flag.Parse()
+
+	if len(*ipset) == 0 {
+		fmt.Fprintln(os.Stderr, "-ipset is required")
+		os.Exit(2)
+	}
+	migration := NewNftablesMigration(*table)
+	err := readInput(*ipset, migration.ParseIpsetSave)
+	if err == nil && len(*iptables) > 0 {
+		err = readInput(*iptables, func(reader io.Reader) error {
+			return migration.ParseIptablesSave(nftables.TableFamilyIPv4, reader)
+		})
+	}
+	if err == nil && len(*ip6tables) > 0 {
+		err = readInput(*ip6tables, func(reader io.Reader) error {
+			return migration.ParseIptablesSave(nftables.TableFamilyIPv6, reader)
+		})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	for _, warning := range migration.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", warning)
+	}
+	switch *output {
+	case "nft":
+		err = migration.WriteNft(os.Stdout)
+	case "corefile":
+		err = migration.WriteCorefile(os.Stdout)
+	default:
+		err = fmt.Errorf("output %v invalid, use nft or corefile", *output)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func readInput(input string, parse func(reader io.Reader) error) error {
+	if input == "-" {
+		return parse(os.Stdin)
+	}
+	file, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := parse(file); err != nil {
+		return fmt.Errorf("%v: %v", input, err)
+	}
+	return nil
+}
@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+const defaultMigrationTable = "coredns_migrated"
+
+// NftablesMigrationSet is an ipset converted to a nftables set, elements are in the text of nft scripts
+type NftablesMigrationSet struct {
+	Set      *nftables.Set
+	Elements []string
+}
+
+// NftablesMigrationChain is a chain of iptables converted to a chain named <table>_<chain>, the built-in chains are
+// base chains hooked like the ones of iptables
+type NftablesMigrationChain struct {
+	Name       string
+	Definition string
+	Rules      []string
+}
+
+// NftablesMigration converts the output of `ipset save` and the `-m set` rules of `iptables-save` and
+// `ip6tables-save` into one nftables table of each family, and the rules of the plugin adding answers into the
+// sets. Everything which can not be converted is reported by Warnings instead of failing.
+type NftablesMigration struct {
+	TableName string
+	Sets      []*NftablesMigrationSet
+	Chains    map[nftables.TableFamily][]*NftablesMigrationChain
+	Warnings  []string
+}
+
+func NewNftablesMigration(tableName string) *NftablesMigration {
+	if len(tableName) == 0 {
+		tableName = defaultMigrationTable
+	}
+	return &NftablesMigration{
+		TableName: tableName,
+		Chains:    make(map[nftables.TableFamily][]*NftablesMigrationChain),
+	}
+}
+
+func (m *NftablesMigration) warnf(format string, args ...any) {
+	m.Warnings = append(m.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (m *NftablesMigration) lookupSet(name string) *NftablesMigrationSet {
+	for _, set := range m.Sets {
+		if set.Set.Name == name {
+			return set
+		}
+	}
+	return nil
+}
+
+// ParseIpsetSave read the sets and their elements written by `ipset save`. Only the sets of addresses(hash:ip,
+// hash:net and bitmap:ip) can be converted.
+func (m *NftablesMigration) ParseIpsetSave(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		fields, err := splitMigrationLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("ipset line %v invalid, %v", line, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "create", "-N":
+			if len(fields) < 3 {
+				return fmt.Errorf("ipset line %v has no set type", line)
+			}
+			m.parseIpsetCreate(fields[1], fields[2], fields[3:])
+		case "add", "-A":
+			if len(fields) < 3 {
+				return fmt.Errorf("ipset line %v has no element", line)
+			}
+			m.parseIpsetAdd(fields[1], fields[2], fields[3:])
+		default:
+			m.warnf("ipset line %v: command %v ignored", line, fields[0])
+		}
+	}
+	return scanner.Err()
+}
+
+func (m *NftablesMigration) parseIpsetCreate(name string, setType string, options []string) {
+	if m.lookupSet(name) != nil {
+		m.warnf("ipset %v: created again, the second one ignored", name)
+		return
+	}
+	set := &nftables.Set{
+		Table:   &nftables.Table{Family: nftables.TableFamilyIPv4, Name: m.TableName},
+		Name:    name,
+		KeyType: nftables.TypeIPAddr,
+	}
+	switch setType {
+	case "hash:ip":
+	case "hash:net", "bitmap:ip":
+		set.Interval = true
+	default:
+		m.warnf("ipset %v: type %v can not be converted, only hash:ip, hash:net and bitmap:ip are supported", name, setType)
+		return
+	}
+
+	for i := 0; i < len(options); i++ {
+		hasValue := i+1 < len(options)
+		switch options[i] {
+		case "family":
+			if hasValue && options[i+1] == "inet6" {
+				set.Table.Family = nftables.TableFamilyIPv6
+				set.KeyType = nftables.TypeIP6Addr
+			}
+			i++
+		case "timeout":
+			if hasValue {
+				seconds, err := strconv.Atoi(options[i+1])
+				if err != nil || seconds < 0 {
+					m.warnf("ipset %v: timeout %v invalid, ignored", name, options[i+1])
+				} else {
+					set.HasTimeout = true
+					set.Timeout = time.Duration(seconds) * time.Second
+				}
+			}
+			i++
+		case "hashsize", "maxelem", "range", "netmask", "markmask", "probes", "resize":
+			// the nftables sets grow by themselves
+			i++
+		case "counters", "comment", "forceadd":
+		default:
+			m.warnf("ipset %v: option %v ignored", name, options[i])
+		}
+	}
+	m.Sets = append(m.Sets, &NftablesMigrationSet{Set: set})
+}
+
+func (m *NftablesMigration) parseIpsetAdd(name string, element string, options []string) {
+	set := m.lookupSet(name)
+	if set == nil {
+		// the warning is already reported when the set is created
+		return
+	}
+	if !validMigrationAddress(element) {
+		m.warnf("ipset %v: element %v is not an address, ignored", name, element)
+		return
+	}
+	if !set.Set.Interval && (strings.Contains(element, "/") || strings.Contains(element, "-")) {
+		m.warnf("ipset %v: element %v of %v is not an address, ignored", name, element, set.Set.KeyType.Name)
+		return
+	}
+
+	text := element
+	for i := 0; i < len(options); i++ {
+		switch options[i] {
+		case "timeout":
+			if i+1 < len(options) && set.Set.HasTimeout && options[i+1] != "0" {
+				text += " timeout " + options[i+1] + "s"
+			}
+			i++
+		case "comment":
+			if i+1 < len(options) {
+				text += " comment " + strconv.Quote(options[i+1])
+			}
+			i++
+		case "packets", "bytes", "skbmark", "skbprio", "skbqueue":
+			i++
+		case "nomatch":
+			m.warnf("ipset %v: nomatch element %v can not be converted, ignored", name, element)
+			return
+		default:
+			m.warnf("ipset %v: option %v of element %v ignored", name, options[i], element)
+		}
+	}
+	set.Elements = append(set.Elements, text)
+}
+
+// migrationHooks are the hooks and priorities of the built-in chains of iptables tables
+var migrationHooks = map[string]map[string]string{
+	"filter": {"INPUT": "filter hook input priority filter", "FORWARD": "filter hook forward priority filter", "OUTPUT": "filter hook output priority filter"},
+	"mangle": {"PREROUTING": "filter hook prerouting priority mangle", "INPUT": "filter hook input priority mangle", "FORWARD": "filter hook forward priority mangle",
+		"OUTPUT": "route hook output priority mangle", "POSTROUTING": "filter hook postrouting priority mangle"},
+	"nat": {"PREROUTING": "nat hook prerouting priority dstnat", "INPUT": "nat hook input priority srcnat", "OUTPUT": "nat hook output priority dstnat",
+		"POSTROUTING": "nat hook postrouting priority srcnat"},
+	"raw": {"PREROUTING": "filter hook prerouting priority raw", "OUTPUT": "filter hook output priority raw"},
+}
+
+// ParseIptablesSave read the rules written by `iptables-save`(IPv4 family) or `ip6tables-save`(IPv6 family), only
+// the rules matching sets by `-m set --match-set` are converted, other rules are kept by iptables or converted by
+// `iptables-translate`.
+func (m *NftablesMigration) ParseIptablesSave(family nftables.TableFamily, reader io.Reader) error {
+	table := ""
+	policies := make(map[string]string)
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case len(text) == 0 || strings.HasPrefix(text, "#") || text == "COMMIT":
+		case strings.HasPrefix(text, "*"):
+			table = text[1:]
+		case strings.HasPrefix(text, ":"):
+			if fields := strings.Fields(text[1:]); len(fields) > 1 {
+				policies[table+" "+fields[0]] = fields[1]
+			}
+		default:
+			fields, err := splitMigrationLine(text)
+			if err != nil {
+				return fmt.Errorf("iptables line %v invalid, %v", line, err)
+			}
+			// the counters of `iptables-save -c`
+			if len(fields) > 0 && strings.HasPrefix(fields[0], "[") {
+				fields = fields[1:]
+			}
+			if len(fields) < 2 || fields[0] != "-A" || !containsField(fields, "--match-set") {
+				continue
+			}
+			rule, jump, err := m.convertIptablesRule(family, table, fields[2:], policies)
+			if err != nil {
+				m.warnf("iptables line %v: %v, ignored", line, err)
+				continue
+			}
+			chain := m.mutableChain(family, table, fields[1], policies[table+" "+fields[1]])
+			chain.Rules = append(chain.Rules, rule)
+			if len(jump) > 0 {
+				m.mutableChain(family, table, jump, "")
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func containsField(fields []string, value string) bool {
+	for _, field := range fields {
+		if field == value {
+			return true
+		}
+	}
+	return false
+}
+
+func migrationChainName(table string, chain string) string {
+	return strings.ToLower(table + "_" + chain)
+}
+
+func (m *NftablesMigration) mutableChain(family nftables.TableFamily, table string, name string, policy string) *NftablesMigrationChain {
+	chainName := migrationChainName(table, name)
+	for _, chain := range m.Chains[family] {
+		if chain.Name == chainName {
+			return chain
+		}
+	}
+
+	chain := &NftablesMigrationChain{Name: chainName}
+	if hook, ok := migrationHooks[table][name]; ok {
+		// the other rules of the chain are not converted, dropping everything else here would break them
+		chain.Definition = fmt.Sprintf("type %v; policy accept;", hook)
+		if policy == "DROP" {
+			m.warnf("iptables chain %v %v: policy DROP is not converted, chain %v accepts the packets not matched", table, name, chainName)
+		}
+	} else {
+		m.warnf("iptables chain %v %v: it's a user chain, only its rules matching sets are converted into chain %v, check the jumps to it", table, name, chainName)
+	}
+	m.Chains[family] = append(m.Chains[family], chain)
+	return chain
+}
+
+// convertIptablesRule returns the nft rule of the matches and target of an iptables rule, and the user chain it
+// jumps to. chains are the policies of the chains declared by the tables.
+func (m *NftablesMigration) convertIptablesRule(family nftables.TableFamily, table string, fields []string, chains map[string]string) (string, string, error) {
+	address := "ip"
+	if family == nftables.TableFamilyIPv6 {
+		address = "ip6"
+	}
+	var statements []string
+	var comment string
+	jump := ""
+	protocol := ""
+	negate := false
+	for i := 0; i < len(fields); i++ {
+		option := fields[i]
+		value := ""
+		if option == "!" {
+			negate = true
+			continue
+		}
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		not := ""
+		if negate {
+			not = "!= "
+			negate = false
+		}
+
+		switch option {
+		case "-m", "--match":
+			// the matches are converted by their options
+			i++
+		case "-p", "--protocol":
+			protocol = strings.ToLower(value)
+			if protocol != "tcp" && protocol != "udp" {
+				statements = append(statements, fmt.Sprintf("meta l4proto %v%v", not, protocol))
+			} else if len(not) > 0 {
+				return "", "", fmt.Errorf("negative protocol %v is not supported", value)
+			}
+			i++
+		case "-s", "--source", "-d", "--destination":
+			direction := "saddr"
+			if option == "-d" || option == "--destination" {
+				direction = "daddr"
+			}
+			statements = append(statements, fmt.Sprintf("%v %v %v%v", address, direction, not, value))
+			i++
+		case "-i", "--in-interface", "-o", "--out-interface":
+			direction := "iifname"
+			if option == "-o" || option == "--out-interface" {
+				direction = "oifname"
+			}
+			statements = append(statements, fmt.Sprintf("%v %v%q", direction, not, strings.Replace(value, "+", "*", 1)))
+			i++
+		case "--match-set":
+			if i+2 >= len(fields) {
+				return "", "", fmt.Errorf("match-set has no direction")
+			}
+			set := m.lookupSet(value)
+			if set == nil {
+				return "", "", fmt.Errorf("set %v is not converted", value)
+			}
+			if set.Set.Table.Family != family {
+				return "", "", fmt.Errorf("set %v is of family %v", value, migrationFamily(set.Set.Table.Family))
+			}
+			direction := "saddr"
+			switch fields[i+2] {
+			case "src":
+			case "dst":
+				direction = "daddr"
+			default:
+				return "", "", fmt.Errorf("match-set direction %v is not supported", fields[i+2])
+			}
+			statements = append(statements, fmt.Sprintf("%v %v %v@%v", address, direction, not, value))
+			i += 2
+		case "--dport", "--destination-port", "--sport", "--source-port", "--dports", "--sports":
+			if protocol != "tcp" && protocol != "udp" {
+				return "", "", fmt.Errorf("%v requires -p tcp or -p udp", option)
+			}
+			direction := "dport"
+			if strings.HasPrefix(option, "--s") {
+				direction = "sport"
+			}
+			ports := strings.Split(strings.ReplaceAll(value, ":", "-"), ",")
+			if len(ports) > 1 {
+				statements = append(statements, fmt.Sprintf("%v %v %v{ %v }", protocol, direction, not, strings.Join(ports, ", ")))
+			} else {
+				statements = append(statements, fmt.Sprintf("%v %v %v%v", protocol, direction, not, ports[0]))
+			}
+			i++
+		case "--state", "--ctstate":
+			statements = append(statements, fmt.Sprintf("ct state %v{ %v }", not, strings.ReplaceAll(strings.ToLower(value), ",", ", ")))
+			i++
+		case "--comment":
+			comment = fmt.Sprintf(" comment %q", value)
+			i++
+		case "-j", "--jump", "-g", "--goto":
+			target, consumed, err := convertIptablesTarget(table, option, fields[i+1:], chains)
+			if err != nil {
+				return "", "", err
+			}
+			if strings.HasPrefix(target, "jump ") || strings.HasPrefix(target, "goto ") {
+				jump = fields[i+1]
+			}
+			statements = append(statements, target)
+			i += consumed
+		default:
+			return "", "", fmt.Errorf("option %v is not supported", option)
+		}
+	}
+	return strings.Join(statements, " ") + comment, jump, nil
+}
+
+// convertIptablesTarget returns the nft statement of the target in fields and how many fields are consumed, the
+// targets which are chains declared by the table are jumps
+func convertIptablesTarget(table string, option string, fields []string, chains map[string]string) (string, int, error) {
+	if len(fields) == 0 {
+		return "", 0, fmt.Errorf("%v has no target", option)
+	}
+	value := func(name string) (string, bool) {
+		for i := 1; i+1 < len(fields); i += 2 {
+			if fields[i] == name {
+				return fields[i+1], true
+			}
+		}
+		return "", false
+	}
+	// the options of targets are all after the target
+	consumed := len(fields)
+
+	switch fields[0] {
+	case "ACCEPT", "DROP", "RETURN":
+		return strings.ToLower(fields[0]), 1, nil
+	case "REJECT":
+		if with, ok := value("--reject-with"); ok && with == "tcp-reset" {
+			return "reject with tcp reset", consumed, nil
+		}
+		return "reject", consumed, nil
+	case "LOG":
+		if prefix, ok := value("--log-prefix"); ok {
+			return fmt.Sprintf("log prefix %q", prefix), consumed, nil
+		}
+		return "log", consumed, nil
+	case "MARK", "CONNMARK":
+		key := "meta mark"
+		if fields[0] == "CONNMARK" {
+			key = "ct mark"
+		}
+		if mark, ok := value("--set-mark"); ok {
+			return fmt.Sprintf("%v set %v", key, mark), consumed, nil
+		}
+		if mark, ok := value("--set-xmark"); ok {
+			if mark, mask, found := strings.Cut(mark, "/"); !found || mask == "0xffffffff" {
+				return fmt.Sprintf("%v set %v", key, mark), consumed, nil
+			}
+		}
+		return "", 0, fmt.Errorf("target %v is only supported with --set-mark", fields[0])
+	}
+
+	if _, ok := chains[table+" "+fields[0]]; !ok || len(fields) > 1 {
+		return "", 0, fmt.Errorf("target %v is not supported", fields[0])
+	}
+	statement := "jump"
+	if option == "-g" || option == "--goto" {
+		statement = "goto"
+	}
+	return fmt.Sprintf("%v %v", statement, migrationChainName(table, fields[0])), 1, nil
+}
+
+// splitMigrationLine split a line of `ipset save` or `iptables-save` by spaces, double quoted strings with
+// backslash escapes are one field
+func splitMigrationLine(line string) ([]string, error) {
+	var fields []string
+	var field bytes.Buffer
+	inField, quoted, escaped := false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inField = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func (m *NftablesMigration) families() []nftables.TableFamily {
+	seen := make(map[nftables.TableFamily]bool)
+	for _, set := range m.Sets {
+		seen[set.Set.Table.Family] = true
+	}
+	for family := range m.Chains {
+		seen[family] = true
+	}
+	var ret []nftables.TableFamily
+	for family := range seen {
+		ret = append(ret, family)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// migrationFamily returns the family of nft scripts
+func migrationFamily(family nftables.TableFamily) string {
+	if family == nftables.TableFamilyIPv6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// migrationTarget returns the family and name of table in nft scripts
+func migrationTarget(table *nftables.Table) string {
+	return fmt.Sprintf("%v %v", migrationFamily(table.Family), table.Name)
+}
+
+// migrationSetStatement returns the statement adding set with its type and flags, the sets converted are only
+// of addresses
+func migrationSetStatement(set *nftables.Set) string {
+	definition := []string{"type " + set.KeyType.Name}
+	var flags []string
+	if set.Interval {
+		flags = append(flags, "interval")
+	}
+	if set.HasTimeout {
+		flags = append(flags, "timeout")
+	}
+	if len(flags) > 0 {
+		definition = append(definition, "flags "+strings.Join(flags, ","))
+	}
+	if set.HasTimeout && set.Timeout > 0 {
+		definition = append(definition, fmt.Sprintf("timeout %ds", set.Timeout/time.Second))
+	}
+	return fmt.Sprintf("add set %v %v { %v; }", migrationTarget(set.Table), set.Name, strings.Join(definition, "; "))
+}
+
+// WriteNft write the converted tables as a script of `nft -f`
+func (m *NftablesMigration) WriteNft(w io.Writer) error {
+	var builder strings.Builder
+	builder.WriteString("#!/usr/sbin/nft -f\n")
+	for _, family := range m.families() {
+		table := &nftables.Table{Family: family, Name: m.TableName}
+		fmt.Fprintf(&builder, "\nadd table %v\n", migrationTarget(table))
+		for _, set := range m.Sets {
+			if set.Set.Table.Family != family {
+				continue
+			}
+			builder.WriteString(migrationSetStatement(set.Set) + "\n")
+			if len(set.Elements) > 0 {
+				fmt.Fprintf(&builder, "add element %v %v { %v }\n", migrationTarget(table), set.Set.Name, strings.Join(set.Elements, ", "))
+			}
+		}
+		// all chains are added before the rules jumping to them
+		for _, chain := range m.Chains[family] {
+			if len(chain.Definition) > 0 {
+				fmt.Fprintf(&builder, "add chain %v %v { %v }\n", migrationTarget(table), chain.Name, chain.Definition)
+			} else {
+				fmt.Fprintf(&builder, "add chain %v %v\n", migrationTarget(table), chain.Name)
+			}
+		}
+		for _, chain := range m.Chains[family] {
+			for _, rule := range chain.Rules {
+				fmt.Fprintf(&builder, "add rule %v %v %v\n", migrationTarget(table), chain.Name, rule)
+			}
+		}
+	}
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
+
+// WriteCorefile write the plugin blocks adding the answers into the converted sets, with the timeout of each set.
+// They apply to all answers of the server block, the domains which filled the ipsets(like `ipset=/domain/set`
+// of dnsmasq) are selected by the zones of the server block or `match`.
+func (m *NftablesMigration) WriteCorefile(w io.Writer) error {
+	var builder strings.Builder
+	for _, family := range m.families() {
+		keyType := "ip"
+		if family == nftables.TableFamilyIPv6 {
+			keyType = "ip6"
+		}
+		var rules []string
+		for _, set := range m.Sets {
+			if set.Set.Table.Family != family {
+				continue
+			}
+			rule := fmt.Sprintf("set add element %v %v %v %v", m.TableName, set.Set.Name, keyType, set.Set.Interval)
+			if set.Set.HasTimeout && set.Set.Timeout > 0 {
+				rule += " " + set.Set.Timeout.String()
+			}
+			rules = append(rules, rule)
+		}
+		if len(rules) == 0 {
+			continue
+		}
+		fmt.Fprintf(&builder, "nftables %v {\n", keyType)
+		for _, rule := range rules {
+			fmt.Fprintf(&builder, "    %v\n", rule)
+		}
+		builder.WriteString("}\n")
+	}
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
+
+// validMigrationAddress returns true if element is an address, a network or a range of addresses
+func validMigrationAddress(element string) bool {
+	if _, _, err := net.ParseCIDR(element); err == nil {
+		return true
+	}
+	first, last, isRange := strings.Cut(element, "-")
+	if isRange {
+		return net.ParseIP(first) != nil && net.ParseIP(last) != nil
+	}
+	return net.ParseIP(element) != nil
+}
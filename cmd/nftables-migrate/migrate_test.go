@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	_ "github.com/owent/coredns-nftables"
+)
+
+const testIpsetSave = `create VPN hash:ip family inet hashsize 1024 maxelem 65536 timeout 3600 comment
+add VPN 192.0.2.1 timeout 0 comment "static host"
+add VPN 192.0.2.2 timeout 120
+create NETS hash:net family inet hashsize 1024 maxelem 65536
+add NETS 198.51.100.0/24
+add NETS 203.0.113.0/25 nomatch
+create VPN6 hash:ip family inet6 hashsize 1024 maxelem 65536
+add VPN6 2001:db8::1
+create PORTS hash:ip,port family inet hashsize 1024 maxelem 65536
+`
+
+const testIptablesSave = `# Generated by iptables-save
+*mangle
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+-A PREROUTING -i br+ -p tcp -m multiport --dports 80,443 -m set --match-set VPN dst -j MARK --set-xmark 0x1/0xffffffff
+-A OUTPUT -m set --match-set PORTS dst,dst -j MARK --set-mark 0x1
+COMMIT
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD DROP [0:0]
+:VPN_CHECK - [0:0]
+[3:180] -A FORWARD -m set ! --match-set NETS src -m comment --comment "not \"trusted\"" -j VPN_CHECK
+-A FORWARD -s 10.0.0.0/8 -j ACCEPT
+-A VPN_CHECK -m conntrack --ctstate NEW,ESTABLISHED -m set --match-set VPN dst -j REJECT --reject-with tcp-reset
+-A VPN_CHECK -m set --match-set VPN dst -j MASQUERADE
+COMMIT
+`
+
+const testIp6tablesSave = `*filter
+:OUTPUT ACCEPT [0:0]
+-A OUTPUT -p udp --dport 53 -m set --match-set VPN6 dst -j LOG --log-prefix "vpn6 "
+COMMIT
+`
+
+func TestMigration(t *testing.T) {
+	migration := NewNftablesMigration("")
+	if err := migration.ParseIpsetSave(strings.NewReader(testIpsetSave)); err != nil {
+		t.Fatal(err)
+	}
+	if err := migration.ParseIptablesSave(nftables.TableFamilyIPv4, strings.NewReader(testIptablesSave)); err != nil {
+		t.Fatal(err)
+	}
+	if err := migration.ParseIptablesSave(nftables.TableFamilyIPv6, strings.NewReader(testIp6tablesSave)); err != nil {
+		t.Fatal(err)
+	}
+
+	var script strings.Builder
+	migration.WriteNft(&script)
+	for _, expected := range []string{
+		"add set ip coredns_migrated VPN { type ipv4_addr; flags timeout; timeout 3600s; }\n",
+		"add element ip coredns_migrated VPN { 192.0.2.1 comment \"static host\", 192.0.2.2 timeout 120s }\n",
+		"add element ip coredns_migrated NETS { 198.51.100.0/24 }\n",
+		"add chain ip coredns_migrated mangle_prerouting { type filter hook prerouting priority mangle; policy accept; }\n",
+		"add chain ip coredns_migrated filter_vpn_check\n",
+		"add rule ip coredns_migrated mangle_prerouting iifname \"br*\" tcp dport { 80, 443 } ip daddr @VPN meta mark set 0x1\n",
+		"add rule ip coredns_migrated filter_forward ip saddr != @NETS jump filter_vpn_check comment \"not \\\"trusted\\\"\"\n",
+		"add rule ip coredns_migrated filter_vpn_check ct state { new, established } ip daddr @VPN reject with tcp reset\n",
+		"add rule ip6 coredns_migrated filter_output udp dport 53 ip6 daddr @VPN6 log prefix \"vpn6 \"\n",
+	} {
+		if !strings.Contains(script.String(), expected) {
+			t.Errorf("Expected %q in the script, but got:\n%v", expected, script.String())
+		}
+	}
+	// the chains are added before the rules jumping to them
+	if strings.Index(script.String(), "add chain ip coredns_migrated filter_vpn_check") > strings.Index(script.String(), "jump filter_vpn_check") {
+		t.Errorf("Expected chain filter_vpn_check added before the jump")
+	}
+	if strings.Contains(script.String(), "PORTS") || strings.Contains(script.String(), "MASQUERADE") || strings.Contains(script.String(), "203.0.113.0") {
+		t.Errorf("Expected the set of ports, the nomatch element and the rules of them not converted, but got:\n%v", script.String())
+	}
+	if len(migration.Warnings) != 6 {
+		t.Errorf("Expected 6 warnings, but got %v", strings.Join(migration.Warnings, "\n"))
+	}
+
+	var corefile strings.Builder
+	migration.WriteCorefile(&corefile)
+	expected := `nftables ip {
+    set add element coredns_migrated VPN ip false 1h0m0s
+    set add element coredns_migrated NETS ip true
+}
+nftables ip6 {
+    set add element coredns_migrated VPN6 ip6 false
+}
+`
+	if corefile.String() != expected {
+		t.Errorf("Expected Corefile:\n%v\nbut got:\n%v", expected, corefile.String())
+	}
+	setup, err := caddy.DirectiveAction("dns", "nftables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setup(caddy.NewTestController("dns", corefile.String())); err != nil {
+		t.Errorf("Expected the Corefile rules valid, but got %v", err)
+	}
+}
+
+func TestSplitMigrationLine(t *testing.T) {
+	fields, err := splitMigrationLine(`-A INPUT  -m comment --comment "a \"b\" c" -j ACCEPT`)
+	if err != nil || len(fields) != 8 || fields[5] != `a "b" c` {
+		t.Errorf("Expected the quoted comment in one field, but got %q, %v", fields, err)
+	}
+	if _, err := splitMigrationLine(`add VPN 192.0.2.1 comment "open`); err == nil {
+		t.Errorf("Expected unterminated quote invalid")
+	}
+}
+
+func TestMigrationInvalidTimeout(t *testing.T) {
+	migration := NewNftablesMigration("")
+	if err := migration.ParseIpsetSave(strings.NewReader("create BAD hash:ip family inet timeout forever\n")); err != nil {
+		t.Fatal(err)
+	}
+	if set := migration.lookupSet("BAD"); set == nil || set.Set.HasTimeout || len(migration.Warnings) != 1 {
+		t.Errorf("Expected the invalid timeout ignored with a warning, but got %v, %v", set, migration.Warnings)
+	}
+}
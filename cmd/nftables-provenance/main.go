@@ -0,0 +1,66 @@
+// nftables-provenance prints the provenance of elements added by coredns-nftables with `userdata true`, it reads
+// the output of `nft -j list set` or `nft -j list ruleset` from stdin or the files of arguments.
+//
+//	nft -j list set ip filter WHITELIST | nftables-provenance [-name www.example.com] [-json]
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	coredns_nftables "github.com/owent/coredns-nftables"
+)
+
+func main() {
+	name := flag.String("name", "", "only print the elements added for this query name")
+	printJSON := flag.Bool("json", false, "print one JSON object per element")
+	flag.Parse()
+
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+	for _, input := range inputs {
+		if err := printProvenance(input, *name, *printJSON); err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", input, err)
+			os.Exit(1)
+		}
+	}
+}
+
+func printProvenance(input string, name string, printJSON bool) error {
+	var data []byte
+	var err error
+	if input == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(input)
+	}
+	if err != nil {
+		return err
+	}
+
+	records, err := coredns_nftables.DecodeNftJSONProvenance(data)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	for _, record := range records {
+		if len(name) > 0 && record.Provenance.QnameHash != coredns_nftables.ElementQnameHash(name) {
+			continue
+		}
+		if printJSON {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Printf("%v %v %v %s qname-hash=%016x time=%v version=%v\n", record.Family, record.Table, record.Set, record.Element,
+			record.Provenance.QnameHash, record.Provenance.Timestamp.UTC().Format(time.RFC3339), record.Provenance.PluginVersion)
+	}
+	return nil
+}
@@ -25,4 +25,378 @@ var recordDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Help:      "Histogram of the time each record took.",
 }, []string{"server"})
 
+var batchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "batch_size",
+	Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	Help:      "Histogram of the elements of one response sent to nftables in one transaction.",
+})
+
+var backpressureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "backpressure_delay_count_total",
+	Help:      "Counter of responses delayed because nftables flush is slow.",
+}, []string{"server"})
+
+var sampleCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "sample_count_total",
+	Help:      "Counter of answers matched by sampled rules.",
+}, []string{"server", "family", "table", "set", "result"})
+
+var driftElements = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "drift_elements",
+	Help:      "Elements intended by the plugin but missing in the kernel set at the latest drift check.",
+}, []string{"family", "table", "set"})
+
+var driftRepairCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "drift_repair_count_total",
+	Help:      "Counter of missing elements added back by the drift check.",
+}, []string{"family", "table", "set"})
+
+var learnCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "learn_count_total",
+	Help:      "Counter of elements journaled but not applied in the learn only period.",
+}, []string{"family", "table", "set"})
+
+var appliedLogLeaseCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "applied_log_lease_count_total",
+	Help:      "Counter of leases of the shared applied elements log by result, acquired or timeout.",
+}, []string{"result"})
+
+var lruRedisCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "lru_redis_count_total",
+	Help:      "Counter of operations of the LRU shared by Redis, labelled by operation(get, increase or remove) and result.",
+}, []string{"operation", "result"})
+
+var staleHandleCount = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "stale_handle_count_total",
+	Help:      "Counter of tables and sets found deleted or recreated by other tools.",
+})
+
+var limitCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "limit_count_total",
+	Help:      "Counter of addresses exceeding the maximum distinct addresses per name of rules.",
+}, []string{"server", "family", "table", "set", "result"})
+
+var panicCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "panic_count_total",
+	Help:      "Counter of panics recovered, labelled by stage(answer, service, commit or close).",
+}, []string{"server", "stage"})
+
+var coalesceCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "coalesce_count_total",
+	Help:      "Counter of responses skipped because an identical response is processed recently.",
+}, []string{"server"})
+
+var reaperQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "reaper_queue_length",
+	Help:      "Elements of sets without timeout flag waiting to be deleted by the reaper.",
+})
+
+var reapCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "reap_count_total",
+	Help:      "Counter of expired elements deleted by the reaper.",
+}, []string{"family", "table", "set"})
+
+var skipExistingCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "skip_existing_count_total",
+	Help:      "Counter of elements not added because they are already present in the kernel set.",
+}, []string{"family", "table", "set"})
+
+var inflightCoalescedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "inflight_coalesced_count_total",
+	Help:      "Counter of elements not sent because the same element is being added by another response.",
+}, []string{"family", "table", "set"})
+
+var groupActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "group_active",
+	Help:      "1 if the rule group is active, 0 if it's disabled by Corefile, admin API or schedules.",
+}, []string{"group"})
+
+var asyncQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "async_queue_length",
+	Help:      "Responses waiting for a worker in async mode.",
+})
+
+var asyncDroppedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "async_dropped_count_total",
+	Help:      "Counter of responses dropped because the queue of async workers is full.",
+}, []string{"policy"})
+
+var scheduleSuppressedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "schedule_suppressed_count_total",
+	Help:      "Counter of answers not applied because the rule or group is out of its schedules.",
+}, []string{"family", "table", "set"})
+
+var retryCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "retry_count_total",
+	Help:      "Counter of flushes retried after transient netlink errors, and the ones abandoned after all attempts.",
+}, []string{"result"})
+
+var breakerStateGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "breaker_state",
+	Help:      "State of the circuit breaker, 0 is closed, 1 is open and 2 is half-open.",
+})
+
+var breakerSkippedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "breaker_skipped_count_total",
+	Help:      "Counter of responses not applied because the circuit breaker is open.",
+}, []string{"server"})
+
+var rolloutCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "rollout_count_total",
+	Help:      "Counter of responses selected or skipped by rollout, labelled by server and result(applied or skipped).",
+}, []string{"server", "result"})
+
+var onErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "on_error_count_total",
+	Help:      "Counter of responses replaced by an error because the update of nftables failed, labelled by server and policy(servfail or refuse).",
+}, []string{"server", "policy"})
+
+var connectionRefreshCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "connection_refresh_count_total",
+	Help:      "Counter of pooled connections reopened because they are older than the maximum age of an operation, labelled by operation.",
+}, []string{"operation"})
+
+var connectionFailureCount = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "connection_failure_count_total",
+	Help:      "Counter of failures to open a netlink connection to nftables.",
+})
+
+var connectionPoolCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "connection_pool_count_total",
+	Help:      "Counter of connections taken from or returned to the pool, labelled by result(reused, opened, expired, idle-timeout, unhealthy or discarded).",
+}, []string{"result"})
+
+var connectionPoolIdleGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "connection_pool_idle",
+	Help:      "Count of idle connections in the pool.",
+}, func() float64 { return float64(countIdleConnections()) })
+
+var flushFailureCount = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "flush_failure_count_total",
+	Help:      "Counter of failed flushes of nftables operations.",
+})
+
+var addFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "add_failure_count_total",
+	Help:      "Counter of elements failed to be added to nftables sets.",
+}, []string{"family", "table", "set"})
+
+var lruSkipCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "lru_skip_count_total",
+	Help:      "Counter of answers ignored by the LRU because they are applied too many times recently.",
+}, []string{"server"})
+
+var lruLookupCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "lru_lookup_count_total",
+	Help:      "Counter of addresses looked up in the LRU, labelled by result(hit or miss).",
+}, []string{"server", "result"})
+
+var lruEvictionCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "lru_eviction_count_total",
+	Help:      "Counter of entries removed from the LRU, labelled by reason(capacity or expired).",
+}, []string{"reason"})
+
+var lruEntriesGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "lru_entries",
+	Help:      "Count of entries in the LRU shared by all server blocks, estimated by `dedupe bloom`.",
+}, func() float64 { return float64(sharedDedupe.len()) })
+
+var lruMaxEntriesGauge = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "lru_max_entries",
+	Help:      "The max count of entries of the LRU set by `set lru max`.",
+}, func() float64 { return float64(setLruMaxCount) })
+
+var syncTimeoutCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "sync_timeout_count_total",
+	Help:      "Counter of responses written before their update finished because it exceeds the sync timeout.",
+}, []string{"server"})
+
+var deferDeadlineCount = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "defer_deadline_count_total",
+	Help:      "Counter of responses written to the client but not applied because the deferred work exceeds the deadline.",
+})
+
+var setElements = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "set_elements",
+	Help:      "Count of elements in the kernel sets used by rules, the end of each interval is not counted.",
+}, []string{"family", "table", "set"})
+
+var elementAddCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "element_add_count_total",
+	Help:      "Counter of elements added to nftables sets, labelled by the closest zone of the query name.",
+}, []string{"zone", "family", "table", "set"})
+
+var propagationDelay = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "propagation_delay_seconds",
+	Buckets:   plugin.TimeBuckets,
+	Help:      "Histogram of the time from receiving the response of the next plugin to flushing its elements into the set.",
+}, []string{"family", "table", "set"})
+
+var pinRepairCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "pin_repair_count_total",
+	Help:      "Counter of pinned elements added back because they are missing in the set.",
+}, []string{"family", "table", "set"})
+
+var agentRpcCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "agent_rpc_count_total",
+	Help:      "Counter of RPCs sent to the nftables agent, labelled by the gRPC status code.",
+}, []string{"method", "code"})
+
+var agentRpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "agent_rpc_duration_microseconds",
+	Buckets:   plugin.TimeBuckets,
+	Help:      "Histogram of the time each RPC sent to the nftables agent took.",
+}, []string{"method"})
+
+var agentConnected = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "agent_connected",
+	Help:      "1 if the connection to the nftables agent is ready, otherwise 0.",
+})
+
+var netlinkErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "netlink_error_count_total",
+	Help:      "Counter of errors of nftables operations, labelled by errno(like EEXIST, ENOENT, EPERM, ENOSPC or other).",
+}, []string{"errno"})
+
+var execNftCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "exec_nft_count_total",
+	Help:      "Counter of nft invocations of the exec-nft backend, labelled by result(success, failure or timeout).",
+}, []string{"result"})
+
+var answerDiffCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "answer_diff_count_total",
+	Help:      "Counter of changes of the addresses of domains, labelled by server and change(added, removed or changed).",
+}, []string{"server", "change"})
+
+var missingSetCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "missing_set_count_total",
+	Help:      "Counter of sets found missing after a flush failed with ENOENT, labelled by result(recreated or missing).",
+}, []string{"result"})
+
+var setFullCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "set_full_count_total",
+	Help:      "Counter of sets found full after a flush failed with ENOSPC, labelled by result(evicted, grown or dropped).",
+}, []string{"family", "table", "set", "result"})
+
+var matchCacheCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "match_cache_count_total",
+	Help:      "Counter of matcher results looked up in the match cache, labelled by result(hit or miss).",
+}, []string{"result"})
+
+var webhookDroppedCount = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "webhook_dropped_count_total",
+	Help:      "Counter of webhook events dropped because the queue is full.",
+})
+
+var configInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "config_info",
+	Help:      "The hash of the effective rule configuration of running handlers, the value is always 1.",
+}, []string{"hash"})
+
 var _ sync.Once
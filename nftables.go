@@ -2,7 +2,9 @@ package coredns_nftables
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -14,96 +16,287 @@ import (
 )
 
 var asyncMode bool = false
+var backpressureThreshold time.Duration = 0
+var backpressureDelay time.Duration = 0
 
 type NftablesRuleSet struct {
 	RuleAddElement []*NftablesSetAddElement
+	RuleAddService []*NftablesSetAddService
 }
 
 // NftablesHandler implements the plugin.Handler interface.
 type NftablesHandler struct {
 	Next plugin.Handler
 
-	Rules map[nftables.TableFamily]*NftablesRuleSet
+	Rules        map[nftables.TableFamily]*NftablesRuleSet
+	ActionChains []*NftablesActionChain
+	Groups       []*NftablesRuleGroup
+	// nil means no canary, see NftablesCanary
+	Canary *NftablesCanary
+	// nil means all addresses are allowed
+	AddressFilter *NftablesAddressFilter
+	// Families of tables the A/AAAA answers are applied to, nil means ip/inet/bridge and ip6/inet/bridge
+	FamiliesIPv4 []nftables.TableFamily
+	FamiliesIPv6 []nftables.TableFamily
+	// How link-local AAAA answers are applied, and the interface of their netdev tables
+	LinkLocal          NftablesLinkLocalPolicy
+	LinkLocalInterface string
+	// Zones of the server block, elements added are counted by the closest zone of the query name
+	Zones []string
+	// Some rules apply addresses ignored by the LRU, see NftablesDedupPolicy
+	DedupBypass bool
+	// What is answered when the update of a response fails in synchronous mode
+	OnError NftablesOnErrorPolicy
+	// The extended DNS error attached to the answer of a failed update, nil means none
+	OnErrorEDE *dns.EDNS0_EDE
+	// Elements of the answers of one RRset use the minimum TTL of the RRset, so they expire together
+	RRsetTTL bool
+	// nil means the rules apply to all qnames, see NftablesRollout
+	Rollout *NftablesRollout
+	// A answers are ignored and rules of IPv4 addresses are rejected, for hosts without IPv4
+	IPv6Only bool
+	// The configured sets are flushed when CoreDNS starts, see FlushSetsOnStart
+	FlushSetOnStart bool
+
+	recentResponses *nftablesRecentResponses
 }
 
 func NewNftablesHandler() NftablesHandler {
 	return NftablesHandler{
-		Next:  nil,
-		Rules: make(map[nftables.TableFamily]*NftablesRuleSet),
+		Next:            nil,
+		Rules:           make(map[nftables.TableFamily]*NftablesRuleSet),
+		recentResponses: newRecentResponses(),
 	}
 }
 
 func (m *NftablesHandler) ServeWorker(ctx context.Context, r *dns.Msg) (int, error) {
+	if !breakerAllow() {
+		log.Debug("Ignore response because the circuit breaker is open")
+		breakerSkippedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		recordSloShed(sloShedBreaker)
+		recordUpdateFailure(ctx, 1)
+		return 0, nil
+	}
+
+	startTime := time.Now()
+	applyCounter, err := m.serveWorker(ctx, r)
+	recordSloRequest(time.Since(startTime), err)
+	return applyCounter, err
+}
+
+func (m *NftablesHandler) serveWorker(ctx context.Context, r *dns.Msg) (int, error) {
 	cache, err := NewCache()
 	if err != nil {
 		log.Errorf("NewCache failed, %v", err)
+		breakerRecord(true, true)
+		recordUpdateFailure(ctx, 1)
 		return 0, err
 	}
 	defer CloseCache(cache)
 	defer exportRecordDuration(ctx, time.Now())
 
+	batch := NewNftablesBatch(cache)
+	defer batch.Release()
+	batch.SetZone(m.originZone(r))
+	batch.SetReceived(responseReceived(ctx))
+	cnameChain := newCnameChain(r)
+	var stagedAnswers []*dns.RR
+	answers := make([]*dns.RR, 0, len(r.Answer))
+	for i := range r.Answer {
+		answers = append(answers, &r.Answer[i])
+	}
+	answers = append(answers, hintAnswers(r)...)
+	if m.RRsetTTL {
+		for answer, ttl := range rrsetMinTTLs(answers) {
+			batch.SetAnswerTTL(answer, ttl)
+		}
+	}
+	for _, answer := range answers {
+		// the rest answers are not staged once the request is canceled
+		if ctx.Err() != nil {
+			break
+		}
+		staged := false
+		if isolatePanic(ctx, "answer", func() string { return (*answer).String() }, func() {
+			staged = m.stageAnswer(ctx, cache, batch, cnameChain, answer)
+		}) {
+			recordUpdateFailure(ctx, 1)
+			continue
+		}
+		if staged {
+			stagedAnswers = append(stagedAnswers, answer)
+		}
+	}
+
+	for family, ruleSet := range m.Rules {
+		for _, rule := range ruleSet.RuleAddService {
+			var err error
+			if isolatePanic(ctx, "service", func() string { return r.Question[0].Name }, func() { err = rule.ServeMsg(ctx, batch, r, family) }) {
+				err = ErrNftablesPanic
+			}
+			if err != nil {
+				atomic.AddUint64(&addElementErrorCount, 1)
+				addFailureCount.WithLabelValues(cache.GetFamilyName(family), rule.TableName, rule.SetName).Inc()
+				log.Errorf("Add services to %v %v %v failed.%v", cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
+				recordUpdateFailure(ctx, 1)
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		// Nothing is sent to nftables, only finish the trial of circuit breaker
+		breakerRecord(false, false)
+		recordUpdateFailure(ctx, 1)
+		return 0, ctx.Err()
+	}
+
+	if isolatePanic(ctx, "commit", func() string { return r.Question[0].Name }, batch.Commit) {
+		// the connection may be broken in the middle of a transaction
+		cache.HasNftableConnectionError = true
+		batch.fail(ErrNftablesPanic)
+	}
+	breakerRecord(batch.Flushed(), batch.Failed())
+
 	applyCounter := 0
-	for _, answer := range r.Answer {
-		var tableFamilies []nftables.TableFamily = nil
-
-		switch answer.Header().Rrtype {
-		case dns.TypeA:
-			{
-				if cache.LruIgnoreIp(&answer) {
-					log.Debugf("Ignore ip element %v(%v) because lru max retry times exceeded", answer.(*dns.A).A.String(), answer.Header().Name)
-				} else {
-					recordCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-					tableFamilies = []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyINet, nftables.TableFamilyBridge}
-				}
+	ipCount := 0
+	for _, answer := range stagedAnswers {
+		rulesCounter, err := batch.AnswerResult(answer)
+		if err == nil {
+			applyCounter += rulesCounter
+		}
+		// answers skipped by all rules(for example not sampled) are not applied, so they are not deduped either
+		if err == nil && rulesCounter > 0 {
+			cache.LruUpdateIp(answer, rulesCounter)
+			ipCount += 1
+		}
+		// the answers only learned are not failures, on-error and the health check must ignore them
+		if err != nil && !errors.Is(err, errLearnOnly) {
+			recordUpdateFailure(ctx, 1)
+		}
+	}
+	if ipCount > 0 {
+		recordHealthApplied()
+	}
+	recordRequestMetadata(ctx, ipCount, batch.AppliedSets())
+
+	return applyCounter, err
+}
+
+// stageAnswer evaluate the rules of answer and stage its elements into batch, it returns true if the answer is
+// staged without errors
+func (m *NftablesHandler) stageAnswer(ctx context.Context, cache *NftablesCache, batch *NftablesBatch, cnameChain *nftablesCnameChain, answer *dns.RR) bool {
+	var tableFamilies []nftables.TableFamily = nil
+
+	switch (*answer).Header().Rrtype {
+	case dns.TypeA:
+		{
+			if m.IPv6Only {
+				log.Debugf("Ignore ip element %v(%v) because of ipv6-only", (*answer).(*dns.A).A.String(), (*answer).Header().Name)
+				break
+			}
+			deduped := cache.lruLookupIp(ctx, answer)
+			if deduped {
+				lruSkipCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
 			}
-		case dns.TypeAAAA:
-			{
-				if cache.LruIgnoreIp(&answer) {
-					log.Debugf("Ignore ip element %v(%v) because lru max retry times exceeded", answer.(*dns.AAAA).AAAA.String(), answer.Header().Name)
-				} else {
-					recordCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-					tableFamilies = []nftables.TableFamily{nftables.TableFamilyIPv6, nftables.TableFamilyINet, nftables.TableFamilyBridge}
+			if deduped && !m.DedupBypass {
+				log.Debugf("Ignore ip element %v(%v) because lru max retry times exceeded", (*answer).(*dns.A).A.String(), (*answer).Header().Name)
+			} else {
+				if deduped {
+					batch.SetAnswerDeduped(answer)
 				}
+				recordCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+				tableFamilies = m.familiesIPv4()
 			}
-		default:
-			{
-				// do nohting
+		}
+	case dns.TypeAAAA:
+		{
+			deduped := cache.lruLookupIp(ctx, answer)
+			if deduped {
+				lruSkipCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+			}
+			if deduped && !m.DedupBypass {
+				log.Debugf("Ignore ip element %v(%v) because lru max retry times exceeded", (*answer).(*dns.AAAA).AAAA.String(), (*answer).Header().Name)
+			} else {
+				if deduped {
+					batch.SetAnswerDeduped(answer)
+				}
+				recordCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+				tableFamilies = m.answerFamiliesIPv6(answer)
+				if tableFamilies == nil {
+					log.Debugf("Ignore ip element %v(%v) because it's a link-local address", (*answer).(*dns.AAAA).AAAA.String(), (*answer).Header().Name)
+				} else if m.LinkLocal == NftablesLinkLocalNetdev && isLinkLocalAnswer(answer) {
+					batch.SetAnswerScope(answer, m.LinkLocalInterface)
+				}
 			}
 		}
-
-		if tableFamilies == nil {
-			continue
+	default:
+		{
+			// do nohting
 		}
+	}
+
+	if tableFamilies == nil {
+		return false
+	}
+	if !m.allowAnswer(answer) {
+		log.Debugf("Ignore ip element %v(%v) because it's filtered by include-cidr/exclude-cidr", answerAddress(answer), (*answer).Header().Name)
+		return false
+	}
 
-		hasError := false
-		for _, family := range tableFamilies {
-			ruleSet, ok := m.Rules[family]
-			if ok {
-				for _, rule := range ruleSet.RuleAddElement {
-					err, ignored := rule.ServeDNS(ctx, cache, &answer, family)
-					if err != nil {
-						hasError = true
-						switch answer.Header().Rrtype {
-						case dns.TypeA:
-							log.Errorf("Add element %v(%v) to %v %v %v failed.%v", answer.(*dns.A).A.String(), answer.Header().Name, cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
-						case dns.TypeAAAA:
-							log.Errorf("Add element %v(%v) to %v %v %v failed.%v", answer.(*dns.AAAA).AAAA.String(), answer.Header().Name, cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
-						default:
-							log.Errorf("Add element %v(%v) to %v %v %v failed.%v", answer.String(), answer.Header().Name, cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
-						}
-					} else if !ignored {
-						applyCounter += 1
-					}
+	names := cnameChain.names(normalizeName((*answer).Header().Name))
+	batch.SetAnswerNames(answer, names)
+	cacheMatchNames(names, batch.AnswerTTL(answer))
+
+	hasError := false
+	for _, family := range tableFamilies {
+		ruleSet, ok := m.Rules[family]
+		if ok {
+			for _, rule := range ruleSet.RuleAddElement {
+				if !rule.MatchName(names...) {
+					continue
+				}
+				err, _ := rule.ServeDNS(ctx, batch, answer, family)
+				if err != nil {
+					hasError = true
+					logAddElementError(cache, answer, family, rule, err)
 				}
 			}
 		}
+	}
 
-		if !hasError {
-			cache.LruUpdateIp(&answer, applyCounter)
+	if group := m.matchGroup(names, tableFamilies); group != nil {
+		if group.ServeDNS(ctx, batch, answer, tableFamilies) {
+			hasError = true
 		}
 	}
 
-	return applyCounter, err
+	for _, chain := range m.ActionChains {
+		if chain.ServeDNS(ctx, batch, answer, tableFamilies) != nil {
+			hasError = true
+		}
+	}
+
+	if m.Canary != nil {
+		m.Canary.ServeDNS(ctx, batch, answer, tableFamilies)
+	}
+
+	if hasError {
+		recordUpdateFailure(ctx, 1)
+	}
+	return !hasError
+}
+
+func logAddElementError(cache *NftablesCache, answer *dns.RR, family nftables.TableFamily, rule *NftablesSetAddElement, err error) {
+	atomic.AddUint64(&addElementErrorCount, 1)
+	addFailureCount.WithLabelValues(cache.GetFamilyName(family), rule.TableName, rule.SetName).Inc()
+	switch (*answer).Header().Rrtype {
+	case dns.TypeA:
+		log.Errorf("Add element %v(%v) to %v %v %v failed.%v", (*answer).(*dns.A).A.String(), (*answer).Header().Name, cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
+	case dns.TypeAAAA:
+		log.Errorf("Add element %v(%v) to %v %v %v failed.%v", (*answer).(*dns.AAAA).AAAA.String(), (*answer).Header().Name, cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
+	default:
+		log.Errorf("Add element %v(%v) to %v %v %v failed.%v", (*answer).String(), (*answer).Header().Name, cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
+	}
 }
 
 func (m *NftablesHandler) Serve(ctx context.Context, r *dns.Msg, nextPluginCost time.Duration) error {
@@ -125,6 +318,7 @@ func (m *NftablesHandler) Name() string { return "nftables" }
 
 func (m *NftablesHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	startTime := time.Now()
+	request := r
 	nw := nonwriter.New(w)
 	rcode, err := plugin.NextOrFailure(m.Name(), m.Next, ctx, nw, r)
 	if err != nil {
@@ -142,9 +336,13 @@ func (m *NftablesHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 			hasValidRecord = true
 			break
 		}
+		if svcb := svcbRecord(answer); svcb != nil && (m.hasServiceRules() || svcbHasHints(svcb)) {
+			hasValidRecord = true
+			break
+		}
 	}
 	if !hasValidRecord {
-		log.Debug("Request didn't contain any answer or A/AAAA record")
+		log.Debug("Request didn't contain any answer or A/AAAA/HTTPS/SVCB record")
 		err = w.WriteMsg(r)
 		if err != nil {
 			return dns.RcodeFormatError, err
@@ -153,22 +351,116 @@ func (m *NftablesHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 		return dns.RcodeSuccess, nil
 	}
 
+	recordAnswerDiff(ctx, r)
+
+	if m.Rollout != nil {
+		if !m.Rollout.selected(rolloutQname(r)) {
+			log.Debugf("Ignore response of %v because it's out of rollout %v", rolloutQname(r), m.Rollout)
+			rolloutCount.WithLabelValues(metrics.WithServer(ctx), "skipped").Inc()
+			err = w.WriteMsg(r)
+			if err != nil {
+				return dns.RcodeServerFailure, err
+			}
+			return rcode, nil
+		}
+		rolloutCount.WithLabelValues(metrics.WithServer(ctx), "applied").Inc()
+	}
+
+	if coalesceWindow > 0 && m.recentResponses != nil && m.recentResponses.coalesce(r, coalesceWindow) {
+		log.Debugf("Ignore response of %v because an identical response is processed in %v", r.Answer[0].Header().Name, coalesceWindow)
+		coalesceCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		err = w.WriteMsg(r)
+		if err != nil {
+			return dns.RcodeServerFailure, err
+		}
+		return rcode, nil
+	}
+
+	// the values of the request like the server, metadata and tracing are kept by the work of all modes, while only
+	// the synchronous one is canceled with the request
+	serveCtx := withResponseReceived(withClientAddress(ctx, w), endTime)
+	detached := detachContext(serveCtx)
 	if asyncMode {
-		copyMsg := r.Copy()
+		copyMsg := compactMsg(r)
+		m.applyBackpressure(ctx)
+		err = w.WriteMsg(r)
+
+		m.serveAsync(detached, copyMsg, endTime.Sub(startTime))
+		if err != nil {
+			return dns.RcodeServerFailure, err
+		}
+	} else if deferWriteMode {
+		// writers of the previous plugins may rewrite the response, so it's copied before writing
+		copyMsg := compactMsg(r)
+		m.applyBackpressure(ctx)
 		err = w.WriteMsg(r)
 
-		go m.Serve(context.Background(), copyMsg, endTime.Sub(startTime))
+		m.serveDeferred(detached, copyMsg, endTime.Sub(startTime))
 		if err != nil {
 			return dns.RcodeServerFailure, err
 		}
 	} else {
-		m.Serve(context.Background(), r, endTime.Sub(startTime))
+		serveCtx, failure := withUpdateFailure(serveCtx)
+		if !m.serveSync(serveCtx, r, endTime.Sub(startTime)) {
+			// the update goes on in background, so the response is served whatever on-error is
+			err = w.WriteMsg(r)
+			if err != nil {
+				return dns.RcodeServerFailure, err
+			}
+			return rcode, nil
+		}
+		m.applyBackpressure(ctx)
+		if reply := m.OnError.failedReply(request); reply != nil && failure.Failed() {
+			log.Warningf("Nftables answer %v instead of the response of %v because the update failed", dns.RcodeToString[reply.Rcode], r.Answer[0].Header().Name)
+			onErrorCount.WithLabelValues(metrics.WithServer(ctx), m.OnError.String()).Inc()
+			attachEDE(reply, request, m.OnErrorEDE)
+			err = w.WriteMsg(reply)
+			if err != nil {
+				return dns.RcodeServerFailure, err
+			}
+			return dns.RcodeSuccess, nil
+		}
+		if failure.Failed() {
+			attachEDE(r, request, m.OnErrorEDE)
+		}
 		err = w.WriteMsg(r)
 	}
 
 	return rcode, nil
 }
 
+// applyBackpressure delays the response when the latest flush of nftables is slower than the threshold
+func (m *NftablesHandler) applyBackpressure(ctx context.Context) {
+	if backpressureDelay <= 0 {
+		return
+	}
+
+	latency := GetLastFlushLatency()
+	if latency < backpressureThreshold {
+		return
+	}
+
+	log.Debugf("Nftables flush latency %vus exceed %vus, delay response for %vus",
+		latency.Microseconds(), backpressureThreshold.Microseconds(), backpressureDelay.Microseconds())
+	backpressureCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+
+	timer := time.NewTimer(backpressureDelay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+func (m *NftablesHandler) hasServiceRules() bool {
+	for _, ruleSet := range m.Rules {
+		if len(ruleSet.RuleAddService) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *NftablesHandler) MutableRuleSet(family nftables.TableFamily) *NftablesRuleSet {
 	ret, ok := m.Rules[family]
 	if ok {
@@ -185,6 +477,43 @@ func exportRecordDuration(ctx context.Context, start time.Time) {
 		Observe(float64(time.Since(start).Microseconds()))
 }
 
+// nftablesDetachedContext keeps the values of the parent, but is never canceled with it
+type nftablesDetachedContext struct {
+	parent context.Context
+}
+
+// detachContext returns a context with the values of parent but without its deadline and cancellation, for the
+// work outliving the request
+func detachContext(parent context.Context) context.Context {
+	return nftablesDetachedContext{parent: parent}
+}
+
+func (ctx nftablesDetachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (ctx nftablesDetachedContext) Done() <-chan struct{}       { return nil }
+func (ctx nftablesDetachedContext) Err() error                  { return nil }
+func (ctx nftablesDetachedContext) Value(key interface{}) interface{} {
+	return ctx.parent.Value(key)
+}
+
+type nftablesResponseReceivedKey struct{}
+
+// withResponseReceived returns parent carrying when the response is received from the next plugin
+func withResponseReceived(parent context.Context, received time.Time) context.Context {
+	return context.WithValue(parent, nftablesResponseReceivedKey{}, received)
+}
+
+// responseReceived returns when the response of ctx is received from the next plugin, the zero time for answers
+// not from a response like `POST /elements`
+func responseReceived(ctx context.Context) time.Time {
+	received, _ := ctx.Value(nftablesResponseReceivedKey{}).(time.Time)
+	return received
+}
+
 func SetNftableAsyncMode(mode bool) {
 	asyncMode = mode
 }
+
+func SetNftableBackpressure(threshold time.Duration, delay time.Duration) {
+	backpressureThreshold = threshold
+	backpressureDelay = delay
+}
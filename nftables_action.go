@@ -0,0 +1,277 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+const webhookTimeout = 5 * time.Second
+
+// NftablesAction is one step of an action chain, it's called once for each matched answer
+type NftablesAction interface {
+	Name() string
+	ServeDNS(ctx context.Context, batch *NftablesBatch, answer *dns.RR, families []nftables.TableFamily) error
+}
+
+// NftablesActionChain runs Actions in order for answers whose name is matched by Matcher and not by Except
+type NftablesActionChain struct {
+	Matcher  *NftablesDomainMatcher
+	Except   *NftablesDomainMatcher
+	Families []nftables.TableFamily
+	Actions  []NftablesAction
+}
+
+func (m *NftablesActionChain) Name() string { return "nftables-action-chain" }
+
+func (m *NftablesActionChain) ServeDNS(ctx context.Context, batch *NftablesBatch, answer *dns.RR, families []nftables.TableFamily) error {
+	names := batch.AnswerNames(answer)
+	if !m.Matcher.MatchAny(names) || (m.Except != nil && m.Except.MatchAny(names)) {
+		return nil
+	}
+
+	var matchedFamilies []nftables.TableFamily
+	for _, family := range families {
+		for _, chainFamily := range m.Families {
+			if family == chainFamily {
+				matchedFamilies = append(matchedFamilies, family)
+				break
+			}
+		}
+	}
+	if len(matchedFamilies) == 0 {
+		return nil
+	}
+
+	var ret error = nil
+	for _, action := range m.Actions {
+		err := action.ServeDNS(ctx, batch, answer, matchedFamilies)
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+
+	return ret
+}
+
+// NftablesSetAction add the answer into a set for each family
+type NftablesSetAction struct {
+	Rule *NftablesSetAddElement
+}
+
+func (m *NftablesSetAction) Name() string { return "set" }
+
+func (m *NftablesSetAction) ServeDNS(ctx context.Context, batch *NftablesBatch, answer *dns.RR, families []nftables.TableFamily) error {
+	var ret error = nil
+	if !m.Rule.MatchName(batch.AnswerNames(answer)...) {
+		return nil
+	}
+	for _, family := range families {
+		err, _ := m.Rule.ServeDNS(ctx, batch, answer, family)
+		if err != nil {
+			logAddElementError(batch.Cache(), answer, family, m.Rule, err)
+			ret = err
+		}
+	}
+
+	return ret
+}
+
+// NftablesMapAction add the answer into a map with the port of Rule as the value for each family
+type NftablesMapAction struct {
+	NftablesSetAction
+}
+
+func (m *NftablesMapAction) Name() string { return "map" }
+
+// actionSetRule returns the rule of the set and map actions, or nil for the other actions
+func actionSetRule(action NftablesAction) *NftablesSetAddElement {
+	switch setAction := action.(type) {
+	case *NftablesSetAction:
+		return setAction.Rule
+	case *NftablesMapAction:
+		return setAction.Rule
+	default:
+		return nil
+	}
+}
+
+// NftablesJournalAction write the answer into the applied elements log after commit, with `-` as the table and
+// the set
+type NftablesJournalAction struct {
+	Action string
+}
+
+func (m *NftablesJournalAction) Name() string { return "journal" }
+
+func (m *NftablesJournalAction) ServeDNS(ctx context.Context, batch *NftablesBatch, answer *dns.RR, families []nftables.TableFamily) error {
+	family := nftables.TableFamilyIPv4
+	if (*answer).Header().Rrtype == dns.TypeAAAA {
+		family = nftables.TableFamilyIPv6
+	}
+	batch.AfterCommit(func() {
+		action := m.Action
+		if _, err := batch.AnswerResult(answer); err != nil {
+			action += "-failed"
+		}
+		WriteAppliedLog(action, []NftablesAppliedElement{{
+			Family:    family,
+			TableName: "-",
+			SetName:   "-",
+			Element:   answerAddress(answer),
+			Name:      batch.AnswerName(answer),
+			Timeout:   batch.AnswerTTL(answer),
+		}})
+	})
+	return nil
+}
+
+// NftablesMetadataAction publish Value as the metadata nftables/match of the request
+type NftablesMetadataAction struct {
+	Value string
+}
+
+func (m *NftablesMetadataAction) Name() string { return "metadata" }
+
+func (m *NftablesMetadataAction) ServeDNS(ctx context.Context, batch *NftablesBatch, answer *dns.RR, families []nftables.TableFamily) error {
+	recordMatchMetadata(ctx, m.Value)
+	return nil
+}
+
+// NftablesLogAction write the answer and how many rules applied it into the log of CoreDNS after commit
+type NftablesLogAction struct{}
+
+func (m *NftablesLogAction) Name() string { return "log" }
+
+func (m *NftablesLogAction) ServeDNS(ctx context.Context, batch *NftablesBatch, answer *dns.RR, families []nftables.TableFamily) error {
+	batch.AfterCommit(func() {
+		applied, err := batch.AnswerResult(answer)
+		if err != nil {
+			log.Infof("Nftables match %v %v failed. %v", (*answer).Header().Name, answerAddress(answer), err)
+		} else {
+			log.Infof("Nftables match %v %v, applied by %v rule(s)", (*answer).Header().Name, answerAddress(answer), applied)
+		}
+	})
+	return nil
+}
+
+// NftablesWebhookEvent is the JSON body posted by webhook actions
+type NftablesWebhookEvent struct {
+	Time    string `json:"time"`
+	Server  string `json:"server"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Address string `json:"address"`
+	TTL     uint32 `json:"ttl"`
+	Applied int    `json:"applied"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NftablesWebhookAction post the answer to URL after commit, it never blocks the response
+type NftablesWebhookAction struct {
+	URL string
+}
+
+func (m *NftablesWebhookAction) Name() string { return "webhook" }
+
+func (m *NftablesWebhookAction) ServeDNS(ctx context.Context, batch *NftablesBatch, answer *dns.RR, families []nftables.TableFamily) error {
+	server := metrics.WithServer(ctx)
+	batch.AfterCommit(func() {
+		event := NftablesWebhookEvent{
+			Time:    time.Now().Format(time.RFC3339),
+			Server:  server,
+			Name:    batch.AnswerName(answer),
+			Type:    dns.TypeToString[(*answer).Header().Rrtype],
+			Address: answerAddress(answer),
+			TTL:     (*answer).Header().Ttl,
+		}
+		applied, err := batch.AnswerResult(answer)
+		event.Applied = applied
+		if err != nil {
+			event.Error = err.Error()
+		}
+
+		enqueueWebhook(m.URL, event.Name, &event)
+	})
+	return nil
+}
+
+type nftablesWebhookJob struct {
+	url   string
+	name  string
+	event any
+}
+
+// all webhooks share one client and a bounded queue served by webhookWorkers, so a slow receiver never piles up
+// goroutines
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+var webhookWorkers int = 4
+var webhookQueueSize int = 1024
+var webhookQueue chan nftablesWebhookJob = nil
+var webhookStart sync.Once
+
+// enqueueWebhook post the JSON of event about name to url in background, the event is dropped when the queue
+// is full. It returns false if the event is dropped.
+func enqueueWebhook(url string, name string, event any) bool {
+	webhookStart.Do(startWebhookWorkers)
+
+	select {
+	case webhookQueue <- nftablesWebhookJob{url: url, name: name, event: event}:
+		return true
+	default:
+		webhookDroppedCount.Inc()
+		log.Warningf("Nftables webhook drop the event of %v to %v because the queue is full", name, url)
+		return false
+	}
+}
+
+func startWebhookWorkers() {
+	webhookQueue = make(chan nftablesWebhookJob, webhookQueueSize)
+	for i := 0; i < webhookWorkers; i++ {
+		go serveWebhooks(webhookQueue)
+	}
+}
+
+func serveWebhooks(queue chan nftablesWebhookJob) {
+	for job := range queue {
+		postWebhook(job.url, job.name, job.event)
+	}
+}
+
+// postWebhook post the JSON of event about name to url
+func postWebhook(url string, name string, event any) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Warningf("Nftables webhook encode event of %v failed. %v", name, err)
+		return
+	}
+
+	rsp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Warningf("Nftables webhook post %v to %v failed. %v", name, url, err)
+		return
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		log.Warningf("Nftables webhook post %v to %v failed. status %v", name, url, rsp.Status)
+	}
+}
+
+func answerAddress(answer *dns.RR) string {
+	switch (*answer).Header().Rrtype {
+	case dns.TypeA:
+		return (*answer).(*dns.A).A.String()
+	case dns.TypeAAAA:
+		return (*answer).(*dns.AAAA).AAAA.String()
+	}
+
+	return strings.TrimPrefix((*answer).String(), (*answer).Header().String())
+}
@@ -0,0 +1,66 @@
+package coredns_nftables
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWebhookQueueDrops(t *testing.T) {
+	webhookStart.Do(startWebhookWorkers)
+	queue := webhookQueue
+	// a queue without workers is full after one event
+	webhookQueue = make(chan nftablesWebhookJob, 1)
+	defer func() { webhookQueue = queue }()
+
+	dropped := testutil.ToFloat64(webhookDroppedCount)
+	if !enqueueWebhook("http://127.0.0.1:1/events", "example.org.", &NftablesWebhookEvent{}) {
+		t.Errorf("Expected the first event queued")
+	}
+	if enqueueWebhook("http://127.0.0.1:1/events", "example.org.", &NftablesWebhookEvent{}) {
+		t.Errorf("Expected the second event dropped")
+	}
+	if got := testutil.ToFloat64(webhookDroppedCount) - dropped; got != 1 {
+		t.Errorf("Expected 1 event dropped, but got %v", got)
+	}
+}
+
+func TestJournalAndMetadataAction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "applied.log")
+	SetAppliedLog(path, 0, 0)
+	defer SetAppliedLog("", 0, 0)
+
+	handle := NewNftablesHandler()
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	ctx := handle.Metadata(metadata.ContextWithMetadata(context.Background()), request.Request{W: &test.ResponseWriter{}, Req: r})
+
+	batch := NewNftablesBatch(&NftablesCache{})
+	answer := newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1")
+	families := []nftables.TableFamily{nftables.TableFamilyIPv4}
+	for _, action := range []NftablesAction{&NftablesJournalAction{Action: "match"}, &NftablesMetadataAction{Value: "vpn"},
+		&NftablesMetadataAction{Value: "ads"}, &NftablesMetadataAction{Value: "vpn"}} {
+		if err := action.ServeDNS(ctx, batch, answer, families); err != nil {
+			t.Fatalf("Expected no errors, but got %v", err)
+		}
+	}
+	batch.Commit()
+
+	if value := metadata.ValueFunc(ctx, "nftables/match")(); value != "vpn,ads" {
+		t.Errorf("Expected vpn,ads, but got %q", value)
+	}
+	data, _ := os.ReadFile(path)
+	entry, err := ParseAppliedLogLine(strings.TrimSpace(string(data)))
+	if err != nil || entry.Action != "match" || entry.Name != "example.org." || entry.Element != "192.0.2.1" {
+		t.Errorf("Expected the match of example.org. in the journal, but got %+v, %v", entry, err)
+	}
+}
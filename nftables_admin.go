@@ -0,0 +1,88 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var adminLock sync.Mutex = sync.Mutex{}
+var adminAddress string = ""
+var adminRefs int = 0
+var adminServer *http.Server = nil
+var adminHandlers = make(map[string]http.HandlerFunc)
+
+// SetAdminAddress set the listen address of the admin HTTP API, empty address disables it
+func SetAdminAddress(address string) {
+	adminLock.Lock()
+	defer adminLock.Unlock()
+
+	adminAddress = address
+	if len(address) > 0 {
+		EnableElementTracker(true)
+	}
+}
+
+// registerAdminHandler add an endpoint to the admin HTTP API, it must be called before StartAdmin
+func registerAdminHandler(pattern string, handler http.HandlerFunc) {
+	adminLock.Lock()
+	defer adminLock.Unlock()
+
+	adminHandlers[pattern] = handler
+}
+
+// StartAdmin start the admin HTTP API when the first handler starts, or restart it when the address changed
+func StartAdmin() error {
+	adminLock.Lock()
+	defer adminLock.Unlock()
+
+	adminRefs += 1
+	if adminServer != nil && adminServer.Addr == adminAddress {
+		return nil
+	}
+	if adminServer != nil {
+		adminServer.Close()
+		adminServer = nil
+	}
+	if len(adminAddress) == 0 {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", adminAddress)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	for pattern, handler := range adminHandlers {
+		mux.HandleFunc(pattern, handler)
+	}
+	adminServer = &http.Server{Addr: adminAddress, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func(server *http.Server) {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("Nftables admin API on %v stopped. %v", server.Addr, err)
+		}
+	}(adminServer)
+
+	log.Infof("Nftables admin API listen on %v", adminAddress)
+	return nil
+}
+
+// StopAdmin stop the admin HTTP API when the last handler stops
+func StopAdmin() {
+	adminLock.Lock()
+	defer adminLock.Unlock()
+
+	if adminRefs > 0 {
+		adminRefs -= 1
+	}
+	if adminRefs == 0 && adminServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		adminServer.Shutdown(ctx)
+		adminServer = nil
+	}
+}
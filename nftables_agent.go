@@ -0,0 +1,390 @@
+package coredns_nftables
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// NftablesAgentTLS is the files of TLS used to connect the agent by `host:port`, the client certificate is optional
+type NftablesAgentTLS struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// nftablesAgentDial is what the connection to the agent is dialed with, the connection is dialed again when it
+// changes
+type nftablesAgentDial struct {
+	address string
+	timeout time.Duration
+	tls     NftablesAgentTLS
+}
+
+var agentLock sync.Mutex = sync.Mutex{}
+var agentAddress string = ""
+var agentTimeout time.Duration = time.Second
+var agentTLS NftablesAgentTLS = NftablesAgentTLS{}
+var agentRefs int = 0
+var agentConn *grpc.ClientConn = nil
+var agentConnDial nftablesAgentDial = nftablesAgentDial{}
+var agentCancel context.CancelFunc = nil
+
+// SetNftablesAgent send the nftables operations of answers to the agent listening on address(`unix:///path` or
+// `host:port`), the timeout applies to each RPC. Empty address applies them in this process.
+func SetNftablesAgent(address string, timeout time.Duration) {
+	agentLock.Lock()
+	defer agentLock.Unlock()
+
+	agentAddress = address
+	agentTimeout = timeout
+}
+
+// SetNftablesAgentTLS set the TLS files used to connect the agent by `host:port`, agents which are not unix
+// sockets can only be connected by TLS
+func SetNftablesAgentTLS(files NftablesAgentTLS) {
+	agentLock.Lock()
+	defer agentLock.Unlock()
+
+	agentTLS = files
+}
+
+// isAgentUnixAddress returns true if address is a unix socket, like `unix:///path` or `unix:path`
+func isAgentUnixAddress(address string) bool {
+	return strings.HasPrefix(address, "unix:") || strings.HasPrefix(address, "unix-abstract:")
+}
+
+// agentCredentials returns the transport credentials of address, the unix socket is protected by its permission
+// and other addresses must use TLS
+func agentCredentials(address string, files NftablesAgentTLS) (credentials.TransportCredentials, error) {
+	if isAgentUnixAddress(address) {
+		return insecure.NewCredentials(), nil
+	}
+	if len(files.CAFile) == 0 {
+		return nil, fmt.Errorf("agent %v is not a unix socket, it requires tls", address)
+	}
+
+	ca, err := os.ReadFile(files.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read agent CA %v failed, %v", files.CAFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("agent CA %v has no certificate", files.CAFile)
+	}
+	config := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if len(files.CertFile) > 0 {
+		certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load agent certificate %v failed, %v", files.CertFile, err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// StartAgent connect to the agent when the first handler starts, or when the address, the timeout or the TLS files
+// are changed by reloading. The connection is reestablished with backoff when it's lost, RPCs fail with EAGAIN
+// until then so that flushes are retried by `retry`.
+func StartAgent() error {
+	agentLock.Lock()
+	defer agentLock.Unlock()
+
+	agentRefs += 1
+	dial := nftablesAgentDial{address: agentAddress, timeout: agentTimeout, tls: agentTLS}
+	if agentConn != nil && agentConnDial == dial {
+		return nil
+	}
+	if agentConn != nil {
+		log.Infof("Nftables agent changed from %v to %v, close the old connection", agentConnDial.address, agentAddress)
+		closeAgentConnection()
+	}
+	if len(agentAddress) == 0 {
+		return nil
+	}
+
+	transportCredentials, err := agentCredentials(agentAddress, agentTLS)
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.Dial(agentAddress,
+		grpc.WithTransportCredentials(transportCredentials),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(nftablesAgentCodecName)),
+		grpc.WithUnaryInterceptor(agentMetricsInterceptor),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.Config{BaseDelay: 100 * time.Millisecond, Multiplier: 1.6, Jitter: 0.2, MaxDelay: 10 * time.Second},
+			MinConnectTimeout: agentTimeout,
+		}))
+	if err != nil {
+		return fmt.Errorf("connect nftables agent %v failed, %v", agentAddress, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	agentConn = conn
+	agentConnDial = dial
+	agentCancel = cancel
+	go watchAgentConnection(ctx, conn, agentAddress)
+	conn.Connect()
+
+	timeout := agentTimeout
+	SetNftBackendFactory(func() (NftBackend, error) { return NewAgentBackend(conn, timeout), nil })
+	log.Infof("Nftables apply operations by agent %v", agentAddress)
+	return nil
+}
+
+// StopAgent close the connection to the agent when the last handler stops
+func StopAgent() {
+	agentLock.Lock()
+	defer agentLock.Unlock()
+
+	if agentRefs > 0 {
+		agentRefs -= 1
+	}
+	if agentRefs == 0 && agentConn != nil {
+		closeAgentConnection()
+	}
+}
+
+// closeAgentConnection close the connection to the agent and apply operations in this process again, it must be
+// called with agentLock held
+func closeAgentConnection() {
+	SetNftBackendFactory(nil)
+	agentCancel()
+	agentConn.Close()
+	agentConn = nil
+	agentConnDial = nftablesAgentDial{}
+	agentCancel = nil
+}
+
+// watchAgentConnection log the state changes of the connection to the agent and export whether it's ready
+func watchAgentConnection(ctx context.Context, conn *grpc.ClientConn, address string) {
+	state := conn.GetState()
+	for {
+		agentConnected.Set(0)
+		if state == connectivity.Ready {
+			agentConnected.Set(1)
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			agentConnected.Set(0)
+			return
+		}
+		previous := state
+		state = conn.GetState()
+		if state == connectivity.Ready {
+			log.Infof("Nftables agent %v connected", address)
+		} else if previous == connectivity.Ready {
+			log.Warningf("Nftables agent %v disconnected, reconnecting", address)
+		} else if state == connectivity.TransientFailure {
+			log.Debugf("Nftables agent %v connect failed, retry later", address)
+		}
+	}
+}
+
+func agentMetricsInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	agentRpcDuration.WithLabelValues(method).Observe(float64(time.Since(start).Microseconds()))
+	agentRpcCount.WithLabelValues(method, status.Code(err).String()).Inc()
+	return err
+}
+
+// agentStatusErrno is the errno of kernel errors carried by gRPC status, so the callers can still check
+// ENOENT/EEXIST and transient errors like a local connection
+var agentStatusErrno = map[codes.Code]unix.Errno{
+	codes.NotFound:          unix.ENOENT,
+	codes.AlreadyExists:     unix.EEXIST,
+	codes.ResourceExhausted: unix.ENOBUFS,
+	codes.Aborted:           unix.EBUSY,
+	codes.Unavailable:       unix.EAGAIN,
+	codes.DeadlineExceeded:  unix.EAGAIN,
+	codes.PermissionDenied:  unix.EPERM,
+	codes.InvalidArgument:   unix.EINVAL,
+}
+
+func agentError(err error) error {
+	if err == nil {
+		return nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	if errno, ok := agentStatusErrno[s.Code()]; ok {
+		return fmt.Errorf("nftables agent %v, %w", s.Message(), errno)
+	}
+	return fmt.Errorf("nftables agent %v", s.Message())
+}
+
+func agentStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	for code, errno := range agentStatusErrno {
+		if code != codes.DeadlineExceeded && errors.Is(err, errno) {
+			return status.Error(code, err.Error())
+		}
+	}
+	return status.Error(codes.Unknown, err.Error())
+}
+
+// AgentBackend is a NftBackend which buffers operations and sends them to the agent in one RPC when flushing.
+// Reads are sent immediately.
+type AgentBackend struct {
+	conn    *grpc.ClientConn
+	timeout time.Duration
+	pending []agentOperation
+	// conversion errors of buffered operations, returned by Flush
+	err error
+}
+
+var _ NftBackend = (*AgentBackend)(nil)
+
+func NewAgentBackend(conn *grpc.ClientConn, timeout time.Duration) *AgentBackend {
+	return &AgentBackend{conn: conn, timeout: timeout}
+}
+
+func (backend *AgentBackend) invoke(method string, req interface{}, reply interface{}) error {
+	ctx := context.Background()
+	if backend.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, backend.timeout)
+		defer cancel()
+	}
+	return agentError(backend.conn.Invoke(ctx, "/"+nftablesAgentService+"/"+method, req, reply))
+}
+
+func (backend *AgentBackend) AddTable(table *nftables.Table) *nftables.Table {
+	encoded := toAgentTable(table)
+	backend.pending = append(backend.pending, agentOperation{Op: agentOpAddTable, Table: &encoded})
+	return table
+}
+
+func (backend *AgentBackend) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	var reply agentListTablesReply
+	if err := backend.invoke("ListTables", &agentListTablesRequest{Family: family}, &reply); err != nil {
+		return nil, err
+	}
+	ret := make([]*nftables.Table, 0, len(reply.Tables))
+	for _, table := range reply.Tables {
+		ret = append(ret, table.decode())
+	}
+	return ret, nil
+}
+
+func (backend *AgentBackend) AddSet(set *nftables.Set, elements []nftables.SetElement) error {
+	encoded := toAgentSet(set)
+	backend.pending = append(backend.pending, agentOperation{Op: agentOpAddSet, Set: &encoded, Elements: toAgentElements(elements)})
+	return nil
+}
+
+func (backend *AgentBackend) GetSetByName(table *nftables.Table, name string) (*nftables.Set, error) {
+	var reply agentGetSetReply
+	if err := backend.invoke("GetSet", &agentGetSetRequest{Table: toAgentTable(table), Name: name}, &reply); err != nil {
+		return nil, err
+	}
+	set, err := reply.Set.decode()
+	if err != nil {
+		return nil, err
+	}
+	set.Table = table
+	return set, nil
+}
+
+func (backend *AgentBackend) SetAddElements(set *nftables.Set, elements []nftables.SetElement) error {
+	encoded := toAgentSet(set)
+	backend.pending = append(backend.pending, agentOperation{Op: agentOpAddElements, Set: &encoded, Elements: toAgentElements(elements)})
+	return nil
+}
+
+func (backend *AgentBackend) SetDeleteElements(set *nftables.Set, elements []nftables.SetElement) error {
+	encoded := toAgentSet(set)
+	backend.pending = append(backend.pending, agentOperation{Op: agentOpDeleteElement, Set: &encoded, Elements: toAgentElements(elements)})
+	return nil
+}
+
+func (backend *AgentBackend) GetSetElements(set *nftables.Set) ([]nftables.SetElement, error) {
+	var reply agentGetSetElementsReply
+	if err := backend.invoke("GetSetElements", &agentGetSetElementsRequest{Set: toAgentSet(set)}, &reply); err != nil {
+		return nil, err
+	}
+	return decodeAgentElements(reply.Elements), nil
+}
+
+// AddObj only supports counters, which are the only objects created by this plugin
+func (backend *AgentBackend) AddObj(obj nftables.Obj) nftables.Obj {
+	counter, ok := obj.(*nftables.CounterObj)
+	if !ok {
+		backend.err = fmt.Errorf("object %T not supported by agent", obj)
+		return obj
+	}
+	encoded := agentCounter{Table: toAgentTable(counter.Table), Name: counter.Name, Bytes: counter.Bytes, Packets: counter.Packets}
+	backend.pending = append(backend.pending, agentOperation{Op: agentOpAddCounter, Counter: &encoded})
+	return obj
+}
+
+func (backend *AgentBackend) GetObject(obj nftables.Obj) (nftables.Obj, error) {
+	counter, ok := obj.(*nftables.CounterObj)
+	if !ok {
+		return nil, fmt.Errorf("object %T not supported by agent", obj)
+	}
+	var reply agentGetCounterReply
+	if err := backend.invoke("GetCounter", &agentGetCounterRequest{Counter: agentCounter{Table: toAgentTable(counter.Table), Name: counter.Name}}, &reply); err != nil {
+		return nil, err
+	}
+	return &nftables.CounterObj{Table: counter.Table, Name: reply.Counter.Name, Bytes: reply.Counter.Bytes, Packets: reply.Counter.Packets}, nil
+}
+
+func (backend *AgentBackend) AddRule(rule *nftables.Rule) *nftables.Rule {
+	encoded, err := toAgentRule(rule)
+	if err != nil {
+		backend.err = err
+		return rule
+	}
+	backend.pending = append(backend.pending, agentOperation{Op: agentOpAddRule, Rule: &encoded})
+	return rule
+}
+
+func (backend *AgentBackend) GetRules(table *nftables.Table, chain *nftables.Chain) ([]*nftables.Rule, error) {
+	var reply agentGetRulesReply
+	if err := backend.invoke("GetRules", &agentGetRulesRequest{Table: toAgentTable(table), Chain: chain.Name}, &reply); err != nil {
+		return nil, err
+	}
+	ret := make([]*nftables.Rule, 0, len(reply.Rules))
+	for _, rule := range reply.Rules {
+		decoded, err := rule.decode()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, decoded)
+	}
+	return ret, nil
+}
+
+// Flush send all buffered operations to the agent, which applies them in one transaction
+func (backend *AgentBackend) Flush() error {
+	pending, err := backend.pending, backend.err
+	backend.pending, backend.err = nil, nil
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	return backend.invoke("Flush", &agentFlushRequest{Operations: pending}, &agentEmpty{})
+}
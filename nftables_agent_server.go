@@ -0,0 +1,301 @@
+package coredns_nftables
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/nftables"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NftablesAgentServer applies the operations sent by AgentBackend, it runs in a privileged process on the host
+// while CoreDNS runs unprivileged. Only tables, sets and elements of the tables it's created with can be changed
+// or read, rules and counters are rejected.
+type NftablesAgentServer struct {
+	// serialize transactions like a single netlink connection does
+	lock    sync.Mutex
+	factory func() (NftBackend, error)
+	tables  map[agentTable]bool
+}
+
+// NewNftablesAgentServer returns an agent applying operations on tables by the backends of factory, nil uses the
+// netlink connection to the kernel. Operations on other tables are rejected.
+func NewNftablesAgentServer(factory func() (NftBackend, error), tables ...*nftables.Table) *NftablesAgentServer {
+	ret := &NftablesAgentServer{factory: factory, tables: make(map[agentTable]bool, len(tables))}
+	for _, table := range tables {
+		ret.tables[toAgentTable(table)] = true
+	}
+	return ret
+}
+
+// checkTable returns PermissionDenied if table is not one of the tables of the agent
+func (s *NftablesAgentServer) checkTable(table agentTable) error {
+	if !s.tables[table] {
+		return status.Errorf(codes.PermissionDenied, "table %v %v is not managed by the agent", getFamilyName(table.Family), table.Name)
+	}
+	return nil
+}
+
+// checkOperation returns PermissionDenied unless operation adds a table, a set or elements, or deletes elements,
+// of the tables of the agent
+func (s *NftablesAgentServer) checkOperation(operation *agentOperation) error {
+	switch operation.Op {
+	case agentOpAddTable:
+		if operation.Table != nil {
+			return s.checkTable(*operation.Table)
+		}
+	case agentOpAddSet, agentOpAddElements, agentOpDeleteElement:
+		if operation.Set != nil {
+			return s.checkTable(operation.Set.Table)
+		}
+	default:
+		return status.Errorf(codes.PermissionDenied, "operation %v is not allowed by the agent", operation.Op)
+	}
+	return status.Errorf(codes.InvalidArgument, "operation %v invalid", operation.Op)
+}
+
+// Register add the agent service to server
+func (s *NftablesAgentServer) Register(server *grpc.Server) {
+	server.RegisterService(&nftablesAgentServiceDesc, s)
+}
+
+// open returns a new backend and the function closing it
+func (s *NftablesAgentServer) open() (NftBackend, func(), error) {
+	if s.factory != nil {
+		backend, err := s.factory()
+		return backend, func() {}, err
+	}
+	conn, newNS, err := openSystemNFTConn()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, func() { cleanupSystemNFTConn(newNS) }, nil
+}
+
+// flush replay the operations of request on a new backend and commit them in one transaction
+func (s *NftablesAgentServer) flush(request *agentFlushRequest) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range request.Operations {
+		if err := s.checkOperation(&request.Operations[i]); err != nil {
+			return err
+		}
+	}
+	if agentDeletesElements(request) {
+		if err := checkDestructive("agent delete-elements"); err != nil {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+	}
+
+	backend, closeBackend, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer closeBackend()
+
+	for _, operation := range request.Operations {
+		if err := applyAgentOperation(backend, &operation); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	return backend.Flush()
+}
+
+// agentDeletesElements returns true if request deletes elements which it does not add again, deleting and adding an
+// element in one transaction only refreshes its timeout
+func agentDeletesElements(request *agentFlushRequest) bool {
+	added := make(map[string]bool)
+	for _, operation := range request.Operations {
+		if (operation.Op != agentOpAddSet && operation.Op != agentOpAddElements) || operation.Set == nil {
+			continue
+		}
+		for _, element := range operation.Elements {
+			added[agentElementKey(operation.Set, element.Key)] = true
+		}
+	}
+	for _, operation := range request.Operations {
+		if operation.Op != agentOpDeleteElement || operation.Set == nil {
+			continue
+		}
+		for _, element := range operation.Elements {
+			if !added[agentElementKey(operation.Set, element.Key)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func agentElementKey(set *agentSet, key []byte) string {
+	return fmt.Sprintf("%v %x", trackedSetKey(set.Table.Family, set.Table.Name, set.Name), key)
+}
+
+func applyAgentOperation(backend NftBackend, operation *agentOperation) error {
+	switch operation.Op {
+	case agentOpAddTable:
+		if operation.Table == nil {
+			break
+		}
+		backend.AddTable(operation.Table.decode())
+		return nil
+	case agentOpAddSet, agentOpAddElements, agentOpDeleteElement:
+		if operation.Set == nil {
+			break
+		}
+		set, err := operation.Set.decode()
+		if err != nil {
+			return err
+		}
+		elements := decodeAgentElements(operation.Elements)
+		if operation.Op == agentOpAddSet {
+			return backend.AddSet(set, elements)
+		} else if operation.Op == agentOpAddElements {
+			return backend.SetAddElements(set, elements)
+		}
+		return backend.SetDeleteElements(set, elements)
+	}
+	return fmt.Errorf("operation %v invalid", operation.Op)
+}
+
+// read run fn with a new backend
+func (s *NftablesAgentServer) read(fn func(backend NftBackend) error) error {
+	backend, closeBackend, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer closeBackend()
+	return fn(backend)
+}
+
+func (s *NftablesAgentServer) listTables(request *agentListTablesRequest) (*agentListTablesReply, error) {
+	reply := &agentListTablesReply{Tables: []agentTable{}}
+	return reply, s.read(func(backend NftBackend) error {
+		tables, err := backend.ListTablesOfFamily(request.Family)
+		for _, table := range tables {
+			if s.tables[toAgentTable(table)] {
+				reply.Tables = append(reply.Tables, toAgentTable(table))
+			}
+		}
+		return err
+	})
+}
+
+func (s *NftablesAgentServer) getSet(request *agentGetSetRequest) (*agentGetSetReply, error) {
+	if err := s.checkTable(request.Table); err != nil {
+		return nil, err
+	}
+	reply := &agentGetSetReply{}
+	return reply, s.read(func(backend NftBackend) error {
+		set, err := backend.GetSetByName(request.Table.decode(), request.Name)
+		if err == nil {
+			reply.Set = toAgentSet(set)
+		}
+		return err
+	})
+}
+
+func (s *NftablesAgentServer) getSetElements(request *agentGetSetElementsRequest) (*agentGetSetElementsReply, error) {
+	if err := s.checkTable(request.Set.Table); err != nil {
+		return nil, err
+	}
+	set, err := request.Set.decode()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	reply := &agentGetSetElementsReply{}
+	return reply, s.read(func(backend NftBackend) error {
+		elements, err := backend.GetSetElements(set)
+		reply.Elements = toAgentElements(elements)
+		return err
+	})
+}
+
+func (s *NftablesAgentServer) getCounter(request *agentGetCounterRequest) (*agentGetCounterReply, error) {
+	if err := s.checkTable(request.Counter.Table); err != nil {
+		return nil, err
+	}
+	reply := &agentGetCounterReply{}
+	return reply, s.read(func(backend NftBackend) error {
+		obj, err := backend.GetObject(&nftables.CounterObj{Table: request.Counter.Table.decode(), Name: request.Counter.Name})
+		if err != nil {
+			return err
+		}
+		counter, ok := obj.(*nftables.CounterObj)
+		if !ok {
+			return status.Errorf(codes.NotFound, "object %v is not a counter", request.Counter.Name)
+		}
+		reply.Counter = agentCounter{Table: request.Counter.Table, Name: counter.Name, Bytes: counter.Bytes, Packets: counter.Packets}
+		return nil
+	})
+}
+
+// getRules only returns the handle, position and userdata of rules, expressions of rules not created by this
+// plugin may not be supported by the agent
+func (s *NftablesAgentServer) getRules(request *agentGetRulesRequest) (*agentGetRulesReply, error) {
+	if err := s.checkTable(request.Table); err != nil {
+		return nil, err
+	}
+	reply := &agentGetRulesReply{Rules: []agentRule{}}
+	return reply, s.read(func(backend NftBackend) error {
+		table := request.Table.decode()
+		rules, err := backend.GetRules(table, &nftables.Chain{Name: request.Chain, Table: table})
+		for _, rule := range rules {
+			reply.Rules = append(reply.Rules, agentRule{
+				Table:    request.Table,
+				Chain:    request.Chain,
+				Position: rule.Position,
+				Handle:   rule.Handle,
+				Flags:    rule.Flags,
+				UserData: rule.UserData,
+			})
+		}
+		return err
+	})
+}
+
+// agentUnaryHandler adapts a method of NftablesAgentServer to grpc.MethodDesc
+func agentUnaryHandler[Request any, Reply any](name string, call func(s *NftablesAgentServer, request *Request) (*Reply, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			request := new(Request)
+			if err := dec(request); err != nil {
+				return nil, err
+			}
+			handle := func(ctx context.Context, req interface{}) (interface{}, error) {
+				reply, err := call(srv.(*NftablesAgentServer), req.(*Request))
+				if err != nil {
+					if _, ok := status.FromError(err); !ok {
+						err = agentStatus(err)
+					}
+					return nil, err
+				}
+				return reply, nil
+			}
+			if interceptor == nil {
+				return handle(ctx, request)
+			}
+			return interceptor(ctx, request, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + nftablesAgentService + "/" + name}, handle)
+		},
+	}
+}
+
+var nftablesAgentServiceDesc = grpc.ServiceDesc{
+	ServiceName: nftablesAgentService,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		agentUnaryHandler("Flush", func(s *NftablesAgentServer, request *agentFlushRequest) (*agentEmpty, error) {
+			return &agentEmpty{}, s.flush(request)
+		}),
+		agentUnaryHandler("ListTables", (*NftablesAgentServer).listTables),
+		agentUnaryHandler("GetSet", (*NftablesAgentServer).getSet),
+		agentUnaryHandler("GetSetElements", (*NftablesAgentServer).getSetElements),
+		agentUnaryHandler("GetCounter", (*NftablesAgentServer).getCounter),
+		agentUnaryHandler("GetRules", (*NftablesAgentServer).getRules),
+	},
+	Streams: []grpc.StreamDesc{},
+}
@@ -0,0 +1,208 @@
+package coredns_nftables
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAgentRuleEncoding(t *testing.T) {
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: "coredns_agent"}
+	set := &nftables.Set{Table: table, Name: "AGENT_SET", KeyType: nftables.TypeIPAddr}
+	exprs, err := buildSetCounterExprs(table.Family, set, &NftablesSetCounter{ChainName: "output", CounterName: "agent_counter"})
+	if err != nil {
+		t.Fatalf("Build counter expressions failed, %v", err)
+	}
+
+	rule := &nftables.Rule{Table: table, Chain: &nftables.Chain{Name: "output", Table: table}, Exprs: exprs, UserData: []byte("comment")}
+	encoded, err := toAgentRule(rule)
+	if err != nil {
+		t.Fatalf("Encode rule failed, %v", err)
+	}
+	decoded, err := encoded.decode()
+	if err != nil {
+		t.Fatalf("Decode rule failed, %v", err)
+	}
+	if !reflect.DeepEqual(decoded.Exprs, rule.Exprs) || string(decoded.UserData) != "comment" || decoded.Chain.Name != "output" {
+		t.Errorf("Expected rule %v, but got %v", rule, decoded)
+	}
+
+	keyType, err := nftables.ConcatSetType(nftables.TypeIPAddr, nftables.TypeInetProto, nftables.TypeInetService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decodedType, err := decodeAgentDatatype(keyType.Name); err != nil || !reflect.DeepEqual(decodedType, keyType) {
+		t.Errorf("Expected key type %v, but got %v, %v", keyType, decodedType, err)
+	}
+	if _, err := decodeAgentDatatype("unknown_type"); err == nil {
+		t.Errorf("Expected unknown key type failed")
+	}
+}
+
+func TestAgentBackend(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "agent.sock"))
+	if err != nil {
+		t.Fatalf("Listen failed, %v", err)
+	}
+	server := grpc.NewServer()
+	NewNftablesAgentServer(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil }, &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_agent"}).Register(server)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	SetNftablesAgent("unix://"+listener.Addr().String(), time.Second)
+	if err := StartAgent(); err != nil {
+		t.Fatalf("Start agent failed, %v", err)
+	}
+	ClearCache()
+	defer func() {
+		StopAgent()
+		SetNftablesAgent("", time.Second)
+		ClearCache()
+	}()
+
+	flushes := testutil.ToFloat64(agentRpcCount.WithLabelValues("/"+nftablesAgentService+"/Flush", "OK"))
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+		TableName: "coredns_agent",
+		SetName:   "AGENT_SET",
+		KeyType:   nftables.TypeInvalid,
+		Timeout:   time.Hour,
+	})
+
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.140", "example.org. 60 IN A 192.0.2.141")
+	if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 2 {
+		t.Fatalf("Expected 2 answers applied by agent, but got %v, %v", applied, err)
+	}
+
+	backend := NewMemoryBackend(ruleset)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_agent"}
+	set, err := backend.GetSetByName(table, "AGENT_SET")
+	if err != nil {
+		t.Fatalf("Expected the set is created by agent, but got %v", err)
+	}
+	if elements, _ := backend.GetSetElements(set); len(elements) != 2 {
+		t.Errorf("Expected 2 elements, but got %v", elements)
+	}
+	if count := testutil.ToFloat64(agentRpcCount.WithLabelValues("/"+nftablesAgentService+"/Flush", "OK")); count <= flushes {
+		t.Errorf("Expected flush RPC counted, but got %v", count)
+	}
+
+	agent, _, err := openBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agent.GetSetByName(table, "MISSING_SET"); !errors.Is(err, unix.ENOENT) {
+		t.Errorf("Expected missing set failed with ENOENT, but got %v", err)
+	}
+	agent.SetAddElements(&nftables.Set{Table: table, Name: "MISSING_SET", KeyType: nftables.TypeIPAddr}, []nftables.SetElement{{Key: net.ParseIP("192.0.2.142").To4()}})
+	if err := agent.Flush(); !errors.Is(err, unix.ENOENT) {
+		t.Errorf("Expected flush to missing set failed with ENOENT, but got %v", err)
+	}
+	remote, err := agent.GetSetElements(set)
+	if err != nil || len(remote) != 2 {
+		t.Errorf("Expected 2 elements read by agent, but got %v, %v", remote, err)
+	}
+
+	// RPCs fail with transient errors when the agent is gone, so they can be retried
+	server.Stop()
+	if _, err := agent.GetSetByName(table, "AGENT_SET"); !isTransientError(err) {
+		t.Errorf("Expected transient error when agent stopped, but got %v", err)
+	}
+}
+
+func TestAgentServerRestrictsOperations(t *testing.T) {
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_agent"}
+	server := NewNftablesAgentServer(func() (NftBackend, error) { return NewMemoryBackend(NewMemoryRuleset()), nil }, table)
+	set := &agentSet{Table: toAgentTable(table), Name: "AGENT_SET", KeyType: nftables.TypeIPAddr.Name}
+	other := agentTable{Family: nftables.TableFamilyIPv4, Name: "filter"}
+
+	if err := server.flush(&agentFlushRequest{Operations: []agentOperation{
+		{Op: agentOpAddTable, Table: &set.Table},
+		{Op: agentOpAddSet, Set: set, Elements: []agentElement{{Key: []byte{192, 0, 2, 1}}}},
+	}}); err != nil {
+		t.Fatalf("Expected the set of the agent table added, but got %v", err)
+	}
+	for _, operation := range []agentOperation{
+		{Op: agentOpAddTable, Table: &other},
+		{Op: agentOpAddElements, Set: &agentSet{Table: other, Name: "VPN", KeyType: nftables.TypeIPAddr.Name}},
+		{Op: agentOpAddRule, Rule: &agentRule{Table: set.Table, Chain: "forward"}},
+		{Op: agentOpAddCounter, Counter: &agentCounter{Table: set.Table, Name: "AGENT_SET"}},
+	} {
+		if err := server.flush(&agentFlushRequest{Operations: []agentOperation{operation}}); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("Expected %v %+v denied, but got %v", operation.Op, operation, err)
+		}
+	}
+	if _, err := server.getRules(&agentGetRulesRequest{Table: other, Chain: "forward"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected rules of other tables denied, but got %v", err)
+	}
+}
+
+func TestAgentCredentials(t *testing.T) {
+	if _, err := agentCredentials("unix:///run/coredns-nftables/agent.sock", NftablesAgentTLS{}); err != nil {
+		t.Errorf("Expected unix socket connected without TLS, but got %v", err)
+	}
+	if _, err := agentCredentials("127.0.0.1:9254", NftablesAgentTLS{}); err == nil {
+		t.Errorf("Expected TCP agent without TLS rejected")
+	}
+
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := agentCredentials("127.0.0.1:9254", NftablesAgentTLS{CAFile: path}); err != nil {
+		t.Errorf("Expected TCP agent connected by TLS, but got %v", err)
+	}
+}
+
+func TestAgentReconnectOnChange(t *testing.T) {
+	dir := t.TempDir()
+	defer func() {
+		for agentRefs > 0 {
+			StopAgent()
+		}
+		SetNftablesAgent("", time.Second)
+	}()
+
+	SetNftablesAgent("unix://"+filepath.Join(dir, "first.sock"), time.Second)
+	if err := StartAgent(); err != nil {
+		t.Fatal(err)
+	}
+	first := agentConn
+	// reloading with the same agent keeps the connection
+	if err := StartAgent(); err != nil || agentConn != first {
+		t.Fatalf("Expected the connection kept, but got %v", err)
+	}
+
+	SetNftablesAgent("unix://"+filepath.Join(dir, "second.sock"), time.Second)
+	if err := StartAgent(); err != nil {
+		t.Fatal(err)
+	}
+	if agentConn == first || agentConnDial.address != "unix://"+filepath.Join(dir, "second.sock") {
+		t.Errorf("Expected the agent connected again after the address changed")
+	}
+
+	SetNftablesAgent("", time.Second)
+	if err := StartAgent(); err != nil || agentConn != nil {
+		t.Errorf("Expected the connection closed after the agent removed, but got %v", err)
+	}
+}
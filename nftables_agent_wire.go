@@ -0,0 +1,328 @@
+package coredns_nftables
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/encoding"
+)
+
+// The agent protocol is plain gRPC with JSON messages, so neither side needs generated protobuf code
+const nftablesAgentService = "coredns.nftables.Agent"
+const nftablesAgentCodecName = "nftables-json"
+
+type nftablesAgentCodec struct{}
+
+func (nftablesAgentCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (nftablesAgentCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (nftablesAgentCodec) Name() string                               { return nftablesAgentCodecName }
+
+func init() {
+	encoding.RegisterCodec(nftablesAgentCodec{})
+}
+
+type agentTable struct {
+	Family nftables.TableFamily `json:"family"`
+	Name   string               `json:"name"`
+}
+
+type agentSet struct {
+	Table         agentTable    `json:"table"`
+	Name          string        `json:"name"`
+	Anonymous     bool          `json:"anonymous,omitempty"`
+	Constant      bool          `json:"constant,omitempty"`
+	Interval      bool          `json:"interval,omitempty"`
+	IsMap         bool          `json:"map,omitempty"`
+	HasTimeout    bool          `json:"has_timeout,omitempty"`
+	Concatenation bool          `json:"concatenation,omitempty"`
+	Timeout       time.Duration `json:"timeout,omitempty"`
+	KeyType       string        `json:"key_type"`
+	DataType      string        `json:"data_type,omitempty"`
+}
+
+type agentElement struct {
+	Key         []byte        `json:"key"`
+	Val         []byte        `json:"val,omitempty"`
+	KeyEnd      []byte        `json:"key_end,omitempty"`
+	IntervalEnd bool          `json:"interval_end,omitempty"`
+	Timeout     time.Duration `json:"timeout,omitempty"`
+}
+
+// agentExpr is an expression in its netlink encoding, Data is the payload of NFTA_EXPR_DATA
+type agentExpr struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"`
+}
+
+type agentRule struct {
+	Table    agentTable  `json:"table"`
+	Chain    string      `json:"chain"`
+	Position uint64      `json:"position,omitempty"`
+	Handle   uint64      `json:"handle,omitempty"`
+	Flags    uint32      `json:"flags,omitempty"`
+	Exprs    []agentExpr `json:"exprs,omitempty"`
+	UserData []byte      `json:"userdata,omitempty"`
+}
+
+type agentCounter struct {
+	Table   agentTable `json:"table"`
+	Name    string     `json:"name"`
+	Bytes   uint64     `json:"bytes,omitempty"`
+	Packets uint64     `json:"packets,omitempty"`
+}
+
+const (
+	agentOpAddTable      = "add-table"
+	agentOpAddSet        = "add-set"
+	agentOpAddElements   = "add-elements"
+	agentOpDeleteElement = "delete-elements"
+	agentOpAddCounter    = "add-counter"
+	agentOpAddRule       = "add-rule"
+)
+
+// agentOperation is one buffered operation of a transaction
+type agentOperation struct {
+	Op       string         `json:"op"`
+	Table    *agentTable    `json:"table,omitempty"`
+	Set      *agentSet      `json:"set,omitempty"`
+	Elements []agentElement `json:"elements,omitempty"`
+	Counter  *agentCounter  `json:"counter,omitempty"`
+	Rule     *agentRule     `json:"rule,omitempty"`
+}
+
+type agentFlushRequest struct {
+	Operations []agentOperation `json:"operations"`
+}
+
+type agentEmpty struct{}
+
+type agentListTablesRequest struct {
+	Family nftables.TableFamily `json:"family"`
+}
+
+type agentListTablesReply struct {
+	Tables []agentTable `json:"tables"`
+}
+
+type agentGetSetRequest struct {
+	Table agentTable `json:"table"`
+	Name  string     `json:"name"`
+}
+
+type agentGetSetReply struct {
+	Set agentSet `json:"set"`
+}
+
+type agentGetSetElementsRequest struct {
+	Set agentSet `json:"set"`
+}
+
+type agentGetSetElementsReply struct {
+	Elements []agentElement `json:"elements"`
+}
+
+type agentGetCounterRequest struct {
+	Counter agentCounter `json:"counter"`
+}
+
+type agentGetCounterReply struct {
+	Counter agentCounter `json:"counter"`
+}
+
+type agentGetRulesRequest struct {
+	Table agentTable `json:"table"`
+	Chain string     `json:"chain"`
+}
+
+type agentGetRulesReply struct {
+	Rules []agentRule `json:"rules"`
+}
+
+func toAgentTable(table *nftables.Table) agentTable {
+	return agentTable{Family: table.Family, Name: table.Name}
+}
+
+func (table agentTable) decode() *nftables.Table {
+	return &nftables.Table{Family: table.Family, Name: table.Name}
+}
+
+func toAgentSet(set *nftables.Set) agentSet {
+	return agentSet{
+		Table:         toAgentTable(set.Table),
+		Name:          set.Name,
+		Anonymous:     set.Anonymous,
+		Constant:      set.Constant,
+		Interval:      set.Interval,
+		IsMap:         set.IsMap,
+		HasTimeout:    set.HasTimeout,
+		Concatenation: set.Concatenation,
+		Timeout:       set.Timeout,
+		KeyType:       set.KeyType.Name,
+		DataType:      set.DataType.Name,
+	}
+}
+
+// decodeAgentDatatype returns the datatype of name, concatenated types are joined by ` . ` like nft does
+func decodeAgentDatatype(name string) (nftables.SetDatatype, error) {
+	if len(name) == 0 || name == nftables.TypeInvalid.Name {
+		return nftables.TypeInvalid, nil
+	}
+	types := nftables.ConcatSetTypeElements(nftables.SetDatatype{Name: name})
+	for i, t := range types {
+		if t.Bytes == 0 {
+			return nftables.TypeInvalid, fmt.Errorf("datatype %v not supported", strings.Split(name, " . ")[i])
+		}
+	}
+	if len(types) == 1 {
+		return types[0], nil
+	}
+	return nftables.ConcatSetType(types...)
+}
+
+func (set agentSet) decode() (*nftables.Set, error) {
+	keyType, err := decodeAgentDatatype(set.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	dataType, err := decodeAgentDatatype(set.DataType)
+	if err != nil {
+		return nil, err
+	}
+	return &nftables.Set{
+		Table:         set.Table.decode(),
+		Name:          set.Name,
+		Anonymous:     set.Anonymous,
+		Constant:      set.Constant,
+		Interval:      set.Interval,
+		IsMap:         set.IsMap,
+		HasTimeout:    set.HasTimeout,
+		Concatenation: set.Concatenation,
+		Timeout:       set.Timeout,
+		KeyType:       keyType,
+		DataType:      dataType,
+	}, nil
+}
+
+func toAgentElements(elements []nftables.SetElement) []agentElement {
+	ret := make([]agentElement, 0, len(elements))
+	for _, element := range elements {
+		ret = append(ret, agentElement{
+			Key:         element.Key,
+			Val:         element.Val,
+			KeyEnd:      element.KeyEnd,
+			IntervalEnd: element.IntervalEnd,
+			Timeout:     element.Timeout,
+		})
+	}
+	return ret
+}
+
+func decodeAgentElements(elements []agentElement) []nftables.SetElement {
+	ret := make([]nftables.SetElement, 0, len(elements))
+	for _, element := range elements {
+		ret = append(ret, nftables.SetElement{
+			Key:         element.Key,
+			Val:         element.Val,
+			KeyEnd:      element.KeyEnd,
+			IntervalEnd: element.IntervalEnd,
+			Timeout:     element.Timeout,
+		})
+	}
+	return ret
+}
+
+// Expressions which can be sent to the agent, they are all the expressions used by the rules of this plugin
+var agentExprTypes = map[string]func() expr.Any{
+	"bitwise":   func() expr.Any { return &expr.Bitwise{} },
+	"cmp":       func() expr.Any { return &expr.Cmp{} },
+	"counter":   func() expr.Any { return &expr.Counter{} },
+	"immediate": func() expr.Any { return &expr.Immediate{} },
+	"lookup":    func() expr.Any { return &expr.Lookup{} },
+	"meta":      func() expr.Any { return &expr.Meta{} },
+	"objref":    func() expr.Any { return &expr.Objref{} },
+	"payload":   func() expr.Any { return &expr.Payload{} },
+}
+
+func toAgentExpr(family nftables.TableFamily, e expr.Any) (agentExpr, error) {
+	data, err := expr.Marshal(byte(family), e)
+	if err != nil {
+		return agentExpr{}, err
+	}
+	attributes, err := netlink.UnmarshalAttributes(data)
+	if err != nil {
+		return agentExpr{}, err
+	}
+
+	var ret agentExpr
+	for _, attribute := range attributes {
+		switch attribute.Type & ^uint16(unix.NLA_F_NESTED) {
+		case unix.NFTA_EXPR_NAME:
+			ret.Name = strings.TrimRight(string(attribute.Data), "\x00")
+		case unix.NFTA_EXPR_DATA:
+			ret.Data = attribute.Data
+		}
+	}
+	if _, ok := agentExprTypes[ret.Name]; !ok {
+		return agentExpr{}, fmt.Errorf("expression %v not supported by agent", ret.Name)
+	}
+	return ret, nil
+}
+
+func (e agentExpr) decode(family nftables.TableFamily) (expr.Any, error) {
+	create, ok := agentExprTypes[e.Name]
+	if !ok {
+		return nil, fmt.Errorf("expression %v not supported by agent", e.Name)
+	}
+	ret := create()
+	if err := expr.Unmarshal(byte(family), e.Data, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func toAgentRule(rule *nftables.Rule) (agentRule, error) {
+	ret := agentRule{
+		Table:    toAgentTable(rule.Table),
+		Position: rule.Position,
+		Handle:   rule.Handle,
+		Flags:    rule.Flags,
+		UserData: rule.UserData,
+	}
+	if rule.Chain != nil {
+		ret.Chain = rule.Chain.Name
+	}
+	for _, e := range rule.Exprs {
+		encoded, err := toAgentExpr(rule.Table.Family, e)
+		if err != nil {
+			return ret, err
+		}
+		ret.Exprs = append(ret.Exprs, encoded)
+	}
+	return ret, nil
+}
+
+func (rule agentRule) decode() (*nftables.Rule, error) {
+	table := rule.Table.decode()
+	ret := &nftables.Rule{
+		Table:    table,
+		Chain:    &nftables.Chain{Name: rule.Chain, Table: table},
+		Position: rule.Position,
+		Handle:   rule.Handle,
+		Flags:    rule.Flags,
+		UserData: rule.UserData,
+	}
+	for _, e := range rule.Exprs {
+		decoded, err := e.decode(table.Family)
+		if err != nil {
+			return nil, err
+		}
+		ret.Exprs = append(ret.Exprs, decoded)
+	}
+	return ret, nil
+}
@@ -0,0 +1,194 @@
+package coredns_nftables
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ahoCorasickExact  uint8 = 1
+	ahoCorasickSuffix uint8 = 2
+)
+
+// nftablesDomainAhoCorasick matches domain suffixes by an Aho-Corasick automaton of the patterns as `.<name>`, so
+// a name is matched in one pass over its bytes without splitting labels. Patterns are added before compile, the
+// compiled automaton keeps the transitions of all states in flat slices sorted by byte.
+type nftablesDomainAhoCorasick struct {
+	// the transitions of states while building, released by compile
+	children []map[byte]int32
+	flags    []uint8
+	depth    []int32
+
+	edgeStart []int32
+	edgeLabel []byte
+	edgeNext  []int32
+	fail      []int32
+	// the nearest state matching a pattern in the failure chain of each state, itself included, 0 means none
+	output []int32
+}
+
+func newNftablesDomainAhoCorasick() *nftablesDomainAhoCorasick {
+	return &nftablesDomainAhoCorasick{
+		children: []map[byte]int32{nil},
+		flags:    []uint8{0},
+		depth:    []int32{0},
+	}
+}
+
+// add returns false if pattern is already added, like nftablesDomainTrie
+func (a *nftablesDomainAhoCorasick) add(pattern string) bool {
+	subDomainOnly := strings.HasPrefix(pattern, "*.")
+	if subDomainOnly {
+		pattern = pattern[2:]
+	}
+	name := strings.TrimSuffix(dns.CanonicalName(pattern), ".")
+
+	state := int32(0)
+	// the root pattern is kept for counting, but never matched like the trie
+	if len(name) > 0 {
+		for _, c := range []byte("." + name) {
+			next, ok := a.children[state][c]
+			if !ok {
+				if a.children[state] == nil {
+					a.children[state] = make(map[byte]int32)
+				}
+				next = int32(len(a.flags))
+				a.children[state][c] = next
+				a.children = append(a.children, nil)
+				a.flags = append(a.flags, 0)
+				a.depth = append(a.depth, a.depth[state]+1)
+			}
+			state = next
+		}
+	}
+
+	flags := a.flags[state]
+	added := flags&ahoCorasickSuffix == 0 || (!subDomainOnly && flags&ahoCorasickExact == 0)
+	a.flags[state] |= ahoCorasickSuffix
+	if !subDomainOnly {
+		a.flags[state] |= ahoCorasickExact
+	}
+	return added
+}
+
+// compile build the failure links by breadth first search, no pattern can be added after it
+func (a *nftablesDomainAhoCorasick) compile() {
+	if a.children == nil {
+		return
+	}
+
+	states := len(a.flags)
+	a.edgeStart = make([]int32, states+1)
+	a.fail = make([]int32, states)
+	a.output = make([]int32, states)
+	labels := make([]byte, 0, 64)
+	queue := []int32{0}
+	for i := 0; i < len(queue); i++ {
+		state := queue[i]
+		labels = labels[:0]
+		for c := range a.children[state] {
+			labels = append(labels, c)
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+
+		for _, c := range labels {
+			next := a.children[state][c]
+			if state != 0 {
+				f := a.fail[state]
+				for {
+					if target, ok := a.children[f][c]; ok {
+						a.fail[next] = target
+						break
+					}
+					if f == 0 {
+						break
+					}
+					f = a.fail[f]
+				}
+			}
+			if a.flags[next] != 0 {
+				a.output[next] = next
+			} else {
+				a.output[next] = a.output[a.fail[next]]
+			}
+			queue = append(queue, next)
+		}
+	}
+
+	// states are numbered in the order they are added, so the edges are laid out by state
+	for state := 0; state < states; state++ {
+		a.edgeStart[state] = int32(len(a.edgeLabel))
+		labels = labels[:0]
+		for c := range a.children[state] {
+			labels = append(labels, c)
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+		for _, c := range labels {
+			a.edgeLabel = append(a.edgeLabel, c)
+			a.edgeNext = append(a.edgeNext, a.children[state][c])
+		}
+	}
+	a.edgeStart[states] = int32(len(a.edgeLabel))
+	a.children = nil
+}
+
+// next returns the transition of state by c, or -1
+func (a *nftablesDomainAhoCorasick) next(state int32, c byte) int32 {
+	low, high := a.edgeStart[state], a.edgeStart[state+1]
+	for low < high {
+		middle := (low + high) / 2
+		switch label := a.edgeLabel[middle]; {
+		case label == c:
+			return a.edgeNext[middle]
+		case label < c:
+			low = middle + 1
+		default:
+			high = middle
+		}
+	}
+	return -1
+}
+
+// match feeds `.<name>` in lower case through the automaton without allocation, a pattern matches when it ends at
+// the end of the name: sub domains when it starts after the beginning, the name itself when it's the whole name.
+// It must be called after compile.
+func (a *nftablesDomainAhoCorasick) match(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 {
+		return false
+	}
+
+	state := int32(0)
+	for i := -1; i < len(name); i++ {
+		c := byte('.')
+		if i >= 0 {
+			c = name[i]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+		}
+		for {
+			if next := a.next(state, c); next >= 0 {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = a.fail[state]
+		}
+	}
+
+	length := int32(len(name) + 1)
+	for matched := a.output[state]; matched > 0; matched = a.output[a.fail[matched]] {
+		if a.depth[matched] < length && a.flags[matched]&ahoCorasickSuffix != 0 {
+			return true
+		}
+		if a.depth[matched] == length && a.flags[matched]&ahoCorasickExact != 0 {
+			return true
+		}
+	}
+	return false
+}
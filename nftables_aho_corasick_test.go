@@ -0,0 +1,144 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDomainAhoCorasick(t *testing.T) {
+	patterns := []string{"example.com", "*.cdn.net.", "a.example.com", "Mixed.Case.org", "*.b.c.d", "c.d", "."}
+	trie := newNftablesDomainTrie()
+	automaton := newNftablesDomainAhoCorasick()
+	for _, pattern := range patterns {
+		if trie.add(pattern) != automaton.add(pattern) {
+			t.Errorf("Expected add(%v) returns the same as the trie", pattern)
+		}
+	}
+	for _, pattern := range []string{"example.com.", "*.cdn.net", "cdn.net"} {
+		if trie.add(pattern) != automaton.add(pattern) {
+			t.Errorf("Expected add(%v) again returns the same as the trie", pattern)
+		}
+	}
+	automaton.compile()
+
+	names := []string{"example.com.", "WWW.Example.COM.", "a.b.example.com", "badexample.com.", "cdn.net.", "img.cdn.net.",
+		"com.", ".", "", "mixed.case.org", "x.mixed.case.org.", "b.c.d.", "x.b.c.d.", "c.d.", "xc.d.", "d."}
+	// random names over a small alphabet hit the failure links of overlapping patterns
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		labels := make([]string, 1+random.Intn(4))
+		for j := range labels {
+			labels[j] = []string{"a", "b", "c", "d", "example", "com", "cdn", "net", "xc"}[random.Intn(9)]
+		}
+		names = append(names, strings.Join(labels, ".")+".")
+	}
+	for _, name := range names {
+		if got, expected := automaton.match(name), trie.match(name); got != expected {
+			t.Errorf("Expected aho-corasick match(%q) %v like the trie, but got %v", name, expected, got)
+		}
+	}
+}
+
+func TestDomainMatchEngine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(path, []byte("example.com\n*.cdn.net\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := getDomainFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetDomainMatchEngine(domainMatchEngineTrie)
+
+	if err := SetDomainMatchEngine("regex"); err == nil {
+		t.Errorf("Expected match engine regex not supported")
+	}
+	if err := SetDomainMatchEngine("Aho-Corasick"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := file.index.Load().(nftablesDomainIndexValue).index.(*nftablesDomainAhoCorasick); !ok {
+		t.Fatalf("Expected the loaded file matched by aho-corasick")
+	}
+	if file.Len() != 2 || !file.Match("www.example.com.") || !file.Match("img.cdn.net.") || file.Match("cdn.net.") {
+		t.Errorf("Unexpected match result of %v by aho-corasick", path)
+	}
+}
+
+// benchmarkDomains returns count domains like a blocklist and the names to match, half of them are matched
+func benchmarkDomains(count int) ([]string, []string) {
+	random := rand.New(rand.NewSource(1))
+	word := func() string {
+		letters := make([]byte, 4+random.Intn(8))
+		for i := range letters {
+			letters[i] = byte('a' + random.Intn(26))
+		}
+		return string(letters)
+	}
+	tlds := []string{"com", "net", "org", "io", "cn"}
+	domains := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		domains = append(domains, word()+"."+tlds[random.Intn(len(tlds))])
+	}
+	names := make([]string, 0, 1024)
+	for i := 0; i < 1024; i++ {
+		if i%2 == 0 {
+			names = append(names, "www."+domains[random.Intn(len(domains))]+".")
+		} else {
+			names = append(names, "www."+word()+"."+tlds[random.Intn(len(tlds))]+".")
+		}
+	}
+	return domains, names
+}
+
+func benchmarkDomainIndex(b *testing.B, index nftablesDomainIndex, count int) {
+	domains, names := benchmarkDomains(count)
+	for _, domain := range domains {
+		index.add(domain)
+	}
+	index.compile()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.match(names[i%len(names)])
+	}
+}
+
+func BenchmarkDomainTrie(b *testing.B) {
+	for _, count := range []int{1000, 100000, 500000} {
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			benchmarkDomainIndex(b, newNftablesDomainTrie(), count)
+		})
+	}
+}
+
+func BenchmarkDomainAhoCorasick(b *testing.B) {
+	for _, count := range []int{1000, 100000, 500000} {
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			benchmarkDomainIndex(b, newNftablesDomainAhoCorasick(), count)
+		})
+	}
+}
+
+// BenchmarkDomainRegexp matches by one alternation of all domains, the baseline of matching blocklists by regex
+func BenchmarkDomainRegexp(b *testing.B) {
+	for _, count := range []int{1000, 10000} {
+		b.Run(fmt.Sprint(count), func(b *testing.B) {
+			domains, names := benchmarkDomains(count)
+			quoted := make([]string, 0, len(domains))
+			for _, domain := range domains {
+				quoted = append(quoted, regexp.QuoteMeta(domain))
+			}
+			pattern := regexp.MustCompile(`(^|\.)(` + strings.Join(quoted, "|") + `)\.$`)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pattern.MatchString(names[i%len(names)])
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/google/nftables"
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/miekg/dns"
+)
+
+const (
+	answerDiffAdded   = "added"
+	answerDiffRemoved = "removed"
+	answerDiffChanged = "changed"
+)
+
+var answerDiffLock sync.Mutex = sync.Mutex{}
+
+// The last addresses of qname and type by the order they are seen, nil if the diffing is disabled
+var answerDiffs *simplelru.LRU = nil
+var answerDiffWebhook string = ""
+var answerDiffJournal bool = false
+
+// NftablesAnswerDiffEvent is the JSON body posted to the webhook of answer-diff when the addresses of a domain
+// change. Change is added or removed when addresses are only added or removed, and changed when both.
+type NftablesAnswerDiffEvent struct {
+	Time      string   `json:"time"`
+	Server    string   `json:"server"`
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Change    string   `json:"change"`
+	Added     []string `json:"added,omitempty"`
+	Removed   []string `json:"removed,omitempty"`
+	Addresses []string `json:"addresses"`
+}
+
+// SetAnswerDiff keep the last addresses of at most maxDomains qnames of each type, and emit the events of their
+// changes to the metrics, the webhook(empty url disables it) and the applied elements log if journal is true. 0
+// maxDomains disables it. The addresses are kept when reloading.
+func SetAnswerDiff(maxDomains int, webhook string, journal bool) {
+	answerDiffLock.Lock()
+	defer answerDiffLock.Unlock()
+
+	answerDiffWebhook = webhook
+	answerDiffJournal = journal
+	if maxDomains <= 0 {
+		answerDiffs = nil
+		return
+	}
+	if answerDiffs == nil {
+		answerDiffs, _ = simplelru.NewLRU(maxDomains, nil)
+	} else {
+		answerDiffs.Resize(maxDomains)
+	}
+}
+
+// answerDiffAddresses returns the sorted distinct addresses of type qtype in the answers
+func answerDiffAddresses(r *dns.Msg, qtype uint16) []string {
+	seen := make(map[string]bool)
+	ret := []string{}
+	for _, answer := range r.Answer {
+		var ip net.IP
+		switch rr := answer.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip == nil || answer.Header().Rrtype != qtype || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		ret = append(ret, ip.String())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// compareAnswerDiff returns the addresses in current but not in previous, and the reverse, both are sorted
+func compareAnswerDiff(previous []string, current []string) ([]string, []string) {
+	var added, removed []string
+	i, j := 0, 0
+	for i < len(previous) || j < len(current) {
+		switch {
+		case j >= len(current) || (i < len(previous) && previous[i] < current[j]):
+			removed = append(removed, previous[i])
+			i++
+		case i >= len(previous) || current[j] < previous[i]:
+			added = append(added, current[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return added, removed
+}
+
+// recordAnswerDiff compare the A/AAAA answers of the response with the last ones of the same qname and type. The
+// first response of a qname is the baseline, and responses without addresses of the type are ignored, so that
+// NODATA and failures never look like removals.
+func recordAnswerDiff(ctx context.Context, r *dns.Msg) {
+	if len(r.Question) == 0 || r.Rcode != dns.RcodeSuccess {
+		return
+	}
+	qtype := r.Question[0].Qtype
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return
+	}
+	current := answerDiffAddresses(r, qtype)
+	if len(current) == 0 {
+		return
+	}
+	name := dns.CanonicalName(r.Question[0].Name)
+
+	answerDiffLock.Lock()
+	if answerDiffs == nil {
+		answerDiffLock.Unlock()
+		return
+	}
+	key := name + " " + dns.TypeToString[qtype]
+	value, ok := answerDiffs.Get(key)
+	answerDiffs.Add(key, current)
+	webhook := answerDiffWebhook
+	journal := answerDiffJournal
+	answerDiffLock.Unlock()
+	if !ok {
+		return
+	}
+
+	added, removed := compareAnswerDiff(value.([]string), current)
+	change := answerDiffChanged
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	} else if len(removed) == 0 {
+		change = answerDiffAdded
+	} else if len(added) == 0 {
+		change = answerDiffRemoved
+	}
+	log.Debugf("Addresses of %v %v %v, added %v, removed %v", name, dns.TypeToString[qtype], change, added, removed)
+	answerDiffCount.WithLabelValues(metrics.WithServer(ctx), change).Inc()
+
+	if journal {
+		family := nftables.TableFamilyIPv4
+		if qtype == dns.TypeAAAA {
+			family = nftables.TableFamilyIPv6
+		}
+		writeAnswerDiffJournal("answer-"+answerDiffAdded, family, name, added)
+		writeAnswerDiffJournal("answer-"+answerDiffRemoved, family, name, removed)
+	}
+	if len(webhook) > 0 {
+		event := NftablesAnswerDiffEvent{
+			Time:      time.Now().Format(time.RFC3339),
+			Server:    metrics.WithServer(ctx),
+			Name:      name,
+			Type:      dns.TypeToString[qtype],
+			Change:    change,
+			Added:     added,
+			Removed:   removed,
+			Addresses: current,
+		}
+		enqueueWebhook(webhook, name, &event)
+	}
+}
+
+// writeAnswerDiffJournal write the addresses into the applied elements log, with `-` as the table and set
+func writeAnswerDiffJournal(action string, family nftables.TableFamily, name string, addresses []string) {
+	var elements []NftablesAppliedElement
+	for _, address := range addresses {
+		elements = append(elements, NftablesAppliedElement{Family: family, TableName: "-", SetName: "-", Element: address, Name: name})
+	}
+	WriteAppliedLog(action, elements)
+}
@@ -0,0 +1,82 @@
+package coredns_nftables
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAnswerDiff(t *testing.T) {
+	events := make(chan NftablesAnswerDiffEvent, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event NftablesAnswerDiffEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "applied.log")
+	SetAppliedLog(path, 0, 0)
+	SetAnswerDiff(10, server.URL, true)
+	defer func() {
+		SetAnswerDiff(0, "", false)
+		SetAppliedLog("", 0, 0)
+	}()
+
+	count := func(change string) float64 {
+		return testutil.ToFloat64(answerDiffCount.WithLabelValues("", change))
+	}
+	changed := count(answerDiffChanged)
+
+	recordAnswerDiff(context.Background(), newTestResponse(t, "Example.ORG.", "example.org. 60 IN A 192.0.2.1", "example.org. 60 IN A 192.0.2.2"))
+	// the same addresses in another order and an empty answer are not changes
+	recordAnswerDiff(context.Background(), newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.2", "example.org. 60 IN A 192.0.2.1"))
+	recordAnswerDiff(context.Background(), newTestResponse(t, "example.org."))
+	recordAnswerDiff(context.Background(), newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.2", "example.org. 60 IN A 192.0.2.3"))
+
+	select {
+	case event := <-events:
+		expected := NftablesAnswerDiffEvent{Time: event.Time, Name: "example.org.", Type: "A", Change: answerDiffChanged,
+			Added: []string{"192.0.2.3"}, Removed: []string{"192.0.2.1"}, Addresses: []string{"192.0.2.2", "192.0.2.3"}}
+		if !reflect.DeepEqual(event, expected) {
+			t.Errorf("Expected %+v, but got %+v", expected, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the event posted to the webhook")
+	}
+	if got := count(answerDiffChanged) - changed; got != 1 {
+		t.Errorf("Expected 1 change counted, but got %v", got)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Expected only one event, but got %+v", event)
+	default:
+	}
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 journal lines, but got %q", data)
+	}
+	for i, action := range []string{"answer-added", "answer-removed"} {
+		entry, err := ParseAppliedLogLine(lines[i])
+		if err != nil || entry.Action != action || entry.Name != "example.org." {
+			t.Errorf("Expected %v of example.org. in the journal, but got %+v, %v", action, entry, err)
+		}
+	}
+}
+
+func TestCompareAnswerDiff(t *testing.T) {
+	added, removed := compareAnswerDiff([]string{"a", "c", "e"}, []string{"b", "c", "d", "e", "f"})
+	if !reflect.DeepEqual(added, []string{"b", "d", "f"}) || !reflect.DeepEqual(removed, []string{"a"}) {
+		t.Errorf("Expected b, d, f added and a removed, but got %v and %v", added, removed)
+	}
+}
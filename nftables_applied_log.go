@@ -0,0 +1,219 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// NftablesAppliedElement is one element sent to nftables, it's written into the applied elements log after flush
+type NftablesAppliedElement struct {
+	Family    nftables.TableFamily
+	TableName string
+	SetName   string
+	Element   string
+	Name      string
+	Timeout   time.Duration
+}
+
+type nftablesAppliedLog struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+var appliedLogLock sync.Mutex = sync.Mutex{}
+var appliedLog *nftablesAppliedLog = nil
+
+// SetAppliedLog set the rotating file of applied elements, empty path disables it
+func SetAppliedLog(path string, maxSize int64, maxBackups int) {
+	appliedLogLock.Lock()
+	defer appliedLogLock.Unlock()
+
+	if appliedLog != nil {
+		appliedLog.close()
+	}
+
+	if len(path) == 0 {
+		appliedLog = nil
+		return
+	}
+
+	appliedLog = &nftablesAppliedLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+}
+
+// CloseAppliedLog close the file of applied elements, it will be opened again when writing
+func CloseAppliedLog() {
+	appliedLogLock.Lock()
+	defer appliedLogLock.Unlock()
+
+	if appliedLog != nil {
+		appliedLog.close()
+	}
+}
+
+// WriteAppliedLog write elements into the applied elements log, one line for each element:
+// <RFC3339 time> <action> <family> <table> <set> <element> <name> <timeout seconds> [instance]
+func WriteAppliedLog(action string, elements []NftablesAppliedElement) {
+	if len(elements) == 0 {
+		return
+	}
+
+	appliedLogLock.Lock()
+	writer := appliedLog
+	appliedLogLock.Unlock()
+	if writer == nil {
+		return
+	}
+
+	instance := getAppliedLogInstance()
+	// lines of a fleet are merged by time, so they need to be more precise than seconds
+	now := time.Now().Format(time.RFC3339)
+	if len(instance) > 0 {
+		now = time.Now().Format(time.RFC3339Nano)
+	}
+	var builder strings.Builder
+	for _, element := range elements {
+		fmt.Fprintf(&builder, "%s %s %s %s %s %s %s %d", now, action, getFamilyName(element.Family),
+			element.TableName, element.SetName, element.Element, element.Name, int64(element.Timeout.Seconds()))
+		if len(instance) > 0 {
+			builder.WriteString(" " + instance)
+		}
+		builder.WriteString("\n")
+	}
+
+	err := writer.write([]byte(builder.String()))
+	if err != nil {
+		log.Errorf("Nftables write applied log %v failed. %v", writer.filePath(), err)
+	}
+}
+
+func (l *nftablesAppliedLog) write(data []byte) error {
+	return l.writeWithHeader(nil, data)
+}
+
+// writeWithHeader write data like write, and header before it when data starts a new file
+func (l *nftablesAppliedLog) writeWithHeader(header []byte, data []byte) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// other instances sharing the file may append or rotate it, so the size is read again under the lease
+	if timeout := getAppliedLogLockTimeout(); timeout > 0 {
+		unlock, err := l.acquireLease(timeout)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		l.reopenIfRotated()
+	}
+
+	if l.file != nil && l.maxSize > 0 && l.size+int64(len(data)) > l.maxSize {
+		l.rotate()
+	}
+
+	if l.file == nil {
+		if _, retention := getAppliedLogCompression(); retention > 0 {
+			removeExpiredLogFiles(l.filePath(), retention)
+		}
+		file, err := os.OpenFile(l.filePath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		l.file = file
+		l.size = info.Size()
+	}
+	if l.size == 0 && len(header) > 0 {
+		n, err := l.file.Write(header)
+		l.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// rotate renames <path> to <path>.1, <path>.1 to <path>.2 and so on, files beyond maxBackups are removed. With
+// `log compress gzip` the rotated file is compressed to <path>.1.gz.
+func (l *nftablesAppliedLog) rotate() {
+	l.file.Close()
+	l.file = nil
+	l.size = 0
+
+	path := l.filePath()
+	if l.maxBackups <= 0 {
+		os.Remove(path)
+		return
+	}
+
+	compress, retention := getAppliedLogCompression()
+	os.Remove(rotatedLogPath(path, l.maxBackups))
+	for i := l.maxBackups - 1; i > 0; i-- {
+		from := rotatedLogPath(path, i)
+		os.Rename(from, path+"."+strconv.Itoa(i+1)+strings.TrimPrefix(from, path+"."+strconv.Itoa(i)))
+	}
+	err := os.Rename(path, path+".1")
+	if err != nil {
+		log.Errorf("Nftables rotate applied log %v failed. %v", path, err)
+		return
+	}
+	if compress == appliedLogCompressGzip {
+		if err := compressLogFile(path + ".1"); err != nil {
+			log.Errorf("Nftables compress applied log %v.1 failed. %v", path, err)
+		}
+	}
+	removeExpiredLogFiles(path, retention)
+}
+
+func (l *nftablesAppliedLog) close() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+		l.size = 0
+	}
+}
+
+// parseSize accept a size in bytes with optional K/M/G suffix
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	upper := strings.ToUpper(value)
+	switch {
+	case strings.HasSuffix(upper, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(upper, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(upper, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		upper = upper[:len(upper)-1]
+	}
+
+	ret, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return ret * multiplier, nil
+}
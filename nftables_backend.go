@@ -0,0 +1,139 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netns"
+)
+
+// NftBackend is the nftables operations used by NftablesCache. Operations are buffered until Flush, which sends
+// them in one transaction. *nftables.Conn implements it.
+type NftBackend interface {
+	AddTable(table *nftables.Table) *nftables.Table
+	ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error)
+	AddSet(set *nftables.Set, elements []nftables.SetElement) error
+	GetSetByName(table *nftables.Table, name string) (*nftables.Set, error)
+	SetAddElements(set *nftables.Set, elements []nftables.SetElement) error
+	SetDeleteElements(set *nftables.Set, elements []nftables.SetElement) error
+	GetSetElements(set *nftables.Set) ([]nftables.SetElement, error)
+	AddObj(obj nftables.Obj) nftables.Obj
+	GetObject(obj nftables.Obj) (nftables.Obj, error)
+	AddRule(rule *nftables.Rule) *nftables.Rule
+	GetRules(table *nftables.Table, chain *nftables.Chain) ([]*nftables.Rule, error)
+	Flush() error
+}
+
+var _ NftBackend = (*nftables.Conn)(nil)
+
+var backendFactoryLock sync.Mutex = sync.Mutex{}
+var backendFactory func() (NftBackend, error) = nil
+var backendName string = defaultBackendName
+
+// defaultBackendName is the backend used when `backend` is not set, builds with the netlink_minimal tag use the
+// netlink backend
+var defaultBackendName string = "nftables"
+
+// SetBackend select the backend applying answers by name, nftables, netlink, ipset, script(see SetNftScript) or
+// exec-nft(see SetExecNft)
+func SetBackend(name string) error {
+	switch strings.ToLower(name) {
+	case "nftables", "netlink":
+		SetNftBackendFactory(nil)
+	case "ipset":
+		SetNftBackendFactory(openIpsetBackend)
+	case "script":
+		SetNftBackendFactory(openScriptBackend)
+	case "exec-nft":
+		SetNftBackendFactory(openExecNftBackend)
+	default:
+		return fmt.Errorf("backend %v not supported, use nftables, netlink, ipset, script or exec-nft", name)
+	}
+	backendName = strings.ToLower(name)
+	return nil
+}
+
+// SetNftBackendFactory set the function creating the backend of new connections, nil uses the netlink
+// connection to the kernel
+func SetNftBackendFactory(factory func() (NftBackend, error)) {
+	backendFactoryLock.Lock()
+	defer backendFactoryLock.Unlock()
+
+	backendFactory = factory
+}
+
+// openBackend returns the backend of a new connection, the network namespace must be cleaned up by
+// cleanupSystemNFTConn
+func openBackend() (NftBackend, netns.NsHandle, error) {
+	return openBackendIn(NftablesNetworkNamespace{})
+}
+
+// openBackendIn open a backend to the network namespace ns, the backends of the factory ignore the namespace
+func openBackendIn(ns NftablesNetworkNamespace) (NftBackend, netns.NsHandle, error) {
+	backendFactoryLock.Lock()
+	factory := backendFactory
+	backendFactoryLock.Unlock()
+
+	if factory != nil {
+		backend, err := factory()
+		return backend, 0, err
+	}
+	if backendName == "netlink" {
+		return NewNetlinkBackend(ns), 0, nil
+	}
+	return openSystemNFTConnIn(ns)
+}
+
+// unsupportedBackendOption returns the first option of handler or the background jobs which backend name can not
+// serve, or an empty string if all of them are supported
+func (m *NftablesHandler) unsupportedBackendOption(name string) string {
+	if name != "ipset" && name != "exec-nft" {
+		return ""
+	}
+
+	for _, running := range m.setRules() {
+		if running.rule.Counter != nil {
+			return "counter"
+		}
+		// nft is run in the network namespace of CoreDNS
+		if name == "exec-nft" && !running.rule.Netns.IsDefault() {
+			return "set add element netns"
+		}
+	}
+	if name == "exec-nft" {
+		if kind, _ := GetNetworkNamespace(); len(kind) > 0 {
+			return "netns"
+		}
+		return ""
+	}
+
+	hasService := func(rules map[nftables.TableFamily]*NftablesRuleSet) bool {
+		for _, ruleSet := range rules {
+			if len(ruleSet.RuleAddService) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	if hasService(m.Rules) || (m.Canary != nil && hasService(m.Canary.Rules)) {
+		return "set add service"
+	}
+	for _, group := range m.Groups {
+		if hasService(group.Rules) {
+			return "set add service"
+		}
+	}
+	switch {
+	case driftCheckInterval > 0:
+		return "drift"
+	case reaperInterval > 0:
+		return "reaper"
+	case setSizeInterval > 0:
+		return "set-size"
+	case len(adminAddress) > 0:
+		return "admin"
+	}
+	return ""
+}
@@ -0,0 +1,649 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"golang.org/x/sys/unix"
+)
+
+const defaultExecNftPath = "nft"
+const defaultExecNftTimeout = 5 * time.Second
+
+const (
+	execNftSuccess = "success"
+	execNftFailure = "failure"
+	execNftTimeout = "timeout"
+)
+
+var ErrExecNftUnsupported = errors.New("not supported by exec-nft backend")
+
+var execNftLock sync.Mutex = sync.Mutex{}
+var execNftPath string = defaultExecNftPath
+var execNftTimeoutDuration time.Duration = defaultExecNftTimeout
+var execNftMinInterval time.Duration = 0
+
+// The time the next invocation of nft can start, every invocation reserves a slot of execNftMinInterval
+var execNftNextSlot time.Time
+
+// The messages of strerror nft prints after `Error: Could not process rule:`, mapped back to the errno
+var execNftErrnos = []syscall.Errno{unix.ENOENT, unix.EEXIST, unix.EPERM, unix.EACCES, unix.ENOSPC, unix.ENOMEM,
+	unix.ENFILE, unix.EBUSY, unix.EINVAL, unix.EOPNOTSUPP}
+
+// ExecNftBackend runs the nft binary instead of talking netlink, for systems where the LSM policy blocks netlink
+// sockets of CoreDNS but permits nft. The statements of a transaction are the ones of ScriptBackend, sent to one
+// `nft -f -` when flushing, which nft applies in one transaction. Tables, sets, elements and counters are read
+// back by `nft -j list`. Rules can not be added since their expressions have no nft syntax here.
+type ExecNftBackend struct {
+	pending []string
+	err     error
+}
+
+var _ NftBackend = (*ExecNftBackend)(nil)
+var _ NftElementUserdataBackend = (*ExecNftBackend)(nil)
+var _ NftHandleResolver = (*ExecNftBackend)(nil)
+
+func NewExecNftBackend() *ExecNftBackend {
+	return &ExecNftBackend{}
+}
+
+func openExecNftBackend() (NftBackend, error) {
+	return NewExecNftBackend(), nil
+}
+
+// SetExecNft set the nft binary run by `backend exec-nft`, the timeout of each invocation(including the wait of
+// the rate limit), and the max invocations per second(0 is unlimited)
+func SetExecNft(path string, timeout time.Duration, rate float64) {
+	execNftLock.Lock()
+	defer execNftLock.Unlock()
+
+	execNftPath = path
+	if len(execNftPath) == 0 {
+		execNftPath = defaultExecNftPath
+	}
+	execNftTimeoutDuration = timeout
+	if execNftTimeoutDuration <= 0 {
+		execNftTimeoutDuration = defaultExecNftTimeout
+	}
+	execNftMinInterval = 0
+	if rate > 0 {
+		execNftMinInterval = time.Duration(float64(time.Second) / rate)
+	}
+}
+
+// execNftError returns the error of the output of nft, the errno is wrapped when nft prints its message
+func execNftError(output []byte, err error) error {
+	message := strings.TrimSpace(string(output))
+	if index := strings.IndexByte(message, '\n'); index >= 0 {
+		message = message[:index]
+	}
+	if len(message) == 0 {
+		return fmt.Errorf("nft failed, %w", err)
+	}
+	for _, errno := range execNftErrnos {
+		if strings.Contains(strings.ToLower(message), errno.Error()) {
+			return fmt.Errorf("nft %v, %w", message, errno)
+		}
+	}
+	return fmt.Errorf("nft %v, %v", message, err)
+}
+
+// runNft run nft with args and stdin when the rate limit allows, it returns the stdout
+func runNft(stdin string, args ...string) ([]byte, error) {
+	execNftLock.Lock()
+	path, timeout := execNftPath, execNftTimeoutDuration
+	now := time.Now()
+	start := now
+	if execNftNextSlot.After(start) {
+		start = execNftNextSlot
+	}
+	if start.Sub(now) > timeout {
+		// the slot is kept for the invocations which can wait for it
+		execNftLock.Unlock()
+		execNftCount.WithLabelValues(execNftTimeout).Inc()
+		return nil, fmt.Errorf("nft rate limited for longer than %v, %w", timeout, context.DeadlineExceeded)
+	}
+	execNftNextSlot = start.Add(execNftMinInterval)
+	execNftLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if wait := time.Until(start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			execNftCount.WithLabelValues(execNftTimeout).Inc()
+			return nil, fmt.Errorf("nft rate limited for longer than %v, %w", timeout, ctx.Err())
+		}
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// nft runs in its own process group, so that the children of a wrapper do not keep the output open when it's
+	// killed by the timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		execNftCount.WithLabelValues(execNftFailure).Inc()
+		return nil, fmt.Errorf("run nft failed, %w", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		execNftCount.WithLabelValues(execNftTimeout).Inc()
+		return nil, fmt.Errorf("nft timed out after %v, %w", timeout, ctx.Err())
+	}
+	if err != nil {
+		execNftCount.WithLabelValues(execNftFailure).Inc()
+		return nil, execNftError(stderr.Bytes(), err)
+	}
+	execNftCount.WithLabelValues(execNftSuccess).Inc()
+	return stdout.Bytes(), nil
+}
+
+// listNft returns the objects of kind in the output of `nft -j list <args>`
+func listNft(kind string, args ...string) ([]json.RawMessage, error) {
+	output, err := runNft("", append([]string{"-j", "list"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Nftables []map[string]json.RawMessage `json:"nftables"`
+	}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, fmt.Errorf("nft output invalid, %v", err)
+	}
+	var ret []json.RawMessage
+	for _, object := range result.Nftables {
+		if raw, ok := object[kind]; ok {
+			ret = append(ret, raw)
+		}
+	}
+	return ret, nil
+}
+
+// execNftFamily returns the family of the family name of nft json
+func execNftFamily(name string) nftables.TableFamily {
+	switch name {
+	case "ip":
+		return nftables.TableFamilyIPv4
+	case "ip6":
+		return nftables.TableFamilyIPv6
+	case "inet":
+		return nftables.TableFamilyINet
+	case "arp":
+		return nftables.TableFamilyARP
+	case "bridge":
+		return nftables.TableFamilyBridge
+	case "netdev":
+		return nftables.TableFamilyNetdev
+	}
+	return nftables.TableFamilyUnspecified
+}
+
+// execNftArgs split the target of table into the arguments of nft
+func execNftArgs(table *nftables.Table, names ...string) []string {
+	return append(strings.Fields(scriptTarget(table)), names...)
+}
+
+func (backend *ExecNftBackend) AddTable(table *nftables.Table) *nftables.Table {
+	backend.pending = append(backend.pending, fmt.Sprintf("add table %v", scriptTarget(table)))
+	return table
+}
+
+func (backend *ExecNftBackend) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	objects, err := listNft("table", "tables", strings.Fields(scriptTarget(&nftables.Table{Family: family}))[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*nftables.Table
+	for _, raw := range objects {
+		var table struct {
+			Family string `json:"family"`
+			Name   string `json:"name"`
+		}
+		if err := json.Unmarshal(raw, &table); err != nil {
+			return nil, err
+		}
+		if execNftFamily(table.Family) == family {
+			ret = append(ret, &nftables.Table{Family: family, Name: table.Name})
+		}
+	}
+	return ret, nil
+}
+
+func (backend *ExecNftBackend) AddSet(set *nftables.Set, elements []nftables.SetElement) error {
+	return backend.AddSetWithDescription(set, NftablesSetDescription{}, elements)
+}
+
+// AddSetWithDescription add set with the size and flags of description, see NftSetDescriber
+func (backend *ExecNftBackend) AddSetWithDescription(set *nftables.Set, description NftablesSetDescription, elements []nftables.SetElement) error {
+	backend.pending = append(backend.pending, scriptDescribedSetStatement(set, description))
+	return backend.SetAddElements(set, elements)
+}
+
+// execNftSet is a set or map of nft json
+type execNftSet struct {
+	Name    string            `json:"name"`
+	Handle  uint64            `json:"handle"`
+	Type    json.RawMessage   `json:"type"`
+	Map     json.RawMessage   `json:"map"`
+	Flags   json.RawMessage   `json:"flags"`
+	Timeout uint64            `json:"timeout"`
+	Elem    []json.RawMessage `json:"elem"`
+}
+
+// execNftDatatype returns the datatype of the type of nft json, which is a name or a list of names
+func execNftDatatype(raw json.RawMessage) (nftables.SetDatatype, error) {
+	var names []string
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		names = []string{name}
+	} else if err := json.Unmarshal(raw, &names); err != nil {
+		return nftables.TypeInvalid, fmt.Errorf("type %s invalid, %v", raw, err)
+	}
+
+	var parts []nftables.SetDatatype
+	for _, name := range names {
+		found := false
+		for _, datatype := range netlinkDatatypes {
+			if datatype.Name == name {
+				parts = append(parts, datatype)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nftables.TypeInvalid, fmt.Errorf("type %v %w", name, ErrExecNftUnsupported)
+		}
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return nftables.ConcatSetType(parts...)
+}
+
+// getSet list the set of name, maps are listed by `list map`
+func (backend *ExecNftBackend) getSet(table *nftables.Table, name string) (*execNftSet, error) {
+	objects, err := listNft("set", append([]string{"set"}, execNftArgs(table, name)...)...)
+	if errors.Is(err, unix.ENOENT) {
+		objects, err = listNft("map", append([]string{"map"}, execNftArgs(table, name)...)...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("set %v not found, %w", name, unix.ENOENT)
+	}
+	ret := &execNftSet{}
+	if err := json.Unmarshal(objects[0], ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (backend *ExecNftBackend) GetSetByName(table *nftables.Table, name string) (*nftables.Set, error) {
+	listed, err := backend.getSet(table, name)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &nftables.Set{Table: table, Name: listed.Name}
+	if set.KeyType, err = execNftDatatype(listed.Type); err != nil {
+		return nil, err
+	}
+	set.Concatenation = strings.Contains(set.KeyType.Name, " . ")
+	if len(listed.Map) > 0 {
+		set.IsMap = true
+		if set.DataType, err = execNftDatatype(listed.Map); err != nil {
+			return nil, err
+		}
+	}
+	// a single flag is printed as a string by newer nft
+	var flags []string
+	var flag string
+	if json.Unmarshal(listed.Flags, &flag) == nil {
+		flags = []string{flag}
+	} else {
+		json.Unmarshal(listed.Flags, &flags)
+	}
+	for _, flag := range flags {
+		switch flag {
+		case "constant":
+			set.Constant = true
+		case "interval":
+			set.Interval = true
+		case "timeout":
+			set.HasTimeout = true
+		}
+	}
+	if listed.Timeout > 0 {
+		set.HasTimeout = true
+		set.Timeout = time.Duration(listed.Timeout) * time.Second
+	}
+	return set, nil
+}
+
+func (backend *ExecNftBackend) SetAddElements(set *nftables.Set, elements []nftables.SetElement) error {
+	return backend.SetAddElementsWithUserdata(set, elements, nil)
+}
+
+// SetAddElementsWithUserdata add elements with the comments of userdata
+func (backend *ExecNftBackend) SetAddElementsWithUserdata(set *nftables.Set, elements []nftables.SetElement, userdata [][]byte) error {
+	if statement, ok := scriptElementStatement("add", set, elements, userdata); ok {
+		backend.pending = append(backend.pending, statement)
+	}
+	return nil
+}
+
+func (backend *ExecNftBackend) SetDeleteElements(set *nftables.Set, elements []nftables.SetElement) error {
+	if statement, ok := scriptElementStatement("delete", set, elements, nil); ok {
+		backend.pending = append(backend.pending, statement)
+	}
+	return nil
+}
+
+// execNftTypeValue returns the bytes of one value of datatype in nft json, the reverse of scriptTypeValue
+func execNftTypeValue(datatype nftables.SetDatatype, raw json.RawMessage) ([]byte, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		var number uint64
+		if err := json.Unmarshal(raw, &number); err != nil {
+			return nil, fmt.Errorf("value %s of %v invalid", raw, datatype.Name)
+		}
+		text = strconv.FormatUint(number, 10)
+	}
+
+	switch datatype.Name {
+	case nftables.TypeIPAddr.Name, nftables.TypeIP6Addr.Name:
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, fmt.Errorf("value %v of %v invalid", text, datatype.Name)
+		}
+		if datatype.Name == nftables.TypeIPAddr.Name {
+			return ip.To4(), nil
+		}
+		return ip.To16(), nil
+	case nftables.TypeEtherAddr.Name:
+		return net.ParseMAC(text)
+	case nftables.TypeInetProto.Name:
+		switch text {
+		case "tcp":
+			return []byte{unix.IPPROTO_TCP}, nil
+		case "udp":
+			return []byte{unix.IPPROTO_UDP}, nil
+		}
+	case nftables.TypeIFName.Name, nftables.TypeString.Name:
+		ret := make([]byte, datatype.Bytes)
+		copy(ret, text)
+		return ret, nil
+	}
+
+	number, err := strconv.ParseUint(text, 0, 64)
+	if err != nil {
+		if strings.HasPrefix(text, "0x") {
+			return hex.DecodeString(text[2:])
+		}
+		return nil, fmt.Errorf("value %v of %v invalid", text, datatype.Name)
+	}
+	switch {
+	case datatype.Name == nftables.TypeMark.Name:
+		return binaryutil.NativeEndian.PutUint32(uint32(number)), nil
+	case datatype.Bytes == 1:
+		return []byte{byte(number)}, nil
+	case datatype.Bytes == 2:
+		return binaryutil.BigEndian.PutUint16(uint16(number)), nil
+	case datatype.Bytes == 8:
+		return binaryutil.BigEndian.PutUint64(number), nil
+	}
+	return binaryutil.BigEndian.PutUint32(uint32(number)), nil
+}
+
+// execNftValue returns the bytes of a key or data in nft json, each field of concatenations is padded to 4 bytes
+func execNftValue(datatype nftables.SetDatatype, raw json.RawMessage) ([]byte, error) {
+	if !strings.Contains(datatype.Name, " . ") {
+		return execNftTypeValue(datatype, raw)
+	}
+
+	var concat struct {
+		Concat []json.RawMessage `json:"concat"`
+	}
+	fields := nftables.ConcatSetTypeElements(datatype)
+	if err := json.Unmarshal(raw, &concat); err != nil || len(concat.Concat) != len(fields) {
+		return nil, fmt.Errorf("value %s of %v invalid", raw, datatype.Name)
+	}
+	var ret []byte
+	for i, field := range fields {
+		value, err := execNftTypeValue(field, concat.Concat[i])
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, value...)
+		for len(ret)%4 != 0 {
+			ret = append(ret, 0)
+		}
+	}
+	return ret, nil
+}
+
+// execNftElements returns the elements of one element of nft json, ranges and prefixes are two elements of the
+// start and the end flagged by IntervalEnd like the kernel
+func execNftElements(set *nftables.Set, raw json.RawMessage) ([]nftables.SetElement, error) {
+	var pair []json.RawMessage
+	if json.Unmarshal(raw, &pair) == nil && len(pair) == 2 {
+		ret, err := execNftElements(&nftables.Set{KeyType: set.KeyType, Interval: set.Interval}, pair[0])
+		if err != nil || len(ret) == 0 {
+			return ret, err
+		}
+		ret[0].Val, err = execNftValue(set.DataType, pair[1])
+		return ret, err
+	}
+
+	var options struct {
+		Elem *struct {
+			Val     json.RawMessage `json:"val"`
+			Timeout uint64          `json:"timeout"`
+			Expires uint64          `json:"expires"`
+		} `json:"elem"`
+		Range  []json.RawMessage `json:"range"`
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+	}
+	json.Unmarshal(raw, &options)
+	if options.Elem != nil {
+		ret, err := execNftElements(set, options.Elem.Val)
+		if err == nil && len(ret) > 0 {
+			// the timeout of elements is the remaining timeout like *nftables.Conn
+			ret[0].Timeout = time.Duration(options.Elem.Timeout) * time.Second
+			if options.Elem.Expires > 0 {
+				ret[0].Timeout = time.Duration(options.Elem.Expires) * time.Second
+			}
+		}
+		return ret, err
+	}
+	if options.Prefix != nil {
+		ip := net.ParseIP(options.Prefix.Addr)
+		if ip == nil {
+			return nil, fmt.Errorf("prefix %v invalid", options.Prefix.Addr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return pinElements(&net.IPNet{IP: ip, Mask: net.CIDRMask(options.Prefix.Len, len(ip)*8)}, true), nil
+	}
+	if len(options.Range) == 2 {
+		start, err := execNftValue(set.KeyType, options.Range[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := execNftValue(set.KeyType, options.Range[1])
+		if err != nil {
+			return nil, err
+		}
+		ret := []nftables.SetElement{{Key: start}}
+		for i := len(end) - 1; i >= 0; i-- {
+			end[i] += 1
+			if end[i] != 0 {
+				return append(ret, nftables.SetElement{Key: end, IntervalEnd: true}), nil
+			}
+		}
+		return ret, nil
+	}
+
+	key, err := execNftValue(set.KeyType, raw)
+	if err != nil {
+		return nil, err
+	}
+	return []nftables.SetElement{{Key: key}}, nil
+}
+
+func (backend *ExecNftBackend) GetSetElements(set *nftables.Set) ([]nftables.SetElement, error) {
+	listed, err := backend.getSet(set.Table, set.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []nftables.SetElement
+	for _, raw := range listed.Elem {
+		elements, err := execNftElements(set, raw)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, elements...)
+	}
+	return ret, nil
+}
+
+// AddObj only supports counters, which are the only objects created by this plugin
+func (backend *ExecNftBackend) AddObj(obj nftables.Obj) nftables.Obj {
+	counter, ok := obj.(*nftables.CounterObj)
+	if !ok {
+		backend.err = fmt.Errorf("object %T %w", obj, ErrExecNftUnsupported)
+		return obj
+	}
+	backend.pending = append(backend.pending, fmt.Sprintf("add counter %v %v { packets %d bytes %d }", scriptTarget(counter.Table), counter.Name, counter.Packets, counter.Bytes))
+	return obj
+}
+
+func (backend *ExecNftBackend) GetObject(obj nftables.Obj) (nftables.Obj, error) {
+	counter, ok := obj.(*nftables.CounterObj)
+	if !ok {
+		return nil, fmt.Errorf("object %T %w", obj, ErrExecNftUnsupported)
+	}
+	objects, err := listNft("counter", append([]string{"counter"}, execNftArgs(counter.Table, counter.Name)...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("counter %v not found, %w", counter.Name, unix.ENOENT)
+	}
+	var listed struct {
+		Packets uint64 `json:"packets"`
+		Bytes   uint64 `json:"bytes"`
+	}
+	if err := json.Unmarshal(objects[0], &listed); err != nil {
+		return nil, err
+	}
+	return &nftables.CounterObj{Table: counter.Table, Name: counter.Name, Packets: listed.Packets, Bytes: listed.Bytes}, nil
+}
+
+// AddRule fails the transaction, the expressions of rules have no nft syntax here
+func (backend *ExecNftBackend) AddRule(rule *nftables.Rule) *nftables.Rule {
+	backend.err = fmt.Errorf("rule of chain %v %w", rule.Chain.Name, ErrExecNftUnsupported)
+	return rule
+}
+
+// GetRules returns the rules of chain with their handle and comment
+func (backend *ExecNftBackend) GetRules(table *nftables.Table, chain *nftables.Chain) ([]*nftables.Rule, error) {
+	objects, err := listNft("rule", append([]string{"chain"}, execNftArgs(table, chain.Name)...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*nftables.Rule
+	for _, raw := range objects {
+		var listed struct {
+			Handle  uint64 `json:"handle"`
+			Comment string `json:"comment"`
+		}
+		if err := json.Unmarshal(raw, &listed); err != nil {
+			return nil, err
+		}
+		rule := &nftables.Rule{Table: table, Chain: chain, Handle: listed.Handle}
+		if len(listed.Comment) > 0 {
+			rule.UserData = buildRuleComment(listed.Comment)
+		}
+		ret = append(ret, rule)
+	}
+	return ret, nil
+}
+
+// GetHandle returns the handle of nft json, it returns 0 when the table or set does not exist
+func (backend *ExecNftBackend) GetHandle(family nftables.TableFamily, tableName string, setName string) (uint64, error) {
+	table := &nftables.Table{Family: family, Name: tableName}
+	if len(setName) > 0 {
+		listed, err := backend.getSet(table, setName)
+		if errors.Is(err, unix.ENOENT) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		return listed.Handle, nil
+	}
+
+	objects, err := listNft("table", append([]string{"table"}, execNftArgs(table)...)...)
+	if errors.Is(err, unix.ENOENT) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var listed struct {
+		Handle uint64 `json:"handle"`
+	}
+	if len(objects) == 0 {
+		return 0, nil
+	}
+	err = json.Unmarshal(objects[0], &listed)
+	return listed.Handle, err
+}
+
+// Flush run one `nft -f -` of all statements, nft applies them in one transaction
+func (backend *ExecNftBackend) Flush() error {
+	pending, err := backend.pending, backend.err
+	backend.pending, backend.err = nil, nil
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	_, err = runNft(strings.Join(pending, "\n")+"\n", "-f", "-")
+	return err
+}
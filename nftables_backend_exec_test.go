@@ -0,0 +1,174 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// writeFakeNft writes a fake nft into dir, it appends the scripts of `-f -` into applied.nft and prints the json
+// of the listed objects
+func writeFakeNft(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "nft")
+	script := `#!/bin/sh
+if [ "$1" = "-f" ]; then
+	cat >> ` + filepath.Join(dir, "applied.nft") + `
+	exit 0
+fi
+shift 2
+case "$*" in
+"tables ip")
+	echo '{"nftables": [{"metainfo": {"version": "1.0.2"}}, {"table": {"family": "ip", "name": "coredns_exec", "handle": 3}}]}' ;;
+"table ip coredns_exec")
+	echo '{"nftables": [{"table": {"family": "ip", "name": "coredns_exec", "handle": 3}}]}' ;;
+"set ip coredns_exec EXEC_SET")
+	echo '{"nftables": [{"set": {"family": "ip", "name": "EXEC_SET", "table": "coredns_exec", "type": "ipv4_addr", "handle": 7, "flags": ["interval", "timeout"], "timeout": 3600,
+		"elem": ["192.0.2.1", {"elem": {"val": "192.0.2.2", "timeout": 3600, "expires": 1800, "comment": "coredns:AQ"}}, {"prefix": {"addr": "198.51.100.0", "len": 24}}, {"range": ["203.0.113.10", "203.0.113.20"]}]}}]}' ;;
+"set ip coredns_exec EXEC_WORKLOAD")
+	echo '{"nftables": [{"set": {"family": "ip", "name": "EXEC_WORKLOAD", "table": "coredns_exec", "type": ["ipv4_addr", "mark"], "handle": 8, "elem": [{"concat": ["192.0.2.3", 16]}]}}]}' ;;
+"map ip coredns_exec EXEC_MAP")
+	echo '{"nftables": [{"map": {"family": "ip", "name": "EXEC_MAP", "table": "coredns_exec", "type": "ipv4_addr", "map": "mark", "handle": 9, "flags": "timeout", "elem": [["192.0.2.4", "0x00000020"]]}}]}' ;;
+"counter ip coredns_exec hits")
+	echo '{"nftables": [{"counter": {"family": "ip", "name": "hits", "table": "coredns_exec", "handle": 4, "packets": 12, "bytes": 960}}]}' ;;
+"chain ip coredns_exec input")
+	echo '{"nftables": [{"chain": {"name": "input"}}, {"rule": {"chain": "input", "handle": 5, "comment": "coredns-nftables counter hits"}}]}' ;;
+"set ip coredns_exec SLOW_SET")
+	sleep 2 ;;
+*)
+	echo "Error: Could not process rule: No such file or directory" >&2
+	echo "list $*" >&2
+	exit 1 ;;
+esac
+`
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("Write fake nft failed, %v", err)
+	}
+	return path
+}
+
+func TestExecNftBackend(t *testing.T) {
+	dir := t.TempDir()
+	SetExecNft(writeFakeNft(t, dir), time.Second, 0)
+	SetBackend("exec-nft")
+	ClearCache()
+	defer func() {
+		SetBackend("nftables")
+		SetExecNft("", 0, 0)
+		ClearCache()
+	}()
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+		TableName: "coredns_exec",
+		SetName:   "EXEC_SET",
+		KeyType:   nftables.TypeInvalid,
+		Timeout:   time.Hour,
+	})
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.140")
+	if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 1 {
+		t.Fatalf("Expected 1 answer applied, but got %v, %v", applied, err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "applied.nft"))
+	if !strings.Contains(string(data), "add element ip coredns_exec EXEC_SET { 192.0.2.140 }\n") {
+		t.Errorf("Expected the element applied by nft -f, but got %q", data)
+	}
+
+	backend := NewExecNftBackend()
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_exec"}
+	set, err := backend.GetSetByName(table, "EXEC_SET")
+	if err != nil || !set.Interval || !set.HasTimeout || set.Timeout != time.Hour || set.KeyType.Name != nftables.TypeIPAddr.Name {
+		t.Fatalf("Expected interval set of ipv4_addr with 1h timeout, but got %+v, %v", set, err)
+	}
+	elements, err := backend.GetSetElements(set)
+	if err != nil || len(elements) != 6 {
+		t.Fatalf("Expected 6 elements, but got %v, %v", elements, err)
+	}
+	if !net.IP(elements[1].Key).Equal(net.ParseIP("192.0.2.2")) || elements[1].Timeout != 30*time.Minute {
+		t.Errorf("Expected 192.0.2.2 expiring in 30m, but got %v", elements[1])
+	}
+	if !net.IP(elements[2].Key).Equal(net.ParseIP("198.51.100.0")) || !net.IP(elements[3].Key).Equal(net.ParseIP("198.51.101.0")) ||
+		!elements[3].IntervalEnd || !net.IP(elements[5].Key).Equal(net.ParseIP("203.0.113.21")) || !elements[5].IntervalEnd {
+		t.Errorf("Expected prefix and range as intervals, but got %v", elements[2:])
+	}
+
+	workload, err := backend.GetSetByName(table, "EXEC_WORKLOAD")
+	if err != nil || !workload.Concatenation {
+		t.Fatalf("Expected concatenation, but got %+v, %v", workload, err)
+	}
+	elements, _ = backend.GetSetElements(workload)
+	if len(elements) != 1 || string(elements[0].Key) != string(workloadElementKey(net.ParseIP("192.0.2.3").To4(), 16)) {
+		t.Errorf("Expected 192.0.2.3 . 0x00000010, but got %v", elements)
+	}
+	mapSet, err := backend.GetSetByName(table, "EXEC_MAP")
+	if err != nil || !mapSet.IsMap || !mapSet.HasTimeout || mapSet.DataType.Name != nftables.TypeMark.Name {
+		t.Fatalf("Expected map of mark, but got %+v, %v", mapSet, err)
+	}
+	if elements, _ := backend.GetSetElements(mapSet); len(elements) != 1 || scriptValue(nftables.TypeMark, elements[0].Val) != "0x00000020" {
+		t.Errorf("Expected 192.0.2.4 : 0x00000020, but got %v", elements)
+	}
+
+	if obj, err := backend.GetObject(&nftables.CounterObj{Table: table, Name: "hits"}); err != nil || obj.(*nftables.CounterObj).Packets != 12 {
+		t.Errorf("Expected counter with 12 packets, but got %v, %v", obj, err)
+	}
+	rules, err := backend.GetRules(table, &nftables.Chain{Table: table, Name: "input"})
+	if err != nil || len(rules) != 1 || string(rules[0].UserData) != string(buildRuleComment("coredns-nftables counter hits")) {
+		t.Errorf("Expected the rule of the counter, but got %v, %v", rules, err)
+	}
+	if handle, err := backend.GetHandle(nftables.TableFamilyIPv4, "coredns_exec", "EXEC_SET"); err != nil || handle != 7 {
+		t.Errorf("Expected set handle 7, but got %v, %v", handle, err)
+	}
+	if handle, err := backend.GetHandle(nftables.TableFamilyIPv4, "coredns_missing", ""); err != nil || handle != 0 {
+		t.Errorf("Expected no handle of missing table, but got %v, %v", handle, err)
+	}
+
+	// the errno printed by nft is wrapped
+	if _, err := backend.GetSetByName(table, "EXEC_MISSING"); !errors.Is(err, unix.ENOENT) {
+		t.Errorf("Expected ENOENT, but got %v", err)
+	}
+	backend.AddRule(&nftables.Rule{Table: table, Chain: &nftables.Chain{Table: table, Name: "input"}})
+	if err := backend.Flush(); !errors.Is(err, ErrExecNftUnsupported) {
+		t.Errorf("Expected rules unsupported, but got %v", err)
+	}
+
+	SetExecNft(writeFakeNft(t, dir), 100*time.Millisecond, 0)
+	if _, err := backend.GetSetByName(table, "SLOW_SET"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected nft timed out, but got %v", err)
+	}
+
+	// invocations are spaced by the rate limit
+	SetExecNft(writeFakeNft(t, dir), time.Second, 10)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		backend.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected 3 invocations take 200ms at least, but got %v", elapsed)
+	}
+
+	// invocations which can not get a slot in the timeout fail without reserving it
+	SetExecNft(writeFakeNft(t, dir), 10*time.Millisecond, 1)
+	backend.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	execNftLock.Lock()
+	slot := execNftNextSlot
+	execNftLock.Unlock()
+	if _, err := backend.ListTablesOfFamily(nftables.TableFamilyIPv4); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected rate limited, but got %v", err)
+	}
+	execNftLock.Lock()
+	if !execNftNextSlot.Equal(slot) {
+		t.Errorf("Expected the slot %v kept, but got %v", slot, execNftNextSlot)
+	}
+	execNftLock.Unlock()
+	if cache := (&NftablesCache{NftableConnection: backend}); !cache.healthy() {
+		t.Errorf("Expected exec-nft always healthy without running nft")
+	}
+}
@@ -0,0 +1,436 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// MemoryBackend is an in-memory NftBackend which keeps tables, sets, elements, objects and rules like the kernel,
+// so that the plugin can be tested without root or netlink. Backends created by NewMemoryBackend share state when
+// they share the same MemoryRuleset.
+type MemoryBackend struct {
+	ruleset *MemoryRuleset
+	pending []func(ruleset *MemoryRuleset) error
+}
+
+// MemoryRuleset is the committed state of MemoryBackend
+type MemoryRuleset struct {
+	lock    sync.Mutex
+	tables  map[string]*nftables.Table
+	sets    map[string]*memorySet
+	objects map[string]nftables.Obj
+	rules   map[string][]*nftables.Rule
+	// handles of tables and sets by handleKey, a new handle is assigned when they are created
+	handles    map[string]uint64
+	lastHandle uint64
+
+	// FlushError is returned by the next flushes when it's not nil, and nothing is committed
+	FlushError error
+	// Flushes is how many transactions are committed
+	Flushes int
+}
+
+type memorySet struct {
+	set      *nftables.Set
+	elements map[string]memoryElement
+	// the maximum number of elements like the size of `nft add set`, 0 means no limit
+	size uint32
+	// the dynamic flag of the set, see NftablesSetDescription
+	dynamic bool
+}
+
+type memoryElement struct {
+	element    nftables.SetElement
+	expireTime time.Time
+	// the userdata sent by SetAddElementsWithUserdata
+	userdata []byte
+}
+
+func NewMemoryRuleset() *MemoryRuleset {
+	return &MemoryRuleset{
+		tables:  make(map[string]*nftables.Table),
+		sets:    make(map[string]*memorySet),
+		objects: make(map[string]nftables.Obj),
+		rules:   make(map[string][]*nftables.Rule),
+		handles: make(map[string]uint64),
+	}
+}
+
+func NewMemoryBackend(ruleset *MemoryRuleset) *MemoryBackend {
+	return &MemoryBackend{ruleset: ruleset}
+}
+
+func memoryTableKey(table *nftables.Table) string {
+	return fmt.Sprintf("%v %v", getFamilyName(table.Family), table.Name)
+}
+
+func memorySetKey(table *nftables.Table, name string) string {
+	return trackedSetKey(table.Family, table.Name, name)
+}
+
+func memoryLookupSet(ruleset *MemoryRuleset, set *nftables.Set) (*memorySet, error) {
+	stored, ok := ruleset.sets[memorySetKey(set.Table, set.Name)]
+	if !ok {
+		return nil, fmt.Errorf("set %v %v not found, %w", set.Table.Name, set.Name, unix.ENOENT)
+	}
+	return stored, nil
+}
+
+func (backend *MemoryBackend) AddTable(table *nftables.Table) *nftables.Table {
+	backend.pending = append(backend.pending, func(ruleset *MemoryRuleset) error {
+		if _, ok := ruleset.tables[memoryTableKey(table)]; !ok {
+			ruleset.tables[memoryTableKey(table)] = table
+			ruleset.assignHandle(handleKey(table.Family, table.Name, ""))
+		}
+		return nil
+	})
+	return table
+}
+
+func (backend *MemoryBackend) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	backend.ruleset.lock.Lock()
+	defer backend.ruleset.lock.Unlock()
+
+	var ret []*nftables.Table
+	for _, table := range backend.ruleset.tables {
+		if family == nftables.TableFamilyUnspecified || table.Family == family {
+			ret = append(ret, table)
+		}
+	}
+	return ret, nil
+}
+
+func (backend *MemoryBackend) AddSet(set *nftables.Set, elements []nftables.SetElement) error {
+	return backend.AddSetWithDescription(set, NftablesSetDescription{}, elements)
+}
+
+// AddSetWithDescription create set with the size of description, see NftSetDescriber
+func (backend *MemoryBackend) AddSetWithDescription(set *nftables.Set, description NftablesSetDescription, elements []nftables.SetElement) error {
+	backend.pending = append(backend.pending, func(ruleset *MemoryRuleset) error {
+		if _, ok := ruleset.tables[memoryTableKey(set.Table)]; !ok {
+			return fmt.Errorf("table %v not found, %w", set.Table.Name, unix.ENOENT)
+		}
+		key := memorySetKey(set.Table, set.Name)
+		if _, ok := ruleset.sets[key]; !ok {
+			ruleset.sets[key] = &memorySet{set: set, elements: make(map[string]memoryElement), size: description.Size, dynamic: description.Dynamic}
+			ruleset.assignHandle(key)
+		}
+		return memoryAddElements(ruleset.sets[key], elements, nil)
+	})
+	return nil
+}
+
+func (backend *MemoryBackend) GetSetByName(table *nftables.Table, name string) (*nftables.Set, error) {
+	backend.ruleset.lock.Lock()
+	defer backend.ruleset.lock.Unlock()
+
+	stored, ok := backend.ruleset.sets[memorySetKey(table, name)]
+	if !ok {
+		return nil, fmt.Errorf("set %v %v not found, %w", table.Name, name, unix.ENOENT)
+	}
+	return stored.set, nil
+}
+
+// DelTable delete table with its sets like `nft delete table`
+func (backend *MemoryBackend) DelTable(table *nftables.Table) {
+	backend.pending = append(backend.pending, func(ruleset *MemoryRuleset) error {
+		if _, ok := ruleset.tables[memoryTableKey(table)]; !ok {
+			return fmt.Errorf("table %v not found, %w", table.Name, unix.ENOENT)
+		}
+		delete(ruleset.tables, memoryTableKey(table))
+		delete(ruleset.handles, handleKey(table.Family, table.Name, ""))
+		for key, stored := range ruleset.sets {
+			if memoryTableKey(stored.set.Table) == memoryTableKey(table) {
+				delete(ruleset.sets, key)
+				delete(ruleset.handles, key)
+			}
+		}
+		return nil
+	})
+}
+
+// DelSet delete set like `nft delete set`
+func (backend *MemoryBackend) DelSet(set *nftables.Set) {
+	backend.pending = append(backend.pending, func(ruleset *MemoryRuleset) error {
+		if _, err := memoryLookupSet(ruleset, set); err != nil {
+			return err
+		}
+		delete(ruleset.sets, memorySetKey(set.Table, set.Name))
+		delete(ruleset.handles, memorySetKey(set.Table, set.Name))
+		return nil
+	})
+}
+
+// GetSetSize returns the maximum number of elements of set, see NftSetResizer
+func (backend *MemoryBackend) GetSetSize(set *nftables.Set) (uint32, error) {
+	backend.ruleset.lock.Lock()
+	defer backend.ruleset.lock.Unlock()
+
+	stored, err := memoryLookupSet(backend.ruleset, set)
+	if err != nil {
+		return 0, err
+	}
+	return stored.size, nil
+}
+
+// ResizeSet delete set and create it again with size in one transaction, the elements are kept with their userdata
+// and expire times. See NftSetResizer.
+func (backend *MemoryBackend) ResizeSet(set *nftables.Set, size uint32) error {
+	backend.pending = append(backend.pending, func(ruleset *MemoryRuleset) error {
+		stored, err := memoryLookupSet(ruleset, set)
+		if err != nil {
+			return err
+		}
+		key := memorySetKey(set.Table, set.Name)
+		elements := make(map[string]memoryElement, len(stored.elements))
+		for elementKey, element := range stored.elements {
+			elements[elementKey] = element
+		}
+		ruleset.sets[key] = &memorySet{set: set, elements: elements, size: size, dynamic: stored.dynamic}
+		ruleset.assignHandle(key)
+		return nil
+	})
+	return backend.Flush()
+}
+
+// GetHandle returns the handle assigned when the table or set is created, see NftHandleResolver
+func (backend *MemoryBackend) GetHandle(family nftables.TableFamily, tableName string, setName string) (uint64, error) {
+	backend.ruleset.lock.Lock()
+	defer backend.ruleset.lock.Unlock()
+
+	return backend.ruleset.handles[handleKey(family, tableName, setName)], nil
+}
+
+// assignHandle give a new handle to key, it must be called with lock held
+func (ruleset *MemoryRuleset) assignHandle(key string) {
+	ruleset.lastHandle += 1
+	ruleset.handles[key] = ruleset.lastHandle
+}
+
+// memoryAddElements add elements like the kernel, the timeout and userdata of existing elements are not refreshed
+func memoryAddElements(stored *memorySet, elements []nftables.SetElement, userdata [][]byte) error {
+	now := time.Now()
+	for i, element := range elements {
+		if exists, ok := stored.elements[string(element.Key)]; ok && (exists.expireTime.IsZero() || exists.expireTime.After(now)) {
+			continue
+		}
+
+		if _, ok := stored.elements[string(element.Key)]; !ok && stored.size > 0 && uint32(len(stored.elements)) >= stored.size {
+			return fmt.Errorf("set %v is full, %w", stored.set.Name, unix.ENOSPC)
+		}
+
+		timeout := element.Timeout
+		if timeout <= 0 {
+			timeout = stored.set.Timeout
+		}
+		added := memoryElement{element: element}
+		if i < len(userdata) {
+			added.userdata = userdata[i]
+		}
+		if stored.set.HasTimeout && timeout > 0 {
+			added.element.Timeout = timeout
+			added.expireTime = now.Add(timeout)
+		}
+		stored.elements[string(element.Key)] = added
+	}
+	return nil
+}
+
+func (backend *MemoryBackend) SetAddElements(set *nftables.Set, elements []nftables.SetElement) error {
+	return backend.SetAddElementsWithUserdata(set, elements, nil)
+}
+
+// SetAddElementsWithUserdata add elements like SetAddElements, userdata[i] is stored with elements[i]
+func (backend *MemoryBackend) SetAddElementsWithUserdata(set *nftables.Set, elements []nftables.SetElement, userdata [][]byte) error {
+	backend.pending = append(backend.pending, func(ruleset *MemoryRuleset) error {
+		stored, err := memoryLookupSet(ruleset, set)
+		if err != nil {
+			return err
+		}
+		// like the kernel, timeouts sent by the definition of set are rejected by a set without the timeout flag, for
+		// example when it's recreated by other tools
+		for _, element := range elements {
+			if set.HasTimeout && element.Timeout > 0 && !stored.set.HasTimeout {
+				return fmt.Errorf("set %v has no timeout flag, %w", set.Name, unix.EINVAL)
+			}
+		}
+		return memoryAddElements(stored, elements, userdata)
+	})
+	return nil
+}
+
+func (backend *MemoryBackend) SetDeleteElements(set *nftables.Set, elements []nftables.SetElement) error {
+	backend.pending = append(backend.pending, func(ruleset *MemoryRuleset) error {
+		stored, err := memoryLookupSet(ruleset, set)
+		if err != nil {
+			return err
+		}
+		for _, element := range elements {
+			if _, ok := stored.elements[string(element.Key)]; !ok {
+				return fmt.Errorf("element of set %v not found, %w", set.Name, unix.ENOENT)
+			}
+			delete(stored.elements, string(element.Key))
+		}
+		return nil
+	})
+	return nil
+}
+
+func (backend *MemoryBackend) GetSetElements(set *nftables.Set) ([]nftables.SetElement, error) {
+	backend.ruleset.lock.Lock()
+	defer backend.ruleset.lock.Unlock()
+
+	stored, err := memoryLookupSet(backend.ruleset, set)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ret := make([]nftables.SetElement, 0, len(stored.elements))
+	for key, element := range stored.elements {
+		if !element.expireTime.IsZero() && !element.expireTime.After(now) {
+			delete(stored.elements, key)
+			continue
+		}
+		ret = append(ret, element.element)
+	}
+	return ret, nil
+}
+
+// GetSetElementsUserdata returns the userdata of the living elements of set by key, see NftElementUserdataReader
+func (backend *MemoryBackend) GetSetElementsUserdata(set *nftables.Set) (map[string][]byte, error) {
+	backend.ruleset.lock.Lock()
+	defer backend.ruleset.lock.Unlock()
+
+	stored, err := memoryLookupSet(backend.ruleset, set)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	ret := make(map[string][]byte, len(stored.elements))
+	for key, element := range stored.elements {
+		if element.expireTime.IsZero() || element.expireTime.After(now) {
+			ret[key] = element.userdata
+		}
+	}
+	return ret, nil
+}
+
+// GetElementUserdata returns the userdata of the element keyed by key, nil if it has none
+func (backend *MemoryBackend) GetElementUserdata(set *nftables.Set, key []byte) ([]byte, error) {
+	backend.ruleset.lock.Lock()
+	defer backend.ruleset.lock.Unlock()
+
+	stored, err := memoryLookupSet(backend.ruleset, set)
+	if err != nil {
+		return nil, err
+	}
+	element, ok := stored.elements[string(key)]
+	if !ok || (!element.expireTime.IsZero() && !element.expireTime.After(time.Now())) {
+		return nil, fmt.Errorf("element of set %v not found, %w", set.Name, unix.ENOENT)
+	}
+	return element.userdata, nil
+}
+
+func memoryObjectKey(obj nftables.Obj) string {
+	counter, ok := obj.(*nftables.CounterObj)
+	if !ok {
+		return fmt.Sprintf("%p", obj)
+	}
+	return memorySetKey(counter.Table, counter.Name)
+}
+
+func (backend *MemoryBackend) AddObj(obj nftables.Obj) nftables.Obj {
+	backend.pending = append(backend.pending, func(ruleset *MemoryRuleset) error {
+		ruleset.objects[memoryObjectKey(obj)] = obj
+		return nil
+	})
+	return obj
+}
+
+func (backend *MemoryBackend) GetObject(obj nftables.Obj) (nftables.Obj, error) {
+	backend.ruleset.lock.Lock()
+	defer backend.ruleset.lock.Unlock()
+
+	stored, ok := backend.ruleset.objects[memoryObjectKey(obj)]
+	if !ok {
+		return nil, fmt.Errorf("object not found, %w", unix.ENOENT)
+	}
+	return stored, nil
+}
+
+func (backend *MemoryBackend) AddRule(rule *nftables.Rule) *nftables.Rule {
+	backend.pending = append(backend.pending, func(ruleset *MemoryRuleset) error {
+		key := memorySetKey(rule.Table, rule.Chain.Name)
+		ruleset.rules[key] = append(ruleset.rules[key], rule)
+		return nil
+	})
+	return rule
+}
+
+func (backend *MemoryBackend) GetRules(table *nftables.Table, chain *nftables.Chain) ([]*nftables.Rule, error) {
+	backend.ruleset.lock.Lock()
+	defer backend.ruleset.lock.Unlock()
+
+	return append([]*nftables.Rule{}, backend.ruleset.rules[memorySetKey(table, chain.Name)]...), nil
+}
+
+// Flush commit the buffered operations in one transaction, nothing is committed when any of them failed
+func (backend *MemoryBackend) Flush() error {
+	pending := backend.pending
+	backend.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+
+	backend.ruleset.lock.Lock()
+	defer backend.ruleset.lock.Unlock()
+
+	if backend.ruleset.FlushError != nil {
+		return backend.ruleset.FlushError
+	}
+
+	committed := backend.ruleset.clone()
+	for _, operation := range pending {
+		if err := operation(committed); err != nil {
+			return err
+		}
+	}
+	backend.ruleset.tables = committed.tables
+	backend.ruleset.sets = committed.sets
+	backend.ruleset.objects = committed.objects
+	backend.ruleset.rules = committed.rules
+	backend.ruleset.handles = committed.handles
+	backend.ruleset.lastHandle = committed.lastHandle
+	backend.ruleset.Flushes += 1
+	return nil
+}
+
+// clone copy the state so that a failed transaction can be dropped, it must be called with lock held
+func (ruleset *MemoryRuleset) clone() *MemoryRuleset {
+	ret := NewMemoryRuleset()
+	for key, table := range ruleset.tables {
+		ret.tables[key] = table
+	}
+	for key, stored := range ruleset.sets {
+		elements := make(map[string]memoryElement, len(stored.elements))
+		for elementKey, element := range stored.elements {
+			elements[elementKey] = element
+		}
+		ret.sets[key] = &memorySet{set: stored.set, elements: elements, size: stored.size, dynamic: stored.dynamic}
+	}
+	for key, obj := range ruleset.objects {
+		ret.objects[key] = obj
+	}
+	for key, rules := range ruleset.rules {
+		ret.rules[key] = append([]*nftables.Rule{}, rules...)
+	}
+	for key, handle := range ruleset.handles {
+		ret.handles[key] = handle
+	}
+	ret.lastHandle = ruleset.lastHandle
+	return ret
+}
@@ -0,0 +1,706 @@
+package coredns_nftables
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// NFT_DATA_VERDICT, the data type of verdict maps, see include/uapi/linux/netfilter/nf_tables.h
+const nftDataVerdict = 0xffffff00
+
+var ErrNetlinkUnsupported = errors.New("not supported by netlink backend")
+
+// The datatypes known by the netlink backend, a key type of several datatypes is a concatenation
+var netlinkDatatypes = []nftables.SetDatatype{
+	nftables.TypeVerdict, nftables.TypeNFProto, nftables.TypeInteger, nftables.TypeString, nftables.TypeLLAddr,
+	nftables.TypeIPAddr, nftables.TypeIP6Addr, nftables.TypeEtherAddr, nftables.TypeEtherType, nftables.TypeInetProto,
+	nftables.TypeInetService, nftables.TypeMark, nftables.TypeIFIndex, nftables.TypeIFName, nftables.TypeCTState,
+	nftables.TypeBoolean,
+}
+
+// NetlinkBackend encodes the nf_tables messages by itself instead of google/nftables, for kernels rejecting what
+// the library sends, for example the kernels of old LTS distributions know neither the concat flag nor the
+// description of sets. Only the attributes Linux 4.x knows are sent: sets are created without the description
+// and the concat flag, and a key type of several datatypes is decoded as a concatenation whatever the flags
+// are. Rules are added with their expressions, but listed with only their handle and userdata.
+// Operations are sent in one transaction when flushing, like *nftables.Conn.
+type NetlinkBackend struct {
+	namespace NftablesNetworkNamespace
+	messages  []netlink.Message
+	err       error
+}
+
+var _ NftBackend = (*NetlinkBackend)(nil)
+var _ NftElementUserdataBackend = (*NetlinkBackend)(nil)
+var _ NftHandleResolver = (*NetlinkBackend)(nil)
+var _ NftSetResizer = (*NetlinkBackend)(nil)
+var _ NftElementUserdataReader = (*NetlinkBackend)(nil)
+
+func NewNetlinkBackend(namespace NftablesNetworkNamespace) *NetlinkBackend {
+	return &NetlinkBackend{namespace: namespace}
+}
+
+func netlinkString(value string) []byte {
+	return []byte(value + "\x00")
+}
+
+func netlinkNftMessage(messageType int, flags netlink.HeaderFlags, family nftables.TableFamily, attributes []netlink.Attribute) (netlink.Message, error) {
+	data, err := netlink.MarshalAttributes(attributes)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | messageType),
+			Flags: netlink.Request | flags,
+		},
+		Data: append([]byte{byte(family), unix.NFNETLINK_V0, 0, 0}, data...),
+	}, nil
+}
+
+// queue stage a message of the transaction, the first error is returned by Flush
+func (backend *NetlinkBackend) queue(message netlink.Message, err error) error {
+	if err == nil && message.Data == nil {
+		err = errors.New("marshal message failed")
+	}
+	if err != nil {
+		if backend.err == nil {
+			backend.err = err
+		}
+		return err
+	}
+	backend.messages = append(backend.messages, message)
+	return nil
+}
+
+// execute send one request outside of the transaction and returns the replies of replyType
+func (backend *NetlinkBackend) execute(messageType int, replyType int, dump bool, family nftables.TableFamily, attributes []netlink.Attribute) ([]netlink.Message, error) {
+	flags := netlink.Acknowledge
+	if dump {
+		flags |= netlink.Dump
+	}
+	request, err := netlinkNftMessage(messageType, flags, family, attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialNetfilterIn(backend.namespace, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	messages, err := conn.Execute(request)
+	if err != nil {
+		return nil, err
+	}
+	var ret []netlink.Message
+	for _, message := range messages {
+		if message.Header.Type == netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8|replyType) && len(message.Data) >= 4 {
+			ret = append(ret, message)
+		}
+	}
+	return ret, nil
+}
+
+func netlinkDecoder(message netlink.Message) (*netlink.AttributeDecoder, error) {
+	decoder, err := netlink.NewAttributeDecoder(message.Data[4:])
+	if err != nil {
+		return nil, err
+	}
+	decoder.ByteOrder = binary.BigEndian
+	return decoder, nil
+}
+
+func (backend *NetlinkBackend) AddTable(table *nftables.Table) *nftables.Table {
+	attributes := []netlink.Attribute{
+		{Type: unix.NFTA_TABLE_NAME, Data: netlinkString(table.Name)},
+		{Type: unix.NFTA_TABLE_FLAGS, Data: binaryutil.BigEndian.PutUint32(table.Flags)},
+	}
+	backend.queue(netlinkNftMessage(unix.NFT_MSG_NEWTABLE, netlink.Acknowledge|netlink.Create, table.Family, attributes))
+	return table
+}
+
+func (backend *NetlinkBackend) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	messages, err := backend.execute(unix.NFT_MSG_GETTABLE, unix.NFT_MSG_NEWTABLE, true, family, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*nftables.Table
+	for _, message := range messages {
+		decoder, err := netlinkDecoder(message)
+		if err != nil {
+			return nil, err
+		}
+		table := &nftables.Table{Family: nftables.TableFamily(message.Data[0])}
+		for decoder.Next() {
+			switch decoder.Type() {
+			case unix.NFTA_TABLE_NAME:
+				table.Name = decoder.String()
+			case unix.NFTA_TABLE_FLAGS:
+				table.Flags = decoder.Uint32()
+			case unix.NFTA_TABLE_USE:
+				table.Use = decoder.Uint32()
+			}
+		}
+		if err := decoder.Err(); err != nil {
+			return nil, err
+		}
+		ret = append(ret, table)
+	}
+	return ret, nil
+}
+
+// AddSet create set with the attributes every kernel with nf_tables knows, the concat flag and the description
+// are never sent
+func (backend *NetlinkBackend) AddSet(set *nftables.Set, elements []nftables.SetElement) error {
+	return backend.addSet(set, NftablesSetDescription{}, elements)
+}
+
+// AddSetWithDescription create set with the size and the dynamic flag of description, see NftSetDescriber
+func (backend *NetlinkBackend) AddSetWithDescription(set *nftables.Set, description NftablesSetDescription, elements []nftables.SetElement) error {
+	return backend.addSet(set, description, elements)
+}
+
+// addSet create set, the description with size is sent only when the size is not 0
+func (backend *NetlinkBackend) addSet(set *nftables.Set, description NftablesSetDescription, elements []nftables.SetElement) error {
+	var flags uint32
+	if set.Anonymous {
+		flags |= unix.NFT_SET_ANONYMOUS
+	}
+	if set.Constant {
+		flags |= unix.NFT_SET_CONSTANT
+	}
+	if set.Interval {
+		flags |= unix.NFT_SET_INTERVAL
+	}
+	if set.IsMap {
+		flags |= unix.NFT_SET_MAP
+	}
+	if set.HasTimeout {
+		flags |= unix.NFT_SET_TIMEOUT
+	}
+	if description.Dynamic {
+		flags |= unix.NFT_SET_EVAL
+	}
+	attributes := []netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: netlinkString(set.Table.Name)},
+		{Type: unix.NFTA_SET_NAME, Data: netlinkString(set.Name)},
+		{Type: unix.NFTA_SET_FLAGS, Data: binaryutil.BigEndian.PutUint32(flags)},
+		{Type: unix.NFTA_SET_KEY_TYPE, Data: binaryutil.BigEndian.PutUint32(set.KeyType.GetNFTMagic())},
+		{Type: unix.NFTA_SET_KEY_LEN, Data: binaryutil.BigEndian.PutUint32(set.KeyType.Bytes)},
+		{Type: unix.NFTA_SET_ID, Data: binaryutil.BigEndian.PutUint32(set.ID)},
+	}
+	if set.IsMap {
+		dataType := set.DataType.GetNFTMagic()
+		if set.DataType.Name == nftables.TypeVerdict.Name {
+			dataType = nftDataVerdict
+		}
+		attributes = append(attributes,
+			netlink.Attribute{Type: unix.NFTA_SET_DATA_TYPE, Data: binaryutil.BigEndian.PutUint32(dataType)},
+			netlink.Attribute{Type: unix.NFTA_SET_DATA_LEN, Data: binaryutil.BigEndian.PutUint32(set.DataType.Bytes)})
+	}
+	if set.HasTimeout && set.Timeout != 0 {
+		attributes = append(attributes, netlink.Attribute{Type: unix.NFTA_SET_TIMEOUT, Data: binaryutil.BigEndian.PutUint64(uint64(set.Timeout.Milliseconds()))})
+	}
+	if description.Size > 0 {
+		desc, err := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: unix.NFTA_SET_DESC_SIZE, Data: binaryutil.BigEndian.PutUint32(description.Size)},
+		})
+		if err != nil {
+			return backend.queue(netlink.Message{}, err)
+		}
+		attributes = append(attributes, netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_SET_DESC, Data: desc})
+	}
+	if err := backend.queue(netlinkNftMessage(unix.NFT_MSG_NEWSET, netlink.Acknowledge|netlink.Create, set.Table.Family, attributes)); err != nil {
+		return err
+	}
+	return backend.SetAddElements(set, elements)
+}
+
+// netlinkDatatype returns the datatype of magic, the parts of a concatenation are SetConcatTypeBits each and the
+// first part is in the highest bits
+func netlinkDatatype(magic uint32) (nftables.SetDatatype, bool, error) {
+	var parts []nftables.SetDatatype
+	for bits := magic; bits != 0; bits >>= nftables.SetConcatTypeBits {
+		found := false
+		for _, datatype := range netlinkDatatypes {
+			if datatype.GetNFTMagic() == bits&nftables.SetConcatTypeMask {
+				parts = append([]nftables.SetDatatype{datatype}, parts...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nftables.TypeInvalid, false, fmt.Errorf("datatype %v of magic %#x %w", bits&nftables.SetConcatTypeMask, magic, ErrNetlinkUnsupported)
+		}
+	}
+	if len(parts) == 0 {
+		return nftables.TypeInvalid, false, nil
+	}
+	if len(parts) == 1 {
+		return parts[0], false, nil
+	}
+	datatype, err := nftables.ConcatSetType(parts...)
+	return datatype, true, err
+}
+
+// decodeNetlinkSet returns the set of a NFT_MSG_NEWSET message
+func decodeNetlinkSet(table *nftables.Table, message netlink.Message) (*nftables.Set, error) {
+	decoder, err := netlinkDecoder(message)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &nftables.Set{Table: table}
+	for decoder.Next() {
+		switch decoder.Type() {
+		case unix.NFTA_SET_NAME:
+			set.Name = decoder.String()
+		case unix.NFTA_SET_ID:
+			set.ID = decoder.Uint32()
+		case unix.NFTA_SET_FLAGS:
+			flags := decoder.Uint32()
+			set.Anonymous = flags&unix.NFT_SET_ANONYMOUS != 0
+			set.Constant = flags&unix.NFT_SET_CONSTANT != 0
+			set.Interval = flags&unix.NFT_SET_INTERVAL != 0
+			set.IsMap = flags&unix.NFT_SET_MAP != 0
+			set.HasTimeout = flags&unix.NFT_SET_TIMEOUT != 0
+		case unix.NFTA_SET_TIMEOUT:
+			set.Timeout = time.Duration(decoder.Uint64()) * time.Millisecond
+			set.HasTimeout = true
+		case unix.NFTA_SET_KEY_TYPE:
+			keyType, concatenation, err := netlinkDatatype(decoder.Uint32())
+			if err != nil {
+				return nil, err
+			}
+			set.KeyType = keyType
+			set.Concatenation = concatenation
+		case unix.NFTA_SET_DATA_TYPE:
+			magic := decoder.Uint32()
+			if magic == nftDataVerdict {
+				set.DataType = nftables.TypeVerdict
+				break
+			}
+			dataType, _, err := netlinkDatatype(magic)
+			if err != nil {
+				return nil, err
+			}
+			set.DataType = dataType
+		}
+	}
+	return set, decoder.Err()
+}
+
+func (backend *NetlinkBackend) GetSetByName(table *nftables.Table, name string) (*nftables.Set, error) {
+	messages, err := backend.execute(unix.NFT_MSG_GETSET, unix.NFT_MSG_NEWSET, false, table.Family, []netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: netlinkString(table.Name)},
+		{Type: unix.NFTA_SET_NAME, Data: netlinkString(name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("set %v not found, %w", name, unix.ENOENT)
+	}
+	return decodeNetlinkSet(table, messages[0])
+}
+
+// GetSetSize returns the size in the description of set, 0 if it has none, see NftSetResizer
+func (backend *NetlinkBackend) GetSetSize(set *nftables.Set) (uint32, error) {
+	messages, err := backend.execute(unix.NFT_MSG_GETSET, unix.NFT_MSG_NEWSET, false, set.Table.Family, []netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: netlinkString(set.Table.Name)},
+		{Type: unix.NFTA_SET_NAME, Data: netlinkString(set.Name)},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(messages) == 0 {
+		return 0, fmt.Errorf("set %v not found, %w", set.Name, unix.ENOENT)
+	}
+	decoder, err := netlinkDecoder(messages[0])
+	if err != nil {
+		return 0, err
+	}
+	var size uint32
+	for decoder.Next() {
+		if decoder.Type() != unix.NFTA_SET_DESC {
+			continue
+		}
+		decoder.Nested(func(desc *netlink.AttributeDecoder) error {
+			for desc.Next() {
+				if desc.Type() == unix.NFTA_SET_DESC_SIZE {
+					size = desc.Uint32()
+				}
+			}
+			return nil
+		})
+	}
+	return size, decoder.Err()
+}
+
+// ResizeSet delete set and create it again with the description of size in one transaction, the elements are
+// added again with their userdata and remaining timeouts. The kernel rejects it with EBUSY when the set is
+// referenced by rules. See NftSetResizer.
+func (backend *NetlinkBackend) ResizeSet(set *nftables.Set, size uint32) error {
+	messages, err := backend.execute(unix.NFT_MSG_GETSETELEM, unix.NFT_MSG_NEWSETELEM, true, set.Table.Family, []netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: netlinkString(set.Table.Name)},
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: netlinkString(set.Name)},
+	})
+	if err != nil {
+		return err
+	}
+	var elements []nftables.SetElement
+	var userdata [][]byte
+	for _, message := range messages {
+		decoded, data, err := decodeNetlinkElementsWithUserdata(message)
+		if err != nil {
+			return err
+		}
+		elements = append(elements, decoded...)
+		userdata = append(userdata, data...)
+	}
+
+	backend.queue(netlinkNftMessage(unix.NFT_MSG_DELSET, netlink.Acknowledge, set.Table.Family, []netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: netlinkString(set.Table.Name)},
+		{Type: unix.NFTA_SET_NAME, Data: netlinkString(set.Name)},
+	}))
+	backend.addSet(set, NftablesSetDescription{Size: size}, nil)
+	backend.SetAddElementsWithUserdata(set, elements, userdata)
+	return backend.Flush()
+}
+
+func (backend *NetlinkBackend) SetAddElements(set *nftables.Set, elements []nftables.SetElement) error {
+	if len(elements) == 0 {
+		return nil
+	}
+	return backend.queue(elementListMessage(unix.NFT_MSG_NEWSETELEM, set, elements, nil), nil)
+}
+
+// SetAddElementsWithUserdata add the elements with userdata[i] of elements[i] in the same transaction
+func (backend *NetlinkBackend) SetAddElementsWithUserdata(set *nftables.Set, elements []nftables.SetElement, userdata [][]byte) error {
+	if len(elements) == 0 {
+		return nil
+	}
+	return backend.queue(elementListMessage(unix.NFT_MSG_NEWSETELEM, set, elements, userdata), nil)
+}
+
+func (backend *NetlinkBackend) SetDeleteElements(set *nftables.Set, elements []nftables.SetElement) error {
+	if len(elements) == 0 {
+		return nil
+	}
+	return backend.queue(elementListMessage(unix.NFT_MSG_DELSETELEM, set, elements, nil), nil)
+}
+
+// decodeNetlinkData returns NFTA_DATA_VALUE, or the verdict of NFTA_DATA_VERDICT, of a nested NFTA_DATA_*
+func decodeNetlinkData(decoder *netlink.AttributeDecoder) ([]byte, *expr.Verdict) {
+	var value []byte
+	var verdict *expr.Verdict
+	decoder.Nested(func(data *netlink.AttributeDecoder) error {
+		for data.Next() {
+			switch data.Type() {
+			case unix.NFTA_DATA_VALUE:
+				value = data.Bytes()
+			case unix.NFTA_DATA_VERDICT:
+				verdict = &expr.Verdict{}
+				data.Nested(func(nested *netlink.AttributeDecoder) error {
+					for nested.Next() {
+						switch nested.Type() {
+						case unix.NFTA_VERDICT_CODE:
+							verdict.Kind = expr.VerdictKind(int32(nested.Uint32()))
+						case unix.NFTA_VERDICT_CHAIN:
+							verdict.Chain = nested.String()
+						}
+					}
+					return nil
+				})
+			}
+		}
+		return nil
+	})
+	return value, verdict
+}
+
+// decodeNetlinkElements returns the elements of a NFT_MSG_NEWSETELEM message, the timeout of elements is the
+// remaining timeout like *nftables.Conn
+func decodeNetlinkElements(message netlink.Message) ([]nftables.SetElement, error) {
+	elements, _, err := decodeNetlinkElementsWithUserdata(message)
+	return elements, err
+}
+
+// decodeNetlinkElementsWithUserdata returns the elements of a NFT_MSG_NEWSETELEM message like
+// decodeNetlinkElements, and the NFTA_SET_ELEM_USERDATA of each element, nil if it has none
+func decodeNetlinkElementsWithUserdata(message netlink.Message) ([]nftables.SetElement, [][]byte, error) {
+	decoder, err := netlinkDecoder(message)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ret []nftables.SetElement
+	var userdata [][]byte
+	for decoder.Next() {
+		if decoder.Type() != unix.NFTA_SET_ELEM_LIST_ELEMENTS {
+			continue
+		}
+		decoder.Nested(func(elements *netlink.AttributeDecoder) error {
+			for elements.Next() {
+				if elements.Type() != unix.NFTA_LIST_ELEM {
+					continue
+				}
+				var element nftables.SetElement
+				var data []byte
+				elements.Nested(func(attributes *netlink.AttributeDecoder) error {
+					for attributes.Next() {
+						switch attributes.Type() {
+						case unix.NFTA_SET_ELEM_KEY:
+							element.Key, _ = decodeNetlinkData(attributes)
+						case nftables.NFTA_SET_ELEM_KEY_END:
+							element.KeyEnd, _ = decodeNetlinkData(attributes)
+						case unix.NFTA_SET_ELEM_DATA:
+							element.Val, element.VerdictData = decodeNetlinkData(attributes)
+						case unix.NFTA_SET_ELEM_FLAGS:
+							element.IntervalEnd = attributes.Uint32()&unix.NFT_SET_ELEM_INTERVAL_END != 0
+						case unix.NFTA_SET_ELEM_TIMEOUT:
+							if element.Timeout == 0 {
+								element.Timeout = time.Duration(attributes.Uint64()) * time.Millisecond
+							}
+						case unix.NFTA_SET_ELEM_EXPIRATION:
+							element.Timeout = time.Duration(attributes.Uint64()) * time.Millisecond
+						case unix.NFTA_SET_ELEM_USERDATA:
+							data = attributes.Bytes()
+						}
+					}
+					return nil
+				})
+				ret = append(ret, element)
+				userdata = append(userdata, data)
+			}
+			return nil
+		})
+	}
+	return ret, userdata, decoder.Err()
+}
+
+// GetSetElementsUserdata returns the userdata of the elements of set by key, see NftElementUserdataReader
+func (backend *NetlinkBackend) GetSetElementsUserdata(set *nftables.Set) (map[string][]byte, error) {
+	messages, err := backend.execute(unix.NFT_MSG_GETSETELEM, unix.NFT_MSG_NEWSETELEM, true, set.Table.Family, []netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: netlinkString(set.Table.Name)},
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: netlinkString(set.Name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string][]byte)
+	for _, message := range messages {
+		elements, userdata, err := decodeNetlinkElementsWithUserdata(message)
+		if err != nil {
+			return nil, err
+		}
+		for i, element := range elements {
+			if !element.IntervalEnd {
+				ret[string(element.Key)] = userdata[i]
+			}
+		}
+	}
+	return ret, nil
+}
+
+func (backend *NetlinkBackend) GetSetElements(set *nftables.Set) ([]nftables.SetElement, error) {
+	messages, err := backend.execute(unix.NFT_MSG_GETSETELEM, unix.NFT_MSG_NEWSETELEM, true, set.Table.Family, []netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: netlinkString(set.Table.Name)},
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: netlinkString(set.Name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []nftables.SetElement
+	for _, message := range messages {
+		elements, err := decodeNetlinkElements(message)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, elements...)
+	}
+	return ret, nil
+}
+
+// AddObj only supports counters, which are the only objects created by this plugin
+func (backend *NetlinkBackend) AddObj(obj nftables.Obj) nftables.Obj {
+	counter, ok := obj.(*nftables.CounterObj)
+	if !ok {
+		backend.queue(netlink.Message{}, fmt.Errorf("object %T %w", obj, ErrNetlinkUnsupported))
+		return obj
+	}
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_COUNTER_BYTES, Data: binaryutil.BigEndian.PutUint64(counter.Bytes)},
+		{Type: unix.NFTA_COUNTER_PACKETS, Data: binaryutil.BigEndian.PutUint64(counter.Packets)},
+	})
+	if err != nil {
+		backend.queue(netlink.Message{}, err)
+		return obj
+	}
+	backend.queue(netlinkNftMessage(unix.NFT_MSG_NEWOBJ, netlink.Acknowledge|netlink.Create, counter.Table.Family, []netlink.Attribute{
+		{Type: unix.NFTA_OBJ_TABLE, Data: netlinkString(counter.Table.Name)},
+		{Type: unix.NFTA_OBJ_NAME, Data: netlinkString(counter.Name)},
+		{Type: unix.NFTA_OBJ_TYPE, Data: binaryutil.BigEndian.PutUint32(nftObjectCounter)},
+		{Type: unix.NLA_F_NESTED | unix.NFTA_OBJ_DATA, Data: data},
+	}))
+	return obj
+}
+
+func (backend *NetlinkBackend) GetObject(obj nftables.Obj) (nftables.Obj, error) {
+	counter, ok := obj.(*nftables.CounterObj)
+	if !ok {
+		return nil, fmt.Errorf("object %T %w", obj, ErrNetlinkUnsupported)
+	}
+	messages, err := backend.execute(unix.NFT_MSG_GETOBJ, unix.NFT_MSG_NEWOBJ, false, counter.Table.Family, []netlink.Attribute{
+		{Type: unix.NFTA_OBJ_TABLE, Data: netlinkString(counter.Table.Name)},
+		{Type: unix.NFTA_OBJ_NAME, Data: netlinkString(counter.Name)},
+		{Type: unix.NFTA_OBJ_TYPE, Data: binaryutil.BigEndian.PutUint32(nftObjectCounter)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("counter %v not found, %w", counter.Name, unix.ENOENT)
+	}
+
+	decoder, err := netlinkDecoder(messages[0])
+	if err != nil {
+		return nil, err
+	}
+	ret := &nftables.CounterObj{Table: counter.Table, Name: counter.Name}
+	for decoder.Next() {
+		if decoder.Type() != unix.NFTA_OBJ_DATA {
+			continue
+		}
+		decoder.Nested(func(data *netlink.AttributeDecoder) error {
+			for data.Next() {
+				switch data.Type() {
+				case unix.NFTA_COUNTER_BYTES:
+					ret.Bytes = data.Uint64()
+				case unix.NFTA_COUNTER_PACKETS:
+					ret.Packets = data.Uint64()
+				}
+			}
+			return nil
+		})
+	}
+	return ret, decoder.Err()
+}
+
+// AddRule append rule to its chain, the expressions are marshaled by google/nftables
+func (backend *NetlinkBackend) AddRule(rule *nftables.Rule) *nftables.Rule {
+	expressions := make([]netlink.Attribute, 0, len(rule.Exprs))
+	for _, expression := range rule.Exprs {
+		data, err := expr.Marshal(byte(rule.Table.Family), expression)
+		if err != nil {
+			backend.queue(netlink.Message{}, err)
+			return rule
+		}
+		expressions = append(expressions, netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_LIST_ELEM, Data: data})
+	}
+	data, err := netlink.MarshalAttributes(expressions)
+	if err != nil {
+		backend.queue(netlink.Message{}, err)
+		return rule
+	}
+	attributes := []netlink.Attribute{
+		{Type: unix.NFTA_RULE_TABLE, Data: netlinkString(rule.Table.Name)},
+		{Type: unix.NFTA_RULE_CHAIN, Data: netlinkString(rule.Chain.Name)},
+		{Type: unix.NLA_F_NESTED | unix.NFTA_RULE_EXPRESSIONS, Data: data},
+	}
+	if len(rule.UserData) > 0 {
+		attributes = append(attributes, netlink.Attribute{Type: unix.NFTA_RULE_USERDATA, Data: rule.UserData})
+	}
+	backend.queue(netlinkNftMessage(unix.NFT_MSG_NEWRULE, netlink.Acknowledge|netlink.Create|netlink.Append, rule.Table.Family, attributes))
+	return rule
+}
+
+// GetRules returns the rules of chain with their handle and userdata, the expressions are not decoded
+func (backend *NetlinkBackend) GetRules(table *nftables.Table, chain *nftables.Chain) ([]*nftables.Rule, error) {
+	messages, err := backend.execute(unix.NFT_MSG_GETRULE, unix.NFT_MSG_NEWRULE, true, table.Family, []netlink.Attribute{
+		{Type: unix.NFTA_RULE_TABLE, Data: netlinkString(table.Name)},
+		{Type: unix.NFTA_RULE_CHAIN, Data: netlinkString(chain.Name)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*nftables.Rule
+	for _, message := range messages {
+		decoder, err := netlinkDecoder(message)
+		if err != nil {
+			return nil, err
+		}
+		rule := &nftables.Rule{Table: table, Chain: chain}
+		for decoder.Next() {
+			switch decoder.Type() {
+			case unix.NFTA_RULE_HANDLE:
+				rule.Handle = decoder.Uint64()
+			case unix.NFTA_RULE_POSITION:
+				rule.Position = decoder.Uint64()
+			case unix.NFTA_RULE_USERDATA:
+				rule.UserData = decoder.Bytes()
+			}
+		}
+		if err := decoder.Err(); err != nil {
+			return nil, err
+		}
+		ret = append(ret, rule)
+	}
+	return ret, nil
+}
+
+// GetHandle reads the handle back from the kernel like *nftables.Conn
+func (backend *NetlinkBackend) GetHandle(family nftables.TableFamily, tableName string, setName string) (uint64, error) {
+	return getKernelHandle(backend.namespace, family, tableName, setName)
+}
+
+// Flush send the staged messages in one transaction, nothing is sent if any of them failed to be staged
+func (backend *NetlinkBackend) Flush() error {
+	messages, err := backend.messages, backend.err
+	backend.messages, backend.err = nil, nil
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	conn, err := dialNetfilterIn(backend.namespace, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	batch := []netlink.Message{{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_MSG_BATCH_BEGIN), Flags: netlink.Request},
+		Data:   []byte{0, unix.NFNETLINK_V0, 0, unix.NFNL_SUBSYS_NFTABLES},
+	}}
+	batch = append(batch, messages...)
+	batch = append(batch, netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_MSG_BATCH_END), Flags: netlink.Request},
+		Data:   []byte{0, unix.NFNETLINK_V0, 0, unix.NFNL_SUBSYS_NFTABLES},
+	})
+	if _, err := conn.SendMessages(batch); err != nil {
+		return fmt.Errorf("SendMessages: %w", err)
+	}
+	for range messages {
+		if _, err := conn.Receive(); err != nil {
+			return fmt.Errorf("conn.Receive: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build netlink_minimal
+
+package coredns_nftables
+
+// Builds with the netlink_minimal tag use the netlink backend by default, for the targets where the requirements
+// of google/nftables conflict with the kernel
+func init() {
+	defaultBackendName = "netlink"
+	backendName = defaultBackendName
+}
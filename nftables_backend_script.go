@@ -0,0 +1,348 @@
+package coredns_nftables
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"golang.org/x/sys/unix"
+)
+
+var scriptLock sync.Mutex = sync.Mutex{}
+var scriptWriter *nftablesAppliedLog = nil
+var scriptRuleset *MemoryRuleset = NewMemoryRuleset()
+
+// ScriptBackend appends `nft` statements equivalent to the operations into a script instead of talking to the
+// kernel, so the firewall state can be generated on an air-gapped machine, audited, or replayed by `nft -f`
+// elsewhere. The state written is kept by a MemoryRuleset, so tables and sets are created once like the kernel.
+// Each transaction is written as one block after it's committed, and each new file of the rotating script starts
+// with the tables, sets and counters created before, so every file can be replayed alone.
+type ScriptBackend struct {
+	*MemoryBackend
+	writer  io.Writer
+	pending []string
+}
+
+var _ NftBackend = (*ScriptBackend)(nil)
+
+func NewScriptBackend(ruleset *MemoryRuleset, writer io.Writer) *ScriptBackend {
+	return &ScriptBackend{MemoryBackend: NewMemoryBackend(ruleset), writer: writer}
+}
+
+// SetNftScript set the rotating script written by `backend script`, the state already written is forgotten when
+// the path is changed
+func SetNftScript(path string, maxSize int64, maxBackups int) {
+	scriptLock.Lock()
+	defer scriptLock.Unlock()
+
+	if scriptWriter != nil {
+		scriptWriter.close()
+		if scriptWriter.path != path {
+			scriptRuleset = NewMemoryRuleset()
+		}
+	}
+	scriptWriter = nil
+	if len(path) > 0 {
+		scriptWriter = &nftablesAppliedLog{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	}
+}
+
+func openScriptBackend() (NftBackend, error) {
+	scriptLock.Lock()
+	defer scriptLock.Unlock()
+
+	if scriptWriter == nil {
+		return nil, fmt.Errorf("script file not configured")
+	}
+	return NewScriptBackend(scriptRuleset, scriptWriter), nil
+}
+
+// nftablesHeaderWriter is a writer starting new files with a header, like the rotating file
+type nftablesHeaderWriter interface {
+	// WriteWithHeader write data, and header before it when data starts a new file
+	WriteWithHeader(header []byte, data []byte) (int, error)
+}
+
+// Write let the rotating file be the writer of ScriptBackend, data is written in one piece
+func (l *nftablesAppliedLog) Write(data []byte) (int, error) {
+	return l.WriteWithHeader(nil, data)
+}
+
+// WriteWithHeader write data in one piece, the header is written first when data starts a new file, see
+// nftablesHeaderWriter
+func (l *nftablesAppliedLog) WriteWithHeader(header []byte, data []byte) (int, error) {
+	if err := l.writeWithHeader(header, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// scriptDefinitions returns the statements creating the tables, sets and counters of ruleset, sorted so that the
+// tables are created first
+func scriptDefinitions(ruleset *MemoryRuleset) []string {
+	ruleset.lock.Lock()
+	defer ruleset.lock.Unlock()
+
+	var tables, sets, counters []string
+	for _, table := range ruleset.tables {
+		tables = append(tables, fmt.Sprintf("add table %v", scriptTarget(table)))
+	}
+	for _, stored := range ruleset.sets {
+		sets = append(sets, scriptDescribedSetStatement(stored.set, NftablesSetDescription{Size: stored.size, Dynamic: stored.dynamic}))
+	}
+	for _, obj := range ruleset.objects {
+		if counter, ok := obj.(*nftables.CounterObj); ok {
+			counters = append(counters, fmt.Sprintf("add counter %v %v", scriptTarget(counter.Table), counter.Name))
+		}
+	}
+	sort.Strings(tables)
+	sort.Strings(sets)
+	sort.Strings(counters)
+	return append(append(tables, sets...), counters...)
+}
+
+func scriptSeconds(timeout time.Duration) string {
+	return fmt.Sprintf("%ds", (timeout+time.Second-1)/time.Second)
+}
+
+// scriptTypeValue returns the text of one value of datatype, or the hex of types unknown to nft scripts
+func scriptTypeValue(datatype nftables.SetDatatype, data []byte) string {
+	switch datatype.Name {
+	case nftables.TypeIPAddr.Name, nftables.TypeIP6Addr.Name:
+		return net.IP(data).String()
+	case nftables.TypeInetProto.Name:
+		switch data[0] {
+		case unix.IPPROTO_TCP:
+			return "tcp"
+		case unix.IPPROTO_UDP:
+			return "udp"
+		}
+		return fmt.Sprintf("%d", data[0])
+	case nftables.TypeInetService.Name:
+		return fmt.Sprintf("%d", binary.BigEndian.Uint16(data))
+	case nftables.TypeMark.Name:
+		// marks are in host byte order like workloadElementKey
+		return fmt.Sprintf("0x%08x", binaryutil.NativeEndian.Uint32(data))
+	}
+	return formatElementKey(data)
+}
+
+// scriptValue returns the text of a key or data, each field of concatenations is padded to 4 bytes
+func scriptValue(datatype nftables.SetDatatype, data []byte) string {
+	if !strings.Contains(datatype.Name, " . ") {
+		return scriptTypeValue(datatype, data)
+	}
+
+	var fields []string
+	for _, field := range nftables.ConcatSetTypeElements(datatype) {
+		size := int(field.Bytes)
+		if size%4 != 0 {
+			size += 4 - size%4
+		}
+		if size > len(data) || field.Bytes == 0 {
+			return formatElementKey(data)
+		}
+		fields = append(fields, scriptTypeValue(field, data[:field.Bytes]))
+		data = data[size:]
+	}
+	return strings.Join(fields, " . ")
+}
+
+// scriptElements returns the elements in nft syntax, the start of a range is followed by the element flagged by
+// IntervalEnd, which is the address after the range
+func scriptElements(set *nftables.Set, elements []nftables.SetElement) []string {
+	return scriptElementsWithUserdata(set, elements, nil)
+}
+
+// scriptElementsWithUserdata returns the elements like scriptElements, with the comment carried by userdata[i] of
+// elements[i]
+func scriptElementsWithUserdata(set *nftables.Set, elements []nftables.SetElement, userdata [][]byte) []string {
+	var ret []string
+	for i, element := range elements {
+		if element.IntervalEnd {
+			continue
+		}
+		text := scriptValue(set.KeyType, element.Key)
+		// an address without end is a single address, like the ones of answers
+		if set.Interval && i+1 < len(elements) && elements[i+1].IntervalEnd {
+			text += "-" + scriptValue(set.KeyType, previousAddress(net.IP(elements[i+1].Key)))
+		}
+		if element.Timeout > 0 {
+			text += " timeout " + scriptSeconds(element.Timeout)
+		}
+		if i < len(userdata) {
+			if comment, ok := parseElementComment(userdata[i]); ok {
+				text += fmt.Sprintf(" comment %q", comment)
+			}
+		}
+		if set.IsMap && len(element.Val) > 0 {
+			text += " : " + scriptValue(set.DataType, element.Val)
+		}
+		ret = append(ret, text)
+	}
+	return ret
+}
+
+// scriptTarget returns the family(in nft syntax) and name of table
+func scriptTarget(table *nftables.Table) string {
+	family := getFamilyName(table.Family)
+	switch table.Family {
+	case nftables.TableFamilyIPv4:
+		family = "ip"
+	case nftables.TableFamilyIPv6:
+		family = "ip6"
+	}
+	return fmt.Sprintf("%v %v", family, table.Name)
+}
+
+func (backend *ScriptBackend) AddTable(table *nftables.Table) *nftables.Table {
+	backend.pending = append(backend.pending, fmt.Sprintf("add table %v", scriptTarget(table)))
+	return backend.MemoryBackend.AddTable(table)
+}
+
+// scriptSetStatement returns the statement adding set with its type and flags
+func scriptSetStatement(set *nftables.Set) string {
+	return scriptDescribedSetStatement(set, NftablesSetDescription{})
+}
+
+// scriptDescribedSetStatement returns the statement adding set with its type, flags and the size and flags of
+// description
+func scriptDescribedSetStatement(set *nftables.Set, description NftablesSetDescription) string {
+	kind := "set"
+	definition := []string{"type " + set.KeyType.Name}
+	if set.IsMap {
+		kind = "map"
+		definition[0] += " : " + set.DataType.Name
+	}
+	var flags []string
+	if set.Constant {
+		flags = append(flags, "constant")
+	}
+	if set.Interval {
+		flags = append(flags, "interval")
+	}
+	if set.HasTimeout {
+		flags = append(flags, "timeout")
+	}
+	if description.Dynamic {
+		flags = append(flags, "dynamic")
+	}
+	if len(flags) > 0 {
+		definition = append(definition, "flags "+strings.Join(flags, ","))
+	}
+	if set.HasTimeout && set.Timeout > 0 {
+		definition = append(definition, "timeout "+scriptSeconds(set.Timeout))
+	}
+	if description.Size > 0 {
+		definition = append(definition, fmt.Sprintf("size %v", description.Size))
+	}
+	return fmt.Sprintf("add %v %v %v { %v; }", kind, scriptTarget(set.Table), set.Name, strings.Join(definition, "; "))
+}
+
+func (backend *ScriptBackend) AddSet(set *nftables.Set, elements []nftables.SetElement) error {
+	return backend.AddSetWithDescription(set, NftablesSetDescription{}, elements)
+}
+
+// AddSetWithDescription write the statement adding set with the size and flags of description, see
+// NftSetDescriber
+func (backend *ScriptBackend) AddSetWithDescription(set *nftables.Set, description NftablesSetDescription, elements []nftables.SetElement) error {
+	backend.pending = append(backend.pending, scriptDescribedSetStatement(set, description))
+	backend.queueElements("add", set, elements)
+	return backend.MemoryBackend.AddSetWithDescription(set, description, elements)
+}
+
+func (backend *ScriptBackend) queueElements(command string, set *nftables.Set, elements []nftables.SetElement) {
+	backend.queueElementsWithUserdata(command, set, elements, nil)
+}
+
+func (backend *ScriptBackend) queueElementsWithUserdata(command string, set *nftables.Set, elements []nftables.SetElement, userdata [][]byte) {
+	if statement, ok := scriptElementStatement(command, set, elements, userdata); ok {
+		backend.pending = append(backend.pending, statement)
+	}
+}
+
+// scriptElementStatement returns the statement of command(add or delete) of elements, it returns false if there
+// is no element
+func scriptElementStatement(command string, set *nftables.Set, elements []nftables.SetElement, userdata [][]byte) (string, bool) {
+	texts := scriptElementsWithUserdata(set, elements, userdata)
+	if len(texts) == 0 {
+		return "", false
+	}
+	return fmt.Sprintf("%v element %v %v { %v }", command, scriptTarget(set.Table), set.Name, strings.Join(texts, ", ")), true
+}
+
+func (backend *ScriptBackend) SetAddElements(set *nftables.Set, elements []nftables.SetElement) error {
+	backend.queueElements("add", set, elements)
+	return backend.MemoryBackend.SetAddElements(set, elements)
+}
+
+// SetAddElementsWithUserdata add elements like SetAddElements, the comments of userdata are written with them
+func (backend *ScriptBackend) SetAddElementsWithUserdata(set *nftables.Set, elements []nftables.SetElement, userdata [][]byte) error {
+	backend.queueElementsWithUserdata("add", set, elements, userdata)
+	return backend.MemoryBackend.SetAddElementsWithUserdata(set, elements, userdata)
+}
+
+func (backend *ScriptBackend) SetDeleteElements(set *nftables.Set, elements []nftables.SetElement) error {
+	backend.queueElements("delete", set, elements)
+	return backend.MemoryBackend.SetDeleteElements(set, elements)
+}
+
+func (backend *ScriptBackend) AddObj(obj nftables.Obj) nftables.Obj {
+	if counter, ok := obj.(*nftables.CounterObj); ok {
+		backend.pending = append(backend.pending, fmt.Sprintf("add counter %v %v", scriptTarget(counter.Table), counter.Name))
+	}
+	return backend.MemoryBackend.AddObj(obj)
+}
+
+// AddRule writes only a comment, the expressions of rules have no nft syntax here
+func (backend *ScriptBackend) AddRule(rule *nftables.Rule) *nftables.Rule {
+	backend.pending = append(backend.pending, fmt.Sprintf("# rule of chain %v %v with %v expression(s) not exported", scriptTarget(rule.Table), rule.Chain.Name, len(rule.Exprs)))
+	return backend.MemoryBackend.AddRule(rule)
+}
+
+// Flush commit the operations to the ruleset and append their statements to the script, nothing is written when
+// the transaction failed
+func (backend *ScriptBackend) Flush() error {
+	pending := backend.pending
+	backend.pending = nil
+	headerWriter, rotating := backend.writer.(nftablesHeaderWriter)
+	var definitions []string
+	if rotating && len(pending) > 0 {
+		// the definitions before this transaction, the ones of this transaction are in its block
+		definitions = scriptDefinitions(backend.ruleset)
+	}
+	if err := backend.MemoryBackend.Flush(); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "# %v\n", now)
+	for _, statement := range pending {
+		builder.WriteString(statement + "\n")
+	}
+	if !rotating {
+		_, err := backend.writer.Write([]byte(builder.String()))
+		return err
+	}
+
+	var header strings.Builder
+	if len(definitions) > 0 {
+		fmt.Fprintf(&header, "# %v definitions\n", now)
+		for _, statement := range definitions {
+			header.WriteString(statement + "\n")
+		}
+	}
+	_, err := headerWriter.WriteWithHeader([]byte(header.String()), []byte(builder.String()))
+	return err
+}
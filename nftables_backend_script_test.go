@@ -0,0 +1,178 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+func TestScriptBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coredns.nft")
+	SetNftScript(path, 0, 0)
+	SetBackend("script")
+	ClearCache()
+	defer func() {
+		SetBackend("nftables")
+		SetNftScript("", 0, 0)
+		ClearCache()
+	}()
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+		TableName: "coredns_script",
+		SetName:   "SCRIPT_SET",
+		KeyType:   nftables.TypeInvalid,
+		Timeout:   time.Hour,
+	})
+
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.130")
+	if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 1 {
+		t.Fatalf("Expected 1 answer applied, but got %v, %v", applied, err)
+	}
+	msg = newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.131")
+	if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 1 {
+		t.Fatalf("Expected 1 answer applied, but got %v, %v", applied, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Expected script written, but got %v", err)
+	}
+	script := string(data)
+	for _, statement := range []string{
+		"add table ip coredns_script\n",
+		"add set ip coredns_script SCRIPT_SET { type ipv4_addr; flags timeout; timeout 3600s; }\n",
+		"add element ip coredns_script SCRIPT_SET { 192.0.2.130 }\n",
+		"add element ip coredns_script SCRIPT_SET { 192.0.2.131 }\n",
+	} {
+		if !strings.Contains(script, statement) {
+			t.Errorf("Expected %q in script, but got %v", statement, script)
+		}
+	}
+	// the table and set are only created by the first transaction
+	if strings.Count(script, "add table") != 1 || strings.Count(script, "add set") != 1 {
+		t.Errorf("Expected table and set created once, but got %v", script)
+	}
+}
+
+func TestScriptElements(t *testing.T) {
+	table := &nftables.Table{Family: nftables.TableFamilyINet, Name: "filter"}
+	serviceType, _ := nftables.ConcatSetType(nftables.TypeIPAddr, nftables.TypeInetProto, nftables.TypeInetService)
+	service := &nftables.Set{Table: table, Name: "SVC", KeyType: serviceType}
+	key := serviceElementKey(net.ParseIP("192.0.2.1").To4(), nftablesService{proto: unix.IPPROTO_TCP, port: 443})
+	if texts := scriptElements(service, []nftables.SetElement{{Key: key}}); len(texts) != 1 || texts[0] != "192.0.2.1 . tcp . 443" {
+		t.Errorf("Expected service element, but got %v", texts)
+	}
+
+	interval := &nftables.Set{Table: table, Name: "NET", KeyType: nftables.TypeIPAddr, Interval: true}
+	_, network, _ := net.ParseCIDR("198.51.100.0/24")
+	elements := append(pinElements(network, true), nftables.SetElement{Key: net.ParseIP("192.0.2.1").To4(), Timeout: 90 * time.Second})
+	texts := scriptElements(interval, elements)
+	if len(texts) != 2 || texts[0] != "198.51.100.0-198.51.100.255" || texts[1] != "192.0.2.1 timeout 90s" {
+		t.Errorf("Expected range and address, but got %v", texts)
+	}
+
+	proxy := &nftables.Set{Table: table, Name: "PROXY", KeyType: nftables.TypeIPAddr, IsMap: true, DataType: nftables.TypeInetService}
+	if texts := scriptElements(proxy, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4(), Val: proxyPortData(12345)}}); len(texts) != 1 || texts[0] != "192.0.2.1 : 12345" {
+		t.Errorf("Expected map element, but got %v", texts)
+	}
+}
+
+func TestScriptBackendFailedTransaction(t *testing.T) {
+	var builder strings.Builder
+	backend := NewScriptBackend(NewMemoryRuleset(), &builder)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	backend.SetAddElements(&nftables.Set{Table: table, Name: "MISSING", KeyType: nftables.TypeIPAddr}, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	if err := backend.Flush(); err == nil {
+		t.Errorf("Expected missing set failed")
+	}
+	if builder.Len() != 0 {
+		t.Errorf("Expected nothing written by the failed transaction, but got %v", builder.String())
+	}
+}
+
+func TestScriptBackendRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coredns.nft")
+	writer := &nftablesAppliedLog{path: path, maxSize: 1, maxBackups: 2}
+	defer writer.close()
+	backend := NewScriptBackend(NewMemoryRuleset(), writer)
+	table := backend.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_script"})
+	set := &nftables.Set{Table: table, Name: "SCRIPT_SET", KeyType: nftables.TypeIPAddr}
+	if err := backend.AddSet(set, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	backend.SetAddElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	if err := backend.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := string(data)
+	// the rotated file starts with the table and set, so it can be replayed alone
+	for _, statement := range []string{
+		"add table ip coredns_script\n",
+		"add set ip coredns_script SCRIPT_SET { type ipv4_addr; }\n",
+		"add element ip coredns_script SCRIPT_SET { 192.0.2.1 }\n",
+	} {
+		if !strings.Contains(script, statement) {
+			t.Errorf("Expected %q in the new file, but got %v", statement, script)
+		}
+	}
+	if strings.Index(script, "add set") > strings.Index(script, "add element") {
+		t.Errorf("Expected definitions before the elements, but got %v", script)
+	}
+}
+
+func TestScriptBackendDrift(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coredns.nft")
+	SetNftScript(path, 0, 0)
+	SetBackend("script")
+	ClearCache()
+	EnableElementTracker(true)
+	defer func() {
+		SetBackend("nftables")
+		SetNftScript("", 0, 0)
+		ClearCache()
+		EnableElementTracker(false)
+	}()
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_script", SetName: "DRIFT_SET", KeyType: nftables.TypeInvalid})
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.132")
+	if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 1 {
+		t.Fatalf("Expected 1 answer applied, but got %v, %v", applied, err)
+	}
+
+	// the element is missing from the state kept in memory, the drift check must repair it there
+	backend := NewMemoryBackend(scriptRuleset)
+	set, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_script"}, "DRIFT_SET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.SetDeleteElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.132").To4()}})
+	if err := backend.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	CheckDrift(true)
+	if elements, _ := backend.GetSetElements(set); len(elements) != 1 {
+		t.Errorf("Expected the drift check repair the memory state of the script, but got %v", elements)
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "add element ip coredns_script DRIFT_SET { 192.0.2.132 }") != 2 {
+		t.Errorf("Expected the repair written into the script, but got %s", data)
+	}
+}
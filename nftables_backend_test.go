@@ -0,0 +1,75 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+	}()
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+		TableName: "coredns_memory",
+		SetName:   "MEMORY_SET",
+		KeyType:   nftables.TypeInvalid,
+		Timeout:   time.Hour,
+	})
+
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.130", "example.org. 60 IN A 192.0.2.131")
+	if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 2 {
+		t.Fatalf("Expected 2 answers applied, but got %v, %v", applied, err)
+	}
+
+	backend := NewMemoryBackend(ruleset)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_memory"}
+	set, err := backend.GetSetByName(table, "MEMORY_SET")
+	if err != nil {
+		t.Fatalf("Expected the set is created, but got %v", err)
+	}
+	if !set.HasTimeout || set.Timeout != time.Hour {
+		t.Errorf("Expected set with 1h timeout, but got %v %v", set.HasTimeout, set.Timeout)
+	}
+	elements, _ := backend.GetSetElements(set)
+	if len(elements) != 2 {
+		t.Fatalf("Expected 2 elements, but got %v", elements)
+	}
+
+	// A failed operation drops the whole transaction
+	backend.SetAddElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.132").To4()}})
+	backend.SetAddElements(&nftables.Set{Table: table, Name: "MISSING_SET"}, []nftables.SetElement{{Key: net.ParseIP("192.0.2.133").To4()}})
+	if err := backend.Flush(); !errors.Is(err, unix.ENOENT) {
+		t.Errorf("Expected missing set failed with ENOENT, but got %v", err)
+	}
+	if elements, _ := backend.GetSetElements(set); len(elements) != 2 {
+		t.Errorf("Expected nothing committed by the failed transaction, but got %v", elements)
+	}
+
+	backend.SetDeleteElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.130").To4()}})
+	if err := backend.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if elements, _ := backend.GetSetElements(set); len(elements) != 1 || !net.IP(elements[0].Key).Equal(net.ParseIP("192.0.2.131")) {
+		t.Errorf("Expected 192.0.2.131 is kept, but got %v", elements)
+	}
+
+	ruleset.FlushError = unix.EBUSY
+	msg = newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.134")
+	if applied, _ := handle.ServeWorker(context.Background(), msg); applied != 0 {
+		t.Errorf("Expected nothing applied when flushes fail, but got %v", applied)
+	}
+	ruleset.FlushError = nil
+}
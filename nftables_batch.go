@@ -0,0 +1,583 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+var batchAtomic bool = false
+
+type nftablesBatchElement struct {
+	element nftables.SetElement
+	applied NftablesAppliedElement
+	answer  *dns.RR
+	// the name queried for answer, see SetElementUserdata
+	origin string
+}
+
+type nftablesBatchEntry struct {
+	tableCache *NftableCache
+	set        *nftables.Set
+	create     bool
+	// the size and flags of the set created, see NftSetDescriber
+	description NftablesSetDescription
+	counter     *NftablesSetCounter
+	elements    []*nftablesBatchElement
+	// elements already present in the kernel set, see SetSkipExisting
+	skipped []*nftablesBatchElement
+	// elements being added by other batches, and the in-flight keys claimed by this entry
+	followers []nftablesInflightFollower
+	leaders   []string
+	keys      map[string]bool
+	// keys of elements which are deleted and added again to refresh their timeout
+	refresh map[string]bool
+	err     error
+}
+
+// NftablesBatch stages all operations of one response, they are sent to nftables by Commit in one flush
+type NftablesBatch struct {
+	cache   *NftablesCache
+	entries []*nftablesBatchEntry
+	index   map[string]*nftablesBatchEntry
+
+	answerApplied map[*dns.RR]int
+	answerErrors  map[*dns.RR]error
+	answerNames   map[*dns.RR][]string
+	answerDeduped map[*dns.RR]bool
+	answerScopes  map[*dns.RR]string
+	answerTTLs    map[*dns.RR]uint32
+	afterCommit   []func()
+	flushed       bool
+	zone          string
+	// when the response is received from the next plugin, see SetReceived
+	received time.Time
+	// batches of the rules targeting other network namespaces, they share the results of answers with this batch
+	namespaces map[NftablesNetworkNamespace]*NftablesBatch
+}
+
+func NewNftablesBatch(cache *NftablesCache) *NftablesBatch {
+	return &NftablesBatch{
+		cache:         cache,
+		index:         make(map[string]*nftablesBatchEntry),
+		answerApplied: make(map[*dns.RR]int),
+		answerErrors:  make(map[*dns.RR]error),
+		answerNames:   make(map[*dns.RR][]string),
+		answerDeduped: make(map[*dns.RR]bool),
+		answerScopes:  make(map[*dns.RR]string),
+		answerTTLs:    make(map[*dns.RR]uint32),
+		zone:          ".",
+	}
+}
+
+func (batch *NftablesBatch) Cache() *NftablesCache {
+	return batch.cache
+}
+
+// InNamespace returns the batch staging operations into the network namespace ns, the default namespace is the one
+// of this batch. The connection of a new namespace is selected from the pool, and it's committed and released with
+// this batch.
+func (batch *NftablesBatch) InNamespace(ns NftablesNetworkNamespace) (*NftablesBatch, error) {
+	if ns.IsDefault() || ns == batch.cache.Namespace {
+		return batch, nil
+	}
+	if child, ok := batch.namespaces[ns]; ok {
+		return child, nil
+	}
+
+	cache, err := NewCacheInNamespace(ns)
+	if err != nil {
+		return nil, err
+	}
+	child := &NftablesBatch{
+		cache:         cache,
+		index:         make(map[string]*nftablesBatchEntry),
+		answerApplied: batch.answerApplied,
+		answerErrors:  batch.answerErrors,
+		answerNames:   batch.answerNames,
+		answerDeduped: batch.answerDeduped,
+		answerScopes:  batch.answerScopes,
+		answerTTLs:    batch.answerTTLs,
+		zone:          batch.zone,
+		received:      batch.received,
+	}
+	if batch.namespaces == nil {
+		batch.namespaces = make(map[NftablesNetworkNamespace]*NftablesBatch)
+	}
+	batch.namespaces[ns] = child
+	return child, nil
+}
+
+// Release return the connections of other network namespaces to the pool, the connection of this batch is
+// released by its owner
+func (batch *NftablesBatch) Release() {
+	for _, child := range batch.namespaces {
+		CloseCache(child.cache)
+	}
+	batch.namespaces = nil
+}
+
+// SetZone set the origin zone of the response, which labels the count of elements added
+func (batch *NftablesBatch) SetZone(zone string) {
+	batch.zone = zone
+	for _, child := range batch.namespaces {
+		child.zone = zone
+	}
+}
+
+// SetReceived set when the response is received from the next plugin, the delay until the elements are flushed
+// is exported as the propagation delay of their sets. The zero time disables it.
+func (batch *NftablesBatch) SetReceived(received time.Time) {
+	batch.received = received
+	for _, child := range batch.namespaces {
+		child.received = received
+	}
+}
+
+func batchEntryKey(tableCache *NftableCache, setName string) string {
+	return fmt.Sprintf("%v %v %v", getFamilyName(tableCache.table.Family), tableCache.table.Name, setName)
+}
+
+// GetSet returns the set staged for creation in this batch, or the set definition of kernel
+func (batch *NftablesBatch) GetSet(tableCache *NftableCache, setName string) *nftables.Set {
+	entry, ok := batch.index[batchEntryKey(tableCache, setName)]
+	if ok {
+		return entry.set
+	}
+
+	return batch.cache.GetSetDefinition(tableCache, setName)
+}
+
+func (batch *NftablesBatch) mutableEntry(tableCache *NftableCache, set *nftables.Set) *nftablesBatchEntry {
+	key := batchEntryKey(tableCache, set.Name)
+	entry, ok := batch.index[key]
+	if !ok {
+		entry = &nftablesBatchEntry{
+			tableCache: tableCache,
+			set:        set,
+			keys:       make(map[string]bool),
+			refresh:    make(map[string]bool),
+		}
+		batch.index[key] = entry
+		batch.entries = append(batch.entries, entry)
+	}
+
+	return entry
+}
+
+// SetAnswerNames set the names used to match rules for answer, see AnswerNames
+func (batch *NftablesBatch) SetAnswerNames(answer *dns.RR, names []string) {
+	batch.answerNames[answer] = names
+}
+
+// AnswerNames returns the normalized owner name of answer and the names of CNAME chain pointing to it
+func (batch *NftablesBatch) AnswerNames(answer *dns.RR) []string {
+	names, ok := batch.answerNames[answer]
+	if ok {
+		return names
+	}
+	return []string{normalizeName((*answer).Header().Name)}
+}
+
+// AnswerName returns the normalized owner name of answer
+func (batch *NftablesBatch) AnswerName(answer *dns.RR) string {
+	return batch.AnswerNames(answer)[0]
+}
+
+// SetAnswerDeduped mark the address of answer is ignored by the LRU, only rules not using the global dedup
+// policy apply it
+func (batch *NftablesBatch) SetAnswerDeduped(answer *dns.RR) {
+	batch.answerDeduped[answer] = true
+}
+
+func (batch *NftablesBatch) AnswerDeduped(answer *dns.RR) bool {
+	return batch.answerDeduped[answer]
+}
+
+// SetAnswerTTL set the TTL used for the elements of answer instead of its own TTL, see NftablesHandler.RRsetTTL
+func (batch *NftablesBatch) SetAnswerTTL(answer *dns.RR, ttl uint32) {
+	batch.answerTTLs[answer] = ttl
+}
+
+// AnswerTTL returns the TTL of the elements of answer, which is the TTL of answer by default
+func (batch *NftablesBatch) AnswerTTL(answer *dns.RR) time.Duration {
+	if ttl, ok := batch.answerTTLs[answer]; ok {
+		return time.Duration(ttl) * time.Second
+	}
+	return time.Duration((*answer).Header().Ttl) * time.Second
+}
+
+// SetAnswerScope set the interface of the link-local address of answer, it's shown as the zone of the element
+func (batch *NftablesBatch) SetAnswerScope(answer *dns.RR, scope string) {
+	batch.answerScopes[answer] = scope
+}
+
+func (batch *NftablesBatch) AnswerScope(answer *dns.RR) string {
+	return batch.answerScopes[answer]
+}
+
+// CreateSet stage the creation of set, counter will be attached after the set is created
+func (batch *NftablesBatch) CreateSet(tableCache *NftableCache, set *nftables.Set, counter *NftablesSetCounter) {
+	batch.CreateSetWithDescription(tableCache, set, NftablesSetDescription{}, counter)
+}
+
+// CreateSetWithDescription stage the creation of set with the size and flags of description, like CreateSet
+func (batch *NftablesBatch) CreateSetWithDescription(tableCache *NftableCache, set *nftables.Set, description NftablesSetDescription, counter *NftablesSetCounter) {
+	entry := batch.mutableEntry(tableCache, set)
+	entry.create = true
+	entry.description = description
+	entry.counter = counter
+}
+
+// AttachCounter stage the counter of an existing set, it's attached after the elements of set are flushed so the
+// transaction of the response is never split
+func (batch *NftablesBatch) AttachCounter(tableCache *NftableCache, set *nftables.Set, counter *NftablesSetCounter) {
+	batch.mutableEntry(tableCache, set).counter = counter
+}
+
+// AddElement stage an element of answer to set
+func (batch *NftablesBatch) AddElement(tableCache *NftableCache, set *nftables.Set, element nftables.SetElement, applied NftablesAppliedElement, answer *dns.RR) {
+	entry := batch.mutableEntry(tableCache, set)
+	batch.answerApplied[answer] += 1
+
+	key := string(element.Key)
+	if entry.keys[key] {
+		return
+	}
+	entry.keys[key] = true
+	// the last name of the CNAME chain is the one queried
+	names := batch.AnswerNames(answer)
+	entry.elements = append(entry.elements, &nftablesBatchElement{
+		element: element,
+		applied: applied,
+		answer:  answer,
+		origin:  names[len(names)-1],
+	})
+}
+
+// RefreshElement stage an element like AddElement, and refresh its timeout if it's already in the set
+func (batch *NftablesBatch) RefreshElement(tableCache *NftableCache, set *nftables.Set, element nftables.SetElement, applied NftablesAppliedElement, answer *dns.RR) {
+	batch.AddElement(tableCache, set, element, applied, answer)
+	batch.mutableEntry(tableCache, set).refresh[string(element.Key)] = true
+}
+
+func (entry *nftablesBatchEntry) queueSet(cache *NftablesCache) error {
+	if !entry.create {
+		return nil
+	}
+	return addSetWithDescription(cache.NftableConnection, entry.set, entry.description, nil)
+}
+
+func (entry *nftablesBatchEntry) queueElements(cache *NftablesCache) error {
+	if len(entry.elements) == 0 {
+		return nil
+	}
+
+	elements := make([]nftables.SetElement, 0, len(entry.elements))
+	var refresh []nftables.SetElement
+	for _, element := range entry.elements {
+		elements = append(elements, element.element)
+		if entry.refresh[string(element.element.Key)] {
+			refresh = append(refresh, element.element)
+		}
+	}
+	if owner := buildOwnerUserdata(); isElementUserdataEnabled() || owner != nil {
+		now := time.Now()
+		userdata := make([][]byte, 0, len(entry.elements))
+		for _, element := range entry.elements {
+			if isElementUserdataEnabled() {
+				// the provenance tells the owner too
+				userdata = append(userdata, buildElementUserdata(element.origin, now))
+			} else {
+				userdata = append(userdata, owner)
+			}
+		}
+		if ok, err := cache.queueElementsWithUserdata(entry.tableCache, entry.set, elements, refresh, userdata); ok {
+			return err
+		}
+	}
+	// The kernel does not refresh the timeout of an existing element, so add the elements to refresh first to make
+	// sure they exist, then delete and add them again in the same transaction
+	if len(refresh) > 0 {
+		err := cache.SetAddElements(entry.tableCache, entry.set, refresh)
+		if err == nil {
+			err = cache.NftableConnection.SetDeleteElements(entry.set, refresh)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return cache.SetAddElements(entry.tableCache, entry.set, elements)
+}
+
+// queue stage the missing table, the set and its elements of entry in this order, so that it can be flushed alone
+func (entry *nftablesBatchEntry) queue(cache *NftablesCache) error {
+	if entry.tableCache.pending {
+		cache.NftableConnection.AddTable(entry.tableCache.table)
+	}
+	err := entry.queueSet(cache)
+	if err == nil {
+		err = entry.queueElements(cache)
+	}
+	return err
+}
+
+// queueAll stage operations of all entries into one transaction by barriers: all missing tables are created
+// first, then all missing sets, then the elements. The kernel applies a transaction in order, so elements
+// never race the creation of the table or set they belong to.
+func (batch *NftablesBatch) queueAll() []*nftablesBatchEntry {
+	tables := make(map[*NftableCache]bool)
+	for _, entry := range batch.entries {
+		if entry.tableCache.pending && !tables[entry.tableCache] {
+			tables[entry.tableCache] = true
+			batch.cache.NftableConnection.AddTable(entry.tableCache.table)
+		}
+	}
+
+	for _, entry := range batch.entries {
+		entry.err = entry.queueSet(batch.cache)
+	}
+
+	var queued []*nftablesBatchEntry
+	for _, entry := range batch.entries {
+		if entry.err == nil {
+			entry.err = entry.queueElements(batch.cache)
+		}
+		if entry.err == nil {
+			queued = append(queued, entry)
+		}
+	}
+	return queued
+}
+
+// AfterCommit register a callback which is called in order after all staged operations are committed
+func (batch *NftablesBatch) AfterCommit(fn func()) {
+	batch.afterCommit = append(batch.afterCommit, fn)
+}
+
+// Commit send all staged operations in one flush. If the flush failed and the batch is not atomic,
+// each set is flushed separately so that one broken set does not affect others.
+func (batch *NftablesBatch) Commit() {
+	defer func() {
+		for _, fn := range batch.afterCommit {
+			fn()
+		}
+	}()
+
+	// every network namespace is a separate transaction
+	for _, child := range batch.namespaces {
+		child.Commit()
+	}
+
+	if len(batch.entries) == 0 {
+		return
+	}
+
+	if IsLearnOnly() {
+		batch.learn()
+		return
+	}
+
+	if err := batch.refreshConnection(); err != nil {
+		log.Warningf("Nftables reopen connection %p failed, keep using it. %v", batch.cache, err)
+	}
+	for _, entry := range batch.entries {
+		entry.skipExisting(batch.cache)
+		entry.claimInflight(batch.cache)
+	}
+	batch.flushed = true
+	queued := batch.queueAll()
+	batch.observeSize()
+	err := batch.cache.Flush()
+	if err != nil {
+		queued, err = batch.retryFlush(queued, err)
+	}
+	if err != nil && batch.recoverStaleHandles() {
+		for _, entry := range batch.entries {
+			entry.err = nil
+		}
+		queued = batch.queueAll()
+		err = batch.cache.Flush()
+	}
+	if errors.Is(err, unix.ENOENT) && batch.recoverMissingSets() {
+		for _, entry := range batch.entries {
+			entry.err = nil
+		}
+		queued = batch.queueAll()
+		err = batch.cache.Flush()
+	}
+	if err != nil {
+		batch.cache.recordConnectionError(err)
+		if batchAtomic || len(queued) <= 1 {
+			for _, entry := range queued {
+				entry.err = err
+			}
+		} else {
+			log.Debugf("Nftables flush %v set(s) failed, try to flush them separately. %v", len(queued), err)
+			for _, entry := range queued {
+				entry.err = entry.queue(batch.cache)
+				if entry.err == nil {
+					entry.err = batch.cache.Flush()
+				}
+			}
+		}
+	}
+	if errors.Is(err, unix.ENOSPC) {
+		batch.recoverFullSets(!batchAtomic || len(queued) <= 1)
+	}
+	for _, entry := range batch.entries {
+		entry.releaseInflight()
+	}
+	for _, entry := range batch.entries {
+		entry.waitInflight(batch)
+	}
+
+	for _, entry := range batch.entries {
+		applied := make([]NftablesAppliedElement, 0, len(entry.elements))
+		for _, element := range entry.elements {
+			applied = append(applied, element.applied)
+		}
+
+		if entry.err != nil {
+			for _, element := range entry.elements {
+				atomic.AddUint64(&addElementErrorCount, 1)
+				addFailureCount.WithLabelValues(getFamilyName(element.applied.Family), element.applied.TableName, element.applied.SetName).Inc()
+				batch.answerErrors[element.answer] = entry.err
+				log.Errorf("Add element %v(%v) to %v %v %v failed.%v", element.applied.Element, element.applied.Name,
+					getFamilyName(element.applied.Family), element.applied.TableName, element.applied.SetName, entry.err)
+			}
+			WriteAppliedLog("failed", applied)
+			continue
+		}
+
+		// The table is created by this flush and the next batch must not create it again
+		entry.tableCache.pending = false
+		WriteAppliedLog("add", applied)
+		if len(entry.elements) > 0 {
+			elementAddCount.WithLabelValues(batch.zone, getFamilyName(entry.tableCache.table.Family), entry.tableCache.table.Name, entry.set.Name).Add(float64(len(entry.elements)))
+			if !batch.received.IsZero() {
+				propagationDelay.WithLabelValues(getFamilyName(entry.tableCache.table.Family), entry.tableCache.table.Name, entry.set.Name).Observe(time.Since(batch.received).Seconds())
+			}
+		}
+		entry.rememberExisting()
+		for i, element := range append(entry.elements, entry.skipped...) {
+			if element.answer != nil {
+				recordDomainStats(element.origin, answerAddress(element.answer), i < len(entry.elements))
+			}
+			// the tracker and its consumers only know the default namespace
+			if batch.cache.Namespace.IsDefault() {
+				if entry.refresh[string(element.element.Key)] {
+					// forget the old expire time of the refreshed element
+					UntrackElement(element.applied.Family, element.applied.TableName, element.applied.SetName, element.element.Key)
+				}
+				TrackElement(element.applied, element.element.Key, element.element.Val)
+			}
+			if i < len(entry.elements) {
+				ownElement(batch.cache.Namespace, element.applied, element.element.Key)
+			}
+			ttl := batch.AnswerTTL(element.answer)
+			RecordHostname(element.applied, ttl)
+			ScheduleReap(batch.cache.Namespace, entry.set, element.applied, element.element.Key, ttl)
+		}
+		if entry.create {
+			batch.cache.AddSetDefinition(entry.tableCache, entry.set)
+		}
+		if entry.counter != nil {
+			batch.cache.AttachSetCounter(entry.tableCache, entry.set, entry.counter)
+		}
+	}
+}
+
+// AppliedSets returns the sets which elements are applied to by the committed batch, elements already present
+// and skipped are applied too. The sets are formatted as <family>/<table>/<set>.
+func (batch *NftablesBatch) AppliedSets() []string {
+	var ret []string
+	for _, entry := range batch.entries {
+		if !batch.flushed || entry.err != nil || len(entry.elements)+len(entry.skipped) == 0 {
+			continue
+		}
+		ret = append(ret, fmt.Sprintf("%v/%v/%v", getFamilyName(entry.tableCache.table.Family), entry.tableCache.table.Name, entry.set.Name))
+	}
+	for _, child := range batch.namespaces {
+		ret = append(ret, child.AppliedSets()...)
+	}
+	return ret
+}
+
+// observeSize record how many elements are sent in the transaction of this batch
+func (batch *NftablesBatch) observeSize() {
+	elements := 0
+	for _, entry := range batch.entries {
+		elements += len(entry.elements)
+	}
+	if elements > 0 {
+		batchSize.Observe(float64(elements))
+	}
+}
+
+// learn journal and count all staged elements without sending them to nftables
+func (batch *NftablesBatch) learn() {
+	for _, entry := range batch.entries {
+		applied := make([]NftablesAppliedElement, 0, len(entry.elements))
+		for _, element := range entry.elements {
+			applied = append(applied, element.applied)
+			batch.answerErrors[element.answer] = errLearnOnly
+			log.Debugf("Nftables learn element %v(%v) for %v %v %v", element.applied.Element, element.applied.Name,
+				getFamilyName(element.applied.Family), element.applied.TableName, element.applied.SetName)
+		}
+		if len(applied) > 0 {
+			WriteAppliedLog("learn", applied)
+			learnCount.WithLabelValues(getFamilyName(entry.tableCache.table.Family), entry.tableCache.table.Name, entry.set.Name).Add(float64(len(applied)))
+		}
+	}
+}
+
+// Flushed returns true if Commit sent the staged operations to nftables, in any network namespace
+func (batch *NftablesBatch) Flushed() bool {
+	if batch.flushed {
+		return true
+	}
+	for _, child := range batch.namespaces {
+		if child.Flushed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Failed returns true if Commit sent the staged operations to nftables and all of them failed
+func (batch *NftablesBatch) Failed() bool {
+	if !batch.Flushed() {
+		return false
+	}
+	for _, entry := range batch.entries {
+		if batch.flushed && entry.err == nil {
+			return false
+		}
+	}
+	for _, child := range batch.namespaces {
+		if child.Flushed() && !child.Failed() {
+			return false
+		}
+	}
+	return true
+}
+
+// AnswerResult returns how many rules applied the answer and the error of it after Commit
+func (batch *NftablesBatch) AnswerResult(answer *dns.RR) (int, error) {
+	err, ok := batch.answerErrors[answer]
+	if ok {
+		return 0, err
+	}
+
+	return batch.answerApplied[answer], nil
+}
+
+func SetNftableBatchAtomic(atomic bool) {
+	batchAtomic = atomic
+}
@@ -0,0 +1,297 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// newTestBatchCache returns a cache whose connection records the message types of each flush, the flushes
+// containing failName are rejected with ENOENT
+func newTestBatchCache(t *testing.T, failName string, flushes *[][]int) *NftablesCache {
+	conn, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+		if len(req) == 0 || req[0].Header.Flags&netlink.Dump != 0 {
+			return nil, io.EOF
+		}
+
+		var types []int
+		failed := false
+		for _, msg := range req {
+			if int(msg.Header.Type)>>8 != unix.NFNL_SUBSYS_NFTABLES {
+				continue
+			}
+			types = append(types, int(msg.Header.Type)&0xff)
+			if len(failName) > 0 && bytes.Contains(msg.Data, []byte(failName)) {
+				failed = true
+			}
+		}
+		*flushes = append(*flushes, types)
+		if failed {
+			return nltest.Error(int(unix.ENOENT), req)
+		}
+		return req, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &NftablesCache{
+		tables:            make(map[nftables.TableFamily]*map[string]*NftableCache),
+		NftableConnection: conn,
+		NetworkNamespace:  netns.NsHandle(0),
+	}
+}
+
+func newTestBatchAnswer(t *testing.T, text string) *dns.RR {
+	rr, err := dns.NewRR(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &rr
+}
+
+func stageTestSet(batch *NftablesBatch, tableName string, setName string, answer *dns.RR) {
+	tableCache := batch.Cache().MutableNftablesTable(nftables.TableFamilyIPv4, tableName)
+	set := batch.GetSet(tableCache, setName)
+	if set == nil {
+		set = &nftables.Set{Table: tableCache.table, Name: setName, KeyType: nftables.TypeIPAddr}
+		batch.CreateSet(tableCache, set, nil)
+	}
+	batch.AddElement(tableCache, set, nftables.SetElement{Key: net.ParseIP("192.0.2.1").To4()}, NftablesAppliedElement{
+		Family:    nftables.TableFamilyIPv4,
+		TableName: tableName,
+		SetName:   setName,
+	}, answer)
+}
+
+// checkTransactionOrder checks all tables are created before sets, and all sets before elements
+func checkTransactionOrder(t *testing.T, types []int) {
+	stage := 0
+	for _, msgType := range types {
+		var current int
+		switch msgType {
+		case unix.NFT_MSG_NEWTABLE:
+			current = 0
+		case unix.NFT_MSG_NEWSET:
+			current = 1
+		case unix.NFT_MSG_NEWSETELEM:
+			current = 2
+		default:
+			continue
+		}
+		if current < stage {
+			t.Errorf("Expected tables, sets and elements are created in order, but got %v", types)
+			return
+		}
+		stage = current
+	}
+}
+
+func TestBatchCreateTableBarrier(t *testing.T) {
+	var flushes [][]int
+	batch := NewNftablesBatch(newTestBatchCache(t, "", &flushes))
+	batch.SetZone("example.org.")
+	added := testutil.ToFloat64(elementAddCount.WithLabelValues("example.org.", getFamilyName(nftables.TableFamilyIPv4), "coredns_b", "SET_B"))
+	answer := newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1")
+	stageTestSet(batch, "coredns_a", "SET_A", answer)
+	stageTestSet(batch, "coredns_b", "SET_B", answer)
+	stageTestSet(batch, "coredns_a", "SET_C", answer)
+	batch.Commit()
+	if count := testutil.ToFloat64(elementAddCount.WithLabelValues("example.org.", getFamilyName(nftables.TableFamilyIPv4), "coredns_b", "SET_B")) - added; count != 1 {
+		t.Errorf("Expected 1 element added in zone example.org., but got %v", count)
+	}
+
+	if len(flushes) != 1 {
+		t.Fatalf("Expected one flush, but got %v", flushes)
+	}
+	checkTransactionOrder(t, flushes[0])
+	tables := 0
+	for _, msgType := range flushes[0] {
+		if msgType == unix.NFT_MSG_NEWTABLE {
+			tables += 1
+		}
+	}
+	if tables != 2 {
+		t.Errorf("Expected each missing table is created once, but got %v", flushes[0])
+	}
+	if applied, err := batch.AnswerResult(answer); err != nil || applied != 3 {
+		t.Errorf("Expected answer applied 3 times, but got %v, %v", applied, err)
+	}
+
+	// The table is created, the next batch of this connection must not create it again
+	flushes = nil
+	batch = NewNftablesBatch(batch.Cache())
+	stageTestSet(batch, "coredns_a", "SET_A", newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1"))
+	batch.Commit()
+	for _, msgType := range flushes[0] {
+		if msgType == unix.NFT_MSG_NEWTABLE || msgType == unix.NFT_MSG_NEWSET {
+			t.Errorf("Expected only elements are added into created set, but got %v", flushes[0])
+		}
+	}
+}
+
+func TestBatchCreateTableRetry(t *testing.T) {
+	batchAtomic = false
+	flushFailures := testutil.ToFloat64(flushFailureCount)
+	addFailures := testutil.ToFloat64(addFailureCount.WithLabelValues(getFamilyName(nftables.TableFamilyIPv4), "coredns_a", "SET_BROKEN"))
+	var flushes [][]int
+	batch := NewNftablesBatch(newTestBatchCache(t, "SET_BROKEN", &flushes))
+	okAnswer := newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1")
+	brokenAnswer := newTestBatchAnswer(t, "example.com. 60 IN A 192.0.2.1")
+	stageTestSet(batch, "coredns_a", "SET_BROKEN", brokenAnswer)
+	stageTestSet(batch, "coredns_a", "SET_OK", okAnswer)
+	batch.Commit()
+
+	// one failed transaction, then each set is retried with the table creation in its own transaction
+	if len(flushes) != 3 {
+		t.Fatalf("Expected 3 flushes, but got %v", flushes)
+	}
+	for _, types := range flushes[1:] {
+		checkTransactionOrder(t, types)
+		if len(types) == 0 || types[0] != unix.NFT_MSG_NEWTABLE {
+			t.Errorf("Expected the separate flush creates the missing table first, but got %v", types)
+		}
+	}
+	if _, err := batch.AnswerResult(brokenAnswer); err == nil {
+		t.Errorf("Expected answer of broken set failed")
+	}
+	if applied, err := batch.AnswerResult(okAnswer); err != nil || applied != 1 {
+		t.Errorf("Expected answer of ok set applied, but got %v, %v", applied, err)
+	}
+	if sets := batch.AppliedSets(); !reflect.DeepEqual(sets, []string{"ipv4/coredns_a/SET_OK"}) {
+		t.Errorf("Expected only the ok set is applied, but got %v", sets)
+	}
+	if failures := testutil.ToFloat64(flushFailureCount) - flushFailures; failures != 2 {
+		t.Errorf("Expected 2 flush failures counted, but got %v", failures)
+	}
+	if failures := testutil.ToFloat64(addFailureCount.WithLabelValues(getFamilyName(nftables.TableFamilyIPv4), "coredns_a", "SET_BROKEN")) - addFailures; failures != 1 {
+		t.Errorf("Expected 1 add failure of broken set counted, but got %v", failures)
+	}
+}
+
+func TestBatchAllAnswers(t *testing.T) {
+	var flushes [][]int
+	batch := NewNftablesBatch(newTestBatchCache(t, "", &flushes))
+	tableCache := batch.Cache().MutableNftablesTable(nftables.TableFamilyIPv4, "coredns")
+	set := &nftables.Set{Table: tableCache.table, Name: "SET_A", KeyType: nftables.TypeIPAddr}
+	batch.CreateSet(tableCache, set, nil)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		answer := newTestBatchAnswer(t, "example.org. 60 IN A "+ip)
+		batch.AddElement(tableCache, set, nftables.SetElement{Key: net.ParseIP(ip).To4()}, NftablesAppliedElement{
+			Family:    nftables.TableFamilyIPv4,
+			TableName: "coredns",
+			SetName:   "SET_A",
+		}, answer)
+	}
+	batch.Commit()
+
+	if len(flushes) != 1 {
+		t.Fatalf("Expected one flush, but got %v", flushes)
+	}
+	elementMessages := 0
+	for _, msgType := range flushes[0] {
+		if msgType == unix.NFT_MSG_NEWSETELEM {
+			elementMessages += 1
+		}
+	}
+	if elementMessages != 1 {
+		t.Errorf("Expected all answers are added into the set by one message, but got %v", flushes[0])
+	}
+}
+
+func TestBatchRefreshElement(t *testing.T) {
+	var flushes [][]int
+	batch := NewNftablesBatch(newTestBatchCache(t, "", &flushes))
+	tableCache := batch.Cache().MutableNftablesTable(nftables.TableFamilyIPv4, "coredns")
+	tableCache.pending = false
+	set := &nftables.Set{Table: tableCache.table, Name: "SET_A", KeyType: nftables.TypeIPAddr, HasTimeout: true, Timeout: time.Hour}
+	batch.Cache().AddSetDefinition(tableCache, set)
+	applied := NftablesAppliedElement{Family: nftables.TableFamilyIPv4, TableName: "coredns", SetName: "SET_A"}
+	batch.RefreshElement(tableCache, set, nftables.SetElement{Key: net.ParseIP("192.0.2.1").To4()}, applied, newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1"))
+	batch.AddElement(tableCache, set, nftables.SetElement{Key: net.ParseIP("192.0.2.2").To4()}, applied, newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.2"))
+	batch.Commit()
+
+	if len(flushes) != 1 {
+		t.Fatalf("Expected one flush, but got %v", flushes)
+	}
+	var elementMessages []int
+	for _, msgType := range flushes[0] {
+		if msgType == unix.NFT_MSG_NEWSETELEM || msgType == unix.NFT_MSG_DELSETELEM {
+			elementMessages = append(elementMessages, msgType)
+		}
+	}
+	expected := []int{unix.NFT_MSG_NEWSETELEM, unix.NFT_MSG_DELSETELEM, unix.NFT_MSG_NEWSETELEM}
+	if len(elementMessages) != len(expected) || elementMessages[0] != expected[0] || elementMessages[1] != expected[1] || elementMessages[2] != expected[2] {
+		t.Errorf("Expected refreshed element is added, deleted and added again, but got %v", flushes[0])
+	}
+}
+
+func TestBatchCounterAfterCommit(t *testing.T) {
+	ClearSetCounters()
+	defer ClearSetCounters()
+
+	var flushes [][]int
+	batch := NewNftablesBatch(newTestBatchCache(t, "", &flushes))
+	tableCache := batch.Cache().MutableNftablesTable(nftables.TableFamilyIPv4, "coredns")
+	tableCache.pending = false
+	batch.Cache().AddSetDefinition(tableCache, &nftables.Set{Table: tableCache.table, Name: "SET_A", KeyType: nftables.TypeIPAddr})
+	rule := &NftablesSetAddElement{TableName: "coredns", SetName: "SET_A", KeyType: nftables.TypeIPAddr, Counter: &NftablesSetCounter{ChainName: "output", CounterName: "set_a"}}
+	answer := newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1")
+	batch.SetAnswerNames(answer, []string{"example.org."})
+	if err, _ := rule.ServeDNS(context.Background(), batch, answer, nftables.TableFamilyIPv4); err != nil {
+		t.Fatal(err)
+	}
+	if len(flushes) != 0 || len(setCounterEntries) != 0 {
+		t.Fatalf("Expected the counter not attached while staging, but got %v", flushes)
+	}
+
+	batch.Commit()
+	if len(flushes) == 0 || len(setCounterEntries) != 1 {
+		t.Fatalf("Expected the counter attached after the commit, but got %v, %v", flushes, setCounterEntries)
+	}
+	if _, err := batch.AnswerResult(answer); err != nil {
+		t.Errorf("Expected the answer applied, but got %v", err)
+	}
+}
+
+func TestBatchPropagationDelay(t *testing.T) {
+	var flushes [][]int
+	cache := newTestBatchCache(t, "", &flushes)
+	delay := func() *dto.Histogram {
+		var metric dto.Metric
+		propagationDelay.WithLabelValues(getFamilyName(nftables.TableFamilyIPv4), "filter", "DELAY_SET").(prometheus.Metric).Write(&metric)
+		return metric.GetHistogram()
+	}
+
+	batch := NewNftablesBatch(cache)
+	batch.SetReceived(time.Now().Add(-time.Second))
+	stageTestSet(batch, "filter", "DELAY_SET", newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1"))
+	count, sum := delay().GetSampleCount(), delay().GetSampleSum()
+	batch.Commit()
+	if batch.Failed() || delay().GetSampleCount() != count+1 || delay().GetSampleSum()-sum < 1 {
+		t.Fatalf("Expected the propagation delay from receiving the response observed once, but got %v", delay())
+	}
+
+	// answers not from a response are not observed
+	batch = NewNftablesBatch(cache)
+	stageTestSet(batch, "filter", "DELAY_SET", newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1"))
+	count = delay().GetSampleCount()
+	batch.Commit()
+	if delay().GetSampleCount() != count {
+		t.Errorf("Expected no propagation delay without the receiving time")
+	}
+}
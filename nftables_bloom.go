@@ -0,0 +1,273 @@
+package coredns_nftables
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+const defaultDedupeBloomFalsePositive = 0.01
+
+// nftablesDedupeStore keeps the apply counts of recently applied addresses, it's the exact LRU by default or the
+// bloom filter selected by `dedupe bloom`
+type nftablesDedupeStore interface {
+	get(ip string) (NftableIPCache, bool)
+	mergeApplyCount(ip string, count int, expireTime time.Time)
+	increase(ip string, timeout time.Duration)
+	remove(ip string)
+	forEach(fn func(ip string, value NftableIPCache))
+	len() int
+}
+
+// The store of recently applied addresses shared by all connections of the pool, see SetDedupeBloom
+var sharedDedupe = &nftablesSharedDedupe{store: sharedLru}
+
+// nftablesSharedDedupe forwards to the selected store, so pooled connections keep using it when `dedupe` changes
+type nftablesSharedDedupe struct {
+	lock  sync.RWMutex
+	store nftablesDedupeStore
+}
+
+func (d *nftablesSharedDedupe) current() nftablesDedupeStore {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.store
+}
+
+func (d *nftablesSharedDedupe) set(store nftablesDedupeStore) {
+	d.lock.Lock()
+	d.store = store
+	d.lock.Unlock()
+}
+
+func (d *nftablesSharedDedupe) get(ip string) (NftableIPCache, bool) {
+	return d.current().get(ip)
+}
+
+func (d *nftablesSharedDedupe) mergeApplyCount(ip string, count int, expireTime time.Time) {
+	d.current().mergeApplyCount(ip, count, expireTime)
+}
+
+func (d *nftablesSharedDedupe) increase(ip string, timeout time.Duration) {
+	d.current().increase(ip, timeout)
+}
+
+func (d *nftablesSharedDedupe) remove(ip string) {
+	d.current().remove(ip)
+}
+
+func (d *nftablesSharedDedupe) forEach(fn func(ip string, value NftableIPCache)) {
+	d.current().forEach(fn)
+}
+
+func (d *nftablesSharedDedupe) len() int {
+	return d.current().len()
+}
+
+// SetDedupeBloom replace the LRU of recently applied addresses by a time-bucketed counting bloom filter sized for
+// size addresses with the false positive rate fp. The entries of the previous store are dropped, unless it's a
+// filter of the same size and rate, so reloads keep it like the LRU.
+func SetDedupeBloom(size int, fp float64) {
+	if bloom, ok := sharedDedupe.current().(*nftablesBloom); ok && bloom.size == size && bloom.fp == fp {
+		return
+	}
+	sharedDedupe.set(newNftablesBloom(size, fp))
+}
+
+// SetDedupeLru use the exact LRU(`set lru max`) for recently applied addresses again, which is the default
+func SetDedupeLru() {
+	sharedDedupe.set(sharedLru)
+}
+
+// nftablesBloom is a counting bloom filter of apply counts in two generations. The current generation takes new
+// addresses, and it becomes the old one every half of the LRU timeout while the old one is cleared, so an address
+// is forgotten after one half to the full LRU timeout. Counters saturate at 255 and are never decreased then.
+// Addresses of false positives are skipped like addresses applied before, and entries can not be listed.
+type nftablesBloom struct {
+	lock        sync.Mutex
+	size        int
+	fp          float64
+	hashes      int
+	generations [2][]uint8
+	// the estimated count of addresses of each generation
+	entries [2]int
+	current int
+	rotated time.Time
+}
+
+// newNftablesBloom returns the filter keeping about size addresses per generation with the false positive rate fp
+func newNftablesBloom(size int, fp float64) *nftablesBloom {
+	if size < 1 {
+		size = 1
+	}
+	if !(fp > 0 && fp < 1) {
+		fp = defaultDedupeBloomFalsePositive
+	}
+	counters := int(math.Ceil(-float64(size) * math.Log(fp) / (math.Ln2 * math.Ln2)))
+	hashes := int(math.Round(float64(counters) / float64(size) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &nftablesBloom{
+		size:        size,
+		fp:          fp,
+		hashes:      hashes,
+		generations: [2][]uint8{make([]uint8, counters), make([]uint8, counters)},
+		rotated:     time.Now(),
+	}
+}
+
+// indexes returns the counters of ip by double hashing
+func (b *nftablesBloom) indexes(ip string) []int {
+	hash := fnv.New64a()
+	hash.Write([]byte(ip))
+	sum := hash.Sum64()
+	low, high := sum&0xffffffff, (sum>>32)|1
+	counters := uint64(len(b.generations[0]))
+	ret := make([]int, b.hashes)
+	for i := range ret {
+		ret[i] = int((low + uint64(i)*high) % counters)
+	}
+	return ret
+}
+
+// rotate clear the generations older than the LRU timeout, it must be called with the lock
+func (b *nftablesBloom) rotate(now time.Time) {
+	window := setLruTimeout / 2
+	elapsed := now.Sub(b.rotated)
+	if elapsed < window && window > 0 {
+		return
+	}
+	b.current = 1 - b.current
+	b.clear(b.current)
+	if elapsed >= 2*window {
+		b.clear(1 - b.current)
+	}
+	b.rotated = now
+}
+
+func (b *nftablesBloom) clear(generation int) {
+	counters := b.generations[generation]
+	for i := range counters {
+		counters[i] = 0
+	}
+	b.entries[generation] = 0
+}
+
+func (b *nftablesBloom) count(generation int, indexes []int) int {
+	counters := b.generations[generation]
+	ret := int(counters[indexes[0]])
+	for _, index := range indexes[1:] {
+		if int(counters[index]) < ret {
+			ret = int(counters[index])
+		}
+	}
+	return ret
+}
+
+// raise raises the count of the address of indexes in generation by delta, only the smallest counters are
+// raised(conservative update), so other addresses sharing the counters are overestimated less
+func (b *nftablesBloom) raise(generation int, indexes []int, delta int) {
+	counters := b.generations[generation]
+	count := b.count(generation, indexes)
+	if count == 0 {
+		b.entries[generation] += 1
+	}
+	target := count + delta
+	if target > math.MaxUint8 {
+		target = math.MaxUint8
+	}
+	for _, index := range indexes {
+		if int(counters[index]) < target {
+			counters[index] = uint8(target)
+		}
+	}
+}
+
+// generationOf returns the generation keeping the address of indexes, the old one if it's in both of them
+func (b *nftablesBloom) generationOf(indexes []int) int {
+	if b.count(1-b.current, indexes) > 0 {
+		return 1 - b.current
+	}
+	return b.current
+}
+
+// get returns the estimated apply count of ip, which is never less than the real one
+func (b *nftablesBloom) get(ip string) (NftableIPCache, bool) {
+	indexes := b.indexes(ip)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.rotate(now)
+	count := b.count(0, indexes) + b.count(1, indexes)
+	if count == 0 {
+		return NftableIPCache{}, false
+	}
+	expireTime := b.rotated.Add(setLruTimeout / 2)
+	if b.generationOf(indexes) == b.current {
+		expireTime = b.rotated.Add(setLruTimeout)
+	}
+	return NftableIPCache{ExpireTime: expireTime, ApplyCount: count}, true
+}
+
+// mergeApplyCount raise the apply count of ip to count unless expireTime is passed, addresses always expire with
+// their generation
+func (b *nftablesBloom) mergeApplyCount(ip string, count int, expireTime time.Time) {
+	if !expireTime.After(time.Now()) {
+		return
+	}
+	indexes := b.indexes(ip)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rotate(time.Now())
+	if current := b.count(0, indexes) + b.count(1, indexes); current < count {
+		b.raise(b.generationOf(indexes), indexes, count-current)
+	}
+}
+
+// increase add 1 to the apply count of ip in the generation keeping it, so that it expires like the LRU entries
+// after its first answer, timeout is ignored
+func (b *nftablesBloom) increase(ip string, timeout time.Duration) {
+	indexes := b.indexes(ip)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rotate(time.Now())
+	b.raise(b.generationOf(indexes), indexes, 1)
+}
+
+// remove subtract the estimated count of ip from its counters in both generations
+func (b *nftablesBloom) remove(ip string) {
+	indexes := b.indexes(ip)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for generation, counters := range b.generations {
+		count := b.count(generation, indexes)
+		if count == 0 {
+			continue
+		}
+		for _, index := range indexes {
+			if counters[index] != math.MaxUint8 {
+				counters[index] -= uint8(count)
+			}
+		}
+		if b.entries[generation] > 0 {
+			b.entries[generation] -= 1
+		}
+	}
+}
+
+// forEach calls nothing, the addresses are not kept by the filter
+func (b *nftablesBloom) forEach(fn func(ip string, value NftableIPCache)) {
+}
+
+// len returns the estimated count of addresses
+func (b *nftablesBloom) len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.entries[0] + b.entries[1]
+}
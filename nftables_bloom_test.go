@@ -0,0 +1,94 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDedupeBloom(t *testing.T) {
+	defer SetSetLruTimeout(setLruTimeout)
+	defer SetSetLruMaxRetryTimes(setLruMaxRetryTimes)
+	SetSetLruTimeout(time.Hour)
+	SetSetLruMaxRetryTimes(2)
+
+	bloom := newNftablesBloom(1000, 0.01)
+	if bloom.hashes != 7 || len(bloom.generations[0]) != 9586 {
+		t.Errorf("Expected 7 hashes of 9586 counters, but got %v of %v", bloom.hashes, len(bloom.generations[0]))
+	}
+	for i := 0; i < 3; i++ {
+		bloom.increase("192.0.2.1", time.Minute)
+	}
+	if value, ok := bloom.get("192.0.2.1"); !ok || value.ApplyCount != 3 {
+		t.Errorf("Expected 192.0.2.1 applied 3 times, but got %v", value)
+	}
+
+	// the false positive rate is kept for the sized count of addresses
+	for i := 0; i < 1000; i++ {
+		bloom.increase(fmt.Sprintf("198.51.%d.%d", i/256, i%256), time.Minute)
+	}
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if _, ok := bloom.get(fmt.Sprintf("203.0.%d.%d", i/256, i%256)); ok {
+			falsePositives++
+		}
+	}
+	if falsePositives > 30 {
+		t.Errorf("Expected about 1%% false positives, but got %v of 1000", falsePositives)
+	}
+	if bloom.len() < 990 || bloom.len() > 1001 {
+		t.Errorf("Expected about 1001 addresses, but got %v", bloom.len())
+	}
+
+	bloom.remove("192.0.2.1")
+	if value, ok := bloom.get("192.0.2.1"); ok {
+		t.Errorf("Expected 192.0.2.1 forgotten, but got %v", value)
+	}
+	bloom.mergeApplyCount("192.0.2.1", 5, time.Now().Add(time.Hour))
+	bloom.mergeApplyCount("192.0.2.1", 2, time.Now().Add(time.Hour))
+	if value, _ := bloom.get("192.0.2.1"); value.ApplyCount != 5 {
+		t.Errorf("Expected the greater apply count kept, but got %v", value)
+	}
+
+	// addresses live in their generation, so they are forgotten after one half to the full LRU timeout
+	bloom.rotated = bloom.rotated.Add(-31 * time.Minute)
+	bloom.increase("192.0.2.1", time.Minute)
+	bloom.increase("192.0.2.2", time.Minute)
+	if value, _ := bloom.get("192.0.2.1"); value.ApplyCount != 6 {
+		t.Errorf("Expected the count of the old generation increased, but got %v", value)
+	}
+	bloom.rotated = bloom.rotated.Add(-31 * time.Minute)
+	if _, ok := bloom.get("192.0.2.1"); ok {
+		t.Errorf("Expected 192.0.2.1 forgotten with its generation")
+	}
+	if value, ok := bloom.get("192.0.2.2"); !ok || value.ApplyCount != 1 {
+		t.Errorf("Expected 192.0.2.2 kept in the old generation, but got %v", value)
+	}
+	bloom.rotated = bloom.rotated.Add(-2 * time.Hour)
+	if _, ok := bloom.get("192.0.2.2"); ok || bloom.len() != 0 {
+		t.Errorf("Expected all addresses forgotten after the LRU timeout, but got %v", bloom.len())
+	}
+
+	// connections of the pool use the selected store
+	SetDedupeBloom(1000, 0.01)
+	defer SetDedupeLru()
+	selected := sharedDedupe.current()
+	SetDedupeBloom(1000, 0.01)
+	if sharedDedupe.current() != selected {
+		t.Errorf("Expected the filter kept when it's selected again")
+	}
+	cache := &NftablesCache{recentlyIPCache: sharedDedupe}
+	answer := newTestBatchAnswer(t, "example.com. 300 IN A 192.0.2.9")
+	cache.LruUpdateIp(answer, 1)
+	cache.LruUpdateIp(answer, 1)
+	if !cache.LruIgnoreIp(answer) {
+		t.Errorf("Expected the address applied twice ignored by the filter")
+	}
+	if _, ok := sharedLru.get("192.0.2.9"); ok {
+		t.Errorf("Expected the LRU not used with the filter")
+	}
+	SetDedupeLru()
+	if cache.LruIgnoreIp(answer) {
+		t.Errorf("Expected the LRU used again")
+	}
+}
@@ -0,0 +1,104 @@
+package coredns_nftables
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerLock sync.Mutex = sync.Mutex{}
+var breakerThreshold int = 0
+var breakerCooldown time.Duration = 0
+var breakerState int = breakerClosed
+var breakerFailures int = 0
+var breakerOpenTime time.Time
+var breakerTrial bool = false
+
+// SetBreaker trip the circuit breaker after threshold consecutive failed flushes, responses are not applied
+// until cooldown passed. 0 threshold disables it.
+func SetBreaker(threshold int, cooldown time.Duration) {
+	breakerLock.Lock()
+	defer breakerLock.Unlock()
+
+	breakerThreshold = threshold
+	breakerCooldown = cooldown
+	breakerFailures = 0
+	breakerTrial = false
+	setBreakerState(breakerClosed)
+}
+
+func getBreakerStateName(state int) string {
+	switch state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// setBreakerState must be called with breakerLock held
+func setBreakerState(state int) {
+	if state != breakerState {
+		log.Infof("Nftables circuit breaker %v -> %v", getBreakerStateName(breakerState), getBreakerStateName(state))
+	}
+	breakerState = state
+	breakerStateGauge.Set(float64(state))
+}
+
+// breakerAllow returns false if the breaker is open. After the cooldown only one response is allowed as a trial
+// until its result is recorded.
+func breakerAllow() bool {
+	breakerLock.Lock()
+	defer breakerLock.Unlock()
+
+	if breakerThreshold <= 0 {
+		return true
+	}
+
+	if breakerState == breakerOpen {
+		if time.Since(breakerOpenTime) < breakerCooldown {
+			return false
+		}
+		setBreakerState(breakerHalfOpen)
+	}
+	if breakerState == breakerHalfOpen {
+		if breakerTrial {
+			return false
+		}
+		breakerTrial = true
+	}
+	return true
+}
+
+// breakerRecord record the result of an allowed response, responses not flushed to nftables only finish the trial
+func breakerRecord(flushed bool, failed bool) {
+	breakerLock.Lock()
+	defer breakerLock.Unlock()
+
+	if breakerThreshold <= 0 {
+		return
+	}
+	breakerTrial = false
+	if !flushed {
+		return
+	}
+
+	if !failed {
+		breakerFailures = 0
+		setBreakerState(breakerClosed)
+		return
+	}
+
+	breakerFailures += 1
+	if breakerState == breakerHalfOpen || (breakerState == breakerClosed && breakerFailures >= breakerThreshold) {
+		log.Warningf("Nftables circuit breaker trips after %v consecutive failure(s), stop applying responses for %v", breakerFailures, breakerCooldown)
+		breakerOpenTime = time.Now()
+		setBreakerState(breakerOpen)
+	}
+}
@@ -0,0 +1,55 @@
+package coredns_nftables
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	SetBreaker(2, time.Hour)
+	defer SetBreaker(0, 0)
+
+	breakerRecord(true, true)
+	if !breakerAllow() {
+		t.Fatalf("Expected breaker is closed before the threshold")
+	}
+	breakerRecord(true, true)
+	if breakerAllow() || breakerState != breakerOpen {
+		t.Fatalf("Expected breaker is open after 2 consecutive failures")
+	}
+
+	// Cool down, only one trial is allowed
+	breakerOpenTime = time.Now().Add(-2 * time.Hour)
+	if !breakerAllow() || breakerState != breakerHalfOpen {
+		t.Fatalf("Expected one trial is allowed after cooldown")
+	}
+	if breakerAllow() {
+		t.Fatalf("Expected only one trial is allowed")
+	}
+	breakerRecord(true, true)
+	if breakerState != breakerOpen || breakerAllow() {
+		t.Fatalf("Expected breaker is open again when the trial failed")
+	}
+
+	breakerOpenTime = time.Now().Add(-2 * time.Hour)
+	if !breakerAllow() {
+		t.Fatalf("Expected one trial is allowed after cooldown")
+	}
+	// A trial without flush does not decide the state
+	breakerRecord(false, false)
+	if breakerState != breakerHalfOpen || !breakerAllow() {
+		t.Fatalf("Expected another trial is allowed when the last one did not flush")
+	}
+	breakerRecord(true, false)
+	if breakerState != breakerClosed || !breakerAllow() {
+		t.Fatalf("Expected breaker is closed when the trial succeeded")
+	}
+
+	// Successes reset the count of consecutive failures
+	breakerRecord(true, true)
+	breakerRecord(true, false)
+	breakerRecord(true, true)
+	if breakerState != breakerClosed {
+		t.Errorf("Expected breaker is closed without consecutive failures")
+	}
+}
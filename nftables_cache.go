@@ -1,28 +1,35 @@
 package coredns_nftables
 
 import (
-	"container/list"
-	"sync"
+	"context"
+	"fmt"
+	"sync/atomic"
 	"time"
 
+	"github.com/coredns/coredns/plugin/metrics"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/google/nftables"
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/mdlayher/netlink"
 	"github.com/miekg/dns"
 	"github.com/vishvananda/netns"
 )
 
 var log = clog.NewWithPlugin("nftables")
-var cacheLock sync.Mutex = sync.Mutex{}
-var cacheList = list.New()
 var cacheExpiredDuration time.Duration = time.Minute * time.Duration(5)
 var setLruMaxRetryTimes int = 2147483647
 var setLruMaxCount int = 10000
 var setLruTimeout time.Duration = time.Hour * time.Duration(720)
+var setLruTTLFactor float64 = 0
+var lastFlushLatency int64 = 0
 
 type NftableCache struct {
 	table    *nftables.Table
-	setCache map[string]*map[string]time.Time
+	setCache map[string]*nftables.Set
+	// The table is missing in kernel, it's created by the batch before its sets in the same transaction
+	pending bool
+	// handles of the table and sets cached, 0 if the backend has no handles, see NftHandleResolver
+	handle     uint64
+	setHandles map[string]uint64
 }
 
 type NftableIPCache struct {
@@ -32,46 +39,49 @@ type NftableIPCache struct {
 
 type NftablesCache struct {
 	tables                    map[nftables.TableFamily]*map[string]*NftableCache
-	recentlyIPCache           *lru.Cache
+	recentlyIPCache           nftablesDedupeStore
 	CreateTimepoint           time.Time
-	NftableConnection         *nftables.Conn
+	NftableConnection         NftBackend
 	NetworkNamespace          netns.NsHandle
 	HasNftableConnectionError bool
+	// the namespace selected by the rules using this connection, connections are pooled by it
+	Namespace NftablesNetworkNamespace
+	// the handleGeneration seen when the tables are cached
+	handleGeneration uint64
+	// the elements with userdata sent after the transaction of NftableConnection, see SetElementUserdata
+	userdataMessages []netlink.Message
+	// when the connection is returned to the pool, see SetConnectionIdleTimeout
+	idleSince time.Time
 }
 
 func NewCache() (*NftablesCache, error) {
-	{
-		cacheLock.Lock()
-		defer cacheLock.Unlock()
-
-		// Destroy timeout connections
-		for cacheList.Front() != nil {
-			cacheHead := cacheList.Front().Value.(*NftablesCache)
-			cacheList.Remove(cacheList.Front())
-
-			if time.Since(cacheHead.CreateTimepoint) > cacheExpiredDuration {
-				go cacheHead.destroy()
-			} else {
-				log.Debugf("Nftables connection select %p from pool", cacheHead)
-				cacheHead.gc()
-				return cacheHead, nil
-			}
-		}
+	return NewCacheInNamespace(NftablesNetworkNamespace{})
+}
+
+// NewCacheInNamespace select a validated idle connection to the network namespace ns from the pool, or open a new one
+func NewCacheInNamespace(ns NftablesNetworkNamespace) (*NftablesCache, error) {
+	if cache := takeIdleConnection(ns); cache != nil {
+		log.Debugf("Nftables connection select %p from pool", cache)
+		cache.gc()
+		return cache, nil
 	}
 
-	c, newNS, err := openSystemNFTConn()
+	c, newNS, err := openBackendIn(ns)
 	if err != nil {
+		connectionFailureCount.Inc()
 		return nil, err
 	}
+	connectionPoolCount.WithLabelValues(connectionPoolOpened).Inc()
 
-	lruCache, _ := lru.New(setLruMaxCount)
 	ret := &NftablesCache{
 		tables:                    make(map[nftables.TableFamily]*map[string]*NftableCache),
-		recentlyIPCache:           lruCache,
+		recentlyIPCache:           sharedDedupe,
 		CreateTimepoint:           time.Now(),
 		NftableConnection:         c,
 		NetworkNamespace:          newNS,
 		HasNftableConnectionError: false,
+		Namespace:                 ns,
+		handleGeneration:          getHandleGeneration(),
 	}
 
 	log.Infof("Nftables create new cache pool %p", ret)
@@ -79,6 +89,11 @@ func NewCache() (*NftablesCache, error) {
 }
 
 func (cache *NftablesCache) LruIgnoreIp(answer *dns.RR) bool {
+	return cache.lruLookupIp(context.Background(), answer)
+}
+
+// lruLookupIp is LruIgnoreIp counting the lookup by the server of ctx
+func (cache *NftablesCache) lruLookupIp(ctx context.Context, answer *dns.RR) bool {
 	if cache.recentlyIPCache == nil {
 		return false
 	}
@@ -97,12 +112,24 @@ func (cache *NftablesCache) LruIgnoreIp(answer *dns.RR) bool {
 		return false
 	}
 
-	value, ok := cache.recentlyIPCache.Get(ip)
+	value, ok := cache.recentlyIPCache.get(ip)
 	if ok {
-		return value.(*NftableIPCache).ApplyCount >= setLruMaxRetryTimes
+		lruLookupCount.WithLabelValues(metrics.WithServer(ctx), lruLookupHit).Inc()
+	} else {
+		lruLookupCount.WithLabelValues(metrics.WithServer(ctx), lruLookupMiss).Inc()
+	}
+	if ok && value.ApplyCount >= setLruMaxRetryTimes {
+		return true
 	}
 
-	return false
+	// The address may be applied by other instances sharing the LRU, see SetLruRedis
+	shared, sharedOk := lruRedisGet(ip)
+	if !sharedOk || shared.ApplyCount < setLruMaxRetryTimes {
+		return false
+	}
+	// keep it in the local LRU, so the next answers of it do not ask Redis again
+	cache.recentlyIPCache.mergeApplyCount(ip, shared.ApplyCount, shared.ExpireTime)
+	return true
 }
 
 func (cache *NftablesCache) LruUpdateIp(answer *dns.RR, rulesCounter int) {
@@ -125,35 +152,35 @@ func (cache *NftablesCache) LruUpdateIp(answer *dns.RR, rulesCounter int) {
 	}
 
 	log.Infof("Nftables apply %v rule(s) for %v(%v) done", rulesCounter, ip, (*answer).Header().Name)
-	value, ok := cache.recentlyIPCache.Get(ip)
-	if ok {
-		value.(*NftableIPCache).ApplyCount += 1
-	} else {
-		cache.recentlyIPCache.Add(ip, &NftableIPCache{
-			ExpireTime: time.Now().Add(setLruTimeout),
-			ApplyCount: 1,
-		})
-	}
+	timeout := lruEntryTimeout(answer)
+	cache.recentlyIPCache.increase(ip, timeout)
+	lruRedisIncrease(ip, timeout)
 }
 
-func (cache *NftablesCache) gc() {
-	if cache.recentlyIPCache == nil {
-		return
-	}
+// getLruEntries returns the living entries of the LRU shared by all connections
+func getLruEntries() map[string]NftableIPCache {
+	ret := make(map[string]NftableIPCache)
+	sharedDedupe.forEach(func(ip string, value NftableIPCache) {
+		ret[ip] = value
+	})
+	return ret
+}
 
-	now := time.Now()
-	for cache.recentlyIPCache.Len() != 0 {
-		_, value, ok := cache.recentlyIPCache.GetOldest()
-		if !ok {
-			break
-		}
+// seedLruEntries add entries into the LRU shared by all connections, living entries keep the greater apply count
+func seedLruEntries(entries map[string]*NftableIPCache) {
+	for ip, value := range entries {
+		sharedDedupe.mergeApplyCount(ip, value.ApplyCount, value.ExpireTime)
+	}
+}
 
-		if value.(*NftableIPCache).ExpireTime.After(now) {
-			break
-		}
+// lruRemoveIp forget ip in the LRU and the shared LRU, so that the next answer of it will be applied again
+func lruRemoveIp(ip string) {
+	lruRedisRemove(ip)
+	sharedDedupe.remove(ip)
+}
 
-		cache.recentlyIPCache.RemoveOldest()
-	}
+func (cache *NftablesCache) gc() {
+	cache.forgetStaleTables()
 }
 
 func (cache *NftablesCache) destroy() error {
@@ -163,37 +190,50 @@ func (cache *NftablesCache) destroy() error {
 	return nil
 }
 
-func CloseCache(cache *NftablesCache) error {
+// Flush send all buffered operations of the connection and record the latency
+func (cache *NftablesCache) Flush() error {
+	startTime := time.Now()
 	err := cache.NftableConnection.Flush()
+	if err == nil {
+		err = cache.flushElementUserdata()
+	} else {
+		cache.userdataMessages = nil
+	}
+	atomic.StoreInt64(&lastFlushLatency, int64(time.Since(startTime)))
+
 	if err != nil {
-		log.Errorf("Nftables Flush connection failed %v", err)
+		atomic.AddUint64(&flushErrorCount, 1)
+		flushFailureCount.Inc()
+	}
+	return err
+}
+
+// GetLastFlushLatency returns the latency of the latest flush of any connection
+func GetLastFlushLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&lastFlushLatency))
+}
+
+func CloseCache(cache *NftablesCache) error {
+	var err error
+	if isolatePanic(context.Background(), "close", func() string { return fmt.Sprintf("%p", cache) }, func() { err = cache.Flush() }) {
 		cache.HasNftableConnectionError = true
+	} else if err != nil {
+		log.Errorf("Nftables Flush connection failed %v", err)
+		cache.recordConnectionError(err)
 	}
 
-	if cache.HasNftableConnectionError || time.Since(cache.CreateTimepoint) > cacheExpiredDuration {
+	if cache.HasNftableConnectionError || cache.expiredFor(connectionOperationAdd) {
 		return cache.destroy()
 	}
 
-	cacheLock.Lock()
-	defer cacheLock.Unlock()
-
-	cacheList.PushBack(cache)
-	log.Debugf("Nftables connection %p add to cache pool", cache)
-
+	putIdleConnection(cache)
 	return nil
 }
 
+// ClearCache destroy all idle connections, the LRU is shared by all connections and kept, so that reloading does
+// not apply all addresses again
 func ClearCache() {
-	cacheLock.Lock()
-	defer cacheLock.Unlock()
-
-	// Destroy timeout connections
-	for cacheList.Front() != nil {
-		cacheHead := cacheList.Front().Value.(*NftablesCache)
-		cacheList.Remove(cacheList.Front())
-
-		go cacheHead.destroy()
-	}
+	drainIdleConnections()
 }
 
 func (cache *NftablesCache) MutableNftablesTable(family nftables.TableFamily, tableName string) *NftableCache {
@@ -212,7 +252,9 @@ func (cache *NftablesCache) MutableNftablesTable(family nftables.TableFamily, ta
 			for _, table := range tables {
 				log.Debugf("\t - %v", table.Name)
 				(*tableSet)[(*table).Name] = &NftableCache{
-					table: table,
+					table:      table,
+					setCache:   make(map[string]*nftables.Set),
+					setHandles: make(map[string]uint64),
 				}
 			}
 		}
@@ -225,25 +267,55 @@ func (cache *NftablesCache) MutableNftablesTable(family nftables.TableFamily, ta
 				Family: family,
 				Name:   tableName,
 			},
+			setCache:   make(map[string]*nftables.Set),
+			setHandles: make(map[string]uint64),
+			pending:    true,
 		}
 		log.Debugf("Nftables try to create table %v %v", (*cache).GetFamilyName(family), tableName)
 		(*tableSet)[tableName] = tableCache
-		tableCache.table = cache.NftableConnection.AddTable(tableCache.table)
 	}
 
 	return tableCache
 }
 
+// GetSetDefinition queries the kernel set definition once and keeps it for the lifetime of this connection
+func (cache *NftablesCache) GetSetDefinition(tableCache *NftableCache, setName string) *nftables.Set {
+	set, ok := tableCache.setCache[setName]
+	if ok {
+		return set
+	}
+	if tableCache.pending {
+		return nil
+	}
+
+	set, _ = cache.NftableConnection.GetSetByName(tableCache.table, setName)
+	if set != nil {
+		tableCache.setCache[setName] = set
+		cache.captureHandles(tableCache, setName)
+	}
+	return set
+}
+
+// AddSetDefinition records a set created by this connection, and the handles the kernel assigned to it
+func (cache *NftablesCache) AddSetDefinition(tableCache *NftableCache, set *nftables.Set) {
+	tableCache.setCache[set.Name] = set
+	cache.captureHandles(tableCache, set.Name)
+}
+
 func (cache *NftablesCache) SetAddElements(tableCache *NftableCache, set *nftables.Set, elements []nftables.SetElement) error {
 	err := cache.NftableConnection.SetAddElements(set, elements)
 	if err != nil {
-		cache.HasNftableConnectionError = true
+		cache.recordConnectionError(err)
 	}
 
 	return err
 }
 
 func (cache *NftablesCache) GetFamilyName(family nftables.TableFamily) string {
+	return getFamilyName(family)
+}
+
+func getFamilyName(family nftables.TableFamily) string {
 	switch family {
 	case nftables.TableFamilyUnspecified:
 		return "unspecified"
@@ -264,33 +336,31 @@ func (cache *NftablesCache) GetFamilyName(family nftables.TableFamily) string {
 	return "unknown"
 }
 
-// openSystemNFTConn returns a netlink connection that tests against
-// the running kernel in a separate network namespace.
-// cleanupSystemNFTConn() must be called from a defer to cleanup
-// created network namespace.
+// openSystemNFTConn returns a netlink connection to the network namespace selected by SetNetworkNamespace.
+// cleanupSystemNFTConn() must be called with the returned handle when the connection is not used anymore, since
+// every flush of the connection opens a socket in the namespace.
 func openSystemNFTConn() (*nftables.Conn, netns.NsHandle, error) {
-	// We lock the goroutine into the current thread, as namespace operations
-	// such as those invoked by `netns.New()` are thread-local. This is undone
-	// in cleanupSystemNFTConn().
-	// runtime.LockOSThread()
-
-	// ns, err := netns.New()
-	// if err != nil {
-	// 	log.Errorf("netns.New() failed: %v", err)
-	// 	return nil, 0, err
-	// }
-	// c, err := nftables.New(nftables.WithNetNSFd(int(ns)))
-	c, err := nftables.New()
+	return openSystemNFTConnIn(NftablesNetworkNamespace{})
+}
+
+// openSystemNFTConnIn returns a netlink connection to the network namespace namespace, see openSystemNFTConn
+func openSystemNFTConnIn(namespace NftablesNetworkNamespace) (*nftables.Conn, netns.NsHandle, error) {
+	ns, err := openNetworkNamespace(namespace)
+	if err != nil {
+		log.Errorf("Nftables open network namespace failed: %v", err)
+		return nil, 0, err
+	}
+
+	c, err := nftables.New(nftables.WithNetNSFd(int(ns)))
 	if err != nil {
 		log.Errorf("Nftables call nftables.New() failed: %v", err)
+		cleanupSystemNFTConn(ns)
+		return c, 0, err
 	}
-	// return c, ns, err
-	return c, 0, err
+	return c, ns, err
 }
 
 func cleanupSystemNFTConn(newNS netns.NsHandle) {
-	// defer runtime.UnlockOSThread()
-
 	if newNS == 0 {
 		return
 	}
@@ -307,8 +377,31 @@ func SetSetLruTimeout(timeout time.Duration) {
 	setLruTimeout = timeout
 }
 
+// SetSetLruTTLFactor let the entries of the LRU expire after the TTL of their first answer multiplied by factor,
+// at most the LRU timeout. 0 means the LRU timeout for all entries.
+func SetSetLruTTLFactor(factor float64) {
+	setLruTTLFactor = factor
+}
+
+// lruEntryTimeout returns how long the entry of the address of answer is kept in the LRU
+func lruEntryTimeout(answer *dns.RR) time.Duration {
+	if setLruTTLFactor <= 0 {
+		return setLruTimeout
+	}
+	timeout := time.Duration(float64((*answer).Header().Ttl) * setLruTTLFactor * float64(time.Second))
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	if timeout > setLruTimeout {
+		timeout = setLruTimeout
+	}
+	return timeout
+}
+
+// SetSetLruMaxCount resize the LRU shared by all connections, the most recent entries are kept
 func SetSetLruMaxCount(count int) {
 	setLruMaxCount = count
+	sharedLru.resize(count)
 }
 
 func SetSetLruMaxRetryTimes(times int) {
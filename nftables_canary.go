@@ -0,0 +1,190 @@
+package coredns_nftables
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+const canaryDefaultSuffix = "_canary"
+
+// canaryReportLimit is how many elements of each side are listed by default, the counts are always complete
+const canaryReportLimit = 100
+
+// NftablesCanary is a new rule configuration applied to shadow sets, the name of each shadow set is the set name
+// of its rule with Suffix. It's applied to the same answers as the production rules, so the shadow sets can be
+// compared with the production sets before the new configuration is rolled out.
+type NftablesCanary struct {
+	Suffix string
+	Rules  map[nftables.TableFamily]*NftablesRuleSet
+}
+
+// NftablesCanaryDiff compares the intended elements of a production set and its shadow set
+type NftablesCanaryDiff struct {
+	Family              string   `json:"family"`
+	Table               string   `json:"table"`
+	Set                 string   `json:"set"`
+	CanarySet           string   `json:"canary_set"`
+	Common              int      `json:"common"`
+	OnlyProductionCount int      `json:"only_production_count"`
+	OnlyCanaryCount     int      `json:"only_canary_count"`
+	OnlyProduction      []string `json:"only_production"`
+	OnlyCanary          []string `json:"only_canary"`
+}
+
+func NewNftablesCanary(suffix string) *NftablesCanary {
+	return &NftablesCanary{Suffix: suffix, Rules: make(map[nftables.TableFamily]*NftablesRuleSet)}
+}
+
+func (canary *NftablesCanary) MutableRuleSet(family nftables.TableFamily) *NftablesRuleSet {
+	ret, ok := canary.Rules[family]
+	if !ok {
+		ret = &NftablesRuleSet{}
+		canary.Rules[family] = ret
+	}
+	return ret
+}
+
+// ProductionSet returns the name of the production set compared with the shadow set of rule
+func (canary *NftablesCanary) ProductionSet(rule *NftablesSetAddElement) string {
+	return strings.TrimSuffix(rule.SetName, canary.Suffix)
+}
+
+// ServeDNS apply the canary rules of each family. Failures are logged and counted like other rules, but never
+// fail the answer, so the production LRU and results are not affected by the canary.
+func (canary *NftablesCanary) ServeDNS(ctx context.Context, batch *NftablesBatch, answer *dns.RR, families []nftables.TableFamily) {
+	for _, family := range families {
+		ruleSet, ok := canary.Rules[family]
+		if !ok {
+			continue
+		}
+		for _, rule := range ruleSet.RuleAddElement {
+			if !rule.MatchName(batch.AnswerNames(answer)...) {
+				continue
+			}
+			err, _ := rule.ServeDNS(ctx, batch, answer, family)
+			if err != nil {
+				logAddElementError(batch.Cache(), answer, family, rule, err)
+			}
+		}
+	}
+}
+
+// getRunningCanaries returns the canaries of all running handlers
+func getRunningCanaries() []*NftablesCanary {
+	stateDumpLock.Lock()
+	defer stateDumpLock.Unlock()
+
+	var ret []*NftablesCanary
+	for handler := range stateDumpHandlers {
+		if handler.Canary != nil {
+			ret = append(ret, handler.Canary)
+		}
+	}
+	return ret
+}
+
+func limitCanaryElements(elements []string, limit int) []string {
+	sort.Strings(elements)
+	if limit >= 0 && len(elements) > limit {
+		return elements[:limit]
+	}
+	return elements
+}
+
+// GetCanaryReport compares the living elements the plugin intends to keep in each production set and its shadow
+// set, at most limit elements of each side are listed and negative limit lists all of them
+func GetCanaryReport(limit int) []NftablesCanaryDiff {
+	tracked := GetTrackedElements()
+	elementsOf := func(family nftables.TableFamily, tableName string, setName string) map[string]bool {
+		ret := make(map[string]bool)
+		for _, element := range tracked[trackedSetKey(family, tableName, setName)] {
+			ret[element.Element] = true
+		}
+		return ret
+	}
+
+	ret := []NftablesCanaryDiff{}
+	seen := make(map[string]bool)
+	for _, canary := range getRunningCanaries() {
+		for family, ruleSet := range canary.Rules {
+			for _, rule := range ruleSet.RuleAddElement {
+				setKey := trackedSetKey(family, rule.TableName, rule.SetName)
+				if seen[setKey] {
+					continue
+				}
+				seen[setKey] = true
+
+				diff := NftablesCanaryDiff{
+					Family:         getFamilyName(family),
+					Table:          rule.TableName,
+					Set:            canary.ProductionSet(rule),
+					CanarySet:      rule.SetName,
+					OnlyProduction: []string{},
+					OnlyCanary:     []string{},
+				}
+				production := elementsOf(family, rule.TableName, diff.Set)
+				shadow := elementsOf(family, rule.TableName, rule.SetName)
+				for element := range production {
+					if shadow[element] {
+						diff.Common += 1
+					} else {
+						diff.OnlyProduction = append(diff.OnlyProduction, element)
+					}
+				}
+				for element := range shadow {
+					if !production[element] {
+						diff.OnlyCanary = append(diff.OnlyCanary, element)
+					}
+				}
+				diff.OnlyProductionCount = len(diff.OnlyProduction)
+				diff.OnlyCanaryCount = len(diff.OnlyCanary)
+				diff.OnlyProduction = limitCanaryElements(diff.OnlyProduction, limit)
+				diff.OnlyCanary = limitCanaryElements(diff.OnlyCanary, limit)
+				ret = append(ret, diff)
+			}
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Family != ret[j].Family {
+			return ret[i].Family < ret[j].Family
+		}
+		if ret[i].Table != ret[j].Table {
+			return ret[i].Table < ret[j].Table
+		}
+		return ret[i].CanarySet < ret[j].CanarySet
+	})
+	return ret
+}
+
+func init() {
+	registerAdminHandler("/canary", serveAdminCanary)
+}
+
+// serveAdminCanary returns the diff of production and shadow sets by GET /canary[?limit=<COUNT>]
+func serveAdminCanary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := canaryReportLimit
+	if value := r.URL.Query().Get("limit"); len(value) > 0 {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "limit "+value+" invalid", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetCanaryReport(limit))
+}
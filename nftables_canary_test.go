@@ -0,0 +1,109 @@
+package coredns_nftables
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+)
+
+func TestCanaryReport(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	EnableElementTracker(true)
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		EnableElementTracker(false)
+		ClearCache()
+	}()
+
+	handle := NewNftablesHandler()
+	production := &NftablesSetAddElement{TableName: "filter", SetName: "VPN", KeyType: nftables.TypeIPAddr, Timeout: time.Hour,
+		Match: NewNftablesDomainMatcher()}
+	production.Match.Add("example.org")
+	handle.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddElement = []*NftablesSetAddElement{production}
+
+	// the new configuration also matches example.net
+	handle.Canary = NewNftablesCanary(canaryDefaultSuffix)
+	canaryRule := &NftablesSetAddElement{TableName: "filter", SetName: "VPN" + canaryDefaultSuffix, KeyType: nftables.TypeIPAddr, Timeout: time.Hour,
+		Match: NewNftablesDomainMatcher()}
+	canaryRule.Match.Add("example.org")
+	canaryRule.Match.Add("example.net")
+	handle.Canary.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddElement = []*NftablesSetAddElement{canaryRule}
+	StartStateDump(&handle)
+	defer StopStateDump(&handle)
+
+	for _, msg := range []struct {
+		qname  string
+		record string
+	}{
+		{"example.org.", "example.org. 60 IN A 192.0.2.1"},
+		{"example.net.", "example.net. 60 IN A 192.0.2.2"},
+	} {
+		if _, err := handle.ServeWorker(context.Background(), newTestResponse(t, msg.qname, msg.record)); err != nil {
+			t.Fatalf("Expected answer applied, but got %v", err)
+		}
+	}
+
+	backend := NewMemoryBackend(ruleset)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	if _, err := backend.GetSetByName(table, "VPN_canary"); err != nil {
+		t.Fatalf("Expected shadow set created, but got %v", err)
+	}
+
+	report := GetCanaryReport(canaryReportLimit)
+	if len(report) != 1 {
+		t.Fatalf("Expected one diff, but got %v", report)
+	}
+	diff := report[0]
+	if diff.Set != "VPN" || diff.CanarySet != "VPN_canary" || diff.Common != 1 || diff.OnlyProductionCount != 0 ||
+		diff.OnlyCanaryCount != 1 || len(diff.OnlyCanary) != 1 || diff.OnlyCanary[0] != "192.0.2.2" {
+		t.Errorf("Expected 192.0.2.2 only in canary, but got %+v", diff)
+	}
+
+	if report := GetCanaryReport(0); len(report[0].OnlyCanary) != 0 || report[0].OnlyCanaryCount != 1 {
+		t.Errorf("Expected elements not listed by limit 0, but got %+v", report[0])
+	}
+
+	recorder := httptest.NewRecorder()
+	serveAdminCanary(recorder, httptest.NewRequest(http.MethodGet, "/canary", nil))
+	var served []NftablesCanaryDiff
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil || len(served) != 1 || served[0].OnlyCanaryCount != 1 {
+		t.Errorf("Expected report served, but got %v, %v", recorder.Body.String(), err)
+	}
+	recorder = httptest.NewRecorder()
+	serveAdminCanary(recorder, httptest.NewRequest(http.MethodGet, "/canary?limit=x", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid limit rejected, but got %v", recorder.Code)
+	}
+}
+
+func TestParseCanary(t *testing.T) {
+	defer EnableElementTracker(false)
+
+	c := caddy.NewTestController("dns", `nftables ip {
+		canary _next {
+			add_element filter VPN ip false 1h {
+				match example.org
+			}
+			add_element ip6 filter VPN6 ip6
+		}
+	}`)
+	handle := NewNftablesHandler()
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if handle.Canary == nil || handle.Canary.Rules[nftables.TableFamilyIPv4].RuleAddElement[0].SetName != "VPN_next" ||
+		handle.Canary.Rules[nftables.TableFamilyIPv6].RuleAddElement[0].SetName != "VPN6_next" {
+		t.Fatalf("Expected canary rules of shadow sets, but got %+v", handle.Canary)
+	}
+	if set := handle.Canary.ProductionSet(handle.Canary.Rules[nftables.TableFamilyIPv4].RuleAddElement[0]); set != "VPN" {
+		t.Errorf("Expected production set VPN, but got %v", set)
+	}
+}
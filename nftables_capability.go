@@ -0,0 +1,173 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// NftablesCapability is the result of probing one kernel feature
+type NftablesCapability struct {
+	Name      string
+	Supported bool
+	Err       error
+}
+
+// NftablesCapabilities is the feature-capability report of the running kernel
+type NftablesCapabilities struct {
+	Kernel       string
+	Capabilities []NftablesCapability
+}
+
+func (report *NftablesCapabilities) Supported(name string) bool {
+	for _, capability := range report.Capabilities {
+		if capability.Name == name {
+			return capability.Supported
+		}
+	}
+
+	return false
+}
+
+func (report *NftablesCapabilities) String() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "nftables capabilities of kernel %v:", report.Kernel)
+	for _, capability := range report.Capabilities {
+		if capability.Supported {
+			fmt.Fprintf(&builder, "\n  - %v: supported", capability.Name)
+		} else {
+			fmt.Fprintf(&builder, "\n  - %v: unsupported(%v)", capability.Name, capability.Err)
+		}
+	}
+	return builder.String()
+}
+
+type nftablesCapabilityProbe struct {
+	name  string
+	probe func(conn *nftables.Conn, table *nftables.Table) error
+}
+
+var nftablesCapabilityProbes = []nftablesCapabilityProbe{
+	{"set", probeSet},
+	{"interval set", probeIntervalSet},
+	{"element timeout", probeElementTimeout},
+	{"concatenation", probeConcatenation},
+	{"dynamic set", probeDynamicSet},
+	{"named counter", probeNamedCounter},
+}
+
+// ProbeCapabilities checks kernel features used by this plugin in a temporary inet table, each feature is
+// probed in its own transaction and the table is deleted at last.
+func ProbeCapabilities(conn *nftables.Conn) *NftablesCapabilities {
+	report := &NftablesCapabilities{Kernel: kernelRelease()}
+	table := &nftables.Table{
+		Family: nftables.TableFamilyINet,
+		Name:   fmt.Sprintf("coredns_nftables_probe_%v", os.Getpid()),
+	}
+
+	conn.AddTable(table)
+	if err := conn.Flush(); err != nil {
+		for _, probe := range nftablesCapabilityProbes {
+			report.Capabilities = append(report.Capabilities, NftablesCapability{Name: probe.name, Err: err})
+		}
+		return report
+	}
+	defer func() {
+		conn.DelTable(table)
+		if err := conn.Flush(); err != nil {
+			log.Warningf("Nftables delete probe table %v failed. %v", table.Name, err)
+		}
+	}()
+
+	for _, probe := range nftablesCapabilityProbes {
+		err := probe.probe(conn, table)
+		if err == nil {
+			err = conn.Flush()
+		} else {
+			// flush anyway so that messages queued by this probe do not leak into the next one
+			conn.Flush()
+		}
+		report.Capabilities = append(report.Capabilities, NftablesCapability{Name: probe.name, Supported: err == nil, Err: err})
+	}
+
+	return report
+}
+
+func probeSet(conn *nftables.Conn, table *nftables.Table) error {
+	set := &nftables.Set{Table: table, Name: "probe_set", KeyType: nftables.TypeIPAddr}
+	return conn.AddSet(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+}
+
+func probeIntervalSet(conn *nftables.Conn, table *nftables.Table) error {
+	set := &nftables.Set{Table: table, Name: "probe_interval", KeyType: nftables.TypeIPAddr, Interval: true}
+	return conn.AddSet(set, []nftables.SetElement{
+		{Key: net.ParseIP("192.0.2.0").To4()},
+		{Key: net.ParseIP("192.0.3.0").To4(), IntervalEnd: true},
+	})
+}
+
+func probeElementTimeout(conn *nftables.Conn, table *nftables.Table) error {
+	set := &nftables.Set{Table: table, Name: "probe_timeout", KeyType: nftables.TypeIPAddr, HasTimeout: true, Timeout: time.Hour}
+	return conn.AddSet(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4(), Timeout: time.Minute}})
+}
+
+func probeConcatenation(conn *nftables.Conn, table *nftables.Table) error {
+	keyType, err := nftables.ConcatSetType(nftables.TypeIPAddr, nftables.TypeInetService)
+	if err != nil {
+		return err
+	}
+	set := &nftables.Set{Table: table, Name: "probe_concat", KeyType: keyType, Concatenation: true}
+	return conn.AddSet(set, []nftables.SetElement{{Key: []byte{192, 0, 2, 1, 1, 187, 0, 0}}})
+}
+
+func probeDynamicSet(conn *nftables.Conn, table *nftables.Table) error {
+	set := &nftables.Set{Table: table, Name: "probe_dynamic", KeyType: nftables.TypeIPAddr, HasTimeout: true, Timeout: time.Hour}
+	if err := conn.AddSet(set, nil); err != nil {
+		return err
+	}
+	chain := conn.AddChain(&nftables.Chain{Table: table, Name: "probe_dynamic"})
+	conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Dynset{SrcRegKey: 1, SetName: set.Name, SetID: set.ID, Operation: 1, Timeout: time.Minute},
+		},
+	})
+	return nil
+}
+
+func probeNamedCounter(conn *nftables.Conn, table *nftables.Table) error {
+	conn.AddObj(&nftables.CounterObj{Table: table, Name: "probe_counter"})
+	return nil
+}
+
+func kernelRelease() string {
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "unknown"
+	}
+	return strings.TrimSpace(string(release))
+}
+
+var logCapabilitiesOnStartup bool = false
+
+func SetLogCapabilitiesOnStartup(enable bool) {
+	logCapabilitiesOnStartup = enable
+}
+
+// LogCapabilities probe the running kernel and log the feature-capability report
+func LogCapabilities() {
+	conn, newNS, err := openSystemNFTConn()
+	if err != nil {
+		return
+	}
+	defer cleanupSystemNFTConn(newNS)
+
+	log.Info(ProbeCapabilities(conn).String())
+}
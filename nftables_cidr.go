@@ -0,0 +1,72 @@
+package coredns_nftables
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// NftablesAddressFilter restricts answers applied by all rules of a handler by address.
+// An address is allowed when it's in any of Include(or Include is empty) and not in any of Exclude.
+type NftablesAddressFilter struct {
+	Include []*net.IPNet
+	Exclude []*net.IPNet
+}
+
+func (f *NftablesAddressFilter) Allow(ip net.IP) bool {
+	for _, network := range f.Exclude {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, network := range f.Include {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parse addresses and networks, a single address is treated as a /32 or /128 network
+func parseCIDRs(args []string) ([]*net.IPNet, error) {
+	ret := make([]*net.IPNet, 0, len(args))
+	for _, arg := range args {
+		arg, err := stripAddressZone(arg)
+		if err != nil {
+			return nil, err
+		}
+		_, network, err := net.ParseCIDR(arg)
+		if err != nil {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return nil, err
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		ret = append(ret, network)
+	}
+	return ret, nil
+}
+
+// allowAnswer returns false if the address of A/AAAA answer is filtered by the CIDR filter of handler
+func (m *NftablesHandler) allowAnswer(answer *dns.RR) bool {
+	if m.AddressFilter == nil {
+		return true
+	}
+
+	switch (*answer).Header().Rrtype {
+	case dns.TypeA:
+		return m.AddressFilter.Allow((*answer).(*dns.A).A)
+	case dns.TypeAAAA:
+		return m.AddressFilter.Allow((*answer).(*dns.AAAA).AAAA)
+	}
+	return true
+}
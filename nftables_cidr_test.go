@@ -0,0 +1,43 @@
+package coredns_nftables
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddressFilter(t *testing.T) {
+	include, err := parseCIDRs([]string{"0.0.0.0/0", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("parseCIDRs failed: %v", err)
+	}
+	exclude, err := parseCIDRs([]string{"10.0.0.0/8", "fe80::/10", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("parseCIDRs failed: %v", err)
+	}
+	filter := &NftablesAddressFilter{Include: include, Exclude: exclude}
+
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"8.8.8.8", true},
+		{"10.1.2.3", false},
+		{"192.0.2.1", false},
+		{"192.0.2.2", true},
+		{"2001:db8::1", true},
+		{"fe80::1", false},
+		{"2606:4700::1111", false},
+	}
+	for _, test := range tests {
+		if got := filter.Allow(net.ParseIP(test.ip)); got != test.expected {
+			t.Errorf("Allow(%v) expected %v, but got %v", test.ip, test.expected, got)
+		}
+	}
+
+	if !(&NftablesAddressFilter{}).Allow(net.ParseIP("10.1.2.3")) {
+		t.Errorf("Expected empty filter to allow all addresses")
+	}
+	if _, err := parseCIDRs([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("Expected invalid CIDR failed")
+	}
+}
@@ -0,0 +1,46 @@
+package coredns_nftables
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Max length of CNAME chain to follow, loops are stopped by it
+const cnameChainMaxDepth = 16
+
+// nftablesCnameChain maps each CNAME target to the owners pointing to it in one response
+type nftablesCnameChain struct {
+	owners map[string][]string
+}
+
+func newCnameChain(r *dns.Msg) *nftablesCnameChain {
+	ret := &nftablesCnameChain{owners: make(map[string][]string)}
+	for _, answer := range r.Answer {
+		cname, ok := answer.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		target := dns.CanonicalName(cname.Target)
+		ret.owners[target] = append(ret.owners[target], normalizeName(cname.Hdr.Name))
+	}
+	return ret
+}
+
+// names returns name and all names pointing to it by CNAME, the query name is the last one of a simple chain
+func (c *nftablesCnameChain) names(name string) []string {
+	ret := []string{name}
+	if len(c.owners) == 0 {
+		return ret
+	}
+
+	seen := map[string]bool{dns.CanonicalName(name): true}
+	for i := 0; i < len(ret) && i < cnameChainMaxDepth; i++ {
+		for _, owner := range c.owners[dns.CanonicalName(ret[i])] {
+			if seen[dns.CanonicalName(owner)] {
+				continue
+			}
+			seen[dns.CanonicalName(owner)] = true
+			ret = append(ret, owner)
+		}
+	}
+	return ret
+}
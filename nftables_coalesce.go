@@ -0,0 +1,79 @@
+package coredns_nftables
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var coalesceWindow time.Duration = 0
+
+// Prune expired keys when there are more than this count of recent responses
+const coalesceMaxEntries = 4096
+
+// SetCoalesceWindow set the window in which identical responses are processed once, 0 disables it
+func SetCoalesceWindow(window time.Duration) {
+	coalesceWindow = window
+}
+
+// nftablesRecentResponses is the micro-cache of responses processed by one handler recently
+type nftablesRecentResponses struct {
+	lock    sync.Mutex
+	expires map[uint64]time.Time
+}
+
+func newRecentResponses() *nftablesRecentResponses {
+	return &nftablesRecentResponses{expires: make(map[uint64]time.Time)}
+}
+
+// responseKey hash the question and answers of r. TTL is not a part of the key, so the same answers served from
+// cache with a smaller TTL are still identical.
+func responseKey(r *dns.Msg) uint64 {
+	answers := make([]string, 0, len(r.Answer))
+	for _, answer := range r.Answer {
+		header := answer.Header()
+		text := strings.TrimPrefix(answer.String(), header.String())
+		answers = append(answers, dns.CanonicalName(header.Name)+" "+strconv.Itoa(int(header.Rrtype))+" "+text)
+	}
+	sort.Strings(answers)
+
+	hash := fnv.New64a()
+	if len(r.Question) > 0 {
+		hash.Write([]byte(dns.CanonicalName(r.Question[0].Name)))
+		hash.Write([]byte{byte(r.Question[0].Qtype >> 8), byte(r.Question[0].Qtype), 0})
+	}
+	for _, answer := range answers {
+		hash.Write([]byte(answer))
+		hash.Write([]byte{0})
+	}
+	return hash.Sum64()
+}
+
+// coalesce returns true if an identical response is already processed in window
+func (recent *nftablesRecentResponses) coalesce(r *dns.Msg, window time.Duration) bool {
+	key := responseKey(r)
+	now := time.Now()
+
+	recent.lock.Lock()
+	defer recent.lock.Unlock()
+
+	expire, ok := recent.expires[key]
+	if ok && expire.After(now) {
+		return true
+	}
+
+	if len(recent.expires) >= coalesceMaxEntries {
+		for k, v := range recent.expires {
+			if !v.After(now) {
+				delete(recent.expires, k)
+			}
+		}
+	}
+	recent.expires[key] = now.Add(window)
+	return false
+}
@@ -0,0 +1,46 @@
+package coredns_nftables
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestResponse(t *testing.T, qname string, records ...string) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(qname, dns.TypeA)
+	for _, text := range records {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+	return r
+}
+
+func TestCoalesceResponses(t *testing.T) {
+	recent := newRecentResponses()
+	first := newTestResponse(t, "example.org.", "example.org. 300 IN A 192.0.2.1", "example.org. 300 IN A 192.0.2.2")
+	if recent.coalesce(first, time.Hour) {
+		t.Fatalf("Expected the first response is processed")
+	}
+
+	// same answers in different order, case and TTL
+	same := newTestResponse(t, "EXAMPLE.org.", "example.org. 100 IN A 192.0.2.2", "Example.org. 100 IN A 192.0.2.1")
+	if !recent.coalesce(same, time.Hour) {
+		t.Errorf("Expected identical response is coalesced")
+	}
+
+	changed := newTestResponse(t, "example.org.", "example.org. 300 IN A 192.0.2.3")
+	if recent.coalesce(changed, time.Hour) {
+		t.Errorf("Expected response with different answers is processed")
+	}
+
+	expired := newTestResponse(t, "example.com.", "example.com. 300 IN A 192.0.2.1")
+	recent.coalesce(expired, -time.Second)
+	if recent.coalesce(expired, time.Hour) {
+		t.Errorf("Expected response is processed again after window")
+	}
+}
@@ -0,0 +1,42 @@
+package coredns_nftables
+
+import (
+	"github.com/miekg/dns"
+)
+
+// compactMsg returns a copy of r which only keeps what the workers read: the header, the question and the
+// A/AAAA/CNAME/SVCB/HTTPS answers. Signatures, authority and additional sections(EDNS0 padding included) are
+// dropped, so that async mode does not copy the whole response of DNSSEC signed zones.
+func compactMsg(r *dns.Msg) *dns.Msg {
+	ret := &dns.Msg{MsgHdr: r.MsgHdr, Compress: r.Compress}
+	if len(r.Question) > 0 {
+		ret.Question = make([]dns.Question, len(r.Question))
+		copy(ret.Question, r.Question)
+	}
+
+	count := 0
+	for _, answer := range r.Answer {
+		if isCompactAnswer(answer) {
+			count += 1
+		}
+	}
+	if count == 0 {
+		return ret
+	}
+
+	ret.Answer = make([]dns.RR, 0, count)
+	for _, answer := range r.Answer {
+		if isCompactAnswer(answer) {
+			ret.Answer = append(ret.Answer, dns.Copy(answer))
+		}
+	}
+	return ret
+}
+
+func isCompactAnswer(answer dns.RR) bool {
+	switch answer.Header().Rrtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypeSVCB, dns.TypeHTTPS:
+		return true
+	}
+	return false
+}
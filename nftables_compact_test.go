@@ -0,0 +1,46 @@
+package coredns_nftables
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCompactMsg(t *testing.T) {
+	r := newTestResponse(t, "www.example.org.",
+		"www.example.org. 300 IN CNAME example.org.",
+		"www.example.org. 300 IN RRSIG CNAME 13 3 300 20300101000000 20200101000000 12345 example.org. dGVzdA==",
+		"example.org. 300 IN A 192.0.2.1",
+		"example.org. 300 IN AAAA 2001:db8::1",
+		"example.org. 300 IN HTTPS 1 . ipv4hint=192.0.2.2",
+		"example.org. 300 IN TXT \"ignored\"")
+	r.Ns = append(r.Ns, r.Answer[5])
+	r.SetEdns0(4096, true)
+	r.Id = 1234
+
+	compact := compactMsg(r)
+	if compact.Id != r.Id || len(compact.Question) != 1 || compact.Question[0] != r.Question[0] {
+		t.Errorf("Expected header and question are kept, got %v", compact)
+	}
+	if len(compact.Ns) != 0 || len(compact.Extra) != 0 {
+		t.Errorf("Expected authority and additional sections are dropped, got %v", compact)
+	}
+	if len(compact.Answer) != 4 {
+		t.Fatalf("Expected 4 answers kept, got %v", compact.Answer)
+	}
+	for i, rrtype := range []uint16{dns.TypeCNAME, dns.TypeA, dns.TypeAAAA, dns.TypeHTTPS} {
+		if compact.Answer[i].Header().Rrtype != rrtype {
+			t.Errorf("Expected answer %v is %v, got %v", i, dns.TypeToString[rrtype], compact.Answer[i])
+		}
+	}
+
+	// the original response may be changed after it's written
+	r.Answer[2].(*dns.A).A[3] = 100
+	if compact.Answer[1].(*dns.A).A.String() != "192.0.2.1" {
+		t.Errorf("Expected answers are copied, got %v", compact.Answer[1])
+	}
+
+	if compact := compactMsg(newTestResponse(t, "example.org.")); len(compact.Answer) != 0 {
+		t.Errorf("Expected no answers, got %v", compact.Answer)
+	}
+}
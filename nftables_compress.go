@@ -0,0 +1,185 @@
+package coredns_nftables
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Compression of rotated applied logs, see SetAppliedLogCompression
+const (
+	appliedLogCompressNone = "none"
+	appliedLogCompressGzip = "gzip"
+)
+
+const gzipSuffix = ".gz"
+
+var appliedLogRetentionLock sync.Mutex = sync.Mutex{}
+var appliedLogCompress string = appliedLogCompressNone
+var appliedLogRetention time.Duration = 0
+
+// SetAppliedLogCompression select how the rotated files of `log file` are compressed, gzip or none(the default)
+func SetAppliedLogCompression(compress string) error {
+	compress = strings.ToLower(compress)
+	switch compress {
+	case appliedLogCompressNone, appliedLogCompressGzip:
+	default:
+		return fmt.Errorf("compression %v not supported, use gzip or none", compress)
+	}
+
+	appliedLogRetentionLock.Lock()
+	defer appliedLogRetentionLock.Unlock()
+
+	appliedLogCompress = compress
+	return nil
+}
+
+// SetAppliedLogRetention remove the rotated files of `log file` modified longer than retention ago, 0 keeps them
+// until max_backups is exceeded
+func SetAppliedLogRetention(retention time.Duration) {
+	appliedLogRetentionLock.Lock()
+	defer appliedLogRetentionLock.Unlock()
+
+	appliedLogRetention = retention
+}
+
+func getAppliedLogCompression() (string, time.Duration) {
+	appliedLogRetentionLock.Lock()
+	defer appliedLogRetentionLock.Unlock()
+
+	return appliedLogCompress, appliedLogRetention
+}
+
+// rotatedLogPath returns the existing file of the index-th backup of path, compressed or not, or the name of an
+// uncompressed one if neither exists
+func rotatedLogPath(path string, index int) string {
+	name := path + "." + strconv.Itoa(index)
+	if _, err := os.Stat(name + gzipSuffix); err == nil {
+		return name + gzipSuffix
+	}
+	return name
+}
+
+// compressLogFile replace path by path.gz
+func compressLogFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(path+gzipSuffix+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(target)
+	_, err = io.Copy(writer, source)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := target.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+gzipSuffix+".tmp", path+gzipSuffix)
+	}
+	if err != nil {
+		os.Remove(path + gzipSuffix + ".tmp")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeExpiredLogFiles remove the rotated files of path modified before retention, it returns how many files
+// are removed
+func removeExpiredLogFiles(path string, retention time.Duration) int {
+	if retention <= 0 {
+		return 0
+	}
+	matches, err := filepath.Glob(path + ".[0-9]*")
+	if err != nil {
+		return 0
+	}
+	deadline := time.Now().Add(-retention)
+	removed := 0
+	for _, match := range matches {
+		suffix := strings.TrimSuffix(match[len(path)+1:], gzipSuffix)
+		if _, err := strconv.Atoi(suffix); err != nil {
+			continue
+		}
+		info, err := os.Stat(match)
+		if err != nil || info.ModTime().After(deadline) {
+			continue
+		}
+		if err := os.Remove(match); err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Infof("Nftables remove %v applied log file(s) of %v older than %v", removed, path, retention)
+	}
+	return removed
+}
+
+// openMaybeCompressed open the file for reading, gzip files are decompressed
+func openMaybeCompressed(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(2)
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{reader, file}, nil
+	}
+	decompressor, err := gzip.NewReader(reader)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{decompressor, file}, nil
+}
+
+// readFileMaybeCompressed read the whole file like os.ReadFile, gzip files are decompressed
+func readFileMaybeCompressed(path string) ([]byte, error) {
+	reader, err := openMaybeCompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// writeFileAtomic write data into a temporary file and rename it to path, so a crash never leaves a broken file.
+// Paths ending with .gz are compressed by gzip.
+func writeFileAtomic(path string, data []byte) error {
+	if strings.HasSuffix(path, gzipSuffix) {
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		data = buffer.Bytes()
+	}
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
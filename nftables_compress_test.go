@@ -0,0 +1,79 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestAppliedLogCompression(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "applied.log")
+	if err := SetAppliedLogCompression("zstd"); err == nil {
+		t.Errorf("Expected zstd rejected")
+	}
+	if err := SetAppliedLogCompression("gzip"); err != nil {
+		t.Fatal(err)
+	}
+	SetAppliedLogRetention(time.Hour)
+	SetAppliedLog(path, 64, 3)
+	defer func() {
+		SetAppliedLog("", 0, 0)
+		SetAppliedLogCompression(appliedLogCompressNone)
+		SetAppliedLogRetention(0)
+	}()
+
+	element := NftablesAppliedElement{Family: nftables.TableFamilyIPv4, TableName: "filter", SetName: "VPN", Element: "192.0.2.1", Name: "example.org."}
+	WriteAppliedLog("add", []NftablesAppliedElement{element})
+	WriteAppliedLog("add", []NftablesAppliedElement{element})
+	if _, err := os.Stat(path + ".1.gz"); err != nil {
+		t.Fatalf("Expected the rotated file compressed, but got %v", err)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("Expected the uncompressed rotated file removed, but got %v", err)
+	}
+
+	var merged bytes.Buffer
+	files, err := appliedLogFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written, err := MergeAppliedLogs(&merged, files, nil); err != nil || written != 2 {
+		t.Fatalf("Expected 2 lines merged from %v, but got %v, %v", files, written, err)
+	}
+	if !strings.Contains(merged.String(), "192.0.2.1") {
+		t.Errorf("Expected the lines decompressed, but got %q", merged.String())
+	}
+
+	// rotated files older than the retention are removed
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(path+".1.gz", old, old)
+	if removed := removeExpiredLogFiles(path, time.Hour); removed != 1 {
+		t.Errorf("Expected 1 expired file removed, but got %v", removed)
+	}
+}
+
+func TestCompressedSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json.gz")
+	if err := writeFileAtomic(path, []byte(`{"version":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(path)
+	if !bytes.HasPrefix(raw, []byte{0x1f, 0x8b}) {
+		t.Errorf("Expected the file compressed")
+	}
+	data, err := readFileMaybeCompressed(path)
+	if err != nil || string(data) != `{"version":1}` {
+		t.Errorf("Expected the file decompressed, but got %q, %v", data, err)
+	}
+
+	plain := filepath.Join(t.TempDir(), "state.json")
+	writeFileAtomic(plain, []byte(`{"version":1}`))
+	if data, err := readFileMaybeCompressed(plain); err != nil || string(data) != `{"version":1}` {
+		t.Errorf("Expected the plain file read, but got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,239 @@
+package coredns_nftables
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+)
+
+var configHashLock sync.Mutex = sync.Mutex{}
+var configHashRefs = make(map[string]int)
+
+// patterns returns the sorted patterns in trie, which can be added into a new trie to get the same matcher
+func (t *nftablesDomainTrie) patterns() []string {
+	var ret []string
+	var walk func(node *nftablesDomainTrie, labels []string)
+	walk = func(node *nftablesDomainTrie, labels []string) {
+		if node.suffix && len(labels) > 0 {
+			name := make([]string, 0, len(labels))
+			for i := len(labels) - 1; i >= 0; i-- {
+				name = append(name, labels[i])
+			}
+			if node.exact {
+				ret = append(ret, strings.Join(name, "."))
+			} else {
+				ret = append(ret, "*."+strings.Join(name, "."))
+			}
+			// sub domains are already matched by this node
+			return
+		}
+		for label, child := range node.children {
+			walk(child, append(labels, label))
+		}
+	}
+	walk(t, nil)
+
+	sort.Strings(ret)
+	return ret
+}
+
+func describeMatcher(w io.Writer, name string, matcher *NftablesDomainMatcher) {
+	if matcher == nil {
+		return
+	}
+	files := make([]string, 0, len(matcher.files))
+	for _, file := range matcher.files {
+		files = append(files, file.path)
+	}
+	sort.Strings(files)
+	fmt.Fprintf(w, " %v=[%v] %v-file=[%v]", name, strings.Join(matcher.trie.patterns(), " "), name, strings.Join(files, " "))
+}
+
+func describeSetRule(w io.Writer, rule *NftablesSetAddElement) {
+	fmt.Fprintf(w, "element %v %v key=%v interval=%v timeout=%v", rule.TableName, rule.SetName, getKeyTypeName(rule.KeyType), rule.Interval, rule.Timeout)
+	if rule.Counter != nil {
+		fmt.Fprintf(w, " counter=%v/%v", rule.Counter.ChainName, rule.Counter.CounterName)
+	}
+	for _, override := range rule.TimeoutOverrides {
+		fmt.Fprintf(w, " timeout=%v", override.Timeout)
+		describeMatcher(w, "for", override.Matcher)
+	}
+	if rule.Sampler != nil {
+		fmt.Fprintf(w, " sample=%v/%v", rule.Sampler.Numerator, rule.Sampler.Denominator)
+	}
+	if rule.TtlTimeout {
+		fmt.Fprintf(w, " ttl=%v-%v", rule.TtlMin, rule.TtlMax)
+	}
+	describeMatcher(w, "match", rule.Match)
+	describeMatcher(w, "except", rule.Except)
+	if rule.Limiter != nil {
+		fmt.Fprintf(w, " max_ips=%v/%v/%v", rule.Limiter.MaxIPs, rule.Limiter.Window, rule.Limiter.QuarantineSetName)
+	}
+	for _, group := range rule.Exclude {
+		fmt.Fprintf(w, " exclude=%v", group.Name)
+	}
+	if rule.CreateSet {
+		fmt.Fprintf(w, " create-set")
+	}
+	if rule.SetSize > 0 {
+		fmt.Fprintf(w, " size=%v", rule.SetSize)
+	}
+	if rule.Dynamic {
+		fmt.Fprintf(w, " dynamic")
+	}
+	if rule.ProxyPort > 0 {
+		fmt.Fprintf(w, " proxy=%v", rule.ProxyPort)
+	}
+	if !rule.Netns.IsDefault() {
+		fmt.Fprintf(w, " netns=[%v]", rule.Netns)
+	}
+	if rule.Workload {
+		fmt.Fprintf(w, " workload=%v", rule.WorkloadDefault)
+	}
+	for i := range rule.Schedules {
+		fmt.Fprintf(w, " schedule=[%v]", rule.Schedules[i].String())
+	}
+	if rule.Dedup != NftablesDedupGlobal {
+		fmt.Fprintf(w, " dedup=%v", rule.Dedup)
+	}
+	for _, network := range rule.Pins {
+		fmt.Fprintf(w, " pin=%v", network)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+func describeRuleSets(w io.Writer, prefix string, rules map[nftables.TableFamily]*NftablesRuleSet) {
+	families := make([]nftables.TableFamily, 0, len(rules))
+	for family := range rules {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i] < families[j] })
+
+	for _, family := range families {
+		for _, rule := range rules[family].RuleAddElement {
+			fmt.Fprintf(w, "%v%v ", prefix, getFamilyName(family))
+			describeSetRule(w, rule)
+		}
+		for _, rule := range rules[family].RuleAddService {
+			fmt.Fprintf(w, "%v%v service %v %v address=%v timeout=%v\n", prefix, getFamilyName(family), rule.TableName, rule.SetName, getKeyTypeName(rule.AddressType), rule.Timeout)
+		}
+	}
+}
+
+// DescribeConfig write the effective rule configuration of handler in a deterministic text form. Rules are kept in
+// the order of Corefile because the order matters, domains are sorted and duplicated domains are merged.
+func (m *NftablesHandler) DescribeConfig(w io.Writer) {
+	describeRuleSets(w, "", m.Rules)
+	for _, group := range m.Groups {
+		fmt.Fprintf(w, "group %v", group.Name)
+		describeMatcher(w, "match", group.Matcher)
+		describeMatcher(w, "except", group.Except)
+		if !group.Enabled {
+			fmt.Fprintf(w, " enabled=false")
+		}
+		for i := range group.Schedules {
+			fmt.Fprintf(w, " schedule=[%v]", group.Schedules[i].String())
+		}
+		fmt.Fprintf(w, "\n")
+		describeRuleSets(w, "  ", group.Rules)
+	}
+	if m.Canary != nil {
+		fmt.Fprintf(w, "canary %v\n", m.Canary.Suffix)
+		describeRuleSets(w, "  ", m.Canary.Rules)
+	}
+	for _, chain := range m.ActionChains {
+		var families []string
+		for _, family := range chain.Families {
+			families = append(families, getFamilyName(family))
+		}
+		fmt.Fprintf(w, "chain families=[%v]", strings.Join(families, " "))
+		describeMatcher(w, "match", chain.Matcher)
+		describeMatcher(w, "except", chain.Except)
+		fmt.Fprintf(w, "\n")
+		for _, action := range chain.Actions {
+			switch a := action.(type) {
+			case *NftablesSetAction:
+				fmt.Fprintf(w, "  ")
+				describeSetRule(w, a.Rule)
+			case *NftablesWebhookAction:
+				fmt.Fprintf(w, "  webhook %v\n", a.URL)
+			default:
+				fmt.Fprintf(w, "  %v\n", action.Name())
+			}
+		}
+	}
+	describeFamilies := func(directive string, families []nftables.TableFamily) {
+		if families == nil {
+			return
+		}
+		var names []string
+		for _, family := range families {
+			names = append(names, getFamilyName(family))
+		}
+		fmt.Fprintf(w, "%v %v\n", directive, strings.Join(names, " "))
+	}
+	describeFamilies("families-ipv4", m.FamiliesIPv4)
+	describeFamilies("families-ipv6", m.FamiliesIPv6)
+	if m.IPv6Only {
+		fmt.Fprintf(w, "ipv6-only true\n")
+	}
+	if m.FlushSetOnStart {
+		fmt.Fprintf(w, "flush-set-on-start true\n")
+	}
+	if m.LinkLocal == NftablesLinkLocalNetdev {
+		fmt.Fprintf(w, "link-local netdev %v\n", m.LinkLocalInterface)
+	} else if m.LinkLocal != NftablesLinkLocalStrip {
+		fmt.Fprintf(w, "link-local %v\n", m.LinkLocal)
+	}
+	if m.OnErrorEDE != nil {
+		fmt.Fprintf(w, "on-error %v ede %v %q\n", m.OnError, m.OnErrorEDE.InfoCode, m.OnErrorEDE.ExtraText)
+	} else if m.OnError != NftablesOnErrorServe {
+		fmt.Fprintf(w, "on-error %v\n", m.OnError)
+	}
+	if m.AddressFilter != nil {
+		for _, network := range m.AddressFilter.Include {
+			fmt.Fprintf(w, "include-cidr %v\n", network)
+		}
+		for _, network := range m.AddressFilter.Exclude {
+			fmt.Fprintf(w, "exclude-cidr %v\n", network)
+		}
+	}
+}
+
+// ConfigHash returns the hex prefix of sha256 of DescribeConfig, handlers with the same rules have the same hash
+func (m *NftablesHandler) ConfigHash() string {
+	hash := sha256.New()
+	m.DescribeConfig(hash)
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// StartConfigHash log the config hash of handler and export it by coredns_nftables_config_info
+func StartConfigHash(handler *NftablesHandler) {
+	configHashLock.Lock()
+	defer configHashLock.Unlock()
+
+	hash := handler.ConfigHash()
+	log.Infof("Nftables rule configuration hash %v", hash)
+	configHashRefs[hash] += 1
+	configInfo.WithLabelValues(hash).Set(1)
+}
+
+// StopConfigHash remove the config hash of handler when no running handler has the same hash
+func StopConfigHash(handler *NftablesHandler) {
+	configHashLock.Lock()
+	defer configHashLock.Unlock()
+
+	hash := handler.ConfigHash()
+	if configHashRefs[hash] > 1 {
+		configHashRefs[hash] -= 1
+		return
+	}
+	delete(configHashRefs, hash)
+	configInfo.DeleteLabelValues(hash)
+}
@@ -0,0 +1,56 @@
+package coredns_nftables
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coredns/caddy"
+)
+
+func parseTestConfigHash(t *testing.T, config string) string {
+	handle := NewNftablesHandler()
+	if err := parse(caddy.NewTestController("dns", config), &handle); err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	return handle.ConfigHash()
+}
+
+func TestConfigHash(t *testing.T) {
+	hash := parseTestConfigHash(t, `nftables ip {
+		set add element filter VPN ip false 1h {
+			match example.com *.cdn.net
+			except internal.example.com
+		}
+		exclude-cidr 10.0.0.0/8
+	}`)
+	same := parseTestConfigHash(t, `nftables ip {
+		set add element filter VPN ip false 1h {
+			match *.cdn.net example.com www.example.com
+			except internal.example.com
+		}
+		exclude-cidr 10.0.0.0/8
+	}`)
+	if hash != same {
+		t.Errorf("Expected the same domains have the same hash, but got %v and %v", hash, same)
+	}
+
+	changed := parseTestConfigHash(t, `nftables ip {
+		set add element filter VPN ip false 2h {
+			match example.com *.cdn.net
+			except internal.example.com
+		}
+		exclude-cidr 10.0.0.0/8
+	}`)
+	if hash == changed {
+		t.Errorf("Expected different timeout changes the hash %v", hash)
+	}
+
+	trie := newNftablesDomainTrie()
+	for _, pattern := range []string{"www.example.com", "example.com", "*.cdn.net", "img.cdn.net", "Example.ORG."} {
+		trie.add(pattern)
+	}
+	expected := []string{"*.cdn.net", "example.com", "example.org"}
+	if patterns := trie.patterns(); !reflect.DeepEqual(patterns, expected) {
+		t.Errorf("Expected patterns %v, but got %v", expected, patterns)
+	}
+}
@@ -0,0 +1,133 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// Operations of a batch with their own maximum age of the pooled connection
+const (
+	connectionOperationAdd    = "add"
+	connectionOperationCreate = "create"
+	connectionOperationDelete = "delete"
+)
+
+var connectionMaxAgeLock sync.Mutex = sync.Mutex{}
+
+// Maximum age of connections by operation, the missing ones use `connection timeout`
+var connectionMaxAges = make(map[string]time.Duration)
+
+// SetConnectionMaxAge set how long a pooled connection and the tables and sets it cached can be reused for an
+// operation: add elements into existing sets(add), create tables and sets(create), or delete elements like
+// `dedup sliding`(delete). A batch needing an operation on an older connection reopens it and resolves its
+// tables and sets again, 0 always reopens it. Negative age unsets it, so the age of add is `connection timeout`
+// and the other operations use any connection of the pool.
+func SetConnectionMaxAge(operation string, age time.Duration) error {
+	operation = strings.ToLower(operation)
+	switch operation {
+	case connectionOperationAdd, connectionOperationCreate, connectionOperationDelete:
+	default:
+		return fmt.Errorf("operation %v unknown, expect add, create or delete", operation)
+	}
+
+	connectionMaxAgeLock.Lock()
+	defer connectionMaxAgeLock.Unlock()
+
+	if age < 0 {
+		delete(connectionMaxAges, operation)
+	} else {
+		connectionMaxAges[operation] = age
+	}
+	return nil
+}
+
+// lookupConnectionMaxAge returns the age set of operation, ok is false if it's not set
+func lookupConnectionMaxAge(operation string) (time.Duration, bool) {
+	connectionMaxAgeLock.Lock()
+	defer connectionMaxAgeLock.Unlock()
+
+	age, ok := connectionMaxAges[operation]
+	return age, ok
+}
+
+func getConnectionMaxAge(operation string) time.Duration {
+	if age, ok := lookupConnectionMaxAge(operation); ok {
+		return age
+	}
+	return cacheExpiredDuration
+}
+
+// expiredFor returns true if the connection is too old for operation
+func (cache *NftablesCache) expiredFor(operation string) bool {
+	return time.Since(cache.CreateTimepoint) > getConnectionMaxAge(operation)
+}
+
+// operations returns the operations the staged entries need besides adding elements
+func (batch *NftablesBatch) operations() []string {
+	var ret []string
+	create, remove := false, false
+	for _, entry := range batch.entries {
+		create = create || entry.create || entry.tableCache.pending
+		remove = remove || len(entry.refresh) > 0
+	}
+	if create {
+		ret = append(ret, connectionOperationCreate)
+	}
+	if remove {
+		ret = append(ret, connectionOperationDelete)
+	}
+	return ret
+}
+
+// refreshConnection reopen the connection of the batch if it's older than the maximum age of any operation
+// staged, the tables and sets are resolved again by the new connection, so that a set created by others since
+// they were cached is used instead of created again
+func (batch *NftablesBatch) refreshConnection() error {
+	operation := ""
+	for _, op := range batch.operations() {
+		// without its own age, an operation is as old as the pool allows
+		if _, ok := lookupConnectionMaxAge(op); ok && batch.cache.expiredFor(op) {
+			operation = op
+			break
+		}
+	}
+	if len(operation) == 0 {
+		return nil
+	}
+
+	cache := batch.cache
+	conn, newNS, err := openBackendIn(cache.Namespace)
+	if err != nil {
+		connectionFailureCount.Inc()
+		return err
+	}
+	log.Debugf("Nftables connection %p is reopened for %v after %v", cache, operation, time.Since(cache.CreateTimepoint))
+	connectionRefreshCount.WithLabelValues(operation).Inc()
+	cleanupSystemNFTConn(cache.NetworkNamespace)
+	cache.NftableConnection = conn
+	cache.NetworkNamespace = newNS
+	cache.CreateTimepoint = time.Now()
+	cache.HasNftableConnectionError = false
+	cache.tables = make(map[nftables.TableFamily]*map[string]*NftableCache)
+
+	index := make(map[string]*nftablesBatchEntry, len(batch.entries))
+	for _, entry := range batch.entries {
+		entry.tableCache = cache.MutableNftablesTable(entry.tableCache.table.Family, entry.tableCache.table.Name)
+		if set := cache.GetSetDefinition(entry.tableCache, entry.set.Name); set != nil {
+			if entry.create {
+				log.Debugf("Nftables set %v %v %v is found by the new connection and not created again", getFamilyName(entry.tableCache.table.Family), entry.tableCache.table.Name, set.Name)
+			}
+			entry.set = set
+			entry.create = false
+		} else {
+			entry.set.Table = entry.tableCache.table
+		}
+		index[batchEntryKey(entry.tableCache, entry.set.Name)] = entry
+	}
+	batch.index = index
+	return nil
+}
@@ -0,0 +1,88 @@
+package coredns_nftables
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnectionMaxAge(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		SetConnectionMaxAge(connectionOperationCreate, -1)
+	}()
+
+	if err := SetConnectionMaxAge("flush", time.Second); err == nil {
+		t.Errorf("Expected operation flush unknown")
+	}
+	if err := SetConnectionMaxAge("Create", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseCache(cache)
+	// the table is cached as missing before another connection creates it with the set
+	cache.MutableNftablesTable(nftables.TableFamilyIPv4, "filter")
+	external := NewMemoryBackend(ruleset)
+	table := external.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"})
+	external.AddSet(&nftables.Set{Table: table, Name: "AGE", KeyType: nftables.TypeIPAddr, HasTimeout: true, Timeout: time.Hour}, nil)
+	if err := external.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed := testutil.ToFloat64(connectionRefreshCount.WithLabelValues(connectionOperationCreate))
+	created := cache.CreateTimepoint
+	batch := NewNftablesBatch(cache)
+	tableCache := cache.MutableNftablesTable(nftables.TableFamilyIPv4, "filter")
+	if !tableCache.pending || batch.GetSet(tableCache, "AGE") != nil {
+		t.Fatalf("Expected the stale cache misses the table")
+	}
+	set := &nftables.Set{Table: tableCache.table, Name: "AGE", KeyType: nftables.TypeIPAddr}
+	batch.CreateSet(tableCache, set, nil)
+	batch.AddElement(tableCache, set, nftables.SetElement{Key: net.ParseIP("192.0.2.1").To4()}, NftablesAppliedElement{
+		Family:    nftables.TableFamilyIPv4,
+		TableName: "filter",
+		SetName:   "AGE",
+		Element:   "192.0.2.1",
+	}, newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1"))
+	batch.Commit()
+
+	if batch.Failed() || testutil.ToFloat64(connectionRefreshCount.WithLabelValues(connectionOperationCreate)) != refreshed+1 {
+		t.Fatalf("Expected the connection reopened before creating the table")
+	}
+	if !cache.CreateTimepoint.After(created) {
+		t.Errorf("Expected the connection renewed")
+	}
+	if entry := batch.entries[0]; entry.create || entry.tableCache.pending || !entry.set.HasTimeout {
+		t.Errorf("Expected the set found by the new connection instead of created again")
+	}
+	stored, _ := external.GetSetByName(table, "AGE")
+	if elements, _ := external.GetSetElements(stored); len(elements) != 1 {
+		t.Errorf("Expected the element added, but got %v", elements)
+	}
+
+	// adds into cached sets keep the connection
+	created = cache.CreateTimepoint
+	batch = NewNftablesBatch(cache)
+	tableCache = cache.MutableNftablesTable(nftables.TableFamilyIPv4, "filter")
+	batch.AddElement(tableCache, batch.GetSet(tableCache, "AGE"), nftables.SetElement{Key: net.ParseIP("192.0.2.2").To4()}, NftablesAppliedElement{
+		Family:    nftables.TableFamilyIPv4,
+		TableName: "filter",
+		SetName:   "AGE",
+		Element:   "192.0.2.2",
+	}, newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.2"))
+	batch.Commit()
+	if batch.Failed() || !cache.CreateTimepoint.Equal(created) {
+		t.Errorf("Expected adds reuse the connection")
+	}
+}
@@ -0,0 +1,228 @@
+package coredns_nftables
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+// NftablesSetCounter describe a named counter object which counts packets sent to the addresses of a set
+type NftablesSetCounter struct {
+	ChainName   string
+	CounterName string
+}
+
+type nftablesSetCounterEntry struct {
+	family      nftables.TableFamily
+	tableName   string
+	setName     string
+	chainName   string
+	counterName string
+}
+
+// NFT_OBJECT_COUNTER, not exported by golang.org/x/sys/unix
+const nftObjectCounter = 1
+
+var setCounterLock sync.Mutex = sync.Mutex{}
+var setCounterEntries = make(map[string]*nftablesSetCounterEntry)
+
+// the counters being attached by a connection, others skip them until the attach finishes
+var setCounterAttaching = make(map[string]bool)
+
+var setCounterPacketsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(plugin.Namespace, "nftables", "rule_counter_packets_total"),
+	"Packets counted by the named counter attached to the set of a rule.",
+	[]string{"family", "table", "set", "counter"}, nil)
+
+var setCounterBytesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(plugin.Namespace, "nftables", "rule_counter_bytes_total"),
+	"Bytes counted by the named counter attached to the set of a rule.",
+	[]string{"family", "table", "set", "counter"}, nil)
+
+type nftablesSetCounterCollector struct{}
+
+func init() {
+	prometheus.MustRegister(&nftablesSetCounterCollector{})
+}
+
+func (c *nftablesSetCounterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- setCounterPacketsDesc
+	ch <- setCounterBytesDesc
+}
+
+func (c *nftablesSetCounterCollector) Collect(ch chan<- prometheus.Metric) {
+	var entries []nftablesSetCounterEntry
+	setCounterLock.Lock()
+	for _, entry := range setCounterEntries {
+		entries = append(entries, *entry)
+	}
+	setCounterLock.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+
+	conn, newNS, err := openBackend()
+	if err != nil {
+		return
+	}
+	defer cleanupSystemNFTConn(newNS)
+
+	for _, entry := range entries {
+		obj, err := conn.GetObject(&nftables.CounterObj{
+			Table: &nftables.Table{Family: entry.family, Name: entry.tableName},
+			Name:  entry.counterName,
+		})
+		if err != nil || obj == nil {
+			log.Debugf("Nftables get counter %v %v %v failed. %v", getFamilyName(entry.family), entry.tableName, entry.counterName, err)
+			continue
+		}
+		counter, ok := obj.(*nftables.CounterObj)
+		if !ok {
+			continue
+		}
+
+		labels := []string{getFamilyName(entry.family), entry.tableName, entry.setName, entry.counterName}
+		ch <- prometheus.MustNewConstMetric(setCounterPacketsDesc, prometheus.CounterValue, float64(counter.Packets), labels...)
+		ch <- prometheus.MustNewConstMetric(setCounterBytesDesc, prometheus.CounterValue, float64(counter.Bytes), labels...)
+	}
+}
+
+// ClearSetCounters forget all attached counters, they will be checked again when the rule is used next time
+func ClearSetCounters() {
+	setCounterLock.Lock()
+	defer setCounterLock.Unlock()
+
+	setCounterEntries = make(map[string]*nftablesSetCounterEntry)
+	setCounterAttaching = make(map[string]bool)
+}
+
+// AttachSetCounter create the named counter and the rule referring it in the chain if they do not exist,
+// it only runs once for each counter in a process, a failed attach is tried again by the next use of the rule.
+// Counters are not attached in the learn only period.
+func (cache *NftablesCache) AttachSetCounter(tableCache *NftableCache, set *nftables.Set, counter *NftablesSetCounter) {
+	if IsLearnOnly() {
+		return
+	}
+
+	family := tableCache.table.Family
+	key := fmt.Sprintf("%v %v %v %v", getFamilyName(family), tableCache.table.Name, counter.ChainName, counter.CounterName)
+
+	setCounterLock.Lock()
+	if _, ok := setCounterEntries[key]; ok || setCounterAttaching[key] {
+		setCounterLock.Unlock()
+		return
+	}
+	setCounterAttaching[key] = true
+	setCounterLock.Unlock()
+
+	attached := cache.attachSetCounter(tableCache, set, counter, key)
+
+	setCounterLock.Lock()
+	defer setCounterLock.Unlock()
+	delete(setCounterAttaching, key)
+	if attached {
+		setCounterEntries[key] = &nftablesSetCounterEntry{
+			family:      family,
+			tableName:   tableCache.table.Name,
+			setName:     set.Name,
+			chainName:   counter.ChainName,
+			counterName: counter.CounterName,
+		}
+	}
+}
+
+// attachSetCounter add the counter and its rule by the connection of cache, it returns true if they are attached
+func (cache *NftablesCache) attachSetCounter(tableCache *NftableCache, set *nftables.Set, counter *NftablesSetCounter, key string) bool {
+	exprs, err := buildSetCounterExprs(tableCache.table.Family, set, counter)
+	if err != nil {
+		log.Errorf("Nftables attach counter %v to set %v failed. %v", key, set.Name, err)
+		return false
+	}
+
+	chain := &nftables.Chain{Name: counter.ChainName, Table: tableCache.table}
+	rules, err := cache.NftableConnection.GetRules(tableCache.table, chain)
+	if err != nil {
+		log.Errorf("Nftables attach counter %v failed, can not list rules of chain. %v", key, err)
+		return false
+	}
+
+	userData := buildRuleComment(fmt.Sprintf("coredns-nftables counter %v", counter.CounterName))
+	for _, rule := range rules {
+		if string(rule.UserData) == string(userData) {
+			log.Debugf("Nftables counter %v already attached", key)
+			return true
+		}
+	}
+
+	obj, _ := cache.NftableConnection.GetObject(&nftables.CounterObj{Table: tableCache.table, Name: counter.CounterName})
+	if obj == nil {
+		cache.NftableConnection.AddObj(&nftables.CounterObj{Table: tableCache.table, Name: counter.CounterName})
+	}
+	cache.NftableConnection.AddRule(&nftables.Rule{
+		Table:    tableCache.table,
+		Chain:    chain,
+		Exprs:    exprs,
+		UserData: userData,
+	})
+
+	err = cache.Flush()
+	if err != nil {
+		log.Errorf("Nftables attach counter %v failed. %v", key, err)
+		return false
+	}
+
+	log.Infof("Nftables attach counter %v to set %v", key, set.Name)
+	return true
+}
+
+func buildSetCounterExprs(family nftables.TableFamily, set *nftables.Set, counter *NftablesSetCounter) ([]expr.Any, error) {
+	var etherType uint16
+	var offset uint32
+	var nfproto nftables.TableFamily
+	switch set.KeyType.Bytes {
+	case net.IPv4len:
+		etherType, offset, nfproto = unix.ETH_P_IP, 16, nftables.TableFamilyIPv4
+	case net.IPv6len:
+		etherType, offset, nfproto = unix.ETH_P_IPV6, 24, nftables.TableFamilyIPv6
+	default:
+		return nil, fmt.Errorf("key type %v is not an address", set.KeyType.Name)
+	}
+
+	var exprs []expr.Any
+	switch family {
+	case nftables.TableFamilyIPv4, nftables.TableFamilyIPv6:
+		if family != nfproto {
+			return nil, fmt.Errorf("key type %v can not be matched in %v family", set.KeyType.Name, getFamilyName(family))
+		}
+	case nftables.TableFamilyINet, nftables.TableFamilyBridge, nftables.TableFamilyNetdev:
+		protocol := make([]byte, 2)
+		binary.BigEndian.PutUint16(protocol, etherType)
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyPROTOCOL, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: protocol},
+		)
+	default:
+		return nil, fmt.Errorf("%v family is not supported", getFamilyName(family))
+	}
+
+	exprs = append(exprs,
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: set.KeyType.Bytes},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+		&expr.Objref{Type: nftObjectCounter, Name: counter.CounterName},
+	)
+	return exprs, nil
+}
+
+// buildRuleComment encode comment as the userdata TLV used by nft
+func buildRuleComment(comment string) []byte {
+	value := append([]byte(comment), 0)
+	return append([]byte{0, byte(len(value))}, value...)
+}
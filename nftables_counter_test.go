@@ -0,0 +1,49 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAttachSetCounterRetry(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearSetCounters()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearSetCounters()
+	}()
+
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	tableCache := &NftableCache{table: table}
+	set := &nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr}
+	counter := &NftablesSetCounter{ChainName: "forward", CounterName: "VPN"}
+	cache := &NftablesCache{NftableConnection: NewMemoryBackend(ruleset)}
+
+	// a failed attach is not recorded, so the next use of the rule tries again
+	ruleset.FlushError = errors.New("netlink unavailable")
+	cache.AttachSetCounter(tableCache, set, counter)
+	setCounterLock.Lock()
+	attached := len(setCounterEntries)
+	setCounterLock.Unlock()
+	if attached != 0 {
+		t.Fatalf("Expected the failed counter not attached, but got %v", attached)
+	}
+
+	ruleset.FlushError = nil
+	cache.AttachSetCounter(tableCache, set, counter)
+	if rules, _ := cache.NftableConnection.GetRules(table, &nftables.Chain{Name: "forward", Table: table}); len(rules) != 1 {
+		t.Fatalf("Expected the rule of the counter added, but got %v", rules)
+	}
+
+	// counters are read by the backend connection
+	ch := make(chan prometheus.Metric, 4)
+	(&nftablesSetCounterCollector{}).Collect(ch)
+	close(ch)
+	if len(ch) != 2 {
+		t.Errorf("Expected packets and bytes of the counter collected, but got %v metric(s)", len(ch))
+	}
+}
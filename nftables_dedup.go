@@ -0,0 +1,78 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// NftablesDedupPolicy decides how a rule is affected by the LRU of recently applied addresses
+type NftablesDedupPolicy int
+
+const (
+	// Addresses ignored by the LRU are not applied, see `set lru *`
+	NftablesDedupGlobal NftablesDedupPolicy = iota
+	// Addresses are applied even if they are ignored by the LRU
+	NftablesDedupOff
+	// Addresses are applied even if they are ignored by the LRU, and the timeout of existing elements is refreshed
+	NftablesDedupSliding
+)
+
+func parseDedupPolicy(name string) (NftablesDedupPolicy, error) {
+	switch strings.ToLower(name) {
+	case "global":
+		return NftablesDedupGlobal, nil
+	case "off":
+		return NftablesDedupOff, nil
+	case "sliding":
+		return NftablesDedupSliding, nil
+	}
+
+	return NftablesDedupGlobal, fmt.Errorf("dedup policy %v not supported, use global, off or sliding", name)
+}
+
+func (policy NftablesDedupPolicy) String() string {
+	switch policy {
+	case NftablesDedupOff:
+		return "off"
+	case NftablesDedupSliding:
+		return "sliding"
+	}
+	return "global"
+}
+
+// bypassDedup returns true if any rule of handler applies addresses ignored by the LRU
+func (m *NftablesHandler) bypassDedup() bool {
+	isBypass := func(ruleSets map[nftables.TableFamily]*NftablesRuleSet) bool {
+		for _, ruleSet := range ruleSets {
+			for _, rule := range ruleSet.RuleAddElement {
+				if rule.Dedup != NftablesDedupGlobal {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if isBypass(m.Rules) {
+		return true
+	}
+	for _, group := range m.Groups {
+		if isBypass(group.Rules) {
+			return true
+		}
+	}
+	if m.Canary != nil && isBypass(m.Canary.Rules) {
+		return true
+	}
+	for _, chain := range m.ActionChains {
+		for _, action := range chain.Actions {
+			rule := actionSetRule(action)
+			if rule != nil && rule.Dedup != NftablesDedupGlobal {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var deferWriteMode bool = false
+var deferWriteDeadline time.Duration = time.Second
+
+// SetNftableDeferWrite set whether the response is written to the client before it's applied to nftables on the
+// same goroutine, the work not committed before deadline is dropped. 0 deadline waits until it's done.
+func SetNftableDeferWrite(mode bool, deadline time.Duration) {
+	deferWriteMode = mode
+	deferWriteDeadline = deadline
+}
+
+// serveDeferred apply the response written to the client already, and log the outcome
+func (m *NftablesHandler) serveDeferred(ctx context.Context, msg *dns.Msg, nextPluginCost time.Duration) {
+	if deferWriteDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deferWriteDeadline)
+		defer cancel()
+	}
+
+	startTime := time.Now()
+	err := m.Serve(ctx, msg, nextPluginCost)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Warningf("Nftables drop the deferred work of %v after %vus, it exceeds the deadline %vus",
+			msg.Answer[0].Header().Name, time.Since(startTime).Microseconds(), deferWriteDeadline.Microseconds())
+		deferDeadlineCount.Inc()
+	} else if err != nil {
+		log.Debugf("Nftables deferred work of %v failed. %v", msg.Answer[0].Header().Name, err)
+	}
+}
@@ -0,0 +1,190 @@
+package coredns_nftables
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// How long a confirmation token of the admin API is valid
+const confirmTokenTimeout = time.Minute
+
+// ErrDestructiveDisabled is returned by the features deleting elements when allow-destructive is not set
+var ErrDestructiveDisabled = errors.New("destructive operations are disabled, set allow-destructive to enable them")
+
+var allowDestructiveLock sync.Mutex = sync.Mutex{}
+var allowDestructive bool = false
+var confirmTokensLock sync.Mutex = sync.Mutex{}
+var confirmTokens = make(map[string]nftablesConfirmToken)
+
+type nftablesConfirmToken struct {
+	operation  string
+	expireTime time.Time
+}
+
+// NftablesConfirmation is returned by the admin API when a destructive operation is not confirmed yet, the same
+// request with confirm=<Token> performs it before Expire
+type NftablesConfirmation struct {
+	Operation string `json:"operation"`
+	Token     string `json:"token"`
+	Expire    string `json:"expire"`
+}
+
+// SetAllowDestructive set whether the features deleting elements(the reaper, the purge of admin API,
+// flush-set-on-start, flush-owned-on-shutdown, on-full evict-oldest/grow and the deletions sent to the agent) can be
+// used
+func SetAllowDestructive(allow bool) {
+	allowDestructiveLock.Lock()
+	defer allowDestructiveLock.Unlock()
+
+	allowDestructive = allow
+}
+
+func isDestructiveAllowed() bool {
+	allowDestructiveLock.Lock()
+	defer allowDestructiveLock.Unlock()
+
+	return allowDestructive
+}
+
+// checkDestructive returns ErrDestructiveDisabled unless allow-destructive is set, every feature deleting elements
+// calls it before deleting anything
+func checkDestructive(feature string) error {
+	if !isDestructiveAllowed() {
+		return fmt.Errorf("%v deletes elements, %w", feature, ErrDestructiveDisabled)
+	}
+	return nil
+}
+
+// issueConfirmToken returns a random token which confirms operation once
+func issueConfirmToken(operation string) (NftablesConfirmation, error) {
+	data := make([]byte, 16)
+	if _, err := rand.Read(data); err != nil {
+		return NftablesConfirmation{}, err
+	}
+	token := hex.EncodeToString(data)
+	expireTime := time.Now().Add(confirmTokenTimeout)
+
+	confirmTokensLock.Lock()
+	defer confirmTokensLock.Unlock()
+
+	now := time.Now()
+	for key, value := range confirmTokens {
+		if !value.expireTime.After(now) {
+			delete(confirmTokens, key)
+		}
+	}
+	confirmTokens[token] = nftablesConfirmToken{operation: operation, expireTime: expireTime}
+	return NftablesConfirmation{Operation: operation, Token: token, Expire: expireTime.Format(time.RFC3339)}, nil
+}
+
+// consumeConfirmToken returns true if token is issued for operation and not expired, a token can only be used once
+func consumeConfirmToken(token string, operation string) bool {
+	confirmTokensLock.Lock()
+	defer confirmTokensLock.Unlock()
+
+	value, ok := confirmTokens[token]
+	if !ok || value.operation != operation {
+		return false
+	}
+	delete(confirmTokens, token)
+	return value.expireTime.After(time.Now())
+}
+
+// confirmDestructive returns true if the destructive request is allowed and confirmed. Otherwise the response is
+// written: 403 when allow-destructive is not set, or 409 with a new token which must be sent back with confirm=<Token>.
+func confirmDestructive(w http.ResponseWriter, r *http.Request) bool {
+	if err := checkDestructive(r.Method + " " + r.URL.Path); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+
+	query := r.URL.Query()
+	token := query.Get("confirm")
+	query.Del("confirm")
+	operation := r.Method + " " + r.URL.Path + "?" + query.Encode()
+	if len(token) > 0 && consumeConfirmToken(token, operation) {
+		return true
+	}
+
+	confirmation, err := issueConfirmToken(operation)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("issue confirmation token failed, %v", err), http.StatusInternalServerError)
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(confirmation)
+	return false
+}
+
+// PurgeElements delete the elements added by the plugin from a set, or only the one formatted as element when it's
+// not empty. Elements not added by the plugin or pinned are never deleted. It returns how many elements are deleted.
+func PurgeElements(family nftables.TableFamily, tableName string, setName string, element string) (int, error) {
+	if err := checkDestructive("purge"); err != nil {
+		return 0, err
+	}
+
+	var purged []NftablesTrackedElement
+	for _, tracked := range GetTrackedElements()[trackedSetKey(family, tableName, setName)] {
+		if isPinned(family, tableName, setName, tracked.Key) {
+			continue
+		}
+		if len(element) == 0 || tracked.Element == element {
+			purged = append(purged, tracked)
+		}
+	}
+	if len(purged) == 0 {
+		return 0, nil
+	}
+
+	conn, newNS, err := openBackend()
+	if err != nil {
+		return 0, err
+	}
+	defer cleanupSystemNFTConn(newNS)
+
+	set, err := conn.GetSetByName(&nftables.Table{Family: family, Name: tableName}, setName)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]nftables.SetElement, 0, len(purged))
+	applied := make([]NftablesAppliedElement, 0, len(purged))
+	for _, tracked := range purged {
+		keys = append(keys, nftables.SetElement{Key: tracked.Key})
+		applied = append(applied, NftablesAppliedElement{
+			Family:    family,
+			TableName: tableName,
+			SetName:   setName,
+			Element:   tracked.Element,
+			Name:      tracked.Name,
+			Timeout:   tracked.Timeout,
+		})
+	}
+	err = conn.SetDeleteElements(set, keys)
+	if err == nil {
+		err = conn.Flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	WriteAppliedLog("purge", applied)
+	for _, tracked := range purged {
+		UntrackElement(family, tableName, setName, tracked.Key)
+		forgetExistingElement(family, tableName, setName, tracked.Key)
+		if len(tracked.Key) == net.IPv4len || len(tracked.Key) == net.IPv6len {
+			lruRemoveIp(net.IP(tracked.Key).String())
+		}
+	}
+	log.Warningf("Nftables purge %v element(s) of set %v %v %v by admin API", len(purged), getFamilyName(family), tableName, setName)
+	return len(purged), nil
+}
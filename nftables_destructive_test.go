@@ -0,0 +1,74 @@
+package coredns_nftables
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/nftables"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConfirmDestructive(t *testing.T) {
+	request := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		serveAdminElements(w, httptest.NewRequest(http.MethodDelete, url, nil))
+		return w
+	}
+
+	if w := request("/elements?family=ip&table=filter&set=VPN"); w.Code != http.StatusForbidden {
+		t.Fatalf("Expected purge is forbidden without allow-destructive, but got %v", w.Code)
+	}
+
+	SetAllowDestructive(true)
+	defer SetAllowDestructive(false)
+	w := request("/elements?family=ip&table=filter&set=VPN")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected purge requires confirmation, but got %v", w.Code)
+	}
+	var confirmation NftablesConfirmation
+	if err := json.NewDecoder(w.Body).Decode(&confirmation); err != nil || len(confirmation.Token) == 0 {
+		t.Fatalf("Expected a confirmation token, but got %v, %v", confirmation, err)
+	}
+
+	// The token only confirms the same operation once
+	if w := request("/elements?family=ip&table=filter&set=OTHER&confirm=" + confirmation.Token); w.Code != http.StatusConflict {
+		t.Errorf("Expected token of another set is rejected, but got %v", w.Code)
+	}
+	if w := request("/elements?family=ip&table=filter&set=VPN&confirm=" + confirmation.Token); w.Code != http.StatusOK {
+		t.Errorf("Expected confirmed purge succeeded, but got %v %v", w.Code, w.Body.String())
+	}
+	if w := request("/elements?family=ip&table=filter&set=VPN&confirm=" + confirmation.Token); w.Code != http.StatusConflict {
+		t.Errorf("Expected used token is rejected, but got %v", w.Code)
+	}
+
+	expired, _ := issueConfirmToken("DELETE /elements?")
+	confirmTokensLock.Lock()
+	confirmTokens[expired.Token] = nftablesConfirmToken{operation: confirmTokens[expired.Token].operation}
+	confirmTokensLock.Unlock()
+	if consumeConfirmToken(expired.Token, "DELETE /elements?") {
+		t.Errorf("Expected expired token is rejected")
+	}
+}
+
+func TestAgentDeletesElements(t *testing.T) {
+	set := &agentSet{Table: agentTable{Family: nftables.TableFamilyIPv4, Name: "filter"}, Name: "VPN"}
+	refresh := &agentFlushRequest{Operations: []agentOperation{
+		{Op: agentOpDeleteElement, Set: set, Elements: []agentElement{{Key: []byte{192, 0, 2, 1}}}},
+		{Op: agentOpAddElements, Set: set, Elements: []agentElement{{Key: []byte{192, 0, 2, 1}}}},
+	}}
+	if agentDeletesElements(refresh) {
+		t.Errorf("Expected refreshing an element is not a deletion")
+	}
+
+	refresh.Operations[0].Elements = append(refresh.Operations[0].Elements, agentElement{Key: []byte{192, 0, 2, 2}})
+	if !agentDeletesElements(refresh) {
+		t.Errorf("Expected deleting an element not added again is a deletion")
+	}
+	server := NewNftablesAgentServer(func() (NftBackend, error) { return NewMemoryBackend(NewMemoryRuleset()), nil }, &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"})
+	if err := server.flush(refresh); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Expected the deletion refused without allow-destructive, but got %v", err)
+	}
+}
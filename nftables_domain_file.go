@@ -0,0 +1,225 @@
+package coredns_nftables
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Interval to check whether domain list files are changed
+var domainFileReloadInterval time.Duration = 5 * time.Second
+
+var domainFileLock sync.Mutex = sync.Mutex{}
+var domainFiles = make(map[string]*nftablesDomainFile)
+var domainFileRefs int = 0
+var domainFileStop chan struct{} = nil
+
+// Engines matching the domains of files, see SetDomainMatchEngine
+const (
+	domainMatchEngineTrie        = "trie"
+	domainMatchEngineAhoCorasick = "aho-corasick"
+)
+
+var domainMatchEngine string = domainMatchEngineTrie
+
+// nftablesDomainIndex is a set of domains with the syntax of NftablesDomainMatcher, the domains are added and
+// compiled before it's matched concurrently
+type nftablesDomainIndex interface {
+	add(pattern string) bool
+	compile()
+	match(name string) bool
+}
+
+// nftablesDomainIndexValue wraps the index of any engine for atomic.Value
+type nftablesDomainIndexValue struct {
+	index nftablesDomainIndex
+}
+
+// SetDomainMatchEngine select the engine matching the domains of match-file and except-file, trie(the default)
+// or aho-corasick. The files already loaded are loaded again by the new engine.
+func SetDomainMatchEngine(engine string) error {
+	engine = strings.ToLower(engine)
+	switch engine {
+	case domainMatchEngineTrie, domainMatchEngineAhoCorasick:
+	default:
+		return fmt.Errorf("match engine %v not supported, use trie or aho-corasick", engine)
+	}
+
+	domainFileLock.Lock()
+	defer domainFileLock.Unlock()
+
+	if domainMatchEngine == engine {
+		return nil
+	}
+	domainMatchEngine = engine
+	for _, file := range domainFiles {
+		if err := file.load(); err != nil {
+			log.Errorf("Nftables reload domain file %v by %v failed, keep the old one. %v", file.path, engine, err)
+		}
+	}
+	return nil
+}
+
+// newDomainIndex returns an empty index of the selected engine, it must be called with domainFileLock held
+func newDomainIndex() nftablesDomainIndex {
+	if domainMatchEngine == domainMatchEngineAhoCorasick {
+		return newNftablesDomainAhoCorasick()
+	}
+	return newNftablesDomainTrie()
+}
+
+// nftablesDomainFile is a domain list file shared by all rules using the same path
+type nftablesDomainFile struct {
+	path    string
+	index   atomic.Value // nftablesDomainIndexValue
+	count   int64
+	modTime time.Time
+	size    int64
+}
+
+// getDomainFile load the file at the first use, later calls with the same path share it
+func getDomainFile(path string) (*nftablesDomainFile, error) {
+	domainFileLock.Lock()
+	defer domainFileLock.Unlock()
+
+	file, ok := domainFiles[path]
+	if ok {
+		return file, nil
+	}
+
+	file = &nftablesDomainFile{path: path}
+	if err := file.load(); err != nil {
+		return nil, err
+	}
+	domainFiles[path] = file
+	return file, nil
+}
+
+func (f *nftablesDomainFile) Len() int {
+	return int(atomic.LoadInt64(&f.count))
+}
+
+func (f *nftablesDomainFile) Match(name string) bool {
+	return f.index.Load().(nftablesDomainIndexValue).index.match(name)
+}
+
+// load parse the file and replace the trie. Each line is a domain with the same syntax as match, empty lines
+// and lines starting with # are ignored. Lines of dnsmasq like `nftset=/example.com/example.org/...` are also
+// accepted, the domains between slashes are used.
+func (f *nftablesDomainFile) load() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	index := newDomainIndex()
+	var count int64 = 0
+	addDomain := func(domain string) {
+		if len(domain) > 0 && index.add(domain) {
+			count += 1
+		}
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if index := strings.Index(line, "=/"); index >= 0 {
+			parts := strings.Split(line[index+2:], "/")
+			// the last part is the target of dnsmasq
+			for _, domain := range parts[:len(parts)-1] {
+				addDomain(domain)
+			}
+			continue
+		}
+		addDomain(strings.Fields(line)[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	index.compile()
+	f.index.Store(nftablesDomainIndexValue{index: index})
+	atomic.StoreInt64(&f.count, count)
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	InvalidateMatchCache()
+	log.Infof("Nftables load %v domain(s) from %v by %v", count, f.path, domainMatchEngine)
+	return nil
+}
+
+// changed returns true if the modification time or size of file differs from the loaded one
+func (f *nftablesDomainFile) changed() bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+}
+
+// ReloadDomainFiles reload all changed domain list files, the old list is kept if the file can not be loaded
+func ReloadDomainFiles() {
+	domainFileLock.Lock()
+	defer domainFileLock.Unlock()
+
+	for _, file := range domainFiles {
+		if !file.changed() {
+			continue
+		}
+		if err := file.load(); err != nil {
+			log.Errorf("Nftables reload domain file %v failed, keep the old one. %v", file.path, err)
+		}
+	}
+}
+
+// StartDomainFileWatcher start checking domain list files when the first handler starts
+func StartDomainFileWatcher() {
+	domainFileLock.Lock()
+	defer domainFileLock.Unlock()
+
+	domainFileRefs += 1
+	if domainFileStop != nil || len(domainFiles) == 0 {
+		return
+	}
+
+	domainFileStop = make(chan struct{})
+	go func(stop chan struct{}, interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ReloadDomainFiles()
+			}
+		}
+	}(domainFileStop, domainFileReloadInterval)
+}
+
+// StopDomainFileWatcher stop checking domain list files when the last handler stops
+func StopDomainFileWatcher() {
+	domainFileLock.Lock()
+	defer domainFileLock.Unlock()
+
+	if domainFileRefs > 0 {
+		domainFileRefs -= 1
+	}
+	if domainFileRefs == 0 && domainFileStop != nil {
+		close(domainFileStop)
+		domainFileStop = nil
+	}
+}
@@ -0,0 +1,158 @@
+package coredns_nftables
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const defaultDomainStatsMaxDomains = 10000
+
+// Addresses remembered for the distinct count of each domain, more addresses are not counted
+const domainStatsMaxAddresses = 1024
+
+var domainStatsLock sync.Mutex = sync.Mutex{}
+var domainStatsRetention time.Duration = 0
+
+// The domains by the order they are seen, nil if the statistics are disabled
+var domainStats *simplelru.LRU = nil
+
+// NftablesDomainStats is the statistics of the elements applied for one domain
+type NftablesDomainStats struct {
+	Domain        string    `json:"domain"`
+	ElementsAdded uint64    `json:"elements_added"`
+	DistinctIPs   int       `json:"distinct_ips"`
+	LastSeen      time.Time `json:"last_seen"`
+	// More addresses than domainStatsMaxAddresses are seen, DistinctIPs is the lower bound
+	Truncated bool `json:"truncated,omitempty"`
+
+	addresses map[string]struct{}
+}
+
+// SetDomainStats keep the statistics of at most maxDomains domains which elements are applied in retention,
+// 0 retention disables them. The statistics are kept when reloading with the same max domains.
+func SetDomainStats(retention time.Duration, maxDomains int) {
+	domainStatsLock.Lock()
+	defer domainStatsLock.Unlock()
+
+	domainStatsRetention = retention
+	if retention <= 0 || maxDomains <= 0 {
+		domainStats = nil
+		return
+	}
+	if domainStats == nil {
+		domainStats, _ = simplelru.NewLRU(maxDomains, nil)
+	} else {
+		domainStats.Resize(maxDomains)
+	}
+}
+
+// recordDomainStats count an element of the address of domain, added is false if the element already exists
+func recordDomainStats(domain string, address string, added bool) {
+	domainStatsLock.Lock()
+	defer domainStatsLock.Unlock()
+
+	if domainStats == nil || len(domain) == 0 {
+		return
+	}
+
+	now := time.Now()
+	gcDomainStats(now)
+	var stats *NftablesDomainStats
+	if value, ok := domainStats.Get(domain); ok {
+		stats = value.(*NftablesDomainStats)
+	} else {
+		stats = &NftablesDomainStats{Domain: domain, addresses: make(map[string]struct{})}
+		domainStats.Add(domain, stats)
+	}
+	stats.LastSeen = now
+	if added {
+		stats.ElementsAdded += 1
+	}
+	if _, ok := stats.addresses[address]; !ok && len(address) > 0 {
+		if len(stats.addresses) < domainStatsMaxAddresses {
+			stats.addresses[address] = struct{}{}
+			stats.DistinctIPs = len(stats.addresses)
+		} else {
+			stats.Truncated = true
+		}
+	}
+}
+
+// gcDomainStats removes the domains not seen in the retention from the oldest one, it must be called with the lock
+func gcDomainStats(now time.Time) {
+	for domainStats.Len() != 0 {
+		_, value, ok := domainStats.GetOldest()
+		if !ok || now.Sub(value.(*NftablesDomainStats).LastSeen) < domainStatsRetention {
+			break
+		}
+		domainStats.RemoveOldest()
+	}
+}
+
+// GetDomainStats returns the statistics of the domains seen in the retention, the domains with the most elements
+// added first
+func GetDomainStats() []NftablesDomainStats {
+	domainStatsLock.Lock()
+	defer domainStatsLock.Unlock()
+
+	ret := []NftablesDomainStats{}
+	if domainStats == nil {
+		return ret
+	}
+	gcDomainStats(time.Now())
+	for _, key := range domainStats.Keys() {
+		value, ok := domainStats.Peek(key)
+		if !ok {
+			continue
+		}
+		stats := *value.(*NftablesDomainStats)
+		stats.addresses = nil
+		ret = append(ret, stats)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].ElementsAdded != ret[j].ElementsAdded {
+			return ret[i].ElementsAdded > ret[j].ElementsAdded
+		}
+		return ret[i].Domain < ret[j].Domain
+	})
+	return ret
+}
+
+func init() {
+	registerAdminHandler("/domains", serveAdminDomains)
+}
+
+// serveAdminDomains export the statistics of domains by GET /domains[?format=<json/csv>]
+func serveAdminDomains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := GetDomainStats()
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(stats)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"domain", "elements_added", "distinct_ips", "last_seen", "truncated"})
+		for _, domain := range stats {
+			writer.Write([]string{domain.Domain, strconv.FormatUint(domain.ElementsAdded, 10), strconv.Itoa(domain.DistinctIPs),
+				domain.LastSeen.UTC().Format(time.RFC3339), strconv.FormatBool(domain.Truncated)})
+		}
+		writer.Flush()
+	default:
+		http.Error(w, "format "+format+" invalid", http.StatusBadRequest)
+	}
+}
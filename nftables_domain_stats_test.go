@@ -0,0 +1,74 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestDomainStats(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) {
+		return NewMemoryBackend(ruleset), nil
+	})
+	ClearCache()
+	SetDomainStats(time.Hour, 2)
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+		SetDomainStats(0, 0)
+	}()
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_domain_stats", SetName: "DOMAIN_STATS", KeyType: nftables.TypeInvalid})
+	handle.ServeWorker(context.Background(), newTestResponse(t, "www.example.org.", "www.example.org. 60 IN CNAME cdn.example.net.", "cdn.example.net. 60 IN A 192.0.2.180", "cdn.example.net. 60 IN A 192.0.2.181"))
+	handle.ServeWorker(context.Background(), newTestResponse(t, "www.example.org.", "www.example.org. 60 IN CNAME cdn.example.net.", "cdn.example.net. 60 IN A 192.0.2.180"))
+
+	// domains are counted by the name queried
+	stats := GetDomainStats()
+	if len(stats) != 1 || stats[0].Domain != "www.example.org." || stats[0].DistinctIPs != 2 || stats[0].ElementsAdded < 2 {
+		t.Fatalf("Expected www.example.org. with 2 distinct addresses, but got %v", stats)
+	}
+
+	// the domain seen the least recently is dropped by the max domains
+	recordDomainStats("a.example.com.", "192.0.2.1", true)
+	recordDomainStats("a.example.com.", "192.0.2.1", false)
+	recordDomainStats("b.example.com.", "192.0.2.2", true)
+	stats = GetDomainStats()
+	if len(stats) != 2 || stats[0].Domain != "a.example.com." || stats[0].ElementsAdded != 1 || stats[0].DistinctIPs != 1 {
+		t.Fatalf("Expected a.example.com. and b.example.com. kept, but got %v", stats)
+	}
+
+	for i := 0; i < domainStatsMaxAddresses+1; i++ {
+		recordDomainStats("b.example.com.", strings.Repeat("x", i), true)
+	}
+	stats = GetDomainStats()
+	if stats[0].Domain != "b.example.com." || stats[0].DistinctIPs != domainStatsMaxAddresses || !stats[0].Truncated {
+		t.Errorf("Expected the distinct addresses of b.example.com. truncated, but got %v", stats[0])
+	}
+
+	recorder := httptest.NewRecorder()
+	serveAdminDomains(recorder, httptest.NewRequest(http.MethodGet, "/domains?format=csv", nil))
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if recorder.Code != http.StatusOK || len(lines) != 3 || lines[0] != "domain,elements_added,distinct_ips,last_seen,truncated" ||
+		!strings.HasPrefix(lines[2], "a.example.com.,1,1,") {
+		t.Errorf("Expected the CSV of 2 domains, but got %v %v", recorder.Code, recorder.Body.String())
+	}
+
+	// domains not seen in the retention are dropped
+	domainStatsLock.Lock()
+	domainStats.Remove("b.example.com.")
+	value, _ := domainStats.Peek("a.example.com.")
+	value.(*NftablesDomainStats).LastSeen = time.Now().Add(-time.Hour)
+	domainStatsLock.Unlock()
+	if stats := GetDomainStats(); len(stats) != 0 {
+		t.Errorf("Expected no domain kept after the retention, but got %v", stats)
+	}
+}
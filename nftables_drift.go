@@ -0,0 +1,201 @@
+package coredns_nftables
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// Elements expiring within this duration may already be removed by the kernel, they are not treated as drift
+const driftExpireTolerance = time.Second
+
+var driftCheckInterval time.Duration = 0
+var driftCheckRepair bool = false
+var driftCheckLock sync.Mutex = sync.Mutex{}
+var driftCheckRefs int = 0
+var driftCheckStop chan struct{} = nil
+
+// SetDriftCheck set the interval to diff the intended elements against kernel sets, 0 disables it
+func SetDriftCheck(interval time.Duration, repair bool) {
+	driftCheckInterval = interval
+	driftCheckRepair = repair
+	if interval > 0 {
+		EnableElementTracker(true)
+	}
+}
+
+// StartDriftCheck start the background drift check when the first handler starts
+func StartDriftCheck() {
+	driftCheckLock.Lock()
+	defer driftCheckLock.Unlock()
+
+	driftCheckRefs += 1
+	if driftCheckStop != nil || driftCheckInterval <= 0 {
+		return
+	}
+
+	driftCheckStop = make(chan struct{})
+	go func(stop chan struct{}, interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				CheckDrift(driftCheckRepair)
+			}
+		}
+	}(driftCheckStop, driftCheckInterval)
+}
+
+// StopDriftCheck stop the background drift check when the last handler stops
+func StopDriftCheck() {
+	driftCheckLock.Lock()
+	defer driftCheckLock.Unlock()
+
+	if driftCheckRefs > 0 {
+		driftCheckRefs -= 1
+	}
+	if driftCheckRefs == 0 && driftCheckStop != nil {
+		close(driftCheckStop)
+		driftCheckStop = nil
+	}
+}
+
+// CheckDrift diff living tracked elements against the kernel sets, export the count of missing elements
+// and add them back when repair is true
+func CheckDrift(repair bool) {
+	tracked := GetTrackedElements()
+	if len(tracked) == 0 {
+		return
+	}
+
+	conn, newNS, err := openBackend()
+	if err != nil {
+		return
+	}
+	defer cleanupSystemNFTConn(newNS)
+
+	for _, elements := range tracked {
+		if len(elements) == 0 {
+			continue
+		}
+
+		familyName := getFamilyName(elements[0].Family)
+		tableName := elements[0].TableName
+		setName := elements[0].SetName
+		table := &nftables.Table{Family: elements[0].Family, Name: tableName}
+		set, err := conn.GetSetByName(table, setName)
+		if err != nil || set == nil {
+			log.Warningf("Nftables drift check can not find set %v %v %v. %v", familyName, tableName, setName, err)
+			driftElements.WithLabelValues(familyName, tableName, setName).Set(float64(len(elements)))
+			if repair {
+				recreateDriftSet(conn, table, setName, elements)
+			}
+			continue
+		}
+
+		kernelElements, err := conn.GetSetElements(set)
+		if err != nil {
+			log.Warningf("Nftables drift check can not list elements of set %v %v %v. %v", familyName, tableName, setName, err)
+			continue
+		}
+		present := make(map[string]bool, len(kernelElements))
+		for _, element := range kernelElements {
+			present[string(element.Key)] = true
+		}
+
+		now := time.Now()
+		var missing []nftables.SetElement
+		for _, element := range elements {
+			if present[string(element.Key)] {
+				continue
+			}
+			remaining := element.Remaining(now)
+			if element.Timeout > 0 && remaining <= driftExpireTolerance {
+				continue
+			}
+
+			log.Debugf("Nftables drift check found element %v(%v) missing in set %v %v %v", element.Element, element.Name, familyName, tableName, setName)
+			missing = append(missing, nftables.SetElement{Key: element.Key, Val: element.Val, Timeout: remaining})
+		}
+
+		driftElements.WithLabelValues(familyName, tableName, setName).Set(float64(len(missing)))
+		if !repair || len(missing) == 0 {
+			continue
+		}
+
+		err = conn.SetAddElements(set, missing)
+		if err == nil {
+			err = conn.Flush()
+		}
+		if err != nil {
+			log.Errorf("Nftables drift check repair %v element(s) of set %v %v %v failed. %v", len(missing), familyName, tableName, setName, err)
+			continue
+		}
+		log.Infof("Nftables drift check repair %v element(s) of set %v %v %v", len(missing), familyName, tableName, setName)
+		driftRepairCount.WithLabelValues(familyName, tableName, setName).Add(float64(len(missing)))
+	}
+}
+
+// recreateDriftSet create the set deleted by others(for example a firewall reload) with the rule which created it,
+// and add the living elements back
+func recreateDriftSet(conn NftBackend, table *nftables.Table, setName string, elements []NftablesTrackedElement) {
+	familyName := getFamilyName(table.Family)
+	var rule *NftablesSetAddElement = nil
+	for _, running := range getRunningSetRules() {
+		if running.family == table.Family && running.rule.TableName == table.Name && running.rule.SetName == setName {
+			rule = running.rule
+			break
+		}
+	}
+	if rule == nil {
+		log.Warningf("Nftables drift check can not recreate set %v %v %v because no rule creates it", familyName, table.Name, setName)
+		return
+	}
+
+	keyType := rule.KeyType
+	if keyType == nftables.TypeInvalid {
+		if len(elements[0].Key) == net.IPv4len {
+			keyType = nftables.TypeIPAddr
+		} else {
+			keyType = nftables.TypeIP6Addr
+		}
+	}
+	set, err := rule.newSet(table, keyType)
+	if err != nil {
+		log.Errorf("Nftables drift check can not recreate set %v %v %v. %v", familyName, table.Name, setName, err)
+		return
+	}
+
+	now := time.Now()
+	var missing []nftables.SetElement
+	for _, element := range elements {
+		if len(element.Key) != int(keyType.Bytes) {
+			continue
+		}
+		remaining := element.Remaining(now)
+		if element.Timeout > 0 && remaining <= driftExpireTolerance {
+			continue
+		}
+		if !set.HasTimeout {
+			remaining = 0
+		}
+		missing = append(missing, nftables.SetElement{Key: element.Key, Val: element.Val, Timeout: remaining})
+	}
+
+	conn.AddTable(table)
+	err = addSetWithDescription(conn, set, rule.setDescription(), missing)
+	if err == nil {
+		err = conn.Flush()
+	}
+	if err != nil {
+		log.Errorf("Nftables drift check recreate set %v %v %v failed. %v", familyName, table.Name, setName, err)
+		return
+	}
+	log.Infof("Nftables drift check recreate set %v %v %v with %v element(s)", familyName, table.Name, setName, len(missing))
+	driftRepairCount.WithLabelValues(familyName, table.Name, setName).Add(float64(len(missing)))
+}
@@ -0,0 +1,267 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+var stateDumpLock sync.Mutex = sync.Mutex{}
+var stateDumpSignal os.Signal = nil
+var stateDumpPath string = ""
+var stateDumpHandlers = make(map[*NftablesHandler]bool)
+var stateDumpChannel chan os.Signal = nil
+
+var addElementErrorCount uint64 = 0
+var flushErrorCount uint64 = 0
+
+// SetStateDump set the signal which triggers dumping state report into path
+func SetStateDump(sig os.Signal, path string) {
+	stateDumpLock.Lock()
+	defer stateDumpLock.Unlock()
+
+	stateDumpSignal = sig
+	stateDumpPath = path
+}
+
+// parseSignal accept USR1/USR2 with or without SIG prefix
+func parseSignal(name string) (os.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	}
+
+	return nil, fmt.Errorf("signal %v not supported, use USR1 or USR2", name)
+}
+
+// StartStateDump register the handler to state report and start listening the signal
+func StartStateDump(handler *NftablesHandler) {
+	stateDumpLock.Lock()
+	defer stateDumpLock.Unlock()
+
+	stateDumpHandlers[handler] = true
+	if stateDumpSignal == nil || stateDumpChannel != nil {
+		return
+	}
+
+	stateDumpChannel = make(chan os.Signal, 1)
+	signal.Notify(stateDumpChannel, stateDumpSignal)
+	go func(ch chan os.Signal) {
+		for range ch {
+			stateDumpLock.Lock()
+			path := stateDumpPath
+			stateDumpLock.Unlock()
+
+			err := WriteStateDump(path)
+			if err != nil {
+				log.Errorf("Nftables dump state to %v failed. %v", path, err)
+			} else {
+				log.Infof("Nftables dump state to %v", path)
+			}
+		}
+	}(stateDumpChannel)
+}
+
+// StopStateDump unregister the handler and stop listening the signal when there is no handler
+func StopStateDump(handler *NftablesHandler) {
+	stateDumpLock.Lock()
+	defer stateDumpLock.Unlock()
+
+	delete(stateDumpHandlers, handler)
+	if len(stateDumpHandlers) > 0 || stateDumpChannel == nil {
+		return
+	}
+
+	signal.Stop(stateDumpChannel)
+	close(stateDumpChannel)
+	stateDumpChannel = nil
+}
+
+// WriteStateDump write a human-readable state report into path
+func WriteStateDump(path string) error {
+	var buffer bytes.Buffer
+	DumpState(&buffer)
+	return os.WriteFile(path, buffer.Bytes(), 0644)
+}
+
+// DumpState write a human-readable report of pool, rules, LRU and error counters
+func DumpState(w io.Writer) {
+	fmt.Fprintf(w, "coredns-nftables state at %v\n\n", time.Now().Format(time.RFC3339))
+
+	fmt.Fprintf(w, "Connection pool:\n")
+	fmt.Fprintf(w, "  connection timeout: %v\n", cacheExpiredDuration)
+	for _, operation := range []string{connectionOperationAdd, connectionOperationCreate, connectionOperationDelete} {
+		fmt.Fprintf(w, "  connection max age of %v: %v\n", operation, getConnectionMaxAge(operation))
+	}
+	fmt.Fprintf(w, "  pool size: %v\n", connectionPoolSize)
+	fmt.Fprintf(w, "  idle timeout: %v\n", connectionIdleTimeout)
+	fmt.Fprintf(w, "  health check: %v\n", connectionHealthCheck)
+	{
+		fmt.Fprintf(w, "  idle connections: %v\n", countIdleConnections())
+		forEachIdleConnection(func(cache *NftablesCache) {
+			fmt.Fprintf(w, "  - %p age %v, idle %v, has error %v\n", cache, time.Since(cache.CreateTimepoint).Truncate(time.Second),
+				time.Since(cache.idleSince).Truncate(time.Second), cache.HasNftableConnectionError)
+		})
+	}
+
+	fmt.Fprintf(w, "\nLRU:\n")
+	fmt.Fprintf(w, "  max count: %v\n", setLruMaxCount)
+	fmt.Fprintf(w, "  max retry times: %v\n", setLruMaxRetryTimes)
+	fmt.Fprintf(w, "  timeout: %v\n", setLruTimeout)
+	fmt.Fprintf(w, "  ttl factor: %v\n", setLruTTLFactor)
+	fmt.Fprintf(w, "  entries: %v\n", sharedDedupe.len())
+
+	fmt.Fprintf(w, "\nRules:\n")
+	{
+		stateDumpLock.Lock()
+		index := 0
+		for handler := range stateDumpHandlers {
+			index += 1
+			fmt.Fprintf(w, "  handler #%v(config hash %v):\n", index, handler.ConfigHash())
+			var families []nftables.TableFamily
+			for family := range handler.Rules {
+				families = append(families, family)
+			}
+			sort.Slice(families, func(i, j int) bool { return families[i] < families[j] })
+			for _, family := range families {
+				fmt.Fprintf(w, "    family %v:\n", getFamilyName(family))
+				for _, rule := range handler.Rules[family].RuleAddElement {
+					fmt.Fprintf(w, "      - add element to %v %v, key type %v, interval %v, timeout %v",
+						rule.TableName, rule.SetName, getKeyTypeName(rule.KeyType), rule.Interval, rule.Timeout)
+					if rule.Counter != nil {
+						fmt.Fprintf(w, ", counter %v in chain %v", rule.Counter.CounterName, rule.Counter.ChainName)
+					}
+					if rule.ProxyPort > 0 {
+						fmt.Fprintf(w, ", proxy port %v", rule.ProxyPort)
+					}
+					if !rule.Netns.IsDefault() {
+						fmt.Fprintf(w, ", netns %v", rule.Netns)
+					}
+					if rule.Workload {
+						fmt.Fprintf(w, ", keyed by workload mark")
+					}
+					fmt.Fprintf(w, "\n")
+				}
+				for _, rule := range handler.Rules[family].RuleAddService {
+					fmt.Fprintf(w, "      - add service to %v %v, address type %v, timeout %v\n",
+						rule.TableName, rule.SetName, getKeyTypeName(rule.AddressType), rule.Timeout)
+				}
+			}
+			for _, group := range handler.Groups {
+				rules := 0
+				for _, ruleSet := range group.Rules {
+					rules += len(ruleSet.RuleAddElement)
+				}
+				fmt.Fprintf(w, "    group %v: %v domain(s), %v rule(s), active %v\n", group.Name, group.Matcher.Len(), rules, group.Active())
+			}
+			for _, chain := range handler.ActionChains {
+				var actions []string
+				for _, action := range chain.Actions {
+					actions = append(actions, action.Name())
+				}
+				fmt.Fprintf(w, "    match %v domain(s): %v\n", chain.Matcher.Len(), strings.Join(actions, " -> "))
+			}
+		}
+		stateDumpLock.Unlock()
+	}
+
+	fmt.Fprintf(w, "\nErrors:\n")
+	fmt.Fprintf(w, "  add element failures: %v\n", atomic.LoadUint64(&addElementErrorCount))
+	fmt.Fprintf(w, "  flush failures: %v\n", atomic.LoadUint64(&flushErrorCount))
+	fmt.Fprintf(w, "  last flush latency: %v\n", GetLastFlushLatency())
+}
+
+func getKeyTypeName(keyType nftables.SetDatatype) string {
+	if keyType == nftables.TypeInvalid {
+		return "auto"
+	}
+	return keyType.Name
+}
+
+// getRunningGroups returns the rule groups of all running handlers
+func getRunningGroups() []*NftablesRuleGroup {
+	stateDumpLock.Lock()
+	defer stateDumpLock.Unlock()
+
+	var ret []*NftablesRuleGroup
+	for handler := range stateDumpHandlers {
+		ret = append(ret, handler.Groups...)
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret
+}
+
+type nftablesRunningRule struct {
+	family nftables.TableFamily
+	rule   *NftablesSetAddElement
+}
+
+// setRules returns the set rules of handler, including the ones in groups, the canary and action chains
+func (m *NftablesHandler) setRules() []nftablesRunningRule {
+	var ret []nftablesRunningRule
+	for family, ruleSet := range m.Rules {
+		for _, rule := range ruleSet.RuleAddElement {
+			ret = append(ret, nftablesRunningRule{family: family, rule: rule})
+		}
+	}
+	for _, group := range m.Groups {
+		for family, ruleSet := range group.Rules {
+			for _, rule := range ruleSet.RuleAddElement {
+				ret = append(ret, nftablesRunningRule{family: family, rule: rule})
+			}
+		}
+	}
+	if m.Canary != nil {
+		for family, ruleSet := range m.Canary.Rules {
+			for _, rule := range ruleSet.RuleAddElement {
+				ret = append(ret, nftablesRunningRule{family: family, rule: rule})
+			}
+		}
+	}
+	for _, chain := range m.ActionChains {
+		for _, action := range chain.Actions {
+			rule := actionSetRule(action)
+			if rule == nil {
+				continue
+			}
+			for _, family := range chain.Families {
+				ret = append(ret, nftablesRunningRule{family: family, rule: rule})
+			}
+		}
+	}
+	return ret
+}
+
+// getRunningSetRules returns the set rules of all running handlers, including the ones in action chains
+func getRunningSetRules() []nftablesRunningRule {
+	stateDumpLock.Lock()
+	defer stateDumpLock.Unlock()
+
+	var ret []nftablesRunningRule
+	for handler := range stateDumpHandlers {
+		ret = append(ret, handler.setRules()...)
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].family != ret[j].family {
+			return ret[i].family < ret[j].family
+		}
+		if ret[i].rule.TableName != ret[j].rule.TableName {
+			return ret[i].rule.TableName < ret[j].rule.TableName
+		}
+		return ret[i].rule.SetName < ret[j].rule.SetName
+	})
+	return ret
+}
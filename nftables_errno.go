@@ -0,0 +1,47 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// The errnos the kernel answers an operation with, the connection still works after them
+var operationErrnos = []syscall.Errno{unix.EEXIST, unix.ENOENT, unix.EPERM, unix.ENOSPC}
+
+// classifyNetlinkError returns the name of the errno of err(like EEXIST), or other if err carries no known errno,
+// and whether the connection should be destroyed because of err
+func classifyNetlinkError(err error) (string, bool) {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return "other", true
+	}
+	name := unix.ErrnoName(errno)
+	if len(name) == 0 {
+		name = "other"
+	}
+	for _, operation := range operationErrnos {
+		if errno == operation {
+			return name, false
+		}
+	}
+	return name, true
+}
+
+// recordConnectionError count err by its errno, and mark the connection to be destroyed unless the kernel just
+// rejected the operation. The tables and sets cached by the connection are forgotten after ENOENT, since they
+// are deleted by others.
+func (cache *NftablesCache) recordConnectionError(err error) {
+	name, fatal := classifyNetlinkError(err)
+	netlinkErrorCount.WithLabelValues(name).Inc()
+	if fatal {
+		cache.HasNftableConnectionError = true
+		return
+	}
+	log.Debugf("Nftables connection %p is kept after %v. %v", cache, name, err)
+	if errors.Is(err, unix.ENOENT) {
+		cache.tables = make(map[nftables.TableFamily]*map[string]*NftableCache)
+	}
+}
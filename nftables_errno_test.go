@@ -0,0 +1,84 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sys/unix"
+)
+
+// failingFlushBackend fails every flush with err, like the replies of the kernel
+type failingFlushBackend struct {
+	*MemoryBackend
+	err error
+}
+
+func (backend *failingFlushBackend) Flush() error {
+	backend.MemoryBackend.Flush()
+	return backend.err
+}
+
+func TestClassifyNetlinkError(t *testing.T) {
+	for _, c := range []struct {
+		err   error
+		name  string
+		fatal bool
+	}{
+		{fmt.Errorf("conn.Receive: %w", &netlink.OpError{Op: "receive", Err: unix.EEXIST}), "EEXIST", false},
+		{fmt.Errorf("set VPN not found, %w", unix.ENOENT), "ENOENT", false},
+		{unix.EPERM, "EPERM", false},
+		{unix.ENOSPC, "ENOSPC", false},
+		{fmt.Errorf("SendMessages: %w", unix.EBADF), "EBADF", true},
+		{unix.ENOBUFS, "ENOBUFS", true},
+		{errors.New("marshal message failed"), "other", true},
+	} {
+		if name, fatal := classifyNetlinkError(c.err); name != c.name || fatal != c.fatal {
+			t.Errorf("Expected %v classified as %v(fatal %v), but got %v(fatal %v)", c.err, c.name, c.fatal, name, fatal)
+		}
+	}
+}
+
+func TestConnectionErrorKeepsConnection(t *testing.T) {
+	backend := &failingFlushBackend{MemoryBackend: NewMemoryBackend(NewMemoryRuleset())}
+	SetNftBackendFactory(func() (NftBackend, error) {
+		return backend, nil
+	})
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+	}()
+
+	// the kernel rejecting the operation does not break the connection
+	backend.err = fmt.Errorf("conn.Receive: %w", unix.EEXIST)
+	before := testutil.ToFloat64(netlinkErrorCount.WithLabelValues("EEXIST"))
+	cache, _ := NewCache()
+	cache.MutableNftablesTable(nftables.TableFamilyIPv4, "filter")
+	CloseCache(cache)
+	if cache.HasNftableConnectionError || countIdleConnections() != 1 {
+		t.Errorf("Expected the connection kept after EEXIST")
+	}
+	if testutil.ToFloat64(netlinkErrorCount.WithLabelValues("EEXIST")) != before+1 {
+		t.Errorf("Expected EEXIST counted")
+	}
+
+	// the tables cached are forgotten after ENOENT
+	backend.err = fmt.Errorf("conn.Receive: %w", unix.ENOENT)
+	cache, _ = NewCache()
+	cache.MutableNftablesTable(nftables.TableFamilyIPv4, "filter")
+	CloseCache(cache)
+	if cache.HasNftableConnectionError || len(cache.tables) != 0 {
+		t.Errorf("Expected the connection kept and its tables forgotten after ENOENT, but got %v", cache.tables)
+	}
+
+	backend.err = fmt.Errorf("SendMessages: %w", unix.EBADF)
+	cache, _ = NewCache()
+	CloseCache(cache)
+	if !cache.HasNftableConnectionError || countIdleConnections() != 0 {
+		t.Errorf("Expected the connection destroyed after EBADF")
+	}
+}
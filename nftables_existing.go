@@ -0,0 +1,149 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+var skipExistingRefresh time.Duration = 0
+var existingElementsLock sync.Mutex = sync.Mutex{}
+var existingElements = make(map[string]*nftablesExistingSet)
+
+// nftablesExistingSet is a snapshot of the elements of a kernel set, it's fetched again after the refresh interval
+type nftablesExistingSet struct {
+	refreshTime time.Time
+	elements    map[string]*nftablesExistingElement
+}
+
+type nftablesExistingElement struct {
+	val []byte
+	// zero means the element never expires
+	expireTime time.Time
+}
+
+func (element *nftablesExistingElement) alive(now time.Time) bool {
+	return element.expireTime.IsZero() || element.expireTime.After(now)
+}
+
+// SetSkipExisting set the refresh interval of the cached kernel set elements, elements already present in the
+// cache are not added again. 0 disables it.
+func SetSkipExisting(refresh time.Duration) {
+	existingElementsLock.Lock()
+	defer existingElementsLock.Unlock()
+
+	skipExistingRefresh = refresh
+	existingElements = make(map[string]*nftablesExistingSet)
+}
+
+// getExistingSet returns the cached elements of set, which are fetched from kernel when they are older than
+// the refresh interval. It returns nil when the elements can not be fetched.
+func getExistingSet(cache *NftablesCache, tableCache *NftableCache, set *nftables.Set, now time.Time) *nftablesExistingSet {
+	setKey := trackedSetKey(tableCache.table.Family, tableCache.table.Name, set.Name)
+	existingSet, ok := existingElements[setKey]
+	if ok && now.Sub(existingSet.refreshTime) < skipExistingRefresh {
+		return existingSet
+	}
+
+	elements, err := cache.NftableConnection.GetSetElements(set)
+	if err != nil {
+		log.Debugf("Nftables get elements of %v %v %v failed. %v", getFamilyName(tableCache.table.Family), tableCache.table.Name, set.Name, err)
+		delete(existingElements, setKey)
+		return nil
+	}
+
+	existingSet = &nftablesExistingSet{
+		refreshTime: now,
+		elements:    make(map[string]*nftablesExistingElement, len(elements)),
+	}
+	for _, element := range elements {
+		existing := &nftablesExistingElement{val: element.Val}
+		if element.Timeout > 0 {
+			existing.expireTime = now.Add(element.Timeout)
+		}
+		existingSet.elements[string(element.Key)] = existing
+	}
+	existingElements[setKey] = existingSet
+	return existingSet
+}
+
+// skipExisting move the elements of entry which are already present in the kernel set to skipped. Interval sets
+// and sets created by this batch are never skipped.
+func (entry *nftablesBatchEntry) skipExisting(cache *NftablesCache) {
+	if entry.create || entry.tableCache.pending || entry.set.Interval || len(entry.elements) == 0 {
+		return
+	}
+
+	existingElementsLock.Lock()
+	defer existingElementsLock.Unlock()
+
+	if skipExistingRefresh <= 0 {
+		return
+	}
+
+	now := time.Now()
+	existingSet := getExistingSet(cache, entry.tableCache, entry.set, now)
+	if existingSet == nil {
+		return
+	}
+
+	elements := entry.elements[:0]
+	for _, element := range entry.elements {
+		existing, ok := existingSet.elements[string(element.element.Key)]
+		if ok && existing.alive(now) && bytes.Equal(existing.val, element.element.Val) && !entry.refresh[string(element.element.Key)] {
+			entry.skipped = append(entry.skipped, element)
+			continue
+		}
+		elements = append(elements, element)
+	}
+	entry.elements = elements
+
+	if len(entry.skipped) > 0 {
+		log.Debugf("Nftables skip %v element(s) already present in %v %v %v", len(entry.skipped),
+			getFamilyName(entry.tableCache.table.Family), entry.tableCache.table.Name, entry.set.Name)
+		skipExistingCount.WithLabelValues(getFamilyName(entry.tableCache.table.Family), entry.tableCache.table.Name, entry.set.Name).Add(float64(len(entry.skipped)))
+	}
+}
+
+// rememberExisting record the elements of entry added to the kernel, so that they are skipped before the next refresh
+func (entry *nftablesBatchEntry) rememberExisting() {
+	existingElementsLock.Lock()
+	defer existingElementsLock.Unlock()
+
+	existingSet, ok := existingElements[trackedSetKey(entry.tableCache.table.Family, entry.tableCache.table.Name, entry.set.Name)]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	for _, element := range entry.elements {
+		existing, ok := existingSet.elements[string(element.element.Key)]
+		if ok && existing.alive(now) && bytes.Equal(existing.val, element.element.Val) && !entry.refresh[string(element.element.Key)] {
+			// The kernel does not refresh the timeout of an existing element
+			continue
+		}
+
+		existing = &nftablesExistingElement{val: element.element.Val}
+		timeout := element.element.Timeout
+		if timeout <= 0 {
+			timeout = entry.set.Timeout
+		}
+		if entry.set.HasTimeout && timeout > 0 {
+			existing.expireTime = now.Add(timeout)
+		}
+		existingSet.elements[string(element.element.Key)] = existing
+	}
+}
+
+// forgetExistingElement drop an element removed from the kernel set, so that it's added again by the next answer
+func forgetExistingElement(family nftables.TableFamily, tableName string, setName string, key []byte) {
+	existingElementsLock.Lock()
+	defer existingElementsLock.Unlock()
+
+	existingSet, ok := existingElements[trackedSetKey(family, tableName, setName)]
+	if ok {
+		delete(existingSet.elements, string(key))
+	}
+}
@@ -0,0 +1,63 @@
+package coredns_nftables
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestSkipExisting(t *testing.T) {
+	SetSkipExisting(time.Minute)
+	defer SetSkipExisting(0)
+
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns"}
+	set := &nftables.Set{Table: table, Name: "SET_A", KeyType: nftables.TypeIPAddr, HasTimeout: true, Timeout: time.Hour}
+	now := time.Now()
+	existingElements[trackedSetKey(table.Family, table.Name, set.Name)] = &nftablesExistingSet{
+		refreshTime: now,
+		elements: map[string]*nftablesExistingElement{
+			string(net.ParseIP("192.0.2.1").To4()): {expireTime: now.Add(time.Minute)},
+			string(net.ParseIP("192.0.2.2").To4()): {expireTime: now.Add(-time.Second)},
+		},
+	}
+
+	newEntry := func() *nftablesBatchEntry {
+		entry := &nftablesBatchEntry{tableCache: &NftableCache{table: table}, set: set}
+		for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+			entry.elements = append(entry.elements, &nftablesBatchElement{element: nftables.SetElement{Key: net.ParseIP(ip).To4()}})
+		}
+		return entry
+	}
+
+	entry := newEntry()
+	entry.skipExisting(nil)
+	if len(entry.skipped) != 1 || !net.IP(entry.skipped[0].element.Key).Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Expected only the living element 192.0.2.1 is skipped, but got %v", len(entry.skipped))
+	}
+	if len(entry.elements) != 2 {
+		t.Errorf("Expected 2 elements are added, but got %v", len(entry.elements))
+	}
+
+	entry.rememberExisting()
+	entry = newEntry()
+	entry.skipExisting(nil)
+	if len(entry.skipped) != 3 || len(entry.elements) != 0 {
+		t.Errorf("Expected all elements are skipped after they are added, but got %v", len(entry.skipped))
+	}
+
+	forgetExistingElement(table.Family, table.Name, set.Name, net.ParseIP("192.0.2.3").To4())
+	entry = newEntry()
+	entry.skipExisting(nil)
+	if len(entry.elements) != 1 || !net.IP(entry.elements[0].element.Key).Equal(net.ParseIP("192.0.2.3")) {
+		t.Errorf("Expected the deleted element 192.0.2.3 is added again, but got %v", len(entry.elements))
+	}
+
+	entry = newEntry()
+	entry.create = true
+	entry.skipExisting(nil)
+	if len(entry.skipped) != 0 {
+		t.Errorf("Expected elements of created sets are never skipped, but got %v", len(entry.skipped))
+	}
+}
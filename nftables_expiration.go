@@ -0,0 +1,235 @@
+package coredns_nftables
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// NftablesElementExpiration is an element of a kernel set and its remaining timeout, durations are formatted for
+// humans and empty when the element never expires
+type NftablesElementExpiration struct {
+	Element   string `json:"element"`
+	Name      string `json:"name,omitempty"`
+	Timeout   string `json:"timeout,omitempty"`
+	Remaining string `json:"remaining,omitempty"`
+	Expire    string `json:"expire,omitempty"`
+
+	remaining time.Duration
+}
+
+// nftablesKernelElement is an element decoded from NFT_MSG_NEWSETELEM, the google/nftables library does not
+// decode NFTA_SET_ELEM_EXPIRATION
+type nftablesKernelElement struct {
+	key        []byte
+	timeout    time.Duration
+	expiration time.Duration
+}
+
+// formatElementKey returns the address of key, or the hex of keys which are not addresses
+func formatElementKey(key []byte) string {
+	if len(key) == net.IPv4len || len(key) == net.IPv6len {
+		return net.IP(key).String()
+	}
+	return "0x" + hex.EncodeToString(key)
+}
+
+// decodeKernelElements decode the elements of a NFT_MSG_NEWSETELEM message, the message is a nfgenmsg followed
+// by NFTA_SET_ELEM_LIST_* attributes. The ends of intervals are skipped.
+func decodeKernelElements(data []byte) ([]nftablesKernelElement, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("message too short")
+	}
+
+	decoder, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	decoder.ByteOrder = binary.BigEndian
+
+	var ret []nftablesKernelElement
+	for decoder.Next() {
+		if decoder.Type() != unix.NFTA_SET_ELEM_LIST_ELEMENTS {
+			continue
+		}
+		decoder.Nested(func(elements *netlink.AttributeDecoder) error {
+			for elements.Next() {
+				if elements.Type() != unix.NFTA_LIST_ELEM {
+					continue
+				}
+				var kernelElement nftablesKernelElement
+				intervalEnd := false
+				elements.Nested(func(element *netlink.AttributeDecoder) error {
+					for element.Next() {
+						switch element.Type() {
+						case unix.NFTA_SET_ELEM_KEY:
+							element.Nested(func(value *netlink.AttributeDecoder) error {
+								for value.Next() {
+									if value.Type() == unix.NFTA_DATA_VALUE {
+										kernelElement.key = value.Bytes()
+									}
+								}
+								return nil
+							})
+						case unix.NFTA_SET_ELEM_TIMEOUT:
+							kernelElement.timeout = time.Duration(element.Uint64()) * time.Millisecond
+						case unix.NFTA_SET_ELEM_EXPIRATION:
+							kernelElement.expiration = time.Duration(element.Uint64()) * time.Millisecond
+						case unix.NFTA_SET_ELEM_FLAGS:
+							intervalEnd = element.Uint32()&unix.NFT_SET_ELEM_INTERVAL_END != 0
+						}
+					}
+					return nil
+				})
+				if !intervalEnd {
+					ret = append(ret, kernelElement)
+				}
+			}
+			return nil
+		})
+	}
+	return ret, decoder.Err()
+}
+
+// listKernelElements dump the elements of a kernel set with their remaining timeouts
+func listKernelElements(family nftables.TableFamily, tableName string, setName string) ([]nftablesKernelElement, error) {
+	conn, err := dialNetfilter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	attributes, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: []byte(tableName + "\x00")},
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: []byte(setName + "\x00")},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_GETSETELEM),
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Dump,
+		},
+		Data: append([]byte{byte(family), unix.NFNETLINK_V0, 0, 0}, attributes...),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []nftablesKernelElement
+	for _, message := range messages {
+		if message.Header.Type != netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8|unix.NFT_MSG_NEWSETELEM) {
+			continue
+		}
+		elements, err := decodeKernelElements(message.Data)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, elements...)
+	}
+	return ret, nil
+}
+
+// GetElementExpirations returns the elements of a kernel set sorted by remaining timeout, elements never
+// expiring are the last ones. Names are filled for the elements tracked by the plugin.
+func GetElementExpirations(family nftables.TableFamily, tableName string, setName string) ([]NftablesElementExpiration, error) {
+	elements, err := listKernelElements(family, tableName, setName)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	for _, tracked := range GetTrackedElements()[trackedSetKey(family, tableName, setName)] {
+		names[string(tracked.Key)] = tracked.Name
+	}
+
+	now := time.Now()
+	ret := make([]NftablesElementExpiration, 0, len(elements))
+	for _, element := range elements {
+		expiration := NftablesElementExpiration{
+			Element:   formatElementKey(element.key),
+			Name:      names[string(element.key)],
+			remaining: element.expiration,
+		}
+		if element.timeout > 0 {
+			expiration.Timeout = element.timeout.String()
+			expiration.Remaining = element.expiration.Round(time.Second).String()
+			expiration.Expire = now.Add(element.expiration).Format(time.RFC3339)
+		}
+		ret = append(ret, expiration)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if (ret[i].remaining > 0) != (ret[j].remaining > 0) {
+			return ret[i].remaining > 0
+		}
+		return ret[i].remaining < ret[j].remaining
+	})
+	return ret, nil
+}
+
+func init() {
+	registerAdminHandler("/elements", serveAdminElements)
+}
+
+// serveAdminElements list the elements of a set by GET /elements?family=<FAMILY>&table=<TABLE>&set=<SET>, and
+// purge the elements added by the plugin by DELETE with the same parameters and optional element=<ELEMENT>
+func serveAdminElements(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	family, err := parseFamilyName(query.Get("family"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tableName := query.Get("table")
+	setName := query.Get("set")
+	if len(tableName) == 0 || len(setName) == 0 {
+		http.Error(w, "table and set are required", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if !confirmDestructive(w, r) {
+			return
+		}
+		purged, err := PurgeElements(family, tableName, setName, query.Get("element"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("purge elements of %v %v %v failed, %v", getFamilyName(family), tableName, setName, err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+		return
+	}
+
+	elements, err := GetElementExpirations(family, tableName, setName)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, unix.ENOENT) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, fmt.Sprintf("list elements of %v %v %v failed, %v", getFamilyName(family), tableName, setName, err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(elements)
+}
@@ -0,0 +1,68 @@
+package coredns_nftables
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func encodeTestKernelElement(t *testing.T, key []byte, timeout time.Duration, expiration time.Duration, flags uint32) []byte {
+	encoder := netlink.NewAttributeEncoder()
+	encoder.ByteOrder = binary.BigEndian
+	encoder.Nested(unix.NFTA_SET_ELEM_KEY, func(value *netlink.AttributeEncoder) error {
+		value.Bytes(unix.NFTA_DATA_VALUE, key)
+		return nil
+	})
+	if timeout > 0 {
+		encoder.Uint64(unix.NFTA_SET_ELEM_TIMEOUT, uint64(timeout.Milliseconds()))
+		encoder.Uint64(unix.NFTA_SET_ELEM_EXPIRATION, uint64(expiration.Milliseconds()))
+	}
+	if flags != 0 {
+		encoder.Uint32(unix.NFTA_SET_ELEM_FLAGS, flags)
+	}
+	data, err := encoder.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeKernelElements(t *testing.T) {
+	elements := netlink.NewAttributeEncoder()
+	elements.Nested(unix.NFTA_SET_ELEM_LIST_ELEMENTS, func(list *netlink.AttributeEncoder) error {
+		list.Bytes(unix.NFTA_LIST_ELEM, encodeTestKernelElement(t, net.ParseIP("192.0.2.1").To4(), time.Hour, 30*time.Minute, 0))
+		list.Bytes(unix.NFTA_LIST_ELEM, encodeTestKernelElement(t, net.ParseIP("192.0.2.2").To4(), 0, 0, 0))
+		list.Bytes(unix.NFTA_LIST_ELEM, encodeTestKernelElement(t, net.ParseIP("192.0.2.3").To4(), 0, 0, unix.NFT_SET_ELEM_INTERVAL_END))
+		return nil
+	})
+	elements.String(unix.NFTA_SET_ELEM_LIST_TABLE, "coredns")
+	data, err := elements.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeKernelElements(append([]byte{unix.NFPROTO_IPV4, unix.NFNETLINK_V0, 0, 0}, data...))
+	if err != nil {
+		t.Fatalf("decodeKernelElements failed: %v", err)
+	}
+	if len(decoded) != 2 {
+		t.Fatalf("Expected 2 elements without the interval end, but got %v", decoded)
+	}
+	if formatElementKey(decoded[0].key) != "192.0.2.1" || decoded[0].timeout != time.Hour || decoded[0].expiration != 30*time.Minute {
+		t.Errorf("Expected element with 30m remaining, but got %v", decoded[0])
+	}
+	if formatElementKey(decoded[1].key) != "192.0.2.2" || decoded[1].timeout != 0 {
+		t.Errorf("Expected element never expiring, but got %v", decoded[1])
+	}
+	if key := formatElementKey([]byte{1, 2}); key != "0x0102" {
+		t.Errorf("Expected hex key, but got %v", key)
+	}
+
+	if _, err := decodeKernelElements([]byte{1}); err == nil {
+		t.Errorf("Expected short message is invalid")
+	}
+}
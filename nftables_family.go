@@ -0,0 +1,53 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+var defaultFamiliesIPv4 = []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyINet, nftables.TableFamilyBridge}
+var defaultFamiliesIPv6 = []nftables.TableFamily{nftables.TableFamilyIPv6, nftables.TableFamilyINet, nftables.TableFamilyBridge}
+
+// parseAnswerFamilies parse the table families which addresses of ip version are applied to. ip6 tables can not
+// hold IPv4 addresses and the reverse, arp tables can not hold any of them.
+func parseAnswerFamilies(version string, args []string) ([]nftables.TableFamily, error) {
+	var ret []nftables.TableFamily
+	for _, arg := range args {
+		family, err := parseFamilyName(strings.ToLower(arg))
+		if err != nil {
+			return nil, err
+		}
+		if family == nftables.TableFamilyARP ||
+			(version == "ipv4" && family == nftables.TableFamilyIPv6) ||
+			(version == "ipv6" && family == nftables.TableFamilyIPv4) {
+			return nil, fmt.Errorf("family %v can not hold %v addresses", arg, version)
+		}
+
+		duplicated := false
+		for _, exists := range ret {
+			duplicated = duplicated || exists == family
+		}
+		if !duplicated {
+			ret = append(ret, family)
+		}
+	}
+	return ret, nil
+}
+
+// familiesIPv4 returns the table families A answers are applied to
+func (m *NftablesHandler) familiesIPv4() []nftables.TableFamily {
+	if m.FamiliesIPv4 != nil {
+		return m.FamiliesIPv4
+	}
+	return defaultFamiliesIPv4
+}
+
+// familiesIPv6 returns the table families AAAA answers are applied to
+func (m *NftablesHandler) familiesIPv6() []nftables.TableFamily {
+	if m.FamiliesIPv6 != nil {
+		return m.FamiliesIPv6
+	}
+	return defaultFamiliesIPv6
+}
@@ -0,0 +1,36 @@
+package coredns_nftables
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+)
+
+func TestAnswerFamilies(t *testing.T) {
+	handle := NewNftablesHandler()
+	if err := parse(caddy.NewTestController("dns", `nftables {
+		families-ipv4 ip inet ip
+	}`), &handle); err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if expected := []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyINet}; !reflect.DeepEqual(handle.familiesIPv4(), expected) {
+		t.Errorf("Expected A answers are applied to %v, but got %v", expected, handle.familiesIPv4())
+	}
+	if !reflect.DeepEqual(handle.familiesIPv6(), defaultFamiliesIPv6) {
+		t.Errorf("Expected AAAA answers are applied to default families, but got %v", handle.familiesIPv6())
+	}
+
+	if families, err := parseAnswerFamilies("ipv6", []string{"netdev", "INET"}); err != nil || len(families) != 2 {
+		t.Errorf("Expected netdev and inet, but got %v, %v", families, err)
+	}
+	for _, args := range [][]string{{"ip6"}, {"arp"}, {"unknown"}} {
+		if _, err := parseAnswerFamilies("ipv4", args); err == nil {
+			t.Errorf("Expected %v is invalid for ipv4", args)
+		}
+	}
+	if _, err := parseAnswerFamilies("ipv6", []string{"ip"}); err == nil {
+		t.Errorf("Expected ip is invalid for ipv6")
+	}
+}
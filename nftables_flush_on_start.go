@@ -0,0 +1,206 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// nftablesConfiguredSet is a set which the rules of a handler add elements into
+type nftablesConfiguredSet struct {
+	namespace NftablesNetworkNamespace
+	family    nftables.TableFamily
+	tableName string
+	setName   string
+	// the networks pinned by the rules of the handler, they are not active yet when the sets are flushed
+	pins []*net.IPNet
+}
+
+func (set nftablesConfiguredSet) key() string {
+	return fmt.Sprintf("%v/%v", set.namespace, trackedSetKey(set.family, set.tableName, set.setName))
+}
+
+var flushOnStartLock sync.Mutex = sync.Mutex{}
+
+// the sets already flushed by this process, reloads never flush them again
+var flushedOnStart = make(map[string]bool)
+
+// configuredSets returns the sets of the element and service rules of handler, see setRules, sorted by their keys
+func (m *NftablesHandler) configuredSets() []nftablesConfiguredSet {
+	found := make(map[string]nftablesConfiguredSet)
+	for _, running := range m.setRules() {
+		set := nftablesConfiguredSet{namespace: running.rule.Netns, family: running.family, tableName: running.rule.TableName, setName: running.rule.SetName}
+		if existing, ok := found[set.key()]; ok {
+			set.pins = existing.pins
+		}
+		set.pins = append(set.pins, running.rule.Pins...)
+		found[set.key()] = set
+	}
+	add := func(rules map[nftables.TableFamily]*NftablesRuleSet) {
+		for family, ruleSet := range rules {
+			for _, rule := range ruleSet.RuleAddService {
+				set := nftablesConfiguredSet{family: family, tableName: rule.TableName, setName: rule.SetName}
+				if _, ok := found[set.key()]; !ok {
+					found[set.key()] = set
+				}
+			}
+		}
+	}
+	add(m.Rules)
+	for _, group := range m.Groups {
+		add(group.Rules)
+	}
+	if m.Canary != nil {
+		add(m.Canary.Rules)
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ret := make([]nftablesConfiguredSet, 0, len(keys))
+	for _, key := range keys {
+		ret = append(ret, found[key])
+	}
+	return ret
+}
+
+// FlushSetsOnStart delete the elements of the sets configured by handler, so the elements left by a previous
+// instance with different rules are dropped before the answers add them again. Pinned elements are kept, and so
+// are the elements without the owner comment when the elements are added with comments. Every set is flushed
+// once by a process, sets missing yet are skipped. It returns how many elements are deleted.
+func FlushSetsOnStart(handler *NftablesHandler) (int, error) {
+	if err := checkDestructive("flush-set-on-start"); err != nil {
+		return 0, err
+	}
+
+	flushOnStartLock.Lock()
+	defer flushOnStartLock.Unlock()
+
+	deleted := 0
+	var lastErr error
+	for _, configured := range handler.configuredSets() {
+		if flushedOnStart[configured.key()] {
+			continue
+		}
+		count, err := configured.flush()
+		if err != nil {
+			log.Errorf("Nftables flush set %v %v %v on start failed. %v", getFamilyName(configured.family), configured.tableName, configured.setName, err)
+			lastErr = err
+			continue
+		}
+		flushedOnStart[configured.key()] = true
+		deleted += count
+	}
+	return deleted, lastErr
+}
+
+func (configured nftablesConfiguredSet) flush() (int, error) {
+	conn, newNS, err := openBackendIn(configured.namespace)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanupSystemNFTConn(newNS)
+
+	set, err := conn.GetSetByName(&nftables.Table{Family: configured.family, Name: configured.tableName}, configured.setName)
+	if errors.Is(err, unix.ENOENT) || (err == nil && set == nil) {
+		log.Debugf("Nftables set %v %v %v does not exist yet, skip flushing it", getFamilyName(configured.family), configured.tableName, configured.setName)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	elements, err := conn.GetSetElements(set)
+	if err != nil {
+		return 0, err
+	}
+	var userdata map[string][]byte
+	if reader := elementCommentReader(conn, configured.namespace); reader != nil {
+		userdata, err = reader.GetSetElementsUserdata(set)
+		if err != nil {
+			// the elements added by operators can not be told apart, so nothing is deleted
+			return 0, fmt.Errorf("read comments of the elements failed, keep them. %w", err)
+		}
+	}
+	elements = configured.deletableElements(elements, userdata)
+	if len(elements) == 0 {
+		return 0, nil
+	}
+	if err := conn.SetDeleteElements(set, elements); err != nil {
+		return 0, err
+	}
+	if err := conn.Flush(); err != nil {
+		return 0, err
+	}
+
+	count := countSetElements(elements)
+	log.Infof("Nftables flush %v element(s) of set %v %v %v on start", count, getFamilyName(configured.family), configured.tableName, configured.setName)
+	for _, element := range elements {
+		if element.IntervalEnd {
+			continue
+		}
+		UntrackElement(configured.family, configured.tableName, configured.setName, element.Key)
+		forgetExistingElement(configured.family, configured.tableName, configured.setName, element.Key)
+		if len(element.Key) == net.IPv4len || len(element.Key) == net.IPv6len {
+			// the dedup LRU restored from the snapshot must not skip the addresses flushed
+			lruRemoveIp(net.IP(element.Key).String())
+		}
+	}
+	return count, nil
+}
+
+// deletableElements returns the elements which can be flushed, the pinned ones and, when userdata is not nil, the
+// ones without the owner comment are kept. The end of a range in interval sets follows the decision of its start.
+func (configured nftablesConfiguredSet) deletableElements(elements []nftables.SetElement, userdata map[string][]byte) []nftables.SetElement {
+	sorted := make([]nftables.SetElement, len(elements))
+	copy(sorted, elements)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if order := bytes.Compare(sorted[i].Key, sorted[j].Key); order != 0 {
+			return order < 0
+		}
+		// a range may end where the next one starts
+		return sorted[i].IntervalEnd && !sorted[j].IntervalEnd
+	})
+
+	ret := make([]nftables.SetElement, 0, len(sorted))
+	deleteEnd := false
+	for _, element := range sorted {
+		if element.IntervalEnd {
+			if deleteEnd {
+				ret = append(ret, element)
+			}
+			deleteEnd = false
+			continue
+		}
+		deleteEnd = false
+		if configured.isPinned(element.Key) {
+			continue
+		}
+		if userdata != nil {
+			if data, ok := userdata[string(element.Key)]; !ok || !isOwnedUserdata(data) {
+				continue
+			}
+		}
+		ret = append(ret, element)
+		deleteEnd = true
+	}
+	return ret
+}
+
+func (configured nftablesConfiguredSet) isPinned(key []byte) bool {
+	if len(key) == net.IPv4len || len(key) == net.IPv6len {
+		for _, network := range configured.pins {
+			if network.Contains(net.IP(key)) {
+				return true
+			}
+		}
+	}
+	return isPinned(configured.family, configured.tableName, configured.setName, key)
+}
@@ -0,0 +1,122 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestFlushSetsOnStart(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+	}()
+
+	// 192.0.2.1 and 192.0.2.2 are left by a previous instance
+	backend := NewMemoryBackend(ruleset)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "flush_on_start"}
+	set := &nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr}
+	backend.AddTable(table)
+	backend.AddSet(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}, {Key: net.ParseIP("192.0.2.2").To4()}})
+	if err := backend.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	handle := NewNftablesHandler()
+	handle.FlushSetOnStart = true
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = []*NftablesSetAddElement{{TableName: "flush_on_start", SetName: "VPN", KeyType: nftables.TypeIPAddr}}
+	// the set of the service rule does not exist yet
+	ruleSet.RuleAddService = []*NftablesSetAddService{{TableName: "flush_on_start", SetName: "SERVICE"}}
+	if sets := handle.configuredSets(); len(sets) != 2 {
+		t.Fatalf("Expected 2 configured sets, but got %v", sets)
+	}
+
+	if _, err := FlushSetsOnStart(&handle); !errors.Is(err, ErrDestructiveDisabled) {
+		t.Fatalf("Expected flush-set-on-start refused without allow-destructive, but got %v", err)
+	}
+	SetAllowDestructive(true)
+	defer SetAllowDestructive(false)
+	if deleted, err := FlushSetsOnStart(&handle); err != nil || deleted != 2 {
+		t.Fatalf("Expected 2 elements flushed, but got %v, %v", deleted, err)
+	}
+	if elements, _ := backend.GetSetElements(set); len(elements) != 0 {
+		t.Errorf("Expected the set empty, but got %v", elements)
+	}
+
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.1")
+	if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+		t.Fatalf("Expected answer applied, but got %v", err)
+	}
+	// a reload never flushes the sets again
+	if deleted, err := FlushSetsOnStart(&handle); err != nil || deleted != 0 {
+		t.Errorf("Expected the set flushed once, but got %v, %v", deleted, err)
+	}
+	if elements, _ := backend.GetSetElements(set); len(elements) != 1 || !net.IP(elements[0].Key).Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Expected the set populated again, but got %v", elements)
+	}
+}
+
+func TestFlushSetsOnStartKeepElements(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	SetElementOwnerComment("coredns")
+	SetAllowDestructive(true)
+	defer func() {
+		SetNftBackendFactory(nil)
+		SetElementOwnerComment("")
+		SetAllowDestructive(false)
+	}()
+
+	// 192.0.2.1 is left by a previous instance, 192.0.2.2 is added by an operator and 192.0.2.3 is pinned
+	backend := NewMemoryBackend(ruleset)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "flush_on_start_keep"}
+	set := &nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr}
+	backend.AddTable(table)
+	backend.AddSet(set, nil)
+	backend.SetAddElementsWithUserdata(set, []nftables.SetElement{
+		{Key: net.ParseIP("192.0.2.1").To4()},
+		{Key: net.ParseIP("192.0.2.2").To4()},
+		{Key: net.ParseIP("192.0.2.3").To4()},
+	}, [][]byte{buildOwnerUserdata(), buildRuleComment("operator"), buildOwnerUserdata()})
+	if err := backend.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	handle := NewNftablesHandler()
+	handle.FlushSetOnStart = true
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	_, pin, _ := net.ParseCIDR("192.0.2.3/32")
+	ruleSet.RuleAddElement = []*NftablesSetAddElement{{TableName: "flush_on_start_keep", SetName: "VPN", KeyType: nftables.TypeIPAddr, Pins: []*net.IPNet{pin}}}
+
+	if deleted, err := FlushSetsOnStart(&handle); err != nil || deleted != 1 {
+		t.Fatalf("Expected 1 element flushed, but got %v, %v", deleted, err)
+	}
+	elements, _ := backend.GetSetElements(set)
+	if len(elements) != 2 {
+		t.Fatalf("Expected the elements of the operator and the pinned one kept, but got %v", elements)
+	}
+	for _, element := range elements {
+		if net.IP(element.Key).Equal(net.ParseIP("192.0.2.1")) {
+			t.Errorf("Expected 192.0.2.1 flushed, but got %v", elements)
+		}
+	}
+}
+
+func TestFlushSetsOnStartInterval(t *testing.T) {
+	_, pin, _ := net.ParseCIDR("198.51.100.0/24")
+	_, left, _ := net.ParseCIDR("203.0.113.0/24")
+	configured := nftablesConfiguredSet{family: nftables.TableFamilyIPv4, tableName: "flush_on_start_interval", setName: "VPN", pins: []*net.IPNet{pin}}
+	elements := append(pinElements(left, true), pinElements(pin, true)...)
+
+	deletable := configured.deletableElements(elements, nil)
+	if len(deletable) != 2 || !net.IP(deletable[0].Key).Equal(left.IP) || !deletable[1].IntervalEnd {
+		t.Errorf("Expected only the range of %v flushed, but got %v", left, deletable)
+	}
+}
@@ -0,0 +1,227 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// NftSetResizer is implemented by backends which can tell the size of a set and create it again with a larger
+// one. *nftables.Conn is resized by netlink directly.
+type NftSetResizer interface {
+	// GetSetSize returns the maximum number of elements of set, 0 means it has no size
+	GetSetSize(set *nftables.Set) (uint32, error)
+	// ResizeSet delete set and create it again with size in one transaction, the elements are kept with their
+	// userdata and remaining timeouts
+	ResizeSet(set *nftables.Set, size uint32) error
+}
+
+var _ NftSetResizer = (*MemoryBackend)(nil)
+
+// NftablesFullPolicy decides how the elements are handled when a set with a fixed size is full and the flush
+// fails with ENOSPC
+type NftablesFullPolicy int
+
+const (
+	// The elements are dropped and logged
+	NftablesFullDrop NftablesFullPolicy = iota
+	// The oldest elements added by the plugin are deleted to make room for the new ones
+	NftablesFullEvictOldest
+	// The set is created again with the double size, up to the max size
+	NftablesFullGrow
+)
+
+// defaultFullGrowMaxSize is the max size of sets grown by NftablesFullGrow when it's not set
+const defaultFullGrowMaxSize uint32 = 1048576
+
+var fullPolicy NftablesFullPolicy = NftablesFullDrop
+var fullGrowMaxSize uint32 = defaultFullGrowMaxSize
+
+func parseFullPolicy(name string) (NftablesFullPolicy, error) {
+	switch strings.ToLower(name) {
+	case "drop":
+		return NftablesFullDrop, nil
+	case "evict-oldest":
+		return NftablesFullEvictOldest, nil
+	case "grow":
+		return NftablesFullGrow, nil
+	}
+
+	return NftablesFullDrop, fmt.Errorf("full set policy %v not supported, use drop, evict-oldest or grow", name)
+}
+
+func (policy NftablesFullPolicy) String() string {
+	switch policy {
+	case NftablesFullEvictOldest:
+		return "evict-oldest"
+	case NftablesFullGrow:
+		return "grow"
+	}
+	return "drop"
+}
+
+// SetFullPolicy set how the elements are handled when a set is full, maxSize is the max size of sets grown by
+// NftablesFullGrow and 0 uses the default
+func SetFullPolicy(policy NftablesFullPolicy, maxSize uint32) {
+	fullPolicy = policy
+	if maxSize == 0 {
+		maxSize = defaultFullGrowMaxSize
+	}
+	fullGrowMaxSize = maxSize
+	// only the elements added by the plugin can be evicted
+	setEvictOwnedElements(policy == NftablesFullEvictOldest)
+}
+
+// setResizer returns the resizer of the backend of the connection
+func (cache *NftablesCache) setResizer() (NftSetResizer, bool) {
+	if resizer, ok := cache.NftableConnection.(NftSetResizer); ok {
+		return resizer, true
+	}
+	if _, ok := cache.NftableConnection.(*nftables.Conn); ok {
+		return NewNetlinkBackend(cache.Namespace), true
+	}
+	return nil, false
+}
+
+// recoverFullSets handle the entries failed with ENOSPC by fullPolicy and flush them again separately. The
+// entries are dropped when they are not recoverable, for example they are flushed in one atomic transaction.
+func (batch *NftablesBatch) recoverFullSets(recoverable bool) {
+	for _, entry := range batch.entries {
+		if !errors.Is(entry.err, unix.ENOSPC) {
+			continue
+		}
+		family := getFamilyName(entry.tableCache.table.Family)
+		tableName := entry.tableCache.table.Name
+		log.Warningf("Nftables set %v %v %v is full", family, tableName, entry.set.Name)
+
+		result := "dropped"
+		if recoverable {
+			policy := fullPolicy
+			if policy != NftablesFullDrop {
+				if err := checkDestructive("on-full " + policy.String()); err != nil {
+					log.Warningf("Nftables drop the elements of full set %v %v %v. %v", family, tableName, entry.set.Name, err)
+					policy = NftablesFullDrop
+				}
+			}
+			var err error
+			switch policy {
+			case NftablesFullEvictOldest:
+				err = batch.evictOldest(entry)
+				result = "evicted"
+			case NftablesFullGrow:
+				err = batch.growSet(entry)
+				result = "grown"
+			default:
+				err = entry.err
+			}
+			entry.err = err
+			if err != nil {
+				result = "dropped"
+			}
+		}
+		setFullCount.WithLabelValues(family, tableName, entry.set.Name, result).Inc()
+	}
+}
+
+// evictOldest delete the oldest elements added by the plugin into the set(see ownElement), as many as the elements
+// of entry, and add the elements in the same transaction. The elements already in the set and skipped are never
+// evicted.
+func (batch *NftablesBatch) evictOldest(entry *nftablesBatchEntry) error {
+	namespace := batch.cache.Namespace
+	family := entry.tableCache.table.Family
+	tableName := entry.tableCache.table.Name
+	setName := entry.set.Name
+	adding := make(map[string]bool, len(entry.elements))
+	for _, element := range entry.elements {
+		adding[string(element.element.Key)] = true
+	}
+	var candidates []nftablesOwnedElement
+	for _, element := range getOwnedElements(namespace, family, tableName, setName) {
+		if adding[string(element.key)] || (namespace.IsDefault() && isPinned(family, tableName, setName, element.key)) {
+			continue
+		}
+		candidates = append(candidates, element)
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no element of set %v can be evicted, %w", setName, unix.ENOSPC)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].addTime.Before(candidates[j].addTime)
+	})
+	if len(candidates) > len(entry.elements) {
+		candidates = candidates[:len(entry.elements)]
+	}
+
+	keys := make([]nftables.SetElement, 0, len(candidates))
+	applied := make([]NftablesAppliedElement, 0, len(candidates))
+	for _, element := range candidates {
+		keys = append(keys, nftables.SetElement{Key: element.key})
+		applied = append(applied, element.applied)
+	}
+	err := batch.cache.NftableConnection.SetDeleteElements(entry.set, keys)
+	if err == nil {
+		err = entry.queue(batch.cache)
+	}
+	if err == nil {
+		err = batch.cache.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Nftables evict %v element(s) of full set %v %v %v", len(keys), getFamilyName(family), tableName, setName)
+	WriteAppliedLog("evict", applied)
+	disownElements(namespace, family, tableName, setName, keys)
+	if !namespace.IsDefault() {
+		// the tracker, the existing elements and the LRU only know the default namespace
+		return nil
+	}
+	for _, element := range keys {
+		UntrackElement(family, tableName, setName, element.Key)
+		forgetExistingElement(family, tableName, setName, element.Key)
+		if len(element.Key) == net.IPv4len || len(element.Key) == net.IPv6len {
+			lruRemoveIp(net.IP(element.Key).String())
+		}
+	}
+	return nil
+}
+
+// growSet create the set again with the double size and its elements, then add the elements of entry. The
+// elements kept keep their comments and remaining timeouts. It fails when the set has no size, or it's referenced
+// by rules.
+func (batch *NftablesBatch) growSet(entry *nftablesBatchEntry) error {
+	resizer, ok := batch.cache.setResizer()
+	if !ok {
+		return fmt.Errorf("backend can not resize set %v, %w", entry.set.Name, unix.ENOSPC)
+	}
+	size, err := resizer.GetSetSize(entry.set)
+	if err != nil {
+		return err
+	}
+	grown := size * 2
+	if grown > fullGrowMaxSize || grown < size {
+		grown = fullGrowMaxSize
+	}
+	if size == 0 || grown <= size {
+		return fmt.Errorf("size %v of set %v can not grow, %w", size, entry.set.Name, unix.ENOSPC)
+	}
+	if err := resizer.ResizeSet(entry.set, grown); err != nil {
+		return err
+	}
+
+	log.Infof("Nftables grow full set %v %v %v from %v to %v", getFamilyName(entry.tableCache.table.Family),
+		entry.tableCache.table.Name, entry.set.Name, size, grown)
+	// the set is created again with a new handle
+	delete(entry.tableCache.setHandles, entry.set.Name)
+	batch.cache.captureHandles(entry.tableCache, entry.set.Name)
+	err = entry.queue(batch.cache)
+	if err == nil {
+		err = batch.cache.Flush()
+	}
+	return err
+}
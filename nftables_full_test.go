@@ -0,0 +1,118 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sys/unix"
+)
+
+func TestFullSetPolicy(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	external := NewMemoryBackend(ruleset)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	definition := &nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr}
+	external.AddTable(table)
+	external.AddSet(definition, nil)
+	if err := external.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := external.ResizeSet(definition, 2); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		SetFullPolicy(NftablesFullDrop, 0)
+		EnableElementTracker(false)
+	}()
+
+	cache := &NftablesCache{
+		tables:            make(map[nftables.TableFamily]*map[string]*NftableCache),
+		NftableConnection: NewMemoryBackend(ruleset),
+	}
+	commit := func(ip string) error {
+		batch := NewNftablesBatch(cache)
+		tableCache := cache.MutableNftablesTable(nftables.TableFamilyIPv4, "filter")
+		set := batch.GetSet(tableCache, "VPN")
+		if set == nil {
+			t.Fatalf("Expected set VPN resolved")
+		}
+		answer := newTestBatchAnswer(t, "example.com. 300 IN A "+ip)
+		batch.AddElement(tableCache, set, nftables.SetElement{Key: net.ParseIP(ip).To4()}, NftablesAppliedElement{
+			Family:    nftables.TableFamilyIPv4,
+			TableName: "filter",
+			SetName:   "VPN",
+			Element:   ip,
+		}, answer)
+		batch.Commit()
+		_, err := batch.AnswerResult(answer)
+		return err
+	}
+	contains := func(ip string) bool {
+		elements, _ := external.GetSetElements(definition)
+		for _, element := range elements {
+			if net.IP(element.Key).Equal(net.ParseIP(ip)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	SetAllowDestructive(true)
+	defer SetAllowDestructive(false)
+	SetFullPolicy(NftablesFullEvictOldest, 0)
+	// the element added by an operator is never evicted
+	external.SetAddElementsWithUserdata(definition, []nftables.SetElement{{Key: net.ParseIP("198.51.100.1").To4()}}, [][]byte{buildRuleComment("operator")})
+	if err := external.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := external.ResizeSet(definition, 3); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if err := commit(ip); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	evicted := testutil.ToFloat64(setFullCount.WithLabelValues("ipv4", "filter", "VPN", "evicted"))
+	if err := commit("192.0.2.3"); err != nil {
+		t.Fatalf("Expected the oldest element evicted, but got %v", err)
+	}
+	if contains("192.0.2.1") || !contains("192.0.2.2") || !contains("192.0.2.3") || !contains("198.51.100.1") {
+		t.Errorf("Expected 192.0.2.1 evicted and the element of the operator kept")
+	}
+	if testutil.ToFloat64(setFullCount.WithLabelValues("ipv4", "filter", "VPN", "evicted"))-evicted != 1 {
+		t.Errorf("Expected the full set counted as evicted")
+	}
+
+	SetFullPolicy(NftablesFullDrop, 0)
+	dropped := testutil.ToFloat64(setFullCount.WithLabelValues("ipv4", "filter", "VPN", "dropped"))
+	if err := commit("192.0.2.4"); !errors.Is(err, unix.ENOSPC) {
+		t.Errorf("Expected ENOSPC, but got %v", err)
+	}
+	if testutil.ToFloat64(setFullCount.WithLabelValues("ipv4", "filter", "VPN", "dropped"))-dropped != 1 || cache.HasNftableConnectionError {
+		t.Errorf("Expected the full set counted as dropped and the connection kept")
+	}
+
+	SetFullPolicy(NftablesFullGrow, 4)
+	if err := commit("192.0.2.4"); err != nil {
+		t.Fatalf("Expected the set grown, but got %v", err)
+	}
+	if size, _ := external.GetSetSize(definition); size != 4 {
+		t.Errorf("Expected the size grown to the max size 4, but got %v", size)
+	}
+	if !contains("192.0.2.2") || !contains("192.0.2.3") || !contains("192.0.2.4") {
+		t.Errorf("Expected the elements kept in the grown set")
+	}
+	if userdata, _ := external.GetElementUserdata(definition, net.ParseIP("198.51.100.1").To4()); !bytes.Equal(userdata, buildRuleComment("operator")) {
+		t.Errorf("Expected the comment of the element kept in the grown set, but got %q", userdata)
+	}
+	if err := commit("192.0.2.5"); !errors.Is(err, unix.ENOSPC) {
+		t.Errorf("Expected ENOSPC when the max size is reached, but got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package coredns_nftables
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+// NftablesRuleGroup routes answers matched by Matcher to its own rules, only the first matched active group of a
+// handler is applied to each answer
+type NftablesRuleGroup struct {
+	Name    string
+	Matcher *NftablesDomainMatcher
+	Except  *NftablesDomainMatcher
+	Rules   map[nftables.TableFamily]*NftablesRuleSet
+	// Enabled by Corefile, the group is only active in Schedules if there is any
+	Enabled   bool
+	Schedules []NftablesSchedule
+	active    int32
+}
+
+func NewNftablesRuleGroup(name string) *NftablesRuleGroup {
+	return &NftablesRuleGroup{
+		Name:    name,
+		Matcher: NewNftablesDomainMatcher(),
+		Rules:   make(map[nftables.TableFamily]*NftablesRuleSet),
+		Enabled: true,
+		active:  groupActiveState,
+	}
+}
+
+// initActive set the active state of a group parsed from Corefile before it's served
+func (g *NftablesRuleGroup) initActive() {
+	groupToggleLock.Lock()
+	defer groupToggleLock.Unlock()
+
+	g.refresh(time.Now())
+}
+
+func (g *NftablesRuleGroup) MutableRuleSet(family nftables.TableFamily) *NftablesRuleSet {
+	ret, ok := g.Rules[family]
+	if !ok {
+		ret = &NftablesRuleSet{}
+		g.Rules[family] = ret
+	}
+	return ret
+}
+
+func (g *NftablesRuleGroup) MatchName(names ...string) bool {
+	return g.Matcher.MatchAny(names) && (g.Except == nil || !g.Except.MatchAny(names))
+}
+
+// ServeDNS apply the rules of group for each family, it returns true if any rule failed
+func (g *NftablesRuleGroup) ServeDNS(ctx context.Context, batch *NftablesBatch, answer *dns.RR, families []nftables.TableFamily) bool {
+	hasError := false
+	for _, family := range families {
+		ruleSet, ok := g.Rules[family]
+		if !ok {
+			continue
+		}
+		for _, rule := range ruleSet.RuleAddElement {
+			if !rule.MatchName(batch.AnswerNames(answer)...) {
+				continue
+			}
+			err, _ := rule.ServeDNS(ctx, batch, answer, family)
+			if err != nil {
+				hasError = true
+				logAddElementError(batch.Cache(), answer, family, rule, err)
+			}
+		}
+	}
+
+	return hasError
+}
+
+// countSuppressed count the rules of group in families which would apply names if it's not out of its schedules
+func (g *NftablesRuleGroup) countSuppressed(names []string, families []nftables.TableFamily) {
+	for _, family := range families {
+		ruleSet, ok := g.Rules[family]
+		if !ok {
+			continue
+		}
+		for _, rule := range ruleSet.RuleAddElement {
+			if rule.MatchName(names...) {
+				scheduleSuppressedCount.WithLabelValues(getFamilyName(family), rule.TableName, rule.SetName).Inc()
+			}
+		}
+	}
+}
+
+// matchGroup returns the first active group matching any of names, or nil
+func (m *NftablesHandler) matchGroup(names []string, families []nftables.TableFamily) *NftablesRuleGroup {
+	for _, group := range m.Groups {
+		if !group.MatchName(names...) {
+			continue
+		}
+		if group.Active() {
+			return group
+		}
+		if group.Suppressed() {
+			group.countSuppressed(names, families)
+		}
+	}
+	return nil
+}
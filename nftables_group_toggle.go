@@ -0,0 +1,221 @@
+package coredns_nftables
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var groupSchedulerInterval time.Duration = 10 * time.Second
+var groupToggleLock sync.Mutex = sync.Mutex{}
+var groupSchedulerRefs int = 0
+var groupSchedulerStop chan struct{} = nil
+
+// groupOverrides are set by the admin API by group name, they are kept when reloading
+var groupOverrides = make(map[string]bool)
+
+const (
+	groupInactive int32 = iota
+	groupActiveState
+	// enabled by Corefile but out of its schedules
+	groupSuppressed
+)
+
+// Scheduled returns if group is enabled by Corefile and now is in any of its schedules, ignoring the admin API
+func (g *NftablesRuleGroup) Scheduled(now time.Time) bool {
+	return g.Enabled && inSchedules(g.Schedules, now)
+}
+
+// Active returns the state refreshed by the group scheduler, it's cheap enough to be called for each answer
+func (g *NftablesRuleGroup) Active() bool {
+	return atomic.LoadInt32(&g.active) == groupActiveState
+}
+
+// Suppressed returns true if the group is only inactive because of its schedules
+func (g *NftablesRuleGroup) Suppressed() bool {
+	return atomic.LoadInt32(&g.active) == groupSuppressed
+}
+
+// refresh update the active state of group by the admin API override or the schedules, it returns true if changed
+func (g *NftablesRuleGroup) refresh(now time.Time) bool {
+	value := groupInactive
+	if active, ok := groupOverrides[g.Name]; ok {
+		if active {
+			value = groupActiveState
+		}
+	} else if g.Scheduled(now) {
+		value = groupActiveState
+	} else if g.Enabled {
+		value = groupSuppressed
+	}
+
+	if value == groupActiveState {
+		groupActive.WithLabelValues(g.Name).Set(1)
+	} else {
+		groupActive.WithLabelValues(g.Name).Set(0)
+	}
+	old := atomic.SwapInt32(&g.active, value)
+	return (old == groupActiveState) != (value == groupActiveState)
+}
+
+// RefreshGroups update the active state of groups of all running handlers and log the groups toggled
+func RefreshGroups() {
+	groupToggleLock.Lock()
+	defer groupToggleLock.Unlock()
+
+	now := time.Now()
+	for _, group := range getRunningGroups() {
+		if group.refresh(now) {
+			log.Infof("Nftables group %v is %v", group.Name, map[bool]string{true: "activated", false: "deactivated"}[group.Active()])
+		}
+	}
+}
+
+// SetGroupOverride force the groups named name active or inactive, nil restores the Corefile flag and schedules.
+// It returns false if there is no such group.
+func SetGroupOverride(name string, active *bool) bool {
+	found := false
+	for _, group := range getRunningGroups() {
+		if group.Name == name {
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+
+	groupToggleLock.Lock()
+	if active == nil {
+		delete(groupOverrides, name)
+	} else {
+		groupOverrides[name] = *active
+	}
+	groupToggleLock.Unlock()
+
+	RefreshGroups()
+	return true
+}
+
+// StartGroupScheduler refresh the groups when the first handler starts, and start refreshing them periodically
+// when any group has schedules
+func StartGroupScheduler() {
+	RefreshGroups()
+
+	groupToggleLock.Lock()
+	defer groupToggleLock.Unlock()
+
+	groupSchedulerRefs += 1
+	if groupSchedulerStop != nil {
+		return
+	}
+	scheduled := false
+	for _, group := range getRunningGroups() {
+		if len(group.Schedules) > 0 {
+			scheduled = true
+		}
+	}
+	if !scheduled {
+		return
+	}
+
+	groupSchedulerStop = make(chan struct{})
+	go func(stop chan struct{}, interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				RefreshGroups()
+			}
+		}
+	}(groupSchedulerStop, groupSchedulerInterval)
+}
+
+// StopGroupScheduler stop refreshing the groups when the last handler stops
+func StopGroupScheduler() {
+	groupToggleLock.Lock()
+	defer groupToggleLock.Unlock()
+
+	if groupSchedulerRefs > 0 {
+		groupSchedulerRefs -= 1
+	}
+	if groupSchedulerRefs == 0 && groupSchedulerStop != nil {
+		close(groupSchedulerStop)
+		groupSchedulerStop = nil
+	}
+}
+
+type NftablesGroupStatus struct {
+	Name      string   `json:"name"`
+	Active    bool     `json:"active"`
+	Enabled   bool     `json:"enabled"`
+	Schedules []string `json:"schedules"`
+	// true or false if it's set by the admin API
+	Override *bool `json:"override,omitempty"`
+}
+
+// GetGroupStatus returns the state of groups of all running handlers
+func GetGroupStatus() []NftablesGroupStatus {
+	groupToggleLock.Lock()
+	defer groupToggleLock.Unlock()
+
+	ret := []NftablesGroupStatus{}
+	for _, group := range getRunningGroups() {
+		status := NftablesGroupStatus{
+			Name:      group.Name,
+			Active:    group.Active(),
+			Enabled:   group.Enabled,
+			Schedules: []string{},
+		}
+		for i := range group.Schedules {
+			status.Schedules = append(status.Schedules, group.Schedules[i].String())
+		}
+		if active, ok := groupOverrides[group.Name]; ok {
+			status.Override = &active
+		}
+		ret = append(ret, status)
+	}
+	return ret
+}
+
+func init() {
+	registerAdminHandler("/groups", serveAdminGroups)
+}
+
+// serveAdminGroups list the groups by GET, and toggle a group by POST /groups?name=<NAME>&active=<true/false/auto>
+func serveAdminGroups(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(GetGroupStatus())
+	case http.MethodPost:
+		name := r.URL.Query().Get("name")
+		value := r.URL.Query().Get("active")
+		var active *bool = nil
+		if value != "auto" {
+			parsed, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("active %v invalid, expect true, false or auto", value), http.StatusBadRequest)
+				return
+			}
+			active = &parsed
+		}
+		if !SetGroupOverride(name, active) {
+			http.Error(w, fmt.Sprintf("group %v not found", name), http.StatusNotFound)
+			return
+		}
+
+		log.Infof("Nftables group %v is set to %v by admin API", name, value)
+		json.NewEncoder(w).Encode(GetGroupStatus())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,32 @@
+package coredns_nftables
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupToggle(t *testing.T) {
+	group := NewNftablesRuleGroup("toggle-test")
+	group.Schedules = append(group.Schedules, NftablesSchedule{Start: 8 * 60, End: 16 * 60})
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	night := time.Date(2024, 1, 1, 20, 0, 0, 0, time.Local)
+
+	if group.refresh(noon) || !group.Active() {
+		t.Errorf("Expected group is active in its schedule")
+	}
+	if !group.refresh(night) || group.Active() {
+		t.Errorf("Expected group is deactivated out of its schedule")
+	}
+
+	groupOverrides[group.Name] = true
+	defer delete(groupOverrides, group.Name)
+	if !group.refresh(night) || !group.Active() {
+		t.Errorf("Expected group is forced active by the override")
+	}
+
+	group.Enabled = false
+	delete(groupOverrides, group.Name)
+	if !group.refresh(noon) || group.Active() {
+		t.Errorf("Expected disabled group is never active")
+	}
+}
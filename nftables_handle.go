@@ -0,0 +1,266 @@
+package coredns_nftables
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Attributes of the kernel missing in golang.org/x/sys/unix
+const (
+	nftaTableHandle = 0x4
+	nftaSetHandle   = 0x10
+)
+
+var errHandleUnsupported = errors.New("backend has no handles")
+
+var handleLock sync.Mutex = sync.Mutex{}
+
+// The latest handles seen of tables and sets, by handleKey
+var handleRegistry = make(map[string]uint64)
+
+// handleGeneration is increased when a table or set is found recreated, so the idle connections forget the
+// definitions they cached
+var handleGeneration uint64 = 0
+
+// NftHandleResolver is implemented by backends which can tell the handle assigned to a table or set, the handle
+// changes when the table or set is deleted and created again by other tools. *nftables.Conn is resolved by
+// netlink directly. It returns 0 and no error when the table or set does not exist, and the set handle is returned
+// when setName is not empty.
+type NftHandleResolver interface {
+	GetHandle(family nftables.TableFamily, tableName string, setName string) (uint64, error)
+}
+
+func handleKey(family nftables.TableFamily, tableName string, setName string) string {
+	if len(setName) == 0 {
+		return fmt.Sprintf("%v %v", getFamilyName(family), tableName)
+	}
+	return trackedSetKey(family, tableName, setName)
+}
+
+// resolveHandle returns the handle of a table or set by its name through the backend of the connection
+func (cache *NftablesCache) resolveHandle(family nftables.TableFamily, tableName string, setName string) (uint64, error) {
+	if resolver, ok := cache.NftableConnection.(NftHandleResolver); ok {
+		return resolver.GetHandle(family, tableName, setName)
+	}
+	if _, ok := cache.NftableConnection.(*nftables.Conn); ok {
+		return getKernelHandle(cache.Namespace, family, tableName, setName)
+	}
+	return 0, errHandleUnsupported
+}
+
+// registryKey returns the key of handleRegistry, tables of different network namespaces never share handles
+func (cache *NftablesCache) registryKey(family nftables.TableFamily, tableName string, setName string) string {
+	if cache.Namespace.IsDefault() {
+		return handleKey(family, tableName, setName)
+	}
+	return fmt.Sprintf("%v/%v", cache.Namespace, handleKey(family, tableName, setName))
+}
+
+// getKernelHandle ask the kernel for one table or set with an acknowledgment, the reply is the same message the
+// kernel echoes when the object is created, which carries the handle. google/nftables does not return the echo
+// of NEWTABLE and NEWSET, so the handles are read back this way after they are created.
+func getKernelHandle(ns NftablesNetworkNamespace, family nftables.TableFamily, tableName string, setName string) (uint64, error) {
+	conn, err := dialNetfilterIn(ns, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	messageType := unix.NFT_MSG_GETTABLE
+	replyType := unix.NFT_MSG_NEWTABLE
+	var handleType uint16 = nftaTableHandle
+	request := []netlink.Attribute{{Type: unix.NFTA_TABLE_NAME, Data: []byte(tableName + "\x00")}}
+	if len(setName) > 0 {
+		messageType = unix.NFT_MSG_GETSET
+		replyType = unix.NFT_MSG_NEWSET
+		handleType = nftaSetHandle
+		request = []netlink.Attribute{
+			{Type: unix.NFTA_SET_TABLE, Data: []byte(tableName + "\x00")},
+			{Type: unix.NFTA_SET_NAME, Data: []byte(setName + "\x00")},
+		}
+	}
+	attributes, err := netlink.MarshalAttributes(request)
+	if err != nil {
+		return 0, err
+	}
+
+	messages, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | messageType),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append([]byte{byte(family), unix.NFNETLINK_V0, 0, 0}, attributes...),
+	})
+	if errors.Is(err, unix.ENOENT) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, message := range messages {
+		if message.Header.Type != netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8|replyType) || len(message.Data) < 4 {
+			continue
+		}
+		decoder, err := netlink.NewAttributeDecoder(message.Data[4:])
+		if err != nil {
+			return 0, err
+		}
+		decoder.ByteOrder = binary.BigEndian
+		for decoder.Next() {
+			if decoder.Type() == handleType {
+				return decoder.Uint64(), nil
+			}
+		}
+		if err := decoder.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("no handle in the reply of %v", handleKey(family, tableName, setName))
+}
+
+// recordHandle remember the handle seen of key, it returns true if another handle was seen before, which means the
+// table or set was recreated
+func recordHandle(key string, handle uint64) bool {
+	handleLock.Lock()
+	defer handleLock.Unlock()
+
+	old, ok := handleRegistry[key]
+	if handle == 0 {
+		delete(handleRegistry, key)
+	} else {
+		handleRegistry[key] = handle
+	}
+	if !ok || old == handle {
+		return false
+	}
+	handleGeneration += 1
+	staleHandleCount.Inc()
+	log.Warningf("Nftables %v is deleted or recreated by other tools, handle %v is replaced by %v", key, old, handle)
+	return true
+}
+
+func getHandleGeneration() uint64 {
+	handleLock.Lock()
+	defer handleLock.Unlock()
+
+	return handleGeneration
+}
+
+// captureHandles record the handles of the table and set of the connection after they are created or resolved,
+// backends without handles are ignored
+func (cache *NftablesCache) captureHandles(tableCache *NftableCache, setName string) {
+	family := tableCache.table.Family
+	if tableCache.handle == 0 {
+		handle, err := cache.resolveHandle(family, tableCache.table.Name, "")
+		if err != nil {
+			if err != errHandleUnsupported {
+				log.Debugf("Nftables get handle of table %v %v failed. %v", getFamilyName(family), tableCache.table.Name, err)
+			}
+			return
+		}
+		tableCache.handle = handle
+		recordHandle(cache.registryKey(family, tableCache.table.Name, ""), handle)
+	}
+
+	if _, ok := tableCache.setHandles[setName]; ok || len(setName) == 0 {
+		return
+	}
+	if tableCache.setHandles == nil {
+		tableCache.setHandles = make(map[string]uint64)
+	}
+	handle, err := cache.resolveHandle(family, tableCache.table.Name, setName)
+	if err != nil {
+		log.Debugf("Nftables get handle of set %v %v %v failed. %v", getFamilyName(family), tableCache.table.Name, setName, err)
+		return
+	}
+	tableCache.setHandles[setName] = handle
+	recordHandle(cache.registryKey(family, tableCache.table.Name, setName), handle)
+}
+
+// refreshStaleTable compare the handle of the table with the kernel, if it's recreated or deleted by other tools,
+// the sets cached are forgotten and the table is created again by the next flush when it's missing
+func (cache *NftablesCache) refreshStaleTable(tableCache *NftableCache) bool {
+	if tableCache.pending || tableCache.handle == 0 {
+		return false
+	}
+
+	family := tableCache.table.Family
+	handle, err := cache.resolveHandle(family, tableCache.table.Name, "")
+	if err != nil || handle == tableCache.handle {
+		return false
+	}
+	recordHandle(cache.registryKey(family, tableCache.table.Name, ""), handle)
+
+	tableCache.handle = handle
+	tableCache.pending = handle == 0
+	tableCache.setCache = make(map[string]*nftables.Set)
+	tableCache.setHandles = make(map[string]uint64)
+	return true
+}
+
+// refreshStaleSet compare the handle of the set with the kernel, if it's recreated or deleted by other tools, its
+// definition is resolved again by name
+func (cache *NftablesCache) refreshStaleSet(tableCache *NftableCache, setName string) bool {
+	cached, ok := tableCache.setHandles[setName]
+	if !ok || cached == 0 {
+		return false
+	}
+
+	family := tableCache.table.Family
+	handle, err := cache.resolveHandle(family, tableCache.table.Name, setName)
+	if err != nil || handle == cached {
+		return false
+	}
+	recordHandle(cache.registryKey(family, tableCache.table.Name, setName), handle)
+
+	delete(tableCache.setCache, setName)
+	delete(tableCache.setHandles, setName)
+	return true
+}
+
+// recoverStaleHandles check the handles of the tables and sets of a failed batch, the ones recreated by other tools
+// are resolved again by name, so the batch can be flushed again instead of failing until the connection is
+// recycled. It returns true if any of them is stale.
+func (batch *NftablesBatch) recoverStaleHandles() bool {
+	stale := false
+	tables := make(map[*NftableCache]bool)
+	for _, entry := range batch.entries {
+		if _, ok := tables[entry.tableCache]; !ok {
+			tables[entry.tableCache] = batch.cache.refreshStaleTable(entry.tableCache)
+			stale = stale || tables[entry.tableCache]
+		}
+	}
+
+	for _, entry := range batch.entries {
+		// the sets of a recreated table are all resolved again
+		if entry.create || (!tables[entry.tableCache] && !batch.cache.refreshStaleSet(entry.tableCache, entry.set.Name)) {
+			continue
+		}
+		stale = true
+		if set := batch.cache.GetSetDefinition(entry.tableCache, entry.set.Name); set != nil {
+			entry.set = set
+		}
+	}
+
+	if stale {
+		log.Infof("Nftables stale handles found after flush failed, flush again with the definitions resolved by name")
+	}
+	return stale
+}
+
+// forgetStaleTables drop the tables and sets cached before another connection found them recreated
+func (cache *NftablesCache) forgetStaleTables() {
+	generation := getHandleGeneration()
+	if cache.handleGeneration == generation {
+		return
+	}
+	cache.handleGeneration = generation
+	cache.tables = make(map[nftables.TableFamily]*map[string]*NftableCache)
+}
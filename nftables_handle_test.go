@@ -0,0 +1,116 @@
+package coredns_nftables
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStaleHandleRecovery(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	external := NewMemoryBackend(ruleset)
+	table := external.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"})
+	external.AddSet(&nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr, HasTimeout: true, Timeout: time.Hour}, nil)
+	if err := external.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := &NftablesCache{
+		tables:            make(map[nftables.TableFamily]*map[string]*NftableCache),
+		NftableConnection: NewMemoryBackend(ruleset),
+	}
+	idle := &NftablesCache{
+		tables:            make(map[nftables.TableFamily]*map[string]*NftableCache),
+		NftableConnection: NewMemoryBackend(ruleset),
+		handleGeneration:  getHandleGeneration(),
+	}
+	stage := func(batch *NftablesBatch, ip string) *NftablesBatch {
+		tableCache := batch.Cache().MutableNftablesTable(nftables.TableFamilyIPv4, "filter")
+		set := batch.GetSet(tableCache, "VPN")
+		if set == nil {
+			t.Fatalf("Expected set VPN resolved")
+		}
+		batch.AddElement(tableCache, set, nftables.SetElement{Key: net.ParseIP(ip).To4(), Timeout: time.Minute}, NftablesAppliedElement{
+			Family:    nftables.TableFamilyIPv4,
+			TableName: "filter",
+			SetName:   "VPN",
+			Element:   ip,
+		}, newTestBatchAnswer(t, "example.com. 300 IN A "+ip))
+		return batch
+	}
+
+	stage(NewNftablesBatch(cache), "192.0.2.1").Commit()
+	stage(NewNftablesBatch(idle), "192.0.2.1").Commit()
+	tableCache := cache.MutableNftablesTable(nftables.TableFamilyIPv4, "filter")
+	if tableCache.handle == 0 || tableCache.setHandles["VPN"] == 0 {
+		t.Fatalf("Expected handles of table and set captured, but got %v %v", tableCache.handle, tableCache.setHandles)
+	}
+
+	// another tool recreates the set without the timeout flag, the definition cached by the connection is stale
+	external.DelSet(&nftables.Set{Table: table, Name: "VPN"})
+	external.AddSet(&nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr}, nil)
+	if err := external.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	staleBefore := testutil.ToFloat64(staleHandleCount)
+	generation := getHandleGeneration()
+	batch := stage(NewNftablesBatch(cache), "192.0.2.2")
+	batch.Commit()
+	for answer := range batch.answerApplied {
+		if _, err := batch.AnswerResult(answer); err != nil {
+			t.Fatalf("Expected element added after the set is resolved again, but got %v", err)
+		}
+	}
+	if cache.HasNftableConnectionError {
+		t.Errorf("Expected connection kept after stale handles recovered")
+	}
+	if testutil.ToFloat64(staleHandleCount) != staleBefore+1 || getHandleGeneration() == generation {
+		t.Errorf("Expected stale handle counted and generation increased")
+	}
+	if set := tableCache.setCache["VPN"]; set == nil || set.HasTimeout {
+		t.Errorf("Expected definition of the recreated set cached, but got %+v", set)
+	}
+	elements, _ := external.GetSetElements(&nftables.Set{Table: table, Name: "VPN"})
+	if len(elements) != 1 {
+		t.Errorf("Expected 1 element in the recreated set, but got %v", elements)
+	}
+
+	// the idle connection forgets its stale definitions when it's selected from the pool
+	idle.gc()
+	if idle.handleGeneration != getHandleGeneration() || len(idle.tables) != 0 {
+		t.Errorf("Expected tables of idle connection forgotten, but got %v", idle.tables)
+	}
+	stage(NewNftablesBatch(idle), "192.0.2.3").Commit()
+	if idle.HasNftableConnectionError {
+		t.Errorf("Expected idle connection add elements to the recreated set")
+	}
+}
+
+func TestMemoryBackendHandles(t *testing.T) {
+	backend := NewMemoryBackend(NewMemoryRuleset())
+	table := backend.AddTable(&nftables.Table{Family: nftables.TableFamilyINet, Name: "filter"})
+	backend.AddSet(&nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr}, nil)
+	backend.Flush()
+
+	tableHandle, _ := backend.GetHandle(nftables.TableFamilyINet, "filter", "")
+	setHandle, _ := backend.GetHandle(nftables.TableFamilyINet, "filter", "VPN")
+	if tableHandle == 0 || setHandle == 0 || tableHandle == setHandle {
+		t.Fatalf("Expected different handles of table and set, but got %v %v", tableHandle, setHandle)
+	}
+
+	backend.DelTable(table)
+	backend.Flush()
+	if handle, _ := backend.GetHandle(nftables.TableFamilyINet, "filter", "VPN"); handle != 0 {
+		t.Errorf("Expected set deleted with its table, but got handle %v", handle)
+	}
+
+	backend.AddTable(table)
+	backend.Flush()
+	if handle, _ := backend.GetHandle(nftables.TableFamilyINet, "filter", ""); handle == 0 || handle == tableHandle {
+		t.Errorf("Expected new handle of recreated table, but got %v", handle)
+	}
+}
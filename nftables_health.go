@@ -0,0 +1,88 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/ready"
+)
+
+var healthLock sync.Mutex = sync.Mutex{}
+
+// Responses failing to apply for this long make the plugin unhealthy, 0 disables the check
+var healthUnhealthyAfter time.Duration = 0
+
+// The first failure since the last applied element, zero if the last update is applied
+var healthFailingSince time.Time = time.Time{}
+
+// SetHealthUnhealthyAfter report unhealthy by GET /health of the admin API when no element is applied while
+// updates of matching answers keep failing for timeout, 0 always reports healthy
+func SetHealthUnhealthyAfter(timeout time.Duration) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	healthUnhealthyAfter = timeout
+}
+
+// recordHealthFailure record that the elements of a matching answer are not applied
+func recordHealthFailure() {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	if healthFailingSince.IsZero() {
+		healthFailingSince = time.Now()
+	}
+}
+
+// recordHealthApplied record that elements are applied, which makes the plugin healthy again
+func recordHealthApplied() {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	if !healthFailingSince.IsZero() && healthUnhealthyAfter > 0 && time.Since(healthFailingSince) >= healthUnhealthyAfter {
+		log.Infof("Nftables is healthy again, elements are applied after failing since %v", healthFailingSince.Format(time.RFC3339))
+	}
+	healthFailingSince = time.Time{}
+}
+
+// Healthy returns false with the time of the first failure when no element is applied for the timeout of
+// SetHealthUnhealthyAfter while updates keep failing
+func Healthy() (bool, time.Time) {
+	healthLock.Lock()
+	defer healthLock.Unlock()
+
+	if healthUnhealthyAfter <= 0 || healthFailingSince.IsZero() || time.Since(healthFailingSince) < healthUnhealthyAfter {
+		return true, time.Time{}
+	}
+	return false, healthFailingSince
+}
+
+var _ ready.Readiness = (*NftablesHandler)(nil)
+
+// Ready implements ready.Readiness, so `/ready` of the ready plugin fails while the plugin is unhealthy, see Healthy
+func (m *NftablesHandler) Ready() bool {
+	healthy, _ := Healthy()
+	return healthy
+}
+
+func init() {
+	registerAdminHandler("/health", serveAdminHealth)
+}
+
+// serveAdminHealth answers GET /health with 200 like the health plugin, or 503 when the plugin is unhealthy
+func serveAdminHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	healthy, failingSince := Healthy()
+	if !healthy {
+		http.Error(w, fmt.Sprintf("no element applied since %v", failingSince.Format(time.RFC3339)), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, http.StatusText(http.StatusOK))
+}
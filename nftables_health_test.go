@@ -0,0 +1,80 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestHealthUnhealthyAfter(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	failed := true
+	SetNftBackendFactory(func() (NftBackend, error) {
+		if failed {
+			return nil, errors.New("netlink unavailable")
+		}
+		return NewMemoryBackend(ruleset), nil
+	})
+	ClearCache()
+	SetHealthUnhealthyAfter(time.Minute)
+	recordHealthApplied()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+		SetHealthUnhealthyAfter(0)
+		recordHealthApplied()
+	}()
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_health", SetName: "HEALTH", KeyType: nftables.TypeInvalid})
+	status := func() int {
+		recorder := httptest.NewRecorder()
+		serveAdminHealth(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+		return recorder.Code
+	}
+
+	handle.ServeWorker(context.Background(), newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.170"))
+	if code := status(); code != http.StatusOK {
+		t.Errorf("Expected healthy before the timeout, but got %v", code)
+	}
+
+	// failures since a minute ago make it unhealthy
+	healthLock.Lock()
+	healthFailingSince = healthFailingSince.Add(-time.Minute)
+	healthLock.Unlock()
+	handle.ServeWorker(context.Background(), newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.170"))
+	if code := status(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected unhealthy after failing for the timeout, but got %v", code)
+	}
+	if handle.Ready() {
+		t.Errorf("Expected not ready while unhealthy")
+	}
+
+	failed = false
+	ClearCache()
+	if applied, err := handle.ServeWorker(context.Background(), newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.170")); applied != 1 || err != nil {
+		t.Fatalf("Expected the element applied, but got %v, %v", applied, err)
+	}
+	if code := status(); code != http.StatusOK {
+		t.Errorf("Expected healthy again after elements are applied, but got %v", code)
+	}
+	if !handle.Ready() {
+		t.Errorf("Expected ready again after elements are applied")
+	}
+
+	SetHealthUnhealthyAfter(0)
+	recordHealthFailure()
+	healthLock.Lock()
+	healthFailingSince = healthFailingSince.Add(-time.Hour)
+	healthLock.Unlock()
+	if code := status(); code != http.StatusOK {
+		t.Errorf("Expected always healthy without the check, but got %v", code)
+	}
+}
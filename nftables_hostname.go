@@ -0,0 +1,157 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var hostnameFileLock sync.Mutex = sync.Mutex{}
+var hostnameFilePath string = ""
+var hostnameFileInterval time.Duration = time.Second
+var hostnameFileRefs int = 0
+var hostnameFileStop chan struct{} = nil
+var hostnameFileDirty bool = false
+
+// ip -> hostname -> expire time
+var hostnameEntries = make(map[string]map[string]time.Time)
+
+// SetHostnameFile set the file of (ip, hostname) pairs for SNI-inspecting components, empty path disables it
+func SetHostnameFile(path string, interval time.Duration) {
+	hostnameFileLock.Lock()
+	defer hostnameFileLock.Unlock()
+
+	hostnameFilePath = path
+	if interval > 0 {
+		hostnameFileInterval = interval
+	} else {
+		hostnameFileInterval = time.Second
+	}
+	if len(path) == 0 {
+		hostnameEntries = make(map[string]map[string]time.Time)
+	}
+}
+
+// RecordHostname remember the name behind an element added into a set until the element expires
+func RecordHostname(applied NftablesAppliedElement, ttl time.Duration) {
+	hostnameFileLock.Lock()
+	defer hostnameFileLock.Unlock()
+
+	if len(hostnameFilePath) == 0 {
+		return
+	}
+
+	// the pairs are consumed by ip, `ip . proto . port` elements are written by their address
+	address := strings.SplitN(applied.Element, " ", 2)[0]
+	timeout := applied.Timeout
+	if timeout <= 0 {
+		timeout = ttl
+	}
+	expire := time.Now().Add(timeout)
+	name := strings.TrimSuffix(applied.Name, ".")
+
+	names, ok := hostnameEntries[address]
+	if !ok {
+		names = make(map[string]time.Time)
+		hostnameEntries[address] = names
+	}
+	if old, ok := names[name]; !ok || old.Before(expire) {
+		names[name] = expire
+		hostnameFileDirty = true
+	}
+}
+
+// StartHostnameFile start writing the hostname file when the first handler starts
+func StartHostnameFile() {
+	hostnameFileLock.Lock()
+	defer hostnameFileLock.Unlock()
+
+	hostnameFileRefs += 1
+	if hostnameFileStop != nil || len(hostnameFilePath) == 0 {
+		return
+	}
+
+	hostnameFileStop = make(chan struct{})
+	go func(stop chan struct{}, interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := WriteHostnameFile(); err != nil {
+					log.Errorf("Nftables write hostname file failed. %v", err)
+				}
+			}
+		}
+	}(hostnameFileStop, hostnameFileInterval)
+}
+
+// StopHostnameFile stop writing the hostname file when the last handler stops
+func StopHostnameFile() {
+	hostnameFileLock.Lock()
+	defer hostnameFileLock.Unlock()
+
+	if hostnameFileRefs > 0 {
+		hostnameFileRefs -= 1
+	}
+	if hostnameFileRefs == 0 && hostnameFileStop != nil {
+		close(hostnameFileStop)
+		hostnameFileStop = nil
+	}
+}
+
+// WriteHostnameFile replace the hostname file when any pair is added or expired, one line for each pair:
+// <ip> <hostname> <RFC3339 expire time>
+func WriteHostnameFile() error {
+	hostnameFileLock.Lock()
+	path := hostnameFilePath
+	now := time.Now()
+	var lines []string
+	for ip, names := range hostnameEntries {
+		for name, expire := range names {
+			if !expire.After(now) {
+				delete(names, name)
+				hostnameFileDirty = true
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s %s %s\n", ip, name, expire.Format(time.RFC3339)))
+		}
+		if len(names) == 0 {
+			delete(hostnameEntries, ip)
+		}
+	}
+	dirty := hostnameFileDirty
+	hostnameFileDirty = false
+	hostnameFileLock.Unlock()
+
+	if len(path) == 0 || !dirty {
+		return nil
+	}
+
+	sort.Strings(lines)
+	// write into a temporary file and rename it, so that readers never see a partial file
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(strings.Join(lines, ""))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
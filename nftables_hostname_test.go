@@ -0,0 +1,32 @@
+package coredns_nftables
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostnameFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hostname.txt")
+	SetHostnameFile(path, 0)
+	defer SetHostnameFile("", 0)
+
+	RecordHostname(NftablesAppliedElement{Element: "192.0.2.1", Name: "example.org.", Timeout: time.Hour}, 0)
+	RecordHostname(NftablesAppliedElement{Element: "192.0.2.1", Name: "cdn.example.org."}, time.Minute)
+	RecordHostname(NftablesAppliedElement{Element: "192.0.2.2", Name: "expired.example.org."}, 0)
+
+	if err := WriteHostnameFile(); err != nil {
+		t.Fatalf("WriteHostnameFile failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "192.0.2.1 cdn.example.org ") || !strings.HasPrefix(lines[1], "192.0.2.1 example.org ") {
+		t.Fatalf("Unexpected hostname file content: %q", string(data))
+	}
+}
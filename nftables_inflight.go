@@ -0,0 +1,102 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+var inflightAddsLock sync.Mutex = sync.Mutex{}
+var inflightAdds = make(map[string]*nftablesInflightAdd)
+
+// nftablesInflightAdd is an element being added by the flush of one batch, batches adding the same element at the
+// same time wait for its result instead of sending it again
+type nftablesInflightAdd struct {
+	done chan struct{}
+	err  error
+}
+
+// nftablesInflightFollower is an element of an entry which piggybacks on the add of another batch
+type nftablesInflightFollower struct {
+	element *nftablesBatchElement
+	leader  *nftablesInflightAdd
+}
+
+func inflightAddKey(cache *NftablesCache, entry *nftablesBatchEntry, element *nftablesBatchElement) string {
+	return fmt.Sprintf("%v|%v|%v|%v|%x|%x", cache.Namespace, getFamilyName(entry.tableCache.table.Family),
+		entry.tableCache.table.Name, entry.set.Name, element.element.Key, element.element.Val)
+}
+
+// claimInflight register the elements of entry which are not being added by other batches, and move the others to
+// followers. Refreshed elements are always sent, interval sets are never coalesced because their elements are pairs.
+func (entry *nftablesBatchEntry) claimInflight(cache *NftablesCache) {
+	if entry.set.Interval || len(entry.elements) == 0 {
+		return
+	}
+
+	inflightAddsLock.Lock()
+	defer inflightAddsLock.Unlock()
+
+	elements := entry.elements[:0]
+	for _, element := range entry.elements {
+		if entry.refresh[string(element.element.Key)] {
+			elements = append(elements, element)
+			continue
+		}
+		key := inflightAddKey(cache, entry, element)
+		if leader, ok := inflightAdds[key]; ok {
+			entry.followers = append(entry.followers, nftablesInflightFollower{element: element, leader: leader})
+			continue
+		}
+		leader := &nftablesInflightAdd{done: make(chan struct{})}
+		inflightAdds[key] = leader
+		entry.leaders = append(entry.leaders, key)
+		elements = append(elements, element)
+	}
+	entry.elements = elements
+
+	if len(entry.followers) > 0 {
+		log.Debugf("Nftables coalesce %v element(s) being added to %v %v %v", len(entry.followers),
+			getFamilyName(entry.tableCache.table.Family), entry.tableCache.table.Name, entry.set.Name)
+		inflightCoalescedCount.WithLabelValues(getFamilyName(entry.tableCache.table.Family), entry.tableCache.table.Name, entry.set.Name).Add(float64(len(entry.followers)))
+	}
+}
+
+// releaseInflight publish the result of the elements claimed by entry to the waiting batches
+func (entry *nftablesBatchEntry) releaseInflight() {
+	if len(entry.leaders) == 0 {
+		return
+	}
+
+	inflightAddsLock.Lock()
+	defer inflightAddsLock.Unlock()
+
+	for _, key := range entry.leaders {
+		leader := inflightAdds[key]
+		delete(inflightAdds, key)
+		leader.err = entry.err
+		close(leader.done)
+	}
+	entry.leaders = nil
+}
+
+// waitInflight wait for the adds which the followers of entry piggyback on, the elements added by them are handled
+// like skipped elements and the failed ones fail the answers of this batch with the same error. It must be called
+// after releaseInflight of all entries of the batch, so that two batches never wait for each other.
+func (entry *nftablesBatchEntry) waitInflight(batch *NftablesBatch) {
+	for _, follower := range entry.followers {
+		<-follower.leader.done
+		if follower.leader.err == nil {
+			entry.skipped = append(entry.skipped, follower.element)
+			continue
+		}
+
+		element := follower.element
+		atomic.AddUint64(&addElementErrorCount, 1)
+		addFailureCount.WithLabelValues(getFamilyName(element.applied.Family), element.applied.TableName, element.applied.SetName).Inc()
+		batch.answerErrors[element.answer] = follower.leader.err
+		log.Errorf("Add element %v(%v) to %v %v %v failed by the coalesced add.%v", element.applied.Element, element.applied.Name,
+			getFamilyName(element.applied.Family), element.applied.TableName, element.applied.SetName, follower.leader.err)
+	}
+	entry.followers = nil
+}
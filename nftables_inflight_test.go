@@ -0,0 +1,81 @@
+package coredns_nftables
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingFlushBackend holds every flush until release is closed and counts the elements sent
+type countingFlushBackend struct {
+	*slowFlushBackend
+	added *int32
+}
+
+func (backend *countingFlushBackend) SetAddElements(set *nftables.Set, elements []nftables.SetElement) error {
+	atomic.AddInt32(backend.added, int32(len(elements)))
+	return backend.MemoryBackend.SetAddElements(set, elements)
+}
+
+func TestInflightCoalesce(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	release := make(chan struct{})
+	var added int32
+	SetNftBackendFactory(func() (NftBackend, error) {
+		return &countingFlushBackend{slowFlushBackend: &slowFlushBackend{MemoryBackend: NewMemoryBackend(ruleset), release: release}, added: &added}, nil
+	})
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+	}()
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_inflight", SetName: "INFLIGHT", KeyType: nftables.TypeInvalid})
+
+	coalesced := testutil.ToFloat64(inflightCoalescedCount.WithLabelValues("ipv4", "coredns_inflight", "INFLIGHT"))
+	const workers = 4
+	results := make([]int, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.210")
+			results[i], errs[i] = handle.ServeWorker(context.Background(), msg)
+		}(i)
+	}
+
+	// all but one of the concurrent adds piggyback on the first one
+	for deadline := time.Now().Add(5 * time.Second); testutil.ToFloat64(inflightCoalescedCount.WithLabelValues("ipv4", "coredns_inflight", "INFLIGHT")) < coalesced+workers-1; {
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatalf("Expected %v adds coalesced, but got %v", workers-1, testutil.ToFloat64(inflightCoalescedCount.WithLabelValues("ipv4", "coredns_inflight", "INFLIGHT"))-coalesced)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < workers; i++ {
+		if results[i] != 1 || errs[i] != nil {
+			t.Errorf("Expected every response applied once, but got %v, %v", results[i], errs[i])
+		}
+	}
+	if added != 1 {
+		t.Errorf("Expected the element sent once, but got %v", added)
+	}
+	inflightAddsLock.Lock()
+	if len(inflightAdds) != 0 {
+		t.Errorf("Expected no in-flight add left, but got %v", len(inflightAdds))
+	}
+	inflightAddsLock.Unlock()
+}
@@ -0,0 +1,1126 @@
+//go:build integration
+// +build integration
+
+package coredns_nftables
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// withTestNetNS runs fn in a new network namespace, it requires CAP_SYS_ADMIN and CAP_NET_ADMIN
+func withTestNetNS(t *testing.T, fn func()) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatalf("netns.Get() failed: %v", err)
+	}
+	defer origin.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Fatalf("netns.New() failed: %v", err)
+	}
+	defer func() {
+		netns.Set(origin)
+		ns.Close()
+	}()
+
+	ClearCache()
+	defer ClearCache()
+	fn()
+}
+
+func TestIntegrationCapabilities(t *testing.T) {
+	withTestNetNS(t, func() {
+		conn, err := nftables.New()
+		if err != nil {
+			t.Fatalf("nftables.New() failed: %v", err)
+		}
+
+		report := ProbeCapabilities(conn)
+		t.Log(report.String())
+		if !report.Supported("set") {
+			t.Fatalf("Expected named sets are supported")
+		}
+	})
+}
+
+func TestIntegrationAddElements(t *testing.T) {
+	withTestNetNS(t, func() {
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: "TEST_SET", KeyType: nftables.TypeInvalid})
+
+		msg := new(dns.Msg)
+		for _, record := range []string{"example.org. 300 IN A 192.0.2.10", "example.org. 300 IN A 192.0.2.11", "example.org. 300 IN AAAA 2001:db8::1"} {
+			rr, err := dns.NewRR(record)
+			if err != nil {
+				t.Fatalf("dns.NewRR(%v) failed: %v", record, err)
+			}
+			msg.Answer = append(msg.Answer, rr)
+		}
+
+		applyCounter, err := handle.ServeWorker(context.Background(), msg)
+		if err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+		if applyCounter != 2 {
+			t.Fatalf("Expected 2 elements applied, but got %v", applyCounter)
+		}
+
+		conn, _ := nftables.New()
+		set, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}, "TEST_SET")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		elements, err := conn.GetSetElements(set)
+		if err != nil {
+			t.Fatalf("GetSetElements failed: %v", err)
+		}
+
+		found := make(map[string]bool)
+		for _, element := range elements {
+			found[net.IP(element.Key).String()] = true
+		}
+		for _, ip := range []string{"192.0.2.10", "192.0.2.11"} {
+			if !found[ip] {
+				t.Errorf("Expected %v in set, but got %v", ip, found)
+			}
+		}
+	})
+}
+
+func TestIntegrationDriftRepair(t *testing.T) {
+	withTestNetNS(t, func() {
+		EnableElementTracker(true)
+		defer EnableElementTracker(false)
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: "DRIFT_SET", KeyType: nftables.TypeInvalid})
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 300 IN A 192.0.2.20")
+		msg.Answer = []dns.RR{rr}
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		conn, _ := nftables.New()
+		set, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}, "DRIFT_SET")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		conn.FlushSet(set)
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("FlushSet failed: %v", err)
+		}
+
+		CheckDrift(true)
+
+		elements, err := conn.GetSetElements(set)
+		if err != nil {
+			t.Fatalf("GetSetElements failed: %v", err)
+		}
+		if len(elements) != 1 || net.IP(elements[0].Key).String() != "192.0.2.20" {
+			t.Fatalf("Expected 192.0.2.20 added back, but got %v", elements)
+		}
+	})
+}
+
+func TestIntegrationDriftRecreateSet(t *testing.T) {
+	withTestNetNS(t, func() {
+		EnableElementTracker(true)
+		defer EnableElementTracker(false)
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: "RELOAD_SET", KeyType: nftables.TypeInvalid, Timeout: time.Hour})
+		StartStateDump(&handle)
+		defer StopStateDump(&handle)
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 300 IN A 192.0.2.80")
+		msg.Answer = []dns.RR{rr}
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		// firewall reload
+		conn, _ := nftables.New()
+		table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}
+		conn.DelTable(table)
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("DelTable failed: %v", err)
+		}
+
+		CheckDrift(true)
+
+		set, err := conn.GetSetByName(table, "RELOAD_SET")
+		if err != nil {
+			t.Fatalf("Expected set recreated, but got %v", err)
+		}
+		elements, err := conn.GetSetElements(set)
+		if err != nil {
+			t.Fatalf("GetSetElements failed: %v", err)
+		}
+		if !set.HasTimeout || len(elements) != 1 || net.IP(elements[0].Key).String() != "192.0.2.80" {
+			t.Fatalf("Expected 192.0.2.80 added back into set with timeout, but got %v", elements)
+		}
+	})
+}
+
+func TestIntegrationReaper(t *testing.T) {
+	withTestNetNS(t, func() {
+		SetReaper(time.Hour)
+		SetAllowDestructive(true)
+		defer func() {
+			SetReaper(0)
+			SetAllowDestructive(false)
+		}()
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: "REAP_SET", KeyType: nftables.TypeInvalid})
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 1 IN A 192.0.2.70")
+		msg.Answer = []dns.RR{rr}
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		conn, _ := nftables.New()
+		set, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}, "REAP_SET")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		if elements, _ := conn.GetSetElements(set); len(elements) != 1 {
+			t.Fatalf("Expected 1 element before reaping, but got %v", elements)
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+		ReapElements()
+		if elements, _ := conn.GetSetElements(set); len(elements) != 0 {
+			t.Fatalf("Expected expired element deleted, but got %v", elements)
+		}
+	})
+}
+
+func TestIntegrationImportState(t *testing.T) {
+	withTestNetNS(t, func() {
+		EnableElementTracker(true)
+		defer EnableElementTracker(false)
+
+		conn, _ := nftables.New()
+		table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"})
+		set := &nftables.Set{Table: table, Name: "IMPORT_SET", KeyType: nftables.TypeIPAddr, HasTimeout: true, Timeout: time.Hour}
+		if err := conn.AddSet(set, nil); err != nil {
+			t.Fatalf("AddSet failed: %v", err)
+		}
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+
+		result, err := ImportState(&NftablesState{
+			Version: NftablesStateVersion,
+			Elements: []NftablesStateElement{
+				{Family: "ipv4", Table: "coredns_test", Set: "IMPORT_SET", Element: "192.0.2.30", Name: "example.org.", Timeout: "1h0m0s", Expire: time.Now().Add(time.Hour).Format(time.RFC3339)},
+				{Family: "ipv4", Table: "coredns_test", Set: "IMPORT_SET", Element: "192.0.2.31", Name: "example.org.", Timeout: "1h0m0s", Expire: time.Now().Add(-time.Hour).Format(time.RFC3339)},
+			},
+		})
+		if err != nil {
+			t.Fatalf("ImportState failed: %v", err)
+		}
+		if result.Elements != 1 || result.Expired != 1 {
+			t.Fatalf("Expected 1 element imported and 1 expired, but got %+v", result)
+		}
+
+		elements, err := conn.GetSetElements(set)
+		if err != nil {
+			t.Fatalf("GetSetElements failed: %v", err)
+		}
+		if len(elements) != 1 || net.IP(elements[0].Key).String() != "192.0.2.30" {
+			t.Fatalf("Expected 192.0.2.30 imported, but got %v", elements)
+		}
+		if exported := ExportState(); len(exported.Elements) != 1 {
+			t.Fatalf("Expected 1 element exported, but got %v", exported.Elements)
+		}
+	})
+}
+
+func TestIntegrationAddServices(t *testing.T) {
+	withTestNetNS(t, func() {
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddService = append(ruleSet.RuleAddService, &NftablesSetAddService{TableName: "coredns_test", SetName: "HTTPS_SERVICES", Timeout: time.Hour})
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR(`example.org. 300 IN HTTPS 1 . alpn="h3,h2" ipv4hint=192.0.2.40`)
+		msg.Answer = []dns.RR{rr}
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		conn, _ := nftables.New()
+		set, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}, "HTTPS_SERVICES")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		elements, err := conn.GetSetElements(set)
+		if err != nil {
+			t.Fatalf("GetSetElements failed: %v", err)
+		}
+		if len(elements) != 2 {
+			t.Fatalf("Expected tcp and udp services, but got %v", elements)
+		}
+	})
+}
+
+func TestIntegrationCreateSet(t *testing.T) {
+	withTestNetNS(t, func() {
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyINet)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: "CREATED_SET", KeyType: nftables.TypeInvalid, Timeout: time.Hour, CreateSet: true})
+
+		msg := new(dns.Msg)
+		for _, record := range []string{"example.org. 300 IN AAAA 2001:db8::60", "example.org. 300 IN A 192.0.2.60"} {
+			rr, _ := dns.NewRR(record)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 1 {
+			t.Fatalf("Expected 1 element applied, but got %v, %v", applied, err)
+		}
+
+		conn, _ := nftables.New()
+		set, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyINet, Name: "coredns_test"}, "CREATED_SET")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		if set.KeyType.Bytes != 16 || !set.HasTimeout {
+			t.Fatalf("Expected ipv6_addr set with timeout, but got key length %v, timeout %v", set.KeyType.Bytes, set.HasTimeout)
+		}
+	})
+}
+
+func TestIntegrationProxyMap(t *testing.T) {
+	withTestNetNS(t, func() {
+		EnableElementTracker(true)
+		defer EnableElementTracker(false)
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: "PROXY_MAP", KeyType: nftables.TypeIPAddr, Timeout: time.Hour, ProxyPort: 12345})
+		StartStateDump(&handle)
+		defer StopStateDump(&handle)
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 300 IN A 192.0.2.90")
+		msg.Answer = []dns.RR{rr}
+		if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 1 {
+			t.Fatalf("Expected 1 element applied, but got %v, %v", applied, err)
+		}
+
+		conn, _ := nftables.New()
+		table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}
+		set, err := conn.GetSetByName(table, "PROXY_MAP")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		check := func() {
+			elements, err := conn.GetSetElements(set)
+			if err != nil {
+				t.Fatalf("GetSetElements failed: %v", err)
+			}
+			if !set.IsMap || len(elements) != 1 || !bytes.Equal(elements[0].Val, []byte{0x30, 0x39}) {
+				t.Fatalf("Expected 192.0.2.90 : 12345 in map, but got %v", elements)
+			}
+		}
+		check()
+
+		// elements of map are added back with their data
+		conn.FlushSet(set)
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("FlushSet failed: %v", err)
+		}
+		CheckDrift(true)
+		check()
+	})
+}
+
+func TestIntegrationLearnOnly(t *testing.T) {
+	withTestNetNS(t, func() {
+		SetLearnOnly(time.Hour)
+		StartLearnOnly()
+		defer func() {
+			SetLearnOnly(0)
+			learnOnlyStart = time.Time{}
+		}()
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: "LEARN_SET", KeyType: nftables.TypeInvalid})
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 300 IN A 192.0.2.50")
+		msg.Answer = []dns.RR{rr}
+		if applied, _ := handle.ServeWorker(context.Background(), msg); applied != 0 {
+			t.Fatalf("Expected nothing applied in learn only period, but got %v", applied)
+		}
+
+		conn, _ := nftables.New()
+		if set, _ := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}, "LEARN_SET"); set != nil {
+			t.Fatalf("Expected set not created in learn only period")
+		}
+	})
+}
+
+func TestIntegrationGroupRouting(t *testing.T) {
+	withTestNetNS(t, func() {
+		handle := NewNftablesHandler()
+		for _, name := range []string{"streaming", "vpn"} {
+			group := NewNftablesRuleGroup(name)
+			group.Matcher.Add("example.org")
+			ruleSet := group.MutableRuleSet(nftables.TableFamilyIPv4)
+			ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: name, KeyType: nftables.TypeInvalid})
+			handle.Groups = append(handle.Groups, group)
+		}
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("www.example.org. 300 IN A 192.0.2.60")
+		msg.Answer = []dns.RR{rr}
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		conn, _ := nftables.New()
+		table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}
+		if set, _ := conn.GetSetByName(table, "streaming"); set == nil {
+			t.Fatalf("Expected answer routed to the first matched group")
+		}
+		if set, _ := conn.GetSetByName(table, "vpn"); set != nil {
+			t.Fatalf("Expected answer not applied to later groups")
+		}
+	})
+}
+
+func TestIntegrationElementMonitor(t *testing.T) {
+	withTestNetNS(t, func() {
+		SetElementMonitor(true)
+		StartElementMonitor()
+		defer func() {
+			StopElementMonitor()
+			SetElementMonitor(false)
+			EnableElementTracker(false)
+		}()
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: "MONITOR_SET", KeyType: nftables.TypeInvalid})
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 300 IN A 192.0.2.70")
+		msg.Answer = []dns.RR{rr}
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+		if len(GetTrackedElements()["ipv4 coredns_test MONITOR_SET"]) != 1 {
+			t.Fatalf("Expected element tracked")
+		}
+
+		conn, _ := nftables.New()
+		set, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}, "MONITOR_SET")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		conn.SetDeleteElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.70").To4()}})
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("SetDeleteElements failed: %v", err)
+		}
+
+		for i := 0; i < 100; i++ {
+			if len(GetTrackedElements()["ipv4 coredns_test MONITOR_SET"]) == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected element untracked after deletion")
+	})
+}
+
+func TestIntegrationDedupSliding(t *testing.T) {
+	withTestNetNS(t, func() {
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+			TableName: "coredns_test",
+			SetName:   "SLIDING_SET",
+			KeyType:   nftables.TypeInvalid,
+			Timeout:   time.Hour,
+			Dedup:     NftablesDedupSliding,
+		})
+
+		failures := atomic.LoadUint64(&addElementErrorCount)
+		// The first answer creates the set and the second one refreshes the existing element
+		for i := 0; i < 2; i++ {
+			msg := new(dns.Msg)
+			rr, _ := dns.NewRR("example.org. 60 IN A 192.0.2.80")
+			msg.Answer = []dns.RR{rr}
+			if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+				t.Fatalf("ServeWorker failed: %v", err)
+			}
+		}
+
+		conn, _ := nftables.New()
+		set, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}, "SLIDING_SET")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		if elements, _ := conn.GetSetElements(set); len(elements) != 1 || !net.IP(elements[0].Key).Equal(net.ParseIP("192.0.2.80")) {
+			t.Fatalf("Expected the refreshed element is kept, but got %v", elements)
+		}
+		if atomic.LoadUint64(&addElementErrorCount) != failures {
+			t.Fatalf("Expected no add element failure, but got %v", atomic.LoadUint64(&addElementErrorCount)-failures)
+		}
+	})
+}
+
+func TestIntegrationDeferWriteDeadline(t *testing.T) {
+	withTestNetNS(t, func() {
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+			TableName: "coredns_test",
+			SetName:   "DEFER_SET",
+			KeyType:   nftables.TypeInvalid,
+		})
+
+		// The deadline is exceeded before commit, nothing is sent to nftables
+		ctx, cancel := context.WithTimeout(context.Background(), 0)
+		defer cancel()
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 60 IN A 192.0.2.90")
+		msg.Answer = []dns.RR{rr}
+		if _, err := handle.ServeWorker(ctx, msg); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected deadline exceeded, but got %v", err)
+		}
+
+		conn, _ := nftables.New()
+		if _, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}, "DEFER_SET"); err == nil {
+			t.Fatalf("Expected the set is not created after the deadline")
+		}
+
+		SetNftableDeferWrite(true, time.Second)
+		defer SetNftableDeferWrite(false, time.Second)
+		handle.serveDeferred(context.Background(), msg, 0)
+		set, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}, "DEFER_SET")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		if elements, _ := conn.GetSetElements(set); len(elements) != 1 {
+			t.Fatalf("Expected the element is added within the deadline, but got %v", elements)
+		}
+	})
+}
+
+func TestIntegrationSetSize(t *testing.T) {
+	withTestNetNS(t, func() {
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+			TableName: "coredns_test",
+			SetName:   "SIZE_SET",
+			KeyType:   nftables.TypeInvalid,
+		})
+		StartStateDump(&handle)
+		defer StopStateDump(&handle)
+
+		msg := new(dns.Msg)
+		for _, text := range []string{"example.org. 60 IN A 192.0.2.100", "example.org. 60 IN A 192.0.2.101"} {
+			rr, _ := dns.NewRR(text)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		CollectSetSizes()
+		if size := testutil.ToFloat64(setElements.WithLabelValues("ipv4", "coredns_test", "SIZE_SET")); size != 2 {
+			t.Fatalf("Expected 2 elements in set, but got %v", size)
+		}
+	})
+}
+
+func TestIntegrationElementExpirations(t *testing.T) {
+	withTestNetNS(t, func() {
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+			TableName: "coredns_test",
+			SetName:   "EXPIRE_SET",
+			KeyType:   nftables.TypeInvalid,
+			Timeout:   time.Hour,
+		})
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 60 IN A 192.0.2.110")
+		msg.Answer = []dns.RR{rr}
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		elements, err := GetElementExpirations(nftables.TableFamilyIPv4, "coredns_test", "EXPIRE_SET")
+		if err != nil {
+			t.Fatalf("GetElementExpirations failed: %v", err)
+		}
+		if len(elements) != 1 || elements[0].Element != "192.0.2.110" || elements[0].remaining <= 0 || elements[0].remaining > time.Hour {
+			t.Fatalf("Expected the element expires within 1h, but got %v", elements)
+		}
+
+		if _, err := GetElementExpirations(nftables.TableFamilyIPv4, "coredns_test", "MISSING_SET"); err == nil {
+			t.Fatalf("Expected missing set failed")
+		}
+	})
+}
+
+func TestIntegrationPurgeElements(t *testing.T) {
+	withTestNetNS(t, func() {
+		EnableElementTracker(true)
+		defer EnableElementTracker(false)
+		SetAllowDestructive(true)
+		defer SetAllowDestructive(false)
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+			TableName: "coredns_test",
+			SetName:   "PURGE_SET",
+			KeyType:   nftables.TypeInvalid,
+			Timeout:   time.Hour,
+		})
+
+		msg := new(dns.Msg)
+		for _, text := range []string{"example.org. 60 IN A 192.0.2.120", "example.org. 60 IN A 192.0.2.121"} {
+			rr, _ := dns.NewRR(text)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		// An element added by others is never purged
+		conn, _ := nftables.New()
+		set, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}, "PURGE_SET")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		conn.SetAddElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.122").To4()}})
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+
+		if purged, err := PurgeElements(nftables.TableFamilyIPv4, "coredns_test", "PURGE_SET", "192.0.2.120"); err != nil || purged != 1 {
+			t.Fatalf("Expected one element purged, but got %v, %v", purged, err)
+		}
+		if purged, err := PurgeElements(nftables.TableFamilyIPv4, "coredns_test", "PURGE_SET", ""); err != nil || purged != 1 {
+			t.Fatalf("Expected the other element added by the plugin purged, but got %v, %v", purged, err)
+		}
+		if elements, _ := conn.GetSetElements(set); len(elements) != 1 || !net.IP(elements[0].Key).Equal(net.ParseIP("192.0.2.122")) {
+			t.Fatalf("Expected only the element added by others is kept, but got %v", elements)
+		}
+	})
+}
+
+func TestIntegrationIpsetBackend(t *testing.T) {
+	withTestNetNS(t, func() {
+		SetNftBackendFactory(openIpsetBackend)
+		defer SetNftBackendFactory(nil)
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+			TableName: "filter",
+			SetName:   "coredns_ipset_v4",
+			KeyType:   nftables.TypeIPAddr,
+			Timeout:   time.Hour,
+			CreateSet: true,
+		}, &NftablesSetAddElement{
+			TableName: "filter",
+			SetName:   "coredns_ipset_net",
+			KeyType:   nftables.TypeIPAddr,
+			Interval:  true,
+			CreateSet: true,
+		})
+		StartStateDump(&handle)
+		defer StopStateDump(&handle)
+
+		msg := new(dns.Msg)
+		for _, text := range []string{"example.org. 60 IN A 192.0.2.150", "example.org. 60 IN A 192.0.2.151"} {
+			rr, _ := dns.NewRR(text)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 4 {
+			t.Fatalf("Expected 4 elements applied to ipset, but got %v, %v", applied, err)
+		}
+
+		backend := NewIpsetBackend()
+		table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+		set, err := backend.GetSetByName(table, "coredns_ipset_v4")
+		if err != nil {
+			t.Fatalf("Expected ipset created, but got %v", err)
+		}
+		if !set.HasTimeout || set.Timeout != time.Hour || set.KeyType.Name != nftables.TypeIPAddr.Name || set.Interval {
+			t.Errorf("Expected hash:ip set with 1h timeout, but got %+v", set)
+		}
+		elements, err := backend.GetSetElements(set)
+		if err != nil || len(elements) != 2 || elements[0].Timeout <= 0 {
+			t.Fatalf("Expected 2 elements with timeout, but got %v, %v", elements, err)
+		}
+
+		// Adding existing elements again and deleting missing elements are not errors
+		ClearCache()
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("Expected existing elements added again, but got %v", err)
+		}
+		backend.SetDeleteElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.150").To4()}, {Key: net.ParseIP("192.0.2.152").To4()}})
+		if err := backend.Flush(); err != nil {
+			t.Fatalf("Delete elements failed, %v", err)
+		}
+		if elements, _ := backend.GetSetElements(set); len(elements) != 1 || !net.IP(elements[0].Key).Equal(net.ParseIP("192.0.2.151")) {
+			t.Errorf("Expected only 192.0.2.151 kept, but got %v", elements)
+		}
+
+		// Ranges of interval sets are stored as networks
+		netSet, err := backend.GetSetByName(table, "coredns_ipset_net")
+		if err != nil || !netSet.Interval {
+			t.Fatalf("Expected hash:net set, but got %v, %v", netSet, err)
+		}
+		_, network, _ := net.ParseCIDR("198.51.100.0/24")
+		backend.SetAddElements(netSet, pinElements(network, true))
+		if err := backend.Flush(); err != nil {
+			t.Fatalf("Add network failed, %v", err)
+		}
+		elements, _ = backend.GetSetElements(netSet)
+		found := false
+		for i, element := range elements {
+			found = found || (net.IP(element.Key).Equal(network.IP) && i+1 < len(elements) && elements[i+1].IntervalEnd)
+		}
+		if !found {
+			t.Errorf("Expected range of 198.51.100.0/24, but got %v", elements)
+		}
+
+		if _, err := backend.GetSetByName(table, "coredns_ipset_missing"); !errors.Is(err, unix.ENOENT) {
+			t.Errorf("Expected missing ipset failed with ENOENT, but got %v", err)
+		}
+	})
+}
+
+func TestIntegrationKernelHandles(t *testing.T) {
+	withTestNetNS(t, func() {
+		conn, _ := nftables.New()
+		table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"})
+		conn.AddSet(&nftables.Set{Table: table, Name: "HANDLE_SET", KeyType: nftables.TypeIPAddr}, nil)
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("Create set failed: %v", err)
+		}
+
+		tableHandle, err := getKernelHandle(NftablesNetworkNamespace{}, nftables.TableFamilyIPv4, "coredns_test", "")
+		if err != nil || tableHandle == 0 {
+			t.Fatalf("Expected handle of table, but got %v, %v", tableHandle, err)
+		}
+		setHandle, err := getKernelHandle(NftablesNetworkNamespace{}, nftables.TableFamilyIPv4, "coredns_test", "HANDLE_SET")
+		if err != nil || setHandle == 0 {
+			t.Fatalf("Expected handle of set, but got %v, %v", setHandle, err)
+		}
+
+		conn.DelSet(&nftables.Set{Table: table, Name: "HANDLE_SET"})
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("DelSet failed: %v", err)
+		}
+		if handle, err := getKernelHandle(NftablesNetworkNamespace{}, nftables.TableFamilyIPv4, "coredns_test", "HANDLE_SET"); err != nil || handle != 0 {
+			t.Errorf("Expected no handle of deleted set, but got %v, %v", handle, err)
+		}
+
+		conn.AddSet(&nftables.Set{Table: table, Name: "HANDLE_SET", KeyType: nftables.TypeIPAddr}, nil)
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("Recreate set failed: %v", err)
+		}
+		if handle, err := getKernelHandle(NftablesNetworkNamespace{}, nftables.TableFamilyIPv4, "coredns_test", "HANDLE_SET"); err != nil || handle == 0 || handle == setHandle {
+			t.Errorf("Expected new handle of recreated set, but got %v, %v", handle, err)
+		}
+	})
+}
+
+func TestIntegrationNetworkNamespace(t *testing.T) {
+	withTestNetNS(t, func() {
+		outer, _ := netns.Get()
+		defer outer.Close()
+		inner, err := netns.New()
+		if err != nil {
+			t.Fatalf("netns.New() failed: %v", err)
+		}
+		defer inner.Close()
+		netns.Set(outer)
+
+		if err := SetNetworkNamespace("path", fmt.Sprintf("/proc/self/fd/%d", int(inner))); err != nil {
+			t.Fatal(err)
+		}
+		defer SetNetworkNamespace("", "")
+
+		cache, err := NewCache()
+		if err != nil {
+			t.Fatalf("NewCache failed: %v", err)
+		}
+		cache.NftableConnection.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_netns"})
+		if err := cache.Flush(); err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+		cache.destroy()
+
+		outerConn, _ := nftables.New()
+		if tables, _ := outerConn.ListTablesOfFamily(nftables.TableFamilyIPv4); len(tables) != 0 {
+			t.Errorf("Expected no table in the namespace of CoreDNS, but got %v", tables)
+		}
+		innerConn, _ := nftables.New(nftables.WithNetNSFd(int(inner)))
+		if tables, _ := innerConn.ListTablesOfFamily(nftables.TableFamilyIPv4); len(tables) != 1 || tables[0].Name != "coredns_netns" {
+			t.Errorf("Expected table created in the selected namespace, but got %v", tables)
+		}
+	})
+}
+
+func TestIntegrationRuleNetworkNamespace(t *testing.T) {
+	withTestNetNS(t, func() {
+		outer, _ := netns.Get()
+		defer outer.Close()
+		inner, err := netns.New()
+		if err != nil {
+			t.Fatalf("netns.New() failed: %v", err)
+		}
+		defer inner.Close()
+		netns.Set(outer)
+		ClearCache()
+		defer ClearCache()
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement,
+			&NftablesSetAddElement{TableName: "coredns_test", SetName: "OUTER_SET", KeyType: nftables.TypeInvalid},
+			&NftablesSetAddElement{TableName: "coredns_test", SetName: "INNER_SET", KeyType: nftables.TypeInvalid,
+				Netns: NftablesNetworkNamespace{Kind: "path", Value: fmt.Sprintf("/proc/self/fd/%d", int(inner))}})
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 300 IN A 192.0.2.40")
+		msg.Answer = append(msg.Answer, rr)
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_test"}
+		outerConn, _ := nftables.New()
+		innerConn, _ := nftables.New(nftables.WithNetNSFd(int(inner)))
+		for _, check := range []struct {
+			conn    *nftables.Conn
+			present string
+			missing string
+		}{{outerConn, "OUTER_SET", "INNER_SET"}, {innerConn, "INNER_SET", "OUTER_SET"}} {
+			if _, err := check.conn.GetSetByName(table, check.missing); err == nil {
+				t.Errorf("Expected set %v not in the namespace of %v", check.missing, check.present)
+			}
+			set, err := check.conn.GetSetByName(table, check.present)
+			if err != nil {
+				t.Fatalf("GetSetByName %v failed: %v", check.present, err)
+			}
+			elements, err := check.conn.GetSetElements(set)
+			if err != nil || len(elements) != 1 || net.IP(elements[0].Key).String() != "192.0.2.40" {
+				t.Errorf("Expected 192.0.2.40 in %v, but got %v, %v", check.present, elements, err)
+			}
+		}
+	})
+}
+
+func TestIntegrationWorkloadMark(t *testing.T) {
+	withTestNetNS(t, func() {
+		ClearCache()
+		defer ClearCache()
+
+		handle := NewNftablesHandler()
+		for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+			ruleSet := handle.MutableRuleSet(family)
+			ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: "WORKLOAD_SET", KeyType: nftables.TypeInvalid, Workload: true, WorkloadDefault: "0x10"})
+		}
+
+		msg := new(dns.Msg)
+		for _, record := range []string{"example.org. 300 IN A 192.0.2.50", "example.org. 300 IN AAAA 2001:db8::50"} {
+			rr, _ := dns.NewRR(record)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		conn, _ := nftables.New()
+		for _, check := range []struct {
+			family  nftables.TableFamily
+			element string
+		}{{nftables.TableFamilyIPv4, "192.0.2.50 . 0x00000010"}, {nftables.TableFamilyIPv6, "2001:db8::50 . 0x00000010"}} {
+			set, err := conn.GetSetByName(&nftables.Table{Family: check.family, Name: "coredns_test"}, "WORKLOAD_SET")
+			if err != nil {
+				t.Fatalf("GetSetByName failed: %v", err)
+			}
+			elements, err := conn.GetSetElements(set)
+			expected, _ := parseElementKey(check.element)
+			if err != nil || len(elements) != 1 || !bytes.Equal(elements[0].Key, expected) {
+				t.Errorf("Expected %v in the set, but got %v, %v", check.element, elements, err)
+			}
+		}
+	})
+}
+
+func TestIntegrationVlanSet(t *testing.T) {
+	withTestNetNS(t, func() {
+		ClearCache()
+		defer ClearCache()
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyBridge)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_test", SetName: "VLAN_SET", KeyType: nftables.TypeIPAddr, Vlans: []uint16{10, 20}})
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 300 IN A 192.0.2.60")
+		msg.Answer = append(msg.Answer, rr)
+		if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+			t.Fatalf("ServeWorker failed: %v", err)
+		}
+
+		conn, _ := nftables.New()
+		set, err := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyBridge, Name: "coredns_test"}, "VLAN_SET")
+		if err != nil {
+			t.Fatalf("GetSetByName failed: %v", err)
+		}
+		elements, err := conn.GetSetElements(set)
+		if err != nil || len(elements) != 2 {
+			t.Fatalf("Expected an element per vlan, but got %v, %v", elements, err)
+		}
+		for _, text := range []string{"10 . 192.0.2.60", "20 . 192.0.2.60"} {
+			expected, _ := parseElementKey(text)
+			found := false
+			for _, element := range elements {
+				found = found || bytes.Equal(element.Key, expected)
+			}
+			if !found {
+				t.Errorf("Expected %v in the set, but got %v", text, elements)
+			}
+		}
+	})
+}
+
+// getKernelElementUserdata dump the elements of set with their NFTA_SET_ELEM_USERDATA, by the key
+func getKernelElementUserdata(t *testing.T, family nftables.TableFamily, tableName string, setName string) map[string][]byte {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		t.Fatalf("netlink.Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	attributes, _ := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: []byte(tableName + "\x00")},
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: []byte(setName + "\x00")},
+	})
+	messages, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_GETSETELEM),
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: append([]byte{byte(family), unix.NFNETLINK_V0, 0, 0}, attributes...),
+	})
+	if err != nil {
+		t.Fatalf("GETSETELEM failed: %v", err)
+	}
+
+	ret := make(map[string][]byte)
+	for _, message := range messages {
+		decoder, err := netlink.NewAttributeDecoder(message.Data[4:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for decoder.Next() {
+			if decoder.Type() != unix.NFTA_SET_ELEM_LIST_ELEMENTS {
+				continue
+			}
+			decoder.Nested(func(list *netlink.AttributeDecoder) error {
+				for list.Next() {
+					var key, userdata []byte
+					list.Nested(func(item *netlink.AttributeDecoder) error {
+						for item.Next() {
+							switch item.Type() {
+							case unix.NFTA_SET_ELEM_KEY:
+								item.Nested(func(value *netlink.AttributeDecoder) error {
+									for value.Next() {
+										key = value.Bytes()
+									}
+									return nil
+								})
+							case unix.NFTA_SET_ELEM_USERDATA:
+								userdata = item.Bytes()
+							}
+						}
+						return nil
+					})
+					ret[string(key)] = userdata
+				}
+				return nil
+			})
+		}
+	}
+	return ret
+}
+
+func TestIntegrationElementUserdata(t *testing.T) {
+	withTestNetNS(t, func() {
+		SetElementUserdata(true)
+		defer SetElementUserdata(false)
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+			TableName: "coredns_test",
+			SetName:   "USERDATA_SET",
+			KeyType:   nftables.TypeInvalid,
+			Timeout:   time.Hour,
+			Dedup:     NftablesDedupSliding,
+		})
+
+		failures := atomic.LoadUint64(&addElementErrorCount)
+		// The first answer creates the set and the second one refreshes the element in the transaction of userdata
+		for i := 0; i < 2; i++ {
+			msg := new(dns.Msg)
+			msg.SetQuestion("www.example.org.", dns.TypeA)
+			for _, record := range []string{"www.example.org. 60 IN CNAME example.org.", "example.org. 60 IN A 192.0.2.180"} {
+				rr, _ := dns.NewRR(record)
+				msg.Answer = append(msg.Answer, rr)
+			}
+			if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+				t.Fatalf("ServeWorker failed: %v", err)
+			}
+		}
+		if atomic.LoadUint64(&addElementErrorCount) != failures {
+			t.Fatalf("Expected no add element failure, but got %v", atomic.LoadUint64(&addElementErrorCount)-failures)
+		}
+
+		elements := getKernelElementUserdata(t, nftables.TableFamilyIPv4, "coredns_test", "USERDATA_SET")
+		userdata, ok := elements[string(net.ParseIP("192.0.2.180").To4())]
+		if len(elements) != 1 || !ok {
+			t.Fatalf("Expected 192.0.2.180 in the set, but got %v", elements)
+		}
+		provenance, err := DecodeElementUserdata(userdata)
+		if err != nil || provenance.QnameHash != ElementQnameHash("www.example.org.") || provenance.PluginVersion != getPluginVersion() {
+			t.Errorf("Expected the provenance of www.example.org., but got %v, %v", provenance, err)
+		}
+	})
+}
+
+func TestIntegrationNetlinkBackend(t *testing.T) {
+	withTestNetNS(t, func() {
+		SetBackend("netlink")
+		defer SetBackend("nftables")
+
+		handle := NewNftablesHandler()
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+			TableName: "coredns_test",
+			SetName:   "NETLINK_SET",
+			KeyType:   nftables.TypeIPAddr,
+			Timeout:   time.Hour,
+			CreateSet: true,
+		}, &NftablesSetAddElement{TableName: "coredns_test", SetName: "NETLINK_WORKLOAD", KeyType: nftables.TypeInvalid, Workload: true, WorkloadDefault: "0x10"})
+
+		msg := new(dns.Msg)
+		rr, _ := dns.NewRR("example.org. 60 IN A 192.0.2.190")
+		msg.Answer = append(msg.Answer, rr)
+		if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 2 {
+			t.Fatalf("Expected 2 elements applied by netlink backend, but got %v, %v", applied, err)
+		}
+
+		backend := NewNetlinkBackend(NftablesNetworkNamespace{})
+		tables, err := backend.ListTablesOfFamily(nftables.TableFamilyIPv4)
+		if err != nil || len(tables) != 1 || tables[0].Name != "coredns_test" {
+			t.Fatalf("Expected table coredns_test, but got %v, %v", tables, err)
+		}
+		set, err := backend.GetSetByName(tables[0], "NETLINK_SET")
+		if err != nil || !set.HasTimeout || set.Timeout != time.Hour || set.KeyType.Name != nftables.TypeIPAddr.Name {
+			t.Fatalf("Expected set of ipv4_addr with 1h timeout, but got %+v, %v", set, err)
+		}
+		elements, err := backend.GetSetElements(set)
+		if err != nil || len(elements) != 1 || !net.IP(elements[0].Key).Equal(net.ParseIP("192.0.2.190")) || elements[0].Timeout <= 0 {
+			t.Fatalf("Expected 192.0.2.190 with timeout, but got %v, %v", elements, err)
+		}
+
+		// concatenations are decoded from the key type, the concat flag is never sent
+		workload, err := backend.GetSetByName(tables[0], "NETLINK_WORKLOAD")
+		if err != nil || !workload.Concatenation || workload.KeyType.Name != "ipv4_addr . mark" {
+			t.Fatalf("Expected set of ipv4_addr . mark, but got %+v, %v", workload, err)
+		}
+		elements, _ = backend.GetSetElements(workload)
+		expected, _ := parseElementKey("192.0.2.190 . 0x00000010")
+		if len(elements) != 1 || !bytes.Equal(elements[0].Key, expected) {
+			t.Errorf("Expected 192.0.2.190 . 0x00000010 in the set, but got %v", elements)
+		}
+
+		backend.SetDeleteElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.190").To4()}})
+		backend.AddObj(&nftables.CounterObj{Table: tables[0], Name: "netlink_counter", Packets: 3})
+		if err := backend.Flush(); err != nil {
+			t.Fatalf("Flush failed, %v", err)
+		}
+		if elements, _ := backend.GetSetElements(set); len(elements) != 0 {
+			t.Errorf("Expected the element deleted, but got %v", elements)
+		}
+		if obj, err := backend.GetObject(&nftables.CounterObj{Table: tables[0], Name: "netlink_counter"}); err != nil || obj.(*nftables.CounterObj).Packets != 3 {
+			t.Errorf("Expected counter with 3 packets, but got %v, %v", obj, err)
+		}
+
+		// rules are listed with their userdata
+		conn, _ := nftables.New()
+		chain := conn.AddChain(&nftables.Chain{Name: "netlink_chain", Table: tables[0]})
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("Add chain failed, %v", err)
+		}
+		backend.AddRule(&nftables.Rule{Table: tables[0], Chain: chain, Exprs: []expr.Any{&expr.Counter{}}, UserData: buildRuleComment("netlink")})
+		if err := backend.Flush(); err != nil {
+			t.Fatalf("Add rule failed, %v", err)
+		}
+		if rules, err := backend.GetRules(tables[0], chain); err != nil || len(rules) != 1 || !bytes.Equal(rules[0].UserData, buildRuleComment("netlink")) {
+			t.Errorf("Expected the rule with userdata, but got %v, %v", rules, err)
+		}
+
+		// failures of staging are returned by Flush and nothing is sent
+		backend.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_unsent"})
+		backend.AddRule(&nftables.Rule{Table: tables[0], Chain: chain, Exprs: []expr.Any{&expr.Numgen{Type: 0xff}}})
+		if err := backend.Flush(); err == nil {
+			t.Errorf("Expected the rule failed to be marshaled")
+		}
+		if tables, _ := backend.ListTablesOfFamily(nftables.TableFamilyIPv4); len(tables) != 1 {
+			t.Errorf("Expected no table added, but got %v", tables)
+		}
+		if _, err := backend.GetSetByName(tables[0], "NETLINK_MISSING"); !errors.Is(err, unix.ENOENT) {
+			t.Errorf("Expected missing set failed with ENOENT, but got %v", err)
+		}
+	})
+}
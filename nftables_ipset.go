@@ -0,0 +1,449 @@
+package coredns_nftables
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ipset netlink protocol, see include/uapi/linux/netfilter/ipset/ip_set.h
+const (
+	ipsetProtocol = 6
+
+	ipsetCmdCreate = 2
+	ipsetCmdList   = 7
+	ipsetCmdAdd    = 9
+	ipsetCmdDel    = 10
+
+	ipsetAttrProtocol = 1
+	ipsetAttrSetName  = 2
+	ipsetAttrTypeName = 3
+	ipsetAttrRevision = 4
+	ipsetAttrFamily   = 5
+	ipsetAttrFlags    = 6
+	ipsetAttrData     = 7
+	ipsetAttrADT      = 8
+
+	ipsetAttrIP      = 1
+	ipsetAttrIPTo    = 2
+	ipsetAttrCIDR    = 3
+	ipsetAttrTimeout = 6
+
+	ipsetAttrIPAddrIPv4 = 1
+	ipsetAttrIPAddrIPv6 = 2
+
+	ipsetFlagListHeader = 1 << 2
+
+	ipsetErrExist    = syscall.Errno(4103)
+	ipsetErrHashFull = syscall.Errno(4352)
+)
+
+var ErrIpsetUnsupported = errors.New("not supported by ipset backend")
+
+// IpsetBackend applies set operations to ipset for hosts still running iptables. Tables do not exist in ipset,
+// so the table of rules is ignored and sets are looked up by name. Only sets of IP addresses are supported, they
+// are `hash:ip`(or `hash:net` for sets with interval flag) of family inet or inet6.
+// Operations are sent one by one when flushing, ipset has no transactions.
+type IpsetBackend struct {
+	pending []ipsetOperation
+}
+
+type ipsetOperation struct {
+	command uint8
+	data    []byte
+	// ignore the error when adding existing elements or deleting missing elements
+	ignoreExist bool
+}
+
+var _ NftBackend = (*IpsetBackend)(nil)
+
+func NewIpsetBackend() *IpsetBackend {
+	return &IpsetBackend{}
+}
+
+func openIpsetBackend() (NftBackend, error) {
+	return NewIpsetBackend(), nil
+}
+
+// ipsetFamily returns the ipset family of the key type of set
+func ipsetFamily(set *nftables.Set) (uint8, error) {
+	switch set.KeyType.Name {
+	case nftables.TypeIPAddr.Name:
+		return unix.NFPROTO_IPV4, nil
+	case nftables.TypeIP6Addr.Name:
+		return unix.NFPROTO_IPV6, nil
+	}
+	return 0, fmt.Errorf("set %v with key type %v %w", set.Name, set.KeyType.Name, ErrIpsetUnsupported)
+}
+
+func ipsetTimeoutSeconds(timeout time.Duration) uint32 {
+	seconds := (timeout + time.Second - 1) / time.Second
+	if seconds > 0xffffffff {
+		return 0xffffffff
+	}
+	return uint32(seconds)
+}
+
+func ipsetMessage(command uint8, family uint8, fn func(ae *netlink.AttributeEncoder)) ([]byte, error) {
+	encoder := netlink.NewAttributeEncoder()
+	encoder.ByteOrder = binary.BigEndian
+	encoder.Uint8(ipsetAttrProtocol, ipsetProtocol)
+	fn(encoder)
+	data, err := encoder.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{family, unix.NFNETLINK_V0, 0, 0}, data...), nil
+}
+
+func ipsetEncodeAddress(ae *netlink.AttributeEncoder, typ uint16, ip net.IP) {
+	ae.Nested(typ, func(nae *netlink.AttributeEncoder) error {
+		if ip4 := ip.To4(); ip4 != nil && len(ip) == net.IPv4len {
+			nae.Bytes(ipsetAttrIPAddrIPv4|unix.NLA_F_NET_BYTEORDER, ip4)
+		} else {
+			nae.Bytes(ipsetAttrIPAddrIPv6|unix.NLA_F_NET_BYTEORDER, ip.To16())
+		}
+		return nil
+	})
+}
+
+// ipsetExecute send one ipset request and returns the replies of type command
+func ipsetExecute(command uint8, data []byte, dump bool) ([]netlink.Message, error) {
+	conn, err := dialNetfilter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	flags := netlink.Request | netlink.Acknowledge
+	if dump {
+		flags |= netlink.Dump
+	}
+	messages, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_SUBSYS_IPSET<<8 | int(command)), Flags: flags},
+		Data:   data,
+	})
+	if err != nil {
+		return nil, ipsetError(err)
+	}
+
+	var ret []netlink.Message
+	for _, message := range messages {
+		if message.Header.Type == netlink.HeaderType(unix.NFNL_SUBSYS_IPSET<<8|int(command)) {
+			ret = append(ret, message)
+		}
+	}
+	return ret, nil
+}
+
+// ipsetError describe the private errno of ipset, and map the ones having the same meaning to the errors of
+// nftables
+func ipsetError(err error) error {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) || errno < 4096 {
+		return err
+	}
+	switch errno {
+	case ipsetErrExist:
+		return fmt.Errorf("ipset element already added or not exists, %w", ipsetErrExist)
+	case ipsetErrHashFull:
+		return fmt.Errorf("ipset hash is full, %w", unix.ENFILE)
+	}
+	return fmt.Errorf("ipset error %d, %w", int(errno), err)
+}
+
+// ListTablesOfFamily returns the tables of running rules of family, since every table exists in ipset
+func (backend *IpsetBackend) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	var ret []*nftables.Table
+	seen := make(map[string]bool)
+	for _, running := range getRunningSetRules() {
+		if running.family != family || seen[running.rule.TableName] {
+			continue
+		}
+		seen[running.rule.TableName] = true
+		ret = append(ret, &nftables.Table{Family: family, Name: running.rule.TableName})
+	}
+	return ret, nil
+}
+
+func (backend *IpsetBackend) AddTable(table *nftables.Table) *nftables.Table {
+	return table
+}
+
+// decodeIpsetHeader returns the set in the header of a list reply
+func decodeIpsetHeader(table *nftables.Table, data []byte) (*nftables.Set, error) {
+	decoder, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	decoder.ByteOrder = binary.BigEndian
+
+	set := &nftables.Set{Table: table}
+	typeName := ""
+	family := uint8(0)
+	for decoder.Next() {
+		switch decoder.Type() {
+		case ipsetAttrSetName:
+			set.Name = decoder.String()
+		case ipsetAttrTypeName:
+			typeName = decoder.String()
+		case ipsetAttrFamily:
+			family = decoder.Uint8()
+		case ipsetAttrData:
+			decoder.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == ipsetAttrTimeout {
+						set.HasTimeout = true
+						set.Timeout = time.Duration(nad.Uint32()) * time.Second
+					}
+				}
+				return nil
+			})
+		}
+	}
+	if err := decoder.Err(); err != nil {
+		return nil, err
+	}
+
+	switch typeName {
+	case "hash:ip":
+	case "hash:net":
+		set.Interval = true
+	default:
+		return nil, fmt.Errorf("ipset %v of type %v %w", set.Name, typeName, ErrIpsetUnsupported)
+	}
+	switch family {
+	case unix.NFPROTO_IPV4:
+		set.KeyType = nftables.TypeIPAddr
+	case unix.NFPROTO_IPV6:
+		set.KeyType = nftables.TypeIP6Addr
+	default:
+		return nil, fmt.Errorf("ipset %v of family %v %w", set.Name, family, ErrIpsetUnsupported)
+	}
+	return set, nil
+}
+
+func (backend *IpsetBackend) GetSetByName(table *nftables.Table, name string) (*nftables.Set, error) {
+	data, err := ipsetMessage(ipsetCmdList, unix.NFPROTO_UNSPEC, func(ae *netlink.AttributeEncoder) {
+		ae.String(ipsetAttrSetName, name)
+		ae.Uint32(ipsetAttrFlags, ipsetFlagListHeader)
+	})
+	if err != nil {
+		return nil, err
+	}
+	messages, err := ipsetExecute(ipsetCmdList, data, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("ipset %v not found, %w", name, unix.ENOENT)
+	}
+	return decodeIpsetHeader(table, messages[0].Data)
+}
+
+func (backend *IpsetBackend) AddSet(set *nftables.Set, elements []nftables.SetElement) error {
+	family, err := ipsetFamily(set)
+	if err != nil {
+		return err
+	}
+	typeName := "hash:ip"
+	if set.Interval {
+		typeName = "hash:net"
+	}
+	data, err := ipsetMessage(ipsetCmdCreate, family, func(ae *netlink.AttributeEncoder) {
+		ae.String(ipsetAttrSetName, set.Name)
+		ae.String(ipsetAttrTypeName, typeName)
+		ae.Uint8(ipsetAttrRevision, 0)
+		ae.Uint8(ipsetAttrFamily, family)
+		ae.Nested(ipsetAttrData, func(nae *netlink.AttributeEncoder) error {
+			if set.HasTimeout {
+				nae.Uint32(ipsetAttrTimeout|unix.NLA_F_NET_BYTEORDER, ipsetTimeoutSeconds(set.Timeout))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	backend.pending = append(backend.pending, ipsetOperation{command: ipsetCmdCreate, data: data})
+	return backend.SetAddElements(set, elements)
+}
+
+// queueElements convert elements to ipset entries, a range of interval set ends with the element flagged by
+// IntervalEnd after it like nftables
+func (backend *IpsetBackend) queueElements(command uint8, set *nftables.Set, elements []nftables.SetElement) error {
+	family, err := ipsetFamily(set)
+	if err != nil {
+		return err
+	}
+
+	for i, element := range elements {
+		if element.IntervalEnd {
+			continue
+		}
+		var end net.IP
+		if set.Interval && i+1 < len(elements) && elements[i+1].IntervalEnd {
+			end = previousAddress(net.IP(elements[i+1].Key))
+		}
+		data, err := ipsetMessage(command, family, func(ae *netlink.AttributeEncoder) {
+			ae.String(ipsetAttrSetName, set.Name)
+			ae.Nested(ipsetAttrData, func(nae *netlink.AttributeEncoder) error {
+				ipsetEncodeAddress(nae, ipsetAttrIP, net.IP(element.Key))
+				if end != nil {
+					ipsetEncodeAddress(nae, ipsetAttrIPTo, end)
+				}
+				if command == ipsetCmdAdd && element.Timeout > 0 {
+					nae.Uint32(ipsetAttrTimeout|unix.NLA_F_NET_BYTEORDER, ipsetTimeoutSeconds(element.Timeout))
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		backend.pending = append(backend.pending, ipsetOperation{command: command, data: data, ignoreExist: true})
+	}
+	return nil
+}
+
+// previousAddress returns the address before ip
+func previousAddress(ip net.IP) net.IP {
+	ret := make(net.IP, len(ip))
+	copy(ret, ip)
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i] -= 1
+		if ret[i] != 0xff {
+			break
+		}
+	}
+	return ret
+}
+
+// SetAddElements add the elements, the timeout of existing elements is not refreshed like nftables
+func (backend *IpsetBackend) SetAddElements(set *nftables.Set, elements []nftables.SetElement) error {
+	return backend.queueElements(ipsetCmdAdd, set, elements)
+}
+
+func (backend *IpsetBackend) SetDeleteElements(set *nftables.Set, elements []nftables.SetElement) error {
+	return backend.queueElements(ipsetCmdDel, set, elements)
+}
+
+// decodeIpsetElements returns the elements in a list reply, networks are returned as ranges like nftables
+func decodeIpsetElements(data []byte) ([]nftables.SetElement, error) {
+	decoder, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	decoder.ByteOrder = binary.BigEndian
+
+	var ret []nftables.SetElement
+	decodeAddress := func(ad *netlink.AttributeDecoder) net.IP {
+		var ip net.IP
+		ad.Nested(func(nad *netlink.AttributeDecoder) error {
+			for nad.Next() {
+				ip = net.IP(nad.Bytes())
+			}
+			return nil
+		})
+		return ip
+	}
+	for decoder.Next() {
+		if decoder.Type() != ipsetAttrADT {
+			continue
+		}
+		decoder.Nested(func(ad *netlink.AttributeDecoder) error {
+			for ad.Next() {
+				if ad.Type() != ipsetAttrData {
+					continue
+				}
+				var ip net.IP
+				var timeout time.Duration
+				cidr := -1
+				ad.Nested(func(nad *netlink.AttributeDecoder) error {
+					for nad.Next() {
+						switch nad.Type() {
+						case ipsetAttrIP:
+							ip = decodeAddress(nad)
+						case ipsetAttrCIDR:
+							cidr = int(nad.Uint8())
+						case ipsetAttrTimeout:
+							timeout = time.Duration(nad.Uint32()) * time.Second
+						}
+					}
+					return nil
+				})
+				if ip == nil {
+					continue
+				}
+				bits := len(ip) * 8
+				if cidr < 0 || cidr == bits {
+					ret = append(ret, nftables.SetElement{Key: ip, Timeout: timeout})
+					continue
+				}
+				for _, element := range pinElements(&net.IPNet{IP: ip, Mask: net.CIDRMask(cidr, bits)}, true) {
+					element.Timeout = timeout
+					ret = append(ret, element)
+				}
+			}
+			return nil
+		})
+	}
+	return ret, decoder.Err()
+}
+
+// GetSetElements returns the elements of set, the timeout of elements is the remaining timeout
+func (backend *IpsetBackend) GetSetElements(set *nftables.Set) ([]nftables.SetElement, error) {
+	data, err := ipsetMessage(ipsetCmdList, unix.NFPROTO_UNSPEC, func(ae *netlink.AttributeEncoder) {
+		ae.String(ipsetAttrSetName, set.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	messages, err := ipsetExecute(ipsetCmdList, data, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []nftables.SetElement
+	for _, message := range messages {
+		elements, err := decodeIpsetElements(message.Data)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, elements...)
+	}
+	return ret, nil
+}
+
+// Counters and rules belong to iptables, they are not supported
+func (backend *IpsetBackend) AddObj(obj nftables.Obj) nftables.Obj { return obj }
+
+func (backend *IpsetBackend) GetObject(obj nftables.Obj) (nftables.Obj, error) {
+	return nil, fmt.Errorf("object %w", ErrIpsetUnsupported)
+}
+
+func (backend *IpsetBackend) AddRule(rule *nftables.Rule) *nftables.Rule { return rule }
+
+func (backend *IpsetBackend) GetRules(table *nftables.Table, chain *nftables.Chain) ([]*nftables.Rule, error) {
+	return nil, fmt.Errorf("rule %w", ErrIpsetUnsupported)
+}
+
+// Flush send the operations one by one and stops at the first error, the ones sent before are not rolled back
+func (backend *IpsetBackend) Flush() error {
+	pending := backend.pending
+	backend.pending = nil
+	for _, operation := range pending {
+		_, err := ipsetExecute(operation.command, operation.data, false)
+		if err != nil && !(operation.ignoreExist && errors.Is(err, ipsetErrExist)) {
+			return err
+		}
+	}
+	return nil
+}
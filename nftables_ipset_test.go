@@ -0,0 +1,89 @@
+package coredns_nftables
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestDecodeIpsetList(t *testing.T) {
+	encoder := netlink.NewAttributeEncoder()
+	encoder.ByteOrder = binary.BigEndian
+	encoder.Uint8(ipsetAttrProtocol, ipsetProtocol)
+	encoder.String(ipsetAttrSetName, "coredns_v4")
+	encoder.String(ipsetAttrTypeName, "hash:net")
+	encoder.Uint8(ipsetAttrRevision, 0)
+	encoder.Uint8(ipsetAttrFamily, unix.NFPROTO_IPV4)
+	encoder.Nested(ipsetAttrData, func(nae *netlink.AttributeEncoder) error {
+		nae.Uint32(ipsetAttrTimeout|unix.NLA_F_NET_BYTEORDER, 3600)
+		return nil
+	})
+	encoder.Nested(ipsetAttrADT, func(ae *netlink.AttributeEncoder) error {
+		ae.Nested(ipsetAttrData, func(nae *netlink.AttributeEncoder) error {
+			ipsetEncodeAddress(nae, ipsetAttrIP, net.ParseIP("192.0.2.1").To4())
+			nae.Uint8(ipsetAttrCIDR, 32)
+			nae.Uint32(ipsetAttrTimeout|unix.NLA_F_NET_BYTEORDER, 60)
+			return nil
+		})
+		ae.Nested(ipsetAttrData, func(nae *netlink.AttributeEncoder) error {
+			ipsetEncodeAddress(nae, ipsetAttrIP, net.ParseIP("198.51.100.0").To4())
+			nae.Uint8(ipsetAttrCIDR, 24)
+			return nil
+		})
+		return nil
+	})
+	attributes, err := encoder.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{unix.NFPROTO_IPV4, unix.NFNETLINK_V0, 0, 0}, attributes...)
+
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	set, err := decodeIpsetHeader(table, data)
+	if err != nil {
+		t.Fatalf("Decode header failed, %v", err)
+	}
+	if set.Name != "coredns_v4" || !set.Interval || !set.HasTimeout || set.Timeout != time.Hour || set.KeyType.Name != nftables.TypeIPAddr.Name {
+		t.Errorf("Expected hash:net set of inet with 1h timeout, but got %+v", set)
+	}
+
+	elements, err := decodeIpsetElements(data)
+	if err != nil {
+		t.Fatalf("Decode elements failed, %v", err)
+	}
+	if len(elements) != 3 || !net.IP(elements[0].Key).Equal(net.ParseIP("192.0.2.1")) || elements[0].Timeout != time.Minute ||
+		!net.IP(elements[1].Key).Equal(net.ParseIP("198.51.100.0")) ||
+		!net.IP(elements[2].Key).Equal(net.ParseIP("198.51.101.0")) || !elements[2].IntervalEnd {
+		t.Errorf("Expected 192.0.2.1 and range of 198.51.100.0/24, but got %v", elements)
+	}
+}
+
+func TestIpsetBackendUnsupported(t *testing.T) {
+	backend := NewIpsetBackend()
+	keyType, _ := nftables.ConcatSetType(nftables.TypeIPAddr, nftables.TypeInetProto, nftables.TypeInetService)
+	set := &nftables.Set{Table: &nftables.Table{Family: nftables.TableFamilyINet, Name: "filter"}, Name: "SERVICES", KeyType: keyType}
+	if err := backend.AddSet(set, nil); !errors.Is(err, ErrIpsetUnsupported) {
+		t.Errorf("Expected concatenated set not supported, but got %v", err)
+	}
+	if _, err := backend.GetRules(set.Table, &nftables.Chain{Name: "output"}); !errors.Is(err, ErrIpsetUnsupported) {
+		t.Errorf("Expected rules not supported, but got %v", err)
+	}
+
+	if ip := previousAddress(net.ParseIP("198.51.101.0").To4()); !ip.Equal(net.ParseIP("198.51.100.255")) {
+		t.Errorf("Expected 198.51.100.255, but got %v", ip)
+	}
+	if err := ipsetError(fmt.Errorf("netlink receive: %w", syscall.Errno(4352))); !errors.Is(err, unix.ENFILE) {
+		t.Errorf("Expected full hash mapped to ENFILE, but got %v", err)
+	}
+	if err := ipsetError(unix.ENOENT); !errors.Is(err, unix.ENOENT) {
+		t.Errorf("Expected ENOENT kept, but got %v", err)
+	}
+}
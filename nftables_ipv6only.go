@@ -0,0 +1,59 @@
+package coredns_nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+)
+
+// validateIPv6Only returns an error if any rule of an IPv6-only handler targets IPv4 addresses. A answers are never
+// applied on IPv6-only hosts, so these rules would never match anything.
+func (m *NftablesHandler) validateIPv6Only() error {
+	if !m.IPv6Only {
+		return nil
+	}
+	if m.FamiliesIPv4 != nil {
+		return fmt.Errorf("families-ipv4 can not be used with ipv6-only")
+	}
+
+	if err := validateIPv6OnlyRules("", m.Rules); err != nil {
+		return err
+	}
+	for _, group := range m.Groups {
+		if err := validateIPv6OnlyRules(fmt.Sprintf("group %v ", group.Name), group.Rules); err != nil {
+			return err
+		}
+	}
+	if m.Canary != nil {
+		if err := validateIPv6OnlyRules("canary ", m.Canary.Rules); err != nil {
+			return err
+		}
+	}
+	for _, chain := range m.ActionChains {
+		for _, family := range chain.Families {
+			if family == nftables.TableFamilyIPv4 {
+				return fmt.Errorf("match rules of ip tables can not be used with ipv6-only")
+			}
+		}
+	}
+	return nil
+}
+
+func validateIPv6OnlyRules(scope string, rules map[nftables.TableFamily]*NftablesRuleSet) error {
+	for family, ruleSet := range rules {
+		if family == nftables.TableFamilyIPv4 && (len(ruleSet.RuleAddElement) > 0 || len(ruleSet.RuleAddService) > 0) {
+			return fmt.Errorf("%vrules of ip tables can not be used with ipv6-only", scope)
+		}
+		for _, rule := range ruleSet.RuleAddElement {
+			if rule.KeyType == nftables.TypeIPAddr {
+				return fmt.Errorf("%vset %v %v of ip addresses can not be used with ipv6-only", scope, rule.TableName, rule.SetName)
+			}
+		}
+		for _, rule := range ruleSet.RuleAddService {
+			if rule.AddressType == nftables.TypeIPAddr {
+				return fmt.Errorf("%vservice set %v %v of ip addresses can not be used with ipv6-only", scope, rule.TableName, rule.SetName)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+func TestIPv6Only(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+	}()
+
+	handle := NewNftablesHandler()
+	handle.IPv6Only = true
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyINet)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+		TableName: "coredns_ipv6_only",
+		SetName:   "IPV6_ONLY_SET",
+		KeyType:   nftables.TypeIP6Addr,
+		Timeout:   time.Hour,
+		CreateSet: true,
+	})
+
+	// A answers are ignored, the IPv4-mapped address of AAAA answers and hints are kept in 16 bytes
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.1", "example.org. 60 IN AAAA ::ffff:192.0.2.2")
+	// the text form rejects IPv4-mapped hints, but they may be received from upstream
+	hint := &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr:      dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeHTTPS, Class: dns.ClassINET, Ttl: 60},
+		Priority: 1,
+		Target:   ".",
+		Value:    []dns.SVCBKeyValue{&dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("::ffff:192.0.2.3")}}},
+	}}
+	msg.Answer = append(msg.Answer, hint)
+	if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 2 {
+		t.Fatalf("Expected 2 elements applied, but got %v, %v", applied, err)
+	}
+
+	backend := NewMemoryBackend(ruleset)
+	set, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyINet, Name: "coredns_ipv6_only"}, "IPV6_ONLY_SET")
+	if err != nil {
+		t.Fatalf("Expected set created, but got %v", err)
+	}
+	elements, _ := backend.GetSetElements(set)
+	if len(elements) != 2 {
+		t.Fatalf("Expected 2 elements, but got %v", elements)
+	}
+	for _, element := range elements {
+		if len(element.Key) != net.IPv6len || !net.IP(element.Key).Equal(net.ParseIP("::ffff:192.0.2.2")) && !net.IP(element.Key).Equal(net.ParseIP("::ffff:192.0.2.3")) {
+			t.Errorf("Expected IPv4-mapped addresses, but got %v", net.IP(element.Key))
+		}
+	}
+}
+
+func TestValidateIPv6Only(t *testing.T) {
+	handle := NewNftablesHandler()
+	handle.IPv6Only = true
+	handle.MutableRuleSet(nftables.TableFamilyIPv6).RuleAddElement = []*NftablesSetAddElement{{TableName: "t", SetName: "s"}}
+	if err := handle.validateIPv6Only(); err != nil {
+		t.Errorf("Expected rules of ip6 tables valid, but got %v", err)
+	}
+
+	handle.MutableRuleSet(nftables.TableFamilyINet).RuleAddService = []*NftablesSetAddService{{TableName: "t", SetName: "s", AddressType: nftables.TypeIPAddr}}
+	if err := handle.validateIPv6Only(); err == nil {
+		t.Errorf("Expected service set of ip addresses invalid")
+	}
+	delete(handle.Rules, nftables.TableFamilyINet)
+
+	group := NewNftablesRuleGroup("v4")
+	group.Rules[nftables.TableFamilyIPv4] = &NftablesRuleSet{RuleAddElement: []*NftablesSetAddElement{{TableName: "t", SetName: "s"}}}
+	handle.Groups = append(handle.Groups, group)
+	if err := handle.validateIPv6Only(); err == nil {
+		t.Errorf("Expected rules of ip tables in group invalid")
+	}
+	handle.Groups = nil
+
+	handle.FamiliesIPv4 = []nftables.TableFamily{nftables.TableFamilyINet}
+	if err := handle.validateIPv6Only(); err == nil {
+		t.Errorf("Expected families-ipv4 invalid")
+	}
+}
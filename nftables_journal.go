@@ -0,0 +1,348 @@
+package coredns_nftables
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// appliedLogInstancePlaceholder in the path of `log file` is replaced by the instance ID, so that every resolver
+// of a fleet writes its own file on the shared storage
+const appliedLogInstancePlaceholder = "{instance}"
+
+const appliedLogLeaseRetry = 10 * time.Millisecond
+
+var appliedLogInstanceLock sync.Mutex = sync.Mutex{}
+var appliedLogInstance string = ""
+var appliedLogLockTimeout time.Duration = 0
+
+// NftablesAppliedLogEntry is one line of the applied elements log
+type NftablesAppliedLogEntry struct {
+	NftablesAppliedElement
+	Time   time.Time
+	Action string
+	// empty for lines written without `log instance`
+	Instance string
+}
+
+// SetAppliedLogInstance set the instance ID appended to every line of the applied elements log, empty instance
+// disables it
+func SetAppliedLogInstance(instance string) {
+	appliedLogInstanceLock.Lock()
+	defer appliedLogInstanceLock.Unlock()
+
+	appliedLogInstance = instance
+}
+
+// SetAppliedLogLock set how long a write waits for the lease of the applied elements log shared by several
+// instances, 0 disables the lease
+func SetAppliedLogLock(timeout time.Duration) {
+	appliedLogInstanceLock.Lock()
+	defer appliedLogInstanceLock.Unlock()
+
+	appliedLogLockTimeout = timeout
+}
+
+func getAppliedLogInstance() string {
+	appliedLogInstanceLock.Lock()
+	defer appliedLogInstanceLock.Unlock()
+
+	return appliedLogInstance
+}
+
+func getAppliedLogLockTimeout() time.Duration {
+	appliedLogInstanceLock.Lock()
+	defer appliedLogInstanceLock.Unlock()
+
+	return appliedLogLockTimeout
+}
+
+// parseAppliedLogInstance validate an instance ID, the timeout field before it is told apart by being numeric
+func parseAppliedLogInstance(instance string) (string, error) {
+	if len(instance) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		instance = hostname
+	}
+	if strings.ContainsAny(instance, " \t\n/") {
+		return "", fmt.Errorf("instance %v can not contain spaces or /", instance)
+	}
+	if _, err := strconv.ParseInt(instance, 10, 64); err == nil {
+		return "", fmt.Errorf("instance %v can not be a number", instance)
+	}
+	return instance, nil
+}
+
+func (l *nftablesAppliedLog) filePath() string {
+	return strings.ReplaceAll(l.path, appliedLogInstancePlaceholder, getAppliedLogInstance())
+}
+
+// acquireLease take the POSIX write lock of <path>.lock, which is released by the kernel(or the NFS lock manager)
+// when the process dies, so a crashed instance never holds the log forever. It gives up after timeout.
+func (l *nftablesAppliedLog) acquireLease(timeout time.Duration) (func(), error) {
+	path := l.filePath() + ".lock"
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	flock := unix.Flock_t{Type: unix.F_WRLCK, Whence: io.SeekStart}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = unix.FcntlFlock(file.Fd(), unix.F_SETLK, &flock)
+		if err == nil {
+			break
+		}
+		if (err != unix.EAGAIN && err != unix.EACCES && err != unix.EINTR) || time.Now().After(deadline) {
+			file.Close()
+			appliedLogLeaseCount.WithLabelValues("timeout").Inc()
+			return nil, fmt.Errorf("lease %v not acquired in %v, %v", path, timeout, err)
+		}
+		time.Sleep(appliedLogLeaseRetry)
+	}
+	appliedLogLeaseCount.WithLabelValues("acquired").Inc()
+
+	return func() {
+		unlock := unix.Flock_t{Type: unix.F_UNLCK, Whence: io.SeekStart}
+		unix.FcntlFlock(file.Fd(), unix.F_SETLK, &unlock)
+		file.Close()
+	}, nil
+}
+
+// reopenIfRotated close the file when another instance rotated or removed it, and read the size appended by others
+func (l *nftablesAppliedLog) reopenIfRotated() {
+	if l.file == nil {
+		return
+	}
+
+	opened, err := l.file.Stat()
+	current, currentErr := os.Stat(l.filePath())
+	if err != nil || currentErr != nil || !os.SameFile(opened, current) {
+		l.file.Close()
+		l.file = nil
+		l.size = 0
+		return
+	}
+	l.size = current.Size()
+}
+
+// ParseAppliedLogLine parse one line written by WriteAppliedLog. The element of a service contains spaces, so
+// the fields are taken from both ends of the line.
+func ParseAppliedLogLine(line string) (*NftablesAppliedLogEntry, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 8 {
+		return nil, fmt.Errorf("line %q has %v fields, expect at least 8", line, len(fields))
+	}
+
+	entry := &NftablesAppliedLogEntry{}
+	last := len(fields) - 1
+	if _, err := strconv.ParseInt(fields[last], 10, 64); err != nil {
+		if len(fields) < 9 {
+			return nil, fmt.Errorf("line %q has no timeout", line)
+		}
+		entry.Instance = fields[last]
+		last--
+	}
+
+	parsedTime, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("line %q time invalid, %v", line, err)
+	}
+	family, err := parseFamilyName(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("line %q family invalid, %v", line, err)
+	}
+	timeout, err := strconv.ParseInt(fields[last], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("line %q timeout invalid, %v", line, err)
+	}
+
+	entry.Time = parsedTime
+	entry.Action = fields[1]
+	entry.Family = family
+	entry.TableName = fields[3]
+	entry.SetName = fields[4]
+	entry.Element = strings.Join(fields[5:last-1], " ")
+	entry.Name = fields[last-1]
+	entry.Timeout = time.Duration(timeout) * time.Second
+	return entry, nil
+}
+
+// appliedLogCursor is the next line of one merged file
+type appliedLogCursor struct {
+	index   int
+	scanner *bufio.Scanner
+	line    string
+	entry   *NftablesAppliedLogEntry
+}
+
+type appliedLogCursors []*appliedLogCursor
+
+func (h appliedLogCursors) Len() int { return len(h) }
+func (h appliedLogCursors) Less(i, j int) bool {
+	if !h[i].entry.Time.Equal(h[j].entry.Time) {
+		return h[i].entry.Time.Before(h[j].entry.Time)
+	}
+	// lines of the same time keep the order of the files given
+	return h[i].index < h[j].index
+}
+func (h appliedLogCursors) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *appliedLogCursors) Push(x any)   { *h = append(*h, x.(*appliedLogCursor)) }
+func (h *appliedLogCursors) Pop() any {
+	old := *h
+	cursor := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return cursor
+}
+
+// next read the next valid line of the cursor, it returns false at the end of the file
+func (cursor *appliedLogCursor) next(path string) (bool, error) {
+	for cursor.scanner.Scan() {
+		line := cursor.scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		entry, err := ParseAppliedLogLine(line)
+		if err != nil {
+			// a line cut by a crash of the writer is skipped, the rest of the file is still useful
+			log.Warningf("Nftables skip applied log line of %v. %v", path, err)
+			continue
+		}
+		cursor.line = line
+		cursor.entry = entry
+		return true, nil
+	}
+	return false, cursor.scanner.Err()
+}
+
+// MergeAppliedLogs merge the applied elements logs of several instances(and their rotated files) into w ordered by
+// time, so that a replay or a provenance query covers the whole fleet. Each file must be ordered by time, which is
+// how WriteAppliedLog writes it. Only the lines accepted by match are written, nil match accepts all lines. It
+// returns how many lines are written.
+func MergeAppliedLogs(w io.Writer, paths []string, match func(entry *NftablesAppliedLogEntry) bool) (int, error) {
+	cursors := appliedLogCursors{}
+	for index, path := range paths {
+		file, err := openMaybeCompressed(path)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+
+		cursor := &appliedLogCursor{index: index, scanner: bufio.NewScanner(file)}
+		ok, err := cursor.next(path)
+		if err != nil {
+			return 0, fmt.Errorf("read %v failed, %v", path, err)
+		}
+		if ok {
+			cursors = append(cursors, cursor)
+		}
+	}
+	heap.Init(&cursors)
+
+	writer := bufio.NewWriter(w)
+	written := 0
+	for cursors.Len() > 0 {
+		cursor := cursors[0]
+		if match == nil || match(cursor.entry) {
+			if _, err := writer.WriteString(cursor.line + "\n"); err != nil {
+				return written, err
+			}
+			written++
+		}
+
+		ok, err := cursor.next(paths[cursor.index])
+		if err != nil {
+			return written, fmt.Errorf("read %v failed, %v", paths[cursor.index], err)
+		}
+		if ok {
+			heap.Fix(&cursors, 0)
+		} else {
+			heap.Pop(&cursors)
+		}
+	}
+	return written, writer.Flush()
+}
+
+func init() {
+	registerAdminHandler("/journal", serveAdminJournal)
+}
+
+// appliedLogFiles returns the files of all instances written by `log file`, including the rotated ones
+func appliedLogFiles() ([]string, error) {
+	appliedLogLock.Lock()
+	writer := appliedLog
+	appliedLogLock.Unlock()
+	if writer == nil {
+		return nil, fmt.Errorf("log file not configured")
+	}
+
+	pattern := strings.ReplaceAll(writer.path, appliedLogInstancePlaceholder, "*")
+	unique := make(map[string]bool)
+	files := []string{}
+	for _, glob := range []string{pattern, pattern + ".[0-9]*"} {
+		matches, err := filepath.Glob(glob)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches {
+			if !unique[match] && !strings.HasSuffix(match, ".lock") {
+				unique[match] = true
+				files = append(files, match)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// serveAdminJournal merge the applied elements logs of all instances by GET /journal, the query parameters family,
+// table, set, element, name, action and instance filter the lines
+func serveAdminJournal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	files, err := appliedLogFiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filters := map[string]func(entry *NftablesAppliedLogEntry) string{
+		"family":   func(entry *NftablesAppliedLogEntry) string { return getFamilyName(entry.Family) },
+		"table":    func(entry *NftablesAppliedLogEntry) string { return entry.TableName },
+		"set":      func(entry *NftablesAppliedLogEntry) string { return entry.SetName },
+		"element":  func(entry *NftablesAppliedLogEntry) string { return entry.Element },
+		"name":     func(entry *NftablesAppliedLogEntry) string { return entry.Name },
+		"action":   func(entry *NftablesAppliedLogEntry) string { return entry.Action },
+		"instance": func(entry *NftablesAppliedLogEntry) string { return entry.Instance },
+	}
+	match := func(entry *NftablesAppliedLogEntry) bool {
+		for key, field := range filters {
+			if value := query.Get(key); len(value) > 0 && field(entry) != value {
+				return false
+			}
+		}
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := MergeAppliedLogs(w, files, match); err != nil {
+		log.Errorf("Nftables merge applied logs failed. %v", err)
+	}
+}
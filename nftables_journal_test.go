@@ -0,0 +1,130 @@
+package coredns_nftables
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestParseAppliedLogLine(t *testing.T) {
+	entry, err := ParseAppliedLogLine("2026-01-02T03:04:05Z add ip filter VPN 192.0.2.1 example.com. 300")
+	if err != nil || entry.Action != "add" || entry.Family != nftables.TableFamilyIPv4 || entry.Element != "192.0.2.1" ||
+		entry.Name != "example.com." || entry.Timeout != 300*time.Second || len(entry.Instance) != 0 {
+		t.Errorf("Expected line without instance parsed, but got %+v, %v", entry, err)
+	}
+
+	entry, err = ParseAppliedLogLine("2026-01-02T03:04:05.123456789Z add inet filter SVC ip . tcp . 443 example.com. 0 dns-1")
+	if err != nil || entry.Element != "ip . tcp . 443" || entry.Instance != "dns-1" || entry.Time.Nanosecond() != 123456789 {
+		t.Errorf("Expected service line with instance parsed, but got %+v, %v", entry, err)
+	}
+
+	if _, err := ParseAppliedLogLine("2026-01-02T03:04:05Z add ip filter"); err == nil {
+		t.Errorf("Expected truncated line failed")
+	}
+	if _, err := ParseAppliedLogLine("2026-01-02T03:04:05Z add ip filter VPN 192.0.2.1 example.com. dns-1"); err == nil {
+		t.Errorf("Expected line without timeout failed")
+	}
+}
+
+func TestParseAppliedLogInstance(t *testing.T) {
+	if instance, err := parseAppliedLogInstance("dns-1"); err != nil || instance != "dns-1" {
+		t.Errorf("Expected instance dns-1, but got %v, %v", instance, err)
+	}
+	if instance, err := parseAppliedLogInstance(""); err != nil || len(instance) == 0 {
+		t.Errorf("Expected hostname as instance, but got %v, %v", instance, err)
+	}
+	if _, err := parseAppliedLogInstance("42"); err == nil {
+		t.Errorf("Expected numeric instance failed")
+	}
+	if _, err := parseAppliedLogInstance("a/b"); err == nil {
+		t.Errorf("Expected instance with / failed")
+	}
+}
+
+func TestAppliedLogSharedLease(t *testing.T) {
+	defer SetAppliedLogInstance("")
+	defer SetAppliedLogLock(0)
+
+	path := filepath.Join(t.TempDir(), "applied.log")
+	SetAppliedLogInstance("dns-1")
+	SetAppliedLogLock(time.Second)
+
+	// two writers of the same shared file, like two resolvers on NFS
+	first := &nftablesAppliedLog{path: path, maxSize: 1024, maxBackups: 1}
+	second := &nftablesAppliedLog{path: path, maxSize: 1024, maxBackups: 1}
+	defer first.close()
+	defer second.close()
+
+	if err := first.write([]byte("first\n")); err != nil {
+		t.Fatalf("Expected write succeed, but got %v", err)
+	}
+	if err := second.write([]byte(strings.Repeat("x", 1020) + "\n")); err != nil {
+		t.Fatalf("Expected write succeed, but got %v", err)
+	}
+	// the size appended by second is seen by first, so first rotates the file and second follows it
+	if err := first.write([]byte("rotated\n")); err != nil {
+		t.Fatalf("Expected write succeed, but got %v", err)
+	}
+	if err := second.write([]byte("after\n")); err != nil {
+		t.Fatalf("Expected write succeed, but got %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "rotated\nafter\n" {
+		t.Errorf("Expected both writers follow the rotated file, but got %q", data)
+	}
+	backup, _ := os.ReadFile(path + ".1")
+	if !strings.HasPrefix(string(backup), "first\n") {
+		t.Errorf("Expected rotated file keeps old lines, but got %q", backup)
+	}
+	if _, err := os.Stat(path + ".lock"); err != nil {
+		t.Errorf("Expected lease file created, but got %v", err)
+	}
+}
+
+func TestMergeAppliedLogs(t *testing.T) {
+	defer SetAppliedLog("", 0, 0)
+	defer SetAppliedLogInstance("")
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "applied-dns-1.log"), []byte(
+		"2026-01-02T03:04:05.1Z add ip filter VPN 192.0.2.1 a.example.com. 300 dns-1\n"+
+			"2026-01-02T03:04:07Z delete ip filter VPN 192.0.2.1 a.example.com. 0 dns-1\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "applied-dns-1.log.1"), []byte(
+		"2026-01-02T03:04:01Z add ip filter VPN 192.0.2.3 c.example.com. 300 dns-1\n"), 0644)
+	os.WriteFile(filepath.Join(dir, "applied-dns-2.log"), []byte(
+		"2026-01-02T03:04:05Z add ip filter VPN 192.0.2.2 b.example.com. 300 dns-2\n"+
+			"broken li"+"\n"+
+			"2026-01-02T03:04:06Z add ip filter VPN 192.0.2.1 a.example.com. 300 dns-2\n"), 0644)
+
+	SetAppliedLogInstance("dns-1")
+	SetAppliedLog(filepath.Join(dir, "applied-{instance}.log"), 0, 0)
+	files, err := appliedLogFiles()
+	if err != nil || len(files) != 3 {
+		t.Fatalf("Expected files of all instances, but got %v, %v", files, err)
+	}
+
+	var builder strings.Builder
+	written, err := MergeAppliedLogs(&builder, files, nil)
+	lines := strings.Split(strings.TrimSpace(builder.String()), "\n")
+	if err != nil || written != 5 || len(lines) != 5 {
+		t.Fatalf("Expected 5 merged lines, but got %v, %v, %v", written, lines, err)
+	}
+	if !strings.Contains(lines[0], "c.example.com.") || !strings.Contains(lines[1], "b.example.com.") ||
+		!strings.Contains(lines[2], "dns-1") || !strings.Contains(lines[3], "dns-2") || !strings.Contains(lines[4], "delete") {
+		t.Errorf("Expected lines ordered by time, but got %v", lines)
+	}
+
+	recorder := httptest.NewRecorder()
+	serveAdminJournal(recorder, httptest.NewRequest(http.MethodGet, "/journal?element=192.0.2.1&action=add", nil))
+	body := strings.TrimSpace(recorder.Body.String())
+	if recorder.Code != http.StatusOK || strings.Count(body, "\n") != 1 || strings.Contains(body, "delete") {
+		t.Errorf("Expected provenance of 192.0.2.1 from both instances, but got %v %q", recorder.Code, body)
+	}
+}
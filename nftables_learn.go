@@ -0,0 +1,43 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errLearnOnly = errors.New("not applied in learn only period")
+
+var learnOnlyLock sync.Mutex = sync.Mutex{}
+var learnOnlyDuration time.Duration = 0
+var learnOnlyStart time.Time = time.Time{}
+
+// SetLearnOnly set the period after startup during which elements are only journaled and counted
+func SetLearnOnly(duration time.Duration) {
+	learnOnlyLock.Lock()
+	defer learnOnlyLock.Unlock()
+
+	learnOnlyDuration = duration
+}
+
+// StartLearnOnly start the learn only period at the first startup, reloading does not restart it
+func StartLearnOnly() {
+	learnOnlyLock.Lock()
+	defer learnOnlyLock.Unlock()
+
+	if learnOnlyDuration > 0 && learnOnlyStart.IsZero() {
+		learnOnlyStart = time.Now()
+		log.Infof("Nftables learn only until %v, elements will not be applied", learnOnlyStart.Add(learnOnlyDuration).Format(time.RFC3339))
+	}
+}
+
+// IsLearnOnly returns true during the learn only period
+func IsLearnOnly() bool {
+	learnOnlyLock.Lock()
+	defer learnOnlyLock.Unlock()
+
+	if learnOnlyDuration <= 0 || learnOnlyStart.IsZero() {
+		return false
+	}
+	return time.Since(learnOnlyStart) < learnOnlyDuration
+}
@@ -0,0 +1,86 @@
+package coredns_nftables
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+func TestLearnOnlySkipsCounter(t *testing.T) {
+	SetLearnOnly(time.Hour)
+	StartLearnOnly()
+	ClearSetCounters()
+	defer func() {
+		SetLearnOnly(0)
+		learnOnlyStart = time.Time{}
+		ClearSetCounters()
+	}()
+
+	// the cache has no connection, attaching the counter would panic on listing the rules
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	tableCache := &NftableCache{table: table}
+	set := &nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr}
+	(&NftablesCache{}).AttachSetCounter(tableCache, set, &NftablesSetCounter{ChainName: "forward", CounterName: "VPN"})
+
+	setCounterLock.Lock()
+	defer setCounterLock.Unlock()
+	if len(setCounterEntries) != 0 {
+		t.Errorf("Expected no counter attached in the learn only period, but got %v", len(setCounterEntries))
+	}
+}
+
+func TestLearnOnlyNotFailed(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	SetLearnOnly(time.Hour)
+	StartLearnOnly()
+	SetHealthUnhealthyAfter(time.Minute)
+	recordHealthApplied()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+		SetLearnOnly(0)
+		learnOnlyStart = time.Time{}
+		SetHealthUnhealthyAfter(0)
+		recordHealthApplied()
+	}()
+
+	ede, _ := parseOnErrorEDE(nil)
+	handle := NewNftablesHandler()
+	handle.OnError = NftablesOnErrorServfail
+	handle.OnErrorEDE = ede
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_learn", SetName: "LEARN", KeyType: nftables.TypeInvalid})
+	handle.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		reply := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.180")
+		reply.SetReply(r)
+		w.WriteMsg(reply)
+		return dns.RcodeSuccess, nil
+	})
+
+	request := new(dns.Msg)
+	request.SetQuestion("example.org.", dns.TypeA)
+	request.SetEdns0(1232, false)
+	recorder := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := handle.ServeDNS(context.Background(), recorder, request); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	if reply := recorder.Msg; reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 || replyEDE(reply) != nil {
+		t.Errorf("Expected the response served without EDE in the learn only period, but got %v", reply)
+	}
+
+	healthLock.Lock()
+	failingSince := healthFailingSince
+	healthLock.Unlock()
+	if !failingSince.IsZero() || !handle.Ready() {
+		t.Errorf("Expected the learned answer not counted as a failure of the health check, but failing since %v", failingSince)
+	}
+}
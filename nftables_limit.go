@@ -0,0 +1,67 @@
+package coredns_nftables
+
+import (
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+)
+
+// Max count of names whose distinct addresses are remembered by each limiter
+const ipLimiterMaxNames = 65536
+
+type nftablesIPLimiterEntry struct {
+	windowStart time.Time
+	addresses   map[string]bool
+}
+
+// NftablesIPLimiter caps how many distinct addresses a name can contribute to a set within Window
+type NftablesIPLimiter struct {
+	MaxIPs int
+	Window time.Duration
+	// Overflowed addresses are added into this set in the same table, or dropped when it's empty
+	QuarantineSetName string
+
+	lock  sync.Mutex
+	names *lru.Cache
+}
+
+func NewNftablesIPLimiter(maxIPs int, window time.Duration, quarantineSetName string) *NftablesIPLimiter {
+	names, _ := lru.New(ipLimiterMaxNames)
+	return &NftablesIPLimiter{
+		MaxIPs:            maxIPs,
+		Window:            window,
+		QuarantineSetName: quarantineSetName,
+		names:             names,
+	}
+}
+
+// take returns false if address is a new one of name and the name already contributed MaxIPs addresses
+func (l *NftablesIPLimiter) take(name string, address string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	name = dns.CanonicalName(name)
+	now := time.Now()
+	var entry *nftablesIPLimiterEntry
+	if value, ok := l.names.Get(name); ok {
+		entry = value.(*nftablesIPLimiterEntry)
+		if now.Sub(entry.windowStart) >= l.Window {
+			entry = nil
+		}
+	}
+	if entry == nil {
+		entry = &nftablesIPLimiterEntry{windowStart: now, addresses: make(map[string]bool)}
+		l.names.Add(name, entry)
+	}
+
+	if entry.addresses[address] {
+		return true
+	}
+	if len(entry.addresses) >= l.MaxIPs {
+		return false
+	}
+	entry.addresses[address] = true
+	return true
+}
@@ -0,0 +1,88 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+// NftablesLinkLocalPolicy decides how link-local AAAA answers(fe80::/10) are applied. DNS never carries the zone
+// of an address, so the same element key means a different host on each interface.
+type NftablesLinkLocalPolicy int
+
+const (
+	// Link-local addresses are applied like any other address, without zone
+	NftablesLinkLocalStrip NftablesLinkLocalPolicy = iota
+	// Link-local addresses are not applied
+	NftablesLinkLocalSkip
+	// Link-local addresses are only applied to netdev tables, which are bound to the named interface
+	NftablesLinkLocalNetdev
+)
+
+func parseLinkLocalPolicy(name string) (NftablesLinkLocalPolicy, error) {
+	switch strings.ToLower(name) {
+	case "strip":
+		return NftablesLinkLocalStrip, nil
+	case "skip":
+		return NftablesLinkLocalSkip, nil
+	case "netdev":
+		return NftablesLinkLocalNetdev, nil
+	}
+
+	return NftablesLinkLocalStrip, fmt.Errorf("link-local policy %v not supported, use strip, skip or netdev", name)
+}
+
+func (policy NftablesLinkLocalPolicy) String() string {
+	switch policy {
+	case NftablesLinkLocalSkip:
+		return "skip"
+	case NftablesLinkLocalNetdev:
+		return "netdev"
+	}
+	return "strip"
+}
+
+// isLinkLocalAnswer returns true if answer is an AAAA record of a link-local unicast address
+func isLinkLocalAnswer(answer *dns.RR) bool {
+	aaaa, ok := (*answer).(*dns.AAAA)
+	return ok && aaaa.AAAA.To4() == nil && aaaa.AAAA.IsLinkLocalUnicast()
+}
+
+// answerFamiliesIPv6 returns the table families the AAAA answer is applied to, nil means it's skipped
+func (m *NftablesHandler) answerFamiliesIPv6(answer *dns.RR) []nftables.TableFamily {
+	if !isLinkLocalAnswer(answer) {
+		return m.familiesIPv6()
+	}
+
+	switch m.LinkLocal {
+	case NftablesLinkLocalSkip:
+		return nil
+	case NftablesLinkLocalNetdev:
+		return []nftables.TableFamily{nftables.TableFamilyNetdev}
+	}
+	return m.familiesIPv6()
+}
+
+// stripAddressZone remove the zone of a link-local address like `fe80::1%eth0` or `fe80::%eth0/64`, the zone is
+// not part of an element key. Zones of other addresses are invalid.
+func stripAddressZone(text string) (string, error) {
+	address, zone, found := strings.Cut(text, "%")
+	if !found {
+		return text, nil
+	}
+	zone, prefix, hasPrefix := strings.Cut(zone, "/")
+	if len(zone) == 0 {
+		return "", fmt.Errorf("address %v has an empty zone", text)
+	}
+	ip := net.ParseIP(address)
+	if ip == nil || ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return "", fmt.Errorf("address %v has a zone but it's not an IPv6 link-local address", text)
+	}
+	if hasPrefix {
+		return address + "/" + prefix, nil
+	}
+	return address, nil
+}
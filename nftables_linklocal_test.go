@@ -0,0 +1,103 @@
+package coredns_nftables
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestStripAddressZone(t *testing.T) {
+	cases := map[string]string{
+		"fe80::1%eth0":    "fe80::1",
+		"fe80::%eth0/64":  "fe80::/64",
+		"2001:db8::1":     "2001:db8::1",
+		"192.0.2.0/24":    "192.0.2.0/24",
+		"fe80::1%eth0.10": "fe80::1",
+	}
+	for text, expected := range cases {
+		if stripped, err := stripAddressZone(text); err != nil || stripped != expected {
+			t.Errorf("Expected %v stripped to %v, but got %v, %v", text, expected, stripped, err)
+		}
+	}
+
+	for _, text := range []string{"2001:db8::1%eth0", "192.0.2.1%eth0", "fe80::1%"} {
+		if _, err := stripAddressZone(text); err == nil {
+			t.Errorf("Expected zone of %v is invalid", text)
+		}
+	}
+
+	if key, err := parseElementKey("fe80::1%eth0"); err != nil || len(key) != 16 {
+		t.Errorf("Expected link-local element with zone parsed, but got %v, %v", key, err)
+	}
+}
+
+func TestAnswerFamiliesIPv6(t *testing.T) {
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN AAAA fe80::1", "example.org. 60 IN AAAA 2001:db8::1")
+	linkLocal, global := &msg.Answer[0], &msg.Answer[1]
+
+	handle := NewNftablesHandler()
+	if families := handle.answerFamiliesIPv6(linkLocal); !reflect.DeepEqual(families, defaultFamiliesIPv6) {
+		t.Errorf("Expected link-local address stripped and applied to default families, but got %v", families)
+	}
+
+	handle.LinkLocal = NftablesLinkLocalSkip
+	if families := handle.answerFamiliesIPv6(linkLocal); families != nil {
+		t.Errorf("Expected link-local address skipped, but got %v", families)
+	}
+	if families := handle.answerFamiliesIPv6(global); !reflect.DeepEqual(families, defaultFamiliesIPv6) {
+		t.Errorf("Expected global address applied to default families, but got %v", families)
+	}
+
+	handle.LinkLocal = NftablesLinkLocalNetdev
+	if families := handle.answerFamiliesIPv6(linkLocal); !reflect.DeepEqual(families, []nftables.TableFamily{nftables.TableFamilyNetdev}) {
+		t.Errorf("Expected link-local address applied to netdev, but got %v", families)
+	}
+}
+
+func TestLinkLocalNetdev(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+	}()
+
+	handle := NewNftablesHandler()
+	handle.LinkLocal = NftablesLinkLocalNetdev
+	handle.LinkLocalInterface = "eth0"
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv6, nftables.TableFamilyNetdev} {
+		ruleSet := handle.MutableRuleSet(family)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+			TableName: "coredns_link_local",
+			SetName:   "LINK_LOCAL_SET",
+			KeyType:   nftables.TypeIP6Addr,
+			Timeout:   time.Hour,
+			CreateSet: true,
+		})
+	}
+
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN AAAA fe80::1", "example.org. 60 IN AAAA 2001:db8::1")
+	if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 2 {
+		t.Fatalf("Expected 2 elements applied, but got %v, %v", applied, err)
+	}
+
+	backend := NewMemoryBackend(ruleset)
+	countElements := func(family nftables.TableFamily) int {
+		set, err := backend.GetSetByName(&nftables.Table{Family: family, Name: "coredns_link_local"}, "LINK_LOCAL_SET")
+		if err != nil {
+			return 0
+		}
+		elements, _ := backend.GetSetElements(set)
+		return len(elements)
+	}
+	if count := countElements(nftables.TableFamilyIPv6); count != 1 {
+		t.Errorf("Expected only the global address added to ip6 set, but got %v element(s)", count)
+	}
+	if count := countElements(nftables.TableFamilyNetdev); count != 1 {
+		t.Errorf("Expected only the link-local address added to netdev set, but got %v element(s)", count)
+	}
+}
@@ -0,0 +1,217 @@
+package coredns_nftables
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+const lruShardCount = 16
+
+const (
+	lruEvictionCapacity = "capacity"
+	lruEvictionExpired  = "expired"
+)
+
+const (
+	lruLookupHit  = "hit"
+	lruLookupMiss = "miss"
+)
+
+// The LRU of recently applied addresses shared by all connections of the pool, see SetSetLruMaxCount
+var sharedLru = newNftablesLru(setLruMaxCount)
+
+// nftablesLru is the LRU of recently applied addresses. Addresses are spread over shards by hash, each shard has
+// its own lock and keeps 1/lruShardCount of the entries, so concurrent responses rarely wait for each other.
+type nftablesLru struct {
+	shards [lruShardCount]nftablesLruShard
+}
+
+type nftablesLruShard struct {
+	lock sync.Mutex
+	// nil if the LRU is disabled
+	cache *simplelru.LRU
+}
+
+// newNftablesLru returns the LRU keeping about size entries, it never keeps any entry if size is not greater than 0
+func newNftablesLru(size int) *nftablesLru {
+	ret := &nftablesLru{}
+	ret.resize(size)
+	return ret
+}
+
+// resize change the capacity of every shard, the most recent entries are kept
+func (l *nftablesLru) resize(size int) {
+	shardSize := (size + lruShardCount - 1) / lruShardCount
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.lock.Lock()
+		if shardSize <= 0 {
+			shard.cache = nil
+		} else if shard.cache == nil {
+			shard.cache, _ = simplelru.NewLRU(shardSize, nil)
+		} else if evicted := shard.cache.Resize(shardSize); evicted > 0 {
+			lruEvictionCount.WithLabelValues(lruEvictionCapacity).Add(float64(evicted))
+		}
+		shard.lock.Unlock()
+	}
+}
+
+func (l *nftablesLru) shard(ip string) *nftablesLruShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(ip))
+	return &l.shards[hash.Sum32()%lruShardCount]
+}
+
+// get returns the living entry of ip and mark it recently used, expired entries are removed
+func (l *nftablesLru) get(ip string) (NftableIPCache, bool) {
+	shard := l.shard(ip)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if shard.cache == nil {
+		return NftableIPCache{}, false
+	}
+	value, ok := shard.cache.Get(ip)
+	if !ok {
+		return NftableIPCache{}, false
+	}
+	if !value.(*NftableIPCache).ExpireTime.After(time.Now()) {
+		shard.cache.Remove(ip)
+		lruEvictionCount.WithLabelValues(lruEvictionExpired).Inc()
+		return NftableIPCache{}, false
+	}
+	return *value.(*NftableIPCache), true
+}
+
+// add replace the entry of ip
+func (l *nftablesLru) add(ip string, value NftableIPCache) {
+	shard := l.shard(ip)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if shard.cache == nil {
+		return
+	}
+	shard.gc(time.Now())
+	if shard.cache.Add(ip, &value) {
+		lruEvictionCount.WithLabelValues(lruEvictionCapacity).Inc()
+	}
+}
+
+// mergeApplyCount raise the apply count of the living entry of ip to count, or add it with expireTime
+func (l *nftablesLru) mergeApplyCount(ip string, count int, expireTime time.Time) {
+	shard := l.shard(ip)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if shard.cache == nil {
+		return
+	}
+	value, ok := shard.cache.Peek(ip)
+	if ok && value.(*NftableIPCache).ExpireTime.After(time.Now()) {
+		if value.(*NftableIPCache).ApplyCount < count {
+			value.(*NftableIPCache).ApplyCount = count
+		}
+		return
+	}
+	if ok {
+		shard.cache.Remove(ip)
+		lruEvictionCount.WithLabelValues(lruEvictionExpired).Inc()
+	}
+	if shard.cache.Add(ip, &NftableIPCache{ExpireTime: expireTime, ApplyCount: count}) {
+		lruEvictionCount.WithLabelValues(lruEvictionCapacity).Inc()
+	}
+}
+
+// increase add 1 to the apply count of ip, a new entry expires after timeout
+func (l *nftablesLru) increase(ip string, timeout time.Duration) {
+	shard := l.shard(ip)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if shard.cache == nil {
+		return
+	}
+	now := time.Now()
+	value, ok := shard.cache.Get(ip)
+	if ok && value.(*NftableIPCache).ExpireTime.After(now) {
+		value.(*NftableIPCache).ApplyCount += 1
+		return
+	}
+	if ok {
+		shard.cache.Remove(ip)
+		lruEvictionCount.WithLabelValues(lruEvictionExpired).Inc()
+	}
+	shard.gc(now)
+	if shard.cache.Add(ip, &NftableIPCache{ExpireTime: now.Add(timeout), ApplyCount: 1}) {
+		lruEvictionCount.WithLabelValues(lruEvictionCapacity).Inc()
+	}
+}
+
+func (l *nftablesLru) remove(ip string) {
+	shard := l.shard(ip)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if shard.cache != nil {
+		shard.cache.Remove(ip)
+	}
+}
+
+// forEach calls fn with every living entry, the shard of the entry is locked while fn is called
+func (l *nftablesLru) forEach(fn func(ip string, value NftableIPCache)) {
+	now := time.Now()
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.lock.Lock()
+		if shard.cache != nil {
+			for _, key := range shard.cache.Keys() {
+				value, ok := shard.cache.Peek(key)
+				if ok && value.(*NftableIPCache).ExpireTime.After(now) {
+					fn(key.(string), *value.(*NftableIPCache))
+				}
+			}
+		}
+		shard.lock.Unlock()
+	}
+}
+
+func (l *nftablesLru) len() int {
+	ret := 0
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.lock.Lock()
+		if shard.cache != nil {
+			ret += shard.cache.Len()
+		}
+		shard.lock.Unlock()
+	}
+	return ret
+}
+
+// purge removes all entries
+func (l *nftablesLru) purge() {
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.lock.Lock()
+		if shard.cache != nil {
+			shard.cache.Purge()
+		}
+		shard.lock.Unlock()
+	}
+}
+
+// gc removes the expired entries from the oldest one, it must be called with the lock of shard
+func (shard *nftablesLruShard) gc(now time.Time) {
+	for shard.cache.Len() != 0 {
+		_, value, ok := shard.cache.GetOldest()
+		if !ok || value.(*NftableIPCache).ExpireTime.After(now) {
+			break
+		}
+		shard.cache.RemoveOldest()
+		lruEvictionCount.WithLabelValues(lruEvictionExpired).Inc()
+	}
+}
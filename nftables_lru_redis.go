@@ -0,0 +1,261 @@
+package coredns_nftables
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const lruRedisDefaultPrefix = "coredns-nftables:lru:"
+
+// lruRedisBackoff is how long Redis is skipped after it failed, so an unreachable server does not add its timeout
+// to every answer
+const lruRedisBackoff = time.Second
+
+const lruRedisDefaultMaxPending = 10000
+
+var lruRedisLock sync.Mutex = sync.Mutex{}
+var lruRedis *redisClient = nil
+var lruRedisPrefix string = lruRedisDefaultPrefix
+var lruRedisDownUntil time.Time
+
+// Increments of apply counts not written into Redis yet by address, see SetLruRedisWriteBehind
+var lruRedisPending = make(map[string]nftablesLruRedisPending)
+var lruRedisWriteBehind time.Duration = 0
+var lruRedisMaxPending int = lruRedisDefaultMaxPending
+var lruRedisRefs int = 0
+var lruRedisStop chan struct{} = nil
+
+// nftablesLruRedisPending is the increment of the apply count of an address, and the greatest timeout of its
+// entry, see lruEntryTimeout
+type nftablesLruRedisPending struct {
+	count   int
+	timeout time.Duration
+}
+
+// SetLruRedis share the dedup LRU of several CoreDNS instances by the Redis server at address(host:port or
+// redis://[:password@]host:port[/db]), the apply count of each address is kept in key <prefix><address> which
+// expires after `set lru timeout`. The local LRU is still checked first and used when Redis fails. Empty address
+// disables it.
+func SetLruRedis(address string, prefix string, timeout time.Duration) error {
+	var client *redisClient
+	if len(address) > 0 {
+		var err error
+		client, err = newRedisClient(address, timeout)
+		if err != nil {
+			return err
+		}
+	}
+	if len(prefix) == 0 {
+		prefix = lruRedisDefaultPrefix
+	}
+
+	lruRedisLock.Lock()
+	defer lruRedisLock.Unlock()
+
+	if lruRedis != nil {
+		lruRedis.Close()
+	}
+	lruRedis = client
+	lruRedisPrefix = prefix
+	lruRedisDownUntil = time.Time{}
+	lruRedisPending = make(map[string]nftablesLruRedisPending)
+	return nil
+}
+
+// SetLruRedisWriteBehind let the apply counts be written into Redis every interval in one pipeline instead of
+// after every answer, so answers never wait for Redis to count them. At most maxPending addresses are buffered,
+// the increments of more addresses are dropped(the local LRU still has them). 0 interval writes them at once.
+func SetLruRedisWriteBehind(interval time.Duration, maxPending int) {
+	if maxPending <= 0 {
+		maxPending = lruRedisDefaultMaxPending
+	}
+
+	lruRedisLock.Lock()
+	defer lruRedisLock.Unlock()
+
+	lruRedisWriteBehind = interval
+	lruRedisMaxPending = maxPending
+}
+
+// StartLruRedis start writing the buffered apply counts into Redis when the first handler starts
+func StartLruRedis() {
+	lruRedisLock.Lock()
+	defer lruRedisLock.Unlock()
+
+	lruRedisRefs += 1
+	if lruRedisStop != nil || lruRedis == nil || lruRedisWriteBehind <= 0 {
+		return
+	}
+
+	lruRedisStop = make(chan struct{})
+	go func(stop chan struct{}, interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				FlushLruRedis()
+			}
+		}
+	}(lruRedisStop, lruRedisWriteBehind)
+}
+
+// StopLruRedis stop the writer when the last handler stops, the buffered apply counts are written before it
+func StopLruRedis() {
+	lruRedisLock.Lock()
+	if lruRedisRefs > 0 {
+		lruRedisRefs -= 1
+	}
+	stopped := lruRedisRefs == 0 && lruRedisStop != nil
+	if stopped {
+		close(lruRedisStop)
+		lruRedisStop = nil
+	}
+	lruRedisLock.Unlock()
+
+	if stopped {
+		FlushLruRedis()
+	}
+}
+
+// FlushLruRedis write the buffered apply counts into Redis in one pipeline, they are kept for the next flush when
+// Redis fails
+func FlushLruRedis() {
+	lruRedisLock.Lock()
+	client := lruRedis
+	pending := lruRedisPending
+	lruRedisPending = make(map[string]nftablesLruRedisPending)
+	prefix := lruRedisPrefix
+	lruRedisLock.Unlock()
+	if client == nil || len(pending) == 0 {
+		return
+	}
+
+	commands := make([][]string, 0, len(pending)*2)
+	for ip, increment := range pending {
+		timeout := strconv.FormatInt(increment.timeout.Milliseconds(), 10)
+		commands = append(commands, []string{"SET", prefix + ip, "0", "PX", timeout, "NX"}, []string{"INCRBY", prefix + ip, strconv.Itoa(increment.count)})
+	}
+	if _, err := client.Do(commands...); err != nil {
+		lruRedisLock.Lock()
+		for ip, increment := range pending {
+			if _, ok := lruRedisPending[ip]; ok || len(lruRedisPending) < lruRedisMaxPending {
+				lruRedisPending[ip] = lruRedisPending[ip].add(increment.count, increment.timeout)
+			}
+		}
+		lruRedisLock.Unlock()
+		lruRedisFailed("increase", err)
+		return
+	}
+	lruRedisCount.WithLabelValues("increase", "ok").Add(float64(len(pending)))
+}
+
+// getLruRedis returns the client and prefix of the shared LRU, nil if it's disabled or backing off after a failure
+func getLruRedis() (*redisClient, string) {
+	lruRedisLock.Lock()
+	defer lruRedisLock.Unlock()
+
+	if lruRedis == nil || time.Now().Before(lruRedisDownUntil) {
+		return nil, ""
+	}
+	return lruRedis, lruRedisPrefix
+}
+
+func lruRedisFailed(operation string, err error) {
+	lruRedisLock.Lock()
+	lruRedisDownUntil = time.Now().Add(lruRedisBackoff)
+	lruRedisLock.Unlock()
+
+	lruRedisCount.WithLabelValues(operation, "error").Inc()
+	log.Warningf("Nftables shared LRU %v failed, use the local LRU for %v. %v", operation, lruRedisBackoff, err)
+}
+
+// lruRedisGet returns the apply count of ip shared by all instances and when it expires, ok is false if the
+// address is unknown or Redis is not available
+func lruRedisGet(ip string) (*NftableIPCache, bool) {
+	client, prefix := getLruRedis()
+	if client == nil {
+		return nil, false
+	}
+
+	replies, err := client.Do([]string{"GET", prefix + ip}, []string{"PTTL", prefix + ip})
+	if err != nil {
+		lruRedisFailed("get", err)
+		return nil, false
+	}
+	if replies[0].null || replies[1].integer <= 0 {
+		lruRedisCount.WithLabelValues("get", "miss").Inc()
+		return nil, false
+	}
+	count, err := strconv.Atoi(replies[0].text)
+	if err != nil {
+		lruRedisFailed("get", err)
+		return nil, false
+	}
+
+	lruRedisCount.WithLabelValues("get", "hit").Inc()
+	return &NftableIPCache{
+		ExpireTime: time.Now().Add(time.Duration(replies[1].integer) * time.Millisecond),
+		ApplyCount: count,
+	}, true
+}
+
+// lruRedisIncrease count one more apply of ip for all instances, the key expires after timeout of the first apply
+// only like the local LRU
+func lruRedisIncrease(ip string, timeout time.Duration) {
+	lruRedisLock.Lock()
+	if lruRedis != nil && lruRedisWriteBehind > 0 {
+		_, ok := lruRedisPending[ip]
+		buffered := ok || len(lruRedisPending) < lruRedisMaxPending
+		if buffered {
+			lruRedisPending[ip] = lruRedisPending[ip].add(1, timeout)
+		}
+		lruRedisLock.Unlock()
+		if !buffered {
+			lruRedisCount.WithLabelValues("increase", "dropped").Inc()
+		}
+		return
+	}
+	lruRedisLock.Unlock()
+
+	client, prefix := getLruRedis()
+	if client == nil {
+		return
+	}
+
+	_, err := client.Do([]string{"SET", prefix + ip, "0", "PX", strconv.FormatInt(timeout.Milliseconds(), 10), "NX"}, []string{"INCR", prefix + ip})
+	if err != nil {
+		lruRedisFailed("increase", err)
+		return
+	}
+	lruRedisCount.WithLabelValues("increase", "ok").Inc()
+}
+
+func (pending nftablesLruRedisPending) add(count int, timeout time.Duration) nftablesLruRedisPending {
+	pending.count += count
+	if timeout > pending.timeout {
+		pending.timeout = timeout
+	}
+	return pending
+}
+
+// lruRedisRemove forget ip for all instances, so that the next answer of it will be applied again
+func lruRedisRemove(ip string) {
+	lruRedisLock.Lock()
+	delete(lruRedisPending, ip)
+	lruRedisLock.Unlock()
+
+	client, prefix := getLruRedis()
+	if client == nil {
+		return
+	}
+
+	if _, err := client.Do([]string{"DEL", prefix + ip}); err != nil {
+		lruRedisFailed("remove", err)
+		return
+	}
+	lruRedisCount.WithLabelValues("remove", "ok").Inc()
+}
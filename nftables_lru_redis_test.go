@@ -0,0 +1,214 @@
+package coredns_nftables
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the commands used by the shared LRU, expire times are kept in milliseconds
+type fakeRedis struct {
+	lock    sync.Mutex
+	values  map[string]int64
+	expires map[string]time.Time
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen failed, %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &fakeRedis{values: make(map[string]int64), expires: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+func (server *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, 0, count)
+		for i := 0; i < count; i++ {
+			reader.ReadString('\n')
+			arg, _ := reader.ReadString('\n')
+			args = append(args, strings.TrimSuffix(arg, "\r\n"))
+		}
+		conn.Write([]byte(server.execute(args)))
+	}
+}
+
+func (server *fakeRedis) execute(args []string) string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	key := ""
+	if len(args) > 1 {
+		key = args[1]
+		if expire, ok := server.expires[key]; ok && !expire.After(time.Now()) {
+			delete(server.values, key)
+			delete(server.expires, key)
+		}
+	}
+	value, exists := server.values[key]
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		if exists {
+			return "$-1\r\n"
+		}
+		milliseconds, _ := strconv.Atoi(args[4])
+		server.values[key], _ = strconv.ParseInt(args[2], 10, 64)
+		server.expires[key] = time.Now().Add(time.Duration(milliseconds) * time.Millisecond)
+		return "+OK\r\n"
+	case "INCR", "INCRBY":
+		increment := int64(1)
+		if len(args) > 2 {
+			increment, _ = strconv.ParseInt(args[2], 10, 64)
+		}
+		server.values[key] = value + increment
+		return fmt.Sprintf(":%d\r\n", value+increment)
+	case "GET":
+		if !exists {
+			return "$-1\r\n"
+		}
+		text := strconv.FormatInt(value, 10)
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(text), text)
+	case "PTTL":
+		if !exists {
+			return ":-2\r\n"
+		}
+		return fmt.Sprintf(":%d\r\n", time.Until(server.expires[key]).Milliseconds())
+	case "DEL":
+		delete(server.values, key)
+		delete(server.expires, key)
+		if exists {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestLruRedisShared(t *testing.T) {
+	server, address := startFakeRedis(t)
+	if err := SetLruRedis(address, "test:", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLruRedis("", "", 0)
+	defer SetSetLruMaxRetryTimes(setLruMaxRetryTimes)
+	SetSetLruMaxRetryTimes(2)
+
+	newInstance := func() *NftablesCache {
+		return &NftablesCache{recentlyIPCache: newNftablesLru(16)}
+	}
+	first := newInstance()
+	second := newInstance()
+	answer := newTestBatchAnswer(t, "example.com. 300 IN A 192.0.2.1")
+
+	first.LruUpdateIp(answer, 1)
+	if second.LruIgnoreIp(answer) {
+		t.Errorf("Expected address applied once is not ignored")
+	}
+	first.LruUpdateIp(answer, 1)
+	if !second.LruIgnoreIp(answer) {
+		t.Fatalf("Expected address applied by another instance ignored")
+	}
+	if value, ok := second.recentlyIPCache.get("192.0.2.1"); !ok || value.ApplyCount != 2 ||
+		!value.ExpireTime.After(time.Now()) {
+		t.Errorf("Expected shared entry kept in the local LRU, but got %v", value)
+	}
+	server.lock.Lock()
+	if _, ok := server.expires["test:192.0.2.1"]; !ok {
+		t.Errorf("Expected key expires")
+	}
+	server.lock.Unlock()
+
+	lruRemoveIp("192.0.2.1")
+	if newInstance().LruIgnoreIp(answer) {
+		t.Errorf("Expected removed address forgotten in Redis")
+	}
+}
+
+func TestLruRedisUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("listen failed, %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	if err := SetLruRedis(address, "", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLruRedis("", "", 0)
+
+	cache := &NftablesCache{recentlyIPCache: newNftablesLru(16)}
+	answer := newTestBatchAnswer(t, "example.com. 300 IN A 192.0.2.1")
+	cache.LruUpdateIp(answer, 1)
+	if cache.LruIgnoreIp(answer) {
+		t.Errorf("Expected local LRU used alone")
+	}
+	if client, _ := getLruRedis(); client != nil {
+		t.Errorf("Expected Redis skipped after it failed")
+	}
+}
+
+func TestNewRedisClient(t *testing.T) {
+	client, err := newRedisClient("redis://:secret@redis.example.com/3", 0)
+	if err != nil || client.address != "redis.example.com:6379" || client.password != "secret" || client.db != 3 || client.timeout != redisDefaultTimeout {
+		t.Errorf("Expected address, password and db parsed, but got %+v, %v", client, err)
+	}
+	if _, err := newRedisClient("redis.example.com", 0); err == nil {
+		t.Errorf("Expected address without port failed")
+	}
+}
+
+func TestLruRedisWriteBehind(t *testing.T) {
+	server, address := startFakeRedis(t)
+	if err := SetLruRedis(address, "test:", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLruRedis("", "", 0)
+	SetLruRedisWriteBehind(time.Hour, 1)
+	defer SetLruRedisWriteBehind(0, 0)
+
+	cache := &NftablesCache{recentlyIPCache: newNftablesLru(16)}
+	cache.LruUpdateIp(newTestBatchAnswer(t, "example.com. 300 IN A 192.0.2.1"), 1)
+	cache.LruUpdateIp(newTestBatchAnswer(t, "example.com. 300 IN A 192.0.2.1"), 1)
+	// only one address is buffered
+	cache.LruUpdateIp(newTestBatchAnswer(t, "example.com. 300 IN A 192.0.2.2"), 1)
+
+	server.lock.Lock()
+	written := len(server.values)
+	server.lock.Unlock()
+	if written != 0 {
+		t.Fatalf("Expected nothing written before flush, but got %v", written)
+	}
+
+	StartLruRedis()
+	StopLruRedis()
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.values["test:192.0.2.1"] != 2 || len(server.values) != 1 {
+		t.Errorf("Expected buffered increments written when stopped, but got %v", server.values)
+	}
+}
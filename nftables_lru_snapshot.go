@@ -0,0 +1,123 @@
+package coredns_nftables
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const NftablesLruSnapshotVersion = 1
+
+var lruSnapshotLock sync.Mutex = sync.Mutex{}
+var lruSnapshotPath string = ""
+var lruSnapshotRestored bool = false
+
+// NftablesLruSnapshot is the dedup LRU merged from all connections, entries are sorted by address
+type NftablesLruSnapshot struct {
+	Version int                  `json:"version"`
+	Time    string               `json:"time"`
+	Entries []NftablesStateDedup `json:"entries"`
+}
+
+// SnapshotLru returns the living entries of the dedup LRU
+func SnapshotLru() *NftablesLruSnapshot {
+	snapshot := &NftablesLruSnapshot{
+		Version: NftablesLruSnapshotVersion,
+		Time:    time.Now().Format(time.RFC3339),
+		Entries: []NftablesStateDedup{},
+	}
+	for address, value := range getLruEntries() {
+		snapshot.Entries = append(snapshot.Entries, NftablesStateDedup{
+			Address:    address,
+			ApplyCount: value.ApplyCount,
+			Expire:     value.ExpireTime.Format(time.RFC3339),
+		})
+	}
+	sort.Slice(snapshot.Entries, func(i, j int) bool { return snapshot.Entries[i].Address < snapshot.Entries[j].Address })
+	return snapshot
+}
+
+// RestoreLru seed the dedup LRU of all connections by snapshot, expired entries are ignored.
+// It returns how many entries are restored.
+func RestoreLru(snapshot *NftablesLruSnapshot) (int, error) {
+	if snapshot.Version <= 0 || snapshot.Version > NftablesLruSnapshotVersion {
+		return 0, fmt.Errorf("snapshot version %v not supported, expect 1-%v", snapshot.Version, NftablesLruSnapshotVersion)
+	}
+
+	now := time.Now()
+	entries := make(map[string]*NftableIPCache)
+	for _, dedup := range snapshot.Entries {
+		expire, err := time.Parse(time.RFC3339, dedup.Expire)
+		if err != nil {
+			return 0, fmt.Errorf("dedup %v expire %v invalid, %v", dedup.Address, dedup.Expire, err)
+		}
+		if !expire.After(now) {
+			continue
+		}
+		entries[dedup.Address] = &NftableIPCache{ExpireTime: expire, ApplyCount: dedup.ApplyCount}
+	}
+	seedLruEntries(entries)
+	return len(entries), nil
+}
+
+// SetLruSnapshotPath set the file which keeps the dedup LRU across restarts, empty path disables it
+func SetLruSnapshotPath(path string) {
+	lruSnapshotLock.Lock()
+	defer lruSnapshotLock.Unlock()
+
+	lruSnapshotPath = path
+}
+
+// RestoreLruSnapshotFile restore the dedup LRU from the snapshot file once after the process starts, a missing
+// file is not an error
+func RestoreLruSnapshotFile() {
+	lruSnapshotLock.Lock()
+	defer lruSnapshotLock.Unlock()
+
+	if len(lruSnapshotPath) == 0 || lruSnapshotRestored {
+		return
+	}
+	lruSnapshotRestored = true
+
+	data, err := readFileMaybeCompressed(lruSnapshotPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	var snapshot NftablesLruSnapshot
+	if err == nil {
+		err = json.Unmarshal(data, &snapshot)
+	}
+	restored := 0
+	if err == nil {
+		restored, err = RestoreLru(&snapshot)
+	}
+	if err != nil {
+		log.Errorf("Nftables restore LRU snapshot from %v failed. %v", lruSnapshotPath, err)
+		return
+	}
+	log.Infof("Nftables restore %v LRU entries from %v", restored, lruSnapshotPath)
+}
+
+// SaveLruSnapshotFile write the dedup LRU into the snapshot file when the process stops
+func SaveLruSnapshotFile() {
+	lruSnapshotLock.Lock()
+	defer lruSnapshotLock.Unlock()
+
+	if len(lruSnapshotPath) == 0 {
+		return
+	}
+
+	snapshot := SnapshotLru()
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = writeFileAtomic(lruSnapshotPath, data)
+	}
+	if err != nil {
+		log.Errorf("Nftables save LRU snapshot to %v failed. %v", lruSnapshotPath, err)
+		return
+	}
+	log.Infof("Nftables save %v LRU entries to %v", len(snapshot.Entries), lruSnapshotPath)
+}
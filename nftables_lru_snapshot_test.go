@@ -0,0 +1,54 @@
+package coredns_nftables
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLruSnapshot(t *testing.T) {
+	resetSeed := func() {
+		sharedLru.purge()
+	}
+	resetSeed()
+	defer resetSeed()
+
+	now := time.Now()
+	restored, err := RestoreLru(&NftablesLruSnapshot{
+		Version: NftablesLruSnapshotVersion,
+		Entries: []NftablesStateDedup{
+			{Address: "192.0.2.1", ApplyCount: 3, Expire: now.Add(time.Hour).Format(time.RFC3339)},
+			{Address: "192.0.2.2", ApplyCount: 1, Expire: now.Add(-time.Hour).Format(time.RFC3339)},
+		},
+	})
+	if err != nil || restored != 1 {
+		t.Fatalf("Expected 1 living entry restored, but got %v, %v", restored, err)
+	}
+	if _, err := RestoreLru(&NftablesLruSnapshot{Version: NftablesLruSnapshotVersion + 1}); err == nil {
+		t.Errorf("Expected snapshot of newer version is rejected")
+	}
+
+	path := filepath.Join(t.TempDir(), "lru.json")
+	SetLruSnapshotPath(path)
+	defer SetLruSnapshotPath("")
+	SaveLruSnapshotFile()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected snapshot file is written, but got %v", err)
+	}
+
+	resetSeed()
+	lruSnapshotRestored = false
+	RestoreLruSnapshotFile()
+	snapshot := SnapshotLru()
+	if len(snapshot.Entries) != 1 || snapshot.Entries[0].Address != "192.0.2.1" || snapshot.Entries[0].ApplyCount != 3 {
+		t.Errorf("Expected 192.0.2.1 applied 3 times is restored from file, but got %+v", snapshot.Entries)
+	}
+
+	// The snapshot file is only restored once after the process starts
+	resetSeed()
+	RestoreLruSnapshotFile()
+	if snapshot := SnapshotLru(); len(snapshot.Entries) != 0 {
+		t.Errorf("Expected snapshot file is not restored again, but got %+v", snapshot.Entries)
+	}
+}
@@ -0,0 +1,144 @@
+package coredns_nftables
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSharedLru(t *testing.T) {
+	defer SetSetLruMaxRetryTimes(setLruMaxRetryTimes)
+	SetSetLruMaxRetryTimes(2)
+	sharedLru.purge()
+	defer sharedLru.purge()
+
+	// an address applied via any connection is skipped by all of them
+	first := &NftablesCache{recentlyIPCache: sharedLru}
+	second := &NftablesCache{recentlyIPCache: sharedLru}
+	answer := newTestBatchAnswer(t, "example.com. 300 IN A 192.0.2.1")
+	first.LruUpdateIp(answer, 1)
+	second.LruUpdateIp(answer, 1)
+	if !first.LruIgnoreIp(answer) || !second.LruIgnoreIp(answer) {
+		t.Errorf("Expected the address applied twice via two connections ignored by both")
+	}
+
+	// applies of concurrent responses are all counted
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cache := &NftablesCache{recentlyIPCache: sharedLru}
+			cache.LruUpdateIp(newTestBatchAnswer(t, fmt.Sprintf("example.com. 300 IN A 198.51.100.%d", i%8)), 1)
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 8; i++ {
+		if value, ok := sharedLru.get(fmt.Sprintf("198.51.100.%d", i)); !ok || value.ApplyCount != 8 {
+			t.Errorf("Expected 198.51.100.%d applied 8 times, but got %v", i, value)
+		}
+	}
+
+	// expired entries are forgotten
+	sharedLru.add("192.0.2.2", NftableIPCache{ExpireTime: time.Now().Add(-time.Second), ApplyCount: 5})
+	if _, ok := sharedLru.get("192.0.2.2"); ok {
+		t.Errorf("Expected the expired entry forgotten")
+	}
+
+	seedLruEntries(map[string]*NftableIPCache{"192.0.2.1": {ExpireTime: time.Now().Add(time.Hour), ApplyCount: 1}})
+	if value, _ := sharedLru.get("192.0.2.1"); value.ApplyCount != 2 {
+		t.Errorf("Expected the greater apply count kept after seeding, but got %v", value)
+	}
+
+	lru := newNftablesLru(lruShardCount * 2)
+	for i := 0; i < 1000; i++ {
+		lru.add(fmt.Sprintf("203.0.113.%d", i), NftableIPCache{ExpireTime: time.Now().Add(time.Hour), ApplyCount: 1})
+	}
+	if lru.len() > lruShardCount*2 {
+		t.Errorf("Expected at most %v entries, but got %v", lruShardCount*2, lru.len())
+	}
+	lru.resize(0)
+	lru.add("192.0.2.1", NftableIPCache{ExpireTime: time.Now().Add(time.Hour), ApplyCount: 1})
+	if lru.len() != 0 {
+		t.Errorf("Expected the disabled LRU keeps nothing, but got %v", lru.len())
+	}
+}
+
+func TestLruEntryTimeout(t *testing.T) {
+	defer SetSetLruTimeout(setLruTimeout)
+	defer SetSetLruTTLFactor(0)
+	sharedLru.purge()
+	defer sharedLru.purge()
+
+	answer := newTestBatchAnswer(t, "cdn.example.com. 30 IN A 192.0.2.3")
+	if timeout := lruEntryTimeout(answer); timeout != setLruTimeout {
+		t.Errorf("Expected the LRU timeout by default, but got %v", timeout)
+	}
+
+	SetSetLruTTLFactor(2)
+	SetSetLruTimeout(time.Hour)
+	for _, c := range []struct {
+		record  string
+		timeout time.Duration
+	}{
+		{"cdn.example.com. 30 IN A 192.0.2.3", time.Minute},
+		{"cdn.example.com. 0 IN A 192.0.2.3", time.Second},
+		{"cdn.example.com. 86400 IN A 192.0.2.3", time.Hour},
+	} {
+		if timeout := lruEntryTimeout(newTestBatchAnswer(t, c.record)); timeout != c.timeout {
+			t.Errorf("Expected the entry of %v expires after %v, but got %v", c.record, c.timeout, timeout)
+		}
+	}
+
+	cache := &NftablesCache{recentlyIPCache: sharedLru}
+	cache.LruUpdateIp(answer, 1)
+	// the next answers do not extend the expire time
+	cache.LruUpdateIp(newTestBatchAnswer(t, "cdn.example.com. 600 IN A 192.0.2.3"), 1)
+	value, ok := sharedLru.get("192.0.2.3")
+	if expire := time.Until(value.ExpireTime); !ok || value.ApplyCount != 2 || expire > time.Minute || expire < 50*time.Second {
+		t.Errorf("Expected the entry applied twice expires after about 1m, but got %v", value)
+	}
+}
+
+func TestLruMetrics(t *testing.T) {
+	sharedLru.purge()
+	defer sharedLru.purge()
+
+	hits := testutil.ToFloat64(lruLookupCount.WithLabelValues("", lruLookupHit))
+	misses := testutil.ToFloat64(lruLookupCount.WithLabelValues("", lruLookupMiss))
+	capacity := testutil.ToFloat64(lruEvictionCount.WithLabelValues(lruEvictionCapacity))
+	expired := testutil.ToFloat64(lruEvictionCount.WithLabelValues(lruEvictionExpired))
+
+	cache := &NftablesCache{recentlyIPCache: sharedLru}
+	answer := newTestBatchAnswer(t, "example.com. 300 IN A 192.0.2.5")
+	cache.lruLookupIp(context.Background(), answer)
+	cache.LruUpdateIp(answer, 1)
+	cache.lruLookupIp(context.Background(), answer)
+	if value := testutil.ToFloat64(lruLookupCount.WithLabelValues("", lruLookupHit)) - hits; value != 1 {
+		t.Errorf("Expected 1 hit, but got %v", value)
+	}
+	if value := testutil.ToFloat64(lruLookupCount.WithLabelValues("", lruLookupMiss)) - misses; value != 1 {
+		t.Errorf("Expected 1 miss, but got %v", value)
+	}
+	if value := testutil.ToFloat64(lruEntriesGauge); value != 1 {
+		t.Errorf("Expected 1 entry, but got %v", value)
+	}
+
+	lru := newNftablesLru(lruShardCount)
+	for i := 0; i < 100; i++ {
+		lru.add(fmt.Sprintf("203.0.113.%d", i), NftableIPCache{ExpireTime: time.Now().Add(time.Hour), ApplyCount: 1})
+	}
+	if value := testutil.ToFloat64(lruEvictionCount.WithLabelValues(lruEvictionCapacity)) - capacity; int(value) != 100-lru.len() {
+		t.Errorf("Expected %v entries evicted by the capacity, but got %v", 100-lru.len(), value)
+	}
+	lru.add("192.0.2.6", NftableIPCache{ExpireTime: time.Now().Add(-time.Second), ApplyCount: 1})
+	lru.get("192.0.2.6")
+	lru.increase("192.0.2.6", time.Hour)
+	if value := testutil.ToFloat64(lruEvictionCount.WithLabelValues(lruEvictionExpired)) - expired; value != 1 {
+		t.Errorf("Expected 1 entry expired, but got %v", value)
+	}
+}
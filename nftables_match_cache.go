@@ -0,0 +1,119 @@
+package coredns_nftables
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// nftablesMatchCacheEntry keeps the results of matchers for one chain of names until the TTL of the answer
+type nftablesMatchCacheEntry struct {
+	expireTime time.Time
+	generation uint64
+	lock       sync.Mutex
+	results    map[*NftablesDomainMatcher]bool
+}
+
+var matchCacheLock sync.Mutex = sync.Mutex{}
+var matchCache *lru.Cache = nil
+
+// bumped when the rules or the domain files are reloaded, the entries of older generations are dropped
+var matchCacheGeneration uint64 = 0
+
+// SetMatchCache keep the matcher results of at most maxEntries chains of names, so that repeats of the same
+// qname skip matching. 0 disables it.
+func SetMatchCache(maxEntries int) {
+	matchCacheLock.Lock()
+	defer matchCacheLock.Unlock()
+
+	atomic.AddUint64(&matchCacheGeneration, 1)
+	if maxEntries <= 0 {
+		matchCache = nil
+		return
+	}
+	if matchCache != nil {
+		matchCache.Resize(maxEntries)
+		matchCache.Purge()
+		return
+	}
+	matchCache, _ = lru.New(maxEntries)
+}
+
+// InvalidateMatchCache drop all matcher results, it's called when the rules are reloaded or a domain file
+// is changed
+func InvalidateMatchCache() {
+	matchCacheLock.Lock()
+	defer matchCacheLock.Unlock()
+
+	atomic.AddUint64(&matchCacheGeneration, 1)
+	if matchCache != nil {
+		matchCache.Purge()
+	}
+}
+
+func matchCacheKey(names []string) string {
+	return strings.ToLower(strings.Join(names, " "))
+}
+
+// cacheMatchNames start keeping the matcher results of names for ttl, the results are added when the matchers
+// are evaluated
+func cacheMatchNames(names []string, ttl time.Duration) {
+	matchCacheLock.Lock()
+	cache := matchCache
+	matchCacheLock.Unlock()
+	if cache == nil || ttl <= 0 || len(names) == 0 {
+		return
+	}
+
+	key := matchCacheKey(names)
+	if value, ok := cache.Get(key); ok && value.(*nftablesMatchCacheEntry).valid() {
+		return
+	}
+	cache.Add(key, &nftablesMatchCacheEntry{
+		expireTime: time.Now().Add(ttl),
+		generation: atomic.LoadUint64(&matchCacheGeneration),
+		results:    make(map[*NftablesDomainMatcher]bool),
+	})
+}
+
+// lookupMatchCache returns the living entry of names, or nil if names are not cached
+func lookupMatchCache(names []string) *nftablesMatchCacheEntry {
+	matchCacheLock.Lock()
+	cache := matchCache
+	matchCacheLock.Unlock()
+	if cache == nil || len(names) == 0 {
+		return nil
+	}
+
+	value, ok := cache.Get(matchCacheKey(names))
+	if !ok {
+		return nil
+	}
+	entry := value.(*nftablesMatchCacheEntry)
+	if !entry.valid() {
+		return nil
+	}
+	return entry
+}
+
+func (entry *nftablesMatchCacheEntry) valid() bool {
+	return entry.generation == atomic.LoadUint64(&matchCacheGeneration) && time.Now().Before(entry.expireTime)
+}
+
+func (entry *nftablesMatchCacheEntry) get(matcher *NftablesDomainMatcher) (bool, bool) {
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	matched, ok := entry.results[matcher]
+	return matched, ok
+}
+
+func (entry *nftablesMatchCacheEntry) set(matcher *NftablesDomainMatcher, matched bool) {
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	entry.results[matcher] = matched
+}
@@ -0,0 +1,45 @@
+package coredns_nftables
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchCache(t *testing.T) {
+	SetMatchCache(16)
+	defer SetMatchCache(0)
+
+	matcher := NewNftablesDomainMatcher()
+	matcher.Add("example.org")
+	names := []string{"www.example.org.", "cdn.example.net."}
+	cacheMatchNames(names, time.Minute)
+	if !matcher.MatchAny(names) {
+		t.Fatalf("Expected %v matched", names)
+	}
+	entry := lookupMatchCache(names)
+	if entry == nil {
+		t.Fatalf("Expected %v cached", names)
+	}
+	if matched, ok := entry.get(matcher); !ok || !matched {
+		t.Errorf("Expected the result of matcher cached, but got %v, %v", matched, ok)
+	}
+
+	// the cached result is used until it's invalidated
+	entry.set(matcher, false)
+	if matcher.MatchAny(names) {
+		t.Errorf("Expected the cached result used")
+	}
+	InvalidateMatchCache()
+	if lookupMatchCache(names) != nil {
+		t.Errorf("Expected the cache invalidated")
+	}
+	if !matcher.MatchAny(names) {
+		t.Errorf("Expected %v matched after invalidated", names)
+	}
+
+	// answers without TTL are never cached
+	cacheMatchNames([]string{"example.com."}, 0)
+	if lookupMatchCache([]string{"example.com."}) != nil {
+		t.Errorf("Expected names without TTL not cached")
+	}
+}
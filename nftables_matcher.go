@@ -0,0 +1,154 @@
+package coredns_nftables
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// nftablesDomainTrie stores domain suffixes by labels from the root, sub domains share the nodes of parents
+type nftablesDomainTrie struct {
+	children map[string]*nftablesDomainTrie
+	// the name of this node is matched
+	exact bool
+	// all sub domains of this node are matched
+	suffix bool
+}
+
+func newNftablesDomainTrie() *nftablesDomainTrie {
+	return &nftablesDomainTrie{}
+}
+
+// reverseLabels split example.com. into [com example]
+func reverseLabels(name string) []string {
+	labels := dns.SplitDomainName(name)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// add returns false if pattern is already in trie
+func (t *nftablesDomainTrie) add(pattern string) bool {
+	subDomainOnly := strings.HasPrefix(pattern, "*.")
+	if subDomainOnly {
+		pattern = pattern[2:]
+	}
+
+	node := t
+	for _, label := range reverseLabels(dns.CanonicalName(pattern)) {
+		if node.children == nil {
+			node.children = make(map[string]*nftablesDomainTrie)
+		}
+		child, ok := node.children[label]
+		if !ok {
+			child = newNftablesDomainTrie()
+			node.children[label] = child
+		}
+		node = child
+	}
+
+	added := !node.suffix || (!subDomainOnly && !node.exact)
+	node.suffix = true
+	if !subDomainOnly {
+		node.exact = true
+	}
+	return added
+}
+
+// compile does nothing, the trie is matched while it's built
+func (t *nftablesDomainTrie) compile() {}
+
+// match walks from the root label and takes O(labels)
+func (t *nftablesDomainTrie) match(name string) bool {
+	labels := reverseLabels(dns.CanonicalName(name))
+	node := t
+	for i, label := range labels {
+		child, ok := node.children[label]
+		if !ok {
+			return false
+		}
+		node = child
+		if i == len(labels)-1 {
+			return node.exact
+		}
+		if node.suffix {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NftablesDomainMatcher match domain names by suffix.
+// "example.com" matches example.com and all of its sub domains, "*.example.com" only matches the sub domains.
+type NftablesDomainMatcher struct {
+	trie  *nftablesDomainTrie
+	count int
+	files []*nftablesDomainFile
+}
+
+func NewNftablesDomainMatcher() *NftablesDomainMatcher {
+	return &NftablesDomainMatcher{
+		trie: newNftablesDomainTrie(),
+	}
+}
+
+func (m *NftablesDomainMatcher) Add(pattern string) {
+	if m.trie.add(pattern) {
+		m.count += 1
+	}
+}
+
+// AddFile also match the domains in file, which is reloaded when it's changed
+func (m *NftablesDomainMatcher) AddFile(file *nftablesDomainFile) {
+	m.files = append(m.files, file)
+}
+
+func (m *NftablesDomainMatcher) Len() int {
+	ret := m.count
+	for _, file := range m.files {
+		ret += file.Len()
+	}
+	return ret
+}
+
+// MatchAny returns true if any of names is matched, the result is kept by the match cache when names are cached
+func (m *NftablesDomainMatcher) MatchAny(names []string) bool {
+	entry := lookupMatchCache(names)
+	if entry == nil {
+		return m.matchAny(names)
+	}
+	if matched, ok := entry.get(m); ok {
+		matchCacheCount.WithLabelValues("hit").Inc()
+		return matched
+	}
+	matchCacheCount.WithLabelValues("miss").Inc()
+	matched := m.matchAny(names)
+	entry.set(m, matched)
+	return matched
+}
+
+func (m *NftablesDomainMatcher) matchAny(names []string) bool {
+	for _, name := range names {
+		if m.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match checks the name and all its parent domains, which takes O(labels)
+func (m *NftablesDomainMatcher) Match(name string) bool {
+	if m.trie.match(name) {
+		return true
+	}
+
+	for _, file := range m.files {
+		if file.Match(name) {
+			return true
+		}
+	}
+
+	return false
+}
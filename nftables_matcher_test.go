@@ -0,0 +1,60 @@
+package coredns_nftables
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDomainMatcher(t *testing.T) {
+	matcher := NewNftablesDomainMatcher()
+	matcher.Add("example.com")
+	matcher.Add("*.cdn.net.")
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"example.com.", true},
+		{"WWW.Example.COM.", true},
+		{"a.b.example.com", true},
+		{"badexample.com.", false},
+		{"cdn.net.", false},
+		{"img.cdn.net.", true},
+		{"com.", false},
+	}
+
+	for _, test := range tests {
+		if got := matcher.Match(test.name); got != test.expected {
+			t.Errorf("Match(%v) expected %v, but got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestDomainFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(path, []byte("# vpn domains\nexample.com\n*.cdn.net\nnftset=/example.org/example.edu/4#inet#filter#VPN\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	file, err := getDomainFile(path)
+	if err != nil {
+		t.Fatalf("getDomainFile failed: %v", err)
+	}
+	matcher := NewNftablesDomainMatcher()
+	matcher.AddFile(file)
+	if matcher.Len() != 4 {
+		t.Fatalf("Expected 4 domains, but got %v", matcher.Len())
+	}
+	if !matcher.Match("www.example.org.") || !matcher.Match("img.cdn.net.") || matcher.Match("cdn.net.") {
+		t.Fatalf("Unexpected match result of %v", path)
+	}
+
+	if err := os.WriteFile(path, []byte("example.net\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	ReloadDomainFiles()
+	if matcher.Match("www.example.org.") || !matcher.Match("www.example.net.") {
+		t.Fatalf("Expected %v reloaded", path)
+	}
+}
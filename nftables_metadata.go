@@ -0,0 +1,90 @@
+package coredns_nftables
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+)
+
+// nftablesRequestMetadata keeps what a request changed in nftables, it's read by the metadata value functions
+type nftablesRequestMetadata struct {
+	lock    sync.Mutex
+	ipCount int
+	sets    []string
+	// values of the metadata actions of matched action chains
+	matches []string
+}
+
+type nftablesRequestMetadataKey struct{}
+
+// Metadata implements the metadata.Provider interface, the values are filled after the response is applied.
+// Responses applied in background by `async true` always report nothing added.
+func (m *NftablesHandler) Metadata(ctx context.Context, state request.Request) context.Context {
+	holder := &nftablesRequestMetadata{}
+	metadata.SetValueFunc(ctx, "nftables/added", func() string {
+		holder.lock.Lock()
+		defer holder.lock.Unlock()
+		return strconv.FormatBool(holder.ipCount > 0)
+	})
+	metadata.SetValueFunc(ctx, "nftables/set", func() string {
+		holder.lock.Lock()
+		defer holder.lock.Unlock()
+		return strings.Join(holder.sets, ",")
+	})
+	metadata.SetValueFunc(ctx, "nftables/ip-count", func() string {
+		holder.lock.Lock()
+		defer holder.lock.Unlock()
+		return strconv.Itoa(holder.ipCount)
+	})
+	metadata.SetValueFunc(ctx, "nftables/match", func() string {
+		holder.lock.Lock()
+		defer holder.lock.Unlock()
+		return strings.Join(holder.matches, ",")
+	})
+	return context.WithValue(ctx, nftablesRequestMetadataKey{}, holder)
+}
+
+// withRequestMetadata returns parent carrying the metadata of the request of ctx, so that the work detached from
+// the request context still fills it
+func withRequestMetadata(parent context.Context, ctx context.Context) context.Context {
+	holder, ok := ctx.Value(nftablesRequestMetadataKey{}).(*nftablesRequestMetadata)
+	if !ok {
+		return parent
+	}
+	return context.WithValue(parent, nftablesRequestMetadataKey{}, holder)
+}
+
+// recordRequestMetadata fill the metadata of the request with the count of addresses applied and the sets
+// they are applied to
+func recordRequestMetadata(ctx context.Context, ipCount int, sets []string) {
+	holder, ok := ctx.Value(nftablesRequestMetadataKey{}).(*nftablesRequestMetadata)
+	if !ok {
+		return
+	}
+
+	holder.lock.Lock()
+	defer holder.lock.Unlock()
+	holder.ipCount = ipCount
+	holder.sets = sets
+}
+
+// recordMatchMetadata append value to the metadata nftables/match of the request, the same value is kept once
+func recordMatchMetadata(ctx context.Context, value string) {
+	holder, ok := ctx.Value(nftablesRequestMetadataKey{}).(*nftablesRequestMetadata)
+	if !ok {
+		return
+	}
+
+	holder.lock.Lock()
+	defer holder.lock.Unlock()
+	for _, match := range holder.matches {
+		if match == value {
+			return
+		}
+	}
+	holder.matches = append(holder.matches, value)
+}
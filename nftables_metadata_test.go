@@ -0,0 +1,34 @@
+package coredns_nftables
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestMetadata(t *testing.T) {
+	handle := NewNftablesHandler()
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	ctx := handle.Metadata(metadata.ContextWithMetadata(context.Background()), request.Request{W: &test.ResponseWriter{}, Req: r})
+
+	values := func() (string, string, string) {
+		return metadata.ValueFunc(ctx, "nftables/added")(), metadata.ValueFunc(ctx, "nftables/set")(), metadata.ValueFunc(ctx, "nftables/ip-count")()
+	}
+	if added, sets, count := values(); added != "false" || sets != "" || count != "0" {
+		t.Errorf("Expected nothing added before serving, but got %v %v %v", added, sets, count)
+	}
+
+	// The work detached from the request context fills the metadata of the request
+	recordRequestMetadata(withRequestMetadata(context.Background(), ctx), 2, []string{"ipv4/filter/VPN", "ipv6/filter/VPN6"})
+	if added, sets, count := values(); added != "true" || sets != "ipv4/filter/VPN,ipv6/filter/VPN6" || count != "2" {
+		t.Errorf("Expected 2 addresses added, but got %v %v %v", added, sets, count)
+	}
+
+	// Requests without the metadata plugin are ignored
+	recordRequestMetadata(withRequestMetadata(context.Background(), context.Background()), 1, nil)
+}
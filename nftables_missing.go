@@ -0,0 +1,103 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// NftablesMissingPolicy decides how the sets deleted by other tools are handled when a flush fails with ENOENT
+type NftablesMissingPolicy int
+
+const (
+	// The sets are resolved again by name, the ones still missing fail
+	NftablesMissingResolve NftablesMissingPolicy = iota
+	// The sets still missing are created again by the definitions cached, with their tables
+	NftablesMissingRecreate
+)
+
+var missingPolicy NftablesMissingPolicy = NftablesMissingResolve
+
+func parseMissingPolicy(name string) (NftablesMissingPolicy, error) {
+	switch strings.ToLower(name) {
+	case "resolve":
+		return NftablesMissingResolve, nil
+	case "recreate":
+		return NftablesMissingRecreate, nil
+	}
+
+	return NftablesMissingResolve, fmt.Errorf("missing set policy %v not supported, use resolve or recreate", name)
+}
+
+func (policy NftablesMissingPolicy) String() string {
+	if policy == NftablesMissingRecreate {
+		return "recreate"
+	}
+	return "resolve"
+}
+
+// SetMissingPolicy set how the sets missing in a flush failed with ENOENT are handled
+func SetMissingPolicy(policy NftablesMissingPolicy) {
+	missingPolicy = policy
+}
+
+// tableExists returns true if the table is listed by the connection
+func (cache *NftablesCache) tableExists(table *nftables.Table) bool {
+	tables, err := cache.NftableConnection.ListTablesOfFamily(table.Family)
+	if err != nil {
+		// assume it exists, so it's never created again by mistake
+		return true
+	}
+	for _, exists := range tables {
+		if exists.Name == table.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverMissingSets forget the definitions of the sets of a batch failed with ENOENT, since the table or set may
+// be deleted or recreated by other tools, and resolve them again by name. The sets still missing are created again
+// with NftablesMissingRecreate. It returns true if the batch can be flushed again.
+func (batch *NftablesBatch) recoverMissingSets() bool {
+	retry := false
+	tables := make(map[*NftableCache]bool)
+	for _, entry := range batch.entries {
+		if entry.create {
+			continue
+		}
+		tableCache := entry.tableCache
+		delete(tableCache.setCache, entry.set.Name)
+		delete(tableCache.setHandles, entry.set.Name)
+		if set := batch.cache.GetSetDefinition(tableCache, entry.set.Name); set != nil {
+			entry.set = set
+			retry = true
+			continue
+		}
+
+		family := getFamilyName(tableCache.table.Family)
+		if missingPolicy != NftablesMissingRecreate {
+			log.Warningf("Nftables set %v %v %v is missing, it's deleted by other tools", family, tableCache.table.Name, entry.set.Name)
+			missingSetCount.WithLabelValues("missing").Inc()
+			continue
+		}
+		if _, ok := tables[tableCache]; !ok && !tableCache.pending {
+			tables[tableCache] = batch.cache.tableExists(tableCache.table)
+			if !tables[tableCache] {
+				log.Warningf("Nftables table %v %v is missing, create it again", family, tableCache.table.Name)
+				tableCache.pending = true
+				tableCache.setCache = make(map[string]*nftables.Set)
+				tableCache.setHandles = make(map[string]uint64)
+			}
+		}
+		log.Warningf("Nftables set %v %v %v is missing, create it again", family, tableCache.table.Name, entry.set.Name)
+		missingSetCount.WithLabelValues("recreated").Inc()
+		recreated := *entry.set
+		recreated.ID = 0
+		entry.set = &recreated
+		entry.create = true
+		retry = true
+	}
+	return retry
+}
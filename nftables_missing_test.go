@@ -0,0 +1,86 @@
+package coredns_nftables
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// unresolvableBackend hides the handles of the memory backend, so deleted sets are only found by ENOENT
+type unresolvableBackend struct {
+	NftBackend
+}
+
+func TestMissingSetRecovery(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	external := NewMemoryBackend(ruleset)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	define := func() {
+		external.AddTable(table)
+		external.AddSet(&nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr, HasTimeout: true, Timeout: time.Hour}, nil)
+		if err := external.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	define()
+	defer SetMissingPolicy(NftablesMissingResolve)
+
+	cache := &NftablesCache{
+		tables:            make(map[nftables.TableFamily]*map[string]*NftableCache),
+		NftableConnection: &unresolvableBackend{NewMemoryBackend(ruleset)},
+	}
+	commit := func(ip string) error {
+		batch := NewNftablesBatch(cache)
+		tableCache := cache.MutableNftablesTable(nftables.TableFamilyIPv4, "filter")
+		set := batch.GetSet(tableCache, "VPN")
+		if set == nil {
+			t.Fatalf("Expected set VPN resolved")
+		}
+		answer := newTestBatchAnswer(t, "example.com. 300 IN A "+ip)
+		batch.AddElement(tableCache, set, nftables.SetElement{Key: net.ParseIP(ip).To4()}, NftablesAppliedElement{
+			Family:    nftables.TableFamilyIPv4,
+			TableName: "filter",
+			SetName:   "VPN",
+			Element:   ip,
+		}, answer)
+		batch.Commit()
+		_, err := batch.AnswerResult(answer)
+		return err
+	}
+
+	if err := commit("192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	external.DelSet(&nftables.Set{Table: table, Name: "VPN"})
+	external.Flush()
+	missing := testutil.ToFloat64(missingSetCount.WithLabelValues("missing"))
+	if err := commit("192.0.2.2"); err == nil || testutil.ToFloat64(missingSetCount.WithLabelValues("missing"))-missing != 1 {
+		t.Errorf("Expected the missing set failed and counted, but got %v", err)
+	}
+
+	// the table is deleted too, both are created again
+	define()
+	if err := commit("192.0.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	external.DelTable(table)
+	external.Flush()
+	SetMissingPolicy(NftablesMissingRecreate)
+	recreated := testutil.ToFloat64(missingSetCount.WithLabelValues("recreated"))
+	if err := commit("192.0.2.4"); err != nil {
+		t.Fatalf("Expected the element added after the set is created again, but got %v", err)
+	}
+	if testutil.ToFloat64(missingSetCount.WithLabelValues("recreated"))-recreated != 1 || cache.HasNftableConnectionError {
+		t.Errorf("Expected the recreated set counted and the connection kept")
+	}
+	set, err := external.GetSetByName(table, "VPN")
+	if err != nil || !set.HasTimeout || set.Timeout != time.Hour {
+		t.Fatalf("Expected the set created again by the cached definition, but got %+v, %v", set, err)
+	}
+	if elements, _ := external.GetSetElements(set); len(elements) != 1 {
+		t.Errorf("Expected 1 element in the recreated set, but got %v", elements)
+	}
+}
@@ -0,0 +1,198 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+var elementMonitorLock sync.Mutex = sync.Mutex{}
+var elementMonitorEnabled bool = false
+var elementMonitorRefs int = 0
+var elementMonitorConn *netlink.Conn = nil
+
+var liveElementsDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(plugin.Namespace, "nftables", "live_elements"),
+	"Elements added by the plugin and not expired or deleted yet.",
+	[]string{"family", "table", "set"}, nil)
+
+type nftablesLiveElementsCollector struct{}
+
+func init() {
+	prometheus.MustRegister(&nftablesLiveElementsCollector{})
+}
+
+func (c *nftablesLiveElementsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- liveElementsDesc
+}
+
+func (c *nftablesLiveElementsCollector) Collect(ch chan<- prometheus.Metric) {
+	elementMonitorLock.Lock()
+	enabled := elementMonitorEnabled
+	elementMonitorLock.Unlock()
+	if !enabled {
+		return
+	}
+
+	for _, elements := range GetTrackedElements() {
+		if len(elements) == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(liveElementsDesc, prometheus.GaugeValue, float64(len(elements)),
+			getFamilyName(elements[0].Family), elements[0].TableName, elements[0].SetName)
+	}
+}
+
+// SetElementMonitor enable subscribing the element deletion events of nftables
+func SetElementMonitor(enable bool) {
+	elementMonitorLock.Lock()
+	defer elementMonitorLock.Unlock()
+
+	elementMonitorEnabled = enable
+	if enable {
+		EnableElementTracker(true)
+	}
+}
+
+// StartElementMonitor subscribe the element deletion events when the first handler starts
+func StartElementMonitor() {
+	elementMonitorLock.Lock()
+	defer elementMonitorLock.Unlock()
+
+	elementMonitorRefs += 1
+	if elementMonitorConn != nil || !elementMonitorEnabled {
+		return
+	}
+
+	conn, err := dialNetfilter(&netlink.Config{Groups: 1 << (unix.NFNLGRP_NFTABLES - 1)})
+	if err != nil {
+		log.Errorf("Nftables subscribe element events failed, the live elements only expire by timeout. %v", err)
+		return
+	}
+	elementMonitorConn = conn
+
+	go func(conn *netlink.Conn) {
+		for {
+			messages, err := conn.Receive()
+			if err != nil {
+				elementMonitorLock.Lock()
+				stopped := elementMonitorConn != conn
+				elementMonitorLock.Unlock()
+				if stopped {
+					return
+				}
+				// ENOBUFS means some events are lost, keep receiving the later ones
+				log.Warningf("Nftables receive element events failed. %v", err)
+				continue
+			}
+
+			for _, message := range messages {
+				if message.Header.Type != netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8|unix.NFT_MSG_DELSETELEM) {
+					continue
+				}
+				if err := handleDeleteElementsEvent(message.Data); err != nil {
+					log.Warningf("Nftables decode element deletion event failed. %v", err)
+				}
+			}
+		}
+	}(conn)
+}
+
+// StopElementMonitor unsubscribe the element deletion events when the last handler stops
+func StopElementMonitor() {
+	elementMonitorLock.Lock()
+	defer elementMonitorLock.Unlock()
+
+	if elementMonitorRefs > 0 {
+		elementMonitorRefs -= 1
+	}
+	if elementMonitorRefs == 0 && elementMonitorConn != nil {
+		conn := elementMonitorConn
+		elementMonitorConn = nil
+		conn.Close()
+	}
+}
+
+// handleDeleteElementsEvent forget the deleted elements which were added by this plugin, the event is a nfgenmsg
+// followed by NFTA_SET_ELEM_LIST_* attributes
+func handleDeleteElementsEvent(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("message too short")
+	}
+	family := nftables.TableFamily(data[0])
+
+	decoder, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return err
+	}
+
+	var tableName, setName string
+	var keys [][]byte
+	for decoder.Next() {
+		switch decoder.Type() {
+		case unix.NFTA_SET_ELEM_LIST_TABLE:
+			tableName = decoder.String()
+		case unix.NFTA_SET_ELEM_LIST_SET:
+			setName = decoder.String()
+		case unix.NFTA_SET_ELEM_LIST_ELEMENTS:
+			decoder.Nested(func(elements *netlink.AttributeDecoder) error {
+				for elements.Next() {
+					if elements.Type() != unix.NFTA_LIST_ELEM {
+						continue
+					}
+					elements.Nested(func(element *netlink.AttributeDecoder) error {
+						for element.Next() {
+							if element.Type() != unix.NFTA_SET_ELEM_KEY {
+								continue
+							}
+							element.Nested(func(value *netlink.AttributeDecoder) error {
+								for value.Next() {
+									if value.Type() == unix.NFTA_DATA_VALUE {
+										keys = append(keys, value.Bytes())
+									}
+								}
+								return nil
+							})
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		}
+	}
+	if err := decoder.Err(); err != nil {
+		return err
+	}
+
+	var deleted []NftablesAppliedElement
+	for _, key := range keys {
+		forgetExistingElement(family, tableName, setName, key)
+		element, ok := UntrackElement(family, tableName, setName, key)
+		if !ok {
+			continue
+		}
+
+		log.Debugf("Nftables element %v(%v) is removed from %v %v %v", element.Element, element.Name, getFamilyName(family), tableName, setName)
+		deleted = append(deleted, NftablesAppliedElement{
+			Family:    family,
+			TableName: tableName,
+			SetName:   setName,
+			Element:   element.Element,
+			Name:      element.Name,
+			Timeout:   element.Timeout,
+		})
+		if len(key) == net.IPv4len || len(key) == net.IPv6len {
+			lruRemoveIp(net.IP(key).String())
+		}
+	}
+	WriteAppliedLog("delete", deleted)
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package coredns_nftables
+
+import (
+	"github.com/miekg/dns"
+)
+
+var preserveNameCase bool = false
+
+// SetPreserveNameCase keep the case of owner names, names are lowercased by default
+func SetPreserveNameCase(preserve bool) {
+	preserveNameCase = preserve
+}
+
+// normalizeName returns the fully qualified name used by matchers, limiters, logs and other name keyed features,
+// so that case-randomizing upstreams(DNS 0x20) do not split the same name into different keys
+func normalizeName(name string) string {
+	if preserveNameCase {
+		return dns.Fqdn(name)
+	}
+	return dns.CanonicalName(name)
+}
@@ -0,0 +1,132 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mdlayher/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+var networkNamespaceLock sync.Mutex = sync.Mutex{}
+var networkNamespace NftablesNetworkNamespace = NftablesNetworkNamespace{}
+
+// NftablesNetworkNamespace selects a network namespace by the name of `ip netns`(kind name), a path like
+// /var/run/netns/<name> or /proc/<pid>/ns/net(kind path) or the pid of a process in it(kind pid). The zero value
+// selects the namespace of `netns`, or the one of CoreDNS.
+type NftablesNetworkNamespace struct {
+	Kind  string
+	Value string
+}
+
+// ParseNetworkNamespace validate kind and value of a network namespace, empty kind is the default namespace
+func ParseNetworkNamespace(kind string, value string) (NftablesNetworkNamespace, error) {
+	kind = strings.ToLower(kind)
+	switch kind {
+	case "":
+		return NftablesNetworkNamespace{}, nil
+	case "name":
+		if len(value) == 0 || strings.Contains(value, "/") {
+			return NftablesNetworkNamespace{}, fmt.Errorf("name %v invalid", value)
+		}
+	case "path":
+		if len(value) == 0 {
+			return NftablesNetworkNamespace{}, fmt.Errorf("path can not be empty")
+		}
+	case "pid":
+		pid, err := strconv.Atoi(value)
+		if err != nil || pid <= 0 {
+			return NftablesNetworkNamespace{}, fmt.Errorf("pid %v invalid", value)
+		}
+	default:
+		return NftablesNetworkNamespace{}, fmt.Errorf("kind %v unknown, expect name, path or pid", kind)
+	}
+	return NftablesNetworkNamespace{Kind: kind, Value: value}, nil
+}
+
+func (ns NftablesNetworkNamespace) IsDefault() bool {
+	return len(ns.Kind) == 0
+}
+
+// String returns `<kind> <value>`, or empty for the default namespace
+func (ns NftablesNetworkNamespace) String() string {
+	if ns.IsDefault() {
+		return ""
+	}
+	return ns.Kind + " " + ns.Value
+}
+
+// SetNetworkNamespace select the network namespace programmed by the plugin, see NftablesNetworkNamespace. The
+// namespace is opened for every new connection, so a container restarted with a new namespace is followed after
+// the connections are recycled. Empty kind selects the namespace of CoreDNS.
+func SetNetworkNamespace(kind string, value string) error {
+	ns, err := ParseNetworkNamespace(kind, value)
+	if err != nil {
+		return err
+	}
+
+	networkNamespaceLock.Lock()
+	defer networkNamespaceLock.Unlock()
+
+	networkNamespace = ns
+	return nil
+}
+
+// GetNetworkNamespace returns the kind and value set by SetNetworkNamespace
+func GetNetworkNamespace() (string, string) {
+	networkNamespaceLock.Lock()
+	defer networkNamespaceLock.Unlock()
+
+	return networkNamespace.Kind, networkNamespace.Value
+}
+
+// openNetworkNamespace returns the handle of ns(the one of SetNetworkNamespace when it's the default), or 0 for
+// the namespace of CoreDNS. The handle must be closed by cleanupSystemNFTConn().
+func openNetworkNamespace(ns NftablesNetworkNamespace) (netns.NsHandle, error) {
+	if ns.IsDefault() {
+		networkNamespaceLock.Lock()
+		ns = networkNamespace
+		networkNamespaceLock.Unlock()
+	}
+
+	var handle netns.NsHandle
+	var err error
+	switch ns.Kind {
+	case "":
+		return 0, nil
+	case "name":
+		handle, err = netns.GetFromName(ns.Value)
+	case "path":
+		handle, err = netns.GetFromPath(ns.Value)
+	case "pid":
+		pid, _ := strconv.Atoi(ns.Value)
+		handle, err = netns.GetFromPid(pid)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("open network namespace %v failed, %v", ns, err)
+	}
+	return handle, nil
+}
+
+// dialNetfilter open a netfilter netlink socket in the selected network namespace, the socket stays in the
+// namespace after it's created
+func dialNetfilter(config *netlink.Config) (*netlink.Conn, error) {
+	return dialNetfilterIn(NftablesNetworkNamespace{}, config)
+}
+
+func dialNetfilterIn(namespace NftablesNetworkNamespace, config *netlink.Config) (*netlink.Conn, error) {
+	ns, err := openNetworkNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanupSystemNFTConn(ns)
+
+	if config == nil {
+		config = &netlink.Config{}
+	}
+	config.NetNS = int(ns)
+	return netlink.Dial(unix.NETLINK_NETFILTER, config)
+}
@@ -0,0 +1,82 @@
+package coredns_nftables
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestParseNetworkNamespace(t *testing.T) {
+	for _, kind := range [][]string{{"name", "vpn"}, {"PATH", "/proc/1/ns/net"}, {"pid", "1"}, {"", ""}} {
+		if _, err := ParseNetworkNamespace(kind[0], kind[1]); err != nil {
+			t.Errorf("Expected netns %v %v valid, but got %v", kind[0], kind[1], err)
+		}
+	}
+	for _, kind := range [][]string{{"name", "a/b"}, {"path", ""}, {"pid", "0"}, {"pid", "abc"}, {"fd", "3"}} {
+		if _, err := ParseNetworkNamespace(kind[0], kind[1]); err == nil {
+			t.Errorf("Expected netns %v %v invalid", kind[0], kind[1])
+		}
+	}
+
+	ns, _ := ParseNetworkNamespace("Name", "vpn")
+	if ns.String() != "name vpn" || ns.IsDefault() {
+		t.Errorf("Expected netns name vpn, but got %v", ns)
+	}
+}
+
+func TestBatchInNamespace(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+	}()
+
+	cache, err := NewCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := NewNftablesBatch(cache)
+	if same, err := batch.InNamespace(NftablesNetworkNamespace{}); err != nil || same != batch {
+		t.Fatalf("Expected the default namespace uses the same batch, but got %v", err)
+	}
+
+	ns := NftablesNetworkNamespace{Kind: "name", Value: "tenant"}
+	child, err := batch.InNamespace(ns)
+	if err != nil || child == batch || child.Cache() == cache || child.Cache().Namespace != ns {
+		t.Fatalf("Expected another batch of namespace %v, but got %v", ns, err)
+	}
+	if again, _ := batch.InNamespace(ns); again != child {
+		t.Errorf("Expected the batch of namespace %v is reused", ns)
+	}
+
+	tableCache := child.Cache().MutableNftablesTable(nftables.TableFamilyIPv4, "coredns_netns")
+	set := &nftables.Set{Table: tableCache.table, Name: "NETNS_SET", KeyType: nftables.TypeIPAddr}
+	child.CreateSet(tableCache, set, nil)
+	child.AddElement(tableCache, set, nftables.SetElement{Key: net.ParseIP("192.0.2.1").To4()}, NftablesAppliedElement{
+		Family:    nftables.TableFamilyIPv4,
+		TableName: "coredns_netns",
+		SetName:   "NETNS_SET",
+	}, newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1"))
+
+	batch.Commit()
+	if !batch.Flushed() || batch.Failed() {
+		t.Errorf("Expected the batch of namespace %v is committed with its parent", ns)
+	}
+	if applied := batch.AppliedSets(); len(applied) != 1 || applied[0] != "ipv4/coredns_netns/NETNS_SET" {
+		t.Errorf("Expected the set of namespace %v applied, but got %v", ns, applied)
+	}
+
+	batch.Release()
+	CloseCache(cache)
+
+	// the pool selects connections by namespace
+	if selected, _ := NewCacheInNamespace(ns); selected != child.Cache() {
+		t.Errorf("Expected the connection of namespace %v selected from the pool", ns)
+	}
+	if selected, _ := NewCache(); selected != cache {
+		t.Errorf("Expected the connection of the default namespace selected from the pool")
+	}
+}
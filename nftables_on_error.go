@@ -0,0 +1,142 @@
+package coredns_nftables
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// NftablesOnErrorPolicy decides what ServeDNS answers when the elements of a response can not be added in
+// synchronous mode
+type NftablesOnErrorPolicy int
+
+const (
+	// The response is served anyway
+	NftablesOnErrorServe NftablesOnErrorPolicy = iota
+	// SERVFAIL is answered instead of the response
+	NftablesOnErrorServfail
+	// REFUSED is answered instead of the response
+	NftablesOnErrorRefuse
+)
+
+func parseOnErrorPolicy(name string) (NftablesOnErrorPolicy, error) {
+	switch strings.ToLower(name) {
+	case "serve":
+		return NftablesOnErrorServe, nil
+	case "servfail":
+		return NftablesOnErrorServfail, nil
+	case "refuse":
+		return NftablesOnErrorRefuse, nil
+	}
+
+	return NftablesOnErrorServe, fmt.Errorf("on-error policy %v not supported, use serve, servfail or refuse", name)
+}
+
+func (policy NftablesOnErrorPolicy) String() string {
+	switch policy {
+	case NftablesOnErrorServfail:
+		return "servfail"
+	case NftablesOnErrorRefuse:
+		return "refuse"
+	}
+	return "serve"
+}
+
+const onErrorDefaultEDEText = "firewall update failed"
+
+// parseExtendedErrorCode parse the info-code of an extended DNS error by number or name of RFC 8914, the spaces
+// of names are optional, like `Other`, `Prohibited` or `NotReady`
+func parseExtendedErrorCode(value string) (uint16, error) {
+	if code, err := strconv.ParseUint(value, 10, 16); err == nil {
+		return uint16(code), nil
+	}
+	name := strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(value))
+	for code, text := range dns.ExtendedErrorCodeToString {
+		if strings.ToLower(strings.ReplaceAll(text, " ", "")) == name {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("extended error code %v unknown", value)
+}
+
+// parseOnErrorEDE returns the extended DNS error attached to the answers of failed updates by `[CODE] [TEXT...]`,
+// the code is Other and the text is onErrorDefaultEDEText by default
+func parseOnErrorEDE(args []string) (*dns.EDNS0_EDE, error) {
+	ede := &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther, ExtraText: onErrorDefaultEDEText}
+	if len(args) > 0 {
+		code, err := parseExtendedErrorCode(args[0])
+		if err != nil {
+			return nil, err
+		}
+		ede.InfoCode = code
+	}
+	if len(args) > 1 {
+		ede.ExtraText = strings.Join(args[1:], " ")
+	}
+	return ede, nil
+}
+
+// attachEDE add ede into the OPT record of reply, clients not sending EDNS never get it
+func attachEDE(reply *dns.Msg, request *dns.Msg, ede *dns.EDNS0_EDE) {
+	if ede == nil || request.IsEdns0() == nil {
+		return
+	}
+	opt := reply.IsEdns0()
+	if opt == nil {
+		reply.SetEdns0(request.IsEdns0().UDPSize(), request.IsEdns0().Do())
+		opt = reply.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: ede.InfoCode, ExtraText: ede.ExtraText})
+}
+
+// nftablesUpdateFailure counts the answers of a request which are not added, it's filled by serveWorker
+type nftablesUpdateFailure struct {
+	failures int32
+}
+
+type nftablesUpdateFailureKey struct{}
+
+// withUpdateFailure returns parent recording whether the update of the request failed
+func withUpdateFailure(parent context.Context) (context.Context, *nftablesUpdateFailure) {
+	failure := &nftablesUpdateFailure{}
+	return context.WithValue(parent, nftablesUpdateFailureKey{}, failure), failure
+}
+
+// recordUpdateFailure mark the update of the request of ctx failed for count answers, also for the health check
+func recordUpdateFailure(ctx context.Context, count int) {
+	if count <= 0 {
+		return
+	}
+	recordHealthFailure()
+	failure, ok := ctx.Value(nftablesUpdateFailureKey{}).(*nftablesUpdateFailure)
+	if !ok {
+		return
+	}
+	atomic.AddInt32(&failure.failures, int32(count))
+}
+
+func (failure *nftablesUpdateFailure) Failed() bool {
+	return atomic.LoadInt32(&failure.failures) > 0
+}
+
+// failedReply returns the reply of request answered instead of the response by policy, nil means serving the
+// response
+func (policy NftablesOnErrorPolicy) failedReply(request *dns.Msg) *dns.Msg {
+	var rcode int
+	switch policy {
+	case NftablesOnErrorServfail:
+		rcode = dns.RcodeServerFailure
+	case NftablesOnErrorRefuse:
+		rcode = dns.RcodeRefused
+	default:
+		return nil
+	}
+
+	reply := new(dns.Msg)
+	reply.SetRcode(request, rcode)
+	return reply
+}
@@ -0,0 +1,127 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+func TestOnErrorPolicy(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	failed := false
+	SetNftBackendFactory(func() (NftBackend, error) {
+		if failed {
+			return nil, errors.New("netlink unavailable")
+		}
+		return NewMemoryBackend(ruleset), nil
+	})
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+	}()
+
+	ede, _ := parseOnErrorEDE(nil)
+	serve := func(policy NftablesOnErrorPolicy) *dns.Msg {
+		handle := NewNftablesHandler()
+		handle.OnError = policy
+		handle.OnErrorEDE = ede
+		ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_on_error", SetName: "ON_ERROR", KeyType: nftables.TypeInvalid})
+		handle.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			reply := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.160")
+			reply.SetReply(r)
+			w.WriteMsg(reply)
+			return dns.RcodeSuccess, nil
+		})
+
+		request := new(dns.Msg)
+		request.SetQuestion("example.org.", dns.TypeA)
+		request.SetEdns0(1232, false)
+		recorder := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := handle.ServeDNS(context.Background(), recorder, request); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		return recorder.Msg
+	}
+
+	if reply := serve(NftablesOnErrorRefuse); reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 || replyEDE(reply) != nil {
+		t.Errorf("Expected the response served without EDE when the update succeeded, but got %v", reply)
+	}
+
+	failed = true
+	ClearCache()
+	for _, c := range []struct {
+		policy NftablesOnErrorPolicy
+		rcode  int
+		answer int
+	}{
+		{NftablesOnErrorServe, dns.RcodeSuccess, 1},
+		{NftablesOnErrorServfail, dns.RcodeServerFailure, 0},
+		{NftablesOnErrorRefuse, dns.RcodeRefused, 0},
+	} {
+		reply := serve(c.policy)
+		if reply.Rcode != c.rcode || len(reply.Answer) != c.answer {
+			t.Errorf("Expected on-error %v answers %v with %v answer(s), but got %v", c.policy, dns.RcodeToString[c.rcode], c.answer, reply)
+		}
+		if option := replyEDE(reply); option == nil || option.InfoCode != dns.ExtendedErrorCodeOther || option.ExtraText != onErrorDefaultEDEText {
+			t.Errorf("Expected on-error %v attaches EDE %q, but got %v", c.policy, onErrorDefaultEDEText, option)
+		}
+	}
+
+	if _, err := parseOnErrorPolicy("drop"); err == nil {
+		t.Errorf("Expected on-error drop invalid")
+	}
+}
+
+func replyEDE(reply *dns.Msg) *dns.EDNS0_EDE {
+	opt := reply.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if ede, ok := option.(*dns.EDNS0_EDE); ok {
+			return ede
+		}
+	}
+	return nil
+}
+
+func TestParseOnErrorEDE(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		code uint16
+		text string
+	}{
+		{nil, dns.ExtendedErrorCodeOther, onErrorDefaultEDEText},
+		{[]string{"18"}, dns.ExtendedErrorCodeProhibited, onErrorDefaultEDEText},
+		{[]string{"NotReady", "nftables", "unavailable"}, dns.ExtendedErrorCodeNotReady, "nftables unavailable"},
+		{[]string{"network-error"}, dns.ExtendedErrorCodeNetworkError, onErrorDefaultEDEText},
+	} {
+		ede, err := parseOnErrorEDE(c.args)
+		if err != nil || ede.InfoCode != c.code || ede.ExtraText != c.text {
+			t.Errorf("Expected EDE %v %q of %v, but got %v, %v", c.code, c.text, c.args, ede, err)
+		}
+	}
+	if _, err := parseOnErrorEDE([]string{"firewall"}); err == nil {
+		t.Errorf("Expected EDE code firewall invalid")
+	}
+
+	// clients without EDNS never get EDE
+	request := new(dns.Msg)
+	request.SetQuestion("example.org.", dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+	ede, _ := parseOnErrorEDE(nil)
+	attachEDE(reply, request, ede)
+	if reply.IsEdns0() != nil {
+		t.Errorf("Expected no OPT record for clients without EDNS")
+	}
+}
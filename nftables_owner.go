@@ -0,0 +1,328 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// NftElementUserdataReader is implemented by backends which can read back the userdata of elements, so the owner
+// comment of elements can be checked. *nftables.Conn is read by netlink directly.
+type NftElementUserdataReader interface {
+	// GetSetElementsUserdata returns the userdata of the elements of set by their keys, nil if one has none
+	GetSetElementsUserdata(set *nftables.Set) (map[string][]byte, error)
+}
+
+var _ NftElementUserdataReader = (*MemoryBackend)(nil)
+
+type nftablesOwnedSet struct {
+	namespace NftablesNetworkNamespace
+	family    nftables.TableFamily
+	tableName string
+	setName   string
+	elements  map[string]nftablesOwnedElement
+}
+
+type nftablesOwnedElement struct {
+	key        []byte
+	applied    NftablesAppliedElement
+	addTime    time.Time
+	expireTime time.Time
+}
+
+var elementOwnerLock sync.Mutex = sync.Mutex{}
+var elementOwnerComment string = ""
+var flushOwnedOnShutdown bool = false
+var evictOwnedElements bool = false
+var ownedElements = make(map[string]*nftablesOwnedSet)
+
+// SetElementOwnerComment set the comment the elements are added with, so that the elements added by the plugin
+// can be told from the ones managed by operators. Empty disables it.
+func SetElementOwnerComment(comment string) {
+	elementOwnerLock.Lock()
+	defer elementOwnerLock.Unlock()
+
+	elementOwnerComment = comment
+}
+
+func getElementOwnerComment() string {
+	elementOwnerLock.Lock()
+	defer elementOwnerLock.Unlock()
+
+	return elementOwnerComment
+}
+
+// SetFlushOwnedOnShutdown set whether the elements added by the plugin are deleted when CoreDNS stops
+func SetFlushOwnedOnShutdown(enable bool) {
+	elementOwnerLock.Lock()
+	defer elementOwnerLock.Unlock()
+
+	flushOwnedOnShutdown = enable
+	if !enable && !evictOwnedElements {
+		ownedElements = make(map[string]*nftablesOwnedSet)
+	}
+}
+
+// setEvictOwnedElements set whether the elements added by the plugin are recorded for `on-full evict-oldest`, only
+// they can be evicted
+func setEvictOwnedElements(enable bool) {
+	elementOwnerLock.Lock()
+	defer elementOwnerLock.Unlock()
+
+	evictOwnedElements = enable
+	if !enable && !flushOwnedOnShutdown {
+		ownedElements = make(map[string]*nftablesOwnedSet)
+	}
+}
+
+func ownedSetKey(namespace NftablesNetworkNamespace, family nftables.TableFamily, tableName string, setName string) string {
+	return fmt.Sprintf("%v/%v", namespace, trackedSetKey(family, tableName, setName))
+}
+
+// buildOwnerUserdata returns the userdata of elements carrying the owner comment, nil if it's not set
+func buildOwnerUserdata() []byte {
+	comment := getElementOwnerComment()
+	if len(comment) == 0 {
+		return nil
+	}
+	return buildRuleComment(comment)
+}
+
+// isOwnedUserdata returns true if the comment of userdata is the owner comment or the provenance of this plugin
+func isOwnedUserdata(userdata []byte) bool {
+	comment, ok := parseElementComment(userdata)
+	if !ok {
+		return false
+	}
+	if owner := getElementOwnerComment(); len(owner) > 0 && comment == owner {
+		return true
+	}
+	_, err := DecodeElementProvenance(comment)
+	return err == nil
+}
+
+// ownElement record an element added by the plugin, the elements already present and skipped are never owned
+func ownElement(namespace NftablesNetworkNamespace, applied NftablesAppliedElement, key []byte) {
+	elementOwnerLock.Lock()
+	defer elementOwnerLock.Unlock()
+
+	if !flushOwnedOnShutdown && !evictOwnedElements {
+		return
+	}
+	setKey := ownedSetKey(namespace, applied.Family, applied.TableName, applied.SetName)
+	owned, ok := ownedElements[setKey]
+	if !ok {
+		owned = &nftablesOwnedSet{
+			namespace: namespace,
+			family:    applied.Family,
+			tableName: applied.TableName,
+			setName:   applied.SetName,
+			elements:  make(map[string]nftablesOwnedElement),
+		}
+		ownedElements[setKey] = owned
+	}
+	now := time.Now()
+	element := nftablesOwnedElement{key: append([]byte(nil), key...), applied: applied, addTime: now}
+	if old, ok := owned.elements[string(key)]; ok && (old.expireTime.IsZero() || old.expireTime.After(now)) {
+		// the element added again is still the one added first
+		element.addTime = old.addTime
+	}
+	if applied.Timeout > 0 {
+		element.expireTime = now.Add(applied.Timeout)
+	}
+	owned.elements[string(key)] = element
+}
+
+// getOwnedElements returns the living owned elements of a set of the network namespace namespace
+func getOwnedElements(namespace NftablesNetworkNamespace, family nftables.TableFamily, tableName string, setName string) []nftablesOwnedElement {
+	elementOwnerLock.Lock()
+	defer elementOwnerLock.Unlock()
+
+	owned, ok := ownedElements[ownedSetKey(namespace, family, tableName, setName)]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	ret := make([]nftablesOwnedElement, 0, len(owned.elements))
+	for key, element := range owned.elements {
+		if !element.expireTime.IsZero() && !element.expireTime.After(now) {
+			delete(owned.elements, key)
+			continue
+		}
+		ret = append(ret, element)
+	}
+	return ret
+}
+
+// disownElements forget the owned elements of a set of the network namespace namespace, they are deleted
+func disownElements(namespace NftablesNetworkNamespace, family nftables.TableFamily, tableName string, setName string, keys []nftables.SetElement) {
+	elementOwnerLock.Lock()
+	defer elementOwnerLock.Unlock()
+
+	owned, ok := ownedElements[ownedSetKey(namespace, family, tableName, setName)]
+	if !ok {
+		return
+	}
+	for _, key := range keys {
+		delete(owned.elements, string(key.Key))
+	}
+}
+
+// hasOwnedElements returns true if there is any owned element to flush on shutdown
+func hasOwnedElements() bool {
+	elementOwnerLock.Lock()
+	defer elementOwnerLock.Unlock()
+
+	if !flushOwnedOnShutdown {
+		return false
+	}
+	for _, owned := range ownedElements {
+		if len(owned.elements) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// takeOwnedElements returns the living owned elements of each set and forgets all of them, nothing is returned
+// when they are not flushed on shutdown
+func takeOwnedElements() []*nftablesOwnedSet {
+	elementOwnerLock.Lock()
+	defer elementOwnerLock.Unlock()
+
+	if !flushOwnedOnShutdown {
+		return nil
+	}
+
+	now := time.Now()
+	ret := make([]*nftablesOwnedSet, 0, len(ownedElements))
+	for _, owned := range ownedElements {
+		for key, element := range owned.elements {
+			if !element.expireTime.IsZero() && !element.expireTime.After(now) {
+				delete(owned.elements, key)
+			}
+		}
+		if len(owned.elements) > 0 {
+			ret = append(ret, owned)
+		}
+	}
+	ownedElements = make(map[string]*nftablesOwnedSet)
+	return ret
+}
+
+// FlushOwnedElements delete the elements added by the plugin, which are still in the kernel sets. When the backend
+// can read back the comments of elements, the ones without the owner comment are kept, they are added by others
+// before the plugin. It returns how many elements are deleted.
+func FlushOwnedElements() (int, error) {
+	if !hasOwnedElements() {
+		return 0, nil
+	}
+	if err := checkDestructive("flush-owned-on-shutdown"); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	var lastErr error
+	for _, owned := range takeOwnedElements() {
+		count, err := owned.flush()
+		if err != nil {
+			log.Errorf("Nftables flush owned elements of set %v %v %v failed. %v", getFamilyName(owned.family), owned.tableName, owned.setName, err)
+			lastErr = err
+			continue
+		}
+		deleted += count
+	}
+	return deleted, lastErr
+}
+
+// elementCommentReader returns the reader of the comments of the elements in conn, or nil if the elements are not
+// added with comments or the backend can not read them back
+func elementCommentReader(conn NftBackend, namespace NftablesNetworkNamespace) NftElementUserdataReader {
+	if len(getElementOwnerComment()) == 0 && !isElementUserdataEnabled() {
+		return nil
+	}
+	if backend, ok := conn.(NftElementUserdataReader); ok {
+		return backend
+	}
+	if _, ok := conn.(*nftables.Conn); ok {
+		return NewNetlinkBackend(namespace)
+	}
+	return nil
+}
+
+func (owned *nftablesOwnedSet) flush() (int, error) {
+	conn, newNS, err := openBackendIn(owned.namespace)
+	if err != nil {
+		return 0, err
+	}
+	defer cleanupSystemNFTConn(newNS)
+
+	set, err := conn.GetSetByName(&nftables.Table{Family: owned.family, Name: owned.tableName}, owned.setName)
+	if err != nil {
+		return 0, err
+	}
+	reader := elementCommentReader(conn, owned.namespace)
+
+	// only the elements still in the set are deleted, the transaction fails when any of them is missing
+	var userdata map[string][]byte
+	if reader != nil {
+		userdata, err = reader.GetSetElementsUserdata(set)
+		if err != nil {
+			// the elements added by operators before the plugin can not be told apart, so nothing is deleted
+			return 0, fmt.Errorf("read comments of the elements failed, keep them. %w", err)
+		}
+	}
+	var present map[string]bool
+	if userdata == nil {
+		elements, err := conn.GetSetElements(set)
+		if err != nil {
+			return 0, err
+		}
+		present = make(map[string]bool, len(elements))
+		for _, element := range elements {
+			present[string(element.Key)] = true
+		}
+	}
+
+	keys := make([]nftables.SetElement, 0, len(owned.elements))
+	applied := make([]NftablesAppliedElement, 0, len(owned.elements))
+	for key, element := range owned.elements {
+		if userdata != nil {
+			data, ok := userdata[key]
+			if !ok || !isOwnedUserdata(data) {
+				continue
+			}
+		} else if !present[key] {
+			continue
+		}
+		if isPinned(owned.family, owned.tableName, owned.setName, element.key) {
+			continue
+		}
+		keys = append(keys, nftables.SetElement{Key: element.key})
+		applied = append(applied, element.applied)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	err = conn.SetDeleteElements(set, keys)
+	if err == nil {
+		err = conn.Flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	log.Infof("Nftables flush %v owned element(s) of set %v %v %v", len(keys), getFamilyName(owned.family), owned.tableName, owned.setName)
+	WriteAppliedLog("flush-owned", applied)
+	for _, element := range keys {
+		UntrackElement(owned.family, owned.tableName, owned.setName, element.Key)
+		forgetExistingElement(owned.family, owned.tableName, owned.setName, element.Key)
+		if len(element.Key) == net.IPv4len || len(element.Key) == net.IPv6len {
+			lruRemoveIp(net.IP(element.Key).String())
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,105 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestFlushOwnedElements(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	SetElementOwnerComment("coredns")
+	SetFlushOwnedOnShutdown(true)
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		SetElementOwnerComment("")
+		SetFlushOwnedOnShutdown(false)
+		ClearCache()
+	}()
+
+	// 192.0.2.1 is managed by the operator before the plugin adds it
+	backend := NewMemoryBackend(ruleset)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	set := &nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr}
+	backend.AddTable(table)
+	backend.AddSet(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	if err := backend.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	handle := NewNftablesHandler()
+	handle.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddElement = []*NftablesSetAddElement{
+		{TableName: "filter", SetName: "VPN", KeyType: nftables.TypeIPAddr},
+	}
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.1", "example.org. 60 IN A 192.0.2.2")
+	if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+		t.Fatalf("Expected answers applied, but got %v", err)
+	}
+	userdata, err := backend.GetElementUserdata(set, net.ParseIP("192.0.2.2").To4())
+	if comment, _ := parseElementComment(userdata); err != nil || comment != "coredns" {
+		t.Fatalf("Expected the element added with the owner comment, but got %q, %v", userdata, err)
+	}
+
+	if _, err := FlushOwnedElements(); !errors.Is(err, ErrDestructiveDisabled) {
+		t.Fatalf("Expected flush-owned-on-shutdown refused without allow-destructive, but got %v", err)
+	}
+	SetAllowDestructive(true)
+	defer SetAllowDestructive(false)
+	if deleted, err := FlushOwnedElements(); err != nil || deleted != 1 {
+		t.Fatalf("Expected 1 owned element deleted, but got %v, %v", deleted, err)
+	}
+	elements, _ := backend.GetSetElements(set)
+	if len(elements) != 1 || !net.IP(elements[0].Key).Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("Expected only the element of the operator kept, but got %v", elements)
+	}
+	if deleted, err := FlushOwnedElements(); err != nil || deleted != 0 {
+		t.Errorf("Expected owned elements forgotten after flushed, but got %v, %v", deleted, err)
+	}
+}
+
+// unreadableCommentsBackend fails to read the comments of elements
+type unreadableCommentsBackend struct {
+	*MemoryBackend
+}
+
+func (backend *unreadableCommentsBackend) GetSetElementsUserdata(set *nftables.Set) (map[string][]byte, error) {
+	return nil, errors.New("comments unavailable")
+}
+
+func TestFlushOwnedElementsUnreadableComments(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) {
+		return &unreadableCommentsBackend{MemoryBackend: NewMemoryBackend(ruleset)}, nil
+	})
+	SetElementOwnerComment("coredns")
+	SetFlushOwnedOnShutdown(true)
+	SetAllowDestructive(true)
+	defer func() {
+		SetNftBackendFactory(nil)
+		SetElementOwnerComment("")
+		SetFlushOwnedOnShutdown(false)
+		SetAllowDestructive(false)
+	}()
+
+	backend := NewMemoryBackend(ruleset)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	set := &nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr}
+	backend.AddTable(table)
+	backend.AddSet(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	if err := backend.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	ownElement(NftablesNetworkNamespace{}, NftablesAppliedElement{Family: nftables.TableFamilyIPv4, TableName: "filter", SetName: "VPN"}, net.ParseIP("192.0.2.1").To4())
+
+	if deleted, err := FlushOwnedElements(); err == nil || deleted != 0 {
+		t.Errorf("Expected the set skipped when its comments can not be read, but got %v, %v", deleted, err)
+	}
+	if elements, _ := backend.GetSetElements(set); len(elements) != 1 {
+		t.Errorf("Expected the element kept, but got %v", elements)
+	}
+}
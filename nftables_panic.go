@@ -0,0 +1,55 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"runtime/debug"
+
+	"github.com/coredns/coredns/plugin/metrics"
+)
+
+// ErrNftablesPanic fails the answers of a batch which Commit panics in
+var ErrNftablesPanic = errors.New("nftables operation panicked")
+
+// isolatePanic call fn and recover from its panic, so one malformed answer or a panic of the backend library never
+// takes down the DNS server. The panic is counted by stage and logged with the subject and the stack, subject is
+// only called after a panic. It returns true if fn panicked.
+func isolatePanic(ctx context.Context, stage string, subject func() string, fn func()) (panicked bool) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+		panicked = true
+		panicCount.WithLabelValues(metrics.WithServer(ctx), stage).Inc()
+		log.Errorf("Nftables recover from panic of %v %q. %v\n%s", stage, describePanicSubject(subject), recovered, debug.Stack())
+	}()
+
+	fn()
+	return false
+}
+
+// describePanicSubject returns the text of subject, the malformed answer may panic again when it's formatted
+func describePanicSubject(subject func() string) (ret string) {
+	defer func() {
+		if recover() != nil {
+			ret = "<malformed>"
+		}
+	}()
+	return subject()
+}
+
+// fail marks all staged operations and answers of the batch failed with err
+func (batch *NftablesBatch) fail(err error) {
+	batch.flushed = true
+	for _, entry := range batch.entries {
+		entry.err = err
+		entry.followers = nil
+	}
+	for answer := range batch.answerApplied {
+		batch.answerErrors[answer] = err
+	}
+	for _, child := range batch.namespaces {
+		child.fail(err)
+	}
+}
@@ -0,0 +1,39 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIsolatePanic(t *testing.T) {
+	if isolatePanic(context.Background(), "answer", func() string { return "ok" }, func() {}) {
+		t.Errorf("Expected no panic")
+	}
+	if !isolatePanic(context.Background(), "answer", func() string { panic("malformed") }, func() { panic("oops") }) {
+		t.Errorf("Expected the panic recovered")
+	}
+	if subject := describePanicSubject(func() string { panic("malformed") }); subject != "<malformed>" {
+		t.Errorf("Expected <malformed>, but got %q", subject)
+	}
+}
+
+func TestBatchFail(t *testing.T) {
+	answer, err := dns.NewRR("example.org. 60 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := NewNftablesBatch(&NftablesCache{})
+	batch.answerApplied[&answer] = 1
+	batch.entries = append(batch.entries, &nftablesBatchEntry{})
+
+	batch.fail(ErrNftablesPanic)
+	if applied, err := batch.AnswerResult(&answer); applied != 0 || !errors.Is(err, ErrNftablesPanic) {
+		t.Errorf("Expected the answer failed by the panic, but got %v, %v", applied, err)
+	}
+	if !errors.Is(batch.entries[0].err, ErrNftablesPanic) {
+		t.Errorf("Expected the entry failed by the panic, but got %v", batch.entries[0].err)
+	}
+}
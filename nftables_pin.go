@@ -0,0 +1,224 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// How often the pinned elements are checked and added back when missing
+const pinCheckInterval = 30 * time.Second
+
+var pinLock sync.Mutex = sync.Mutex{}
+var pinRefs int = 0
+var pinStop chan struct{} = nil
+var pinnedNetworks = make(map[string][]*net.IPNet)
+
+// parsePins parse the addresses and networks pinned in a set, networks are only allowed in interval sets
+func parsePins(args []string, keyType nftables.SetDatatype, interval bool) ([]*net.IPNet, error) {
+	networks, err := parseCIDRs(args)
+	if err != nil {
+		return nil, err
+	}
+	for _, network := range networks {
+		ones, bits := network.Mask.Size()
+		if ones != bits && !interval {
+			return nil, fmt.Errorf("network %v can only be pinned in interval sets", network)
+		}
+		if keyType != nftables.TypeInvalid && len(network.IP) != int(keyType.Bytes) {
+			return nil, fmt.Errorf("address %v does not match key type %v", network, keyType.Name)
+		}
+	}
+	return networks, nil
+}
+
+// pinElements returns the elements of network, a network in interval sets is a range ending with the next
+// address after it
+func pinElements(network *net.IPNet, interval bool) []nftables.SetElement {
+	ret := []nftables.SetElement{{Key: network.IP}}
+	if !interval {
+		return ret
+	}
+
+	end := make(net.IP, len(network.IP))
+	overflow := true
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i] = network.IP[i] | ^network.Mask[i]
+	}
+	for i := len(end) - 1; i >= 0 && overflow; i-- {
+		end[i] += 1
+		overflow = end[i] == 0
+	}
+	if !overflow {
+		ret = append(ret, nftables.SetElement{Key: end, IntervalEnd: true})
+	}
+	return ret
+}
+
+// isPinned returns true if the element of key is pinned in the set, it must never be deleted by the plugin
+func isPinned(family nftables.TableFamily, tableName string, setName string, key []byte) bool {
+	if len(key) != net.IPv4len && len(key) != net.IPv6len {
+		return false
+	}
+
+	pinLock.Lock()
+	defer pinLock.Unlock()
+
+	for _, network := range pinnedNetworks[trackedSetKey(family, tableName, setName)] {
+		if network.Contains(net.IP(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRunningPins() bool {
+	for _, running := range getRunningSetRules() {
+		if len(running.rule.Pins) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// StartPinning start checking the pinned elements when the first handler starts, it runs only if any rule pins
+// elements
+func StartPinning() {
+	pinLock.Lock()
+	defer pinLock.Unlock()
+
+	pinRefs += 1
+	if pinStop != nil || !hasRunningPins() {
+		return
+	}
+
+	pinStop = make(chan struct{})
+	go func(stop chan struct{}) {
+		EnsurePinned()
+		ticker := time.NewTicker(pinCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				EnsurePinned()
+			}
+		}
+	}(pinStop)
+}
+
+// StopPinning stop checking the pinned elements when the last handler stops
+func StopPinning() {
+	pinLock.Lock()
+	defer pinLock.Unlock()
+
+	if pinRefs > 0 {
+		pinRefs -= 1
+	}
+	if pinRefs == 0 && pinStop != nil {
+		close(pinStop)
+		pinStop = nil
+		pinnedNetworks = make(map[string][]*net.IPNet)
+	}
+}
+
+// EnsurePinned add the pinned elements missing in the sets of running rules, missing sets are created by the rule
+func EnsurePinned() {
+	networks := make(map[string][]*net.IPNet)
+	var rules []nftablesRunningRule
+	for _, running := range getRunningSetRules() {
+		if len(running.rule.Pins) == 0 {
+			continue
+		}
+		setKey := trackedSetKey(running.family, running.rule.TableName, running.rule.SetName)
+		if _, ok := networks[setKey]; !ok {
+			rules = append(rules, running)
+		}
+		networks[setKey] = append(networks[setKey], running.rule.Pins...)
+	}
+
+	pinLock.Lock()
+	pinnedNetworks = networks
+	pinLock.Unlock()
+	if len(rules) == 0 {
+		return
+	}
+
+	conn, newNS, err := openBackend()
+	if err != nil {
+		return
+	}
+	defer cleanupSystemNFTConn(newNS)
+
+	for _, running := range rules {
+		ensureSetPinned(conn, running.family, running.rule, networks[trackedSetKey(running.family, running.rule.TableName, running.rule.SetName)])
+	}
+}
+
+func ensureSetPinned(conn NftBackend, family nftables.TableFamily, rule *NftablesSetAddElement, networks []*net.IPNet) {
+	familyName := getFamilyName(family)
+	table := &nftables.Table{Family: family, Name: rule.TableName}
+	set, err := conn.GetSetByName(table, rule.SetName)
+	if err != nil || set == nil {
+		keyType := rule.KeyType
+		if keyType == nftables.TypeInvalid {
+			keyType = nftables.TypeIPAddr
+			if len(networks[0].IP) == net.IPv6len {
+				keyType = nftables.TypeIP6Addr
+			}
+		}
+		set, err = rule.newSet(table, keyType)
+		if err == nil {
+			conn.AddTable(table)
+			err = addSetWithDescription(conn, set, rule.setDescription(), nil)
+		}
+		if err == nil {
+			err = conn.Flush()
+		}
+		if err != nil {
+			log.Errorf("Nftables create set %v %v %v for pinned elements failed. %v", familyName, rule.TableName, rule.SetName, err)
+			return
+		}
+		log.Infof("Nftables create set %v %v %v for pinned elements", familyName, rule.TableName, rule.SetName)
+	}
+
+	elements, err := conn.GetSetElements(set)
+	if err != nil {
+		log.Warningf("Nftables can not list elements of set %v %v %v for pinned elements. %v", familyName, rule.TableName, rule.SetName, err)
+		return
+	}
+	present := make(map[string]bool, len(elements))
+	for _, element := range elements {
+		if !element.IntervalEnd {
+			present[string(element.Key)] = true
+		}
+	}
+
+	var missing []nftables.SetElement
+	count := 0
+	for _, network := range networks {
+		if len(network.IP) != int(set.KeyType.Bytes) || present[string(network.IP)] {
+			continue
+		}
+		missing = append(missing, pinElements(network, set.Interval)...)
+		count += 1
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	err = conn.SetAddElements(set, missing)
+	if err == nil {
+		err = conn.Flush()
+	}
+	if err != nil {
+		log.Errorf("Nftables add %v pinned element(s) to set %v %v %v failed. %v", count, familyName, rule.TableName, rule.SetName, err)
+		return
+	}
+	log.Infof("Nftables add %v missing pinned element(s) to set %v %v %v", count, familyName, rule.TableName, rule.SetName)
+	pinRepairCount.WithLabelValues(familyName, rule.TableName, rule.SetName).Add(float64(count))
+}
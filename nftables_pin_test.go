@@ -0,0 +1,98 @@
+package coredns_nftables
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestParsePins(t *testing.T) {
+	pins, err := parsePins([]string{"192.0.2.1", "198.51.100.0/24"}, nftables.TypeIPAddr, true)
+	if err != nil || len(pins) != 2 || pins[1].String() != "198.51.100.0/24" {
+		t.Errorf("Expected 2 pins, but got %v, %v", pins, err)
+	}
+
+	if _, err := parsePins([]string{"198.51.100.0/24"}, nftables.TypeIPAddr, false); err == nil {
+		t.Errorf("Expected network can not be pinned in set without interval")
+	}
+	if _, err := parsePins([]string{"2001:db8::1"}, nftables.TypeIPAddr, false); err == nil {
+		t.Errorf("Expected IPv6 address can not be pinned in IPv4 set")
+	}
+	if _, err := parsePins([]string{"2001:db8::1", "192.0.2.1"}, nftables.TypeInvalid, false); err != nil {
+		t.Errorf("Expected both IPv4 and IPv6 address can be pinned in auto set, but got %v", err)
+	}
+	if _, err := parsePins([]string{"not-an-ip"}, nftables.TypeIPAddr, false); err == nil {
+		t.Errorf("Expected invalid address failed")
+	}
+}
+
+func TestPinElements(t *testing.T) {
+	_, network, _ := net.ParseCIDR("198.51.100.0/24")
+	elements := pinElements(network, true)
+	if len(elements) != 2 || !net.IP(elements[0].Key).Equal(net.ParseIP("198.51.100.0")) ||
+		!net.IP(elements[1].Key).Equal(net.ParseIP("198.51.101.0")) || !elements[1].IntervalEnd {
+		t.Errorf("Expected range 198.51.100.0-198.51.101.0, but got %v", elements)
+	}
+
+	if elements := pinElements(network, false); len(elements) != 1 {
+		t.Errorf("Expected only one element without interval, but got %v", elements)
+	}
+
+	_, network, _ = net.ParseCIDR("255.255.255.0/24")
+	if elements := pinElements(network, true); len(elements) != 1 {
+		t.Errorf("Expected end omitted when it overflows, but got %v", elements)
+	}
+}
+
+func TestEnsurePinned(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+	}()
+
+	pins, _ := parsePins([]string{"192.0.2.1", "192.0.2.2"}, nftables.TypeIPAddr, false)
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+		TableName: "coredns_pin",
+		SetName:   "PIN_SET",
+		KeyType:   nftables.TypeIPAddr,
+		Pins:      pins,
+	})
+	StartStateDump(&handle)
+	defer StopStateDump(&handle)
+
+	EnsurePinned()
+
+	backend := NewMemoryBackend(ruleset)
+	set, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_pin"}, "PIN_SET")
+	if err != nil {
+		t.Fatalf("Expected the set is created for pinned elements, but got %v", err)
+	}
+	if elements, _ := backend.GetSetElements(set); len(elements) != 2 {
+		t.Fatalf("Expected 2 pinned elements, but got %v", elements)
+	}
+
+	backend.SetDeleteElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	if err := backend.Flush(); err != nil {
+		t.Fatalf("Delete element failed, %v", err)
+	}
+	EnsurePinned()
+	if elements, _ := backend.GetSetElements(set); len(elements) != 2 {
+		t.Errorf("Expected the deleted pinned element is added back, but got %v", elements)
+	}
+
+	if !isPinned(nftables.TableFamilyIPv4, "coredns_pin", "PIN_SET", net.ParseIP("192.0.2.2").To4()) {
+		t.Errorf("Expected 192.0.2.2 is pinned")
+	}
+	if isPinned(nftables.TableFamilyIPv4, "coredns_pin", "PIN_SET", net.ParseIP("192.0.2.3").To4()) {
+		t.Errorf("Expected 192.0.2.3 is not pinned")
+	}
+	if isPinned(nftables.TableFamilyIPv4, "coredns_pin", "OTHER_SET", net.ParseIP("192.0.2.2").To4()) {
+		t.Errorf("Expected 192.0.2.2 is not pinned in other set")
+	}
+}
@@ -0,0 +1,184 @@
+package coredns_nftables
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+const defaultConnectionPoolSize = 16
+
+const (
+	connectionPoolReused      = "reused"
+	connectionPoolOpened      = "opened"
+	connectionPoolExpired     = "expired"
+	connectionPoolIdleTimeout = "idle-timeout"
+	connectionPoolUnhealthy   = "unhealthy"
+	connectionPoolDiscarded   = "discarded"
+)
+
+// connectionPoolLock guards the map of pools, and every send to and receive from them, so that the pools can be
+// replaced when the pool size changes. Sends and receives never block.
+var connectionPoolLock sync.Mutex = sync.Mutex{}
+var connectionPoolSize int = defaultConnectionPoolSize
+var connectionIdleTimeout time.Duration = 0
+var connectionHealthCheck bool = true
+
+// The idle connections of each network namespace, buffered by connectionPoolSize
+var connectionPools = make(map[NftablesNetworkNamespace]chan *NftablesCache)
+
+// SetConnectionPoolSize keep at most size idle connections to each network namespace, the surplus connections are
+// destroyed when they are returned to the pool
+func SetConnectionPoolSize(size int) {
+	connectionPoolLock.Lock()
+	defer connectionPoolLock.Unlock()
+
+	if size < 0 {
+		size = 0
+	}
+	connectionPoolSize = size
+	for ns, pool := range connectionPools {
+		resized := make(chan *NftablesCache, size)
+		for len(pool) > 0 {
+			cache := <-pool
+			select {
+			case resized <- cache:
+			default:
+				connectionPoolCount.WithLabelValues(connectionPoolDiscarded).Inc()
+				go cache.destroy()
+			}
+		}
+		connectionPools[ns] = resized
+	}
+}
+
+// SetConnectionIdleTimeout destroy idle connections which are not reused for timeout, 0 reuses them until
+// `connection timeout`
+func SetConnectionIdleTimeout(timeout time.Duration) {
+	connectionPoolLock.Lock()
+	defer connectionPoolLock.Unlock()
+
+	connectionIdleTimeout = timeout
+}
+
+// SetConnectionHealthCheck check an idle connection by listing tables before it's reused
+func SetConnectionHealthCheck(enable bool) {
+	connectionPoolLock.Lock()
+	defer connectionPoolLock.Unlock()
+
+	connectionHealthCheck = enable
+}
+
+// connectionPool returns the pool of ns, it must be called with connectionPoolLock
+func connectionPool(ns NftablesNetworkNamespace) chan *NftablesCache {
+	pool, ok := connectionPools[ns]
+	if !ok {
+		pool = make(chan *NftablesCache, connectionPoolSize)
+		connectionPools[ns] = pool
+	}
+	return pool
+}
+
+// takeIdleConnection returns a validated idle connection to ns, or nil if there is none. Connections expired,
+// idle for too long or failing the health check are destroyed.
+func takeIdleConnection(ns NftablesNetworkNamespace) *NftablesCache {
+	for {
+		var cache *NftablesCache
+		connectionPoolLock.Lock()
+		idleTimeout, healthCheck := connectionIdleTimeout, connectionHealthCheck
+		select {
+		case cache = <-connectionPool(ns):
+		default:
+		}
+		connectionPoolLock.Unlock()
+		if cache == nil {
+			return nil
+		}
+
+		result := connectionPoolReused
+		if cache.expiredFor(connectionOperationAdd) {
+			result = connectionPoolExpired
+		} else if idleTimeout > 0 && time.Since(cache.idleSince) > idleTimeout {
+			result = connectionPoolIdleTimeout
+		} else if healthCheck && !cache.healthy() {
+			result = connectionPoolUnhealthy
+		}
+		connectionPoolCount.WithLabelValues(result).Inc()
+		if result == connectionPoolReused {
+			return cache
+		}
+		log.Debugf("Nftables connection %p is %v, destroy it", cache, result)
+		go cache.destroy()
+	}
+}
+
+// putIdleConnection return cache to its pool, it's destroyed if the pool is full
+func putIdleConnection(cache *NftablesCache) {
+	cache.idleSince = time.Now()
+
+	connectionPoolLock.Lock()
+	defer connectionPoolLock.Unlock()
+
+	select {
+	case connectionPool(cache.Namespace) <- cache:
+		log.Debugf("Nftables connection %p add to cache pool", cache)
+	default:
+		connectionPoolCount.WithLabelValues(connectionPoolDiscarded).Inc()
+		log.Debugf("Nftables connection pool is full, destroy connection %p", cache)
+		go cache.destroy()
+	}
+}
+
+// forEachIdleConnection calls fn with every idle connection, no connection is taken or returned while fn is called
+func forEachIdleConnection(fn func(cache *NftablesCache)) {
+	connectionPoolLock.Lock()
+	defer connectionPoolLock.Unlock()
+
+	for _, pool := range connectionPools {
+		for i := len(pool); i > 0; i-- {
+			cache := <-pool
+			fn(cache)
+			pool <- cache
+		}
+	}
+}
+
+// countIdleConnections returns the count of idle connections of all network namespaces
+func countIdleConnections() int {
+	connectionPoolLock.Lock()
+	defer connectionPoolLock.Unlock()
+
+	ret := 0
+	for _, pool := range connectionPools {
+		ret += len(pool)
+	}
+	return ret
+}
+
+// drainIdleConnections destroy all idle connections
+func drainIdleConnections() {
+	connectionPoolLock.Lock()
+	defer connectionPoolLock.Unlock()
+
+	for _, pool := range connectionPools {
+		for len(pool) > 0 {
+			cache := <-pool
+			go cache.destroy()
+		}
+	}
+}
+
+// healthy returns false if the connection can not list tables, for example its netlink socket or network
+// namespace is gone
+func (cache *NftablesCache) healthy() bool {
+	if _, ok := cache.NftableConnection.(*ExecNftBackend); ok {
+		// every operation runs a new nft, there is no socket to die and the check would spend the rate limit
+		return true
+	}
+	if _, err := cache.NftableConnection.ListTablesOfFamily(nftables.TableFamilyIPv4); err != nil {
+		log.Warningf("Nftables connection %p failed the health check. %v", cache, err)
+		return false
+	}
+	return true
+}
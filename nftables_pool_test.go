@@ -0,0 +1,120 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// brokenListBackend fails to list tables once broken, like a connection whose netlink socket is gone
+type brokenListBackend struct {
+	*MemoryBackend
+	broken *bool
+}
+
+func (backend *brokenListBackend) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	if *backend.broken {
+		return nil, errors.New("netlink socket closed")
+	}
+	return backend.MemoryBackend.ListTablesOfFamily(family)
+}
+
+func TestConnectionPool(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	broken := false
+	SetNftBackendFactory(func() (NftBackend, error) {
+		return &brokenListBackend{MemoryBackend: NewMemoryBackend(ruleset), broken: &broken}, nil
+	})
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		SetConnectionPoolSize(defaultConnectionPoolSize)
+		SetConnectionIdleTimeout(0)
+		SetConnectionHealthCheck(true)
+	}()
+	count := func(result string) float64 {
+		return testutil.ToFloat64(connectionPoolCount.WithLabelValues(result))
+	}
+
+	first, _ := NewCache()
+	CloseCache(first)
+	if reused, _ := NewCache(); reused != first {
+		t.Fatalf("Expected the idle connection reused")
+	}
+
+	// a connection failing the health check is never handed back
+	unhealthy := count(connectionPoolUnhealthy)
+	CloseCache(first)
+	broken = true
+	second, _ := NewCache()
+	broken = false
+	if second == first || count(connectionPoolUnhealthy)-unhealthy != 1 {
+		t.Errorf("Expected the unhealthy connection destroyed and a new one opened")
+	}
+
+	// surplus connections are destroyed
+	SetConnectionPoolSize(1)
+	discarded := count(connectionPoolDiscarded)
+	third, _ := NewCache()
+	CloseCache(second)
+	CloseCache(third)
+	if countIdleConnections() != 1 || count(connectionPoolDiscarded)-discarded != 1 {
+		t.Errorf("Expected 1 idle connection and 1 discarded, but got %v and %v", countIdleConnections(), count(connectionPoolDiscarded)-discarded)
+	}
+
+	SetConnectionIdleTimeout(time.Minute)
+	forEachIdleConnection(func(cache *NftablesCache) {
+		cache.idleSince = time.Now().Add(-2 * time.Minute)
+	})
+	idle := count(connectionPoolIdleTimeout)
+	if reused, _ := NewCache(); reused == second || count(connectionPoolIdleTimeout)-idle != 1 {
+		t.Errorf("Expected the connection idle for too long destroyed")
+	}
+}
+
+func TestConnectionPoolSpike(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) {
+		return NewMemoryBackend(ruleset), nil
+	})
+	ClearCache()
+	SetConnectionPoolSize(4)
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		SetConnectionPoolSize(defaultConnectionPoolSize)
+	}()
+
+	// all connections opened by the spike are returned at once, only the pool size of them are kept
+	discarded := testutil.ToFloat64(connectionPoolCount.WithLabelValues(connectionPoolDiscarded))
+	caches := make(chan *NftablesCache, 64)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(caches); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cache, err := NewCache()
+			if err == nil {
+				caches <- cache
+			}
+		}()
+	}
+	wg.Wait()
+	close(caches)
+	opened := len(caches)
+	for cache := range caches {
+		CloseCache(cache)
+	}
+
+	if countIdleConnections() != 4 {
+		t.Errorf("Expected 4 idle connections, but got %v", countIdleConnections())
+	}
+	if got := testutil.ToFloat64(connectionPoolCount.WithLabelValues(connectionPoolDiscarded)) - discarded; int(got) != opened-4 {
+		t.Errorf("Expected %v surplus connections destroyed, but got %v", opened-4, got)
+	}
+}
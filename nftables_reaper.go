@@ -0,0 +1,220 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netns"
+)
+
+var reaperInterval time.Duration = 0
+var reaperLock sync.Mutex = sync.Mutex{}
+var reaperRefs int = 0
+var reaperStop chan struct{} = nil
+var reaperQueue = make(map[string]*nftablesReapElement)
+
+// nftablesReapElement is an element added into a set without timeout flag, it's deleted by the reaper at ExpireTime
+type nftablesReapElement struct {
+	namespace  NftablesNetworkNamespace
+	applied    NftablesAppliedElement
+	key        []byte
+	expireTime time.Time
+}
+
+// SetReaper set the interval to delete expired elements of sets without timeout flag, 0 disables it
+func SetReaper(interval time.Duration) {
+	reaperLock.Lock()
+	defer reaperLock.Unlock()
+
+	reaperInterval = interval
+	if interval <= 0 {
+		reaperQueue = make(map[string]*nftablesReapElement)
+		reaperQueueLength.Set(0)
+	}
+}
+
+// reapSetKey returns the key of the set of element in the reaper, sets of other network namespaces than the
+// default one are prefixed by the namespace
+func reapSetKey(namespace NftablesNetworkNamespace, applied NftablesAppliedElement) string {
+	if namespace.IsDefault() {
+		return trackedSetKey(applied.Family, applied.TableName, applied.SetName)
+	}
+	return fmt.Sprintf("%v/%v", namespace, trackedSetKey(applied.Family, applied.TableName, applied.SetName))
+}
+
+// ScheduleReap queue an element added into set of the network namespace namespace which has no timeout flag. It
+// expires after the timeout of applied, or ttl when the rule has no timeout. Adding the same element again
+// refreshes its expire time.
+func ScheduleReap(namespace NftablesNetworkNamespace, set *nftables.Set, applied NftablesAppliedElement, key []byte, ttl time.Duration) {
+	if set.HasTimeout {
+		return
+	}
+
+	timeout := applied.Timeout
+	if timeout <= 0 {
+		timeout = ttl
+	}
+	if timeout <= 0 {
+		return
+	}
+
+	reaperLock.Lock()
+	defer reaperLock.Unlock()
+
+	if reaperInterval <= 0 {
+		return
+	}
+	reaperQueue[reapSetKey(namespace, applied)+" "+string(key)] = &nftablesReapElement{
+		namespace:  namespace,
+		applied:    applied,
+		key:        append([]byte(nil), key...),
+		expireTime: time.Now().Add(timeout),
+	}
+	reaperQueueLength.Set(float64(len(reaperQueue)))
+}
+
+// StartReaper start the background reaper when the first handler starts
+func StartReaper() {
+	reaperLock.Lock()
+	defer reaperLock.Unlock()
+
+	reaperRefs += 1
+	if reaperStop != nil || reaperInterval <= 0 {
+		return
+	}
+
+	reaperStop = make(chan struct{})
+	go func(stop chan struct{}, interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ReapElements()
+			}
+		}
+	}(reaperStop, reaperInterval)
+}
+
+// StopReaper stop the background reaper when the last handler stops, the queued elements are kept for reloading
+func StopReaper() {
+	reaperLock.Lock()
+	defer reaperLock.Unlock()
+
+	if reaperRefs > 0 {
+		reaperRefs -= 1
+	}
+	if reaperRefs == 0 && reaperStop != nil {
+		close(reaperStop)
+		reaperStop = nil
+	}
+}
+
+// takeExpiredReapElements remove the expired elements from queue and group them by set
+func takeExpiredReapElements(now time.Time) map[string][]*nftablesReapElement {
+	reaperLock.Lock()
+	defer reaperLock.Unlock()
+
+	ret := make(map[string][]*nftablesReapElement)
+	for key, element := range reaperQueue {
+		if element.expireTime.After(now) {
+			continue
+		}
+		delete(reaperQueue, key)
+		setKey := reapSetKey(element.namespace, element.applied)
+		ret[setKey] = append(ret[setKey], element)
+	}
+	reaperQueueLength.Set(float64(len(reaperQueue)))
+	return ret
+}
+
+// ReapElements delete the expired elements from kernel sets, through a connection to the network namespace of each
+// set
+func ReapElements() {
+	expired := takeExpiredReapElements(time.Now())
+	if len(expired) == 0 {
+		return
+	}
+	if err := checkDestructive("reaper"); err != nil {
+		log.Warningf("Nftables reaper keep %v set(s) of expired elements. %v", len(expired), err)
+		return
+	}
+
+	conns := make(map[NftablesNetworkNamespace]NftBackend)
+	var handles []netns.NsHandle
+	defer func() {
+		for _, newNS := range handles {
+			cleanupSystemNFTConn(newNS)
+		}
+	}()
+	for _, elements := range expired {
+		namespace := elements[0].namespace
+		conn, ok := conns[namespace]
+		if !ok {
+			var newNS netns.NsHandle
+			var err error
+			conn, newNS, err = openBackendIn(namespace)
+			if err != nil {
+				continue
+			}
+			conns[namespace] = conn
+			handles = append(handles, newNS)
+		}
+		familyName := getFamilyName(elements[0].applied.Family)
+		tableName := elements[0].applied.TableName
+		setName := elements[0].applied.SetName
+		set, err := conn.GetSetByName(&nftables.Table{Family: elements[0].applied.Family, Name: tableName}, setName)
+		if err != nil || set == nil {
+			log.Warningf("Nftables reaper can not find set %v %v %v. %v", familyName, tableName, setName, err)
+			continue
+		}
+
+		unpinned := elements[:0]
+		for _, element := range elements {
+			if namespace.IsDefault() && isPinned(element.applied.Family, tableName, setName, element.key) {
+				log.Debugf("Nftables reaper keep pinned element %v(%v) of set %v %v %v", element.applied.Element, element.applied.Name, familyName, tableName, setName)
+				continue
+			}
+			unpinned = append(unpinned, element)
+		}
+		elements = unpinned
+		if len(elements) == 0 {
+			continue
+		}
+
+		keys := make([]nftables.SetElement, 0, len(elements))
+		applied := make([]NftablesAppliedElement, 0, len(elements))
+		for _, element := range elements {
+			keys = append(keys, nftables.SetElement{Key: element.key})
+			applied = append(applied, element.applied)
+		}
+		err = conn.SetDeleteElements(set, keys)
+		if err == nil {
+			err = conn.Flush()
+		}
+		if err != nil {
+			log.Errorf("Nftables reaper delete %v element(s) of set %v %v %v failed. %v", len(keys), familyName, tableName, setName, err)
+			continue
+		}
+
+		log.Debugf("Nftables reaper delete %v element(s) of set %v %v %v", len(keys), familyName, tableName, setName)
+		reapCount.WithLabelValues(familyName, tableName, setName).Add(float64(len(keys)))
+		WriteAppliedLog("reap", applied)
+		if !namespace.IsDefault() {
+			// the tracker, the existing elements and the LRU only know the default namespace
+			continue
+		}
+		for _, element := range elements {
+			UntrackElement(element.applied.Family, tableName, setName, element.key)
+			forgetExistingElement(element.applied.Family, tableName, setName, element.key)
+			if len(element.key) == net.IPv4len || len(element.key) == net.IPv6len {
+				lruRemoveIp(net.IP(element.key).String())
+			}
+		}
+	}
+}
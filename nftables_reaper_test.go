@@ -0,0 +1,47 @@
+package coredns_nftables
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestReaperQueue(t *testing.T) {
+	SetReaper(time.Minute)
+	defer SetReaper(0)
+
+	set := &nftables.Set{Name: "TEST_SET"}
+	applied := NftablesAppliedElement{Family: nftables.TableFamilyIPv4, TableName: "filter", SetName: "TEST_SET", Element: "192.0.2.1"}
+	ScheduleReap(NftablesNetworkNamespace{}, set, applied, []byte{192, 0, 2, 1}, time.Hour)
+	ScheduleReap(NftablesNetworkNamespace{}, set, applied, []byte{192, 0, 2, 1}, time.Hour)
+	applied.Timeout = time.Millisecond
+	ScheduleReap(NftablesNetworkNamespace{}, set, applied, []byte{192, 0, 2, 2}, time.Hour)
+	ScheduleReap(NftablesNetworkNamespace{}, &nftables.Set{Name: "TEST_SET", HasTimeout: true}, applied, []byte{192, 0, 2, 3}, time.Hour)
+	if len(reaperQueue) != 2 {
+		t.Fatalf("Expected 2 queued elements, but got %v", len(reaperQueue))
+	}
+
+	expired := takeExpiredReapElements(time.Now().Add(time.Second))
+	elements := expired[trackedSetKey(nftables.TableFamilyIPv4, "filter", "TEST_SET")]
+	if len(elements) != 1 || elements[0].key[3] != 2 {
+		t.Fatalf("Expected the element with rule timeout expired, but got %v", expired)
+	}
+	if len(reaperQueue) != 1 {
+		t.Fatalf("Expected 1 queued element left, but got %v", len(reaperQueue))
+	}
+
+	ns := NftablesNetworkNamespace{Kind: "name", Value: "tenant"}
+	ScheduleReap(ns, set, applied, []byte{192, 0, 2, 2}, time.Hour)
+	expired = takeExpiredReapElements(time.Now().Add(time.Second))
+	elements = expired[reapSetKey(ns, applied)]
+	if len(expired) != 1 || len(elements) != 1 || elements[0].namespace != ns {
+		t.Fatalf("Expected the element of the namespace reaped apart, but got %v", expired)
+	}
+
+	SetReaper(0)
+	ScheduleReap(NftablesNetworkNamespace{}, set, applied, []byte{192, 0, 2, 4}, time.Hour)
+	if len(reaperQueue) != 0 {
+		t.Fatalf("Expected nothing queued when the reaper is disabled")
+	}
+}
@@ -0,0 +1,223 @@
+package coredns_nftables
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisDefaultTimeout = 100 * time.Millisecond
+const redisMaxIdle = 8
+
+// redisReply is one reply of RESP, arrays are not used by the commands of this plugin
+type redisReply struct {
+	integer int64
+	text    string
+	null    bool
+}
+
+// redisClient is a minimal RESP client with pipelining, it keeps a few idle connections so the commands of
+// concurrent answers do not wait for each other
+type redisClient struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+
+	lock sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// newRedisClient parse address as host:port or redis://[:password@]host:port[/db]
+func newRedisClient(address string, timeout time.Duration) (*redisClient, error) {
+	if timeout <= 0 {
+		timeout = redisDefaultTimeout
+	}
+	client := &redisClient{address: address, timeout: timeout}
+	if !strings.Contains(address, "://") {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "redis" {
+		return nil, fmt.Errorf("scheme %v not supported, expect redis", parsed.Scheme)
+	}
+	client.address = parsed.Host
+	if _, _, err := net.SplitHostPort(client.address); err != nil {
+		client.address = net.JoinHostPort(parsed.Host, "6379")
+	}
+	if parsed.User != nil {
+		client.password, _ = parsed.User.Password()
+		if len(client.password) == 0 {
+			client.password = parsed.User.Username()
+		}
+	}
+	if db := strings.Trim(parsed.Path, "/"); len(db) > 0 {
+		client.db, err = strconv.Atoi(db)
+		if err != nil || client.db < 0 {
+			return nil, fmt.Errorf("db %v invalid", db)
+		}
+	}
+	return client, nil
+}
+
+func (client *redisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", client.address, client.timeout)
+	if err != nil {
+		return nil, err
+	}
+	ret := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	var setup [][]string
+	if len(client.password) > 0 {
+		setup = append(setup, []string{"AUTH", client.password})
+	}
+	if client.db > 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(client.db)})
+	}
+	if len(setup) > 0 {
+		if _, err := ret.execute(client.timeout, setup); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// Do send commands in one pipeline and returns their replies in order
+func (client *redisClient) Do(commands ...[]string) ([]redisReply, error) {
+	client.lock.Lock()
+	var conn *redisConn
+	if len(client.idle) > 0 {
+		conn = client.idle[len(client.idle)-1]
+		client.idle = client.idle[:len(client.idle)-1]
+	}
+	client.lock.Unlock()
+
+	var err error
+	if conn == nil {
+		conn, err = client.dial()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := conn.execute(client.timeout, commands)
+	if err != nil {
+		// the stream may be in the middle of a reply, so the connection is never reused
+		conn.conn.Close()
+		return nil, err
+	}
+
+	client.lock.Lock()
+	if len(client.idle) < redisMaxIdle {
+		client.idle = append(client.idle, conn)
+		conn = nil
+	}
+	client.lock.Unlock()
+	if conn != nil {
+		conn.conn.Close()
+	}
+	return replies, nil
+}
+
+func (client *redisClient) Close() {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	for _, conn := range client.idle {
+		conn.conn.Close()
+	}
+	client.idle = nil
+}
+
+func (conn *redisConn) execute(timeout time.Duration, commands [][]string) ([]redisReply, error) {
+	conn.conn.SetDeadline(time.Now().Add(timeout))
+
+	var builder strings.Builder
+	for _, command := range commands {
+		fmt.Fprintf(&builder, "*%d\r\n", len(command))
+		for _, arg := range command {
+			fmt.Fprintf(&builder, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := conn.conn.Write([]byte(builder.String())); err != nil {
+		return nil, err
+	}
+
+	replies := make([]redisReply, 0, len(commands))
+	var replyErr error
+	for range commands {
+		reply, err := conn.readReply()
+		if err != nil {
+			if _, ok := err.(redisError); !ok {
+				return nil, err
+			}
+			// read the rest of the pipeline even after an error reply
+			if replyErr == nil {
+				replyErr = err
+			}
+		}
+		replies = append(replies, reply)
+	}
+	return replies, replyErr
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis " + string(e)
+}
+
+func (conn *redisConn) readReply() (redisReply, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return redisReply{}, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return redisReply{}, fmt.Errorf("redis empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return redisReply{text: line[1:]}, nil
+	case '-':
+		return redisReply{}, redisError(line[1:])
+	case ':':
+		value, err := strconv.ParseInt(line[1:], 10, 64)
+		return redisReply{integer: value}, err
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return redisReply{}, err
+		}
+		if size < 0 {
+			return redisReply{null: true}, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(conn.reader, data); err != nil {
+			return redisReply{}, err
+		}
+		return redisReply{text: string(data[:size])}, nil
+	}
+	return redisReply{}, fmt.Errorf("redis reply %q not supported", line)
+}
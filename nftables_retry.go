@@ -0,0 +1,66 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var retryMaxAttempts int = 0
+var retryBaseDelay time.Duration = 10 * time.Millisecond
+var retryMaxDelay time.Duration = time.Second
+
+// SetRetry set how many times a flush failed with transient netlink errors is retried, the delay before each
+// retry starts from base and is doubled until max. 0 attempts disables retrying.
+func SetRetry(attempts int, base time.Duration, max time.Duration) {
+	retryMaxAttempts = attempts
+	retryBaseDelay = base
+	retryMaxDelay = max
+}
+
+// isTransientError returns true if err means the kernel is busy or the socket buffer is full, so the same
+// operations may succeed later
+func isTransientError(err error) bool {
+	return errors.Is(err, unix.EBUSY) || errors.Is(err, unix.ENOBUFS) || errors.Is(err, unix.EAGAIN)
+}
+
+// retryDelay returns the delay before the attempt(from 1) with jitter, which is a random duration between half
+// and the whole exponential backoff
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryFlush stage all operations of batch again and flush them until it succeeds, the error is not transient
+// or the attempts are used up. It returns the queued entries and the error of the last flush.
+func (batch *NftablesBatch) retryFlush(queued []*nftablesBatchEntry, err error) ([]*nftablesBatchEntry, error) {
+	for attempt := 1; attempt <= retryMaxAttempts && isTransientError(err); attempt++ {
+		delay := retryDelay(attempt)
+		log.Debugf("Nftables flush failed with transient error, retry %v/%v after %v. %v", attempt, retryMaxAttempts, delay, err)
+		retryCount.WithLabelValues("retried").Inc()
+		time.Sleep(delay)
+
+		for _, entry := range batch.entries {
+			entry.err = nil
+		}
+		queued = batch.queueAll()
+		err = batch.cache.Flush()
+	}
+
+	if isTransientError(err) && retryMaxAttempts > 0 {
+		log.Warningf("Nftables flush abandoned after %v retries. %v", retryMaxAttempts, err)
+		retryCount.WithLabelValues("abandoned").Inc()
+	}
+	return queued, err
+}
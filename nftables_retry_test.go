@@ -0,0 +1,80 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestRetryDelay(t *testing.T) {
+	defer SetRetry(0, 10*time.Millisecond, time.Second)
+
+	SetRetry(5, 10*time.Millisecond, 50*time.Millisecond)
+	for attempt, expected := range []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond} {
+		delay := retryDelay(attempt + 1)
+		if delay < expected/2 || delay > expected {
+			t.Errorf("Expected delay of attempt %v in [%v, %v], but got %v", attempt+1, expected/2, expected, delay)
+		}
+	}
+
+	if !isTransientError(fmt.Errorf("conn.Receive: %w", &netlink.OpError{Op: "receive", Err: unix.EBUSY})) {
+		t.Errorf("Expected EBUSY is transient")
+	}
+	if isTransientError(fmt.Errorf("conn.Receive: %w", &netlink.OpError{Op: "receive", Err: unix.ENOENT})) {
+		t.Errorf("Expected ENOENT is not transient")
+	}
+}
+
+func TestBatchRetryFlush(t *testing.T) {
+	defer SetRetry(0, 10*time.Millisecond, time.Second)
+
+	for _, c := range []struct {
+		attempts int
+		failures int
+		flushes  int
+		applied  bool
+	}{
+		{0, 1, 1, false},
+		{3, 2, 3, true},
+		{2, 3, 3, false},
+	} {
+		SetRetry(c.attempts, time.Millisecond, time.Millisecond)
+		flushes := 0
+		conn, err := nftables.New(nftables.WithTestDial(func(req []netlink.Message) ([]netlink.Message, error) {
+			if len(req) == 0 || req[0].Header.Flags&netlink.Dump != 0 {
+				return nil, io.EOF
+			}
+			flushes += 1
+			if flushes <= c.failures {
+				return nltest.Error(int(unix.EBUSY), req)
+			}
+			return req, nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		batch := NewNftablesBatch(&NftablesCache{
+			tables:            make(map[nftables.TableFamily]*map[string]*NftableCache),
+			NftableConnection: conn,
+			NetworkNamespace:  netns.NsHandle(0),
+		})
+		answer := newTestBatchAnswer(t, "example.org. 60 IN A 192.0.2.1")
+		stageTestSet(batch, "coredns", "SET_A", answer)
+		batch.Commit()
+
+		if flushes != c.flushes {
+			t.Errorf("Expected %v flush(es) with %v attempts and %v failures, but got %v", c.flushes, c.attempts, c.failures, flushes)
+		}
+		if _, err := batch.AnswerResult(answer); (err == nil) != c.applied {
+			t.Errorf("Expected answer applied %v with %v attempts and %v failures, but got %v", c.applied, c.attempts, c.failures, err)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rolloutBuckets is the resolution of rollout percentages, 0.01%
+const rolloutBuckets = 10000
+
+// NftablesRollout applies the rules only to the qnames whose hash falls in the first Buckets of rolloutBuckets,
+// so the same qnames are selected by every instance and every reload
+type NftablesRollout struct {
+	Buckets uint64
+}
+
+// parseRollout parse percentages like `25%` or `2.5%`, in [0%, 100%] with at most two decimals
+func parseRollout(value string) (*NftablesRollout, error) {
+	if !strings.HasSuffix(value, "%") {
+		return nil, fmt.Errorf("rollout %v is not a percentage", value)
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil || math.IsNaN(percent) || percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("rollout %v is not in 0%%-100%%", value)
+	}
+	buckets := percent * rolloutBuckets / 100
+	if math.Abs(buckets-math.Round(buckets)) > 1e-6 {
+		return nil, fmt.Errorf("rollout %v has more than two decimals", value)
+	}
+	return &NftablesRollout{Buckets: uint64(math.Round(buckets))}, nil
+}
+
+func (rollout *NftablesRollout) String() string {
+	return strconv.FormatFloat(float64(rollout.Buckets)*100/rolloutBuckets, 'f', -1, 64) + "%"
+}
+
+// selected returns true if the rules apply to the answers of qname, names are case insensitive
+func (rollout *NftablesRollout) selected(qname string) bool {
+	if rollout == nil || rollout.Buckets >= rolloutBuckets {
+		return true
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(strings.ToLower(dns.CanonicalName(qname))))
+	return hash.Sum64()%rolloutBuckets < rollout.Buckets
+}
+
+// rolloutQname returns the name selecting the rollout bucket of response r
+func rolloutQname(r *dns.Msg) string {
+	if len(r.Question) > 0 {
+		return r.Question[0].Name
+	}
+	return r.Answer[0].Header().Name
+}
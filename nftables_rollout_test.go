@@ -0,0 +1,108 @@
+package coredns_nftables
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRollout(t *testing.T) {
+	for _, c := range []struct {
+		value   string
+		buckets uint64
+	}{{"25%", 2500}, {"2.5%", 250}, {"0%", 0}, {"100%", rolloutBuckets}, {"0.01%", 1}} {
+		rollout, err := parseRollout(c.value)
+		if err != nil || rollout.Buckets != c.buckets || rollout.String() != c.value {
+			t.Errorf("Expected rollout %v has %v buckets, but got %v, %v", c.value, c.buckets, rollout, err)
+		}
+	}
+	for _, invalid := range []string{"25", "-1%", "101%", "half%", "NaN%", "2.555%", "0.001%"} {
+		if _, err := parseRollout(invalid); err == nil {
+			t.Errorf("Expected rollout %v invalid", invalid)
+		}
+	}
+}
+
+func TestRolloutSelected(t *testing.T) {
+	rollout, _ := parseRollout("25%")
+	selected := 0
+	for i := 0; i < 10000; i++ {
+		name := fmt.Sprintf("host%d.example.org.", i)
+		if rollout.selected(name) {
+			selected += 1
+		}
+		if rollout.selected(name) != rollout.selected(fmt.Sprintf("HOST%d.Example.org", i)) {
+			t.Fatalf("Expected %v selected regardless of case and the trailing dot", name)
+		}
+	}
+	if selected < 2200 || selected > 2800 {
+		t.Errorf("Expected about 25%% of names selected, but got %v of 10000", selected)
+	}
+	if all, _ := parseRollout("100%"); !all.selected("example.org.") {
+		t.Errorf("Expected all names selected by 100%%")
+	}
+	if none, _ := parseRollout("0%"); none.selected("example.org.") {
+		t.Errorf("Expected no name selected by 0%%")
+	}
+}
+
+func TestRolloutServeDNS(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+	}()
+
+	handle := NewNftablesHandler()
+	handle.Rollout, _ = parseRollout("0%")
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_rollout", SetName: "ROLLOUT", KeyType: nftables.TypeInvalid})
+	handle.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		reply := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.240")
+		reply.SetReply(r)
+		w.WriteMsg(reply)
+		return dns.RcodeSuccess, nil
+	})
+
+	serve := func() *dns.Msg {
+		request := new(dns.Msg)
+		request.SetQuestion("example.org.", dns.TypeA)
+		recorder := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := handle.ServeDNS(context.Background(), recorder, request); err != nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+		return recorder.Msg
+	}
+
+	skipped := testutil.ToFloat64(rolloutCount.WithLabelValues("", "skipped"))
+	if reply := serve(); reply == nil || len(reply.Answer) != 1 {
+		t.Fatalf("Expected the response served out of rollout, but got %v", reply)
+	}
+	if testutil.ToFloat64(rolloutCount.WithLabelValues("", "skipped")) != skipped+1 {
+		t.Errorf("Expected the skipped response counted")
+	}
+	backend := NewMemoryBackend(ruleset)
+	if _, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_rollout"}, "ROLLOUT"); err == nil {
+		t.Errorf("Expected no element added out of rollout")
+	}
+
+	handle.Rollout, _ = parseRollout("100%")
+	serve()
+	set, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_rollout"}, "ROLLOUT")
+	if err != nil {
+		t.Fatalf("Expected the set is created in rollout, but got %v", err)
+	}
+	if elements, _ := backend.GetSetElements(set); len(elements) != 1 {
+		t.Errorf("Expected the element added in rollout, but got %v", elements)
+	}
+}
@@ -0,0 +1,38 @@
+package coredns_nftables
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type nftablesRRsetKey struct {
+	name   string
+	class  uint16
+	rrtype uint16
+}
+
+// rrsetMinTTLs returns the minimum TTL of the RRset of each answer, answers of the same owner name(case
+// insensitive), class and type are one RRset. Answers alone in their RRset are not returned.
+func rrsetMinTTLs(answers []*dns.RR) map[*dns.RR]uint32 {
+	minTTLs := make(map[nftablesRRsetKey]uint32)
+	sizes := make(map[nftablesRRsetKey]int)
+	keys := make([]nftablesRRsetKey, len(answers))
+	for i, answer := range answers {
+		header := (*answer).Header()
+		key := nftablesRRsetKey{name: strings.ToLower(dns.CanonicalName(header.Name)), class: header.Class, rrtype: header.Rrtype}
+		keys[i] = key
+		if ttl, ok := minTTLs[key]; !ok || header.Ttl < ttl {
+			minTTLs[key] = header.Ttl
+		}
+		sizes[key] += 1
+	}
+
+	ret := make(map[*dns.RR]uint32)
+	for i, answer := range answers {
+		if sizes[keys[i]] > 1 {
+			ret[answer] = minTTLs[keys[i]]
+		}
+	}
+	return ret
+}
@@ -0,0 +1,50 @@
+package coredns_nftables
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestRRsetTTL(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+	}()
+
+	handle := NewNftablesHandler()
+	handle.RRsetTTL = true
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_rrset", SetName: "RRSET_TTL", KeyType: nftables.TypeIPAddr, TtlTimeout: true})
+
+	msg := newTestResponse(t, "pool.example.org.", "pool.Example.org. 300 IN A 192.0.2.230", "pool.example.org. 60 IN A 192.0.2.231",
+		"pool.example.org. 120 IN A 192.0.2.232", "other.example.org. 30 IN A 192.0.2.233")
+	if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 4 {
+		t.Fatalf("Expected 4 answers applied, but got %v, %v", applied, err)
+	}
+
+	backend := NewMemoryBackend(ruleset)
+	set, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_rrset"}, "RRSET_TTL")
+	if err != nil {
+		t.Fatalf("Expected the set is created, but got %v", err)
+	}
+	elements, _ := backend.GetSetElements(set)
+	if len(elements) != 4 {
+		t.Fatalf("Expected 4 elements, but got %v", elements)
+	}
+	for _, element := range elements {
+		expected := time.Minute
+		if element.Key[3] == 233 {
+			expected = 30 * time.Second
+		}
+		if element.Timeout != expected {
+			t.Errorf("Expected element %v expires after %v, but got %v", element.Key, expected, element.Timeout)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var scheduleLocationLock sync.Mutex = sync.Mutex{}
+var scheduleLocation *time.Location = time.Local
+
+var scheduleWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// NftablesSchedule is a daily window in which a rule or group is active, the window may cross midnight
+type NftablesSchedule struct {
+	// minutes since midnight
+	Start int
+	End   int
+	// bit mask of time.Weekday the window starts, 0 means every day
+	Weekdays uint8
+}
+
+func parseClock(text string) (int, error) {
+	clock, err := time.Parse("15:04", text)
+	if err != nil {
+		return 0, err
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// parseWeekdays accept names like mon, and ranges like mon-fri or fri-mon
+func parseWeekdays(text string) (uint8, error) {
+	names := strings.SplitN(strings.ToLower(text), "-", 2)
+	from, ok := scheduleWeekdays[names[0]]
+	if !ok {
+		return 0, fmt.Errorf("weekday %v invalid", names[0])
+	}
+	to := from
+	if len(names) > 1 {
+		to, ok = scheduleWeekdays[names[1]]
+		if !ok {
+			return 0, fmt.Errorf("weekday %v invalid", names[1])
+		}
+	}
+
+	var ret uint8 = 0
+	for day := from; ; day = (day + 1) % 7 {
+		ret |= 1 << uint(day)
+		if day == to {
+			break
+		}
+	}
+	return ret, nil
+}
+
+// ParseSchedule parse <HH:MM>-<HH:MM> [WEEKDAY...]
+func ParseSchedule(args []string) (NftablesSchedule, error) {
+	var ret NftablesSchedule
+	if len(args) < 1 {
+		return ret, fmt.Errorf("window is missing")
+	}
+	clocks := strings.SplitN(args[0], "-", 2)
+	if len(clocks) != 2 {
+		return ret, fmt.Errorf("window %v invalid, expect <HH:MM>-<HH:MM>", args[0])
+	}
+	var err error
+	if ret.Start, err = parseClock(clocks[0]); err != nil {
+		return ret, fmt.Errorf("window %v invalid, %v", args[0], err)
+	}
+	if ret.End, err = parseClock(clocks[1]); err != nil {
+		return ret, fmt.Errorf("window %v invalid, %v", args[0], err)
+	}
+	if ret.Start == ret.End {
+		return ret, fmt.Errorf("window %v is empty", args[0])
+	}
+	for _, arg := range args[1:] {
+		days, err := parseWeekdays(arg)
+		if err != nil {
+			return ret, err
+		}
+		ret.Weekdays |= days
+	}
+	return ret, nil
+}
+
+func (s *NftablesSchedule) hasWeekday(day time.Weekday) bool {
+	return s.Weekdays == 0 || s.Weekdays&(1<<uint(day)) != 0
+}
+
+// Contains returns true if now is in the window of the schedule timezone, weekdays are checked against the day
+// the window starts
+func (s *NftablesSchedule) Contains(now time.Time) bool {
+	now = now.In(getScheduleLocation())
+	minute := now.Hour()*60 + now.Minute()
+	if s.Start < s.End {
+		return minute >= s.Start && minute < s.End && s.hasWeekday(now.Weekday())
+	}
+	if minute >= s.Start {
+		return s.hasWeekday(now.Weekday())
+	}
+	return minute < s.End && s.hasWeekday((now.Weekday()+6)%7)
+}
+
+func (s *NftablesSchedule) String() string {
+	ret := fmt.Sprintf("%02d:%02d-%02d:%02d", s.Start/60, s.Start%60, s.End/60, s.End%60)
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if s.Weekdays&(1<<uint(day)) != 0 {
+			ret += " " + strings.ToLower(day.String()[:3])
+		}
+	}
+	return ret
+}
+
+// SetScheduleLocation set the timezone of all schedules, nil means the local timezone
+func SetScheduleLocation(location *time.Location) {
+	scheduleLocationLock.Lock()
+	defer scheduleLocationLock.Unlock()
+
+	if location == nil {
+		location = time.Local
+	}
+	scheduleLocation = location
+}
+
+func getScheduleLocation() *time.Location {
+	scheduleLocationLock.Lock()
+	defer scheduleLocationLock.Unlock()
+
+	return scheduleLocation
+}
+
+// inSchedules returns true if there is no schedule or now is in any of schedules
+func inSchedules(schedules []NftablesSchedule, now time.Time) bool {
+	if len(schedules) == 0 {
+		return true
+	}
+	for i := range schedules {
+		if schedules[i].Contains(now) {
+			return true
+		}
+	}
+	return false
+}
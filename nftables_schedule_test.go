@@ -0,0 +1,84 @@
+package coredns_nftables
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	// 2024-01-01 is a Monday
+	at := func(day int, clock string) time.Time {
+		minute, err := parseClock(clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2024, 1, day, minute/60, minute%60, 0, 0, time.Local)
+	}
+
+	schedule, err := ParseSchedule([]string{"08:00-16:00", "mon-fri"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		now      time.Time
+		expected bool
+	}{
+		{at(1, "07:59"), false},
+		{at(1, "08:00"), true},
+		{at(5, "15:59"), true},
+		{at(1, "16:00"), false},
+		{at(6, "10:00"), false},
+	} {
+		if schedule.Contains(c.now) != c.expected {
+			t.Errorf("Expected %v in schedule %v is %v", c.now, schedule.String(), c.expected)
+		}
+	}
+
+	schedule, err = ParseSchedule([]string{"22:00-06:00", "fri"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		now      time.Time
+		expected bool
+	}{
+		{at(5, "23:00"), true},
+		{at(6, "05:59"), true},
+		{at(6, "23:00"), false},
+		{at(5, "05:00"), false},
+	} {
+		if schedule.Contains(c.now) != c.expected {
+			t.Errorf("Expected %v in schedule %v is %v", c.now, schedule.String(), c.expected)
+		}
+	}
+	if schedule.String() != "22:00-06:00 fri" {
+		t.Errorf("Expected schedule is written as 22:00-06:00 fri, but got %v", schedule.String())
+	}
+
+	for _, args := range [][]string{{}, {"08:00"}, {"08:00-08:00"}, {"8am-4pm"}, {"08:00-16:00", "mon-someday"}} {
+		if _, err := ParseSchedule(args); err == nil {
+			t.Errorf("Expected schedule %v is invalid", args)
+		}
+	}
+}
+
+func TestScheduleLocation(t *testing.T) {
+	defer SetScheduleLocation(nil)
+
+	schedule, err := ParseSchedule([]string{"08:00-16:00"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 6, 0, 0, 0, time.UTC)
+	SetScheduleLocation(time.UTC)
+	if schedule.Contains(now) {
+		t.Errorf("Expected 06:00 UTC is out of schedule in UTC")
+	}
+	SetScheduleLocation(time.FixedZone("UTC+8", 8*3600))
+	if !schedule.Contains(now) {
+		t.Errorf("Expected 06:00 UTC is in schedule in UTC+8")
+	}
+	if !inSchedules(nil, now) {
+		t.Errorf("Expected rules without schedule are always active")
+	}
+}
@@ -0,0 +1,376 @@
+package coredns_nftables
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+const defaultServicePort = 443
+
+// nftablesService is a transport protocol and port of an endpoint advertised by a HTTPS record
+type nftablesService struct {
+	proto uint8
+	port  uint16
+}
+
+// NftablesSetAddService add `ip . inet_proto . inet_service` elements for the endpoints advertised by HTTPS
+// records, alpn h3 advertises udp and other protocols advertise tcp.
+type NftablesSetAddService struct {
+	TableName string
+	SetName   string
+	// nftables.TypeIPAddr or nftables.TypeIP6Addr, others mean detecting by table family
+	AddressType nftables.SetDatatype
+	Timeout     time.Duration
+}
+
+func (m *NftablesSetAddService) Name() string { return "nftables-set-add-service" }
+
+func (m *NftablesSetAddService) addressType(family nftables.TableFamily) nftables.SetDatatype {
+	if m.AddressType == nftables.TypeIPAddr || m.AddressType == nftables.TypeIP6Addr {
+		return m.AddressType
+	}
+	if family == nftables.TableFamilyIPv6 {
+		return nftables.TypeIP6Addr
+	}
+	return nftables.TypeIPAddr
+}
+
+// ServeMsg add the endpoints of all HTTPS records in r, the addresses come from ipv4hint/ipv6hint and the
+// A/AAAA records in the same response
+func (m *NftablesSetAddService) ServeMsg(ctx context.Context, batch *NftablesBatch, r *dns.Msg, family nftables.TableFamily) error {
+	addressType := m.addressType(family)
+	keyType, err := nftables.ConcatSetType(addressType, nftables.TypeInetProto, nftables.TypeInetService)
+	if err != nil {
+		return err
+	}
+
+	cache := batch.Cache()
+	tableCache := cache.MutableNftablesTable(family, m.TableName)
+	var set *nftables.Set = nil
+
+	for i := range r.Answer {
+		answer := &r.Answer[i]
+		https, ok := (*answer).(*dns.HTTPS)
+		if !ok || https.Priority == 0 {
+			continue
+		}
+
+		services := httpsServices(&https.SVCB)
+		addresses := httpsAddresses(r, &https.SVCB, addressType)
+		if len(services) == 0 || len(addresses) == 0 {
+			continue
+		}
+
+		if set == nil {
+			set = batch.GetSet(tableCache, m.SetName)
+			if set == nil {
+				set = &nftables.Set{
+					Table:         tableCache.table,
+					Name:          m.SetName,
+					KeyType:       keyType,
+					Concatenation: true,
+					HasTimeout:    m.Timeout > 0,
+					Timeout:       m.Timeout,
+				}
+				log.Debugf("Nftables create service set %v %v %v", cache.GetFamilyName(family), m.TableName, m.SetName)
+				batch.CreateSet(tableCache, set, nil)
+			}
+		}
+
+		timeout := m.Timeout
+		if set.HasTimeout && timeout <= 0 {
+			timeout = set.Timeout
+		}
+		for _, address := range addresses {
+			for _, service := range services {
+				element := nftables.SetElement{Key: serviceElementKey(address, service)}
+				text := serviceElementText(address, service)
+				log.Debugf("Nftables set %v %v %v add element %s", cache.GetFamilyName(family), m.TableName, m.SetName, text)
+				batch.AddElement(tableCache, set, element, NftablesAppliedElement{
+					Family:    family,
+					TableName: m.TableName,
+					SetName:   m.SetName,
+					Element:   text,
+					Name:      batch.AnswerName(answer),
+					Timeout:   timeout,
+				}, answer)
+			}
+		}
+	}
+
+	return nil
+}
+
+// httpsServices returns the protocols and port advertised by alpn, no-default-alpn and port keys
+func httpsServices(svcb *dns.SVCB) []nftablesService {
+	var port uint16 = defaultServicePort
+	tcp := true
+	udp := false
+	for _, value := range svcb.Value {
+		switch v := value.(type) {
+		case *dns.SVCBPort:
+			port = v.Port
+		case *dns.SVCBNoDefaultAlpn:
+			tcp = false
+		}
+	}
+	for _, value := range svcb.Value {
+		alpn, ok := value.(*dns.SVCBAlpn)
+		if !ok {
+			continue
+		}
+		for _, protocol := range alpn.Alpn {
+			if strings.HasPrefix(protocol, "h3") {
+				udp = true
+			} else {
+				tcp = true
+			}
+		}
+	}
+
+	var ret []nftablesService
+	if tcp {
+		ret = append(ret, nftablesService{proto: unix.IPPROTO_TCP, port: port})
+	}
+	if udp {
+		ret = append(ret, nftablesService{proto: unix.IPPROTO_UDP, port: port})
+	}
+	return ret
+}
+
+// httpsAddresses collect hints and A/AAAA records of the target name(or the owner name when target is ".")
+func httpsAddresses(r *dns.Msg, svcb *dns.SVCB, addressType nftables.SetDatatype) []net.IP {
+	target := svcb.Target
+	if target == "." {
+		target = svcb.Hdr.Name
+	}
+	target = dns.CanonicalName(target)
+
+	var ret []net.IP
+	seen := make(map[string]bool)
+	add := func(ip net.IP) {
+		if addressType == nftables.TypeIPAddr {
+			ip = ip.To4()
+		} else if ip.To4() != nil {
+			return
+		} else {
+			ip = ip.To16()
+		}
+		if ip == nil || seen[string(ip)] {
+			return
+		}
+		seen[string(ip)] = true
+		ret = append(ret, ip)
+	}
+
+	for _, value := range svcb.Value {
+		switch v := value.(type) {
+		case *dns.SVCBIPv4Hint:
+			for _, ip := range v.Hint {
+				add(ip)
+			}
+		case *dns.SVCBIPv6Hint:
+			for _, ip := range v.Hint {
+				add(ip)
+			}
+		}
+	}
+	for _, answer := range r.Answer {
+		if dns.CanonicalName(answer.Header().Name) != target {
+			continue
+		}
+		switch rr := answer.(type) {
+		case *dns.A:
+			add(rr.A)
+		case *dns.AAAA:
+			add(rr.AAAA)
+		}
+	}
+
+	return ret
+}
+
+// serviceElementKey pad each field of `ip . inet_proto . inet_service` to 4 bytes like nft does
+func serviceElementKey(address net.IP, service nftablesService) []byte {
+	key := make([]byte, 0, len(address)+8)
+	key = append(key, address...)
+	key = append(key, service.proto, 0, 0, 0)
+	port := make([]byte, 4)
+	binary.BigEndian.PutUint16(port, service.port)
+	return append(key, port...)
+}
+
+func serviceElementText(address net.IP, service nftablesService) string {
+	proto := "tcp"
+	if service.proto == unix.IPPROTO_UDP {
+		proto = "udp"
+	}
+	return fmt.Sprintf("%v . %v . %v", address.String(), proto, service.port)
+}
+
+// parseElementKey convert the text of an element back to its key, it accepts `ip`, `ip . mark`,
+// `ip . proto . port` and any of them prefixed by `vlan . `
+func parseElementKey(text string) ([]byte, error) {
+	if key, ok, err := parseVlanElementKey(text); ok {
+		return key, err
+	}
+	parts := strings.Split(text, " . ")
+	address, err := stripAddressZone(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("element %v is not an ip address", text)
+	}
+	if ip.To4() != nil {
+		ip = ip.To4()
+	}
+	if len(parts) == 1 {
+		return ip, nil
+	}
+	if len(parts) == 2 {
+		mark, err := parseMark(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("element %v %v", text, err)
+		}
+		return workloadElementKey(ip, mark), nil
+	}
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("element %v is not `ip . proto . port`", text)
+	}
+
+	service := nftablesService{}
+	switch parts[1] {
+	case "tcp":
+		service.proto = unix.IPPROTO_TCP
+	case "udp":
+		service.proto = unix.IPPROTO_UDP
+	default:
+		return nil, fmt.Errorf("element %v protocol %v invalid", text, parts[1])
+	}
+	port, err := strconv.ParseUint(parts[2], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("element %v port %v invalid, %v", text, parts[2], err)
+	}
+	service.port = uint16(port)
+
+	return serviceElementKey(ip, service), nil
+}
+
+// mapElementText returns the text of proxy map element like `192.0.2.1 : 12345`
+func mapElementText(ip net.IP, port uint16) string {
+	return fmt.Sprintf("%v : %v", ip, port)
+}
+
+// proxyPortData returns the inet_service data of map elements
+func proxyPortData(port uint16) []byte {
+	ret := make([]byte, 2)
+	binary.BigEndian.PutUint16(ret, port)
+	return ret
+}
+
+// parseElement parse the text of element, which is the key with an optional `: port` data of map elements
+func parseElement(text string) (nftables.SetElement, error) {
+	parts := strings.SplitN(text, " : ", 2)
+	key, err := parseElementKey(parts[0])
+	if err != nil {
+		return nftables.SetElement{}, err
+	}
+	if len(parts) == 1 {
+		return nftables.SetElement{Key: key}, nil
+	}
+
+	port, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return nftables.SetElement{}, fmt.Errorf("element %v port %v invalid, %v", text, parts[1], err)
+	}
+	return nftables.SetElement{Key: key, Val: proxyPortData(uint16(port))}, nil
+}
+
+// svcbRecord returns the SVCB data of HTTPS and SVCB records, or nil for other records
+func svcbRecord(answer dns.RR) *dns.SVCB {
+	switch rr := answer.(type) {
+	case *dns.HTTPS:
+		return &rr.SVCB
+	case *dns.SVCB:
+		return rr
+	}
+	return nil
+}
+
+// svcbHasHints returns true if svcb is in ServiceMode and has ipv4hint or ipv6hint
+func svcbHasHints(svcb *dns.SVCB) bool {
+	if svcb.Priority == 0 {
+		return false
+	}
+	for _, value := range svcb.Value {
+		switch value.(type) {
+		case *dns.SVCBIPv4Hint, *dns.SVCBIPv6Hint:
+			return true
+		}
+	}
+	return false
+}
+
+// hintAnswers converts the ipv4hint/ipv6hint of HTTPS/SVCB records in r into A/AAAA records of the owner name,
+// so that they are applied by the set rules like other answers. Hints already in the A/AAAA records of the same
+// name and hints of AliasMode records are ignored.
+func hintAnswers(r *dns.Msg) []*dns.RR {
+	seen := make(map[string]bool)
+	for _, answer := range r.Answer {
+		switch rr := answer.(type) {
+		case *dns.A:
+			seen[dns.CanonicalName(rr.Hdr.Name)+" "+rr.A.String()] = true
+		case *dns.AAAA:
+			seen[dns.CanonicalName(rr.Hdr.Name)+" "+rr.AAAA.String()] = true
+		}
+	}
+
+	var ret []*dns.RR
+	add := func(svcb *dns.SVCB, ip net.IP, ipv6 bool) {
+		key := dns.CanonicalName(svcb.Hdr.Name) + " " + ip.String()
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+
+		// IPv4-mapped addresses of ipv6hint are kept as AAAA records, they are applied to ip6 tables
+		var answer dns.RR
+		if !ipv6 && ip.To4() != nil {
+			answer = &dns.A{Hdr: dns.RR_Header{Name: svcb.Hdr.Name, Rrtype: dns.TypeA, Class: svcb.Hdr.Class, Ttl: svcb.Hdr.Ttl}, A: ip.To4()}
+		} else {
+			answer = &dns.AAAA{Hdr: dns.RR_Header{Name: svcb.Hdr.Name, Rrtype: dns.TypeAAAA, Class: svcb.Hdr.Class, Ttl: svcb.Hdr.Ttl}, AAAA: ip.To16()}
+		}
+		ret = append(ret, &answer)
+	}
+
+	for _, answer := range r.Answer {
+		svcb := svcbRecord(answer)
+		if svcb == nil || svcb.Priority == 0 {
+			continue
+		}
+		for _, value := range svcb.Value {
+			switch v := value.(type) {
+			case *dns.SVCBIPv4Hint:
+				for _, ip := range v.Hint {
+					add(svcb, ip, false)
+				}
+			case *dns.SVCBIPv6Hint:
+				for _, ip := range v.Hint {
+					add(svcb, ip, true)
+				}
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,111 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+func TestHTTPSServices(t *testing.T) {
+	msg := new(dns.Msg)
+	for _, text := range []string{
+		`example.org. 300 IN HTTPS 1 . alpn="h3,h2" port=8443 ipv4hint=192.0.2.1`,
+		"example.org. 300 IN A 192.0.2.2",
+		"other.org. 300 IN A 192.0.2.3",
+	} {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			t.Fatalf("NewRR(%v) failed: %v", text, err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	https := &msg.Answer[0].(*dns.HTTPS).SVCB
+
+	services := httpsServices(https)
+	if len(services) != 2 || services[0].port != 8443 || serviceElementText(nil, services[1]) != "<nil> . udp . 8443" {
+		t.Fatalf("Unexpected services %v", services)
+	}
+
+	addresses := httpsAddresses(msg, https, nftables.TypeIPAddr)
+	if len(addresses) != 2 || addresses[0].String() != "192.0.2.1" || addresses[1].String() != "192.0.2.2" {
+		t.Fatalf("Unexpected addresses %v", addresses)
+	}
+	if len(httpsAddresses(msg, https, nftables.TypeIP6Addr)) != 0 {
+		t.Fatalf("Expected no ipv6 addresses")
+	}
+
+	text := serviceElementText(addresses[0], services[1])
+	key, err := parseElementKey(text)
+	if err != nil {
+		t.Fatalf("parseElementKey(%v) failed: %v", text, err)
+	}
+	if !bytes.Equal(key, []byte{192, 0, 2, 1, 17, 0, 0, 0, 0x20, 0xfb, 0, 0}) {
+		t.Fatalf("Unexpected key %v of %v", key, text)
+	}
+
+	rr, _ := dns.NewRR(`example.org. 300 IN HTTPS 1 . no-default-alpn alpn="h3"`)
+	services = httpsServices(&rr.(*dns.HTTPS).SVCB)
+	if len(services) != 1 || serviceElementText(nil, services[0]) != "<nil> . udp . 443" {
+		t.Fatalf("Unexpected services %v", services)
+	}
+}
+
+func TestHintAnswers(t *testing.T) {
+	msg := new(dns.Msg)
+	for _, text := range []string{
+		`example.org. 300 IN HTTPS 1 . alpn="h2" ipv4hint=192.0.2.1,192.0.2.2 ipv6hint=2001:db8::1`,
+		"example.org. 300 IN A 192.0.2.2",
+		`_8443._foo.example.org. 60 IN SVCB 1 svc.example.org. ipv4hint=192.0.2.3`,
+		`alias.example.org. 300 IN HTTPS 0 example.org. ipv4hint=192.0.2.4`,
+	} {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			t.Fatalf("NewRR(%v) failed: %v", text, err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	var got []string
+	for _, answer := range hintAnswers(msg) {
+		got = append(got, (*answer).String())
+	}
+	expected := []string{
+		"example.org.\t300\tIN\tA\t192.0.2.1",
+		"example.org.\t300\tIN\tAAAA\t2001:db8::1",
+		"_8443._foo.example.org.\t60\tIN\tA\t192.0.2.3",
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected hint answers %v, but got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected hint answer %v, but got %v", expected[i], got[i])
+		}
+	}
+
+	if svcbHasHints(svcbRecord(msg.Answer[3])) {
+		t.Errorf("Expected hints of AliasMode record are ignored")
+	}
+}
+
+func TestParseMapElement(t *testing.T) {
+	text := mapElementText(net.ParseIP("192.0.2.1"), 12345)
+	element, err := parseElement(text)
+	if err != nil {
+		t.Fatalf("parseElement(%v) failed: %v", text, err)
+	}
+	if !bytes.Equal(element.Key, []byte{192, 0, 2, 1}) || !bytes.Equal(element.Val, []byte{0x30, 0x39}) {
+		t.Fatalf("Unexpected element %v of %v", element, text)
+	}
+
+	element, err = parseElement("2001:db8::1")
+	if err != nil || len(element.Key) != 16 || element.Val != nil {
+		t.Fatalf("Unexpected element %v, %v", element, err)
+	}
+	if _, err := parseElement("192.0.2.1 : http"); err == nil {
+		t.Fatalf("Expected invalid port failed")
+	}
+}
@@ -2,39 +2,297 @@ package coredns_nftables
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/coredns/coredns/plugin/metrics"
+
 	"github.com/google/nftables"
 	"github.com/miekg/dns"
 )
 
+// Sets whose key length matches neither A nor AAAA answers, only warn once for each of them
+var setKeyTypeWarnings sync.Map
+
+// NftablesTimeoutOverride use a different element timeout for names matched by Matcher
+type NftablesTimeoutOverride struct {
+	Timeout time.Duration
+	Matcher *NftablesDomainMatcher
+}
+
+// NftablesSampler applies Numerator of every Denominator answers
+type NftablesSampler struct {
+	Numerator   uint64
+	Denominator uint64
+	counter     uint64
+}
+
+func (s *NftablesSampler) take() bool {
+	index := atomic.AddUint64(&s.counter, 1) - 1
+	return index%s.Denominator < s.Numerator
+}
+
 type NftablesSetAddElement struct {
-	TableName string
-	SetName   string
-	Interval  bool
-	Timeout   time.Duration
-	KeyType   nftables.SetDatatype
+	TableName        string
+	SetName          string
+	Interval         bool
+	Timeout          time.Duration
+	KeyType          nftables.SetDatatype
+	Counter          *NftablesSetCounter
+	TimeoutOverrides []*NftablesTimeoutOverride
+	Sampler          *NftablesSampler
+	// Use the TTL of answer as element timeout, clamped into [TtlMin, TtlMax] when they are greater than 0
+	TtlTimeout bool
+	TtlMin     time.Duration
+	TtlMax     time.Duration
+	// Only names matched by Match(all names when it's nil) and not matched by Except are applied
+	Match  *NftablesDomainMatcher
+	Except *NftablesDomainMatcher
+	// Cap distinct addresses of each name, overflowed addresses are handled by quarantineRule
+	Limiter        *NftablesIPLimiter
+	quarantineRule *NftablesSetAddElement
+	// Addresses in any of these groups are not applied
+	Exclude []*NftablesAddressGroup
+	// Create the missing set in any family, the key type of auto follows the first answer
+	CreateSet bool
+	// The size and the dynamic flag of sets created by this rule
+	SetSize uint32
+	Dynamic bool
+	// Add `ip : port` elements into a map with inet_service data when it's greater than 0
+	ProxyPort uint16
+	// Only apply answers in any of these windows, or all the time when it's empty
+	Schedules []NftablesSchedule
+	Dedup     NftablesDedupPolicy
+	// Addresses and networks always kept in the set, they are added back when missing and never deleted
+	Pins []*net.IPNet
+	// The network namespace of the set, the default is the namespace of `netns`
+	Netns NftablesNetworkNamespace
+	// Add `ip . mark` elements with the mark of the workload class of the client, see SetWorkloadFile. Clients
+	// without a class use WorkloadDefault, or are ignored when it's empty.
+	Workload        bool
+	WorkloadDefault string
+	// Add `vlan id . ip` elements for each of these VLANs into tables of bridge and netdev families, the answers
+	// are ignored by tables of other families
+	Vlans []uint16
 }
 
 func (m *NftablesSetAddElement) Name() string { return "nftables-set-add-element" }
 
-func (m *NftablesSetAddElement) ServeDNS(ctx context.Context, cache *NftablesCache, answer *dns.RR, family nftables.TableFamily) (error, bool) {
-	var elements []nftables.SetElement
+// setAcceptAnswer detects the address family of a set by its key length,
+// A answers go to 4-byte-key sets and AAAA answers go to 16-byte-key sets
+func (m *NftablesSetAddElement) setAcceptAnswer(cache *NftablesCache, set *nftables.Set, answer *dns.RR, family nftables.TableFamily) bool {
+	if set.IsMap != (m.ProxyPort > 0) || (set.IsMap && set.DataType.Bytes != nftables.TypeInetService.Bytes) {
+		warningKey := fmt.Sprintf("%v %v %v", (*cache).GetFamilyName(family), m.TableName, m.SetName)
+		if _, loaded := setKeyTypeWarnings.LoadOrStore(warningKey, true); !loaded {
+			if m.ProxyPort > 0 {
+				log.Warningf("Nftables set %v is not a map with inet_service data, which is required by proxy", warningKey)
+			} else {
+				log.Warningf("Nftables set %v is a map, use proxy to add elements into it", warningKey)
+			}
+		}
+		return false
+	}
+
+	keyBytes := set.KeyType.Bytes
+	if m.Workload {
+		if !set.Concatenation {
+			warningKey := fmt.Sprintf("%v %v %v", (*cache).GetFamilyName(family), m.TableName, m.SetName)
+			if _, loaded := setKeyTypeWarnings.LoadOrStore(warningKey, true); !loaded {
+				log.Warningf("Nftables set %v is not keyed by `ip . mark`, which is required by workload", warningKey)
+			}
+			return false
+		}
+		keyBytes -= nftables.TypeMark.Bytes
+	}
+	if len(m.Vlans) > 0 {
+		if !set.Concatenation || set.KeyType.Bytes < nftablesVlanIDType.Bytes {
+			warningKey := fmt.Sprintf("%v %v %v", (*cache).GetFamilyName(family), m.TableName, m.SetName)
+			if _, loaded := setKeyTypeWarnings.LoadOrStore(warningKey, true); !loaded {
+				log.Warningf("Nftables set %v is not keyed by `vlan id . ip`, which is required by vlan", warningKey)
+			}
+			return false
+		}
+		keyBytes -= nftablesVlanIDType.Bytes
+	}
+
+	switch keyBytes {
+	case net.IPv4len:
+		return (*answer).Header().Rrtype == dns.TypeA
+	case net.IPv6len:
+		return (*answer).Header().Rrtype == dns.TypeAAAA
+	}
+
+	warningKey := fmt.Sprintf("%v %v %v", (*cache).GetFamilyName(family), m.TableName, m.SetName)
+	if _, loaded := setKeyTypeWarnings.LoadOrStore(warningKey, true); !loaded {
+		log.Warningf("Nftables set %v has key type %v(%v bytes), which matches neither A nor AAAA answers", warningKey, set.KeyType.Name, set.KeyType.Bytes)
+	}
+	return false
+}
+
+// SetLimiter set the limiter of distinct addresses per name, a quarantine rule is derived when the limiter has
+// a quarantine set
+func (m *NftablesSetAddElement) SetLimiter(limiter *NftablesIPLimiter) {
+	m.Limiter = limiter
+	m.quarantineRule = nil
+	if limiter != nil && len(limiter.QuarantineSetName) > 0 {
+		m.quarantineRule = &NftablesSetAddElement{
+			TableName: m.TableName,
+			SetName:   limiter.QuarantineSetName,
+			Interval:  m.Interval,
+			Timeout:   m.Timeout,
+			KeyType:   m.KeyType,
+			CreateSet: m.CreateSet,
+			SetSize:   m.SetSize,
+			Dynamic:   m.Dynamic,
+			Dedup:     m.Dedup,
+		}
+	}
+}
+
+// excludedBy returns the group which contains ip, or nil if ip is not excluded
+func (m *NftablesSetAddElement) excludedBy(ip net.IP) *NftablesAddressGroup {
+	for _, group := range m.Exclude {
+		if group.Contains(ip) {
+			return group
+		}
+	}
+	return nil
+}
+
+// MatchName returns true if the rule applies to answers of names, names are the owner name and the names
+// of CNAME chain which points to it. Any of them matched by Except skips the answer.
+func (m *NftablesSetAddElement) MatchName(names ...string) bool {
+	if m.Match != nil && !m.Match.MatchAny(names) {
+		return false
+	}
+	if m.Except != nil && m.Except.MatchAny(names) {
+		return false
+	}
+	return true
+}
+
+// elementTimeout returns the timeout of the first override matching any of names, or the clamped TTL of answer
+// when TtlTimeout is set, or the default timeout of the rule
+func (m *NftablesSetAddElement) elementTimeout(answer *dns.RR, names []string) (time.Duration, bool) {
+	return m.elementTimeoutOfTTL(time.Duration((*answer).Header().Ttl)*time.Second, names)
+}
+
+// elementTimeoutOfTTL returns the timeout like elementTimeout, with ttl instead of the TTL of answer
+func (m *NftablesSetAddElement) elementTimeoutOfTTL(ttl time.Duration, names []string) (time.Duration, bool) {
+	for _, override := range m.TimeoutOverrides {
+		if override.Matcher.MatchAny(names) {
+			return override.Timeout, true
+		}
+	}
+
+	if m.TtlTimeout {
+		timeout := ttl
+		if m.TtlMin > 0 && timeout < m.TtlMin {
+			timeout = m.TtlMin
+		}
+		if m.TtlMax > 0 && timeout > m.TtlMax {
+			timeout = m.TtlMax
+		}
+		// timeout 0 means the default timeout of set
+		if timeout < time.Second {
+			timeout = time.Second
+		}
+		return timeout, true
+	}
+
+	return m.Timeout, false
+}
+
+func (m *NftablesSetAddElement) ServeDNS(ctx context.Context, batch *NftablesBatch, answer *dns.RR, family nftables.TableFamily) (error, bool) {
+	var element nftables.SetElement
 	var element_text string
+	var ip net.IP
 	switch (*answer).Header().Rrtype {
 	case dns.TypeA:
-		elements = []nftables.SetElement{{Key: (*answer).(*dns.A).A}}
-		element_text = (*answer).(*dns.A).A.String()
+		ip = (*answer).(*dns.A).A
+		element = nftables.SetElement{Key: ip.To4()}
+		element_text = ip.String()
 	case dns.TypeAAAA:
-		elements = []nftables.SetElement{{Key: (*answer).(*dns.AAAA).AAAA}}
-		element_text = (*answer).(*dns.AAAA).AAAA.String()
+		ip = (*answer).(*dns.AAAA).AAAA
+		element = nftables.SetElement{Key: ip.To16()}
+		element_text = ip.String()
+		if scope := batch.AnswerScope(answer); len(scope) > 0 {
+			element_text += "%" + scope
+		}
 	default:
 		return nil, true
 	}
 
+	batch, err := batch.InNamespace(m.Netns)
+	if err != nil {
+		return err, false
+	}
+	cache := batch.Cache()
+	if len(m.Vlans) > 0 && !acceptVlanFamily(family) {
+		log.Debugf("Nftables set %v %v %v ignore element %s because vlan is only used by bridge and netdev tables", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
+		return nil, true
+	}
+	// the element of a workload rule depends on the client, so recently applied addresses are not skipped
+	if m.Dedup == NftablesDedupGlobal && !m.Workload && batch.AnswerDeduped(answer) {
+		log.Debugf("Nftables set %v %v %v ignore element %s(%s) because lru max retry times exceeded", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, (*answer).Header().Name)
+		return nil, true
+	}
+	if !inSchedules(m.Schedules, time.Now()) {
+		log.Debugf("Nftables set %v %v %v ignore element %s(%s) because it's out of schedules", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, (*answer).Header().Name)
+		scheduleSuppressedCount.WithLabelValues((*cache).GetFamilyName(family), m.TableName, m.SetName).Inc()
+		return nil, true
+	}
+	if group := m.excludedBy(ip); group != nil {
+		log.Debugf("Nftables set %v %v %v ignore element %s(%s) because it's in %v addresses", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, (*answer).Header().Name, group.Name)
+		return nil, true
+	}
+	if m.Limiter != nil && !m.Limiter.take(batch.AnswerName(answer), element_text) {
+		if m.quarantineRule != nil {
+			limitCount.WithLabelValues(metrics.WithServer(ctx), (*cache).GetFamilyName(family), m.TableName, m.SetName, "quarantined").Inc()
+			log.Debugf("Nftables set %v %v %v move element %s(%s) to quarantine set %v because of too many addresses", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, (*answer).Header().Name, m.quarantineRule.SetName)
+			return m.quarantineRule.ServeDNS(ctx, batch, answer, family)
+		}
+		limitCount.WithLabelValues(metrics.WithServer(ctx), (*cache).GetFamilyName(family), m.TableName, m.SetName, "dropped").Inc()
+		log.Debugf("Nftables set %v %v %v drop element %s(%s) because of too many addresses", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, (*answer).Header().Name)
+		return nil, true
+	}
+
+	if m.Workload {
+		mark, ok := workloadMark(clientAddress(ctx), m.WorkloadDefault)
+		if !ok {
+			log.Debugf("Nftables set %v %v %v ignore element %s(%s) because client %v has no workload class", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, (*answer).Header().Name, clientAddress(ctx))
+			return nil, true
+		}
+		element.Key = workloadElementKey(element.Key, mark)
+		element_text = workloadElementText(element_text, mark)
+	}
+	if m.ProxyPort > 0 {
+		element.Val = proxyPortData(m.ProxyPort)
+		if m.Workload {
+			element_text = fmt.Sprintf("%v : %v", element_text, m.ProxyPort)
+		} else {
+			element_text = mapElementText(ip, m.ProxyPort)
+		}
+	}
+
+	timeout, overridden := m.elementTimeoutOfTTL(batch.AnswerTTL(answer), batch.AnswerNames(answer))
+
+	// the set is not created for answers not sampled
+	if m.Sampler != nil {
+		if !m.Sampler.take() {
+			sampleCount.WithLabelValues(metrics.WithServer(ctx), (*cache).GetFamilyName(family), m.TableName, m.SetName, "skipped").Inc()
+			log.Debugf("Nftables set %v %v %v skip element %s because it's not sampled", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
+			return nil, true
+		}
+		sampleCount.WithLabelValues(metrics.WithServer(ctx), (*cache).GetFamilyName(family), m.TableName, m.SetName, "applied").Inc()
+	}
+
 	tableCache := cache.MutableNftablesTable(family, m.TableName)
 	// get old set
-	set, _ := cache.NftableConnection.GetSetByName(tableCache.table, m.SetName)
+	set := batch.GetSet(tableCache, m.SetName)
 	if set == nil {
 		// Create nftable set if KeyType is not nftables.TypeInvalid
 		var keyType = m.KeyType
@@ -43,6 +301,10 @@ func (m *NftablesSetAddElement) ServeDNS(ctx context.Context, cache *NftablesCac
 				keyType = nftables.TypeIPAddr
 			} else if family == nftables.TableFamilyIPv6 {
 				keyType = nftables.TypeIP6Addr
+			} else if m.CreateSet && (*answer).Header().Rrtype == dns.TypeA {
+				keyType = nftables.TypeIPAddr
+			} else if m.CreateSet {
+				keyType = nftables.TypeIP6Addr
 			} else {
 				log.Debugf("Nftables set %v %v %v ignore element %s because set not found", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
 				return nil, true
@@ -58,37 +320,103 @@ func (m *NftablesSetAddElement) ServeDNS(ctx context.Context, cache *NftablesCac
 			return nil, true
 		}
 
-		portSet := &nftables.Set{
-			Table:      tableCache.table,
-			Name:       m.SetName,
-			KeyType:    keyType,
-			Interval:   m.Interval,
-			HasTimeout: m.Timeout.Microseconds() > 0,
-			Timeout:    m.Timeout,
+		set, err = m.newSet(tableCache.table, keyType)
+		if err != nil {
+			return err, false
+		}
+		log.Debugf("Nftables create set %v %v %v and add element %s", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
+		batch.CreateSetWithDescription(tableCache, set, m.setDescription(), m.Counter)
+	} else {
+		// Ignore unmatched set
+		if !m.setAcceptAnswer(cache, set, answer, family) {
+			log.Debugf("Nftables set %v %v %v ignore element %s because key type %v not match", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, set.KeyType.Name)
+			return nil, true
+		}
+		log.Debugf("Nftables set %v %v %v add element %s", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
+	}
+
+	if overridden {
+		if set.HasTimeout {
+			element.Timeout = timeout
+		} else {
+			log.Debugf("Nftables set %v %v %v ignore timeout %v of element %s because the set has no timeout flag", (*cache).GetFamilyName(family), m.TableName, m.SetName, timeout, element_text)
+			timeout = set.Timeout
 		}
+	} else if set.HasTimeout {
+		timeout = set.Timeout
+	}
 
-		log.Debugf("Nftables create set %v %v %v and add element %s", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
-		err := cache.NftableConnection.AddSet(portSet, elements)
+	elements := []nftables.SetElement{element}
+	texts := []string{element_text}
+	if len(m.Vlans) > 0 {
+		elements = make([]nftables.SetElement, 0, len(m.Vlans))
+		texts = make([]string, 0, len(m.Vlans))
+		for _, vlan := range m.Vlans {
+			vlanElement := element
+			vlanElement.Key = vlanElementKey(vlan, element.Key)
+			elements = append(elements, vlanElement)
+			texts = append(texts, vlanElementText(vlan, element_text))
+		}
+	}
+	if m.Counter != nil {
+		batch.AttachCounter(tableCache, set, m.Counter)
+	}
+	for i := range elements {
+		applied := m.appliedElement(batch.AnswerName(answer), family, texts[i], timeout)
+		if m.Dedup == NftablesDedupSliding && set.HasTimeout && !set.Interval {
+			batch.RefreshElement(tableCache, set, elements[i], applied, answer)
+		} else {
+			batch.AddElement(tableCache, set, elements[i], applied, answer)
+		}
+	}
+	return nil, false
+}
+
+// newSet returns the definition of set created by this rule
+func (m *NftablesSetAddElement) newSet(table *nftables.Table, keyType nftables.SetDatatype) (*nftables.Set, error) {
+	set := &nftables.Set{
+		Table:      table,
+		Name:       m.SetName,
+		KeyType:    keyType,
+		Interval:   m.Interval,
+		HasTimeout: m.Timeout.Microseconds() > 0 || len(m.TimeoutOverrides) > 0 || m.TtlTimeout,
+		Timeout:    m.Timeout,
+	}
+	var err error
+	if m.Workload {
+		set.KeyType, err = nftables.ConcatSetType(keyType, nftables.TypeMark)
 		if err != nil {
-			log.Errorf("Nftables create set %v %v %v and add element %s but AddSet failed. %v", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, err)
-			return err, false
+			return nil, fmt.Errorf("key type of workload set %v invalid, %v", m.SetName, err)
 		}
-		err = cache.NftableConnection.Flush()
+		set.Concatenation = true
+	}
+	if len(m.Vlans) > 0 {
+		types := append([]nftables.SetDatatype{nftablesVlanIDType}, nftables.ConcatSetTypeElements(set.KeyType)...)
+		set.KeyType, err = nftables.ConcatSetType(types...)
 		if err != nil {
-			log.Errorf("Nftables create set %v %v %v and add element %s but Flush failed. %v", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, err)
-			cache.HasNftableConnectionError = true
+			return nil, fmt.Errorf("key type of vlan set %v invalid, %v", m.SetName, err)
 		}
-		return err, false
+		set.Concatenation = true
 	}
+	if m.ProxyPort > 0 {
+		set.IsMap = true
+		set.DataType = nftables.TypeInetService
+	}
+	return set, nil
+}
 
-	// Ignore unmatched set
-	if (*answer).Header().Rrtype == dns.TypeA && set.KeyType == nftables.TypeIP6Addr {
-		log.Debugf("Nftables set %v %v %v ignore element %s because it's a ipv6 set", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
-		return nil, true
-	} else if (*answer).Header().Rrtype == dns.TypeAAAA && set.KeyType == nftables.TypeIPAddr {
-		log.Debugf("Nftables set %v %v %v ignore element %s because it's a ipv4 set", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
-		return nil, true
+// setDescription returns the size and flags of sets created by this rule
+func (m *NftablesSetAddElement) setDescription() NftablesSetDescription {
+	return NftablesSetDescription{Size: m.SetSize, Dynamic: m.Dynamic}
+}
+
+func (m *NftablesSetAddElement) appliedElement(name string, family nftables.TableFamily, element string, timeout time.Duration) NftablesAppliedElement {
+	return NftablesAppliedElement{
+		Family:    family,
+		TableName: m.TableName,
+		SetName:   m.SetName,
+		Element:   element,
+		Name:      name,
+		Timeout:   timeout,
 	}
-	log.Debugf("Nftables set %v %v %v add element %s", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
-	return cache.SetAddElements(tableCache, set, elements), false
 }
@@ -0,0 +1,55 @@
+package coredns_nftables
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// NftablesSetDescription is what `nft add set` accepts beyond *nftables.Set, google/nftables does not send them
+type NftablesSetDescription struct {
+	// the maximum number of elements, 0 means no limit
+	Size uint32
+	// the dynamic flag, so rules like `update @SET` can add elements from the packet path
+	Dynamic bool
+}
+
+// NftSetDescriber is implemented by backends which can create sets with a description
+type NftSetDescriber interface {
+	// AddSetWithDescription create set with the size and flags of description, like AddSet
+	AddSetWithDescription(set *nftables.Set, description NftablesSetDescription, elements []nftables.SetElement) error
+}
+
+var _ NftSetDescriber = (*MemoryBackend)(nil)
+var _ NftSetDescriber = (*NetlinkBackend)(nil)
+var _ NftSetDescriber = (*ScriptBackend)(nil)
+var _ NftSetDescriber = (*ExecNftBackend)(nil)
+
+// IsZero returns true if the description has neither the size nor the flags
+func (description NftablesSetDescription) IsZero() bool {
+	return description.Size == 0 && !description.Dynamic
+}
+
+// backendDescribesSets returns true if the backend of name can create sets with a description
+func backendDescribesSets(name string) bool {
+	switch name {
+	case "netlink", "script", "exec-nft":
+		return true
+	default:
+		return false
+	}
+}
+
+// addSetWithDescription create set by backend with description, it fails if the description is not empty and
+// the backend can not send it
+func addSetWithDescription(backend NftBackend, set *nftables.Set, description NftablesSetDescription, elements []nftables.SetElement) error {
+	if description.IsZero() {
+		return backend.AddSet(set, elements)
+	}
+	describer, ok := backend.(NftSetDescriber)
+	if !ok {
+		return fmt.Errorf("backend can not create set %v with size or dynamic flag, %w", set.Name, unix.EOPNOTSUPP)
+	}
+	return describer.AddSetWithDescription(set, description, elements)
+}
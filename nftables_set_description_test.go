@@ -0,0 +1,47 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetDescription(t *testing.T) {
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}
+	set := &nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr, HasTimeout: true}
+	description := NftablesSetDescription{Size: 2, Dynamic: true}
+
+	statement := scriptDescribedSetStatement(set, description)
+	if !strings.Contains(statement, "flags timeout,dynamic") || !strings.Contains(statement, "size 2") {
+		t.Errorf("Expected the size and the dynamic flag in %q", statement)
+	}
+	if statement := scriptSetStatement(set); strings.Contains(statement, "size") || strings.Contains(statement, "dynamic") {
+		t.Errorf("Expected no description in %q", statement)
+	}
+
+	// the memory backend limits the elements by the size
+	ruleset := NewMemoryRuleset()
+	cache := &NftablesCache{
+		tables:            make(map[nftables.TableFamily]*map[string]*NftableCache),
+		NftableConnection: NewMemoryBackend(ruleset),
+	}
+	batch := NewNftablesBatch(cache)
+	tableCache := cache.MutableNftablesTable(nftables.TableFamilyIPv4, "filter")
+	rule := &NftablesSetAddElement{TableName: "filter", SetName: "VPN", KeyType: nftables.TypeIPAddr, CreateSet: true, SetSize: 2}
+	created, err := rule.newSet(tableCache.table, nftables.TypeIPAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch.CreateSetWithDescription(tableCache, created, rule.setDescription(), nil)
+	batch.Commit()
+	if size, err := NewMemoryBackend(ruleset).GetSetSize(created); err != nil || size != 2 {
+		t.Errorf("Expected the set created with size 2, but got %v, %v", size, err)
+	}
+
+	if err := addSetWithDescription(&nftables.Conn{}, set, description, nil); !errors.Is(err, unix.EOPNOTSUPP) {
+		t.Errorf("Expected EOPNOTSUPP for the backends without description, but got %v", err)
+	}
+}
@@ -0,0 +1,124 @@
+package coredns_nftables
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+var setSizeInterval time.Duration = 0
+var setSizeLock sync.Mutex = sync.Mutex{}
+var setSizeRefs int = 0
+var setSizeStop chan struct{} = nil
+var setSizeSets = make(map[string]nftablesManagedSet)
+
+// SetSetSizeInterval set the interval to count the elements of all managed sets, 0 disables it
+func SetSetSizeInterval(interval time.Duration) {
+	setSizeInterval = interval
+}
+
+// StartSetSizeCollector start the background collector when the first handler starts
+func StartSetSizeCollector() {
+	setSizeLock.Lock()
+	defer setSizeLock.Unlock()
+
+	setSizeRefs += 1
+	if setSizeStop != nil || setSizeInterval <= 0 {
+		return
+	}
+
+	setSizeStop = make(chan struct{})
+	go func(stop chan struct{}, interval time.Duration) {
+		CollectSetSizes()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				CollectSetSizes()
+			}
+		}
+	}(setSizeStop, setSizeInterval)
+}
+
+// StopSetSizeCollector stop the background collector when the last handler stops
+func StopSetSizeCollector() {
+	setSizeLock.Lock()
+	defer setSizeLock.Unlock()
+
+	if setSizeRefs > 0 {
+		setSizeRefs -= 1
+	}
+	if setSizeRefs == 0 && setSizeStop != nil {
+		close(setSizeStop)
+		setSizeStop = nil
+	}
+}
+
+// countSetElements returns the count of elements, the end of each interval is not counted
+func countSetElements(elements []nftables.SetElement) int {
+	ret := 0
+	for _, element := range elements {
+		if !element.IntervalEnd {
+			ret += 1
+		}
+	}
+	return ret
+}
+
+type nftablesManagedSet struct {
+	family    nftables.TableFamily
+	tableName string
+	setName   string
+}
+
+func (set nftablesManagedSet) labels() []string {
+	return []string{getFamilyName(set.family), set.tableName, set.setName}
+}
+
+// CollectSetSizes export the element count of the sets used by rules of running handlers. Sets not existing
+// in the kernel are removed from the gauges.
+func CollectSetSizes() {
+	current := make(map[string]nftablesManagedSet)
+	for _, running := range getRunningSetRules() {
+		current[trackedSetKey(running.family, running.rule.TableName, running.rule.SetName)] = nftablesManagedSet{
+			family:    running.family,
+			tableName: running.rule.TableName,
+			setName:   running.rule.SetName,
+		}
+	}
+
+	conn, newNS, err := openBackend()
+	if err != nil {
+		return
+	}
+	defer cleanupSystemNFTConn(newNS)
+
+	setSizeLock.Lock()
+	defer setSizeLock.Unlock()
+
+	for key, managed := range setSizeSets {
+		if _, ok := current[key]; !ok {
+			setElements.DeleteLabelValues(managed.labels()...)
+		}
+	}
+	setSizeSets = current
+
+	for _, managed := range current {
+		set, err := conn.GetSetByName(&nftables.Table{Family: managed.family, Name: managed.tableName}, managed.setName)
+		if err != nil || set == nil {
+			setElements.DeleteLabelValues(managed.labels()...)
+			continue
+		}
+
+		elements, err := conn.GetSetElements(set)
+		if err != nil {
+			log.Warningf("Nftables can not list elements of set %v %v %v. %v", getFamilyName(managed.family), managed.tableName, managed.setName, err)
+			continue
+		}
+		setElements.WithLabelValues(managed.labels()...).Set(float64(countSetElements(elements)))
+	}
+}
@@ -0,0 +1,200 @@
+package coredns_nftables
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+func TestElementTimeout(t *testing.T) {
+	override := &NftablesTimeoutOverride{Timeout: time.Minute, Matcher: NewNftablesDomainMatcher()}
+	override.Matcher.Add("fixed.example.org")
+	rule := &NftablesSetAddElement{
+		Timeout:          time.Hour,
+		TimeoutOverrides: []*NftablesTimeoutOverride{override},
+		TtlTimeout:       true,
+		TtlMin:           5 * time.Minute,
+		TtlMax:           24 * time.Hour,
+	}
+
+	tests := []struct {
+		rr       string
+		expected time.Duration
+	}{
+		{"example.org. 60 IN A 192.0.2.1", 5 * time.Minute},
+		{"example.org. 3600 IN A 192.0.2.1", time.Hour},
+		{"example.org. 604800 IN A 192.0.2.1", 24 * time.Hour},
+		{"fixed.example.org. 3600 IN A 192.0.2.1", time.Minute},
+	}
+
+	for _, test := range tests {
+		rr, err := dns.NewRR(test.rr)
+		if err != nil {
+			t.Fatalf("NewRR(%v) failed: %v", test.rr, err)
+		}
+		if got, overridden := rule.elementTimeout(&rr, []string{rr.Header().Name}); got != test.expected || !overridden {
+			t.Errorf("elementTimeout(%v) expected %v, but got %v(%v)", test.rr, test.expected, got, overridden)
+		}
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	rule := &NftablesSetAddElement{Match: NewNftablesDomainMatcher(), Except: NewNftablesDomainMatcher()}
+	rule.Match.Add("example.com")
+	rule.Match.Add("*.cdn.net")
+	rule.Except.Add("internal.example.com")
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"www.example.com.", true},
+		{"img.cdn.net.", true},
+		{"cdn.net.", false},
+		{"db.internal.example.com.", false},
+		{"example.org.", false},
+	}
+
+	for _, test := range tests {
+		if got := rule.MatchName(test.name); got != test.expected {
+			t.Errorf("MatchName(%v) expected %v, but got %v", test.name, test.expected, got)
+		}
+	}
+
+	if !(&NftablesSetAddElement{}).MatchName("example.org.") {
+		t.Errorf("Expected rule without match lists to apply to all names")
+	}
+}
+
+func TestIPLimiter(t *testing.T) {
+	limiter := NewNftablesIPLimiter(2, time.Hour, "QUARANTINE")
+	if !limiter.take("example.org.", "192.0.2.1") || !limiter.take("Example.org", "192.0.2.2") {
+		t.Fatalf("Expected the first 2 addresses accepted")
+	}
+	if !limiter.take("example.org.", "192.0.2.1") {
+		t.Fatalf("Expected known address accepted")
+	}
+	if limiter.take("example.org.", "192.0.2.3") {
+		t.Fatalf("Expected the 3rd address rejected")
+	}
+	if !limiter.take("example.com.", "192.0.2.3") {
+		t.Fatalf("Expected addresses of other names accepted")
+	}
+
+	rule := &NftablesSetAddElement{TableName: "filter", SetName: "VPN", Timeout: time.Hour}
+	rule.SetLimiter(limiter)
+	if rule.quarantineRule == nil || rule.quarantineRule.SetName != "QUARANTINE" || rule.quarantineRule.Timeout != time.Hour {
+		t.Fatalf("Unexpected quarantine rule %+v", rule.quarantineRule)
+	}
+}
+
+func TestCnameChain(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	for _, text := range []string{
+		"www.example.com. 60 IN CNAME www.example.com.cdn.net.",
+		"www.example.com.cdn.net. 60 IN CNAME edge.cdn.net.",
+		"edge.cdn.net. 60 IN A 192.0.2.1",
+		"loop.example.org. 60 IN CNAME loop.example.org.",
+	} {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+
+	chain := newCnameChain(r)
+	names := chain.names("edge.cdn.net.")
+	expected := []string{"edge.cdn.net.", "www.example.com.cdn.net.", "www.example.com."}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected names %v, but got %v", expected, names)
+	}
+	if names := chain.names("loop.example.org."); len(names) != 1 {
+		t.Errorf("Expected CNAME loop to be stopped, but got %v", names)
+	}
+
+	rule := &NftablesSetAddElement{Match: NewNftablesDomainMatcher(), Except: NewNftablesDomainMatcher()}
+	rule.Match.Add("example.com")
+	if !rule.MatchName(names...) {
+		t.Errorf("Expected %v to be matched by the query name", names)
+	}
+	rule.Except.Add("cdn.net")
+	if rule.MatchName(names...) {
+		t.Errorf("Expected %v to be skipped by except", names)
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("wWw.ExAmple.COM.", dns.TypeA)
+	for _, text := range []string{
+		"wWw.ExAmple.COM. 60 IN CNAME Edge.CDN.net.",
+		"edge.cdn.NET. 60 IN A 192.0.2.1",
+	} {
+		rr, err := dns.NewRR(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+
+	batch := NewNftablesBatch(nil)
+	answer := &r.Answer[1]
+	if name := batch.AnswerName(answer); name != "edge.cdn.net." {
+		t.Errorf("Expected lowercased name, but got %v", name)
+	}
+
+	names := newCnameChain(r).names(normalizeName((*answer).Header().Name))
+	expected := []string{"edge.cdn.net.", "www.example.com."}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected names %v, but got %v", expected, names)
+	}
+
+	SetPreserveNameCase(true)
+	defer SetPreserveNameCase(false)
+	if name := normalizeName("Edge.CDN.net"); name != "Edge.CDN.net." {
+		t.Errorf("Expected case preserved, but got %v", name)
+	}
+}
+
+func TestSamplerSkipsSetAndLru(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	sharedLru.purge()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+	}()
+
+	handle := NewNftablesHandler()
+	// the first answer is not sampled
+	rule := &NftablesSetAddElement{TableName: "sample", SetName: "ANALYTICS", KeyType: nftables.TypeIPAddr, CreateSet: true,
+		Sampler: &NftablesSampler{Numerator: 1, Denominator: 2, counter: 1}}
+	handle.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddElement = []*NftablesSetAddElement{rule}
+
+	backend := NewMemoryBackend(ruleset)
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "sample"}
+	if applied, err := handle.ServeWorker(context.Background(), newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.1")); applied != 0 || err != nil {
+		t.Fatalf("Expected the answer not sampled, but got %v, %v", applied, err)
+	}
+	if set, _ := backend.GetSetByName(table, "ANALYTICS"); set != nil {
+		t.Errorf("Expected the set not created for the answer not sampled")
+	}
+	if _, ok := getLruEntries()["192.0.2.1"]; ok {
+		t.Errorf("Expected the answer not sampled not deduped")
+	}
+
+	if applied, err := handle.ServeWorker(context.Background(), newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.1")); applied != 1 || err != nil {
+		t.Fatalf("Expected the answer sampled, but got %v, %v", applied, err)
+	}
+	if _, ok := getLruEntries()["192.0.2.1"]; !ok {
+		t.Errorf("Expected the answer applied deduped")
+	}
+}
@@ -0,0 +1,284 @@
+package coredns_nftables
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The SLO report covers the last minute, kept in buckets of 10s
+const sloBucketDuration = 10 * time.Second
+const sloBucketCount = 6
+
+// Latencies kept in each bucket for percentiles, they are sampled uniformly when there are more
+const sloBucketSamples = 1024
+
+const (
+	sloShedAsyncDropped = "async-dropped"
+	sloShedBreaker      = "breaker"
+	sloShedDeadline     = "deadline"
+)
+
+var sloLock sync.Mutex = sync.Mutex{}
+var sloBudget time.Duration = 0
+var sloPercentile float64 = 99
+var sloBuckets [sloBucketCount]nftablesSloBucket
+
+// nftablesSloLatencies is a uniform sample of latencies and their exact count, sum and max
+type nftablesSloLatencies struct {
+	samples []time.Duration
+	count   uint64
+	sum     time.Duration
+	max     time.Duration
+}
+
+func (latencies *nftablesSloLatencies) add(latency time.Duration) {
+	latencies.count += 1
+	latencies.sum += latency
+	if latency > latencies.max {
+		latencies.max = latency
+	}
+	if len(latencies.samples) < sloBucketSamples {
+		latencies.samples = append(latencies.samples, latency)
+	} else if i := rand.Int63n(int64(latencies.count)); i < sloBucketSamples {
+		latencies.samples[i] = latency
+	}
+}
+
+type nftablesSloBucket struct {
+	start    time.Time
+	requests uint64
+	errors   uint64
+	shed     map[string]uint64
+	cost     nftablesSloLatencies
+	poolWait nftablesSloLatencies
+}
+
+// SetSlo set the latency budget which the percentile of the self cost of responses should stay below,
+// 0 budget only reports the latencies
+func SetSlo(budget time.Duration, percentile float64) {
+	sloLock.Lock()
+	defer sloLock.Unlock()
+
+	sloBudget = budget
+	sloPercentile = percentile
+}
+
+// currentSloBucket returns the bucket of now, it's reset when it belongs to an older window. It must be called
+// with sloLock held.
+func currentSloBucket(now time.Time) *nftablesSloBucket {
+	start := now.Truncate(sloBucketDuration)
+	bucket := &sloBuckets[(start.UnixNano()/int64(sloBucketDuration))%sloBucketCount]
+	if !bucket.start.Equal(start) {
+		*bucket = nftablesSloBucket{start: start, shed: make(map[string]uint64)}
+	}
+	return bucket
+}
+
+// recordSloRequest record the self cost of a response, and whether it failed or its work is dropped by the deadline
+func recordSloRequest(cost time.Duration, err error) {
+	sloLock.Lock()
+	defer sloLock.Unlock()
+
+	bucket := currentSloBucket(time.Now())
+	bucket.requests += 1
+	bucket.cost.add(cost)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		bucket.shed[sloShedDeadline] += 1
+	} else if err != nil {
+		bucket.errors += 1
+	}
+}
+
+// recordSloShed record a response which is not applied to protect the latency, reason is sloShed*
+func recordSloShed(reason string) {
+	sloLock.Lock()
+	defer sloLock.Unlock()
+
+	currentSloBucket(time.Now()).shed[reason] += 1
+}
+
+// recordSloPoolWait record how long a response waited in the queue for an async worker
+func recordSloPoolWait(wait time.Duration) {
+	sloLock.Lock()
+	defer sloLock.Unlock()
+
+	currentSloBucket(time.Now()).poolWait.add(wait)
+}
+
+// NftablesSloLatency is the distribution of latencies in microseconds
+type NftablesSloLatency struct {
+	Count uint64 `json:"count"`
+	P50   int64  `json:"p50_us"`
+	P90   int64  `json:"p90_us"`
+	P99   int64  `json:"p99_us"`
+	Max   int64  `json:"max_us"`
+
+	samples []time.Duration
+	sum     time.Duration
+}
+
+func (latency *NftablesSloLatency) quantile(q float64) time.Duration {
+	if len(latency.samples) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(q*float64(len(latency.samples)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return latency.samples[i]
+}
+
+// NftablesSloReport summarizes how the plugin honors its latency budget in the last minute
+type NftablesSloReport struct {
+	Window    string             `json:"window"`
+	Requests  uint64             `json:"requests"`
+	Errors    uint64             `json:"errors"`
+	ErrorRate float64            `json:"error_rate"`
+	Shed      map[string]uint64  `json:"shed"`
+	ShedRate  float64            `json:"shed_rate"`
+	SelfCost  NftablesSloLatency `json:"self_cost"`
+	PoolWait  NftablesSloLatency `json:"pool_wait"`
+	// Only reported when a budget is set by `slo`
+	Budget     string  `json:"budget,omitempty"`
+	Percentile float64 `json:"percentile,omitempty"`
+	Honored    *bool   `json:"honored,omitempty"`
+}
+
+func mergeSloLatencies(latencies []*nftablesSloLatencies) NftablesSloLatency {
+	var ret NftablesSloLatency
+	var longest time.Duration
+	for _, l := range latencies {
+		ret.Count += l.count
+		ret.sum += l.sum
+		ret.samples = append(ret.samples, l.samples...)
+		if l.max > longest {
+			longest = l.max
+		}
+	}
+	sort.Slice(ret.samples, func(i, j int) bool { return ret.samples[i] < ret.samples[j] })
+	ret.P50 = ret.quantile(0.5).Microseconds()
+	ret.P90 = ret.quantile(0.9).Microseconds()
+	ret.P99 = ret.quantile(0.99).Microseconds()
+	ret.Max = longest.Microseconds()
+	return ret
+}
+
+// GetSloReport returns the SLO report of the last minute
+func GetSloReport() *NftablesSloReport {
+	sloLock.Lock()
+	defer sloLock.Unlock()
+
+	now := time.Now()
+	report := &NftablesSloReport{Window: (sloBucketDuration * sloBucketCount).String(), Shed: make(map[string]uint64)}
+	var costs, waits []*nftablesSloLatencies
+	shed := uint64(0)
+	for i := range sloBuckets {
+		bucket := &sloBuckets[i]
+		if bucket.start.IsZero() || now.Sub(bucket.start) >= sloBucketDuration*sloBucketCount {
+			continue
+		}
+		report.Requests += bucket.requests
+		report.Errors += bucket.errors
+		for reason, count := range bucket.shed {
+			report.Shed[reason] += count
+			shed += count
+		}
+		costs = append(costs, &bucket.cost)
+		waits = append(waits, &bucket.poolWait)
+	}
+	report.SelfCost = mergeSloLatencies(costs)
+	report.PoolWait = mergeSloLatencies(waits)
+	if report.Requests > 0 {
+		report.ErrorRate = float64(report.Errors) / float64(report.Requests)
+	}
+	if report.Requests+shed > 0 {
+		report.ShedRate = float64(shed) / float64(report.Requests+shed)
+	}
+
+	if sloBudget > 0 {
+		honored := report.SelfCost.quantile(sloPercentile/100) <= sloBudget
+		report.Budget = sloBudget.String()
+		report.Percentile = sloPercentile
+		report.Honored = &honored
+	}
+	return report
+}
+
+var sloSelfCostDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(plugin.Namespace, "nftables", "slo_self_cost_microseconds"),
+	"Summary of the self cost of responses in the last minute.", nil, nil)
+
+var sloPoolWaitDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(plugin.Namespace, "nftables", "slo_pool_wait_microseconds"),
+	"Summary of the time responses waited for an async worker in the last minute.", nil, nil)
+
+var sloErrorRatioDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(plugin.Namespace, "nftables", "slo_error_ratio"),
+	"Ratio of responses failed to apply in the last minute.", nil, nil)
+
+var sloShedRatioDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(plugin.Namespace, "nftables", "slo_shed_ratio"),
+	"Ratio of responses dropped to protect the latency in the last minute.", nil, nil)
+
+var sloHonoredDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(plugin.Namespace, "nftables", "slo_budget_honored"),
+	"1 if the percentile of the self cost in the last minute is within the budget of `slo`, otherwise 0.", nil, nil)
+
+type nftablesSloCollector struct{}
+
+func init() {
+	prometheus.MustRegister(&nftablesSloCollector{})
+	registerAdminHandler("/slo", serveAdminSlo)
+}
+
+func (c *nftablesSloCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sloSelfCostDesc
+	ch <- sloPoolWaitDesc
+	ch <- sloErrorRatioDesc
+	ch <- sloShedRatioDesc
+	ch <- sloHonoredDesc
+}
+
+func sloSummary(desc *prometheus.Desc, latency *NftablesSloLatency) prometheus.Metric {
+	return prometheus.MustNewConstSummary(desc, latency.Count, float64(latency.sum.Microseconds()), map[float64]float64{
+		0.5:  float64(latency.P50),
+		0.9:  float64(latency.P90),
+		0.99: float64(latency.P99),
+	})
+}
+
+func (c *nftablesSloCollector) Collect(ch chan<- prometheus.Metric) {
+	report := GetSloReport()
+	ch <- sloSummary(sloSelfCostDesc, &report.SelfCost)
+	ch <- sloSummary(sloPoolWaitDesc, &report.PoolWait)
+	ch <- prometheus.MustNewConstMetric(sloErrorRatioDesc, prometheus.GaugeValue, report.ErrorRate)
+	ch <- prometheus.MustNewConstMetric(sloShedRatioDesc, prometheus.GaugeValue, report.ShedRate)
+	if report.Honored != nil {
+		honored := 0.0
+		if *report.Honored {
+			honored = 1
+		}
+		ch <- prometheus.MustNewConstMetric(sloHonoredDesc, prometheus.GaugeValue, honored)
+	}
+}
+
+// serveAdminSlo returns the SLO report by GET /slo
+func serveAdminSlo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetSloReport())
+}
@@ -0,0 +1,78 @@
+package coredns_nftables
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSloReport(t *testing.T) {
+	sloBuckets = [sloBucketCount]nftablesSloBucket{}
+	SetSlo(5*time.Millisecond, 90)
+	defer SetSlo(0, 99)
+
+	for i := 1; i <= 10; i++ {
+		recordSloRequest(time.Duration(i)*time.Millisecond, nil)
+	}
+	recordSloRequest(time.Millisecond, errors.New("flush failed"))
+	recordSloRequest(time.Millisecond, context.DeadlineExceeded)
+	recordSloShed(sloShedAsyncDropped)
+	recordSloPoolWait(3 * time.Millisecond)
+
+	report := GetSloReport()
+	if report.Requests != 12 || report.Errors != 1 {
+		t.Errorf("Expected 12 requests and 1 error, but got %v and %v", report.Requests, report.Errors)
+	}
+	if report.Shed[sloShedDeadline] != 1 || report.Shed[sloShedAsyncDropped] != 1 {
+		t.Errorf("Expected 1 deadline and 1 async dropped shed, but got %v", report.Shed)
+	}
+	if report.SelfCost.Count != 12 || report.SelfCost.Max != 10000 || report.SelfCost.P50 != 4000 {
+		t.Errorf("Expected self cost of 12 requests with p50 4ms and max 10ms, but got %+v", report.SelfCost)
+	}
+	if report.PoolWait.Count != 1 || report.PoolWait.P99 != 3000 {
+		t.Errorf("Expected 1 pool wait of 3ms, but got %+v", report.PoolWait)
+	}
+	if report.Honored == nil || *report.Honored {
+		t.Errorf("Expected p90 9ms exceeds budget 5ms, but got %v", report.Honored)
+	}
+
+	SetSlo(10*time.Millisecond, 90)
+	if report := GetSloReport(); report.Honored == nil || !*report.Honored {
+		t.Errorf("Expected p90 9ms within budget 10ms, but got %v", report.Honored)
+	}
+
+	// Buckets older than the window are not reported
+	sloLock.Lock()
+	for i := range sloBuckets {
+		sloBuckets[i].start = sloBuckets[i].start.Add(-sloBucketDuration * sloBucketCount)
+	}
+	sloLock.Unlock()
+	if report := GetSloReport(); report.Requests != 0 || report.SelfCost.Count != 0 {
+		t.Errorf("Expected expired buckets ignored, but got %+v", report)
+	}
+}
+
+func TestAdminSlo(t *testing.T) {
+	sloBuckets = [sloBucketCount]nftablesSloBucket{}
+	recordSloRequest(time.Millisecond, nil)
+
+	w := httptest.NewRecorder()
+	serveAdminSlo(w, httptest.NewRequest(http.MethodGet, "/slo", nil))
+	var report NftablesSloReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected SLO report, but got %v %v", w.Code, err)
+	}
+	if report.Requests != 1 || report.Window != "1m0s" || report.Honored != nil {
+		t.Errorf("Expected 1 request without budget in 1m window, but got %+v", report)
+	}
+
+	w = httptest.NewRecorder()
+	serveAdminSlo(w, httptest.NewRequest(http.MethodPost, "/slo", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected POST not allowed, but got %v", w.Code)
+	}
+}
@@ -0,0 +1,87 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// NftablesAddressGroup is a named list of address ranges, addresses in Except are not contained even if they are
+// in Ranges
+type NftablesAddressGroup struct {
+	Name   string
+	Ranges []*net.IPNet
+	Except []*net.IPNet
+}
+
+func (g *NftablesAddressGroup) Contains(ip net.IP) bool {
+	for _, except := range g.Except {
+		if except.Contains(ip) {
+			return false
+		}
+	}
+	for _, r := range g.Ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func newAddressGroup(name string, ranges []string, except []string) *NftablesAddressGroup {
+	mustParse := func(cidrs []string) []*net.IPNet {
+		ret := make([]*net.IPNet, 0, len(cidrs))
+		for _, cidr := range cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				panic(fmt.Sprintf("invalid builtin address range %v of %v", cidr, name))
+			}
+			ret = append(ret, network)
+		}
+		return ret
+	}
+
+	return &NftablesAddressGroup{Name: name, Ranges: mustParse(ranges), Except: mustParse(except)}
+}
+
+// Builtin address groups. special-purpose contains the entries of IANA IPv4 and IPv6 Special-Purpose Address
+// Registries which are not globally reachable, so NAT64(64:ff9b::/96), AS112 and AMT addresses still work.
+// IPv4-mapped addresses(::ffff:0:0/96) are checked as IPv4 addresses by net.IPNet, so they are not listed.
+// https://www.iana.org/assignments/iana-ipv4-special-registry
+// https://www.iana.org/assignments/iana-ipv6-special-registry
+var builtinAddressGroups = map[string]*NftablesAddressGroup{
+	"special-purpose": newAddressGroup("special-purpose", []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+		"240.0.0.0/4", "255.255.255.255/32",
+		"::/128", "::1/128", "64:ff9b:1::/48", "100::/64", "2001::/23", "2001:db8::/32",
+		"3fff::/20", "5f00::/16", "fc00::/7", "fe80::/10",
+	}, []string{
+		"192.0.0.9/32", "192.0.0.10/32",
+		"2001:1::1/128", "2001:1::2/128", "2001:1::3/128", "2001:3::/32", "2001:4:112::/48", "2001:20::/28", "2001:30::/28",
+	}),
+	"private":       newAddressGroup("private", []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}, nil),
+	"shared":        newAddressGroup("shared", []string{"100.64.0.0/10"}, nil),
+	"loopback":      newAddressGroup("loopback", []string{"127.0.0.0/8", "::1/128"}, nil),
+	"link-local":    newAddressGroup("link-local", []string{"169.254.0.0/16", "fe80::/10"}, nil),
+	"documentation": newAddressGroup("documentation", []string{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24", "2001:db8::/32", "3fff::/20"}, nil),
+	"benchmarking":  newAddressGroup("benchmarking", []string{"198.18.0.0/15", "2001:2::/48"}, nil),
+	"reserved":      newAddressGroup("reserved", []string{"240.0.0.0/4", "255.255.255.255/32"}, nil),
+	"unspecified":   newAddressGroup("unspecified", []string{"0.0.0.0/8", "::/128"}, nil),
+	"multicast":     newAddressGroup("multicast", []string{"224.0.0.0/4", "ff00::/8"}, nil),
+}
+
+// getAddressGroup returns the builtin address group of name
+func getAddressGroup(name string) (*NftablesAddressGroup, error) {
+	group, ok := builtinAddressGroups[strings.ToLower(name)]
+	if !ok {
+		var names []string
+		for groupName := range builtinAddressGroups {
+			names = append(names, groupName)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("address group %v not found, valid groups are %v", name, strings.Join(names, ", "))
+	}
+	return group, nil
+}
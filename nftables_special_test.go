@@ -0,0 +1,38 @@
+package coredns_nftables
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddressGroups(t *testing.T) {
+	group, err := getAddressGroup("special-purpose")
+	if err != nil {
+		t.Fatalf("getAddressGroup failed: %v", err)
+	}
+
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.1.2.3", true},
+		{"192.0.2.1", true},
+		{"192.0.0.9", false},
+		{"8.8.8.8", false},
+		{"::1", true},
+		{"fe80::1", true},
+		{"2001:db8::1", true},
+		{"2001:4:112::1", false},
+		{"64:ff9b::808:808", false},
+		{"2606:4700::1111", false},
+	}
+	for _, test := range tests {
+		if got := group.Contains(net.ParseIP(test.ip)); got != test.expected {
+			t.Errorf("special-purpose contains %v expected %v, but got %v", test.ip, test.expected, got)
+		}
+	}
+
+	if _, err := getAddressGroup("bogon"); err == nil {
+		t.Errorf("Expected errors for unknown group")
+	}
+}
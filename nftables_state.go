@@ -0,0 +1,270 @@
+package coredns_nftables
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// NftablesStateVersion is the version of the state schema written by ExportState, ImportState only accepts
+// states of the same or older versions
+const NftablesStateVersion = 1
+
+// NftablesState is the versioned export of rules, intended elements and dedup cache
+type NftablesState struct {
+	Version  int                    `json:"version"`
+	Time     string                 `json:"time"`
+	Rules    []NftablesStateRule    `json:"rules"`
+	Elements []NftablesStateElement `json:"elements"`
+	Dedup    []NftablesStateDedup   `json:"dedup"`
+}
+
+type NftablesStateRule struct {
+	Family   string `json:"family"`
+	Table    string `json:"table"`
+	Set      string `json:"set"`
+	KeyType  string `json:"key_type"`
+	Interval bool   `json:"interval"`
+	Timeout  string `json:"timeout"`
+}
+
+type NftablesStateElement struct {
+	Family  string `json:"family"`
+	Table   string `json:"table"`
+	Set     string `json:"set"`
+	Element string `json:"element"`
+	Name    string `json:"name"`
+	Timeout string `json:"timeout"`
+	// RFC3339 time, empty if the element never expires
+	Expire string `json:"expire,omitempty"`
+}
+
+type NftablesStateDedup struct {
+	Address    string `json:"address"`
+	ApplyCount int    `json:"apply_count"`
+	Expire     string `json:"expire"`
+}
+
+// NftablesImportResult is the summary of importing a state
+type NftablesImportResult struct {
+	Elements int `json:"elements"`
+	Expired  int `json:"expired"`
+	Dedup    int `json:"dedup"`
+}
+
+func init() {
+	registerAdminHandler("/state", serveAdminState)
+}
+
+// ExportState collect the rules of running handlers, the living tracked elements and the dedup LRU
+func ExportState() *NftablesState {
+	now := time.Now()
+	state := &NftablesState{
+		Version:  NftablesStateVersion,
+		Time:     now.Format(time.RFC3339),
+		Rules:    []NftablesStateRule{},
+		Elements: []NftablesStateElement{},
+		Dedup:    []NftablesStateDedup{},
+	}
+
+	for _, rule := range getRunningSetRules() {
+		state.Rules = append(state.Rules, NftablesStateRule{
+			Family:   getFamilyName(rule.family),
+			Table:    rule.rule.TableName,
+			Set:      rule.rule.SetName,
+			KeyType:  getKeyTypeName(rule.rule.KeyType),
+			Interval: rule.rule.Interval,
+			Timeout:  rule.rule.Timeout.String(),
+		})
+	}
+
+	tracked := GetTrackedElements()
+	setKeys := make([]string, 0, len(tracked))
+	for setKey := range tracked {
+		setKeys = append(setKeys, setKey)
+	}
+	sort.Strings(setKeys)
+	for _, setKey := range setKeys {
+		for _, element := range tracked[setKey] {
+			stateElement := NftablesStateElement{
+				Family:  getFamilyName(element.Family),
+				Table:   element.TableName,
+				Set:     element.SetName,
+				Element: element.Element,
+				Name:    element.Name,
+				Timeout: element.Timeout.String(),
+			}
+			if !element.ExpireTime.IsZero() {
+				stateElement.Expire = element.ExpireTime.Format(time.RFC3339)
+			}
+			state.Elements = append(state.Elements, stateElement)
+		}
+	}
+
+	state.Dedup = SnapshotLru().Entries
+
+	return state
+}
+
+// ImportState add the living elements of state into kernel sets and seed the dedup LRU.
+// Rules are not imported, they always come from the Corefile.
+func ImportState(state *NftablesState) (*NftablesImportResult, error) {
+	if state.Version <= 0 || state.Version > NftablesStateVersion {
+		return nil, fmt.Errorf("state version %v not supported, expect 1-%v", state.Version, NftablesStateVersion)
+	}
+
+	result := &NftablesImportResult{}
+	now := time.Now()
+
+	type importSet struct {
+		family    nftables.TableFamily
+		tableName string
+		setName   string
+		elements  []nftables.SetElement
+		applied   []NftablesAppliedElement
+	}
+	var sets []*importSet
+	index := make(map[string]*importSet)
+	for _, element := range state.Elements {
+		family, err := parseFamilyName(element.Family)
+		if err != nil {
+			return nil, err
+		}
+		setElement, err := parseElement(element.Element)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := time.ParseDuration(element.Timeout); err != nil {
+			return nil, fmt.Errorf("element %v timeout %v invalid, %v", element.Element, element.Timeout, err)
+		}
+
+		var remaining time.Duration = 0
+		if len(element.Expire) > 0 {
+			expire, err := time.Parse(time.RFC3339, element.Expire)
+			if err != nil {
+				return nil, fmt.Errorf("element %v expire %v invalid, %v", element.Element, element.Expire, err)
+			}
+			remaining = expire.Sub(now)
+			if remaining <= 0 {
+				result.Expired += 1
+				continue
+			}
+		}
+
+		setKey := trackedSetKey(family, element.Table, element.Set)
+		target, ok := index[setKey]
+		if !ok {
+			target = &importSet{family: family, tableName: element.Table, setName: element.Set}
+			index[setKey] = target
+			sets = append(sets, target)
+		}
+
+		setElement.Timeout = remaining
+		target.elements = append(target.elements, setElement)
+		target.applied = append(target.applied, NftablesAppliedElement{
+			Family:    family,
+			TableName: element.Table,
+			SetName:   element.Set,
+			Element:   element.Element,
+			Name:      element.Name,
+			Timeout:   remaining,
+		})
+	}
+
+	if len(sets) > 0 {
+		conn, newNS, err := openBackend()
+		if err != nil {
+			return nil, err
+		}
+		defer cleanupSystemNFTConn(newNS)
+
+		for _, target := range sets {
+			table := &nftables.Table{Family: target.family, Name: target.tableName}
+			set, err := conn.GetSetByName(table, target.setName)
+			if err != nil || set == nil {
+				return result, fmt.Errorf("set %v %v %v not found, %v", getFamilyName(target.family), target.tableName, target.setName, err)
+			}
+			if !set.HasTimeout {
+				for i := range target.elements {
+					target.elements[i].Timeout = 0
+				}
+			}
+
+			err = conn.SetAddElements(set, target.elements)
+			if err == nil {
+				err = conn.Flush()
+			}
+			if err != nil {
+				WriteAppliedLog("failed", target.applied)
+				return result, fmt.Errorf("import %v element(s) into set %v %v %v failed, %v", len(target.elements), getFamilyName(target.family), target.tableName, target.setName, err)
+			}
+
+			WriteAppliedLog("add", target.applied)
+			for i, applied := range target.applied {
+				TrackElement(applied, target.elements[i].Key, target.elements[i].Val)
+			}
+			result.Elements += len(target.elements)
+		}
+	}
+
+	restored, err := RestoreLru(&NftablesLruSnapshot{Version: NftablesLruSnapshotVersion, Entries: state.Dedup})
+	result.Dedup = restored
+	return result, err
+}
+
+// serveAdminState export the state with GET and import it with POST
+func serveAdminState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(ExportState())
+	case http.MethodPost:
+		var state NftablesState
+		data, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(data, &state)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid state, %v", err), http.StatusBadRequest)
+			return
+		}
+
+		result, err := ImportState(&state)
+		if err != nil {
+			log.Errorf("Nftables import state failed. %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Nftables import %v element(s) and %v dedup entries, %v expired element(s) ignored", result.Elements, result.Dedup, result.Expired)
+		json.NewEncoder(w).Encode(result)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseFamilyName accept the names of getFamilyName and the names used in Corefile
+func parseFamilyName(name string) (nftables.TableFamily, error) {
+	switch name {
+	case "ip", "ipv4":
+		return nftables.TableFamilyIPv4, nil
+	case "ip6", "ipv6":
+		return nftables.TableFamilyIPv6, nil
+	case "inet":
+		return nftables.TableFamilyINet, nil
+	case "arp":
+		return nftables.TableFamilyARP, nil
+	case "bridge":
+		return nftables.TableFamilyBridge, nil
+	case "netdev":
+		return nftables.TableFamilyNetdev, nil
+	}
+
+	return nftables.TableFamilyUnspecified, fmt.Errorf("family %v invalid", name)
+}
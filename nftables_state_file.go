@@ -0,0 +1,124 @@
+package coredns_nftables
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+var stateFileLock sync.Mutex = sync.Mutex{}
+var stateFilePath string = ""
+var stateFileInterval time.Duration = time.Minute
+var stateFileRefs int = 0
+var stateFileStop chan struct{} = nil
+var stateFileRestored bool = false
+
+// SetStateFile set the file recording the living elements added by the plugin(the same state as GET /state), it's
+// saved every interval and when the process stops, and restored once when it starts. Empty path disables it.
+func SetStateFile(path string, interval time.Duration) {
+	stateFileLock.Lock()
+	defer stateFileLock.Unlock()
+
+	stateFilePath = path
+	if interval > 0 {
+		stateFileInterval = interval
+	} else {
+		stateFileInterval = time.Minute
+	}
+	if len(path) > 0 {
+		EnableElementTracker(true)
+	}
+}
+
+// StartStateFile restore the state file once after the process starts, and save it periodically
+func StartStateFile() {
+	RestoreStateFile()
+
+	stateFileLock.Lock()
+	defer stateFileLock.Unlock()
+
+	stateFileRefs += 1
+	if stateFileStop != nil || len(stateFilePath) == 0 {
+		return
+	}
+
+	stateFileStop = make(chan struct{})
+	go func(stop chan struct{}, interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				SaveStateFile()
+			}
+		}
+	}(stateFileStop, stateFileInterval)
+}
+
+func StopStateFile() {
+	stateFileLock.Lock()
+	defer stateFileLock.Unlock()
+
+	if stateFileRefs > 0 {
+		stateFileRefs -= 1
+	}
+	if stateFileRefs == 0 && stateFileStop != nil {
+		close(stateFileStop)
+		stateFileStop = nil
+	}
+}
+
+// RestoreStateFile add the living elements of the state file back into their sets, so a restart does not leave the
+// firewall missing elements until clients resolve the names again. A missing file is not an error.
+func RestoreStateFile() {
+	stateFileLock.Lock()
+	defer stateFileLock.Unlock()
+
+	if len(stateFilePath) == 0 || stateFileRestored {
+		return
+	}
+	stateFileRestored = true
+
+	data, err := readFileMaybeCompressed(stateFilePath)
+	if os.IsNotExist(err) {
+		return
+	}
+	var state NftablesState
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	var result *NftablesImportResult
+	if err == nil {
+		result, err = ImportState(&state)
+	}
+	if err != nil {
+		log.Errorf("Nftables restore state from %v failed. %v", stateFilePath, err)
+		return
+	}
+	log.Infof("Nftables restore %v element(s) and %v dedup entries from %v, %v expired element(s) ignored",
+		result.Elements, result.Dedup, stateFilePath, result.Expired)
+}
+
+// SaveStateFile write the state into the state file
+func SaveStateFile() {
+	stateFileLock.Lock()
+	defer stateFileLock.Unlock()
+
+	if len(stateFilePath) == 0 {
+		return
+	}
+
+	state := ExportState()
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = writeFileAtomic(stateFilePath, data)
+	}
+	if err != nil {
+		log.Errorf("Nftables save state to %v failed. %v", stateFilePath, err)
+		return
+	}
+	log.Debugf("Nftables save %v element(s) to %v", len(state.Elements), stateFilePath)
+}
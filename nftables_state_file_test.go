@@ -0,0 +1,78 @@
+package coredns_nftables
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func newTestStateRuleset(t *testing.T) (*MemoryRuleset, *nftables.Set) {
+	ruleset := NewMemoryRuleset()
+	backend := NewMemoryBackend(ruleset)
+	table := backend.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"})
+	set := &nftables.Set{Table: table, Name: "VPN", KeyType: nftables.TypeIPAddr, HasTimeout: true, Timeout: time.Hour}
+	backend.AddSet(set, nil)
+	if err := backend.Flush(); err != nil {
+		t.Fatalf("Expected set created, but got %v", err)
+	}
+	return ruleset, set
+}
+
+func TestStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	SetStateFile(path, 0)
+	defer func() {
+		SetStateFile("", 0)
+		stateFileRestored = false
+		EnableElementTracker(false)
+		SetNftBackendFactory(nil)
+	}()
+
+	TrackElement(NftablesAppliedElement{Family: nftables.TableFamilyIPv4, TableName: "filter", SetName: "VPN", Element: "192.0.2.1",
+		Name: "example.org.", Timeout: time.Hour}, net.ParseIP("192.0.2.1").To4(), nil)
+	SaveStateFile()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected state file saved, but got %v", err)
+	}
+
+	// the process restarts with empty sets
+	EnableElementTracker(false)
+	EnableElementTracker(true)
+	ruleset, set := newTestStateRuleset(t)
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	stateFileRestored = false
+	RestoreStateFile()
+
+	elements, _ := NewMemoryBackend(ruleset).GetSetElements(set)
+	if len(elements) != 1 || !net.IP(elements[0].Key).Equal(net.ParseIP("192.0.2.1")) || elements[0].Timeout <= 0 || elements[0].Timeout > time.Hour {
+		t.Fatalf("Expected element restored with remaining timeout, but got %v", elements)
+	}
+	if tracked := GetTrackedElements()[trackedSetKey(nftables.TableFamilyIPv4, "filter", "VPN")]; len(tracked) != 1 {
+		t.Errorf("Expected restored element tracked, but got %v", tracked)
+	}
+
+	// restored only once
+	ruleset, set = newTestStateRuleset(t)
+	RestoreStateFile()
+	if elements, _ := NewMemoryBackend(ruleset).GetSetElements(set); len(elements) != 0 {
+		t.Errorf("Expected state restored only once, but got %v", elements)
+	}
+}
+
+func TestStateFileMissing(t *testing.T) {
+	SetStateFile(filepath.Join(t.TempDir(), "missing.json"), time.Second)
+	defer func() {
+		SetStateFile("", 0)
+		stateFileRestored = false
+		EnableElementTracker(false)
+	}()
+
+	RestoreStateFile()
+	if !stateFileRestored {
+		t.Errorf("Expected missing state file ignored")
+	}
+}
@@ -0,0 +1,39 @@
+package coredns_nftables
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImportStateVersion(t *testing.T) {
+	if _, err := ImportState(&NftablesState{Version: NftablesStateVersion + 1}); err == nil {
+		t.Fatalf("Expected errors for unsupported version, but got nil")
+	}
+	if _, err := ImportState(&NftablesState{}); err == nil {
+		t.Fatalf("Expected errors for missing version, but got nil")
+	}
+}
+
+func TestImportStateDedup(t *testing.T) {
+	defer func() { sharedLru.purge() }()
+
+	expire := time.Now().Add(time.Hour).Format(time.RFC3339)
+	result, err := ImportState(&NftablesState{
+		Version: NftablesStateVersion,
+		Dedup: []NftablesStateDedup{
+			{Address: "192.0.2.1", ApplyCount: 3, Expire: expire},
+			{Address: "192.0.2.2", ApplyCount: 1, Expire: time.Now().Add(-time.Hour).Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if result.Dedup != 1 {
+		t.Fatalf("Expected 1 dedup entry imported, but got %v", result.Dedup)
+	}
+
+	state := ExportState()
+	if len(state.Dedup) != 1 || state.Dedup[0].Address != "192.0.2.1" || state.Dedup[0].ApplyCount != 3 {
+		t.Fatalf("Expected 192.0.2.1 exported with apply count 3, but got %v", state.Dedup)
+	}
+}
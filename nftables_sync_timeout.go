@@ -0,0 +1,65 @@
+package coredns_nftables
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/miekg/dns"
+)
+
+var syncTimeout time.Duration = 0
+
+// SetNftableSyncTimeout set the latency budget of the synchronous mode, the response is written once the update
+// exceeds it and the rest of the update is finished in background. 0 waits until the update is done.
+func SetNftableSyncTimeout(timeout time.Duration) {
+	asyncPoolLock.Lock()
+	defer asyncPoolLock.Unlock()
+
+	syncTimeout = timeout
+}
+
+// serveSync apply r before the response is written, it returns false when the update exceeds `sync-timeout` and
+// is left to finish in background, then the result of the update is unknown. With the worker pool of async mode,
+// the update is served by the pool under its overflow policy, so the updates left in background are bounded.
+func (m *NftablesHandler) serveSync(ctx context.Context, r *dns.Msg, nextPluginCost time.Duration) bool {
+	asyncPoolLock.Lock()
+	timeout := syncTimeout
+	queue := asyncPoolQueue
+	stop := asyncPoolStop
+	overflow := asyncOverflow
+	asyncPoolLock.Unlock()
+	if timeout <= 0 {
+		m.Serve(ctx, r, nextPluginCost)
+		return true
+	}
+
+	// writers of the previous plugins may rewrite the response while the update goes on, so it's copied
+	copyMsg := compactMsg(r)
+	done := make(chan struct{})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	if queue == nil {
+		go func() {
+			defer close(done)
+			m.Serve(detachContext(ctx), copyMsg, nextPluginCost)
+		}()
+	} else {
+		job := &nftablesAsyncJob{ctx: detachContext(ctx), handler: m, msg: copyMsg, duration: nextPluginCost, queued: time.Now(), done: done}
+		if !queueAsyncJob(queue, stop, overflow, job, timer.C) {
+			log.Debugf("Nftables update of %v is dropped by the async queue, write the response", r.Answer[0].Header().Name)
+			syncTimeoutCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+			return false
+		}
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	log.Debugf("Nftables update of %v exceeds %vus, write the response and finish it in background", r.Answer[0].Header().Name, timeout.Microseconds())
+	syncTimeoutCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	return false
+}
@@ -0,0 +1,143 @@
+package coredns_nftables
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowFlushBackend holds every flush until release is closed
+type slowFlushBackend struct {
+	*MemoryBackend
+	release chan struct{}
+}
+
+func (backend *slowFlushBackend) Flush() error {
+	<-backend.release
+	return backend.MemoryBackend.Flush()
+}
+
+func TestSyncTimeout(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	release := make(chan struct{})
+	SetNftBackendFactory(func() (NftBackend, error) {
+		return &slowFlushBackend{MemoryBackend: NewMemoryBackend(ruleset), release: release}, nil
+	})
+	ClearCache()
+	SetNftableSyncTimeout(10 * time.Millisecond)
+	defer func() {
+		SetNftableSyncTimeout(0)
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+	}()
+
+	handle := NewNftablesHandler()
+	handle.OnError = NftablesOnErrorServfail
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_sync", SetName: "SYNC_TIMEOUT", KeyType: nftables.TypeInvalid})
+	handle.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		reply := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.200")
+		reply.SetReply(r)
+		w.WriteMsg(reply)
+		return dns.RcodeSuccess, nil
+	})
+
+	timeouts := testutil.ToFloat64(syncTimeoutCount.WithLabelValues(""))
+	request := new(dns.Msg)
+	request.SetQuestion("example.org.", dns.TypeA)
+	recorder := dnstest.NewRecorder(&test.ResponseWriter{})
+	startTime := time.Now()
+	if _, err := handle.ServeDNS(context.Background(), recorder, request); err != nil {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	if time.Since(startTime) > time.Second || recorder.Msg == nil || recorder.Msg.Rcode != dns.RcodeSuccess || len(recorder.Msg.Answer) != 1 {
+		t.Fatalf("Expected the response written once the update exceeds the timeout, but got %v", recorder.Msg)
+	}
+	if testutil.ToFloat64(syncTimeoutCount.WithLabelValues("")) != timeouts+1 {
+		t.Errorf("Expected the sync timeout counted")
+	}
+
+	// the rest of the update finishes in background
+	close(release)
+	backend := NewMemoryBackend(ruleset)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		set, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_sync"}, "SYNC_TIMEOUT")
+		if err == nil {
+			if elements, _ := backend.GetSetElements(set); len(elements) == 1 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the element added in background")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// updates in the budget are not counted
+	SetNftableSyncTimeout(time.Minute)
+	recorder = dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := handle.ServeDNS(context.Background(), recorder, request); err != nil || recorder.Msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("ServeDNS failed: %v", err)
+	}
+	if testutil.ToFloat64(syncTimeoutCount.WithLabelValues("")) != timeouts+1 {
+		t.Errorf("Expected the update in the budget not counted")
+	}
+}
+
+func TestSyncTimeoutPool(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	release := make(chan struct{})
+	SetNftBackendFactory(func() (NftBackend, error) {
+		return &slowFlushBackend{MemoryBackend: NewMemoryBackend(ruleset), release: release}, nil
+	})
+	ClearCache()
+	SetNftableSyncTimeout(10 * time.Millisecond)
+	if err := SetNftableAsyncPool(1, 1, asyncOverflowDrop); err != nil {
+		t.Fatal(err)
+	}
+	StartAsyncPool()
+	defer func() {
+		close(release)
+		StopAsyncPool()
+		SetNftableAsyncPool(0, 4096, asyncOverflowDrop)
+		SetNftableSyncTimeout(0)
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+	}()
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_sync", SetName: "SYNC_POOL", KeyType: nftables.TypeInvalid})
+	addresses := []string{"192.0.2.201", "192.0.2.202", "192.0.2.203"}
+	served := 0
+	handle.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		reply := newTestResponse(t, "example.org.", "example.org. 60 IN A "+addresses[served])
+		served++
+		reply.SetReply(r)
+		w.WriteMsg(reply)
+		return dns.RcodeSuccess, nil
+	})
+
+	// the first update holds the worker, the second one waits in the queue and the third one is dropped
+	dropped := testutil.ToFloat64(asyncDroppedCount.WithLabelValues(asyncOverflowDrop))
+	for range addresses {
+		request := new(dns.Msg)
+		request.SetQuestion("example.org.", dns.TypeA)
+		recorder := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := handle.ServeDNS(context.Background(), recorder, request); err != nil || recorder.Msg == nil {
+			t.Fatalf("ServeDNS failed: %v", err)
+		}
+	}
+	if testutil.ToFloat64(asyncDroppedCount.WithLabelValues(asyncOverflowDrop)) != dropped+1 {
+		t.Errorf("Expected the update over the pool dropped by the overflow policy")
+	}
+}
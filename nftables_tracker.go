@@ -0,0 +1,151 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// NftablesTrackedElement is an element the plugin intends to keep in a set until ExpireTime
+type NftablesTrackedElement struct {
+	Family    nftables.TableFamily
+	TableName string
+	SetName   string
+	Key       []byte
+	// The data of map elements
+	Val        []byte
+	Element    string
+	Name       string
+	Timeout    time.Duration
+	ExpireTime time.Time
+	// when the element is added, the oldest elements are evicted first from a full set, see SetFullPolicy
+	AddTime time.Time
+}
+
+type nftablesTrackedSet struct {
+	family    nftables.TableFamily
+	tableName string
+	setName   string
+	elements  map[string]*NftablesTrackedElement
+}
+
+var elementTrackerLock sync.Mutex = sync.Mutex{}
+var elementTrackerEnabled bool = false
+var elementTracker = make(map[string]*nftablesTrackedSet)
+
+// Expired returns true if the kernel should already have removed the element
+func (element *NftablesTrackedElement) Expired(now time.Time) bool {
+	return !element.ExpireTime.IsZero() && !element.ExpireTime.After(now)
+}
+
+// Remaining returns the time left before the element expires, 0 means it never expires
+func (element *NftablesTrackedElement) Remaining(now time.Time) time.Duration {
+	if element.ExpireTime.IsZero() {
+		return 0
+	}
+	return element.ExpireTime.Sub(now)
+}
+
+func trackedSetKey(family nftables.TableFamily, tableName string, setName string) string {
+	return fmt.Sprintf("%v %v %v", getFamilyName(family), tableName, setName)
+}
+
+// EnableElementTracker start recording the elements added by the plugin, it's used by the features relying on
+// the intended state such as drift detection
+func EnableElementTracker(enable bool) {
+	elementTrackerLock.Lock()
+	defer elementTrackerLock.Unlock()
+
+	elementTrackerEnabled = enable
+	if !enable {
+		elementTracker = make(map[string]*nftablesTrackedSet)
+	}
+}
+
+// TrackElement record an element which is added to the kernel successfully.
+// The kernel does not refresh the timeout of an existing element, so the expire time of a living element is kept.
+func TrackElement(applied NftablesAppliedElement, key []byte, val []byte) {
+	elementTrackerLock.Lock()
+	defer elementTrackerLock.Unlock()
+
+	if !elementTrackerEnabled {
+		return
+	}
+
+	setKey := trackedSetKey(applied.Family, applied.TableName, applied.SetName)
+	trackedSet, ok := elementTracker[setKey]
+	if !ok {
+		trackedSet = &nftablesTrackedSet{
+			family:    applied.Family,
+			tableName: applied.TableName,
+			setName:   applied.SetName,
+			elements:  make(map[string]*NftablesTrackedElement),
+		}
+		elementTracker[setKey] = trackedSet
+	}
+
+	now := time.Now()
+	old, ok := trackedSet.elements[string(key)]
+	if ok && !old.Expired(now) {
+		old.Name = applied.Name
+		old.Val = append([]byte(nil), val...)
+		return
+	}
+
+	element := &NftablesTrackedElement{
+		Family:    applied.Family,
+		TableName: applied.TableName,
+		SetName:   applied.SetName,
+		Key:       append([]byte(nil), key...),
+		Val:       append([]byte(nil), val...),
+		Element:   applied.Element,
+		Name:      applied.Name,
+		Timeout:   applied.Timeout,
+		AddTime:   now,
+	}
+	if applied.Timeout > 0 {
+		element.ExpireTime = now.Add(applied.Timeout)
+	}
+	trackedSet.elements[string(key)] = element
+}
+
+// UntrackElement forget an element, for example it's removed from the kernel. It returns the forgotten element.
+func UntrackElement(family nftables.TableFamily, tableName string, setName string, key []byte) (NftablesTrackedElement, bool) {
+	elementTrackerLock.Lock()
+	defer elementTrackerLock.Unlock()
+
+	trackedSet, ok := elementTracker[trackedSetKey(family, tableName, setName)]
+	if !ok {
+		return NftablesTrackedElement{}, false
+	}
+	element, ok := trackedSet.elements[string(key)]
+	if !ok {
+		return NftablesTrackedElement{}, false
+	}
+	delete(trackedSet.elements, string(key))
+	return *element, true
+}
+
+// GetTrackedElements returns the living elements of each tracked set and removes expired ones
+func GetTrackedElements() map[string][]NftablesTrackedElement {
+	elementTrackerLock.Lock()
+	defer elementTrackerLock.Unlock()
+
+	now := time.Now()
+	ret := make(map[string][]NftablesTrackedElement)
+	for setKey, trackedSet := range elementTracker {
+		elements := make([]NftablesTrackedElement, 0, len(trackedSet.elements))
+		for key, element := range trackedSet.elements {
+			if element.Expired(now) {
+				delete(trackedSet.elements, key)
+				continue
+			}
+			elements = append(elements, *element)
+		}
+		ret[setKey] = elements
+	}
+
+	return ret
+}
@@ -0,0 +1,422 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// The provenance of elements is a comment of the element userdata, so that `nft list set` and `nft -j list set`
+// show it. The comment is ElementProvenancePrefix and a base64 blob of TLVs: a version byte, then type(1 byte),
+// length(1 byte) and value of each field.
+const ElementProvenancePrefix = "coredns:"
+
+const (
+	elementProvenanceVersion = 1
+	// FNV-1a 64 of the canonical origin qname, 8 bytes in big endian
+	elementProvenanceQnameHash = 1
+	// unix time in seconds when the element is added, 8 bytes in big endian
+	elementProvenanceTimestamp = 2
+	// version of the plugin adding the element
+	elementProvenancePluginVersion = 3
+)
+
+// The comment length nft accepts
+const elementCommentMaxLength = 128
+
+const modulePath = "github.com/owent/coredns-nftables"
+
+var elementUserdataLock sync.Mutex = sync.Mutex{}
+var elementUserdata bool = false
+
+var pluginVersionOnce sync.Once
+var pluginVersion string
+
+// NftElementUserdataBackend is implemented by backends which can store userdata with the elements they add.
+// *nftables.Conn is not, the elements of it are sent by netlink directly in a transaction after the one of
+// the connection.
+type NftElementUserdataBackend interface {
+	SetAddElementsWithUserdata(set *nftables.Set, elements []nftables.SetElement, userdata [][]byte) error
+}
+
+// NftablesElementProvenance is decoded from the userdata of an element added by this plugin
+type NftablesElementProvenance struct {
+	QnameHash     uint64
+	Timestamp     time.Time
+	PluginVersion string
+}
+
+// SetElementUserdata set whether the elements of answers carry their provenance in userdata
+func SetElementUserdata(enabled bool) {
+	elementUserdataLock.Lock()
+	defer elementUserdataLock.Unlock()
+
+	elementUserdata = enabled
+}
+
+func isElementUserdataEnabled() bool {
+	elementUserdataLock.Lock()
+	defer elementUserdataLock.Unlock()
+
+	return elementUserdata
+}
+
+// ElementQnameHash returns the hash of qname stored in the provenance, audit tools compare it with the hash of
+// the names they know
+func ElementQnameHash(qname string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(dns.CanonicalName(qname)))
+	return hash.Sum64()
+}
+
+// getPluginVersion returns the version of this module in the binary, devel when it's not built as a dependency
+func getPluginVersion() string {
+	pluginVersionOnce.Do(func() {
+		pluginVersion = "devel"
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		module := &info.Main
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				module = dep
+			}
+		}
+		if module.Path == modulePath && len(module.Version) > 0 && module.Version != "(devel)" {
+			pluginVersion = module.Version
+		}
+		if len(pluginVersion) > 32 {
+			pluginVersion = pluginVersion[:32]
+		}
+	})
+	return pluginVersion
+}
+
+// EncodeElementProvenance returns the comment carrying the provenance
+func EncodeElementProvenance(provenance NftablesElementProvenance) string {
+	blob := []byte{elementProvenanceVersion}
+	appendField := func(fieldType byte, value []byte) {
+		blob = append(blob, fieldType, byte(len(value)))
+		blob = append(blob, value...)
+	}
+	appendField(elementProvenanceQnameHash, binaryutil.BigEndian.PutUint64(provenance.QnameHash))
+	appendField(elementProvenanceTimestamp, binaryutil.BigEndian.PutUint64(uint64(provenance.Timestamp.Unix())))
+	version := provenance.PluginVersion
+	if len(version) > 32 {
+		version = version[:32]
+	}
+	appendField(elementProvenancePluginVersion, []byte(version))
+	return ElementProvenancePrefix + base64.RawStdEncoding.EncodeToString(blob)
+}
+
+// DecodeElementProvenance decode the comment of an element, like the `comment` of `nft -j list set`
+func DecodeElementProvenance(comment string) (*NftablesElementProvenance, error) {
+	if !strings.HasPrefix(comment, ElementProvenancePrefix) {
+		return nil, fmt.Errorf("comment %q is not added by coredns-nftables", comment)
+	}
+	blob, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(comment, ElementProvenancePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("comment %q invalid, %v", comment, err)
+	}
+	if len(blob) < 1 || blob[0] != elementProvenanceVersion {
+		return nil, fmt.Errorf("comment %q has unsupported version", comment)
+	}
+
+	provenance := &NftablesElementProvenance{}
+	for offset := 1; offset < len(blob); {
+		if offset+2 > len(blob) || offset+2+int(blob[offset+1]) > len(blob) {
+			return nil, fmt.Errorf("comment %q is truncated", comment)
+		}
+		fieldType, value := blob[offset], blob[offset+2:offset+2+int(blob[offset+1])]
+		offset += 2 + len(value)
+		switch fieldType {
+		case elementProvenanceQnameHash, elementProvenanceTimestamp:
+			if len(value) != 8 {
+				return nil, fmt.Errorf("comment %q has invalid field %v", comment, fieldType)
+			}
+			if fieldType == elementProvenanceQnameHash {
+				provenance.QnameHash = binary.BigEndian.Uint64(value)
+			} else {
+				provenance.Timestamp = time.Unix(int64(binary.BigEndian.Uint64(value)), 0)
+			}
+		case elementProvenancePluginVersion:
+			provenance.PluginVersion = string(value)
+		}
+		// unknown fields are skipped, they are added by newer versions
+	}
+	return provenance, nil
+}
+
+// parseElementComment returns the comment in the userdata TLVs of nft
+func parseElementComment(userdata []byte) (string, bool) {
+	for offset := 0; offset+2 <= len(userdata); offset += 2 + int(userdata[offset+1]) {
+		end := offset + 2 + int(userdata[offset+1])
+		if end > len(userdata) {
+			return "", false
+		}
+		if userdata[offset] == 0 {
+			return string(bytes.TrimRight(userdata[offset+2:end], "\x00")), true
+		}
+	}
+	return "", false
+}
+
+// DecodeElementUserdata decode the raw userdata of an element, like NFTA_SET_ELEM_USERDATA of netlink
+func DecodeElementUserdata(userdata []byte) (*NftablesElementProvenance, error) {
+	comment, ok := parseElementComment(userdata)
+	if !ok {
+		return nil, errors.New("userdata has no comment")
+	}
+	return DecodeElementProvenance(comment)
+}
+
+// NftablesElementProvenanceRecord is an element of `nft -j list set` with the provenance decoded from its comment
+type NftablesElementProvenanceRecord struct {
+	Family     string                     `json:"family"`
+	Table      string                     `json:"table"`
+	Set        string                     `json:"set"`
+	Element    json.RawMessage            `json:"elem"`
+	Provenance *NftablesElementProvenance `json:"provenance"`
+}
+
+// DecodeNftJSONProvenance returns the elements with provenance in the output of `nft -j list set` or
+// `nft -j list ruleset`, elements without it are ignored
+func DecodeNftJSONProvenance(data []byte) ([]NftablesElementProvenanceRecord, error) {
+	var output struct {
+		Nftables []map[string]json.RawMessage `json:"nftables"`
+	}
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, err
+	}
+
+	var ret []NftablesElementProvenanceRecord
+	for _, object := range output.Nftables {
+		for _, kind := range []string{"set", "map"} {
+			raw, ok := object[kind]
+			if !ok {
+				continue
+			}
+			var set struct {
+				Family string            `json:"family"`
+				Table  string            `json:"table"`
+				Name   string            `json:"name"`
+				Elem   []json.RawMessage `json:"elem"`
+			}
+			if err := json.Unmarshal(raw, &set); err != nil {
+				return nil, err
+			}
+			for _, item := range set.Elem {
+				value, comment := nftJSONElementComment(item)
+				provenance, err := DecodeElementProvenance(comment)
+				if err != nil {
+					continue
+				}
+				ret = append(ret, NftablesElementProvenanceRecord{
+					Family:     set.Family,
+					Table:      set.Table,
+					Set:        set.Name,
+					Element:    value,
+					Provenance: provenance,
+				})
+			}
+		}
+	}
+	return ret, nil
+}
+
+// nftJSONElementComment returns the value and comment of an element of nft json, an element with options is
+// `{"elem": {"val": ..., "comment": ...}}`, and the one of maps is `[key, data]`
+func nftJSONElementComment(item json.RawMessage) (json.RawMessage, string) {
+	var pair []json.RawMessage
+	if json.Unmarshal(item, &pair) == nil && len(pair) == 2 {
+		value, comment := nftJSONElementComment(pair[0])
+		return json.RawMessage(fmt.Sprintf("[%s,%s]", value, pair[1])), comment
+	}
+	var options struct {
+		Elem *struct {
+			Val     json.RawMessage `json:"val"`
+			Comment string          `json:"comment"`
+		} `json:"elem"`
+	}
+	if json.Unmarshal(item, &options) == nil && options.Elem != nil {
+		return options.Elem.Val, options.Elem.Comment
+	}
+	return item, ""
+}
+
+// buildElementUserdata returns the userdata of an element of origin qname
+func buildElementUserdata(qname string, now time.Time) []byte {
+	comment := EncodeElementProvenance(NftablesElementProvenance{
+		QnameHash:     ElementQnameHash(qname),
+		Timestamp:     now,
+		PluginVersion: getPluginVersion(),
+	})
+	if len(comment) > elementCommentMaxLength-1 {
+		return nil
+	}
+	return buildRuleComment(comment)
+}
+
+// queueElementsWithUserdata stage the elements of the batch with userdata, the elements in refresh are deleted
+// and added again. It returns false when the backend can not store userdata.
+func (cache *NftablesCache) queueElementsWithUserdata(tableCache *NftableCache, set *nftables.Set, elements []nftables.SetElement, refresh []nftables.SetElement, userdata [][]byte) (bool, error) {
+	if backend, ok := cache.NftableConnection.(NftElementUserdataBackend); ok {
+		if len(refresh) > 0 {
+			err := cache.SetAddElements(tableCache, set, refresh)
+			if err == nil {
+				err = cache.NftableConnection.SetDeleteElements(set, refresh)
+			}
+			if err != nil {
+				return true, err
+			}
+		}
+		err := backend.SetAddElementsWithUserdata(set, elements, userdata)
+		if err != nil {
+			cache.recordConnectionError(err)
+		}
+		return true, err
+	}
+
+	if _, ok := cache.NftableConnection.(*nftables.Conn); !ok {
+		return false, nil
+	}
+	if batchAtomic {
+		// the messages of userdata are sent by a transaction of their own after the one of the connection, so
+		// they would break the all-or-nothing commit of `atomic`
+		return false, nil
+	}
+	for _, element := range elements {
+		if element.VerdictData != nil {
+			return false, nil
+		}
+	}
+	// the elements are all in the transaction of userdata, so that the refresh is still atomic
+	var messages []netlink.Message
+	if len(refresh) > 0 {
+		messages = append(messages,
+			elementListMessage(unix.NFT_MSG_NEWSETELEM, set, refresh, nil),
+			elementListMessage(unix.NFT_MSG_DELSETELEM, set, refresh, nil))
+	}
+	messages = append(messages, elementListMessage(unix.NFT_MSG_NEWSETELEM, set, elements, userdata))
+	for _, message := range messages {
+		if message.Data == nil {
+			cache.HasNftableConnectionError = true
+			return true, fmt.Errorf("marshal elements of set %v failed", set.Name)
+		}
+	}
+	cache.userdataMessages = append(cache.userdataMessages, messages...)
+	return true, nil
+}
+
+// elementListMessage returns the netlink message of elements like google/nftables, with NFTA_SET_ELEM_USERDATA of
+// userdata[i] for elements[i]. The data is nil when it can not be marshaled.
+func elementListMessage(messageType int, set *nftables.Set, elements []nftables.SetElement, userdata [][]byte) netlink.Message {
+	message := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | messageType),
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Create,
+		},
+	}
+
+	list := make([]netlink.Attribute, 0, len(elements))
+	for i, element := range elements {
+		var item []netlink.Attribute
+		if element.IntervalEnd {
+			item = append(item, netlink.Attribute{Type: unix.NFTA_SET_ELEM_FLAGS, Data: binaryutil.BigEndian.PutUint32(unix.NFT_SET_ELEM_INTERVAL_END)})
+		}
+		key, err := netlink.MarshalAttributes([]netlink.Attribute{{Type: unix.NFTA_DATA_VALUE, Data: element.Key}})
+		if err != nil {
+			return message
+		}
+		item = append(item, netlink.Attribute{Type: unix.NFTA_SET_ELEM_KEY | unix.NLA_F_NESTED, Data: key})
+		if len(element.KeyEnd) > 0 {
+			keyEnd, err := netlink.MarshalAttributes([]netlink.Attribute{{Type: unix.NFTA_DATA_VALUE, Data: element.KeyEnd}})
+			if err != nil {
+				return message
+			}
+			item = append(item, netlink.Attribute{Type: nftables.NFTA_SET_ELEM_KEY_END | unix.NLA_F_NESTED, Data: keyEnd})
+		}
+		if set.HasTimeout && element.Timeout != 0 {
+			item = append(item, netlink.Attribute{Type: unix.NFTA_SET_ELEM_TIMEOUT, Data: binaryutil.BigEndian.PutUint64(uint64(element.Timeout.Milliseconds()))})
+		}
+		if len(element.Val) > 0 {
+			value, err := netlink.MarshalAttributes([]netlink.Attribute{{Type: unix.NFTA_DATA_VALUE, Data: element.Val}})
+			if err != nil {
+				return message
+			}
+			item = append(item, netlink.Attribute{Type: unix.NFTA_SET_ELEM_DATA | unix.NLA_F_NESTED, Data: value})
+		}
+		if i < len(userdata) && len(userdata[i]) > 0 {
+			item = append(item, netlink.Attribute{Type: unix.NFTA_SET_ELEM_USERDATA, Data: userdata[i]})
+		}
+		encoded, err := netlink.MarshalAttributes(item)
+		if err != nil {
+			return message
+		}
+		list = append(list, netlink.Attribute{Type: uint16(i+1) | unix.NLA_F_NESTED, Data: encoded})
+	}
+	encodedList, err := netlink.MarshalAttributes(list)
+	if err != nil {
+		return message
+	}
+	attributes, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: []byte(set.Table.Name + "\x00")},
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: []byte(set.Name + "\x00")},
+		{Type: unix.NFTA_SET_ELEM_LIST_ELEMENTS | unix.NLA_F_NESTED, Data: encodedList},
+	})
+	if err != nil {
+		return message
+	}
+	message.Data = append([]byte{byte(set.Table.Family), unix.NFNETLINK_V0, 0, 0}, attributes...)
+	return message
+}
+
+// flushElementUserdata send the elements with userdata staged by queueElementsWithUserdata in one transaction,
+// it's called after the transaction of the connection which creates their tables and sets
+func (cache *NftablesCache) flushElementUserdata() error {
+	messages := cache.userdataMessages
+	cache.userdataMessages = nil
+	if len(messages) == 0 {
+		return nil
+	}
+
+	conn, err := dialNetfilterIn(cache.Namespace, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	batch := []netlink.Message{{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_MSG_BATCH_BEGIN), Flags: netlink.Request},
+		Data:   []byte{0, unix.NFNETLINK_V0, 0, unix.NFNL_SUBSYS_NFTABLES},
+	}}
+	batch = append(batch, messages...)
+	batch = append(batch, netlink.Message{
+		Header: netlink.Header{Type: netlink.HeaderType(unix.NFNL_MSG_BATCH_END), Flags: netlink.Request},
+		Data:   []byte{0, unix.NFNETLINK_V0, 0, unix.NFNL_SUBSYS_NFTABLES},
+	})
+	if _, err := conn.SendMessages(batch); err != nil {
+		return fmt.Errorf("SendMessages: %w", err)
+	}
+	for range messages {
+		if _, err := conn.Receive(); err != nil {
+			return fmt.Errorf("conn.Receive: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestElementProvenance(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	comment := EncodeElementProvenance(NftablesElementProvenance{QnameHash: ElementQnameHash("WWW.Example.org"), Timestamp: now, PluginVersion: "v1.2.3"})
+	if !strings.HasPrefix(comment, ElementProvenancePrefix) || len(comment) >= elementCommentMaxLength {
+		t.Fatalf("Expected a short comment with prefix, but got %q", comment)
+	}
+	provenance, err := DecodeElementProvenance(comment)
+	if err != nil || provenance.QnameHash != ElementQnameHash("www.example.org.") || !provenance.Timestamp.Equal(now) || provenance.PluginVersion != "v1.2.3" {
+		t.Errorf("Expected the provenance decoded, but got %v, %v", provenance, err)
+	}
+
+	userdata := buildElementUserdata("www.example.org.", now)
+	if provenance, err := DecodeElementUserdata(userdata); err != nil || provenance.QnameHash != ElementQnameHash("www.example.org.") {
+		t.Errorf("Expected the provenance decoded from userdata, but got %v, %v", provenance, err)
+	}
+	for _, invalid := range []string{"", "allow ssh", ElementProvenancePrefix + "!", ElementProvenancePrefix + "AgEI", ElementProvenancePrefix + "AQEIAAAA"} {
+		if _, err := DecodeElementProvenance(invalid); err == nil {
+			t.Errorf("Expected comment %q invalid", invalid)
+		}
+	}
+
+	output := `{"nftables": [{"metainfo": {"json_schema_version": 1}},
+		{"set": {"family": "ip", "name": "WHITELIST", "table": "filter", "type": "ipv4_addr", "elem": [
+			"192.0.2.1",
+			{"elem": {"val": "192.0.2.2", "timeout": 3600, "comment": "` + comment + `"}},
+			{"elem": {"val": "192.0.2.3", "comment": "allow ssh"}}
+		]}},
+		{"map": {"family": "ip", "name": "PROXY", "table": "filter", "type": "ipv4_addr", "map": "inet_service", "elem": [
+			[{"elem": {"val": "192.0.2.4", "comment": "` + comment + `"}}, 12345]
+		]}}]}`
+	records, err := DecodeNftJSONProvenance([]byte(output))
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Expected 2 elements with provenance, but got %v, %v", records, err)
+	}
+	if records[0].Set != "WHITELIST" || string(records[0].Element) != `"192.0.2.2"` || records[0].Provenance.PluginVersion != "v1.2.3" {
+		t.Errorf("Expected 192.0.2.2 of WHITELIST, but got %+v", records[0])
+	}
+	if records[1].Set != "PROXY" || string(records[1].Element) != `["192.0.2.4",12345]` {
+		t.Errorf("Expected 192.0.2.4 : 12345 of PROXY, but got %+v", records[1])
+	}
+}
+
+func TestElementUserdataRule(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	SetElementUserdata(true)
+	defer func() {
+		SetElementUserdata(false)
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+	}()
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_userdata", SetName: "USERDATA", KeyType: nftables.TypeInvalid})
+
+	msg := newTestResponse(t, "www.example.org.", "www.example.org. 60 IN CNAME edge.cdn.net.", "edge.cdn.net. 60 IN A 192.0.2.170")
+	if applied, err := handle.ServeWorker(context.Background(), msg); err != nil || applied != 1 {
+		t.Fatalf("Expected 1 answer applied, but got %v, %v", applied, err)
+	}
+
+	backend := NewMemoryBackend(ruleset)
+	set, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_userdata"}, "USERDATA")
+	if err != nil {
+		t.Fatalf("Expected the set is created, but got %v", err)
+	}
+	userdata, err := backend.GetElementUserdata(set, net.ParseIP("192.0.2.170").To4())
+	if err != nil {
+		t.Fatal(err)
+	}
+	provenance, err := DecodeElementUserdata(userdata)
+	if err != nil || provenance.QnameHash != ElementQnameHash("www.example.org.") || time.Since(provenance.Timestamp) > time.Minute {
+		t.Errorf("Expected the element added for www.example.org. just now, but got %v, %v", provenance, err)
+	}
+
+	texts := scriptElementsWithUserdata(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.170").To4()}}, [][]byte{userdata})
+	if comment, _ := parseElementComment(userdata); len(texts) != 1 || texts[0] != "192.0.2.170 comment \""+comment+"\"" {
+		t.Errorf("Expected the script element with comment, but got %v", texts)
+	}
+}
+
+func TestElementUserdataAtomic(t *testing.T) {
+	defer SetNftableBatchAtomic(false)
+
+	cache := &NftablesCache{NftableConnection: &nftables.Conn{}}
+	set := &nftables.Set{Table: &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "filter"}, Name: "USERDATA", KeyType: nftables.TypeIPAddr}
+	elements := []nftables.SetElement{{Key: net.ParseIP("192.0.2.171").To4()}}
+	userdata := [][]byte{buildElementUserdata("example.org.", time.Now())}
+
+	SetNftableBatchAtomic(true)
+	if queued, err := cache.queueElementsWithUserdata(nil, set, elements, nil, userdata); queued || err != nil || len(cache.userdataMessages) != 0 {
+		t.Errorf("Expected the library path kept for atomic, but got %v, %v, %v", queued, err, len(cache.userdataMessages))
+	}
+	SetNftableBatchAtomic(false)
+	if queued, err := cache.queueElementsWithUserdata(nil, set, elements, nil, userdata); !queued || err != nil || len(cache.userdataMessages) != 1 {
+		t.Errorf("Expected the elements queued with userdata, but got %v, %v, %v", queued, err, len(cache.userdataMessages))
+	}
+}
@@ -0,0 +1,61 @@
+package coredns_nftables
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// nftablesVlanIDType is the datatype of the vlan id field of `vlan id . ip` keys, nft has no datatype of it and
+// shows it as integer
+var nftablesVlanIDType = nftables.TypeInteger
+
+// parseVlanIDs parse the ids of `vlan <ID>...`, 0 and 4095 are reserved by 802.1Q
+func parseVlanIDs(args []string) ([]uint16, error) {
+	var ret []uint16
+	for _, arg := range args {
+		id, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil || id < 1 || id > 4094 {
+			return nil, fmt.Errorf("vlan id %v is not in 1-4094", arg)
+		}
+		ret = append(ret, uint16(id))
+	}
+	return ret, nil
+}
+
+// acceptVlanFamily returns true if tables of family see the VLAN headers of packets, which is bridge and netdev
+func acceptVlanFamily(family nftables.TableFamily) bool {
+	return family == nftables.TableFamilyBridge || family == nftables.TableFamilyNetdev
+}
+
+// vlanElementKey returns the key of `vlan id . ip` elements, the vlan id is in network byte order like the
+// payload loaded by `vlan id` and padded to 4 bytes as fields of concatenations
+func vlanElementKey(vlan uint16, key []byte) []byte {
+	ret := make([]byte, 4, 4+len(key))
+	binary.BigEndian.PutUint16(ret, vlan)
+	return append(ret, key...)
+}
+
+func vlanElementText(vlan uint16, element string) string {
+	return fmt.Sprintf("%v . %v", vlan, element)
+}
+
+// parseVlanElementKey parse the key of `<VLAN> . <ELEMENT>`, ok is false if text does not start with a vlan id
+func parseVlanElementKey(text string) ([]byte, bool, error) {
+	parts := strings.SplitN(text, " . ", 2)
+	if len(parts) != 2 {
+		return nil, false, nil
+	}
+	vlans, err := parseVlanIDs(parts[:1])
+	if err != nil {
+		return nil, false, nil
+	}
+	key, err := parseElementKey(parts[1])
+	if err != nil {
+		return nil, true, err
+	}
+	return vlanElementKey(vlans[0], key), true, nil
+}
@@ -0,0 +1,72 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestVlanRule(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+		sharedLru.purge()
+	}()
+
+	handle := NewNftablesHandler()
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyBridge, nftables.TableFamilyINet} {
+		ruleSet := handle.MutableRuleSet(family)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+			TableName: "coredns_vlan",
+			SetName:   "VLAN_SET",
+			KeyType:   nftables.TypeIPAddr,
+			Vlans:     []uint16{10, 20},
+		})
+	}
+
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.220")
+	if _, err := handle.ServeWorker(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewMemoryBackend(ruleset)
+	if _, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyINet, Name: "coredns_vlan"}, "VLAN_SET"); err == nil {
+		t.Errorf("Expected the inet table ignored by vlan rules")
+	}
+	set, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyBridge, Name: "coredns_vlan"}, "VLAN_SET")
+	if err != nil {
+		t.Fatalf("Expected the set is created, but got %v", err)
+	}
+	if !set.Concatenation || set.KeyType.Bytes != 8 || set.KeyType.Name != "integer . ipv4_addr" {
+		t.Errorf("Expected set keyed by integer . ipv4_addr, but got %v", set.KeyType.Name)
+	}
+
+	elements, _ := backend.GetSetElements(set)
+	if len(elements) != 2 {
+		t.Fatalf("Expected an element per vlan, but got %v", elements)
+	}
+	for _, text := range []string{"10 . 192.0.2.220", "20 . 192.0.2.220"} {
+		expected, err := parseElementKey(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, element := range elements {
+			found = found || bytes.Equal(element.Key, expected)
+		}
+		if !found {
+			t.Errorf("Expected element %v, but got %v", text, elements)
+		}
+	}
+	if key := vlanElementKey(10, []byte{192, 0, 2, 220}); !bytes.Equal(key, []byte{0, 10, 0, 0, 192, 0, 2, 220}) {
+		t.Errorf("Expected the vlan id in network byte order and padded, but got %v", key)
+	}
+	if _, err := parseElementKey("10 . example.org"); err == nil {
+		t.Errorf("Expected element 10 . example.org invalid")
+	}
+}
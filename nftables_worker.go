@@ -0,0 +1,163 @@
+package coredns_nftables
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	asyncOverflowDrop   = "drop"
+	asyncOverflowOldest = "oldest"
+	asyncOverflowBlock  = "block"
+)
+
+var asyncWorkers int = 0
+var asyncQueueSize int = 4096
+var asyncOverflow string = asyncOverflowDrop
+var asyncPoolLock sync.Mutex = sync.Mutex{}
+var asyncPoolRefs int = 0
+var asyncPoolQueue chan *nftablesAsyncJob = nil
+var asyncPoolStop chan struct{} = nil
+
+// nftablesAsyncJob is a compact copy of the response made by ServeDNS in async mode, waiting for a worker
+type nftablesAsyncJob struct {
+	// detached from the request, it only carries the client address
+	ctx      context.Context
+	handler  *NftablesHandler
+	msg      *dns.Msg
+	duration time.Duration
+	queued   time.Time
+	// closed once the response is served, nil when nobody waits for it
+	done chan struct{}
+}
+
+// SetNftableAsyncPool set the size of the worker pool and its queue used by async mode, and the policy when the
+// queue is full: drop the new response, drop the oldest queued response, or block until a worker is free.
+// 0 workers spawns a goroutine for each response.
+func SetNftableAsyncPool(workers int, queue int, overflow string) error {
+	switch overflow {
+	case asyncOverflowDrop, asyncOverflowOldest, asyncOverflowBlock:
+	default:
+		return fmt.Errorf("overflow policy %v invalid, use drop, oldest or block", overflow)
+	}
+
+	asyncPoolLock.Lock()
+	defer asyncPoolLock.Unlock()
+
+	asyncWorkers = workers
+	asyncQueueSize = queue
+	asyncOverflow = overflow
+	return nil
+}
+
+// StartAsyncPool start the workers when the first handler starts. A running pool is kept by reloading.
+func StartAsyncPool() {
+	asyncPoolLock.Lock()
+	defer asyncPoolLock.Unlock()
+
+	asyncPoolRefs += 1
+	if asyncPoolQueue != nil || asyncWorkers <= 0 {
+		return
+	}
+
+	asyncPoolQueue = make(chan *nftablesAsyncJob, asyncQueueSize)
+	asyncPoolStop = make(chan struct{})
+	for i := 0; i < asyncWorkers; i++ {
+		go func(queue chan *nftablesAsyncJob, stop chan struct{}) {
+			for {
+				select {
+				case <-stop:
+					return
+				case job := <-queue:
+					asyncQueueLength.Set(float64(len(queue)))
+					recordSloPoolWait(time.Since(job.queued))
+					job.handler.Serve(job.ctx, job.msg, job.duration)
+					if job.done != nil {
+						close(job.done)
+					}
+				}
+			}
+		}(asyncPoolQueue, asyncPoolStop)
+	}
+	log.Debugf("Nftables start %v async worker(s) with queue size %v", asyncWorkers, asyncQueueSize)
+}
+
+// StopAsyncPool stop the workers when the last handler stops, the queued responses are dropped
+func StopAsyncPool() {
+	asyncPoolLock.Lock()
+	defer asyncPoolLock.Unlock()
+
+	if asyncPoolRefs > 0 {
+		asyncPoolRefs -= 1
+	}
+	if asyncPoolRefs == 0 && asyncPoolStop != nil {
+		close(asyncPoolStop)
+		asyncPoolStop = nil
+		asyncPoolQueue = nil
+		asyncQueueLength.Set(0)
+	}
+}
+
+// serveAsync queue the response to the worker pool, or serve it in a new goroutine when there is no pool
+func (m *NftablesHandler) serveAsync(ctx context.Context, msg *dns.Msg, duration time.Duration) {
+	asyncPoolLock.Lock()
+	queue := asyncPoolQueue
+	stop := asyncPoolStop
+	overflow := asyncOverflow
+	asyncPoolLock.Unlock()
+
+	if queue == nil {
+		go m.Serve(ctx, msg, duration)
+		return
+	}
+
+	job := &nftablesAsyncJob{ctx: ctx, handler: m, msg: msg, duration: duration, queued: time.Now()}
+	queueAsyncJob(queue, stop, overflow, job, nil)
+}
+
+// queueAsyncJob queue job by the overflow policy, it returns false when job is dropped. With the block policy it
+// waits until a worker is free, the pool stops or deadline fires, a nil deadline never fires.
+func queueAsyncJob(queue chan *nftablesAsyncJob, stop chan struct{}, overflow string, job *nftablesAsyncJob, deadline <-chan time.Time) bool {
+	if overflow == asyncOverflowBlock {
+		select {
+		case queue <- job:
+			asyncQueueLength.Set(float64(len(queue)))
+			return true
+		case <-stop:
+		case <-deadline:
+			log.Debugf("Nftables async queue is still full at the deadline, drop the response")
+			asyncDroppedCount.WithLabelValues(overflow).Inc()
+			recordSloShed(sloShedAsyncDropped)
+		}
+		return false
+	}
+
+	for {
+		select {
+		case queue <- job:
+			asyncQueueLength.Set(float64(len(queue)))
+			return true
+		default:
+		}
+
+		if overflow == asyncOverflowDrop {
+			log.Debugf("Nftables async queue is full, drop the response")
+			asyncDroppedCount.WithLabelValues(overflow).Inc()
+			recordSloShed(sloShedAsyncDropped)
+			return false
+		}
+
+		// drop the oldest queued response and try again
+		select {
+		case <-queue:
+			log.Debugf("Nftables async queue is full, drop the oldest response")
+			asyncDroppedCount.WithLabelValues(overflow).Inc()
+			recordSloShed(sloShedAsyncDropped)
+		default:
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+func TestAsyncOverflow(t *testing.T) {
+	defer func() {
+		asyncPoolQueue = nil
+		asyncPoolStop = nil
+		SetNftableAsyncPool(0, 4096, asyncOverflowDrop)
+	}()
+
+	handler := NewNftablesHandler()
+	newMsg := func(id uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.Id = id
+		return msg
+	}
+
+	// No worker is started, so the queue is never consumed
+	for _, c := range []struct {
+		overflow string
+		expected []uint16
+	}{
+		{asyncOverflowDrop, []uint16{1, 2}},
+		{asyncOverflowOldest, []uint16{2, 3}},
+	} {
+		SetNftableAsyncPool(1, 2, c.overflow)
+		asyncPoolQueue = make(chan *nftablesAsyncJob, 2)
+		asyncPoolStop = make(chan struct{})
+		for id := uint16(1); id <= 3; id++ {
+			handler.serveAsync(context.Background(), newMsg(id), 0)
+		}
+
+		close(asyncPoolQueue)
+		var ids []uint16
+		for job := range asyncPoolQueue {
+			ids = append(ids, job.msg.Id)
+		}
+		if len(ids) != len(c.expected) || ids[0] != c.expected[0] || ids[1] != c.expected[1] {
+			t.Errorf("Expected %v policy keeps %v, but got %v", c.overflow, c.expected, ids)
+		}
+	}
+
+	if err := SetNftableAsyncPool(1, 2, "wait"); err == nil {
+		t.Errorf("Expected overflow policy wait is invalid")
+	}
+}
+
+func TestDetachContext(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithTimeout(context.WithValue(context.Background(), key{}, "server"), time.Hour)
+	detached := detachContext(parent)
+	cancel()
+
+	if _, ok := detached.Deadline(); ok || detached.Done() != nil || detached.Err() != nil {
+		t.Errorf("Expected the detached context never canceled with its parent")
+	}
+	if detached.Value(key{}) != "server" {
+		t.Errorf("Expected the values of parent kept, but got %v", detached.Value(key{}))
+	}
+
+	// a canceled request stages nothing
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+	}()
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{TableName: "coredns_cancel", SetName: "CANCEL", KeyType: nftables.TypeInvalid})
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.190")
+	if _, err := handle.ServeWorker(parent, msg); !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the canceled request returns its error, but got %v", err)
+	}
+	if _, err := NewMemoryBackend(ruleset).GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_cancel"}, "CANCEL"); err == nil {
+		t.Errorf("Expected nothing sent to nftables for the canceled request")
+	}
+	if applied, err := handle.ServeWorker(detached, msg); err != nil || applied != 1 {
+		t.Errorf("Expected the detached context applies the answer, but got %v, %v", applied, err)
+	}
+}
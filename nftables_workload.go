@@ -0,0 +1,289 @@
+package coredns_nftables
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/google/nftables/binaryutil"
+	"github.com/miekg/dns"
+)
+
+var workloadFileLock sync.Mutex = sync.Mutex{}
+var workloadFilePath string = ""
+var workloadFileInterval time.Duration = 5 * time.Second
+var workloadFileModTime time.Time
+var workloadFileSize int64 = 0
+var workloadFileRefs int = 0
+var workloadFileStop chan struct{} = nil
+var workloadTable *nftablesWorkloadTable = nil
+
+// nftablesWorkloadTable maps client addresses to the marks of their workload classes, the longest prefix wins
+type nftablesWorkloadTable struct {
+	classes map[string]uint32
+	// mark of each network by its text, and the prefix lengths present of each address length
+	networks map[string]uint32
+	prefixes map[int][]int
+}
+
+type nftablesClientKey struct{}
+
+// withClientAddress returns parent carrying the address of the client of w, which selects the workload class of
+// the rules with `workload`
+func withClientAddress(parent context.Context, w dns.ResponseWriter) context.Context {
+	state := request.Request{W: w}
+	ip := net.ParseIP(state.IP())
+	if ip == nil {
+		return parent
+	}
+	return context.WithValue(parent, nftablesClientKey{}, ip)
+}
+
+// clientAddress returns the address of the client which sent the request of ctx, nil for answers not from a
+// client like `POST /elements`
+func clientAddress(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(nftablesClientKey{}).(net.IP)
+	return ip
+}
+
+// parseMark parse a mark in decimal or hexadecimal with 0x prefix
+func parseMark(value string) (uint32, error) {
+	mark, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("mark %v invalid, %v", value, err)
+	}
+	return uint32(mark), nil
+}
+
+// loadWorkloadTable parse the workload file. Each line is `class <NAME> <MARK>` which names a mark, or
+// `<IP/CIDR> <CLASS>` where CLASS is a name defined before or a mark. Empty lines and lines starting with # are
+// ignored.
+func loadWorkloadTable(path string) (*nftablesWorkloadTable, os.FileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	table := &nftablesWorkloadTable{
+		classes:  make(map[string]uint32),
+		networks: make(map[string]uint32),
+		prefixes: make(map[int][]int),
+	}
+	lineNumber := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineNumber += 1
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if strings.ToLower(fields[0]) == "class" {
+			if len(fields) != 3 {
+				return nil, nil, fmt.Errorf("%v:%v expect class <NAME> <MARK>", path, lineNumber)
+			}
+			mark, err := parseMark(fields[2])
+			if err != nil {
+				return nil, nil, fmt.Errorf("%v:%v %v", path, lineNumber, err)
+			}
+			table.classes[strings.ToLower(fields[1])] = mark
+			continue
+		}
+
+		if len(fields) != 2 {
+			return nil, nil, fmt.Errorf("%v:%v expect <IP/CIDR> <CLASS>", path, lineNumber)
+		}
+		networks, err := parseCIDRs(fields[:1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%v:%v %v", path, lineNumber, err)
+		}
+		mark, ok := table.class(fields[1])
+		if !ok {
+			return nil, nil, fmt.Errorf("%v:%v class %v unknown", path, lineNumber, fields[1])
+		}
+		table.add(networks[0], mark)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for bits := range table.prefixes {
+		sort.Sort(sort.Reverse(sort.IntSlice(table.prefixes[bits])))
+	}
+	return table, info, nil
+}
+
+// class returns the mark of a class name or a mark
+func (table *nftablesWorkloadTable) class(name string) (uint32, bool) {
+	if mark, ok := table.classes[strings.ToLower(name)]; ok {
+		return mark, true
+	}
+	mark, err := parseMark(name)
+	return mark, err == nil
+}
+
+func (table *nftablesWorkloadTable) add(network *net.IPNet, mark uint32) {
+	ones, bits := network.Mask.Size()
+	key := network.String()
+	if _, ok := table.networks[key]; !ok {
+		table.prefixes[bits] = append(table.prefixes[bits], ones)
+	}
+	table.networks[key] = mark
+}
+
+func (table *nftablesWorkloadTable) lookup(ip net.IP) (uint32, bool) {
+	bits := net.IPv6len * 8
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = net.IPv4len * 8
+	}
+	for _, ones := range table.prefixes[bits] {
+		mask := net.CIDRMask(ones, bits)
+		network := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		if mark, ok := table.networks[network.String()]; ok {
+			return mark, true
+		}
+	}
+	return 0, false
+}
+
+// SetWorkloadFile set the file mapping client addresses to workload classes, see loadWorkloadTable. It's checked
+// every interval and reloaded when it's changed. Empty path disables it.
+func SetWorkloadFile(path string, interval time.Duration) error {
+	var table *nftablesWorkloadTable
+	var info os.FileInfo
+	if len(path) > 0 {
+		var err error
+		table, info, err = loadWorkloadTable(path)
+		if err != nil {
+			return err
+		}
+		log.Infof("Nftables load %v workload network(s) from %v", len(table.networks), path)
+	}
+
+	workloadFileLock.Lock()
+	defer workloadFileLock.Unlock()
+
+	workloadFilePath = path
+	workloadTable = table
+	if info != nil {
+		workloadFileModTime = info.ModTime()
+		workloadFileSize = info.Size()
+	}
+	if interval > 0 {
+		workloadFileInterval = interval
+	} else {
+		workloadFileInterval = 5 * time.Second
+	}
+	return nil
+}
+
+// ReloadWorkloadFile reload the workload file if it's changed, the old mapping is kept if it can not be loaded
+func ReloadWorkloadFile() {
+	workloadFileLock.Lock()
+	defer workloadFileLock.Unlock()
+
+	if len(workloadFilePath) == 0 {
+		return
+	}
+	info, err := os.Stat(workloadFilePath)
+	if err != nil || (info.ModTime().Equal(workloadFileModTime) && info.Size() == workloadFileSize) {
+		return
+	}
+
+	table, info, err := loadWorkloadTable(workloadFilePath)
+	if err != nil {
+		log.Errorf("Nftables reload workload file %v failed, keep the old one. %v", workloadFilePath, err)
+		return
+	}
+	workloadTable = table
+	workloadFileModTime = info.ModTime()
+	workloadFileSize = info.Size()
+	log.Infof("Nftables load %v workload network(s) from %v", len(table.networks), workloadFilePath)
+}
+
+// StartWorkloadFile start checking the workload file when the first handler starts
+func StartWorkloadFile() {
+	workloadFileLock.Lock()
+	defer workloadFileLock.Unlock()
+
+	workloadFileRefs += 1
+	if workloadFileStop != nil || len(workloadFilePath) == 0 {
+		return
+	}
+
+	workloadFileStop = make(chan struct{})
+	go func(stop chan struct{}, interval time.Duration) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ReloadWorkloadFile()
+			}
+		}
+	}(workloadFileStop, workloadFileInterval)
+}
+
+// StopWorkloadFile stop checking the workload file when the last handler stops
+func StopWorkloadFile() {
+	workloadFileLock.Lock()
+	defer workloadFileLock.Unlock()
+
+	if workloadFileRefs > 0 {
+		workloadFileRefs -= 1
+	}
+	if workloadFileRefs == 0 && workloadFileStop != nil {
+		close(workloadFileStop)
+		workloadFileStop = nil
+	}
+}
+
+// workloadMark returns the mark of the workload class of client, clients not in the workload file use
+// defaultClass. ok is false if neither selects a class.
+func workloadMark(client net.IP, defaultClass string) (uint32, bool) {
+	workloadFileLock.Lock()
+	table := workloadTable
+	workloadFileLock.Unlock()
+
+	if table == nil {
+		table = &nftablesWorkloadTable{}
+	}
+	if client != nil {
+		if mark, ok := table.lookup(client); ok {
+			return mark, true
+		}
+	}
+	if len(defaultClass) == 0 {
+		return 0, false
+	}
+	return table.class(defaultClass)
+}
+
+// workloadElementKey returns the key of `ip . mark` elements, marks are in host byte order like `meta mark`
+func workloadElementKey(key []byte, mark uint32) []byte {
+	ret := make([]byte, 0, len(key)+4)
+	ret = append(ret, key...)
+	return append(ret, binaryutil.NativeEndian.PutUint32(mark)...)
+}
+
+func workloadElementText(address string, mark uint32) string {
+	return fmt.Sprintf("%v . 0x%08x", address, mark)
+}
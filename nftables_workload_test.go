@@ -0,0 +1,121 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestWorkloadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workloads.txt")
+	content := "# workloads\nclass web 0x10\nclass Batch 32\n\n10.88.0.0/16 web\n10.88.5.0/24 batch\n10.89.0.7 0x30\n2001:db8::/32 web\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetWorkloadFile(path, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer SetWorkloadFile("", 0)
+
+	for _, check := range []struct {
+		client       string
+		defaultClass string
+		mark         uint32
+		ok           bool
+	}{
+		{"10.88.1.1", "", 0x10, true},
+		{"10.88.5.9", "", 0x20, true},
+		{"10.89.0.7", "", 0x30, true},
+		{"2001:db8::1", "", 0x10, true},
+		{"192.0.2.1", "", 0, false},
+		{"192.0.2.1", "batch", 0x20, true},
+		{"192.0.2.1", "0x40", 0x40, true},
+		{"192.0.2.1", "unknown", 0, false},
+		{"", "web", 0x10, true},
+	} {
+		mark, ok := workloadMark(net.ParseIP(check.client), check.defaultClass)
+		if mark != check.mark || ok != check.ok {
+			t.Errorf("Expected client %v(default %v) has mark %v %v, but got %v %v", check.client, check.defaultClass, check.mark, check.ok, mark, ok)
+		}
+	}
+
+	// an invalid file keeps the old mapping, a valid one replaces it
+	os.WriteFile(path, []byte("10.88.0.0/16 unknown\n"), 0644)
+	ReloadWorkloadFile()
+	if mark, _ := workloadMark(net.ParseIP("10.88.1.1"), ""); mark != 0x10 {
+		t.Errorf("Expected the old mapping kept after an invalid reload, but got %v", mark)
+	}
+	os.WriteFile(path, []byte("10.88.0.0/16 0x50\n"), 0644)
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	ReloadWorkloadFile()
+	if mark, _ := workloadMark(net.ParseIP("10.88.1.1"), ""); mark != 0x50 {
+		t.Errorf("Expected the mapping reloaded, but got %v", mark)
+	}
+
+	for _, invalid := range []string{"class web\n", "class web mark\n", "10.88.0.0/16\n", "10.88.0.0/33 0x10\n", "10.88.0.0/16 web\n"} {
+		os.WriteFile(path, []byte(invalid), 0644)
+		if err := SetWorkloadFile(path, 0); err == nil {
+			t.Errorf("Expected workload file %q invalid", invalid)
+		}
+	}
+}
+
+func TestWorkloadRule(t *testing.T) {
+	ruleset := NewMemoryRuleset()
+	SetNftBackendFactory(func() (NftBackend, error) { return NewMemoryBackend(ruleset), nil })
+	ClearCache()
+	defer func() {
+		SetNftBackendFactory(nil)
+		ClearCache()
+	}()
+
+	path := filepath.Join(t.TempDir(), "workloads.txt")
+	os.WriteFile(path, []byte("class web 0x10\n10.88.0.0/16 web\n"), 0644)
+	if err := SetWorkloadFile(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer SetWorkloadFile("", 0)
+
+	handle := NewNftablesHandler()
+	ruleSet := handle.MutableRuleSet(nftables.TableFamilyIPv4)
+	ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &NftablesSetAddElement{
+		TableName: "coredns_workload",
+		SetName:   "WORKLOAD_SET",
+		KeyType:   nftables.TypeInvalid,
+		Workload:  true,
+	})
+
+	msg := newTestResponse(t, "example.org.", "example.org. 60 IN A 192.0.2.150")
+	ctx := context.WithValue(context.Background(), nftablesClientKey{}, net.ParseIP("10.88.1.1"))
+	if applied, err := handle.ServeWorker(ctx, msg); err != nil || applied != 1 {
+		t.Fatalf("Expected 1 answer applied, but got %v, %v", applied, err)
+	}
+	// clients without a class are ignored
+	if applied, _ := handle.ServeWorker(context.Background(), msg); applied != 0 {
+		t.Errorf("Expected answers of clients without a class ignored, but got %v", applied)
+	}
+
+	backend := NewMemoryBackend(ruleset)
+	set, err := backend.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "coredns_workload"}, "WORKLOAD_SET")
+	if err != nil {
+		t.Fatalf("Expected the set is created, but got %v", err)
+	}
+	if !set.Concatenation || set.KeyType.Bytes != 8 {
+		t.Errorf("Expected set keyed by ipv4_addr . mark, but got %v", set.KeyType.Name)
+	}
+
+	expected, err := parseElementKey("192.0.2.150 . 0x00000010")
+	if err != nil {
+		t.Fatal(err)
+	}
+	elements, _ := backend.GetSetElements(set)
+	if len(elements) != 1 || !bytes.Equal(elements[0].Key, expected) {
+		t.Errorf("Expected element 192.0.2.150 . 0x00000010, but got %v", elements)
+	}
+}
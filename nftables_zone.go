@@ -0,0 +1,23 @@
+package coredns_nftables
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// originZone returns the closest zone of the server block which the query name of r belongs to, "." is
+// returned when no zone matches
+func (m *NftablesHandler) originZone(r *dns.Msg) string {
+	var qname string
+	if len(r.Question) > 0 {
+		qname = r.Question[0].Name
+	} else if len(r.Answer) > 0 {
+		qname = r.Answer[0].Header().Name
+	}
+
+	zone := plugin.Zones(m.Zones).Matches(dns.CanonicalName(qname))
+	if len(zone) == 0 {
+		return "."
+	}
+	return zone
+}
@@ -0,0 +1,35 @@
+package coredns_nftables
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestOriginZone(t *testing.T) {
+	handle := NewNftablesHandler()
+	handle.Zones = []string{".", "example.org.", "cdn.example.org."}
+
+	for qname, expected := range map[string]string{
+		"www.cdn.example.org.": "cdn.example.org.",
+		"WWW.Example.ORG.":     "example.org.",
+		"example.com.":         ".",
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion(qname, dns.TypeA)
+		if zone := handle.originZone(r); zone != expected {
+			t.Errorf("Expected zone of %v is %v, but got %v", qname, expected, zone)
+		}
+	}
+
+	// Responses without question use the owner of answers, no zone matches falls back to the root
+	handle.Zones = []string{"example.org."}
+	if zone := handle.originZone(newTestResponse(t, "example.com.", "example.com. 60 IN A 192.0.2.1")); zone != "." {
+		t.Errorf("Expected root zone, but got %v", zone)
+	}
+	r := newTestResponse(t, "example.org.", "www.example.org. 60 IN A 192.0.2.1")
+	r.Question = nil
+	if zone := handle.originZone(r); zone != "example.org." {
+		t.Errorf("Expected zone of answer is example.org., but got %v", zone)
+	}
+}
@@ -1,6 +1,10 @@
 package coredns_nftables
 
 import (
+	"fmt"
+	"math"
+	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -21,6 +25,74 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return plugin.Error("nftables", err)
 	}
+	handle.Zones = plugin.OriginsFromArgsOrServerBlock(nil, c.ServerBlockKeys)
+
+	c.OnStartup(func() error {
+		if err := StartAgent(); err != nil {
+			return plugin.Error("nftables", err)
+		}
+		RestoreLruSnapshotFile()
+		// the matchers of the old rules are gone
+		InvalidateMatchCache()
+		if handle.FlushSetOnStart {
+			if _, err := FlushSetsOnStart(&handle); err != nil {
+				log.Warningf("Nftables flush sets on start failed. %v", err)
+			}
+		}
+		StartStateDump(&handle)
+		StartConfigHash(&handle)
+		StartLearnOnly()
+		StartDriftCheck()
+		StartPinning()
+		StartStateFile()
+		StartSetSizeCollector()
+		StartReaper()
+		StartHostnameFile()
+		StartWorkloadFile()
+		StartDomainFileWatcher()
+		StartGroupScheduler()
+		StartAsyncPool()
+		StartElementMonitor()
+		StartLruRedis()
+		if err := StartAdmin(); err != nil {
+			return plugin.Error("nftables", err)
+		}
+		if logCapabilitiesOnStartup {
+			LogCapabilities()
+		}
+		return nil
+	})
+
+	c.OnShutdown(func() error {
+		StopStateDump(&handle)
+		StopConfigHash(&handle)
+		StopDriftCheck()
+		StopPinning()
+		StopStateFile()
+		StopSetSizeCollector()
+		StopReaper()
+		StopHostnameFile()
+		StopWorkloadFile()
+		StopDomainFileWatcher()
+		StopGroupScheduler()
+		StopAsyncPool()
+		StopElementMonitor()
+		StopLruRedis()
+		StopAdmin()
+		ClearSetCounters()
+		CloseAppliedLog()
+		StopAgent()
+		return nil
+	})
+
+	c.OnFinalShutdown(func() error {
+		if _, err := FlushOwnedElements(); err != nil {
+			log.Warningf("Nftables flush owned elements on shutdown failed. %v", err)
+		}
+		SaveLruSnapshotFile()
+		SaveStateFile()
+		return nil
+	})
 
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		handle.Next = next
@@ -34,11 +106,12 @@ func setup(c *caddy.Controller) error {
 }
 
 func parse(c *caddy.Controller, handle *NftablesHandler) error {
+	// a reload without allow-destructive must not keep the destructive features of the last configuration
+	SetAllowDestructive(false)
 	for c.Next() {
 		var families []nftables.TableFamily
 		// nftables [family...]
 		args := c.RemainingArgs()
-		allowAutoIpAddr := true
 		if len(args) > 0 {
 			for _, family := range args {
 				switch strings.ToLower(family) {
@@ -48,16 +121,14 @@ func parse(c *caddy.Controller, handle *NftablesHandler) error {
 					families = append(families, nftables.TableFamilyIPv6)
 				case "inet":
 					families = append(families, nftables.TableFamilyINet)
-					allowAutoIpAddr = false
 				case "arp":
 					families = append(families, nftables.TableFamilyARP)
-					allowAutoIpAddr = false
 				case "bridge":
 					families = append(families, nftables.TableFamilyBridge)
-					allowAutoIpAddr = false
 				case "netdev":
 					families = append(families, nftables.TableFamilyNetdev)
-					allowAutoIpAddr = false
+				default:
+					return c.Errf("nftables family %v invalid", family)
 				}
 			}
 		}
@@ -77,8 +148,10 @@ func parse(c *caddy.Controller, handle *NftablesHandler) error {
 						return c.Errf("nftables set argument count invalid")
 					}
 					var err error = nil
-					if strings.ToLower(args[0]) == "add" {
-						err = setupSetAddElement(c, handle, allowAutoIpAddr, families, args)
+					if strings.ToLower(args[0]) == "add" && len(args) > 1 && strings.ToLower(args[1]) == "service" {
+						err = setupSetAddService(c, handle, families, args)
+					} else if strings.ToLower(args[0]) == "add" {
+						err = setupSetAddElement(c, handle, families, args)
 					} else if strings.ToLower(args[0]) == "lru" {
 						err = setupSetLruOptions(c, handle, args)
 					} else {
@@ -89,13 +162,101 @@ func parse(c *caddy.Controller, handle *NftablesHandler) error {
 					}
 				}
 
-			case "connection":
+			case "group":
+				{
+					// group <NAME> { <option>... }
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables group argument count invalid")
+					}
+					err := setupRuleGroup(c, handle, families, args[0])
+					if err != nil {
+						return err
+					}
+				}
+
+			case "canary":
+				{
+					// canary [SUFFIX] { add_element ... }
+					args := c.RemainingArgs()
+					if len(args) > 1 {
+						return c.Errf("nftables canary argument count invalid")
+					}
+					suffix := canaryDefaultSuffix
+					if len(args) > 0 {
+						suffix = args[0]
+					}
+					err := setupCanary(c, handle, families, suffix)
+					if err != nil {
+						return err
+					}
+				}
+
+			case "match":
+				{
+					// match <domain...> { <action>... }
+					err := setupActionChain(c, handle, families, c.RemainingArgs())
+					if err != nil {
+						return err
+					}
+				}
+
+			case "connection", "connection-pool-size":
 				{
+					directive := strings.ToLower(c.Val())
 					args := c.RemainingArgs()
+					if directive == "connection-pool-size" {
+						// connection-pool-size <count> is the alias of connection pool-size <count>
+						args = append([]string{"pool-size"}, args...)
+					}
 					if len(args) < 2 {
 						return c.Errf("nftables set argument count invalid")
 					}
 					connectionAction := strings.ToLower(args[0])
+					if connectionAction == "max-age" {
+						// connection max-age <add/create/delete> <duration>
+						if len(args) != 3 {
+							return c.Errf("nftables connection max-age argument count invalid")
+						}
+						age, err := time.ParseDuration(args[2])
+						if err != nil || age < 0 {
+							return c.Errf("nftables connection max-age %v invalid, %v", args[2], err)
+						}
+						if err := SetConnectionMaxAge(args[1], age); err != nil {
+							return c.Errf("nftables connection max-age invalid, %v", err)
+						}
+						break
+					}
+					if len(args) != 2 && (connectionAction == "pool-size" || connectionAction == "idle-timeout" || connectionAction == "health-check") {
+						return c.Errf("nftables connection %v argument count invalid", connectionAction)
+					}
+					if connectionAction == "pool-size" {
+						// connection pool-size <count>
+						size, err := strconv.Atoi(args[1])
+						if err != nil || size < 0 {
+							return c.Errf("nftables connection pool-size %v invalid, %v", args[1], err)
+						}
+						SetConnectionPoolSize(size)
+						break
+					}
+					if connectionAction == "idle-timeout" {
+						// connection idle-timeout <timeout>
+						timeout, err := time.ParseDuration(args[1])
+						if err != nil || timeout < 0 {
+							return c.Errf("nftables connection idle-timeout %v invalid, %v", args[1], err)
+						}
+						SetConnectionIdleTimeout(timeout)
+						break
+					}
+					if connectionAction == "health-check" {
+						// connection health-check <true/false>
+						enable, err := strconv.ParseBool(args[1])
+						if err != nil {
+							return c.Errf("nftables connection health-check %v invalid, %v", args[1], err)
+						}
+						SetConnectionHealthCheck(enable)
+						break
+					}
 					if connectionAction != "timeout" {
 						return c.Errf("nftables connection action %v invalid", connectionAction)
 					}
@@ -104,22 +265,1036 @@ func parse(c *caddy.Controller, handle *NftablesHandler) error {
 					if err != nil {
 						return c.Errf("nftables connection action %v argument %v invalid, %v", connectionAction, args[1], err)
 					}
-					SetConnectionTimeout(parseTimeout)
+					SetConnectionTimeout(parseTimeout)
+				}
+
+			case "async":
+				{
+					// async <true/false> [workers <count>] [queue <size>] [overflow <drop/oldest/block>]
+					// async workers <count> [queue <size>] [overflow <drop/oldest/block>]
+					// async defer [deadline]
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables set argument count invalid")
+					}
+
+					if strings.ToLower(args[0]) == "defer" {
+						if len(args) > 2 {
+							return c.Errf("nftables async defer argument count invalid")
+						}
+						deadline := time.Second
+						if len(args) > 1 {
+							var err error
+							deadline, err = time.ParseDuration(args[1])
+							if err != nil || deadline < 0 {
+								return c.Errf("nftables async defer deadline %v invalid, %v", args[1], err)
+							}
+						}
+						SetNftableAsyncMode(false)
+						SetNftableDeferWrite(true, deadline)
+						continue
+					}
+
+					parseAsync, err := strconv.ParseBool(args[0])
+					if err == nil {
+						args = args[1:]
+					} else if strings.ToLower(args[0]) == "workers" {
+						parseAsync = true
+					} else {
+						return c.Errf("nftables async argument %v invalid, %v", args[0], err)
+					}
+
+					workers, queue, overflow := 0, 4096, asyncOverflowDrop
+					if len(args)%2 != 0 {
+						return c.Errf("nftables async argument count invalid")
+					}
+					for i := 0; i < len(args); i += 2 {
+						option := strings.ToLower(args[i])
+						switch option {
+						case "workers", "queue":
+							value, err := strconv.Atoi(args[i+1])
+							if err != nil || value <= 0 {
+								return c.Errf("nftables async %v %v invalid, %v", option, args[i+1], err)
+							}
+							if option == "workers" {
+								workers = value
+							} else {
+								queue = value
+							}
+						case "overflow":
+							overflow = strings.ToLower(args[i+1])
+						default:
+							return c.Errf("nftables async option %v invalid", args[i])
+						}
+					}
+					if err := SetNftableAsyncPool(workers, queue, overflow); err != nil {
+						return c.Errf("nftables async invalid, %v", err)
+					}
+
+					SetNftableAsyncMode(parseAsync)
+					SetNftableDeferWrite(false, time.Second)
+				}
+
+			case "atomic":
+				{
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables atomic argument count invalid")
+					}
+
+					parseAtomic, err := strconv.ParseBool(args[0])
+					if err != nil {
+						return c.Errf("nftables atomic argument %v invalid, %v", args[0], err)
+					}
+
+					SetNftableBatchAtomic(parseAtomic)
+				}
+
+			case "userdata":
+				{
+					// userdata <true/false>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables userdata argument count invalid")
+					}
+
+					parseUserdata, err := strconv.ParseBool(args[0])
+					if err != nil {
+						return c.Errf("nftables userdata argument %v invalid, %v", args[0], err)
+					}
+
+					SetElementUserdata(parseUserdata)
+				}
+
+			case "owner-comment":
+				{
+					// owner-comment <COMMENT>
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables owner-comment argument count invalid")
+					}
+					if len(args[0]) == 0 || len(args[0]) > elementCommentMaxLength-1 || strings.ContainsAny(args[0], "\"\\") {
+						return c.Errf("nftables owner-comment %q invalid, it must be 1-%v characters without quotes", args[0], elementCommentMaxLength-1)
+					}
+
+					SetElementOwnerComment(args[0])
+				}
+
+			case "flush-owned-on-shutdown":
+				{
+					// flush-owned-on-shutdown <true/false>
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables flush-owned-on-shutdown argument count invalid")
+					}
+
+					parseFlush, err := strconv.ParseBool(args[0])
+					if err != nil {
+						return c.Errf("nftables flush-owned-on-shutdown argument %v invalid, %v", args[0], err)
+					}
+
+					SetFlushOwnedOnShutdown(parseFlush)
+				}
+
+			case "monitor":
+				{
+					// monitor <true/false>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables monitor argument count invalid")
+					}
+
+					parseMonitor, err := strconv.ParseBool(args[0])
+					if err != nil {
+						return c.Errf("nftables monitor argument %v invalid, %v", args[0], err)
+					}
+
+					SetElementMonitor(parseMonitor)
+				}
+
+			case "preserve-case":
+				{
+					// preserve-case <true/false>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables preserve-case argument count invalid")
+					}
+
+					parsePreserve, err := strconv.ParseBool(args[0])
+					if err != nil {
+						return c.Errf("nftables preserve-case argument %v invalid, %v", args[0], err)
+					}
+
+					SetPreserveNameCase(parsePreserve)
+				}
+
+			case "learn":
+				{
+					// learn <duration>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables learn argument count invalid")
+					}
+
+					parseDuration, err := time.ParseDuration(args[0])
+					if err != nil {
+						return c.Errf("nftables learn duration %v invalid, %v", args[0], err)
+					}
+
+					SetLearnOnly(parseDuration)
+				}
+
+			case "capabilities":
+				{
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables capabilities argument count invalid")
+					}
+
+					parseCapabilities, err := strconv.ParseBool(args[0])
+					if err != nil {
+						return c.Errf("nftables capabilities argument %v invalid, %v", args[0], err)
+					}
+
+					SetLogCapabilitiesOnStartup(parseCapabilities)
+				}
+
+			case "log":
+				{
+					// log file <path> [max_size] [max_backups]
+					// log instance [ID]
+					// log lock [timeout]
+					// log compress <gzip/none>
+					// log retention <duration>
+					args := c.RemainingArgs()
+					if len(args) > 0 && strings.ToLower(args[0]) == "compress" {
+						if len(args) != 2 {
+							return c.Errf("nftables log compress argument count invalid")
+						}
+						if err := SetAppliedLogCompression(args[1]); err != nil {
+							return c.Errf("nftables log compress invalid, %v", err)
+						}
+						continue
+					}
+					if len(args) > 0 && strings.ToLower(args[0]) == "retention" {
+						if len(args) != 2 {
+							return c.Errf("nftables log retention argument count invalid")
+						}
+						retention, err := time.ParseDuration(args[1])
+						if err != nil || retention < 0 {
+							return c.Errf("nftables log retention %v invalid", args[1])
+						}
+						SetAppliedLogRetention(retention)
+						continue
+					}
+					if len(args) > 0 && strings.ToLower(args[0]) == "instance" {
+						if len(args) > 2 {
+							return c.Errf("nftables log instance argument count invalid")
+						}
+						id := ""
+						if len(args) > 1 {
+							id = args[1]
+						}
+						instance, err := parseAppliedLogInstance(id)
+						if err != nil {
+							return c.Errf("nftables log instance invalid, %v", err)
+						}
+						SetAppliedLogInstance(instance)
+						continue
+					}
+					if len(args) > 0 && strings.ToLower(args[0]) == "lock" {
+						if len(args) > 2 {
+							return c.Errf("nftables log lock argument count invalid")
+						}
+						timeout := time.Second
+						if len(args) > 1 {
+							parseTimeout, err := time.ParseDuration(args[1])
+							if err != nil || parseTimeout <= 0 {
+								return c.Errf("nftables log lock timeout %v invalid", args[1])
+							}
+							timeout = parseTimeout
+						}
+						SetAppliedLogLock(timeout)
+						continue
+					}
+					if len(args) < 2 || strings.ToLower(args[0]) != "file" {
+						return c.Errf("nftables log argument invalid")
+					}
+
+					var maxSize int64 = 0
+					maxBackups := 0
+					if len(args) > 2 {
+						parseSize, err := parseSize(args[2])
+						if err != nil {
+							return c.Errf("nftables log file max size %v invalid, %v", args[2], err)
+						}
+						maxSize = parseSize
+					}
+					if len(args) > 3 {
+						parseBackups, err := strconv.ParseInt(args[3], 10, 32)
+						if err != nil {
+							return c.Errf("nftables log file max backups %v invalid, %v", args[3], err)
+						}
+						maxBackups = int(parseBackups)
+					}
+
+					SetAppliedLog(args[1], maxSize, maxBackups)
+				}
+
+			case "hostname":
+				{
+					// hostname file <path> [interval]
+					args := c.RemainingArgs()
+					if len(args) < 2 || strings.ToLower(args[0]) != "file" {
+						return c.Errf("nftables hostname argument invalid")
+					}
+
+					var interval time.Duration = 0
+					if len(args) > 2 {
+						parseInterval, err := time.ParseDuration(args[2])
+						if err != nil {
+							return c.Errf("nftables hostname file interval %v invalid, %v", args[2], err)
+						}
+						interval = parseInterval
+					}
+
+					SetHostnameFile(args[1], interval)
+				}
+
+			case "workload":
+				{
+					// workload file <path> [reload interval]
+					args := c.RemainingArgs()
+					if len(args) < 2 || len(args) > 3 || strings.ToLower(args[0]) != "file" {
+						return c.Errf("nftables workload argument invalid")
+					}
+
+					var interval time.Duration = 0
+					if len(args) > 2 {
+						parseInterval, err := time.ParseDuration(args[2])
+						if err != nil || parseInterval <= 0 {
+							return c.Errf("nftables workload file reload interval %v invalid, %v", args[2], err)
+						}
+						interval = parseInterval
+					}
+
+					if err := SetWorkloadFile(args[1], interval); err != nil {
+						return c.Errf("nftables workload file invalid, %v", err)
+					}
+				}
+
+			case "dump":
+				{
+					// dump <USR1/USR2> <path>
+					args := c.RemainingArgs()
+					if len(args) < 2 {
+						return c.Errf("nftables dump argument count invalid")
+					}
+
+					sig, err := parseSignal(args[0])
+					if err != nil {
+						return c.Errf("nftables dump %v", err)
+					}
+
+					SetStateDump(sig, args[1])
+				}
+
+			case "drift":
+				{
+					// drift <interval> [repair]
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables drift argument count invalid")
+					}
+
+					parseInterval, err := time.ParseDuration(args[0])
+					if err != nil {
+						return c.Errf("nftables drift interval %v invalid, %v", args[0], err)
+					}
+
+					repair := false
+					if len(args) > 1 {
+						if strings.ToLower(args[1]) != "repair" {
+							return c.Errf("nftables drift option %v invalid", args[1])
+						}
+						repair = true
+					}
+
+					SetDriftCheck(parseInterval, repair)
+				}
+
+			case "state":
+				{
+					// state file <path> [interval]
+					args := c.RemainingArgs()
+					if len(args) < 2 || len(args) > 3 || strings.ToLower(args[0]) != "file" {
+						return c.Errf("nftables state argument invalid")
+					}
+
+					var interval time.Duration = 0
+					if len(args) > 2 {
+						parseInterval, err := time.ParseDuration(args[2])
+						if err != nil || parseInterval <= 0 {
+							return c.Errf("nftables state file interval %v invalid", args[2])
+						}
+						interval = parseInterval
+					}
+					SetStateFile(args[1], interval)
+				}
+
+			case "netns":
+				{
+					// netns <name/path/pid> <value>
+					args := c.RemainingArgs()
+					if len(args) != 2 {
+						return c.Errf("nftables netns argument count invalid")
+					}
+					if err := SetNetworkNamespace(args[0], args[1]); err != nil {
+						return c.Errf("nftables netns invalid, %v", err)
+					}
+				}
+
+			case "backend":
+				{
+					// backend <nftables/netlink/ipset>
+					// backend script <path> [max_size] [max_backups]
+					// backend exec-nft [path] [timeout] [rate]
+					args := c.RemainingArgs()
+					if len(args) > 0 && strings.ToLower(args[0]) == "script" {
+						if len(args) < 2 || len(args) > 4 {
+							return c.Errf("nftables backend script argument count invalid")
+						}
+						var maxSize int64 = 0
+						maxBackups := 0
+						if len(args) > 2 {
+							parseSize, err := parseSize(args[2])
+							if err != nil {
+								return c.Errf("nftables backend script max size %v invalid, %v", args[2], err)
+							}
+							maxSize = parseSize
+						}
+						if len(args) > 3 {
+							parseBackups, err := strconv.ParseInt(args[3], 10, 32)
+							if err != nil {
+								return c.Errf("nftables backend script max backups %v invalid, %v", args[3], err)
+							}
+							maxBackups = int(parseBackups)
+						}
+						SetNftScript(args[1], maxSize, maxBackups)
+						args = args[:1]
+					}
+					if len(args) > 0 && strings.ToLower(args[0]) == "exec-nft" {
+						if len(args) > 4 {
+							return c.Errf("nftables backend exec-nft argument count invalid")
+						}
+						path := defaultExecNftPath
+						timeout := defaultExecNftTimeout
+						rate := 0.0
+						if len(args) > 1 {
+							path = args[1]
+						}
+						if len(args) > 2 {
+							parseTimeout, err := time.ParseDuration(args[2])
+							if err != nil || parseTimeout <= 0 {
+								return c.Errf("nftables backend exec-nft timeout %v invalid, %v", args[2], err)
+							}
+							timeout = parseTimeout
+						}
+						if len(args) > 3 {
+							parseRate, err := strconv.ParseFloat(args[3], 64)
+							if err != nil || parseRate < 0 {
+								return c.Errf("nftables backend exec-nft rate %v invalid, %v", args[3], err)
+							}
+							rate = parseRate
+						}
+						SetExecNft(path, timeout, rate)
+						args = args[:1]
+					}
+					if len(args) != 1 {
+						return c.Errf("nftables backend argument count invalid")
+					}
+					if err := SetBackend(args[0]); err != nil {
+						return c.Errf("nftables backend invalid, %v", err)
+					}
+				}
+
+			case "agent":
+				{
+					// agent <address> [timeout] [tls <CA_FILE> [CERT_FILE KEY_FILE]]
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables agent argument count invalid")
+					}
+
+					timeout := time.Second
+					nextArgIndex := 1
+					if len(args) > nextArgIndex && strings.ToLower(args[nextArgIndex]) != "tls" {
+						var err error
+						timeout, err = time.ParseDuration(args[nextArgIndex])
+						if err != nil || timeout <= 0 {
+							return c.Errf("nftables agent timeout %v invalid, %v", args[nextArgIndex], err)
+						}
+						nextArgIndex += 1
+					}
+					files := NftablesAgentTLS{}
+					if len(args) > nextArgIndex {
+						tlsArgs := args[nextArgIndex+1:]
+						if strings.ToLower(args[nextArgIndex]) != "tls" || (len(tlsArgs) != 1 && len(tlsArgs) != 3) {
+							return c.Errf("nftables agent argument count invalid")
+						}
+						files.CAFile = tlsArgs[0]
+						if len(tlsArgs) == 3 {
+							files.CertFile = tlsArgs[1]
+							files.KeyFile = tlsArgs[2]
+						}
+					}
+					// the unix socket is protected by its permission, other addresses must use TLS
+					if _, err := agentCredentials(args[0], files); err != nil {
+						return c.Errf("nftables agent invalid, %v", err)
+					}
+					SetNftablesAgent(args[0], timeout)
+					SetNftablesAgentTLS(files)
+				}
+
+			case "slo":
+				{
+					// slo <budget> [percentile]
+					args := c.RemainingArgs()
+					if len(args) < 1 || len(args) > 2 {
+						return c.Errf("nftables slo argument count invalid")
+					}
+
+					budget, err := time.ParseDuration(args[0])
+					if err != nil || budget <= 0 {
+						return c.Errf("nftables slo budget %v invalid, %v", args[0], err)
+					}
+					percentile := 99.0
+					if len(args) > 1 {
+						percentile, err = strconv.ParseFloat(args[1], 64)
+						if err != nil || percentile <= 0 || percentile > 100 {
+							return c.Errf("nftables slo percentile %v invalid, it must be in (0, 100]", args[1])
+						}
+					}
+					SetSlo(budget, percentile)
+				}
+
+			case "set-size":
+				{
+					// set-size <interval>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables set-size argument count invalid")
+					}
+
+					parseInterval, err := time.ParseDuration(args[0])
+					if err != nil || parseInterval < 0 {
+						return c.Errf("nftables set-size interval %v invalid, %v", args[0], err)
+					}
+
+					SetSetSizeInterval(parseInterval)
+				}
+
+			case "allow-destructive":
+				{
+					// allow-destructive [true/false]
+					args := c.RemainingArgs()
+					allow := true
+					if len(args) > 0 {
+						var err error
+						allow, err = strconv.ParseBool(args[0])
+						if err != nil {
+							return c.Errf("nftables allow-destructive %v invalid, %v", args[0], err)
+						}
+					}
+
+					SetAllowDestructive(allow)
+				}
+
+			case "reaper":
+				{
+					// reaper <interval>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables reaper argument count invalid")
+					}
+
+					parseInterval, err := time.ParseDuration(args[0])
+					if err != nil || parseInterval < 0 {
+						return c.Errf("nftables reaper interval %v invalid, %v", args[0], err)
+					}
+
+					SetReaper(parseInterval)
+				}
+
+			case "breaker":
+				{
+					// breaker <failures> <cooldown>
+					args := c.RemainingArgs()
+					if len(args) != 2 {
+						return c.Errf("nftables breaker argument count invalid")
+					}
+
+					threshold, err := strconv.Atoi(args[0])
+					if err != nil || threshold < 0 {
+						return c.Errf("nftables breaker failures %v invalid, %v", args[0], err)
+					}
+					cooldown, err := time.ParseDuration(args[1])
+					if err != nil || cooldown <= 0 {
+						return c.Errf("nftables breaker cooldown %v invalid, %v", args[1], err)
+					}
+
+					SetBreaker(threshold, cooldown)
+				}
+
+			case "retry":
+				{
+					// retry <max attempts> [base delay] [max delay]
+					args := c.RemainingArgs()
+					if len(args) < 1 || len(args) > 3 {
+						return c.Errf("nftables retry argument count invalid")
+					}
+
+					attempts, err := strconv.Atoi(args[0])
+					if err != nil || attempts < 0 {
+						return c.Errf("nftables retry max attempts %v invalid, %v", args[0], err)
+					}
+					base, max := 10*time.Millisecond, time.Second
+					if len(args) > 1 {
+						base, err = time.ParseDuration(args[1])
+						if err != nil || base <= 0 {
+							return c.Errf("nftables retry base delay %v invalid, %v", args[1], err)
+						}
+					}
+					if len(args) > 2 {
+						max, err = time.ParseDuration(args[2])
+						if err != nil || max < base {
+							return c.Errf("nftables retry max delay %v invalid, %v", args[2], err)
+						}
+					}
+
+					SetRetry(attempts, base, max)
+				}
+
+			case "on-missing":
+				{
+					// on-missing <resolve/recreate>
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables on-missing argument count invalid")
+					}
+					policy, err := parseMissingPolicy(args[0])
+					if err != nil {
+						return c.Errf("nftables on-missing invalid, %v", err)
+					}
+					SetMissingPolicy(policy)
+				}
+
+			case "on-full":
+				{
+					// on-full <drop/evict-oldest/grow> [max size]
+					args := c.RemainingArgs()
+					if len(args) < 1 || len(args) > 2 {
+						return c.Errf("nftables on-full argument count invalid")
+					}
+					policy, err := parseFullPolicy(args[0])
+					if err != nil {
+						return c.Errf("nftables on-full invalid, %v", err)
+					}
+					var maxSize uint64 = 0
+					if len(args) > 1 {
+						if policy != NftablesFullGrow {
+							return c.Errf("nftables on-full max size is only valid with grow")
+						}
+						maxSize, err = strconv.ParseUint(args[1], 10, 32)
+						if err != nil || maxSize == 0 {
+							return c.Errf("nftables on-full max size %v invalid, %v", args[1], err)
+						}
+					}
+					SetFullPolicy(policy, uint32(maxSize))
+				}
+
+			case "timezone":
+				{
+					// timezone <NAME>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables timezone argument count invalid")
+					}
+
+					location, err := time.LoadLocation(args[0])
+					if err != nil {
+						return c.Errf("nftables timezone %v invalid, %v", args[0], err)
+					}
+
+					SetScheduleLocation(location)
+				}
+
+			case "skip-existing":
+				{
+					// skip-existing <refresh interval>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables skip-existing argument count invalid")
+					}
+
+					parseRefresh, err := time.ParseDuration(args[0])
+					if err != nil || parseRefresh < 0 {
+						return c.Errf("nftables skip-existing refresh interval %v invalid, %v", args[0], err)
+					}
+
+					SetSkipExisting(parseRefresh)
+				}
+
+			case "admin":
+				{
+					// admin <address>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables admin argument count invalid")
+					}
+					if _, _, err := net.SplitHostPort(args[0]); err != nil {
+						return c.Errf("nftables admin address %v invalid, %v", args[0], err)
+					}
+
+					SetAdminAddress(args[0])
+				}
+
+			case "include-cidr", "exclude-cidr":
+				{
+					// include-cidr <CIDR...> / exclude-cidr <CIDR...>
+					directive := strings.ToLower(c.Val())
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables %v argument count invalid", directive)
+					}
+					networks, err := parseCIDRs(args)
+					if err != nil {
+						return c.Errf("nftables %v argument invalid, %v", directive, err)
+					}
+
+					if handle.AddressFilter == nil {
+						handle.AddressFilter = &NftablesAddressFilter{}
+					}
+					if directive == "include-cidr" {
+						handle.AddressFilter.Include = append(handle.AddressFilter.Include, networks...)
+					} else {
+						handle.AddressFilter.Exclude = append(handle.AddressFilter.Exclude, networks...)
+					}
+				}
+
+			case "families-ipv4", "families-ipv6":
+				{
+					// families-ipv4 <family...> / families-ipv6 <family...>
+					directive := strings.ToLower(c.Val())
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables %v argument count invalid", directive)
+					}
+					families, err := parseAnswerFamilies(strings.TrimPrefix(directive, "families-"), args)
+					if err != nil {
+						return c.Errf("nftables %v argument invalid, %v", directive, err)
+					}
+
+					if directive == "families-ipv4" {
+						handle.FamiliesIPv4 = families
+					} else {
+						handle.FamiliesIPv6 = families
+					}
+				}
+
+			case "link-local":
+				{
+					// link-local <strip|skip|netdev> [interface]
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables link-local argument count invalid")
+					}
+					policy, err := parseLinkLocalPolicy(args[0])
+					if err != nil {
+						return c.Errf("nftables link-local invalid, %v", err)
+					}
+					if (policy == NftablesLinkLocalNetdev) != (len(args) == 2) || len(args) > 2 {
+						return c.Errf("nftables link-local %v argument count invalid, only netdev requires an interface", args[0])
+					}
+					handle.LinkLocal = policy
+					handle.LinkLocalInterface = ""
+					if policy == NftablesLinkLocalNetdev {
+						handle.LinkLocalInterface = args[1]
+					}
+				}
+
+			case "on-error":
+				{
+					// on-error <serve/servfail/refuse> [ede [CODE] [TEXT...]]
+					args := c.RemainingArgs()
+					if len(args) < 1 || (len(args) > 1 && strings.ToLower(args[1]) != "ede") {
+						return c.Errf("nftables on-error argument invalid")
+					}
+					policy, err := parseOnErrorPolicy(args[0])
+					if err != nil {
+						return c.Errf("nftables on-error invalid, %v", err)
+					}
+					handle.OnError = policy
+					handle.OnErrorEDE = nil
+					if len(args) > 1 {
+						handle.OnErrorEDE, err = parseOnErrorEDE(args[2:])
+						if err != nil {
+							return c.Errf("nftables on-error ede invalid, %v", err)
+						}
+					}
+				}
+
+			case "rollout":
+				{
+					// rollout <PERCENT>
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables rollout argument count invalid")
+					}
+					rollout, err := parseRollout(args[0])
+					if err != nil {
+						return c.Errf("nftables rollout invalid, %v", err)
+					}
+					handle.Rollout = rollout
+				}
+
+			case "rrset-ttl":
+				{
+					// rrset-ttl <true/false>
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables rrset-ttl argument count invalid")
+					}
+					parseRRsetTTL, err := strconv.ParseBool(args[0])
+					if err != nil {
+						return c.Errf("nftables rrset-ttl argument %v invalid, %v", args[0], err)
+					}
+					handle.RRsetTTL = parseRRsetTTL
+				}
+
+			case "ipv6-only":
+				{
+					// ipv6-only <true/false>
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables ipv6-only argument count invalid")
+					}
+					parseIPv6Only, err := strconv.ParseBool(args[0])
+					if err != nil {
+						return c.Errf("nftables ipv6-only argument %v invalid, %v", args[0], err)
+					}
+					handle.IPv6Only = parseIPv6Only
+				}
+
+			case "flush-set-on-start":
+				{
+					// flush-set-on-start <true/false>
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables flush-set-on-start argument count invalid")
+					}
+					parseFlush, err := strconv.ParseBool(args[0])
+					if err != nil {
+						return c.Errf("nftables flush-set-on-start argument %v invalid, %v", args[0], err)
+					}
+					handle.FlushSetOnStart = parseFlush
+				}
+
+			case "match-engine":
+				{
+					// match-engine <trie/aho-corasick>
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables match-engine argument count invalid")
+					}
+					if err := SetDomainMatchEngine(args[0]); err != nil {
+						return c.Errf("nftables match-engine invalid, %v", err)
+					}
+				}
+
+			case "match-cache":
+				{
+					// match-cache <max entries>
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables match-cache argument count invalid")
+					}
+					maxEntries, err := strconv.Atoi(args[0])
+					if err != nil || maxEntries < 0 {
+						return c.Errf("nftables match-cache %v invalid, it must be a non-negative integer", args[0])
+					}
+					SetMatchCache(maxEntries)
+				}
+
+			case "sync-timeout":
+				{
+					// sync-timeout <timeout>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables sync-timeout argument count invalid")
+					}
+
+					parseTimeout, err := time.ParseDuration(args[0])
+					if err != nil || parseTimeout < 0 {
+						return c.Errf("nftables sync-timeout %v invalid, %v", args[0], err)
+					}
+
+					SetNftableSyncTimeout(parseTimeout)
+				}
+
+			case "coalesce":
+				{
+					// coalesce <window>
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables coalesce argument count invalid")
+					}
+
+					parseWindow, err := time.ParseDuration(args[0])
+					if err != nil || parseWindow < 0 {
+						return c.Errf("nftables coalesce window %v invalid, %v", args[0], err)
+					}
+
+					SetCoalesceWindow(parseWindow)
+				}
+
+			case "dedupe":
+				{
+					// dedupe lru
+					// dedupe bloom [size <SIZE>] [fp <RATE>]
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables dedupe argument count invalid")
+					}
+					switch strings.ToLower(args[0]) {
+					case "lru":
+						if len(args) != 1 {
+							return c.Errf("nftables dedupe lru argument count invalid")
+						}
+						SetDedupeLru()
+					case "bloom":
+						if len(args)%2 != 1 {
+							return c.Errf("nftables dedupe bloom argument count invalid")
+						}
+						size := int64(setLruMaxCount)
+						fp := defaultDedupeBloomFalsePositive
+						for i := 1; i < len(args); i += 2 {
+							switch strings.ToLower(args[i]) {
+							case "size":
+								parseSize, err := parseSize(args[i+1])
+								if err != nil || parseSize < 1 || parseSize > math.MaxInt32 {
+									return c.Errf("nftables dedupe bloom size %v invalid, %v", args[i+1], err)
+								}
+								size = parseSize
+							case "fp":
+								parseRate, err := strconv.ParseFloat(args[i+1], 64)
+								if err != nil || !(parseRate > 0 && parseRate < 1) {
+									return c.Errf("nftables dedupe bloom fp %v invalid, %v", args[i+1], err)
+								}
+								fp = parseRate
+							default:
+								return c.Errf("nftables dedupe bloom option %v invalid", args[i])
+							}
+						}
+						SetDedupeBloom(int(size), fp)
+					default:
+						return c.Errf("nftables dedupe %v invalid", args[0])
+					}
+				}
+
+			case "health":
+				{
+					// health <timeout>
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables health argument count invalid")
+					}
+
+					parseTimeout, err := time.ParseDuration(args[0])
+					if err != nil || parseTimeout < 0 {
+						return c.Errf("nftables health timeout %v invalid, %v", args[0], err)
+					}
+
+					SetHealthUnhealthyAfter(parseTimeout)
+				}
+
+			case "domain-stats":
+				{
+					// domain-stats <retention> [max domains]
+					args := c.RemainingArgs()
+					if len(args) < 1 || len(args) > 2 {
+						return c.Errf("nftables domain-stats argument count invalid")
+					}
+
+					parseRetention, err := time.ParseDuration(args[0])
+					if err != nil || parseRetention < 0 {
+						return c.Errf("nftables domain-stats retention %v invalid, %v", args[0], err)
+					}
+					maxDomains := defaultDomainStatsMaxDomains
+					if len(args) > 1 {
+						parseMaxDomains, err := strconv.Atoi(args[1])
+						if err != nil || parseMaxDomains < 1 {
+							return c.Errf("nftables domain-stats max domains %v invalid, %v", args[1], err)
+						}
+						maxDomains = parseMaxDomains
+					}
+
+					SetDomainStats(parseRetention, maxDomains)
+				}
+
+			case "answer-diff":
+				{
+					// answer-diff <max domains> [webhook <URL>] [journal]
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables answer-diff argument count invalid")
+					}
+					maxDomains, err := strconv.Atoi(args[0])
+					if err != nil || maxDomains < 0 {
+						return c.Errf("nftables answer-diff max domains %v invalid, %v", args[0], err)
+					}
+					webhook := ""
+					journal := false
+					for i := 1; i < len(args); i++ {
+						switch strings.ToLower(args[i]) {
+						case "webhook":
+							if i+1 >= len(args) {
+								return c.Errf("nftables answer-diff webhook argument count invalid")
+							}
+							i++
+							parsedURL, err := url.Parse(args[i])
+							if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+								return c.Errf("nftables answer-diff webhook url %v invalid", args[i])
+							}
+							webhook = args[i]
+						case "journal":
+							journal = true
+						default:
+							return c.Errf("nftables answer-diff option %v invalid", args[i])
+						}
+					}
+
+					SetAnswerDiff(maxDomains, webhook, journal)
 				}
 
-			case "async":
+			case "backpressure":
 				{
+					// backpressure <threshold> <delay>
 					args := c.RemainingArgs()
-					if len(args) < 1 {
-						return c.Errf("nftables set argument count invalid")
+					if len(args) < 2 {
+						return c.Errf("nftables backpressure argument count invalid")
 					}
 
-					parseAsync, err := strconv.ParseBool(args[0])
+					parseThreshold, err := time.ParseDuration(args[0])
 					if err != nil {
-						return c.Errf("nftables async argument %v invalid, %v", args[0], err)
+						return c.Errf("nftables backpressure threshold %v invalid, %v", args[0], err)
+					}
+					parseDelay, err := time.ParseDuration(args[1])
+					if err != nil {
+						return c.Errf("nftables backpressure delay %v invalid, %v", args[1], err)
 					}
 
-					SetNftableAsyncMode(parseAsync)
+					SetNftableBackpressure(parseThreshold, parseDelay)
 				}
 
 			default:
@@ -130,12 +1305,68 @@ func parse(c *caddy.Controller, handle *NftablesHandler) error {
 		log.Debug("Successfully parsed configuration")
 	}
 
+	handle.DedupBypass = handle.bypassDedup()
+	if err := handle.validateIPv6Only(); err != nil {
+		return c.Errf("nftables ipv6-only invalid, %v", err)
+	}
+	if reaperInterval > 0 && !isDestructiveAllowed() {
+		SetReaper(0)
+		return c.Errf("nftables reaper deletes elements, it requires allow-destructive")
+	}
+	if handle.FlushSetOnStart && !isDestructiveAllowed() {
+		handle.FlushSetOnStart = false
+		return c.Errf("nftables flush-set-on-start deletes elements, it requires allow-destructive")
+	}
+	if flushOwnedOnShutdown && !isDestructiveAllowed() {
+		SetFlushOwnedOnShutdown(false)
+		return c.Errf("nftables flush-owned-on-shutdown deletes elements, it requires allow-destructive")
+	}
+	if fullPolicy != NftablesFullDrop && !isDestructiveAllowed() {
+		policy := fullPolicy
+		SetFullPolicy(NftablesFullDrop, 0)
+		return c.Errf("nftables on-full %v deletes elements, it requires allow-destructive", policy)
+	}
+	if !backendDescribesSets(backendName) {
+		for _, running := range handle.setRules() {
+			if !running.rule.setDescription().IsZero() {
+				return c.Errf("nftables set add element size and dynamic can not be used with backend %v", backendName)
+			}
+		}
+	}
+	if option := handle.unsupportedBackendOption(backendName); len(option) > 0 {
+		name := backendName
+		SetBackend(defaultBackendName)
+		return c.Errf("nftables %v can not be used with backend %v", option, name)
+	}
+	if backendName != defaultBackendName && len(agentAddress) > 0 {
+		name := backendName
+		SetBackend(defaultBackendName)
+		return c.Errf("nftables backend %v can not be used with agent", name)
+	}
+	if appliedLog != nil && strings.Contains(appliedLog.path, appliedLogInstancePlaceholder) && len(getAppliedLogInstance()) == 0 {
+		SetAppliedLog("", 0, 0)
+		return c.Errf("nftables log file %v requires log instance", appliedLogInstancePlaceholder)
+	}
+	return nil
+}
+
+func setupSetAddElement(c *caddy.Controller, handle *NftablesHandler, families []nftables.TableFamily, args []string) error {
+	rule, err := parseSetAddElement(c, args)
+	if err != nil {
+		return err
+	}
+
+	for _, family := range families {
+		ruleSet := handle.MutableRuleSet(family)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, rule)
+	}
+
 	return nil
 }
 
-func setupSetAddElement(c *caddy.Controller, handle *NftablesHandler, allowAutoIpAddr bool, families []nftables.TableFamily, args []string) error {
+func parseSetAddElement(c *caddy.Controller, args []string) (*NftablesSetAddElement, error) {
 	if len(args) <= 3 {
-		return c.Errf("nftables set add element argument count invalid")
+		return nil, c.Errf("nftables set add element argument count invalid")
 	}
 
 	setRuleAction := strings.ToLower(args[0])
@@ -146,7 +1377,7 @@ func setupSetAddElement(c *caddy.Controller, handle *NftablesHandler, allowAutoI
 	var setRuleTimeout time.Duration = 0 // time.ParseDuration()
 	var keyType nftables.SetDatatype = nftables.TypeInvalid
 	if setRuleAction != "add" || setRuleTarget != "element" {
-		return c.Errf("nftables set action %v invalid", setRuleTarget)
+		return nil, c.Errf("nftables set action %v invalid", setRuleTarget)
 	}
 	var nextArgIndex int = 4
 
@@ -163,10 +1394,6 @@ func setupSetAddElement(c *caddy.Controller, handle *NftablesHandler, allowAutoI
 			nextArgIndex += 1
 		}
 	}
-	if keyType == nftables.TypeInvalid && !allowAutoIpAddr {
-		return c.Errf("nftables set action %v address type invalid, only ip and ip6 family support auto address type", setRuleTarget)
-	}
-
 	if len(args) > nextArgIndex {
 		tryInterval := strings.ToLower(args[nextArgIndex])
 		if parseBool, err := strconv.ParseBool(tryInterval); err == nil {
@@ -187,15 +1414,646 @@ func setupSetAddElement(c *caddy.Controller, handle *NftablesHandler, allowAutoI
 	}
 
 	rule := NftablesSetAddElement{TableName: setRuleTableName, SetName: setRuleSetName, Interval: setRuleIsInterval, Timeout: setRuleTimeout, KeyType: keyType}
+	// set add element ... {
+	if c.NextArg() && c.Val() == "{" {
+		err := setupSetAddElementOptions(c, &rule)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &rule, nil
+}
+
+func setupSetAddService(c *caddy.Controller, handle *NftablesHandler, families []nftables.TableFamily, args []string) error {
+	// add service <TABLE_NAME> <SET_NAME> [ip/ip6/auto] [timeout]
+	if len(args) <= 3 {
+		return c.Errf("nftables set add service argument count invalid")
+	}
+
+	rule := &NftablesSetAddService{TableName: args[2], SetName: args[3], AddressType: nftables.TypeInvalid}
+	nextArgIndex := 4
+	if len(args) > nextArgIndex {
+		switch strings.ToLower(args[nextArgIndex]) {
+		case "ip":
+			rule.AddressType = nftables.TypeIPAddr
+			nextArgIndex += 1
+		case "ip6":
+			rule.AddressType = nftables.TypeIP6Addr
+			nextArgIndex += 1
+		case "auto":
+			nextArgIndex += 1
+		}
+	}
+	if len(args) > nextArgIndex {
+		parseTimeout, err := time.ParseDuration(args[nextArgIndex])
+		if err != nil {
+			return c.Errf("nftables set add service timeout %v invalid, %v", args[nextArgIndex], err)
+		}
+		rule.Timeout = parseTimeout
+		nextArgIndex += 1
+	}
+	for i := nextArgIndex; i < len(args); i++ {
+		log.Warningf("Ignore invalid setting %s", args[i])
+	}
 
 	for _, family := range families {
+		if rule.AddressType == nftables.TypeInvalid && family != nftables.TableFamilyIPv4 && family != nftables.TableFamilyIPv6 {
+			return c.Errf("nftables set add service %v %v need ip or ip6 in %v family", rule.TableName, rule.SetName, getFamilyName(family))
+		}
 		ruleSet := handle.MutableRuleSet(family)
-		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &rule)
+		ruleSet.RuleAddService = append(ruleSet.RuleAddService, rule)
 	}
 
 	return nil
 }
 
+func setupRuleGroup(c *caddy.Controller, handle *NftablesHandler, families []nftables.TableFamily, name string) error {
+	if !c.NextArg() || c.Val() != "{" {
+		return c.Errf("nftables group %v expect a block", name)
+	}
+	for _, group := range handle.Groups {
+		if group.Name == name {
+			return c.Errf("nftables group %v already exists", name)
+		}
+	}
+
+	group := NewNftablesRuleGroup(name)
+	hasRule := false
+	for c.Next() {
+		if c.Val() == "}" {
+			if !hasRule {
+				return c.Errf("nftables group %v has no add_element", name)
+			}
+			if group.Matcher.Len() == 0 && len(group.Matcher.files) == 0 {
+				return c.Errf("nftables group %v has no domain", name)
+			}
+			group.initActive()
+			handle.Groups = append(handle.Groups, group)
+			return nil
+		}
+
+		option := strings.ToLower(c.Val())
+		args := c.RemainingArgs()
+		switch option {
+		case "match", "except":
+			{
+				// match <domain...>
+				// except <domain...>
+				if len(args) < 1 {
+					return c.Errf("nftables group %v %v argument count invalid", name, option)
+				}
+				matcher := group.Matcher
+				if option == "except" {
+					if group.Except == nil {
+						group.Except = NewNftablesDomainMatcher()
+					}
+					matcher = group.Except
+				}
+				for _, domain := range args {
+					matcher.Add(domain)
+				}
+			}
+		case "match-file":
+			{
+				// match-file <path...>
+				if len(args) < 1 {
+					return c.Errf("nftables group %v match-file argument count invalid", name)
+				}
+				for _, path := range args {
+					file, err := getDomainFile(path)
+					if err != nil {
+						return c.Errf("nftables group %v match-file %v invalid, %v", name, path, err)
+					}
+					group.Matcher.AddFile(file)
+				}
+			}
+		case "enabled":
+			{
+				// enabled <true/false>
+				if len(args) < 1 {
+					return c.Errf("nftables group %v enabled argument count invalid", name)
+				}
+				enabled, err := strconv.ParseBool(args[0])
+				if err != nil {
+					return c.Errf("nftables group %v enabled %v invalid, %v", name, args[0], err)
+				}
+				group.Enabled = enabled
+			}
+		case "schedule":
+			{
+				// schedule <HH:MM>-<HH:MM> [WEEKDAY...]
+				schedule, err := ParseSchedule(args)
+				if err != nil {
+					return c.Errf("nftables group %v schedule invalid, %v", name, err)
+				}
+				group.Schedules = append(group.Schedules, schedule)
+			}
+		case "add_element":
+			{
+				// add_element [FAMILY] <TABLE_NAME> <SET_NAME> [ip/ip6/auto] [interval] [timeout] [{ ... }]
+				ruleFamilies := families
+				if len(args) > 0 {
+					if family, err := parseFamilyName(strings.ToLower(args[0])); err == nil {
+						ruleFamilies = []nftables.TableFamily{family}
+						args = args[1:]
+					}
+				}
+				rule, err := parseSetAddElement(c, append([]string{"add", "element"}, args...))
+				if err != nil {
+					return err
+				}
+				for _, family := range ruleFamilies {
+					ruleSet := group.MutableRuleSet(family)
+					ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, rule)
+				}
+				hasRule = true
+			}
+		default:
+			return c.Errf("nftables group %v option %v invalid", name, c.Val())
+		}
+	}
+
+	return c.EOFErr()
+}
+
+func setupCanary(c *caddy.Controller, handle *NftablesHandler, families []nftables.TableFamily, suffix string) error {
+	if !c.NextArg() || c.Val() != "{" {
+		return c.Errf("nftables canary expect a block")
+	}
+	if handle.Canary != nil {
+		return c.Errf("nftables canary already exists")
+	}
+
+	canary := NewNftablesCanary(suffix)
+	hasRule := false
+	for c.Next() {
+		if c.Val() == "}" {
+			if !hasRule {
+				return c.Errf("nftables canary has no add_element")
+			}
+			// the diff report relies on the intended state
+			EnableElementTracker(true)
+			handle.Canary = canary
+			return nil
+		}
+
+		if strings.ToLower(c.Val()) != "add_element" {
+			return c.Errf("nftables canary option %v invalid", c.Val())
+		}
+		// add_element [FAMILY] <TABLE_NAME> <SET_NAME> [ip/ip6/auto] [interval] [timeout] [{ ... }]
+		args := c.RemainingArgs()
+		ruleFamilies := families
+		if len(args) > 0 {
+			if family, err := parseFamilyName(strings.ToLower(args[0])); err == nil {
+				ruleFamilies = []nftables.TableFamily{family}
+				args = args[1:]
+			}
+		}
+		rule, err := parseSetAddElement(c, append([]string{"add", "element"}, args...))
+		if err != nil {
+			return err
+		}
+		rule.SetName += suffix
+		for _, family := range ruleFamilies {
+			ruleSet := canary.MutableRuleSet(family)
+			ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, rule)
+		}
+		hasRule = true
+	}
+
+	return c.EOFErr()
+}
+
+func setupActionChain(c *caddy.Controller, handle *NftablesHandler, families []nftables.TableFamily, domains []string) error {
+	if !c.NextArg() || c.Val() != "{" {
+		return c.Errf("nftables match expect a block of actions")
+	}
+
+	chain := &NftablesActionChain{Matcher: NewNftablesDomainMatcher(), Families: families}
+	for _, domain := range domains {
+		chain.Matcher.Add(domain)
+	}
+
+	for c.Next() {
+		if c.Val() == "}" {
+			if len(chain.Actions) == 0 {
+				return c.Errf("nftables match has no action")
+			}
+			if chain.Matcher.Len() == 0 && len(chain.Matcher.files) == 0 {
+				return c.Errf("nftables match has no domain")
+			}
+			handle.ActionChains = append(handle.ActionChains, chain)
+			return nil
+		}
+
+		action := strings.ToLower(c.Val())
+		args := c.RemainingArgs()
+		switch action {
+		case "set":
+			{
+				// set add element <TABLE_NAME> <SET_NAME> [ip/ip6/auto] [interval] [timeout]
+				if len(args) < 1 || strings.ToLower(args[0]) != "add" {
+					return c.Errf("nftables match set action invalid")
+				}
+				rule, err := parseSetAddElement(c, args)
+				if err != nil {
+					return err
+				}
+				chain.Actions = append(chain.Actions, &NftablesSetAction{Rule: rule})
+			}
+		case "match-file":
+			{
+				// match-file <path...>
+				if len(args) < 1 {
+					return c.Errf("nftables match match-file argument count invalid")
+				}
+				for _, path := range args {
+					file, err := getDomainFile(path)
+					if err != nil {
+						return c.Errf("nftables match match-file %v invalid, %v", path, err)
+					}
+					chain.Matcher.AddFile(file)
+				}
+			}
+		case "except":
+			{
+				// except <domain...>
+				if len(args) < 1 {
+					return c.Errf("nftables match except argument count invalid")
+				}
+				if chain.Except == nil {
+					chain.Except = NewNftablesDomainMatcher()
+				}
+				for _, domain := range args {
+					chain.Except.Add(domain)
+				}
+			}
+		case "map":
+			{
+				// map add element <TABLE_NAME> <MAP_NAME> <PORT> [ip/ip6/auto] [interval] [timeout]
+				if len(args) < 5 || strings.ToLower(args[0]) != "add" {
+					return c.Errf("nftables match map action invalid")
+				}
+				parsePort, err := strconv.ParseUint(args[4], 10, 16)
+				if err != nil || parsePort == 0 {
+					return c.Errf("nftables match map port %v invalid, %v", args[4], err)
+				}
+				rule, err := parseSetAddElement(c, append(append([]string{}, args[:4]...), args[5:]...))
+				if err != nil {
+					return err
+				}
+				rule.ProxyPort = uint16(parsePort)
+				chain.Actions = append(chain.Actions, &NftablesMapAction{NftablesSetAction{Rule: rule}})
+			}
+		case "log":
+			chain.Actions = append(chain.Actions, &NftablesLogAction{})
+		case "journal":
+			{
+				// journal [ACTION]
+				if len(args) > 1 {
+					return c.Errf("nftables match journal argument count invalid")
+				}
+				journalAction := "match"
+				if len(args) > 0 {
+					journalAction = args[0]
+				}
+				chain.Actions = append(chain.Actions, &NftablesJournalAction{Action: journalAction})
+			}
+		case "metadata":
+			{
+				// metadata <VALUE>
+				if len(args) != 1 {
+					return c.Errf("nftables match metadata argument count invalid")
+				}
+				chain.Actions = append(chain.Actions, &NftablesMetadataAction{Value: args[0]})
+			}
+		case "webhook":
+			{
+				// webhook <URL>
+				if len(args) < 1 {
+					return c.Errf("nftables match webhook argument count invalid")
+				}
+				parsedURL, err := url.Parse(args[0])
+				if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+					return c.Errf("nftables match webhook url %v invalid", args[0])
+				}
+				chain.Actions = append(chain.Actions, &NftablesWebhookAction{URL: args[0]})
+			}
+		default:
+			return c.Errf("nftables match action %v invalid", c.Val())
+		}
+	}
+
+	return c.EOFErr()
+}
+
+func setupSetAddElementOptions(c *caddy.Controller, rule *NftablesSetAddElement) error {
+	var limiter *NftablesIPLimiter = nil
+	for c.Next() {
+		if c.Val() == "}" {
+			if len(rule.Pins) > 0 && !rule.Netns.IsDefault() {
+				return c.Errf("nftables set add element pin can not be used with netns %v", rule.Netns)
+			}
+			if len(rule.Pins) > 0 && rule.Workload {
+				return c.Errf("nftables set add element pin can not be used with workload")
+			}
+			if len(rule.Pins) > 0 && len(rule.Vlans) > 0 {
+				return c.Errf("nftables set add element pin can not be used with vlan")
+			}
+			if !rule.setDescription().IsZero() && !rule.CreateSet {
+				return c.Errf("nftables set add element size and dynamic require create-set")
+			}
+			rule.SetLimiter(limiter)
+			return nil
+		}
+
+		option := strings.ToLower(c.Val())
+		args := c.RemainingArgs()
+		switch option {
+		case "counter":
+			{
+				// counter <CHAIN_NAME> [COUNTER_NAME]
+				if len(args) < 1 {
+					return c.Errf("nftables set add element counter argument count invalid")
+				}
+				counter := &NftablesSetCounter{ChainName: args[0], CounterName: rule.SetName}
+				if len(args) > 1 {
+					counter.CounterName = args[1]
+				}
+				rule.Counter = counter
+			}
+		case "timeout":
+			{
+				// timeout <timeout> <domain...>
+				if len(args) < 2 {
+					return c.Errf("nftables set add element timeout argument count invalid")
+				}
+				parseTimeout, err := time.ParseDuration(args[0])
+				if err != nil {
+					return c.Errf("nftables set add element timeout %v invalid, %v", args[0], err)
+				}
+				override := &NftablesTimeoutOverride{Timeout: parseTimeout, Matcher: NewNftablesDomainMatcher()}
+				for _, domain := range args[1:] {
+					override.Matcher.Add(domain)
+				}
+				rule.TimeoutOverrides = append(rule.TimeoutOverrides, override)
+			}
+		case "match":
+			{
+				// match <domain...>
+				if len(args) < 1 {
+					return c.Errf("nftables set add element match argument count invalid")
+				}
+				if rule.Match == nil {
+					rule.Match = NewNftablesDomainMatcher()
+				}
+				for _, domain := range args {
+					rule.Match.Add(domain)
+				}
+			}
+		case "except":
+			{
+				// except <domain...>
+				if len(args) < 1 {
+					return c.Errf("nftables set add element except argument count invalid")
+				}
+				if rule.Except == nil {
+					rule.Except = NewNftablesDomainMatcher()
+				}
+				for _, domain := range args {
+					rule.Except.Add(domain)
+				}
+			}
+		case "match-file", "except-file":
+			{
+				// match-file <path...>
+				// except-file <path...>
+				if len(args) < 1 {
+					return c.Errf("nftables set add element %v argument count invalid", option)
+				}
+				if option == "match-file" && rule.Match == nil {
+					rule.Match = NewNftablesDomainMatcher()
+				} else if option == "except-file" && rule.Except == nil {
+					rule.Except = NewNftablesDomainMatcher()
+				}
+				for _, path := range args {
+					file, err := getDomainFile(path)
+					if err != nil {
+						return c.Errf("nftables set add element %v %v invalid, %v", option, path, err)
+					}
+					if option == "match-file" {
+						rule.Match.AddFile(file)
+					} else {
+						rule.Except.AddFile(file)
+					}
+				}
+			}
+		case "exclude":
+			{
+				// exclude <GROUP...>
+				if len(args) < 1 {
+					return c.Errf("nftables set add element exclude argument count invalid")
+				}
+				for _, name := range args {
+					group, err := getAddressGroup(name)
+					if err != nil {
+						return c.Errf("nftables set add element exclude %v", err)
+					}
+					rule.Exclude = append(rule.Exclude, group)
+				}
+			}
+		case "max_ips":
+			{
+				// max_ips <COUNT> <WINDOW> [QUARANTINE_SET_NAME]
+				if len(args) < 2 {
+					return c.Errf("nftables set add element max_ips argument count invalid")
+				}
+				parseCount, err := strconv.ParseInt(args[0], 10, 32)
+				if err != nil || parseCount <= 0 {
+					return c.Errf("nftables set add element max_ips count %v invalid, %v", args[0], err)
+				}
+				parseWindow, err := time.ParseDuration(args[1])
+				if err != nil {
+					return c.Errf("nftables set add element max_ips window %v invalid, %v", args[1], err)
+				}
+				quarantine := ""
+				if len(args) > 2 {
+					quarantine = args[2]
+				}
+				limiter = NewNftablesIPLimiter(int(parseCount), parseWindow, quarantine)
+			}
+		case "ttl":
+			{
+				// ttl [MIN] [MAX]
+				rule.TtlTimeout = true
+				if len(args) > 0 {
+					parseMin, err := time.ParseDuration(args[0])
+					if err != nil {
+						return c.Errf("nftables set add element ttl min %v invalid, %v", args[0], err)
+					}
+					rule.TtlMin = parseMin
+				}
+				if len(args) > 1 {
+					parseMax, err := time.ParseDuration(args[1])
+					if err != nil {
+						return c.Errf("nftables set add element ttl max %v invalid, %v", args[1], err)
+					}
+					rule.TtlMax = parseMax
+				}
+				if rule.TtlMax > 0 && rule.TtlMin > rule.TtlMax {
+					return c.Errf("nftables set add element ttl min %v is greater than max %v", rule.TtlMin, rule.TtlMax)
+				}
+			}
+		case "proxy":
+			{
+				// proxy <PORT>
+				if len(args) != 1 {
+					return c.Errf("nftables set add element proxy argument count invalid")
+				}
+				parsePort, err := strconv.ParseUint(args[0], 10, 16)
+				if err != nil || parsePort == 0 {
+					return c.Errf("nftables set add element proxy port %v invalid, %v", args[0], err)
+				}
+				rule.ProxyPort = uint16(parsePort)
+			}
+		case "schedule":
+			{
+				// schedule <HH:MM>-<HH:MM> [WEEKDAY...]
+				schedule, err := ParseSchedule(args)
+				if err != nil {
+					return c.Errf("nftables set add element schedule invalid, %v", err)
+				}
+				rule.Schedules = append(rule.Schedules, schedule)
+			}
+		case "dedup":
+			{
+				// dedup <global/off/sliding>
+				if len(args) != 1 {
+					return c.Errf("nftables set add element dedup argument count invalid")
+				}
+				policy, err := parseDedupPolicy(args[0])
+				if err != nil {
+					return c.Errf("nftables set add element dedup invalid, %v", err)
+				}
+				rule.Dedup = policy
+			}
+		case "pin":
+			{
+				// pin <IP/CIDR...>
+				if len(args) < 1 {
+					return c.Errf("nftables set add element pin argument count invalid")
+				}
+				pins, err := parsePins(args, rule.KeyType, rule.Interval)
+				if err != nil {
+					return c.Errf("nftables set add element pin invalid, %v", err)
+				}
+				rule.Pins = append(rule.Pins, pins...)
+			}
+		case "netns":
+			{
+				// netns <name/path/pid> <value>
+				if len(args) != 2 {
+					return c.Errf("nftables set add element netns argument count invalid")
+				}
+				ns, err := ParseNetworkNamespace(args[0], args[1])
+				if err != nil {
+					return c.Errf("nftables set add element netns invalid, %v", err)
+				}
+				rule.Netns = ns
+			}
+		case "workload":
+			{
+				// workload [DEFAULT_CLASS]
+				if len(args) > 1 {
+					return c.Errf("nftables set add element workload argument count invalid")
+				}
+				rule.Workload = true
+				if len(args) > 0 {
+					rule.WorkloadDefault = args[0]
+				}
+			}
+		case "vlan":
+			{
+				// vlan <ID>...
+				if len(args) < 1 {
+					return c.Errf("nftables set add element vlan argument count invalid")
+				}
+				vlans, err := parseVlanIDs(args)
+				if err != nil {
+					return c.Errf("nftables set add element vlan invalid, %v", err)
+				}
+				rule.Vlans = append(rule.Vlans, vlans...)
+			}
+		case "create-set":
+			{
+				// create-set
+				if len(args) > 0 {
+					return c.Errf("nftables set add element create-set argument count invalid")
+				}
+				rule.CreateSet = true
+			}
+		case "size":
+			{
+				// size <MAX_ELEMENTS>
+				if len(args) != 1 {
+					return c.Errf("nftables set add element size argument count invalid")
+				}
+				parseSize, err := strconv.ParseUint(args[0], 10, 32)
+				if err != nil || parseSize == 0 {
+					return c.Errf("nftables set add element size %v invalid, %v", args[0], err)
+				}
+				rule.SetSize = uint32(parseSize)
+			}
+		case "dynamic":
+			{
+				// dynamic
+				if len(args) > 0 {
+					return c.Errf("nftables set add element dynamic argument count invalid")
+				}
+				rule.Dynamic = true
+			}
+		case "sample":
+			{
+				// sample <NUMERATOR>/<DENOMINATOR>
+				if len(args) < 1 {
+					return c.Errf("nftables set add element sample argument count invalid")
+				}
+				sampler, err := parseSampler(args[0])
+				if err != nil {
+					return c.Errf("nftables set add element sample %v invalid, %v", args[0], err)
+				}
+				rule.Sampler = sampler
+			}
+		default:
+			return c.Errf("nftables set add element option %v invalid", c.Val())
+		}
+	}
+
+	return c.EOFErr()
+}
+
+func parseSampler(value string) (*NftablesSampler, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expect <NUMERATOR>/<DENOMINATOR>")
+	}
+
+	numerator, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	denominator, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	if denominator == 0 || numerator > denominator {
+		return nil, fmt.Errorf("expect 0 <= NUMERATOR <= DENOMINATOR and DENOMINATOR > 0")
+	}
+
+	return &NftablesSampler{Numerator: numerator, Denominator: denominator}, nil
+}
+
 func setupSetLruOptions(c *caddy.Controller, handle *NftablesHandler, args []string) error {
 	if len(args) <= 2 {
 		return c.Errf("nftables set lru argument count invalid")
@@ -208,6 +2066,20 @@ func setupSetLruOptions(c *caddy.Controller, handle *NftablesHandler, args []str
 		}
 
 		SetSetLruMaxCount(int(parseRetryTimes))
+	} else if strings.ToLower(args[1]) == "timeout" && strings.ToLower(args[2]) == "ttl" {
+		// set lru timeout ttl [FACTOR]
+		factor := 1.0
+		if len(args) > 4 {
+			return c.Errf("nftables set lru timeout ttl argument count invalid")
+		}
+		if len(args) > 3 {
+			parseFactor, err := strconv.ParseFloat(args[3], 64)
+			if err != nil || !(parseFactor > 0) || math.IsInf(parseFactor, 0) {
+				return c.Errf("nftables set lru timeout ttl factor %v invalid", args[3])
+			}
+			factor = parseFactor
+		}
+		SetSetLruTTLFactor(factor)
 	} else if strings.ToLower(args[1]) == "timeout" {
 		parseTimeout, err := time.ParseDuration(args[2])
 		if err != nil {
@@ -228,6 +2100,38 @@ func setupSetLruOptions(c *caddy.Controller, handle *NftablesHandler, args []str
 		}
 
 		SetSetLruMaxRetryTimes(int(parseRetryTimes))
+	} else if strings.ToLower(args[1]) == "snapshot" {
+		SetLruSnapshotPath(args[2])
+	} else if strings.ToLower(args[1]) == "write-behind" {
+		parseInterval, err := time.ParseDuration(args[2])
+		if err != nil || parseInterval < 0 {
+			return c.Errf("nftables set lru write-behind interval %v invalid, %v", args[2], err)
+		}
+		maxPending := 0
+		if len(args) > 3 {
+			parseMaxPending, err := strconv.ParseInt(args[3], 10, 32)
+			if err != nil || parseMaxPending <= 0 {
+				return c.Errf("nftables set lru write-behind max pending %v invalid, %v", args[3], err)
+			}
+			maxPending = int(parseMaxPending)
+		}
+		SetLruRedisWriteBehind(parseInterval, maxPending)
+	} else if strings.ToLower(args[1]) == "redis" {
+		prefix := ""
+		if len(args) > 3 {
+			prefix = args[3]
+		}
+		var timeout time.Duration = 0
+		if len(args) > 4 {
+			parseTimeout, err := time.ParseDuration(args[4])
+			if err != nil || parseTimeout <= 0 {
+				return c.Errf("nftables set lru redis timeout %v invalid, %v", args[4], err)
+			}
+			timeout = parseTimeout
+		}
+		if err := SetLruRedis(args[2], prefix, timeout); err != nil {
+			return c.Errf("nftables set lru redis %v invalid, %v", args[2], err)
+		}
 	} else {
 		return c.Errf("nftables set lru %v unknown option", args[1])
 	}
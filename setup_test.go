@@ -1,7 +1,11 @@
 package coredns_nftables
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
 )
@@ -16,4 +20,1546 @@ func TestSetup(t *testing.T) {
 	if err := setup(c); err == nil {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter IPSET auto
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter IPV4 ip false 24h {
+			counter forward
+		}
+		set add element filter IPV6 ip6 false 24h {
+			counter forward ipv6_counter
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter IPV4 ip false 24h {
+			counter
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		backpressure 50ms 20ms
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		backpressure 50ms
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		log file /var/log/coredns-nftables.log 16M 5
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetAppliedLog("", 0, 0)
+
+	c = caddy.NewTestController("dns", `nftables {
+		log file /var/log/coredns-nftables.log 16X
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		dump USR1 /tmp/coredns-nftables.dump
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetStateDump(nil, "")
+
+	c = caddy.NewTestController("dns", `nftables {
+		dump HUP /tmp/coredns-nftables.dump
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter IPV6 ip6 false 1h {
+			timeout 24h corp.example.com *.salesforce.com
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter IPV6 ip6 false 1h {
+			timeout 24h
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		atomic true
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetNftableBatchAtomic(false)
+
+	c = caddy.NewTestController("dns", `nftables {
+		capabilities yes
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter ANALYTICS ip false 1h {
+			sample 1/100
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter ANALYTICS ip false 1h {
+			sample 2/1
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		drift 5m repair
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetDriftCheck(0, false)
+	EnableElementTracker(false)
+
+	c = caddy.NewTestController("dns", `nftables {
+		drift 5m fix
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		match example.org *.example.com {
+			set add element filter IPV4 ip false 24h {
+				counter forward
+			}
+			log
+			webhook http://127.0.0.1:8080/events
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		match example.org {
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		match example.org {
+			webhook 127.0.0.1
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		admin 127.0.0.1:9253
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetAdminAddress("")
+	EnableElementTracker(false)
+
+	c = caddy.NewTestController("dns", `nftables {
+		admin 9253
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		hostname file /tmp/coredns-nftables-hostname.txt 5s
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetHostnameFile("", 0)
+
+	c = caddy.NewTestController("dns", `nftables {
+		hostname map /tmp/coredns-nftables-hostname.txt
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip ip6 {
+		set add service filter HTTPS_SERVICES auto 1h
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add service filter HTTPS_SERVICES
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter IPV4 ip false {
+			ttl 5m 24h
+		}
+		set add element filter IPV6 ip6 false {
+			ttl
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter IPV4 ip false {
+			ttl 24h 5m
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		learn 24h
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetLearnOnly(0)
+
+	c = caddy.NewTestController("dns", `nftables {
+		learn
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter VPN ip false 1h {
+			match example.com *.cdn.net
+			except internal.example.com
+		}
+		match example.org {
+			except internal.example.org
+			log
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter VPN ip false 1h {
+			except
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	domainFile := filepath.Join(t.TempDir(), "vpn-domains.txt")
+	if err := os.WriteFile(domainFile, []byte("example.com\n"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter VPN ip false 1h {
+			match-file `+domainFile+`
+			except-file `+domainFile+`
+		}
+		match {
+			match-file `+domainFile+`
+			log
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter VPN ip false 1h {
+			match-file /nonexistent/vpn-domains.txt
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter VPN ip false 1h {
+			max_ips 32 1h VPN_QUARANTINE
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter VPN ip false 1h {
+			max_ips 0 1h
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter VPN ip false 1h {
+			exclude special-purpose multicast
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter VPN ip false 1h {
+			exclude bogon
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip ip6 {
+		group streaming {
+			match netflix.com
+			except corp.netflix.com
+			add_element ip filter streaming_v4
+			add_element filter streaming_v6 ip6 false 1h {
+				ttl
+			}
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		group streaming {
+			add_element ip filter streaming_v4
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		monitor true
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetElementMonitor(false)
+	EnableElementTracker(false)
+
+	c = caddy.NewTestController("dns", `nftables {
+		monitor yes
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		set add element filter IPSET auto
+		exclude-cidr 10.0.0.0/8 fe80::/10 192.0.2.1
+		include-cidr 0.0.0.0/0 ::/0
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		exclude-cidr 10.0.0.0/33
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		include-cidr
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet bridge {
+		set add element filter IPSET auto false 1h {
+			create-set
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		set add element filter IPSET auto {
+			create-set 1024
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		preserve-case true
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetPreserveNameCase(false)
+
+	c = caddy.NewTestController("dns", `nftables {
+		preserve-case
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		coalesce 2s
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetCoalesceWindow(0)
+
+	c = caddy.NewTestController("dns", `nftables {
+		coalesce -1s
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		reaper 10s
+		allow-destructive
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetReaper(0)
+	SetAllowDestructive(false)
+
+	c = caddy.NewTestController("dns", `nftables {
+		reaper 10s
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+	if reaperInterval != 0 {
+		t.Errorf("Expected the reaper is disabled without allow-destructive, but got %v", reaperInterval)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		reaper never
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		skip-existing 30s
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetSkipExisting(0)
+
+	c = caddy.NewTestController("dns", `nftables {
+		skip-existing
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element proxy PROXY_V4 ip false 1h {
+			proxy 12345
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element proxy PROXY_V4 ip false 1h {
+			proxy 65536
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		group school-hours {
+			match games.example.com
+			enabled false
+			schedule 08:00-16:00 mon-fri
+			schedule 22:00-06:00
+			add_element ip filter blocklist_v4
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		group school-hours {
+			match games.example.com
+			schedule 08:00-25:00
+			add_element ip filter blocklist_v4
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		group school-hours {
+			match games.example.com
+			schedule 08:00-16:00 someday
+			add_element ip filter blocklist_v4
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		async workers 8 queue 4096 overflow oldest
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !asyncMode || asyncWorkers != 8 || asyncQueueSize != 4096 || asyncOverflow != asyncOverflowOldest {
+		t.Errorf("Expected async mode with 8 workers, but got %v %v %v %v", asyncMode, asyncWorkers, asyncQueueSize, asyncOverflow)
+	}
+	SetNftableAsyncMode(false)
+	SetNftableAsyncPool(0, 4096, asyncOverflowDrop)
+
+	c = caddy.NewTestController("dns", `nftables {
+		async true workers 0
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		async true workers 4 overflow wait
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		timezone UTC
+		set add element school blocklist_v4 ip false 1h {
+			schedule 08:00-16:00 mon-fri
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetScheduleLocation(nil)
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		timezone Mars/Olympus_Mons
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element school blocklist_v4 ip false 1h {
+			schedule 16:00
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element filter hot_v4 ip false 1h {
+			dedup sliding
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element filter hot_v4 ip false 1h {
+			dedup always
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		retry 3 10ms 1s
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetRetry(0, 10*time.Millisecond, time.Second)
+
+	c = caddy.NewTestController("dns", `nftables {
+		retry 3 1s 10ms
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		set lru snapshot /var/lib/coredns/nftables-lru.json
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetLruSnapshotPath("")
+
+	c = caddy.NewTestController("dns", `nftables {
+		breaker 10 30s
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetBreaker(0, 0)
+
+	c = caddy.NewTestController("dns", `nftables {
+		breaker 10
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		async defer 200ms
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if asyncMode || !deferWriteMode || deferWriteDeadline != 200*time.Millisecond {
+		t.Errorf("Expected defer write mode with deadline 200ms, but got %v %v %v", asyncMode, deferWriteMode, deferWriteDeadline)
+	}
+	SetNftableDeferWrite(false, time.Second)
+
+	c = caddy.NewTestController("dns", `nftables {
+		async defer 1s workers 8
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+	SetNftableDeferWrite(false, time.Second)
+
+	c = caddy.NewTestController("dns", `nftables {
+		set-size 1m
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if setSizeInterval != time.Minute {
+		t.Errorf("Expected set size interval 1m, but got %v", setSizeInterval)
+	}
+	SetSetSizeInterval(0)
+
+	c = caddy.NewTestController("dns", `nftables {
+		set-size forever
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		families-ipv4 ip inet
+		families-ipv6 netdev
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		families-ipv4 ip6
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element filter pinned_v4 ip true 1h {
+			pin 192.0.2.1 198.51.100.0/24
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element filter pinned_v4 ip false 1h {
+			pin 198.51.100.0/24
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element filter pinned_v4 ip false 1h {
+			pin 2001:db8::1
+		}
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		link-local netdev eth0
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, option := range []string{"link-local netdev", "link-local skip eth0", "link-local drop"} {
+		c = caddy.NewTestController("dns", `nftables {
+		`+option+`
+	}`)
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", option, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		agent unix:///run/coredns-nftables/agent.sock 500ms
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if agentAddress != "unix:///run/coredns-nftables/agent.sock" || agentTimeout != 500*time.Millisecond {
+		t.Errorf("Expected agent unix:///run/coredns-nftables/agent.sock 500ms, but got %v %v", agentAddress, agentTimeout)
+	}
+	SetNftablesAgent("", time.Second)
+
+	c = caddy.NewTestController("dns", `nftables {
+		agent 127.0.0.1:9254 never
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	for _, config := range []string{"agent 127.0.0.1:9254", "agent 127.0.0.1:9254 1s tls", "agent 127.0.0.1:9254 tls /missing/ca.pem",
+		"agent 127.0.0.1:9254 tls ca.pem cert.pem", "agent unix:///run/agent.sock 1s 2s"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+	SetNftablesAgent("", time.Second)
+
+	c = caddy.NewTestController("dns", `nftables {
+		slo 2ms 99.9
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if sloBudget != 2*time.Millisecond || sloPercentile != 99.9 {
+		t.Errorf("Expected slo 2ms 99.9, but got %v %v", sloBudget, sloPercentile)
+	}
+	SetSlo(0, 99)
+
+	c = caddy.NewTestController("dns", `nftables {
+		slo 2ms 101
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		backend ipset
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if backendName != "ipset" {
+		t.Errorf("Expected ipset backend, but got %v", backendName)
+	}
+	SetBackend("nftables")
+
+	for _, config := range []string{"backend iptables", "backend ipset\n\t\tagent unix:///run/agent.sock"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+	SetNftablesAgent("", time.Second)
+
+	// the background jobs and the options ipset can not serve are rejected
+	for _, config := range []string{
+		"set add element filter IPV4 ip false 24h {\n\t\t\tcounter forward\n\t\t}",
+		"set add service filter HTTPS_SERVICES auto 1h",
+		"drift 30s repair",
+		"reaper 10s\n\t\tallow-destructive",
+		"set-size 1m",
+		"admin 127.0.0.1:9253",
+	} {
+		c = caddy.NewTestController("dns", "nftables ip {\n\t\tbackend ipset\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil || !strings.Contains(err.Error(), "can not be used with backend ipset") {
+			t.Fatalf("Expected errors of %v with backend ipset, but got: %v", config, err)
+		}
+		if backendName != "nftables" {
+			t.Errorf("Expected the backend reset after %v, but got %v", config, backendName)
+		}
+		SetDriftCheck(0, false)
+		SetReaper(0)
+		SetSetSizeInterval(0)
+		SetAdminAddress("")
+		SetAllowDestructive(false)
+		EnableElementTracker(false)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		log file /mnt/shared/coredns-{instance}.log 16M 5
+		log instance dns-1
+		log lock 2s
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetAppliedLog("", 0, 0)
+	SetAppliedLogInstance("")
+	SetAppliedLogLock(0)
+
+	c = caddy.NewTestController("dns", `nftables {
+		log file /mnt/shared/coredns-{instance}.log
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		log instance 42
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		log lock -1s
+	}`)
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		backend script /var/lib/coredns/nftables.nft 16M 5
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if backendName != "script" {
+		t.Errorf("Expected script backend, but got %v", backendName)
+	}
+	SetBackend("nftables")
+	SetNftScript("", 0, 0)
+
+	for _, config := range []string{"backend script", "backend script /tmp/nftables.nft 16X", "backend script /tmp/nftables.nft\n\t\tagent unix:///run/agent.sock"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+	SetNftablesAgent("", time.Second)
+	SetNftScript("", 0, 0)
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element filter VPN ip false 1h
+		canary _next {
+			add_element filter VPN ip false 1h {
+				match example.org
+			}
+			add_element ip6 filter VPN6 ip6
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	EnableElementTracker(false)
+
+	for _, config := range []string{"canary {\n\t\t}", "canary a b {\n\t\tadd_element filter VPN\n\t\t}", "canary {\n\t\tset add element filter VPN\n\t\t}",
+		"canary\n", "canary {\n\t\tadd_element filter VPN\n\t\t}\n\t\tcanary {\n\t\tadd_element filter VPN\n\t\t}"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+	EnableElementTracker(false)
+
+	c = caddy.NewTestController("dns", `nftables {
+		state file /var/lib/coredns/nftables-state.json 30s
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetStateFile("", 0)
+	EnableElementTracker(false)
+
+	for _, config := range []string{"state file", "state path /tmp/state.json", "state file /tmp/state.json 0s", "state file /tmp/state.json 1x"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		set lru redis redis://:secret@127.0.0.1:6379/2 dns: 50ms
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetLruRedis("", "", 0)
+
+	for _, config := range []string{"set lru redis 127.0.0.1", "set lru redis http://127.0.0.1:6379", "set lru redis redis://127.0.0.1/x",
+		"set lru redis 127.0.0.1:6379 dns: 0s"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		netns name vpn
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if kind, value := GetNetworkNamespace(); kind != "name" || value != "vpn" {
+		t.Fatalf("Expected netns name vpn, but got %v %v", kind, value)
+	}
+	SetNetworkNamespace("", "")
+
+	for _, config := range []string{"netns", "netns name", "netns name a/b", "netns pid 0", "netns pid x", "netns docker abc", "netns path"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+	SetNetworkNamespace("", "")
+
+	c = caddy.NewTestController("dns", `nftables {
+		set lru redis 127.0.0.1:6379
+		set lru write-behind 500ms 2000
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetLruRedis("", "", 0)
+	SetLruRedisWriteBehind(0, 0)
+
+	for _, config := range []string{"set lru write-behind", "set lru write-behind 1x", "set lru write-behind 1s 0", "set lru write-behind -1s"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		set add element filter TENANT_SET ip {
+			netns name tenant
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, config := range []string{"netns", "netns name", "netns pid 0", "netns fd 3", "netns name tenant\n\t\t\tpin 192.0.2.1"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\tset add element filter TENANT_SET ip {\n\t\t\t"+config+"\n\t\t}\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	workloadFile := filepath.Join(t.TempDir(), "workloads.txt")
+	os.WriteFile(workloadFile, []byte("class web 0x10\n10.88.0.0/16 web\n"), 0644)
+	c = caddy.NewTestController("dns", `nftables {
+		workload file `+workloadFile+` 10s
+		set add element filter WORKLOAD_SET ip {
+			workload web
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetWorkloadFile("", 0)
+
+	for _, config := range []string{"workload", "workload file", "workload path " + workloadFile, "workload file /nonexistent/workloads.txt", "workload file " + workloadFile + " 0s",
+		"set add element filter WORKLOAD_SET ip {\n\t\t\tworkload web batch\n\t\t}", "set add element filter WORKLOAD_SET ip {\n\t\t\tworkload\n\t\t\tpin 192.0.2.1\n\t\t}"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+	SetWorkloadFile("", 0)
+
+	c = caddy.NewTestController("dns", `nftables {
+		connection max-age add 30m
+		connection max-age create 10s
+		connection max-age delete 0s
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if getConnectionMaxAge(connectionOperationAdd) != 30*time.Minute || getConnectionMaxAge(connectionOperationDelete) != 0 {
+		t.Fatalf("Expected connection max age of add 30m and delete 0s, but got %v %v", getConnectionMaxAge(connectionOperationAdd), getConnectionMaxAge(connectionOperationDelete))
+	}
+	for _, operation := range []string{connectionOperationAdd, connectionOperationCreate, connectionOperationDelete} {
+		SetConnectionMaxAge(operation, -1)
+	}
+
+	for _, config := range []string{"connection max-age", "connection max-age add", "connection max-age flush 1s", "connection max-age add -1s", "connection max-age add 1x", "connection max-age add 1s 2s"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		on-error refuse
+		on-error serve ede NotReady "nftables unavailable"
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, config := range []string{"on-error", "on-error drop", "on-error serve servfail", "on-error serve ede firewall"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		userdata true
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !isElementUserdataEnabled() {
+		t.Fatalf("Expected userdata enabled")
+	}
+	SetElementUserdata(false)
+
+	for _, config := range []string{"userdata", "userdata maybe"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		sync-timeout 20ms
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if syncTimeout != 20*time.Millisecond {
+		t.Fatalf("Expected sync timeout 20ms, but got %v", syncTimeout)
+	}
+	SetNftableSyncTimeout(0)
+
+	for _, config := range []string{"sync-timeout", "sync-timeout -1ms", "sync-timeout fast"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		match-engine aho-corasick
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if domainMatchEngine != domainMatchEngineAhoCorasick {
+		t.Fatalf("Expected match engine aho-corasick, but got %v", domainMatchEngine)
+	}
+	SetDomainMatchEngine(domainMatchEngineTrie)
+
+	for _, config := range []string{"match-engine", "match-engine regex", "match-engine trie aho-corasick"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables bridge {
+		set add element filter GUEST_ALLOWED ip {
+			vlan 10 20
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, config := range []string{"set add element filter GUEST_ALLOWED ip {\n\t\t\tvlan\n\t\t}", "set add element filter GUEST_ALLOWED ip {\n\t\t\tvlan 0\n\t\t}",
+		"set add element filter GUEST_ALLOWED ip {\n\t\t\tvlan 4095\n\t\t}", "set add element filter GUEST_ALLOWED ip {\n\t\t\tvlan guest\n\t\t}",
+		"set add element filter GUEST_ALLOWED ip {\n\t\t\tvlan 10\n\t\t\tpin 192.0.2.1\n\t\t}"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		rrset-ttl true
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, config := range []string{"rrset-ttl", "rrset-ttl on off", "rrset-ttl always"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		rollout 25%
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, config := range []string{"rollout", "rollout 25", "rollout 120%", "rollout 10% 20%"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		set lru timeout ttl 1.5
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if setLruTTLFactor != 1.5 {
+		t.Fatalf("Expected lru ttl factor 1.5, but got %v", setLruTTLFactor)
+	}
+	c = caddy.NewTestController("dns", `nftables {
+		set lru timeout ttl
+	}`)
+	if err := setup(c); err != nil || setLruTTLFactor != 1 {
+		t.Fatalf("Expected lru ttl factor 1, but got %v, %v", setLruTTLFactor, err)
+	}
+	SetSetLruTTLFactor(0)
+
+	for _, config := range []string{"set lru timeout ttl 0", "set lru timeout ttl -1", "set lru timeout ttl double", "set lru timeout ttl 2 3"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+	SetSetLruTTLFactor(0)
+
+	c = caddy.NewTestController("dns", `nftables {
+		dedupe bloom size 4k fp 0.001
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if bloom, ok := sharedDedupe.current().(*nftablesBloom); !ok || bloom.size != 4096 || bloom.fp != 0.001 {
+		t.Fatalf("Expected the bloom filter of 4096 addresses with fp 0.001, but got %v", sharedDedupe.current())
+	}
+	c = caddy.NewTestController("dns", `nftables {
+		dedupe lru
+	}`)
+	if err := setup(c); err != nil || sharedDedupe.current() != sharedLru {
+		t.Fatalf("Expected the LRU selected, but got %v", err)
+	}
+
+	for _, config := range []string{"dedupe", "dedupe cuckoo", "dedupe lru 1", "dedupe bloom size", "dedupe bloom size 0", "dedupe bloom size 4x", "dedupe bloom fp 1", "dedupe bloom fp 0", "dedupe bloom count 4"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+	SetDedupeLru()
+
+	c = caddy.NewTestController("dns", `nftables {
+		health 5m
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if healthUnhealthyAfter != 5*time.Minute {
+		t.Fatalf("Expected health timeout 5m, but got %v", healthUnhealthyAfter)
+	}
+	SetHealthUnhealthyAfter(0)
+
+	for _, config := range []string{"health", "health 5", "health -1m", "health 1m 2m"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		domain-stats 24h 500
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if domainStatsRetention != 24*time.Hour || domainStats == nil {
+		t.Fatalf("Expected domain statistics kept for 24h, but got %v", domainStatsRetention)
+	}
+	SetDomainStats(0, 0)
+
+	for _, config := range []string{"domain-stats", "domain-stats 24", "domain-stats -1h", "domain-stats 1h 0", "domain-stats 1h many", "domain-stats 1h 10 20"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		connection pool-size 4
+		connection idle-timeout 30s
+		connection health-check false
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if connectionPoolSize != 4 || connectionIdleTimeout != 30*time.Second || connectionHealthCheck {
+		t.Fatalf("Expected pool size 4, idle timeout 30s and no health check, but got %v, %v, %v", connectionPoolSize, connectionIdleTimeout, connectionHealthCheck)
+	}
+	SetConnectionPoolSize(defaultConnectionPoolSize)
+	SetConnectionIdleTimeout(0)
+	SetConnectionHealthCheck(true)
+
+	c = caddy.NewTestController("dns", `nftables {
+		connection-pool-size 8
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if connectionPoolSize != 8 {
+		t.Fatalf("Expected pool size 8, but got %v", connectionPoolSize)
+	}
+	SetConnectionPoolSize(defaultConnectionPoolSize)
+
+	for _, config := range []string{"connection pool-size", "connection pool-size -1", "connection pool-size many", "connection idle-timeout 30", "connection idle-timeout -1s", "connection health-check maybe", "connection pool-size 1 2", "connection-pool-size", "connection-pool-size many"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		backend netlink
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if backendName != "netlink" {
+		t.Errorf("Expected netlink backend, but got %v", backendName)
+	}
+	if backend, _, err := openBackendIn(NftablesNetworkNamespace{}); err != nil {
+		t.Errorf("Expected the netlink backend opened, but got %v", err)
+	} else if _, ok := backend.(*NetlinkBackend); !ok {
+		t.Errorf("Expected *NetlinkBackend, but got %T", backend)
+	}
+	SetBackend("nftables")
+
+	c = caddy.NewTestController("dns", "nftables {\n\t\tbackend netlink\n\t\tagent unix:///run/agent.sock\n\t}")
+	if err := setup(c); err == nil || backendName != "nftables" {
+		t.Fatalf("Expected errors of netlink with agent, but got: %v", err)
+	}
+	SetNftablesAgent("", time.Second)
+
+	c = caddy.NewTestController("dns", `nftables {
+		backend exec-nft /usr/sbin/nft 2s 50
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if backendName != "exec-nft" || execNftPath != "/usr/sbin/nft" || execNftTimeoutDuration != 2*time.Second || execNftMinInterval != 20*time.Millisecond {
+		t.Errorf("Expected exec-nft backend of /usr/sbin/nft, but got %v %v %v %v", backendName, execNftPath, execNftTimeoutDuration, execNftMinInterval)
+	}
+	SetBackend("nftables")
+	SetExecNft("", 0, 0)
+
+	for _, config := range []string{"backend exec-nft nft 0s", "backend exec-nft nft 1s -1", "backend exec-nft nft 1s 1 2"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+	SetExecNft("", 0, 0)
+
+	// nft can not add rules or enter other network namespaces
+	for _, config := range []string{
+		"set add element filter IPV4 ip false 24h {\n\t\t\tcounter forward\n\t\t}",
+		"set add element filter TENANT_SET ip {\n\t\t\tnetns name tenant\n\t\t}",
+		"netns name vpn",
+	} {
+		c = caddy.NewTestController("dns", "nftables ip {\n\t\tbackend exec-nft\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil || !strings.Contains(err.Error(), "can not be used with backend exec-nft") {
+			t.Fatalf("Expected errors of %v with backend exec-nft, but got: %v", config, err)
+		}
+		if backendName != "nftables" {
+			t.Errorf("Expected the backend reset after %v, but got %v", config, backendName)
+		}
+		SetNetworkNamespace("", "")
+		SetExecNft("", 0, 0)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip6 inet {
+		ipv6-only true
+		set add element coredns_ipv6 IPV6_SET ip6 true 1h
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, config := range []string{"ipv6-only yes", "ipv6-only true\n\t\tfamilies-ipv4 inet", "ipv6-only true\n\t\tset add element t s ip", "set add service t s ip\n\t\tipv6-only true"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+	c = caddy.NewTestController("dns", "nftables ip {\n\t\tipv6-only true\n\t\tset add element t s\n\t}")
+	if err := setup(c); err == nil {
+		t.Fatalf("Expected errors of ip rules with ipv6-only, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		answer-diff 500 webhook https://hooks.example.org/dns journal
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if answerDiffs == nil || answerDiffWebhook != "https://hooks.example.org/dns" || !answerDiffJournal {
+		t.Errorf("Expected answer diff with webhook and journal, but got %v %v", answerDiffWebhook, answerDiffJournal)
+	}
+	SetAnswerDiff(0, "", false)
+
+	for _, config := range []string{"answer-diff", "answer-diff -1", "answer-diff 10 webhook", "answer-diff 10 webhook ftp://example.org", "answer-diff 10 syslog"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		on-missing recreate
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if missingPolicy != NftablesMissingRecreate {
+		t.Errorf("Expected missing sets recreated, but got %v", missingPolicy)
+	}
+	SetMissingPolicy(NftablesMissingResolve)
+
+	for _, config := range []string{"on-missing", "on-missing create", "on-missing resolve recreate"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		on-full grow 65536
+		allow-destructive
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if fullPolicy != NftablesFullGrow || fullGrowMaxSize != 65536 {
+		t.Errorf("Expected full sets grown up to 65536, but got %v %v", fullPolicy, fullGrowMaxSize)
+	}
+	SetFullPolicy(NftablesFullDrop, 0)
+	SetAllowDestructive(false)
+
+	for _, config := range []string{"on-full grow", "on-full evict-oldest"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v without allow-destructive, but got: %v", config, err)
+		}
+		if fullPolicy != NftablesFullDrop {
+			t.Errorf("Expected full sets dropped without allow-destructive, but got %v", fullPolicy)
+		}
+	}
+
+	for _, config := range []string{"on-full", "on-full shrink", "on-full evict-oldest 100", "on-full grow 0", "on-full grow large", "on-full grow 10 20"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		owner-comment coredns
+		flush-owned-on-shutdown true
+		allow-destructive
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if getElementOwnerComment() != "coredns" || !flushOwnedOnShutdown {
+		t.Errorf("Expected owned elements commented and flushed on shutdown, but got %q %v", getElementOwnerComment(), flushOwnedOnShutdown)
+	}
+	SetElementOwnerComment("")
+	SetFlushOwnedOnShutdown(false)
+	SetAllowDestructive(false)
+
+	for _, config := range []string{"owner-comment", "owner-comment a b", "flush-owned-on-shutdown true", "owner-comment " + strings.Repeat("a", 128), `owner-comment "core\"dns"`,
+		"flush-owned-on-shutdown", "flush-owned-on-shutdown maybe"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		flush-set-on-start true
+		set add element coredns_flush FLUSH_SET ip true 1h
+		allow-destructive
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetAllowDestructive(false)
+
+	for _, config := range []string{"flush-set-on-start", "flush-set-on-start true", "flush-set-on-start always", "flush-set-on-start true false"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		match-cache 1024
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if matchCache == nil || matchCache.Len() != 0 {
+		t.Fatalf("Expected an empty match cache, but got %v", matchCache)
+	}
+	SetMatchCache(0)
+
+	for _, config := range []string{"match-cache", "match-cache -1", "match-cache many", "match-cache 1 2"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables {
+		log compress gzip
+		log retention 168h
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if compress, retention := getAppliedLogCompression(); compress != appliedLogCompressGzip || retention != 168*time.Hour {
+		t.Fatalf("Expected gzip with 168h retention, but got %v, %v", compress, retention)
+	}
+	SetAppliedLogCompression(appliedLogCompressNone)
+	SetAppliedLogRetention(0)
+
+	for _, config := range []string{"log compress", "log compress zstd", "log compress gzip none", "log retention", "log retention -1h", "log retention forever"} {
+		c = caddy.NewTestController("dns", "nftables {\n\t\t"+config+"\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		match example.org {
+			map add element proxy PROXY_V4 12345 ip false 1h
+			journal
+			metadata vpn
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, config := range []string{"map add element proxy PROXY_V4", "map add element proxy PROXY_V4 0", "journal a b", "metadata", "metadata a b"} {
+		c = caddy.NewTestController("dns", "nftables inet {\n\t\tmatch example.org {\n\t\t\t"+config+"\n\t\t}\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		backend netlink
+		set add element filter VPN ip false 1h {
+			create-set
+			size 65536
+			dynamic
+		}
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetBackend(defaultBackendName)
+
+	for _, config := range []string{"create-set\n\t\t\tsize", "create-set\n\t\t\tsize 0", "create-set\n\t\t\tdynamic true", "size 1024", "create-set\n\t\t\tdynamic"} {
+		c = caddy.NewTestController("dns", "nftables ip {\n\t\tset add element filter VPN ip false 1h {\n\t\t\t"+config+"\n\t\t}\n\t}")
+		if err := setup(c); err == nil {
+			t.Fatalf("Expected errors of %v, but got: %v", config, err)
+		}
+	}
+
+	// reloading without allow-destructive disables the destructive features again
+	SetAllowDestructive(true)
+	c = caddy.NewTestController("dns", `nftables {
+	}`)
+	if err := setup(c); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if isDestructiveAllowed() {
+		t.Errorf("Expected allow-destructive reset when parsing")
+	}
 }
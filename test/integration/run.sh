@@ -0,0 +1,43 @@
+#!/bin/bash
+# Run the integration tests of coredns-nftables against several kernels.
+#
+#   ./run.sh          run in every vagrant machine defined in Vagrantfile
+#   ./run.sh <name>   run in one vagrant machine
+#   ./run.sh local    run on this host, requires root
+#
+# Each run prints the nftables capability report of the kernel before the test results.
+
+set -e
+
+SCRIPT_DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+REPO_DIR="$(cd "$SCRIPT_DIR/../.." && pwd)"
+TEST_COMMAND="go test -count=1 -tags integration -run Integration -v ."
+
+if [[ "$1" == "local" ]]; then
+  cd "$REPO_DIR"
+  uname -r
+  sudo -E env "PATH=$PATH" $TEST_COMMAND
+  exit $?
+fi
+
+cd "$SCRIPT_DIR"
+if [[ $# -gt 0 ]]; then
+  MACHINES=("$@")
+else
+  MACHINES=($(vagrant status --machine-readable | awk -F, '$3 == "state" { print $2 }'))
+fi
+
+FAILED=()
+for MACHINE in "${MACHINES[@]}"; do
+  echo "==================== $MACHINE ===================="
+  vagrant up "$MACHINE"
+  if ! vagrant ssh "$MACHINE" -c "uname -r && cd /coredns-nftables && sudo -E env PATH=\$PATH:/usr/local/go/bin $TEST_COMMAND"; then
+    FAILED+=("$MACHINE")
+  fi
+  vagrant halt "$MACHINE"
+done
+
+if [[ ${#FAILED[@]} -gt 0 ]]; then
+  echo "Integration tests failed on: ${FAILED[*]}"
+  exit 1
+fi